@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxAlerts is how many alerts a session keeps for followers that
+	// fall behind.
+	maxAlerts = 16
+	// bellInterval is the least time between bells passed on; more are
+	// dropped, so a program ringing in a loop can't flood clients.
+	bellInterval = time.Second
+	// maxNotificationsPerSecond bounds the notifications passed on.
+	maxNotificationsPerSecond = 4
+	maxNotificationText       = 1024
+)
+
+var alertsDropped = newCounter("dos3_terminal_alerts_dropped_total",
+	"Bells and notifications from sessions dropped for coming too fast, by type.")
+
+// alertMessage is a bell, or a desktop notification a program asked for
+// with OSC 9 (iTerm2's "9;body") or OSC 777 (urxvt's
+// "777;notify;title;body"), sent to /ws control clients and SSE clients
+// for them to show.
+type alertMessage struct {
+	Type  string `json:"type"` // "bell" or "notification"
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+// parseNotification reads the arguments of an OSC 9 or 777 sequence. OSC 9
+// with a number first is one of ConEmu's commands, such as progress
+// ("9;4;1;50"), not a notification.
+func parseNotification(num, arg string) (alertMessage, bool) {
+	m := alertMessage{Type: "notification"}
+	switch num {
+	case "9":
+		if first, _, _ := strings.Cut(arg, ";"); first != "" && strings.Trim(first, "0123456789") == "" {
+			return alertMessage{}, false
+		}
+		m.Body = arg
+	case "777":
+		rest, ok := strings.CutPrefix(arg, "notify;")
+		if !ok {
+			return alertMessage{}, false
+		}
+		m.Title, m.Body, _ = strings.Cut(rest, ";")
+	}
+	m.Title, m.Body = alertText(m.Title), alertText(m.Body)
+	return m, m.Title != "" || m.Body != ""
+}
+
+// alertText makes s valid UTF-8 and cuts it to maxNotificationText bytes.
+func alertText(s string) string {
+	s = strings.ToValidUTF8(s, "�")
+	if len(s) <= maxNotificationText {
+		return s
+	}
+	s = s[:maxNotificationText]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// addAlerts passes on the alerts the session's output raised, dropping
+// those that come too fast.
+func (s *session) addAlerts(alerts []alertMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	added := false
+	for _, a := range alerts {
+		if a.Type == "bell" {
+			if now.Sub(s.lastBell) < bellInterval {
+				alertsDropped.add(1, "type", a.Type)
+				continue
+			}
+			s.lastBell = now
+		} else {
+			if now.Sub(s.notifyWindow) >= time.Second {
+				s.notifyWindow, s.notifyCount = now, 0
+			}
+			if s.notifyCount >= maxNotificationsPerSecond {
+				alertsDropped.add(1, "type", a.Type)
+				continue
+			}
+			s.notifyCount++
+		}
+		s.alerts = append(s.alerts, a)
+		s.alertsSent++
+		added = true
+	}
+	if n := len(s.alerts) - maxAlerts; n > 0 {
+		s.alerts = append(s.alerts[:0:0], s.alerts[n:]...)
+	}
+	if added && s.alertChanged != nil {
+		close(s.alertChanged)
+		s.alertChanged = nil
+	}
+}
+
+// followAlerts sends, in the background, the alerts raised from when it is
+// called until ctx is done or the session ends.
+func (s *session) followAlerts(ctx context.Context, send func(alertMessage)) {
+	s.mu.Lock()
+	seen := s.alertsSent
+	s.mu.Unlock()
+	go s.sendAlerts(ctx, seen, send)
+}
+
+func (s *session) sendAlerts(ctx context.Context, seen int, send func(alertMessage)) {
+	for {
+		s.mu.Lock()
+		// Alerts dropped from the list before this follower saw them are
+		// skipped.
+		from := max(len(s.alerts)-(s.alertsSent-seen), 0)
+		pending := append([]alertMessage(nil), s.alerts[from:]...)
+		seen = s.alertsSent
+		if s.alertChanged == nil {
+			s.alertChanged = make(chan struct{})
+		}
+		changed := s.alertChanged
+		s.mu.Unlock()
+		for _, a := range pending {
+			send(a)
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTerminalAlerts(t *testing.T) {
+	var sc promptScanner
+	sc.feed([]byte("a\a\a\x1b]9;Build done\a\x1b]9;4;1;50\a\x1bPq\a\x1b]777;notify;CI;"))
+	sc.feed([]byte("passed\x1b\\"))
+	want := []alertMessage{{Type: "bell"}, {Type: "notification", Body: "Build done"}, {Type: "notification", Title: "CI", Body: "passed"}}
+	if got := sc.takeAlerts(); !slices.Equal(got, want) {
+		t.Fatalf("alerts = %+v, want %+v", got, want)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws?control=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	conn.WriteMessage(websocket.TextMessage, []byte(`printf '\a\a'; sleep 0.1; printf '\033]777;notify;make;done\a'`+"\n"))
+	var got []alertMessage
+	for len(got) < 2 {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("%v; alerts so far %+v", err, got)
+		}
+		var m alertMessage
+		if typ == websocket.TextMessage && json.Unmarshal(data, &m) == nil && (m.Type == "bell" || m.Type == "notification") {
+			got = append(got, m)
+		}
+	}
+	if want := []alertMessage{{Type: "bell"}, {Type: "notification", Title: "make", Body: "done"}}; !slices.Equal(got, want) {
+		t.Errorf("alert messages = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,987 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// route is one endpoint of the versioned API. The same table registers the
+// handlers and generates /v1/openapi.json, so the document can't drift from
+// what is served.
+type route struct {
+	Method  string
+	Path    string // ServeMux pattern path, e.g. /v1/files/{path...}
+	Summary string
+	Tag     string
+	Query   []queryParam
+	// Body and Result are zero values of the JSON types exchanged, or a
+	// rawBody for non-JSON payloads. A nil Result means 204 No Content.
+	Body   any
+	Result any
+	Status int
+	// Compress negotiates a compressed response (see compress), for
+	// endpoints whose responses can be large.
+	Compress bool
+	// Streaming routes run as long as their transfer or their own timeout
+	// takes; the others are bounded by request_timeout (see withTimeout).
+	Streaming bool
+	// Users routes serve requests scoped to a user (see withUser), keeping
+	// them to the user's namespace; the others refuse such requests.
+	Users bool
+	// Traffic is the kind its bytes count as in dos3_traffic_bytes_total
+	// (see routeTraffic); file for files routes and api by default.
+	Traffic string
+	// Class is the concurrency_limits class its requests count against
+	// (see limits.go); files for files routes, none by default.
+	Class string
+	// Control routes require CONTROL_TOKEN, as the operator endpoints do
+	// (see auth.go).
+	Control bool
+	// Approval is the require_approval operation the route performs, which
+	// then needs an approval's token (see approvals.go).
+	Approval string
+	// Writes routes change files under /data; they are refused while the
+	// workspace is frozen, and a freeze waits for those in flight (see
+	// freeze.go).
+	Writes  bool
+	Handler http.HandlerFunc
+}
+
+type queryParam struct {
+	Name        string
+	Type        string // OpenAPI primitive type
+	Description string
+}
+
+// rawBody marks a request or response carried as bytes, not JSON.
+type rawBody struct {
+	ContentType string
+}
+
+var octetStream = rawBody{"application/octet-stream"}
+
+var startTime = time.Now()
+
+type healthResponse struct {
+	// Status is "ok", or "degraded" with /data on local disk because the
+	// bucket couldn't be mounted, for the reason in Degraded.
+	Status     string `json:"status"`
+	Degraded   string `json:"degraded,omitempty"`
+	InstanceID string `json:"instance_id"`
+	Mounted    bool   `json:"mounted"`
+	Sessions   int    `json:"sessions"`
+	Uptime     string `json:"uptime"`
+	// WarmSessions is how many sessions wait in the warm pool to be handed
+	// to the next clients; they aren't counted in Sessions.
+	WarmSessions int `json:"warm_sessions"`
+
+	// PendingWrites and PendingWriteBytes are file API writes queued until
+	// the mount recovers: not yet durable.
+	PendingWrites     int   `json:"pending_writes"`
+	PendingWriteBytes int64 `json:"pending_write_bytes"`
+
+	// Version is the build, as served at /version.
+	Version versionInfo `json:"version"`
+
+	// Resources is the container's resource headroom, measured every 10s.
+	Resources *resourceUsage `json:"resources,omitempty"`
+	// Upstream is the last probe of the S3 endpoint, made every 30s apart
+	// from the mount; absent without a bucket.
+	Upstream *upstreamProbe `json:"upstream,omitempty"`
+}
+
+type sessionInfo struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	// User is who a session scoped to a user belongs to (see withUser).
+	User string `json:"user,omitempty"`
+	sessionMeta
+	Modes terminalModes `json:"modes"`
+	// Cols and Rows are the terminal's size as last set, after clamping to
+	// max_cols and max_rows.
+	Cols int `json:"cols"`
+	Rows int `json:"rows"`
+	// Prompt is the shell's directory and last exit code, as shell
+	// integration reports them; absent until it has.
+	Prompt *promptState `json:"prompt,omitempty"`
+	// Suspended is set while idle_suspend has the session's processes
+	// stopped.
+	Suspended bool `json:"suspended,omitempty"`
+	// InputPolicy is how input from its /ws connections is arbitrated:
+	// free, single or host (see floor.go).
+	InputPolicy string `json:"input_policy"`
+}
+
+func newSessionInfo(s *session) sessionInfo {
+	cols, rows := s.size()
+	prompt, _ := s.promptStatus()
+	return sessionInfo{ID: s.id, Created: s.created, User: s.user, sessionMeta: s.metadata(), Modes: s.terminalModes(), Cols: cols, Rows: rows, Prompt: prompt, Suspended: s.isSuspended(), InputPolicy: s.floor.currentPolicy()}
+}
+
+type sessionList struct {
+	Sessions []sessionInfo `json:"sessions"`
+}
+
+type fileList struct {
+	Entries []fileInfo `json:"entries"`
+}
+
+var sizeParams = []queryParam{
+	{"cols", "integer", "Terminal width (default 80)"},
+	{"rows", "integer", "Terminal height (default 24)"},
+	{"session_name", "string", "Display name for the session"},
+	{"tag", "string", "Session tag; may be repeated"},
+	{"meta", "string", "Session metadata as key=value; may be repeated"},
+}
+
+var diffParams = []queryParam{
+	{"a", "string", "Old file; with POST, just the name shown for the body"},
+	{"b", "string", "New file"},
+	{"context", "integer", "Lines of context around changes (default 3)"},
+}
+
+var apiRoutes = []route{
+	{Method: "GET", Path: "/v1/health", Tag: "health", Summary: "Report server and mount status",
+		Result: healthResponse{}, Users: true, Handler: handleHealth},
+	{Method: "GET", Path: "/v1/metrics", Tag: "health", Summary: "Server metrics in the Prometheus text format",
+		Result: rawBody{"text/plain"}, Handler: handleMetrics},
+	{Method: "GET", Path: "/v1/durability", Tag: "health", Summary: "Whether recent writes under /data are known to be saved to the bucket",
+		Result: durabilityStatus{}, Handler: handleDurability},
+	{Method: "GET", Path: "/v1/cache", Tag: "health", Summary: "Mount cache hit ratios and memory use",
+		Result: cacheStats{}, Handler: handleCacheStats},
+	{Method: "GET", Path: "/v1/freeze", Tag: "health", Summary: "Whether the workspace is frozen read-only",
+		Result: freezeStatus{}, Control: true, Handler: handleFreezeStatus},
+	{Method: "POST", Path: "/v1/freeze", Tag: "health", Summary: "Make the workspace read-only once the writes in flight finish and reach the bucket, for a consistent snapshot",
+		Body: freezeRequest{}, Result: freezeStatus{}, Streaming: true, Control: true, Handler: handleFreeze},
+	{Method: "POST", Path: "/v1/unfreeze", Tag: "health", Summary: "Let writes to the workspace through again",
+		Result: freezeStatus{}, Control: true, Handler: handleUnfreeze},
+	{Method: "POST", Path: "/v1/self-check", Tag: "health", Summary: "Check end to end that the mount takes writes, a shell starts on a PTY, and a session runs over a WebSocket; 503 if a check failed",
+		Result: selfCheckReport{}, Streaming: true, Control: true, Handler: handleSelfCheck},
+	{Method: "POST", Path: "/v1/shutdown", Tag: "health", Summary: "Stop the server as SIGTERM does, telling connected clients why, such as the workspace going to sleep",
+		Body: shutdownRequest{}, Result: shutdownNotice{}, Status: http.StatusAccepted, Control: true, Handler: handleShutdown},
+
+	{Method: "GET", Path: "/v1/sessions", Tag: "sessions", Summary: "List live terminal sessions",
+		Result: sessionList{}, Users: true, Handler: handleListSessions},
+	{Method: "GET", Path: "/v1/sessions/{id}", Tag: "sessions", Summary: "Describe a session",
+		Result: sessionInfo{}, Users: true, Handler: handleGetSession},
+	{Method: "GET", Path: "/v1/state/sessions", Tag: "sessions", Summary: "List sessions past and present from the state database, newest first",
+		Query:  stateParams("user", "Only this user's sessions"),
+		Result: sessionRecords{}, Handler: handleStateSessions},
+	{Method: "PATCH", Path: "/v1/sessions/{id}", Tag: "sessions", Summary: "Update a session's name, tags, or metadata",
+		Body: sessionMetaPatch{}, Result: sessionInfo{}, Users: true, Handler: handleUpdateSession},
+	{Method: "DELETE", Path: "/v1/sessions/{id}", Tag: "sessions", Summary: "Close a session",
+		Users: true, Handler: handleCloseSession},
+	{Method: "POST", Path: "/v1/sessions/{id}/input", Tag: "sessions", Summary: "Write raw bytes to a session's PTY",
+		Query: []queryParam{
+			{"seq", "integer", "Sequence number, from 1, of this input in the client's sequence; input already applied is dropped"},
+			{"client", "string", "Client ID naming the sequence"},
+		},
+		Body: octetStream, Users: true, Traffic: trafficTerminal, Handler: handleSessionInput},
+	{Method: "POST", Path: "/v1/sessions/{id}/resize", Tag: "sessions", Summary: "Resize a session's PTY",
+		Body: resizeMessage{}, Users: true, Handler: handleSessionResize},
+	{Method: "POST", Path: "/v1/sessions/{id}/key", Tag: "sessions", Summary: "Send Ctrl-C, Ctrl-D or Ctrl-Z to a session's foreground program",
+		Body: keyMessage{}, Users: true, Handler: handleSessionKey},
+	{Method: "POST", Path: "/v1/sessions/{id}/paste", Tag: "sessions", Summary: "Save a pasted file under /data/pastes and type its path into the session",
+		Query: []queryParam{{"name", "string", "Original file name, used for the extension"}},
+		Body:  octetStream, Result: fileInfo{}, Status: http.StatusCreated, Streaming: true, Traffic: trafficFile, Writes: true, Handler: handleSessionPaste},
+	{Method: "GET", Path: "/v1/sessions/{id}/transcript", Tag: "sessions", Summary: "Plain-text transcript of a session, without escape codes",
+		Query:  []queryParam{{"download", "boolean", "Serve as an attachment"}},
+		Result: rawBody{"text/plain"}, Compress: true, Users: true, Handler: handleSessionTranscript},
+	{Method: "GET", Path: "/v1/sessions/{id}/history", Tag: "sessions", Summary: "Commands the session's shell ran, with their times and exit codes",
+		Query:  []queryParam{{"failed", "boolean", "Only commands that exited non-zero"}},
+		Result: commandHistory{}, Users: true, Handler: handleSessionHistory},
+	{Method: "GET", Path: "/v1/sessions/{id}/screen", Tag: "sessions", Summary: "The session's screen as a terminal would show it, optionally once it contains some text",
+		Query: []queryParam{{"contains", "string", "Wait for this text to be on the screen"},
+			{"timeout", "string", "How long to wait for ?contains=, up to 25s (default 10s)"}},
+		Result: screenSnapshot{}, Users: true, Handler: handleSessionScreen},
+	{Method: "GET", Path: "/v1/sessions/{id}/search", Tag: "sessions", Summary: "Find text in the session's transcript, returning where each match is",
+		Query: []queryParam{{"q", "string", "Text to find"},
+			{"regex", "boolean", "Treat q as a Go regular expression"},
+			{"ignore_case", "boolean", "Match regardless of case"},
+			{"limit", "integer", "Most matches to return, oldest first (default 100, at most 1000)"}},
+		Result: searchResults{}, Users: true, Handler: handleSessionSearch},
+	{Method: "POST", Path: "/v1/sessions/{id}/shares", Tag: "sessions", Summary: "Make a link that attaches someone else to the session, observing or typing, until it expires",
+		Body: shareRequest{}, Result: shareInfo{}, Status: http.StatusCreated, Users: true, Handler: handleCreateShare},
+	{Method: "GET", Path: "/v1/sessions/{id}/shares", Tag: "sessions", Summary: "List the session's live share links, without their tokens",
+		Result: shareList{}, Users: true, Handler: handleListShares},
+	{Method: "DELETE", Path: "/v1/sessions/{id}/shares/{share}", Tag: "sessions", Summary: "Revoke a share link, disconnecting whoever it let in",
+		Users: true, Handler: handleRevokeShare},
+	{Method: "GET", Path: "/v1/sessions/{id}/input-policy", Tag: "sessions", Summary: "Who may type into the session over /ws, and who has control",
+		Result: inputControlMessage{}, Users: true, Handler: handleGetInputPolicy},
+	{Method: "PUT", Path: "/v1/sessions/{id}/input-policy", Tag: "sessions", Summary: "Set how input from the session's /ws connections is arbitrated: free, single or host",
+		Body: inputPolicyRequest{}, Result: inputControlMessage{}, Users: true, Handler: handleSetInputPolicy},
+	{Method: "POST", Path: "/v1/sessions/{id}/notify", Tag: "sessions", Summary: "POST to notify_url when the running command, or the next, finishes",
+		Body: notifyRequest{}, Result: notifyPending{}, Status: http.StatusAccepted, Users: true, Handler: handleSessionNotify},
+	{Method: "POST", Path: "/v1/sessions/{id}/inject", Tag: "sessions", Summary: "Type data or a command into a session on automation's behalf, recorded in its audit trail",
+		Body: injectRequest{}, Result: injectionRecord{}, Control: true, Traffic: trafficTerminal, Handler: handleSessionInject},
+	{Method: "GET", Path: "/v1/sessions/{id}/injections", Tag: "sessions", Summary: "The audit trail of input injected into a session",
+		Result: injectionLog{}, Users: true, Handler: handleSessionInjections},
+	{Method: "POST", Path: "/v1/handoff", Tag: "sessions", Summary: "Save the live sessions to the bucket for the container replacing this one to recreate",
+		Result: handoffResult{}, Handler: handleHandoff},
+	{Method: "GET", Path: "/v1/sse", Tag: "sessions", Summary: "Start a session streamed as Server-Sent Events",
+		Query: sizeParams, Result: rawBody{"text/event-stream"}, Streaming: true, Users: true, Traffic: trafficTerminal, Handler: handleSSE},
+	{Method: "POST", Path: "/v1/poll", Tag: "sessions", Summary: "Start a long-poll session",
+		Query: sizeParams, Result: pollResponse{}, Status: http.StatusCreated, Users: true, Traffic: trafficTerminal, Handler: handlePollStart},
+	{Method: "GET", Path: "/v1/poll/{id}", Tag: "sessions", Summary: "Wait for output after seq",
+		Query: []queryParam{{"seq", "integer", "Offset to read from"}}, Result: pollResponse{}, Streaming: true, Users: true, Traffic: trafficTerminal, Handler: handlePoll},
+	{Method: "DELETE", Path: "/v1/poll/{id}", Tag: "sessions", Summary: "Close a long-poll session",
+		Users: true, Traffic: trafficTerminal, Handler: handlePollClose},
+
+	{Method: "GET", Path: "/v1/packages", Tag: "exec", Summary: "The apt, pip and npm packages recorded in /data/.packages.json to reinstall at boot",
+		Result: packageManifest{}, Handler: handleGetPackages},
+	{Method: "POST", Path: "/v1/packages", Tag: "exec", Summary: "Record the packages installed since the image in /data/.packages.json",
+		Result: packageManifest{}, Writes: true, Handler: handleRecordPackages},
+	{Method: "POST", Path: "/v1/packages/restore", Tag: "exec", Summary: "Start a job reinstalling the recorded packages that are missing",
+		Result: jobInfo{}, Status: http.StatusAccepted, Writes: true, Handler: handleRestorePackages},
+	{Method: "GET", Path: "/v1/motd", Tag: "sessions", Summary: "The message of the day new sessions are shown, rendered from /data/.motd",
+		Result: rawBody{"text/plain"}, Users: true, Handler: handleMOTD},
+	{Method: "GET", Path: "/v1/env", Tag: "sessions", Summary: "List the environment variables persisted in /data/.env for new sessions",
+		Result: envVars{}, Users: true, Handler: handleGetEnv},
+	{Method: "PATCH", Path: "/v1/env", Tag: "sessions", Summary: "Persist environment variables for new sessions; null stops persisting one",
+		Body: envVars{}, Result: envVars{}, Users: true, Approval: approvalEnv, Writes: true, Handler: handlePatchEnv},
+
+	{Method: "POST", Path: "/v1/approvals", Tag: "sessions", Summary: "Ask the control clients attached to your sessions to approve an operation gated by require_approval",
+		Body: approvalRequest{}, Result: approval{}, Status: http.StatusAccepted, Users: true, Handler: handleRequestApproval},
+	{Method: "GET", Path: "/v1/approvals/{id}", Tag: "sessions", Summary: "Report an approval request, with its token once approved",
+		Result: approval{}, Users: true, Handler: handleGetApproval},
+
+	{Method: "GET", Path: "/v1/clipboard", Tag: "clipboard", Summary: "Read the workspace clipboard",
+		Result: rawBody{"text/plain"}, Handler: handleGetClipboard},
+	{Method: "POST", Path: "/v1/clipboard", Tag: "clipboard", Summary: "Replace the workspace clipboard",
+		Body: rawBody{"text/plain"}, Handler: handleSetClipboard},
+
+	{Method: "GET", Path: "/v1/services", Tag: "services", Summary: "List supervised services; attach a terminal with /ws?service={name}",
+		Result: serviceList{}, Handler: handleListServices},
+	{Method: "GET", Path: "/v1/services/{name}", Tag: "services", Summary: "Describe a service",
+		Result: serviceInfo{}, Handler: handleGetService},
+	{Method: "POST", Path: "/v1/services/{name}/restart", Tag: "services", Summary: "Restart a service now",
+		Handler: handleRestartService},
+	{Method: "GET", Path: "/v1/workspace", Tag: "services", Summary: "Report the workspace file in effect, its named ports and its mounts",
+		Result: workspaceStatus{}, Handler: handleGetWorkspace},
+	{Method: "POST", Path: "/v1/workspace/reload", Tag: "services", Summary: "Read the workspace file again, starting and stopping its services",
+		Result: workspaceStatus{}, Handler: handleReloadWorkspace},
+
+	{Method: "POST", Path: "/v1/ide", Tag: "ide", Summary: "Start the browser IDE (code-server) and wait until it is ready",
+		Result: ideStatus{}, Streaming: true, Handler: handleStartIDE},
+	{Method: "GET", Path: "/v1/ide", Tag: "ide", Summary: "Report the browser IDE's status",
+		Result: ideStatus{}, Handler: handleIDEStatus},
+	{Method: "DELETE", Path: "/v1/ide", Tag: "ide", Summary: "Stop the browser IDE",
+		Handler: handleStopIDE},
+
+	{Method: "POST", Path: "/v1/exec", Tag: "exec", Summary: "Run a command to completion without a PTY",
+		Body: execRequest{}, Result: execResponse{}, Streaming: true, Users: true, Handler: handleExec},
+	{Method: "POST", Path: "/v1/jobs", Tag: "exec", Summary: "Run a command in the background as a job, kept under /data/.jobs, whose output outlives the request",
+		Body: execRequest{}, Result: jobInfo{}, Status: http.StatusAccepted, Writes: true, Handler: handleStartJob},
+	{Method: "POST", Path: "/v1/jobs/export", Tag: "exec", Summary: "Copy the workspace, or a path in it, to another S3-compatible bucket as a job reporting its progress",
+		Body: exportRequest{}, Result: jobInfo{}, Status: http.StatusAccepted, Writes: true, Handler: handleStartExport},
+	{Method: "POST", Path: "/v1/jobs/import", Tag: "exec", Summary: "Copy the objects in another S3-compatible bucket, or a list of URLs, into the workspace as a job whose output is a manifest of the results",
+		Body: importRequest{}, Result: jobInfo{}, Status: http.StatusAccepted, Writes: true, Handler: handleStartImport},
+	{Method: "GET", Path: "/v1/jobs", Tag: "exec", Summary: "List jobs, oldest first",
+		Result: jobList{}, Handler: handleListJobs},
+	{Method: "GET", Path: "/v1/state/jobs", Tag: "exec", Summary: "List jobs from the state database, newest first, including removed ones",
+		Query:  stateParams("state", "Only jobs in this state"),
+		Result: jobRecords{}, Handler: handleStateJobs},
+	{Method: "GET", Path: "/v1/timeline", Tag: "sessions", Summary: "What happened in the workspace, newest first: sessions, commands, file changes and snapshots",
+		Query: append(stateParams("user", "Only this user's sessions and commands"),
+			queryParam{"until", "string", "Only those before this RFC 3339 time"},
+			queryParam{"kind", "string", "session, command, file or snapshot; may be repeated"},
+			queryParam{"session", "string", "Only this session's entries"}),
+		Result: timelineEntries{}, Handler: handleTimeline},
+	{Method: "GET", Path: "/v1/jobs/{id}", Tag: "exec", Summary: "Report a job's state",
+		Result: jobInfo{}, Handler: handleGetJob},
+	{Method: "GET", Path: "/v1/jobs/{id}/output", Tag: "exec", Summary: "Read a job's output, or follow it until the job ends",
+		Query: []queryParam{
+			{"stream", "string", "stdout (the default) or stderr"},
+			{"follow", "boolean", "Stream output as it is written until the job ends"},
+			{"offset", "integer", "With follow, the byte to start from"},
+		},
+		Result: octetStream, Streaming: true, Handler: handleJobOutput},
+	{Method: "POST", Path: "/v1/jobs/{id}/cancel", Tag: "exec", Summary: "Kill a running job",
+		Result: jobInfo{}, Handler: handleCancelJob},
+	{Method: "DELETE", Path: "/v1/jobs/{id}", Tag: "exec", Summary: "Remove a finished job and its output",
+		Writes: true, Handler: handleRemoveJob},
+
+	{Method: "GET", Path: "/v1/files/{path...}", Tag: "files", Summary: "Download a file, or list a directory as JSON",
+		Query: []queryParam{
+			{"stat", "boolean", "Return the file's metadata instead of its contents"},
+			{"versions", "boolean", "List the versions the bucket keeps of the file, as a FileVersionList"},
+			{"checksum", "string", "Return the file's checksum, as a FileChecksum, by this algorithm: sha256, sha512, sha1 or md5"},
+		},
+		Result: octetStream, Compress: true, Streaming: true, Users: true, Handler: handleGetFile},
+	{Method: "PUT", Path: "/v1/files/{path...}", Tag: "files", Summary: "Upload a file, creating parent directories",
+		Query: []queryParam{{"mode", "string", "Octal permission bits (default 0644)"}},
+		Body:  octetStream, Result: fileInfo{}, Streaming: true, Users: true, Writes: true, Handler: handlePutFile},
+	{Method: "POST", Path: "/v1/files:batch", Tag: "files", Summary: "Move, copy, delete and create files in one request, undoing them all if one fails",
+		Body: batchRequest{}, Result: batchResponse{}, Users: true, Writes: true, Handler: handleFileBatch},
+	{Method: "POST", Path: "/v1/files:restore", Tag: "files", Summary: "Restore a file to a version listed by ?versions=1",
+		Body: restoreRequest{}, Result: fileInfo{}, Streaming: true, Approval: approvalRestore, Writes: true, Handler: handleFileRestore},
+	{Method: "GET", Path: "/v1/uploads", Tag: "files", Summary: "List multipart uploads in progress",
+		Result: uploadList{}, Handler: handleListUploads},
+	{Method: "POST", Path: "/v1/uploads", Tag: "files", Summary: "Start a multipart upload straight to the bucket, for files too large to send in one request",
+		Body: uploadRequest{}, Result: uploadInfo{}, Status: http.StatusCreated, Writes: true, Handler: handleStartUpload},
+	{Method: "GET", Path: "/v1/uploads/{id}", Tag: "files", Summary: "Report a multipart upload and the parts it has",
+		Result: uploadInfo{}, Handler: handleGetUpload},
+	{Method: "PATCH", Path: "/v1/uploads/{id}", Tag: "files", Summary: "Append a chunk at the Upload-Offset header's offset, which must be where the upload is; answers with the new Upload-Offset",
+		Body: octetStream, Streaming: true, Writes: true, Handler: handlePatchUpload},
+	{Method: "PUT", Path: "/v1/uploads/{id}/{part}", Tag: "files", Summary: "Upload a part, numbered from 1; parts may be sent in parallel and again",
+		Body: octetStream, Result: uploadedPart{}, Streaming: true, Writes: true, Handler: handleUploadPart},
+	{Method: "POST", Path: "/v1/uploads/{id}/complete", Tag: "files", Summary: "Assemble the parts into the file",
+		Result: fileInfo{}, Streaming: true, Writes: true, Handler: handleCompleteUpload},
+	{Method: "DELETE", Path: "/v1/uploads/{id}", Tag: "files", Summary: "Abort a multipart upload",
+		Writes: true, Handler: handleAbortUpload},
+	{Method: "GET", Path: "/v1/trash", Tag: "files", Summary: "List files deleted through the file API, oldest first",
+		Result: trashList{}, Handler: handleListTrash},
+	{Method: "POST", Path: "/v1/trash/{id}/restore", Tag: "files", Summary: "Move a deleted file back to where it was, or to ?to=",
+		Query:  []queryParam{{"to", "string", "Restore to this path instead"}},
+		Result: fileInfo{}, Approval: approvalRestore, Writes: true, Handler: handleRestoreTrash},
+	{Method: "DELETE", Path: "/v1/trash/{id}", Tag: "files", Summary: "Remove a deleted file for good",
+		Approval: approvalPurge, Writes: true, Handler: handlePurgeTrash},
+	{Method: "POST", Path: "/v1/manifest", Tag: "files", Summary: "Write the workspace manifest to the bucket now",
+		Result: manifestResult{}, Class: classBulk, Handler: handleWriteManifest},
+	{Method: "POST", Path: "/v1/replace", Tag: "files", Summary: "Regex find-and-replace across files matching a glob, or a dry run of it",
+		Body: replaceRequest{}, Result: replaceResponse{}, Compress: true, Class: classSearch, Writes: true, Handler: handleReplace},
+	{Method: "GET", Path: "/v1/diff", Tag: "files", Summary: "Unified diff of two files",
+		Query:  diffParams,
+		Result: rawBody{"text/x-diff"}, Compress: true, Handler: handleDiff},
+	{Method: "POST", Path: "/v1/diff", Tag: "files", Summary: "Unified diff of a previous version, sent as the body, against a file",
+		Query: diffParams,
+		Body:  octetStream, Result: rawBody{"text/x-diff"}, Compress: true, Handler: handleDiff},
+	{Method: "GET", Path: "/v1/locks", Tag: "files", Summary: "List the advisory file locks held",
+		Result: lockList{}, Handler: handleListLocks},
+	{Method: "POST", Path: "/v1/locks", Tag: "files", Summary: "Acquire or renew an advisory lock on a path, held until its TTL runs out or it is released",
+		Body: lockRequest{}, Result: lockInfo{}, Handler: handleAcquireLock},
+	{Method: "DELETE", Path: "/v1/locks/{path...}", Tag: "files", Summary: "Release an advisory lock",
+		Query:   []queryParam{{"token", "string", "The token returned when the lock was acquired"}},
+		Handler: handleReleaseLock},
+	{Method: "POST", Path: "/v1/publish", Tag: "files", Summary: "Copy a file or directory to the bucket's public prefix and return its URL",
+		Body: publishRequest{}, Result: publishResult{}, Streaming: true, Handler: handlePublish},
+	{Method: "DELETE", Path: "/v1/files/{path...}", Tag: "files", Summary: "Move a file or directory to the trash",
+		Query: []queryParam{{"recursive", "boolean", "Delete directories with their contents"}},
+		Users: true, Writes: true, Handler: handleDeleteFile},
+}
+
+// registerAPI adds apiRoutes to mux, along with the OpenAPI document
+// describing them.
+func registerAPI(mux *http.ServeMux) {
+	routes := append(apiRoutes, route{
+		Method: "GET", Path: "/v1/openapi.json", Tag: "health", Summary: "This document",
+		Result: rawBody{"application/json"}, Users: true,
+	})
+	routes[len(routes)-1].Handler = openAPIHandler(routes)
+	for _, rt := range routes {
+		h := rt.Handler
+		if rt.Writes {
+			h = refuseWhenFrozen(h)
+		}
+		if rt.Compress {
+			h = compress(h)
+		}
+		if class := routeClass(rt); class != "" {
+			h = limitConcurrency(class, h)
+		}
+		if !rt.Streaming {
+			h = withTimeout(h)
+		}
+		if rt.Approval != "" {
+			h = requireApproval(rt.Approval, h)
+		}
+		if !rt.Users {
+			h = unscopedOnly(h)
+		}
+		if rt.Control {
+			h = requireControlToken(h)
+		}
+		// Outermost, so compressed responses count as sent.
+		h = meterHTTP(rt.Method+" "+rt.Path, routeTraffic(rt), h)
+		mux.HandleFunc(rt.Method+" "+rt.Path, h)
+	}
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	pending, pendingBytes := writes.depth()
+	status, reason := "ok", degraded.status()
+	if reason != "" {
+		status = "degraded"
+	}
+	writeJSON(w, http.StatusOK, healthResponse{
+		Status:            status,
+		Degraded:          reason,
+		InstanceID:        os.Getenv("CLOUDFLARE_DURABLE_OBJECT_ID"),
+		Mounted:           mountReady.Load(),
+		PendingWrites:     pending,
+		PendingWriteBytes: pendingBytes,
+		Sessions:          len(sessions.list()),
+		WarmSessions:      sessions.warmCount(),
+		Uptime:            time.Since(startTime).Round(time.Second).String(),
+		Version:           buildVersion,
+		Resources:         currentResources(),
+		Upstream:          lastUpstream.Load(),
+	})
+}
+
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	list := sessionList{Sessions: []sessionInfo{}}
+	for _, s := range sessions.list() {
+		if !ownsSession(r, s) {
+			continue
+		}
+		list.Sessions = append(list.Sessions, newSessionInfo(s))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleGetSession(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, newSessionInfo(sess))
+}
+
+func handleUpdateSession(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	var patch sessionMetaPatch
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&patch); err != nil {
+		httpError(w, r, "invalid session update: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := sess.updateMetadata(patch); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSessionInfo(sess))
+}
+
+func handleCloseSession(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	sess.close()
+	// Answer once the shell has gone, so the session is no longer listed.
+	select {
+	case <-sess.done:
+	case <-r.Context().Done():
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionFromPath looks up the session named by the {id} path wildcard,
+// writing a 404 if it doesn't exist.
+func sessionFromPath(w http.ResponseWriter, r *http.Request) *session {
+	sess := sessions.get(r.PathValue("id"))
+	if sess != nil && !ownsSession(r, sess) {
+		sess = nil
+	}
+	if sess == nil {
+		writeError(w, r, errSessionNotFound)
+	}
+	return sess
+}
+
+// handleSessionInput writes the raw request body to a session's PTY.
+func handleSessionInput(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	var seq int64
+	if v := r.URL.Query().Get("seq"); v != "" {
+		var err error
+		if seq, err = strconv.ParseInt(v, 10, 64); err != nil || seq < 1 {
+			httpError(w, r, fmt.Sprintf("invalid seq=%q: must be a positive integer", v), http.StatusBadRequest)
+			return
+		}
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxInputBody))
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	// A retried request whose input was already applied succeeds without
+	// applying it again.
+	if seq > 0 && !sess.dedup.fresh(r.URL.Query().Get("client"), seq) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := sess.write(data); err != nil {
+		writeProblem(w, r, http.StatusGone, err)
+		return
+	}
+	sess.meterTraffic(trafficTerminal, "in", len(data))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSessionResize applies a {"cols": n, "rows": n} body to a session.
+func handleSessionResize(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	var resize resizeMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxInputBody)).Decode(&resize); err != nil {
+		httpError(w, r, fmt.Sprintf("invalid JSON body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := sess.resize(resize.Cols, resize.Rows); err != nil {
+		status := http.StatusGone
+		if errors.Is(err, errInvalidSize) {
+			status = http.StatusBadRequest
+		}
+		writeProblem(w, r, status, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type keyMessage struct {
+	// Key is "interrupt" (SIGINT to the foreground process group), "eof"
+	// or "suspend" (SIGTSTP).
+	Key string `json:"key"`
+}
+
+// handleSessionKey sends a {"key": "interrupt"} body's control key.
+func handleSessionKey(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	var msg keyMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxInputBody)).Decode(&msg); err != nil {
+		httpError(w, r, fmt.Sprintf("invalid JSON body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := sess.key(msg.Key); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// httpStatus maps the server's errors onto HTTP status codes, mirroring
+// grpcError.
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, errSessionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrExist):
+		return http.StatusConflict
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, errOutsideData), errors.Is(err, errEmptyCommand), errors.Is(err, errIsDir),
+		errors.Is(err, exec.ErrNotFound), errors.Is(err, errInvalidMetadata), errors.Is(err, errInvalidSize),
+		errors.Is(err, errUnknownKey), errors.Is(err, errInvalidBatch),
+		errors.Is(err, errInvalidReplace), errors.Is(err, errInvalidRestore), errors.Is(err, errInvalidUpload),
+		errors.Is(err, errInvalidChecksum), errors.Is(err, errInvalidPublish), errors.Is(err, errInvalidEnv), errors.Is(err, errInvalidLock),
+		errors.Is(err, errInvalidNotify), errors.Is(err, errInvalidExport), errors.Is(err, errInvalidImport),
+		errors.Is(err, errInvalidInjection), errors.Is(err, errInvalidApproval), errors.Is(err, errInvalidStateQuery), errors.Is(err, errInvalidShare),
+		errors.Is(err, errInvalidSearch), errors.Is(err, errInvalidInputPolicy), errors.Is(err, errInvalidMOTD), errors.Is(err, errInvalidFreeze), errors.Is(err, errInvalidShutdown),
+		errors.Is(err, errInvalidWorkspaceFile):
+		return http.StatusBadRequest
+	case errors.Is(err, errPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errFileTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errJournalFull):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, errVersioningUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, errApprovalRequired):
+		return http.StatusPreconditionRequired
+	case errors.Is(err, errNoBucket), errors.Is(err, errNoNotifyURL), errors.Is(err, errNoApprover):
+		return http.StatusConflict
+	case errors.Is(err, errUserScope), errors.Is(err, errPathNotGranted):
+		return http.StatusForbidden
+	case errors.Is(err, errTooManySessions), errors.Is(err, errUpgrading), errors.Is(err, errNoState):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, errSessionClosed), errors.Is(err, errJobRunning), errors.Is(err, errLocked), errors.Is(err, errUploadOffset),
+		errors.Is(err, errNameConflict), errors.Is(err, errFrozen):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// writeError answers with err as a problem, named by the error where it's
+// one of the server's own.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := httpStatus(err)
+	writeProblem(w, r, status, err)
+}
+
+// maxExecOutput bounds how much of each stream /v1/exec buffers; clients that
+// need more should use the streaming gRPC Exec.
+const maxExecOutput = 1 << 20
+
+type execResponse struct {
+	ExitCode  int    `json:"exit_code"`
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// cappedBuffer keeps the first max bytes written and discards the rest.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func handleExec(w http.ResponseWriter, r *http.Request) {
+	var req execRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&req); err != nil {
+		httpError(w, r, "invalid exec request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if user := userFromContext(r.Context()); user != "" {
+		if err := scopeExec(r, user, &req); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	stdout := &cappedBuffer{max: maxExecOutput}
+	stderr := &cappedBuffer{max: maxExecOutput}
+	code, err := runExec(r.Context(), req, stdout, stderr)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		// The command never ran; a timeout is reported in the response.
+		writeError(w, r, err)
+		return
+	}
+	resp := execResponse{
+		ExitCode:  code,
+		Stdout:    stdout.buf.String(),
+		Stderr:    stderr.buf.String(),
+		Truncated: stdout.truncated || stderr.truncated,
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// fileETag identifies a version of a file by the size and modification time
+// the mount reports, which change with every upload. It is strong, for
+// If-Match and byte ranges; a compressed download carries it weakened (see
+// compressWriter), as its bytes differ.
+func fileETag(fi fileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.Size, fi.ModTime.UnixNano())
+}
+
+// etagMatch reports whether an If-None-Match header lists etag, comparing
+// weakly as RFC 9110 requires for GET.
+func etagMatch(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatchStrong reports whether an If-Match header lists etag, comparing
+// strongly as RFC 9110 requires: a weak tag never matches.
+func etagMatchStrong(header, etag string) bool {
+	if strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// errPreconditionFailed answers a write whose If-Match or If-None-Match
+// doesn't hold.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// conditionalWrites serializes the commits of writes to the same path made
+// with If-Match or If-None-Match, so two of them can't both pass the check
+// before either writes.
+var conditionalWrites = &pathLocks{locks: map[string]*pathLock{}}
+
+// pathLocks holds a mutex for each path in use.
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks p, returning the function that unlocks it.
+func (l *pathLocks) lock(p string) func() {
+	l.mu.Lock()
+	pl := l.locks[p]
+	if pl == nil {
+		pl = &pathLock{}
+		l.locks[p] = pl
+	}
+	pl.refs++
+	l.mu.Unlock()
+	pl.Lock()
+	return func() {
+		pl.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if pl.refs--; pl.refs == 0 {
+			delete(l.locks, p)
+		}
+	}
+}
+
+// checkWritePreconditions refuses a write to p whose If-Match lists
+// neither the file's ETag, as downloads carry it, nor the ETag of the
+// object behind it in the bucket, or whose If-None-Match lists the file's
+// (or is "*" and the file exists).
+func checkWritePreconditions(r *http.Request, p string) error {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+	fi, err := statPath(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		if ifMatch != "" {
+			return fmt.Errorf("%w: If-Match: %s does not exist", errPreconditionFailed, unscopePath(r, relPathOf(p)))
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	etag := fileETag(fi)
+	if ifMatch != "" && !etagMatchStrong(ifMatch, etag) && !objectETagMatch(ifMatch, p, fi) {
+		return fmt.Errorf("%w: If-Match: %s has changed; its ETag is now %s", errPreconditionFailed, unscopePath(r, fi.Path), etag)
+	}
+	if ifNoneMatch != "" && etagMatch(ifNoneMatch, etag) {
+		return fmt.Errorf("%w: If-None-Match: %s exists", errPreconditionFailed, unscopePath(r, fi.Path))
+	}
+	return nil
+}
+
+// writeConditionally runs write, a write to p, committing it once the
+// request's preconditions hold. The body is staged before that, so only the
+// check and the commit hold up other conditional writes to p.
+func writeConditionally[T any](r *http.Request, p string, write func(commitFunc) (T, error)) (T, error) {
+	if r.Header.Get("If-Match") == "" && r.Header.Get("If-None-Match") == "" {
+		return write(commitNow)
+	}
+	return write(func(step func() error) error {
+		unlock := conditionalWrites.lock(p)
+		defer unlock()
+		if err := checkWritePreconditions(r, p); err != nil {
+			return err
+		}
+		return step()
+	})
+}
+
+// objectETagMatch reports whether header lists the ETag of the object
+// behind the file at p, if the bucket has caught up with the file.
+func objectETagMatch(header, p string, fi fileInfo) bool {
+	full, err := resolvePath(p)
+	if err != nil || fi.Queued || durability.unsaved(fi.ModTime) {
+		return false
+	}
+	etag := objectETag(full)
+	return etag != "" && etagMatchStrong(header, `"`+etag+`"`)
+}
+
+// relPathOf is p relative to /data, for messages.
+func relPathOf(p string) string {
+	if full, err := resolvePath(p); err == nil {
+		return relPath(full)
+	}
+	return p
+}
+
+// writeJSONETag is writeJSON for a 200 response that clients poll: it is
+// tagged with a hash of its body, and a request already holding that
+// version gets 304 Not Modified instead.
+func writeJSONETag(w http.ResponseWriter, r *http.Request, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := fmt.Sprintf(`W/"%x"`, sum[:12])
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+// handleGetFile serves a file, its metadata or a directory listing. Each is
+// tagged with an ETag, and files with Last-Modified, so that polling
+// clients can revalidate with If-None-Match or If-Modified-Since and get
+// 304 Not Modified while nothing changed.
+func handleGetFile(w http.ResponseWriter, r *http.Request) {
+	p, err := scopePath(r, r.PathValue("path"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// The transfer may take as long as it takes, but the mount has to answer
+	// within request_timeout.
+	ctx, cancel := mountContext(r)
+	defer cancel()
+	if r.URL.Query().Get("versions") != "" {
+		list, err := listVersions(ctx, p)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		list.Path = unscopePath(r, list.Path)
+		writeJSONETag(w, r, list)
+		return
+	}
+	if alg := r.URL.Query().Get("checksum"); alg != "" {
+		// Reading the whole file may take longer than request_timeout;
+		// give up when the client does.
+		sum, err := fsCall(r.Context(), func() (fileChecksum, error) { return checksumFile(p, alg) })
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		sum.Path = unscopePath(r, sum.Path)
+		writeJSONETag(w, r, sum)
+		return
+	}
+	if r.URL.Query().Get("stat") != "" {
+		fi, err := fsCall(ctx, func() (fileInfo, error) { return statPath(p) })
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		fi.Path = unscopePath(r, fi.Path)
+		writeJSONETag(w, r, fi)
+		return
+	}
+	of, err := fsCall(ctx, func() (openedFile, error) {
+		f, fi, err := openFile(p)
+		return openedFile{f, fi}, err
+	})
+	if errors.Is(err, errIsDir) {
+		entries, err := fsCall(ctx, func() ([]fileInfo, error) { return listDir(p) })
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		for i := range entries {
+			entries[i].Path = unscopePath(r, entries[i].Path)
+		}
+		writeJSONETag(w, r, fileList{Entries: entries})
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	f, fi := of.File, of.info
+	defer f.Close()
+	if cf, _ := fsCall(ctx, func() (*os.File, error) { return content.open(f, fi), nil }); cf != nil {
+		defer cf.Close()
+		f = cf
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", fileETag(fi))
+	// Cacheable, but revalidated on every use: the file may change at any
+	// time.
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, fi.Name, fi.ModTime, f)
+}
+
+func handlePutFile(w http.ResponseWriter, r *http.Request) {
+	mode := fs.FileMode(0644)
+	if m := r.URL.Query().Get("mode"); m != "" {
+		v, err := strconv.ParseUint(m, 8, 32)
+		if err != nil {
+			httpError(w, r, "invalid mode", http.StatusBadRequest)
+			return
+		}
+		mode = fs.FileMode(v).Perm()
+	}
+	p, err := scopePath(r, r.PathValue("path"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// Uploads aren't bounded by request_timeout, but give up when the client
+	// does.
+	fi, err := fsCall(r.Context(), func() (fileInfo, error) {
+		return writeConditionally(r, p, func(commit commitFunc) (fileInfo, error) {
+			if useDirectUpload(r) {
+				return putDirect(r.Context(), p, r.Body, commit)
+			}
+			return writeFileCommit(p, r.Body, mode, commit)
+		})
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	fi.Path = unscopePath(r, fi.Path)
+	w.Header().Set("ETag", fileETag(fi))
+	writeJSON(w, http.StatusOK, fi)
+}
+
+func handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	p, err := scopePath(r, r.PathValue("path"))
+	if err == nil && isUserRoot(r, p) {
+		err = fmt.Errorf("%w: cannot remove the user's directory", errOutsideData)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_, err = fsCall(r.Context(), func() (struct{}, error) {
+		return writeConditionally(r, p, func(commit commitFunc) (struct{}, error) {
+			return struct{}{}, commit(func() error {
+				return removePath(p, r.URL.Query().Get("recursive") != "")
+			})
+		})
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Operations require_approval can gate, each covering the routes marked
+// with it. env stands for credential rotation: the persisted variables are
+// where a workspace's credentials live.
+const (
+	approvalRestore = "restore"
+	approvalPurge   = "purge"
+	approvalEnv     = "env"
+)
+
+var approvalOperations = []string{approvalRestore, approvalPurge, approvalEnv}
+
+const (
+	// approvalHeader carries the confirmation token to a gated route.
+	approvalHeader = "X-Approval-Token"
+	// approvalTimeout is how long a request waits for its answer, and
+	// approvalTokenTTL how long the token an approval issues stays valid.
+	approvalTimeout  = 5 * time.Minute
+	approvalTokenTTL = 5 * time.Minute
+	// maxApprovalReason bounds the reason shown to the approver.
+	maxApprovalReason = 256
+)
+
+var (
+	errInvalidApproval  = errors.New("invalid approval request")
+	errNoApprover       = errors.New("no session to approve in")
+	errApprovalRequired = errors.New("approval required")
+)
+
+var approvalsAnswered = newCounter("dos3_approvals_total",
+	"Approval requests for gated operations, by operation and how they ended.")
+
+// checkApprovalPolicy checks require_approval names operations that exist.
+func checkApprovalPolicy(ops []string) error {
+	for _, op := range ops {
+		if !slices.Contains(approvalOperations, op) {
+			return fmt.Errorf("require_approval: unknown operation %q; operations are %v", op, approvalOperations)
+		}
+	}
+	return nil
+}
+
+// approvalRequest is the body of POST /v1/approvals.
+type approvalRequest struct {
+	Operation string `json:"operation"`
+	// Reason is shown to whoever is asked to approve.
+	Reason string `json:"reason,omitempty"`
+}
+
+// approval is a request to perform a gated operation, answered by a control
+// client attached to one of the requester's sessions.
+type approval struct {
+	ID        string `json:"id"`
+	Operation string `json:"operation"`
+	Reason    string `json:"reason,omitempty"`
+	User      string `json:"user,omitempty"`
+	// Status is pending, approved, denied, expired or used.
+	Status    string    `json:"status"`
+	Requested time.Time `json:"requested"`
+	// Expires is when a pending request lapses, or an approval's token.
+	Expires time.Time `json:"expires"`
+	// Session is the session the answer came from.
+	Session string `json:"session,omitempty"`
+	// Token, once approved and until used, is sent in X-Approval-Token
+	// to perform the operation once.
+	Token string `json:"token,omitempty"`
+}
+
+// approvalMessage asks /ws control clients to approve a request
+// ("approval_request"), or tells them it was answered or lapsed
+// ("approval_closed"). Clients answer with {"type": "approval",
+// "approval": id, "accept": bool}.
+type approvalMessage struct {
+	Type      string    `json:"type"`
+	ID        string    `json:"id"`
+	Operation string    `json:"operation"`
+	Reason    string    `json:"reason,omitempty"`
+	Status    string    `json:"status"`
+	Expires   time.Time `json:"expires"`
+}
+
+type approvalBook struct {
+	mu   sync.Mutex
+	byID map[string]*approval
+	// approvers counts the control clients that can answer, by user.
+	approvers map[string]int
+	changed   chan struct{}
+}
+
+var approvals = &approvalBook{
+	byID:      make(map[string]*approval),
+	approvers: make(map[string]int),
+	changed:   make(chan struct{}),
+}
+
+// notifyLocked wakes the clients following requests. Called with b.mu held.
+func (b *approvalBook) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// request opens an approval request for user, telling every session of
+// theirs about it.
+func (b *approvalBook) request(req approvalRequest, user string) (approval, error) {
+	if !slices.Contains(approvalOperations, req.Operation) {
+		return approval{}, fmt.Errorf("%w: operation %q; operations are %v", errInvalidApproval, req.Operation, approvalOperations)
+	}
+	if len(req.Reason) > maxApprovalReason {
+		return approval{}, fmt.Errorf("%w: reason longer than %d bytes", errInvalidApproval, maxApprovalReason)
+	}
+	now := time.Now().UTC()
+	a := &approval{
+		ID:        randomID(),
+		Operation: req.Operation,
+		Reason:    req.Reason,
+		User:      user,
+		Status:    "pending",
+		Requested: now,
+		Expires:   now.Add(approvalTimeout),
+	}
+	b.mu.Lock()
+	if b.approvers[user] == 0 {
+		b.mu.Unlock()
+		return approval{}, fmt.Errorf("%w: no control client is attached to a session to answer", errNoApprover)
+	}
+	b.byID[a.ID] = a
+	b.notifyLocked()
+	b.mu.Unlock()
+	time.AfterFunc(approvalTimeout, func() { b.expire(a.ID) })
+
+	msg := fmt.Sprintf("Approval requested for %s", a.Operation)
+	if a.Reason != "" {
+		msg += ": " + a.Reason
+	}
+	for _, s := range sessions.list() {
+		if s.user == user {
+			s.notice(msg + ". Answer it in your terminal client.")
+		}
+	}
+	infof("Approval %s requested for %s", a.ID, a.Operation)
+	return *a, nil
+}
+
+// get returns the request id of user's, without its token once used.
+func (b *approvalBook) get(id, user string) (approval, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	a := b.byID[id]
+	if a == nil || a.User != user {
+		return approval{}, false
+	}
+	return *a, true
+}
+
+// answer records the answer a control client of session gave.
+func (b *approvalBook) answer(id string, s *session, accept bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	a := b.byID[id]
+	if a == nil || a.User != s.user || a.Status != "pending" {
+		return
+	}
+	a.Session = s.id
+	if accept {
+		a.Status, a.Token, a.Expires = "approved", randomID(), time.Now().UTC().Add(approvalTokenTTL)
+		time.AfterFunc(approvalTokenTTL, func() { b.expire(id) })
+	} else {
+		a.Status = "denied"
+	}
+	approvalsAnswered.add(1, "operation", a.Operation, "status", a.Status)
+	infof("Approval %s for %s %s in session %s", a.ID, a.Operation, a.Status, s.id)
+	b.notifyLocked()
+}
+
+// expire ends a request still pending, or an approval whose token went
+// unused, and forgets it.
+func (b *approvalBook) expire(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	a := b.byID[id]
+	if a == nil {
+		return
+	}
+	if a.Status == "pending" || a.Status == "approved" {
+		a.Status, a.Token = "expired", ""
+		approvalsAnswered.add(1, "operation", a.Operation, "status", a.Status)
+		b.notifyLocked()
+	}
+	// Kept a while longer for requesters still polling.
+	time.AfterFunc(approvalTimeout, func() {
+		b.mu.Lock()
+		delete(b.byID, id)
+		b.mu.Unlock()
+	})
+}
+
+// use spends user's token on op.
+func (b *approvalBook) use(op, token, user string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if token != "" {
+		for _, a := range b.byID {
+			if a.Token == token && a.Status == "approved" && a.Operation == op && a.User == user {
+				a.Status, a.Token = "used", ""
+				approvalsAnswered.add(1, "operation", a.Operation, "status", a.Status)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: %s needs approval: POST /v1/approvals, have it approved in an attached session, then send the token in %s",
+		errApprovalRequired, op, approvalHeader)
+}
+
+// follow sends the requests of user to a control client as they are made
+// and closed, counting it as an approver meanwhile.
+func (b *approvalBook) follow(ctx context.Context, user string, send func(approvalMessage)) {
+	b.mu.Lock()
+	b.approvers[user]++
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.approvers[user]--
+		b.mu.Unlock()
+	}()
+	asked := make(map[string]bool)
+	for {
+		var msgs []approvalMessage
+		b.mu.Lock()
+		for _, a := range b.byID {
+			if a.User != user || (a.Status == "pending") == asked[a.ID] {
+				continue
+			}
+			m := approvalMessage{Type: "approval_request", ID: a.ID, Operation: a.Operation, Reason: a.Reason, Status: a.Status, Expires: a.Expires}
+			if asked[a.ID] {
+				m.Type = "approval_closed"
+				delete(asked, a.ID)
+			} else {
+				asked[a.ID] = true
+			}
+			msgs = append(msgs, m)
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		for _, m := range msgs {
+			send(m)
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// requireApproval runs h for an operation gated by require_approval only
+// with an approval's token.
+func requireApproval(op string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(currentConfig().RequireApproval, op) {
+			if err := approvals.use(op, r.Header.Get(approvalHeader), userFromContext(r.Context())); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+func handleRequestApproval(w http.ResponseWriter, r *http.Request) {
+	var req approvalRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&req); err != nil {
+		httpError(w, r, "invalid approval request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	a, err := approvals.request(req, userFromContext(r.Context()))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, a)
+}
+
+func handleGetApproval(w http.ResponseWriter, r *http.Request) {
+	a, ok := approvals.get(r.PathValue("id"), userFromContext(r.Context()))
+	if !ok {
+		httpError(w, r, "approval not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
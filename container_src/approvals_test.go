@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestApprovalGate(t *testing.T) {
+	cfg := *currentConfig()
+	cfg.RequireApproval = []string{approvalPurge}
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	do := func(method, path, token, body string) (int, string) {
+		req, _ := http.NewRequest(method, testURL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set(approvalHeader, token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	if code, resp := do("DELETE", "/v1/trash/missing", "", ""); code != http.StatusPreconditionRequired || !strings.Contains(resp, "approval-required") {
+		t.Errorf("gated purge without a token: %d %s", code, resp)
+	}
+	if code, resp := do("POST", "/v1/approvals", "", `{"operation": "purge"}`); code != http.StatusConflict || !strings.Contains(resp, "no-approver") {
+		t.Errorf("approval with no session attached: %d %s", code, resp)
+	}
+	if code, _ := do("POST", "/v1/approvals", "", `{"operation": "shutdown"}`); code != http.StatusBadRequest {
+		t.Errorf("approval of an unknown operation: %d, want 400", code)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws?control=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var a approval
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		code, resp := do("POST", "/v1/approvals", "", `{"operation": "purge", "reason": "emptying the trash"}`)
+		if code == http.StatusAccepted {
+			json.Unmarshal([]byte(resp), &a)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("approval request: %d %s", code, resp)
+		}
+	}
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m approvalMessage
+		if json.Unmarshal(data, &m) == nil && m.Type == "approval_request" {
+			if m.ID != a.ID || m.Operation != "purge" || m.Reason != "emptying the trash" {
+				t.Fatalf("approval request sent to the client: %+v", m)
+			}
+			break
+		}
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "approval", "approval": "`+a.ID+`", "accept": true}`))
+	for deadline := time.Now().Add(5 * time.Second); a.Status == "pending"; time.Sleep(10 * time.Millisecond) {
+		_, resp := do("GET", "/v1/approvals/"+a.ID, "", "")
+		json.Unmarshal([]byte(resp), &a)
+		if time.Now().After(deadline) {
+			t.Fatal("approval not answered")
+		}
+	}
+	if a.Status != "approved" || a.Token == "" || a.Session == "" {
+		t.Fatalf("answered approval: %+v", a)
+	}
+
+	// The token is for that operation, and only once.
+	if code, _ := do("PATCH", "/v1/env", a.Token, `{}`); code != http.StatusOK {
+		t.Errorf("ungated operation: %d, want 200", code)
+	}
+	if code, resp := do("DELETE", "/v1/trash/missing", a.Token, ""); code != http.StatusNotFound {
+		t.Errorf("gated purge with a token: %d %s, want 404 from the handler", code, resp)
+	}
+	if code, _ := do("DELETE", "/v1/trash/missing", a.Token, ""); code != http.StatusPreconditionRequired {
+		t.Errorf("token used twice: %d, want 428", code)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// requireControlToken guards operator endpoints with the shared secret in
+// CONTROL_TOKEN, presented as "Authorization: Bearer <token>". When no token
+// is configured the endpoints are disabled entirely.
+func requireControlToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if os.Getenv("CONTROL_TOKEN") == "" {
+			httpError(w, r, "control API disabled: CONTROL_TOKEN not set", http.StatusForbidden)
+			return
+		}
+		if !hasControlToken(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, r, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// hasControlToken reports whether r presents CONTROL_TOKEN, which must be
+// set.
+func hasControlToken(r *http.Request) bool {
+	want := os.Getenv("CONTROL_TOKEN")
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return want != "" && ok && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// Providers auth.provider can name, each a way of learning which user a
+// request is from (see withUser).
+const (
+	authUserToken    = "user_token"
+	authSharedSecret = "shared_secret"
+	authJWKS         = "jwks"
+	authAccess       = "access"
+)
+
+var authProviders = []string{authUserToken, authSharedSecret, authJWKS, authAccess}
+
+const (
+	// authSecretHeader and authUserHeader carry the shared secret and the
+	// user it vouches for.
+	authSecretHeader = "X-Auth-Secret"
+	authUserHeader   = "X-Auth-User"
+	// accessJWTHeader carries the token Cloudflare Access signs for a
+	// request it let through.
+	accessJWTHeader = "Cf-Access-Jwt-Assertion"
+)
+
+// errAuthDisabled is returned by a provider missing the secret it checks
+// credentials against, which refuses every request carrying them.
+var errAuthDisabled = errors.New("authentication disabled")
+
+// errNoCredentials is a request without the credentials a provider reads.
+var errNoCredentials = errors.New("no credentials")
+
+// errAuthExpired is credentials past their expiry, which the client can
+// replace with fresh ones.
+var errAuthExpired = errors.New("expired")
+
+// authConfig chooses how requests are authenticated as a user.
+type authConfig struct {
+	// Provider is user_token (the default), shared_secret, jwks or
+	// access.
+	Provider string `json:"provider"`
+	// JWKSURL is where jwks fetches the keys tokens are signed with.
+	JWKSURL string `json:"jwks_url,omitempty"`
+	// Issuer and Audience, if set, must be the token's iss and one of its
+	// aud. access requires Audience, the Access application's AUD tag.
+	Issuer   string `json:"issuer,omitempty"`
+	Audience string `json:"audience,omitempty"`
+	// UserClaim is the claim naming the user for jwks; sub by default.
+	UserClaim string `json:"user_claim,omitempty"`
+	// AccessTeam is the Cloudflare Access team domain for access, such as
+	// example.cloudflareaccess.com.
+	AccessTeam string `json:"access_team,omitempty"`
+	// AllowAnonymous serves requests without credentials, unscoped, under
+	// providers other than user_token, which refuse them by default.
+	AllowAnonymous bool `json:"allow_anonymous,omitempty"`
+}
+
+func (c authConfig) validate() error {
+	switch c.Provider {
+	case "", authUserToken, authSharedSecret:
+	case authJWKS:
+		if err := checkHTTPURL(c.JWKSURL); err != nil {
+			return fmt.Errorf("auth: jwks_url: %w", err)
+		}
+	case authAccess:
+		if err := checkHost(c.AccessTeam); err != nil {
+			return fmt.Errorf("auth: access_team: %w", err)
+		}
+		if c.Audience == "" {
+			return errors.New("auth: access needs audience, the application's AUD tag")
+		}
+	default:
+		return fmt.Errorf("auth: unknown provider %q; providers are %v", c.Provider, authProviders)
+	}
+	return nil
+}
+
+// authProvider learns from a request's credentials which user it is from.
+type authProvider interface {
+	// authenticate returns who r is from, errNoCredentials if it carries
+	// none the provider reads, or why those it carries are refused.
+	authenticate(r *http.Request) (identity, error)
+}
+
+// authenticate returns who r is from, as c's provider says. A request
+// without credentials is served unscoped under user_token, with
+// allow_anonymous, or when it presents CONTROL_TOKEN as the operator;
+// otherwise it is refused.
+func (c authConfig) authenticate(r *http.Request) (identity, error) {
+	id, err := c.provider().authenticate(r)
+	if errors.Is(err, errNoCredentials) {
+		if c.Provider == "" || c.Provider == authUserToken || c.AllowAnonymous || hasControlToken(r) {
+			return identity{}, nil
+		}
+		return identity{}, fmt.Errorf("%w: %s needs them on every request", err, c.Provider)
+	}
+	return id, err
+}
+
+// provider returns the provider c configures.
+func (c authConfig) provider() authProvider {
+	switch c.Provider {
+	case authSharedSecret:
+		return sharedSecretAuth{}
+	case authJWKS:
+		claim := c.UserClaim
+		if claim == "" {
+			claim = "sub"
+		}
+		return jwtAuth{keys: jwksFor(c.JWKSURL), issuer: c.Issuer, audience: c.Audience, claim: claim}
+	case authAccess:
+		team := "https://" + c.AccessTeam
+		return jwtAuth{keys: jwksFor(team + "/cdn-cgi/access/certs"), issuer: team, audience: c.Audience, claim: "common_name", header: accessJWTHeader}
+	}
+	return userTokenAuth{}
+}
+
+// userTokenFrom returns the token r carries in X-User-Token, or for
+// WebSocket clients, which can't set headers, in ?user_token=. Other
+// requests can't use the query parameter, which would leave their tokens
+// in logs.
+func userTokenFrom(r *http.Request) string {
+	if token := r.Header.Get(userTokenHeader); token != "" {
+		return token
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		return ""
+	}
+	return r.URL.Query().Get("user_token")
+}
+
+// userTokenAuth reads HS256 user tokens signed with USER_TOKEN_SECRET.
+type userTokenAuth struct{}
+
+func (userTokenAuth) authenticate(r *http.Request) (identity, error) {
+	token := userTokenFrom(r)
+	if token == "" {
+		return identity{}, errNoCredentials
+	}
+	secret := os.Getenv("USER_TOKEN_SECRET")
+	if secret == "" {
+		return identity{}, fmt.Errorf("%w: USER_TOKEN_SECRET not set", errAuthDisabled)
+	}
+	return verifyUserToken(token, []byte(secret), time.Now())
+}
+
+// sharedSecretAuth trusts X-Auth-User, and X-Auth-Paths, from whoever
+// presents the secret in AUTH_SHARED_SECRET, such as a proxy that has
+// authenticated the user itself. The secret without a user is the proxy
+// itself, which is not scoped.
+type sharedSecretAuth struct{}
+
+func (sharedSecretAuth) authenticate(r *http.Request) (identity, error) {
+	user := r.Header.Get(authUserHeader)
+	if user == "" && r.Header.Get(authSecretHeader) == "" {
+		return identity{}, errNoCredentials
+	}
+	want := os.Getenv("AUTH_SHARED_SECRET")
+	if want == "" {
+		return identity{}, fmt.Errorf("%w: AUTH_SHARED_SECRET not set", errAuthDisabled)
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(authSecretHeader)), []byte(want)) != 1 {
+		return identity{}, fmt.Errorf("%s does not match AUTH_SHARED_SECRET", authSecretHeader)
+	}
+	if user == "" {
+		return identity{}, nil
+	}
+	if err := checkUser(user); err != nil {
+		return identity{}, err
+	}
+	var claim []string
+	if v := r.Header.Get(authPathsHeader); v != "" {
+		claim = strings.Split(v, ",")
+	}
+	grants, err := parsePathGrants(claim)
+	if err != nil {
+		return identity{}, err
+	}
+	return identity{User: user, Paths: grants}, nil
+}
+
+// jwtAuth reads tokens signed with the keys of a JWKS, as an identity
+// provider issues them or Cloudflare Access does for service tokens.
+type jwtAuth struct {
+	keys             *jwks
+	issuer, audience string
+	// claim names the user.
+	claim string
+	// header carries the token; "" for the user token's header or query
+	// parameter.
+	header string
+}
+
+func (a jwtAuth) authenticate(r *http.Request) (identity, error) {
+	token := userTokenFrom(r)
+	if a.header != "" {
+		token = r.Header.Get(a.header)
+	}
+	if token == "" {
+		return identity{}, errNoCredentials
+	}
+	claims, err := a.keys.verify(r.Context(), token, time.Now())
+	if err != nil {
+		return identity{}, err
+	}
+	if iss, _ := claims["iss"].(string); a.issuer != "" && iss != a.issuer {
+		return identity{}, fmt.Errorf("issuer %q, want %q", iss, a.issuer)
+	}
+	if a.audience != "" && !slices.Contains(audiences(claims["aud"]), a.audience) {
+		return identity{}, fmt.Errorf("audience %v does not include %q", claims["aud"], a.audience)
+	}
+	user, _ := claims[a.claim].(string)
+	if user == "" {
+		return identity{}, fmt.Errorf("no %s claim naming the user", a.claim)
+	}
+	if err := checkUser(user); err != nil {
+		return identity{}, err
+	}
+	var claim []string
+	if paths, ok := claims["paths"]; ok {
+		list, ok := paths.([]any)
+		if !ok {
+			return identity{}, errors.New("paths claim is not a list")
+		}
+		claim = []string{}
+		for _, p := range list {
+			s, ok := p.(string)
+			if !ok {
+				return identity{}, errors.New("paths claim has a non-string element")
+			}
+			claim = append(claim, s)
+		}
+	}
+	grants, err := parsePathGrants(claim)
+	if err != nil {
+		return identity{}, err
+	}
+	return identity{User: user, Paths: grants}, nil
+}
+
+// audiences returns a token's aud claim, a string or an array of them, as
+// a list.
+func audiences(aud any) []string {
+	switch v := aud.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var auds []string
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+		return auds
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// userToken signs an HS256 user token for user with secret.
+func userToken(secret, user string) string {
+	return signUserToken(secret, fmt.Sprintf(`{"user":%q}`, user))
+}
+
+// signUserToken signs an HS256 user token with the given claims.
+func signUserToken(secret, claims string) string {
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthProviders(t *testing.T) {
+	cfg := *currentConfig()
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	whoami := withUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, userFromContext(r.Context()))
+	}))
+	auth := func(header map[string]string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/v1/sessions", nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		whoami.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	// user_token, the default, serves requests without a token unscoped.
+	if code, user := auth(nil); code != http.StatusOK || user != "" {
+		t.Errorf("user_token, no credentials: %d %q, want unscoped", code, user)
+	}
+
+	cfg.Auth = authConfig{Provider: authSharedSecret}
+	if code, _ := auth(map[string]string{authUserHeader: "alice"}); code != http.StatusForbidden {
+		t.Errorf("shared secret unset: %d, want 403", code)
+	}
+	t.Setenv("AUTH_SHARED_SECRET", "proxy-secret")
+	if code, user := auth(map[string]string{authUserHeader: "alice", authSecretHeader: "proxy-secret"}); code != http.StatusOK || user != "alice" {
+		t.Errorf("shared secret: %d %q", code, user)
+	}
+	if code, _ := auth(map[string]string{authUserHeader: "alice", authSecretHeader: "guess"}); code != http.StatusUnauthorized {
+		t.Errorf("wrong shared secret: %d, want 401", code)
+	}
+	if code, user := auth(map[string]string{authSecretHeader: "proxy-secret"}); code != http.StatusOK || user != "" {
+		t.Errorf("shared secret without a user: %d %q, want unscoped", code, user)
+	}
+	if code, _ := auth(map[string]string{authUserHeader: "alice"}); code != http.StatusUnauthorized {
+		t.Errorf("user without the shared secret: %d, want 401", code)
+	}
+	if code, _ := auth(nil); code != http.StatusUnauthorized {
+		t.Errorf("shared secret, no credentials: %d, want 401", code)
+	}
+	// Anonymous requests are for the operator, or when allowed.
+	t.Setenv("CONTROL_TOKEN", "operator")
+	if code, user := auth(map[string]string{"Authorization": "Bearer operator"}); code != http.StatusOK || user != "" {
+		t.Errorf("control token: %d %q, want unscoped", code, user)
+	}
+	if code, _ := auth(map[string]string{"Authorization": "Bearer guess"}); code != http.StatusUnauthorized {
+		t.Errorf("wrong control token: %d, want 401", code)
+	}
+	cfg.Auth.AllowAnonymous = true
+	if code, user := auth(nil); code != http.StatusOK || user != "" {
+		t.Errorf("allow_anonymous, no credentials: %d %q, want unscoped", code, user)
+	}
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	enc := base64.RawURLEncoding.EncodeToString
+	keys := fmt.Sprintf(`{"keys": [{"kid": "r1", "kty": "RSA", "n": %q, "e": "AQAB"}, {"kid": "e1", "kty": "EC", "crv": "P-256", "x": %q, "y": %q}]}`,
+		enc(rsaKey.N.Bytes()), enc(ecKey.X.FillBytes(make([]byte, 32))), enc(ecKey.Y.FillBytes(make([]byte, 32))))
+	sign := func(alg, kid, claims string) string {
+		unsigned := enc([]byte(fmt.Sprintf(`{"alg":%q,"kid":%q}`, alg, kid))) + "." + enc([]byte(claims))
+		digest := sha256.Sum256([]byte(unsigned))
+		var sig []byte
+		if alg == "RS256" {
+			sig, _ = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		} else {
+			r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+		return unsigned + "." + enc(sig)
+	}
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, keys)
+	}))
+	defer idp.Close()
+	saved := jwksClient
+	jwksClient = idp.Client()
+	defer func() { jwksClient = saved }()
+
+	cfg.Auth = authConfig{Provider: authJWKS, JWKSURL: idp.URL + "/jwks", Issuer: "https://idp", Audience: "workspace", UserClaim: "preferred_username"}
+	if err := cfg.Auth.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := auth(nil); code != http.StatusUnauthorized {
+		t.Errorf("jwks, no credentials: %d, want 401", code)
+	}
+	good := `{"iss": "https://idp", "aud": ["workspace"], "preferred_username": "bob"}`
+	for _, alg := range []string{"RS256", "ES256"} {
+		kid := map[string]string{"RS256": "r1", "ES256": "e1"}[alg]
+		if code, user := auth(map[string]string{userTokenHeader: sign(alg, kid, good)}); code != http.StatusOK || user != "bob" {
+			t.Errorf("%s token: %d %q", alg, code, user)
+		}
+	}
+	for name, token := range map[string]string{
+		"wrong key":      sign("RS256", "e1", good),
+		"wrong issuer":   sign("RS256", "r1", `{"iss": "https://evil", "aud": "workspace", "preferred_username": "bob"}`),
+		"wrong audience": sign("RS256", "r1", `{"iss": "https://idp", "aud": "other", "preferred_username": "bob"}`),
+		"expired":        sign("RS256", "r1", `{"iss": "https://idp", "aud": "workspace", "preferred_username": "bob", "exp": 1}`),
+		"bad user":       sign("RS256", "r1", `{"iss": "https://idp", "aud": "workspace", "preferred_username": "../root"}`),
+		"HS256":          userToken("s3cret", "bob"),
+	} {
+		if code, _ := auth(map[string]string{userTokenHeader: token}); code != http.StatusUnauthorized {
+			t.Errorf("%s: %d, want 401", name, code)
+		}
+	}
+
+	// Cloudflare Access signs service tokens' requests with the team's
+	// keys, naming the token in common_name.
+	team := strings.TrimPrefix(idp.URL, "https://")
+	cfg.Auth = authConfig{Provider: authAccess, AccessTeam: team, Audience: "app-aud"}
+	token := sign("RS256", "r1", fmt.Sprintf(`{"iss": %q, "aud": ["app-aud"], "common_name": "ci.access"}`, idp.URL))
+	if code, user := auth(map[string]string{accessJWTHeader: token}); code != http.StatusOK || user != "ci.access" {
+		t.Errorf("Access service token: %d %q", code, user)
+	}
+	if code, _ := auth(map[string]string{userTokenHeader: token}); code != http.StatusUnauthorized {
+		t.Errorf("Access token in the user token header: %d, want 401", code)
+	}
+	if code, _ := auth(nil); code != http.StatusUnauthorized {
+		t.Errorf("access, no credentials: %d, want 401", code)
+	}
+	if err := (authConfig{Provider: authAccess, AccessTeam: team}).validate(); err == nil {
+		t.Error("access without an audience accepted")
+	}
+	if err := (authConfig{Provider: "ldap"}).validate(); err == nil {
+		t.Error("unknown provider accepted")
+	}
+}
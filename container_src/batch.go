@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// maxBatchOps caps the operations in one batch request.
+	maxBatchOps = 1000
+	// batchTrashPrefix names the hidden directories under /data that hold
+	// a batch's deletions until it succeeds, so they can be undone; then
+	// they go to the trash.
+	batchTrashPrefix = ".batch-trash-"
+)
+
+var errInvalidBatch = errors.New("invalid batch")
+
+// batchOp is one item of a POST /v1/files:batch request.
+type batchOp struct {
+	// Op is move, copy, delete or mkdir.
+	Op string `json:"op"`
+	// From and To are the source and destination of a move or copy. The
+	// destination must not exist.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Path is what a delete or mkdir applies to.
+	Path string `json:"path,omitempty"`
+	// Recursive lets delete remove a directory with its contents.
+	Recursive bool `json:"recursive,omitempty"`
+}
+
+type batchRequest struct {
+	Operations []batchOp `json:"operations"`
+	// ContinueOnError runs every operation whatever happens to the others.
+	// By default the batch stops at the first failure and undoes what it
+	// had done.
+	ContinueOnError bool `json:"continue_on_error,omitempty"`
+}
+
+// batchResult is the outcome of one operation: ok, error, skipped (not run
+// after an earlier failure) or rolled_back.
+type batchResult struct {
+	Op     string    `json:"op"`
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	File   *fileInfo `json:"file,omitempty"`
+}
+
+type batchResponse struct {
+	OK      bool          `json:"ok"`
+	Results []batchResult `json:"results"`
+}
+
+// resolvedOp is a batchOp with its paths mapped under dataDir.
+type resolvedOp struct {
+	batchOp
+	from, to string
+}
+
+// resolveBatch checks every operation before any is run, so a typo in the
+// last one doesn't leave the first half applied.
+func resolveBatch(ops []batchOp) ([]resolvedOp, error) {
+	if len(ops) == 0 || len(ops) > maxBatchOps {
+		return nil, fmt.Errorf("%w: need 1 to %d operations", errInvalidBatch, maxBatchOps)
+	}
+	out := make([]resolvedOp, len(ops))
+	for i, op := range ops {
+		r := resolvedOp{batchOp: op}
+		var err error
+		switch op.Op {
+		case "move", "copy":
+			if op.From == "" || op.To == "" {
+				return nil, fmt.Errorf("%w: operation %d: %s needs from and to", errInvalidBatch, i, op.Op)
+			}
+			if r.from, err = resolvePath(op.From); err == nil {
+				r.to, err = resolvePath(op.To)
+			}
+		case "delete", "mkdir":
+			if op.Path == "" {
+				return nil, fmt.Errorf("%w: operation %d: %s needs path", errInvalidBatch, i, op.Op)
+			}
+			r.to, err = resolvePath(op.Path)
+		default:
+			return nil, fmt.Errorf("%w: operation %d: unknown op %q", errInvalidBatch, i, op.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+		if r.from == dataDir || r.to == dataDir {
+			return nil, fmt.Errorf("%w: operation %d: cannot %s %s itself", errInvalidBatch, i, op.Op, dataDir)
+		}
+		out[i] = r
+	}
+	return out, nil
+}
+
+// fileBatch runs operations and remembers how to undo each one.
+type fileBatch struct {
+	trash   string // created on the first delete
+	undo    []func() error
+	deleted []stagedDelete
+}
+
+// stagedDelete is a batch's deletion, moved aside until the batch is done.
+type stagedDelete struct {
+	staged, orig string
+	info         fs.FileInfo
+}
+
+func (b *fileBatch) run(op resolvedOp) (*fileInfo, error) {
+	switch op.Op {
+	case "move":
+		if err := mustNotExist(op.to); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(op.to), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(op.from, op.to); err != nil {
+			return nil, err
+		}
+		b.undo = append(b.undo, func() error { return os.Rename(op.to, op.from) })
+	case "copy":
+		if err := mustNotExist(op.to); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(op.to), 0755); err != nil {
+			return nil, err
+		}
+		err := copyTree(op.from, op.to)
+		b.undo = append(b.undo, func() error { return os.RemoveAll(op.to) })
+		if err != nil {
+			return nil, err
+		}
+	case "mkdir":
+		// Undo removes the highest directory this created.
+		top := ""
+		for dir := op.to; dir != dataDir; dir = filepath.Dir(dir) {
+			if _, err := os.Lstat(dir); err == nil {
+				break
+			}
+			top = dir
+		}
+		if err := os.MkdirAll(op.to, 0755); err != nil {
+			return nil, err
+		}
+		if top != "" {
+			b.undo = append(b.undo, func() error { return os.RemoveAll(top) })
+		}
+	case "delete":
+		fi, err := os.Lstat(op.to)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() && !op.Recursive {
+			if entries, err := os.ReadDir(op.to); err != nil {
+				return nil, err
+			} else if len(entries) > 0 {
+				return nil, fmt.Errorf("%s: directory not empty", op.Path)
+			}
+		}
+		// Deleting is moving into the trash, emptied once the batch is done.
+		if b.trash == "" {
+			if b.trash, err = os.MkdirTemp(dataDir, batchTrashPrefix); err != nil {
+				return nil, err
+			}
+		}
+		staged := filepath.Join(b.trash, fmt.Sprint(len(b.undo)))
+		if err := os.Rename(op.to, staged); err != nil {
+			return nil, err
+		}
+		n := len(b.deleted)
+		b.deleted = append(b.deleted, stagedDelete{staged, op.to, fi})
+		b.undo = append(b.undo, func() error {
+			b.deleted = b.deleted[:n]
+			return os.Rename(staged, op.to)
+		})
+		return nil, nil
+	}
+	fi, err := os.Stat(op.to)
+	if err != nil {
+		return nil, err
+	}
+	info := newFileInfo(op.to, fi)
+	return &info, nil
+}
+
+// rollback undoes everything run so far, newest first.
+func (b *fileBatch) rollback() error {
+	var errs []error
+	for i := len(b.undo) - 1; i >= 0; i-- {
+		if err := b.undo[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	b.undo = nil
+	return errors.Join(errs...)
+}
+
+// finish moves the batch's deletions to the trash and removes its staging
+// directory.
+func (b *fileBatch) finish() {
+	for _, d := range b.deleted {
+		if inTrash(d.orig) {
+			// Deleted from the trash: gone for good with the staging
+			// directory.
+			continue
+		}
+		if err := moveToTrash(d.staged, d.orig, d.info); err != nil {
+			warnf("Moving %s to the trash: %v", relPath(d.orig), err)
+		}
+	}
+	if b.trash != "" {
+		if err := os.RemoveAll(b.trash); err != nil {
+			warnf("Removing batch trash %s: %v", b.trash, err)
+		}
+	}
+}
+
+func mustNotExist(p string) error {
+	if _, err := os.Lstat(p); err == nil {
+		return fmt.Errorf("%s: %w", relPath(p), fs.ErrExist)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// copyTree copies a file, symlink or directory tree, keeping permissions.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.Mkdir(target, fi.Mode().Perm())
+		case fi.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			return copyFile(p, target, fi.Mode().Perm())
+		}
+		return fmt.Errorf("%s: cannot copy %s", relPath(p), fi.Mode().Type())
+	})
+}
+
+func copyFile(src, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// handleFileBatch runs a list of file operations in one round trip, for
+// multi-select actions in file-tree UIs. The whole batch is validated
+// first; then operations run in order, and unless continue_on_error is set
+// the first failure undoes the ones before it. The filesystem has no
+// transactions, so a rollback can itself fail, which the results report.
+func handleFileBatch(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxInputBody)).Decode(&req); err != nil {
+		httpError(w, r, fmt.Sprintf("invalid JSON body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := scopeBatch(r, req.Operations); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ops, err := resolveBatch(req.Operations)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// A batch abandoned because the mount stopped answering still finishes,
+	// rollback included, when it does.
+	resp, err := fsCall(r.Context(), func() (batchResponse, error) {
+		return runBatch(ops, req.ContinueOnError), nil
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	for _, res := range resp.Results {
+		if res.File != nil {
+			res.File.Path = unscopePath(r, res.File.Path)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// runBatch applies ops in order. Unless continueOnError is set, the first
+// failure skips the rest and rolls back those that succeeded.
+func runBatch(ops []resolvedOp, continueOnError bool) batchResponse {
+	resp := batchResponse{OK: true, Results: make([]batchResult, len(ops))}
+	var b fileBatch
+	defer b.finish()
+	failed := -1
+	for i, op := range ops {
+		resp.Results[i].Op = op.Op
+		if failed >= 0 {
+			resp.Results[i].Status = "skipped"
+			continue
+		}
+		info, err := b.run(op)
+		if err != nil {
+			resp.OK = false
+			resp.Results[i].Status = "error"
+			resp.Results[i].Error = err.Error()
+			if !continueOnError {
+				failed = i
+			}
+			continue
+		}
+		resp.Results[i].Status = "ok"
+		resp.Results[i].File = info
+	}
+
+	if failed >= 0 {
+		err := b.rollback()
+		for i := range failed {
+			if resp.Results[i].Status == "ok" {
+				resp.Results[i].Status = "rolled_back"
+				resp.Results[i].File = nil
+			}
+		}
+		if err != nil {
+			warnf("Rolling back file batch: %v", err)
+			resp.Results[failed].Error += fmt.Sprintf(" (rollback failed: %v)", err)
+		}
+	}
+	return resp
+}
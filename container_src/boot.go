@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Boot stages, in the order they normally happen. Stages that don't apply,
+// such as the mount ones without a bucket, are left out of the timeline.
+const (
+	bootConfigLoaded  = "config_loaded"
+	bootEnvValidated  = "env_validated"
+	bootBucketChecked = "bucket_checked"
+	bootMountStarted  = "mount_started"
+	bootMountReady    = "mount_ready"
+	// Only when a new workspace was populated from WORKSPACE_TEMPLATE.
+	bootTemplateApplied = "template_applied"
+	bootListening       = "listening"
+)
+
+var bootStageSeconds = newGauge("dos3_boot_stage_seconds",
+	"Seconds from process start to each boot stage of this instance, by stage and location.")
+
+type bootStage struct {
+	Stage string    `json:"stage"`
+	At    time.Time `json:"at"`
+	// SinceStartMS is the time from process start to this stage.
+	SinceStartMS float64 `json:"since_start_ms"`
+}
+
+type bootReport struct {
+	Location   string      `json:"location"`
+	InstanceID string      `json:"instance_id"`
+	Started    time.Time   `json:"started"`
+	Stages     []bootStage `json:"stages"`
+	// Ready is set once the server is listening.
+	Ready bool `json:"ready"`
+}
+
+// bootTimeline records when each boot stage was reached, for tracking
+// cold-start latency per Cloudflare location.
+type bootTimeline struct {
+	mu     sync.Mutex
+	stages []bootStage
+}
+
+var boot bootTimeline
+
+// mark records that stage was reached now. Only the first time counts:
+// mount stages repeat when a degraded start retries.
+func (b *bootTimeline) mark(stage string) {
+	now := time.Now()
+	since := now.Sub(startTime)
+	b.mu.Lock()
+	for _, s := range b.stages {
+		if s.Stage == stage {
+			b.mu.Unlock()
+			return
+		}
+	}
+	b.stages = append(b.stages, bootStage{Stage: stage, At: now, SinceStartMS: float64(since.Microseconds()) / 1000})
+	b.mu.Unlock()
+	bootStageSeconds.set(since.Seconds(), "stage", stage, "location", bootLocation())
+	debugf("Boot stage %s reached after %s", stage, since.Round(time.Millisecond))
+	if stage == bootListening {
+		infof("Boot timeline (%s): %s", bootLocation(), b.summary())
+	}
+}
+
+func (b *bootTimeline) report() bootReport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := bootReport{
+		Location:   bootLocation(),
+		InstanceID: os.Getenv("CLOUDFLARE_DURABLE_OBJECT_ID"),
+		Started:    startTime,
+		Stages:     append([]bootStage{}, b.stages...),
+	}
+	for _, s := range b.stages {
+		if s.Stage == bootListening {
+			r.Ready = true
+		}
+	}
+	return r
+}
+
+// summary is the timeline on one line: "config_loaded +2ms, ...".
+func (b *bootTimeline) summary() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	parts := make([]string, len(b.stages))
+	for i, s := range b.stages {
+		parts[i] = fmt.Sprintf("%s +%s", s.Stage, s.At.Sub(startTime).Round(time.Millisecond))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func bootLocation() string {
+	return envOr("CLOUDFLARE_LOCATION", "local")
+}
+
+// handleBoot serves the boot timeline: GET /debug/boot.
+func handleBoot(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, boot.report())
+}
+
+// readyCallbackAttempts is how many times the readiness callback is tried.
+const readyCallbackAttempts = 5
+
+// readyNotice is the readiness callback's body.
+type readyNotice struct {
+	bootReport
+	// Status and Degraded are as in /v1/health.
+	Status   string `json:"status"`
+	Degraded string `json:"degraded,omitempty"`
+}
+
+// Sends the readiness callback again once a degraded start recovers.
+var _ = events.subscribe("ready_callback", func(event) { notifyReady() }, eventMountRecovered)
+
+// notifyReady POSTs the boot report to READY_CALLBACK_URL, if set, so the
+// Worker can route the user to the container without polling /v1/health.
+// It is sent once the server is listening, and again after a degraded start
+// switches over to the bucket. Failed attempts are retried with backoff.
+func notifyReady() {
+	url := os.Getenv("READY_CALLBACK_URL")
+	if url == "" {
+		return
+	}
+	n := readyNotice{bootReport: boot.report(), Status: "ok", Degraded: degraded.status()}
+	if n.Degraded != "" {
+		n.Status = "degraded"
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		warnf("Readiness callback: %v", err)
+		return
+	}
+	// Retries keep the ID, so the receiver can tell them apart from a
+	// second notice.
+	id := randomID()
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := postReady(url, id, body)
+		if err == nil {
+			debugf("Readiness callback sent (%s, request %s)", n.Status, id)
+			return
+		}
+		if attempt == readyCallbackAttempts {
+			warnf("Readiness callback failed after %d attempts: %v (request %s)", attempt, err, id)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postReady(url, id string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(requestIDHeader, id)
+	if token := os.Getenv("S3_AUTH_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
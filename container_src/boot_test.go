@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyCallback(t *testing.T) {
+	got := make(chan readyNotice, 1)
+	cb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n readyNotice
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil || r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got <- n
+	}))
+	defer cb.Close()
+	t.Setenv("READY_CALLBACK_URL", cb.URL)
+	t.Setenv("S3_AUTH_TOKEN", "tok")
+	t.Setenv("CLOUDFLARE_DURABLE_OBJECT_ID", "do-1")
+
+	notifyReady()
+	select {
+	case n := <-got:
+		if n.Status != "ok" || n.InstanceID != "do-1" {
+			t.Fatalf("readiness callback = %+v", n)
+		}
+	default:
+		t.Fatal("no readiness callback")
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// changeMaxDelay bounds how long a change waits while others keep
+	// arriving within change_events.debounce of each other.
+	changeMaxDelay = 10 * time.Second
+	// maxPendingChanges bounds the changes kept while the callback is
+	// failing; the oldest are dropped past it.
+	maxPendingChanges = 10000
+	// changeWatchMask is what the watcher listens for. Writes are reported
+	// once the writer closes the file rather than on every write.
+	changeWatchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+)
+
+var (
+	changesSent = newCounter("dos3_change_events_sent_total",
+		"Filesystem change events delivered to the change_events callback.")
+	changesDropped = newCounter("dos3_change_events_dropped_total",
+		"Filesystem change events dropped because the callback kept failing.")
+)
+
+// changeEventsConfig configures the filesystem change callback.
+type changeEventsConfig struct {
+	// URL receives POSTs of changeBatch JSON, such as an endpoint of the
+	// Durable Object; the S3 auth token is sent as a bearer token. Empty
+	// disables change events.
+	URL string `json:"url,omitempty"`
+	// Debounce is how long the workspace must be quiet before the changes
+	// so far are sent.
+	Debounce duration `json:"debounce"`
+}
+
+// changeEvent is one changed path under /data, after coalescing everything
+// that happened to it since the last batch.
+type changeEvent struct {
+	Path string `json:"path"`
+	// Op is create, modify, delete or rename. A rescan event, without a
+	// path, means events were lost and consumers should re-read the tree.
+	Op    string `json:"op"`
+	From  string `json:"from,omitempty"` // rename
+	IsDir bool   `json:"is_dir,omitempty"`
+	// Size is the file's size afterwards and SizeDelta the change in it.
+	Size      int64 `json:"size"`
+	SizeDelta int64 `json:"size_delta"`
+}
+
+type changeBatch struct {
+	Events []changeEvent `json:"events"`
+}
+
+// changeWatcher follows changes under /data with inotify, whichever way
+// they're made: shells, exec, the file API or services. Events on the
+// FUSE mount are those made through this container; changes made to the
+// bucket elsewhere aren't seen.
+type changeWatcher struct {
+	fd int
+
+	mu      sync.Mutex
+	watches map[int32]string // watch descriptor to directory
+	sizes   map[string]int64 // last known size of each file
+	pending []*changeEvent
+	byPath  map[string]*changeEvent
+	first   time.Time // of the oldest pending change
+	last    time.Time // of the newest
+	full    bool      // out of watches; logged once
+
+	stop chan struct{} // closed to stop delivering
+}
+
+var changes struct {
+	once sync.Once
+	w    *changeWatcher
+}
+
+// syncChangeEvents starts the watcher the first time change_events.url is
+// set, or at boot if something subscribes to file.changed events. It keeps
+// running if the URL is removed again, dropping its batches.
+func syncChangeEvents() {
+	if currentConfig().ChangeEvents.URL == "" && !events.wants(eventFileChanged) {
+		return
+	}
+	changes.once.Do(func() {
+		w, err := newChangeWatcher()
+		if err != nil {
+			warnf("Filesystem change events disabled: %v", err)
+			return
+		}
+		changes.w = w
+		go w.read()
+		go w.deliver()
+	})
+}
+
+func newChangeWatcher() (*changeWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	w := &changeWatcher{
+		fd:      fd,
+		watches: make(map[int32]string),
+		sizes:   make(map[string]int64),
+		byPath:  make(map[string]*changeEvent),
+		stop:    make(chan struct{}),
+	}
+	w.mu.Lock()
+	w.addTree(dataDir, false)
+	n := len(w.watches)
+	w.mu.Unlock()
+	infof("Watching %d directories under %s for change events", n, dataDir)
+	return w, nil
+}
+
+// addTree watches dir and everything below it. With report set, whatever
+// is already there is reported as created: it appeared before the watch
+// could see it. Called with w.mu held.
+func (w *changeWatcher) addTree(dir string, report bool) {
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if p != dataDir && skipDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			wd, err := syscall.InotifyAddWatch(w.fd, p, changeWatchMask)
+			if err != nil {
+				if errors.Is(err, syscall.ENOSPC) && !w.full {
+					w.full = true
+					warnf("Out of inotify watches at %s; raise fs.inotify.max_user_watches to see changes below it", relPath(p))
+				}
+				return filepath.SkipDir
+			}
+			w.watches[int32(wd)] = p
+			if report && p != dir {
+				w.record(changeEvent{Path: relPath(p), Op: "create", IsDir: true})
+			}
+			return nil
+		}
+		if fi, err := d.Info(); err == nil && fi.Mode().IsRegular() {
+			w.sizes[p] = fi.Size()
+			if report {
+				w.record(changeEvent{Path: relPath(p), Op: "create", Size: fi.Size(), SizeDelta: fi.Size()})
+			}
+		}
+		return nil
+	})
+}
+
+// read handles inotify events until the descriptor fails.
+func (w *changeWatcher) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			errorf("Reading inotify events: %v", err)
+			return
+		}
+		w.mu.Lock()
+		// A rename is a MOVED_FROM and a MOVED_TO with the same cookie,
+		// normally in the same read.
+		moves := make(map[uint32]string)
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			w.handle(ev, string(bytes.TrimRight(name, "\x00")), moves)
+		}
+		// Moved out of the watched tree (or into the trash).
+		for _, from := range moves {
+			w.removed(from, true)
+		}
+		w.mu.Unlock()
+	}
+}
+
+// handle applies one event. Called with w.mu held.
+func (w *changeWatcher) handle(ev *syscall.InotifyEvent, name string, moves map[uint32]string) {
+	if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		warnf("inotify queue overflowed; change events were lost")
+		w.record(changeEvent{Op: "rescan"})
+		return
+	}
+	dir, ok := w.watches[ev.Wd]
+	if !ok {
+		return
+	}
+	if ev.Mask&syscall.IN_IGNORED != 0 {
+		delete(w.watches, ev.Wd)
+		return
+	}
+	p := filepath.Join(dir, name)
+	isDir := ev.Mask&syscall.IN_ISDIR != 0
+	if isDir && skipDir(name) {
+		return
+	}
+	switch {
+	case ev.Mask&syscall.IN_CREATE != 0:
+		if isDir {
+			w.record(changeEvent{Path: relPath(p), Op: "create", IsDir: true})
+			w.addTree(p, true)
+		} else {
+			w.sizes[p] = 0
+			w.record(changeEvent{Path: relPath(p), Op: "create"})
+		}
+	case ev.Mask&syscall.IN_CLOSE_WRITE != 0:
+		fi, err := os.Stat(p)
+		if err != nil {
+			return
+		}
+		before := w.sizes[p]
+		w.sizes[p] = fi.Size()
+		w.record(changeEvent{Path: relPath(p), Op: "modify", Size: fi.Size(), SizeDelta: fi.Size() - before})
+	case ev.Mask&syscall.IN_DELETE != 0:
+		w.removed(p, isDir)
+	case ev.Mask&syscall.IN_MOVED_FROM != 0:
+		moves[ev.Cookie] = p
+	case ev.Mask&syscall.IN_MOVED_TO != 0:
+		from, ok := moves[ev.Cookie]
+		delete(moves, ev.Cookie)
+		if !ok {
+			// Moved in from outside the watched tree.
+			if isDir {
+				w.record(changeEvent{Path: relPath(p), Op: "create", IsDir: true})
+				w.addTree(p, true)
+			} else if fi, err := os.Stat(p); err == nil {
+				w.sizes[p] = fi.Size()
+				w.record(changeEvent{Path: relPath(p), Op: "create", Size: fi.Size(), SizeDelta: fi.Size()})
+			}
+			return
+		}
+		w.renamed(from, p, isDir)
+	}
+}
+
+// removed records p's deletion. Called with w.mu held.
+func (w *changeWatcher) removed(p string, isDir bool) {
+	size := w.sizes[p]
+	delete(w.sizes, p)
+	if isDir {
+		for f, n := range w.sizes {
+			if strings.HasPrefix(f, p+"/") {
+				size += n
+				delete(w.sizes, f)
+			}
+		}
+	}
+	w.record(changeEvent{Path: relPath(p), Op: "delete", IsDir: isDir, SizeDelta: -size})
+}
+
+// renamed moves what's known about from to to. Called with w.mu held.
+func (w *changeWatcher) renamed(from, to string, isDir bool) {
+	size := w.sizes[from]
+	delete(w.sizes, from)
+	w.sizes[to] = size
+	if isDir {
+		for f, n := range w.sizes {
+			if rest, ok := strings.CutPrefix(f, from+"/"); ok {
+				delete(w.sizes, f)
+				w.sizes[to+"/"+rest] = n
+			}
+		}
+		// Watches follow the directories; only their paths change.
+		for wd, dir := range w.watches {
+			if dir == from {
+				w.watches[wd] = to
+			} else if rest, ok := strings.CutPrefix(dir, from+"/"); ok {
+				w.watches[wd] = to + "/" + rest
+			}
+		}
+	}
+	var delta int64
+	if !isDir {
+		// A write closed just before the rename can't be stat'd by the
+		// time its event is handled; the size is caught up here.
+		if fi, err := os.Stat(to); err == nil {
+			delta = fi.Size() - size
+			size = fi.Size()
+			w.sizes[to] = size
+		}
+	}
+	w.record(changeEvent{Path: relPath(to), Op: "rename", From: relPath(from), IsDir: isDir, Size: size, SizeDelta: delta})
+}
+
+// record adds ev to the pending batch, folding it into an earlier change
+// of the same path. Called with w.mu held.
+func (w *changeWatcher) record(ev changeEvent) {
+	events.publish(event{Kind: eventFileChanged, Change: ev})
+	now := time.Now()
+	if len(w.pending) == 0 {
+		w.first = now
+	}
+	w.last = now
+
+	if ev.Op == "rename" {
+		if prev, ok := w.byPath[ev.From]; ok && prev.Op == "create" {
+			// Created and renamed within one batch: just created.
+			w.drop(ev.From)
+			ev.Op, ev.From, ev.SizeDelta = "create", "", ev.Size
+		}
+	}
+	prev, ok := w.byPath[ev.Path]
+	if !ok || ev.Op == "rescan" {
+		w.add(ev)
+		return
+	}
+	delta := prev.SizeDelta + ev.SizeDelta
+	switch {
+	case prev.Op == "create" && ev.Op == "modify":
+		prev.Size, prev.SizeDelta = ev.Size, delta
+	case prev.Op == "create" && ev.Op == "delete":
+		w.drop(ev.Path)
+	case prev.Op == "delete" && ev.Op == "create":
+		prev.Op, prev.Size, prev.SizeDelta = "modify", ev.Size, delta
+	case prev.Op == "rename" && ev.Op == "modify":
+		prev.Size, prev.SizeDelta = ev.Size, delta
+	default:
+		// Move the path to the end so events stay in order.
+		w.drop(ev.Path)
+		ev.SizeDelta = delta
+		w.add(ev)
+	}
+}
+
+func (w *changeWatcher) add(ev changeEvent) {
+	if len(w.pending) >= maxPendingChanges {
+		w.drop(w.pending[0].Path)
+		changesDropped.add(1)
+	}
+	e := &ev
+	w.pending = append(w.pending, e)
+	if ev.Path != "" {
+		w.byPath[ev.Path] = e
+	}
+}
+
+func (w *changeWatcher) drop(p string) {
+	e := w.byPath[p]
+	delete(w.byPath, p)
+	for i, x := range w.pending {
+		if x == e {
+			w.pending = append(w.pending[:i], w.pending[i+1:]...)
+			break
+		}
+	}
+}
+
+// deliver sends pending changes once the workspace has been quiet for the
+// debounce period, or changeMaxDelay after the first of them, until
+// w.stop is closed.
+func (w *changeWatcher) deliver() {
+	backoff := time.Second
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-w.stop:
+			return
+		}
+		cfg := currentConfig().ChangeEvents
+		w.mu.Lock()
+		due := len(w.pending) > 0 &&
+			(time.Since(w.last) >= cfg.Debounce.Duration || time.Since(w.first) >= changeMaxDelay)
+		if !due {
+			w.mu.Unlock()
+			continue
+		}
+		batch := make([]changeEvent, len(w.pending))
+		for i, e := range w.pending {
+			batch[i] = *e
+		}
+		w.pending, w.byPath = nil, make(map[string]*changeEvent)
+		w.mu.Unlock()
+
+		if cfg.URL == "" {
+			continue
+		}
+		id := randomID()
+		if err := postChanges(cfg.URL, id, batch); err != nil {
+			warnf("Delivering %d change events: %v; retrying in %s (request %s)", len(batch), err, backoff, id)
+			w.requeue(batch)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		backoff = time.Second
+		changesSent.add(float64(len(batch)))
+	}
+}
+
+// requeue puts a batch that failed to send back in front of newer changes.
+// Newer changes to the same paths win.
+func (w *changeWatcher) requeue(batch []changeEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	newer := w.pending
+	w.pending, w.byPath = nil, make(map[string]*changeEvent)
+	for _, ev := range batch {
+		w.add(ev)
+	}
+	for _, e := range newer {
+		w.record(*e)
+	}
+	w.first = time.Now().Add(-changeMaxDelay)
+}
+
+// postChanges sends batch to url, identified by id.
+func postChanges(url, id string, batch []changeEvent) error {
+	body, err := json.Marshal(changeBatch{Events: batch})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(requestIDHeader, id)
+	if token := os.Getenv("S3_AUTH_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestChangeEventsDebounced checks that a burst of changes reaches the
+// callback as one batch, once the workspace has been quiet for the debounce
+// period, with each path's changes folded together.
+func TestChangeEventsDebounced(t *testing.T) {
+	const prefix = "changes-burst"
+	type received struct {
+		at    time.Time
+		batch changeBatch
+	}
+	batches := make(chan received, 10)
+	cb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b changeBatch
+		json.NewDecoder(r.Body).Decode(&b)
+		// Only this test's changes: others may write under /data meanwhile.
+		var ours []changeEvent
+		for _, ev := range b.Events {
+			if ev.Path == prefix || strings.HasPrefix(ev.Path, prefix+"/") {
+				ours = append(ours, ev)
+			}
+		}
+		if len(ours) > 0 {
+			batches <- received{time.Now(), changeBatch{Events: ours}}
+		}
+	}))
+	defer cb.Close()
+	cfg := *currentConfig()
+	cfg.ChangeEvents = changeEventsConfig{URL: cb.URL, Debounce: duration{300 * time.Millisecond}}
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+
+	w, err := newChangeWatcher()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer func() {
+		// read stays blocked without watches; closing the descriptor
+		// could hand it to another watcher's.
+		w.mu.Lock()
+		for wd := range w.watches {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+		}
+		w.mu.Unlock()
+		close(w.stop)
+	}()
+	go w.read()
+	go w.deliver()
+
+	dir := filepath.Join(dataDir, prefix)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, body := range []string{"a", "ab", "abc", "abcd", "final"} {
+		os.WriteFile(filepath.Join(dir, "a.txt"), []byte(body), 0644)
+		time.Sleep(20 * time.Millisecond)
+	}
+	os.WriteFile(filepath.Join(dir, "tmp.txt"), []byte("x"), 0644)
+	os.Remove(filepath.Join(dir, "tmp.txt"))
+	os.WriteFile(filepath.Join(dir, "draft.txt"), []byte("doc"), 0644)
+	os.Rename(filepath.Join(dir, "draft.txt"), filepath.Join(dir, "doc.txt"))
+	quiet := time.Now()
+
+	var got received
+	select {
+	case got = <-batches:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change events delivered")
+	}
+	if early := got.at.Sub(quiet); early < 300*time.Millisecond {
+		t.Errorf("batch sent %s after the last change, before the debounce period", early)
+	}
+	want := map[string]changeEvent{
+		prefix:              {Path: prefix, Op: "create", IsDir: true},
+		prefix + "/a.txt":   {Path: prefix + "/a.txt", Op: "create", Size: 5, SizeDelta: 5},
+		prefix + "/doc.txt": {Path: prefix + "/doc.txt", Op: "create", Size: 3, SizeDelta: 3},
+	}
+	if len(got.batch.Events) != len(want) {
+		t.Errorf("batch has %d events, want %d: %+v", len(got.batch.Events), len(want), got.batch.Events)
+	}
+	for _, ev := range got.batch.Events {
+		if ev != want[ev.Path] {
+			t.Errorf("event %+v, want %+v", ev, want[ev.Path])
+		}
+	}
+	select {
+	case b := <-batches:
+		t.Errorf("second batch for the same burst: %+v", b.batch.Events)
+	case <-time.After(time.Second):
+	}
+}
+
+// TestChangeEventsUserScoped checks that users confined to a namespace
+// can't read the workspace's file changes, which cover every path under
+// /data, through the timeline.
+func TestChangeEventsUserScoped(t *testing.T) {
+	t.Setenv("USER_TOKEN_SECRET", "s3cret")
+	req, _ := http.NewRequest("GET", testURL+"/v1/timeline?kind=file", nil)
+	req.Header.Set(userTokenHeader, userToken("s3cret", "mallory"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p problem
+	json.NewDecoder(resp.Body).Decode(&p)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || p.Type != problemTypePrefix+"user-scoped" {
+		t.Errorf("file changes as a user: %s %q, want 403 user-scoped", resp.Status, p.Type)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxChecksumCache bounds the checksums remembered; past it, arbitrary
+// entries are forgotten.
+const maxChecksumCache = 4096
+
+var errInvalidChecksum = errors.New("invalid checksum algorithm")
+
+// checksumAlgorithms are those ?checksum= accepts. md5 is there because it
+// is what S3 ETags of single-part uploads are.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+}
+
+var checksumLookups = newCounter("dos3_checksum_lookups_total",
+	"File checksums requested, by result (hit for one served from the cache, or miss).")
+
+type fileChecksum struct {
+	Path      string `json:"path"`
+	Algorithm string `json:"algorithm"`
+	// Checksum is hex-encoded.
+	Checksum string    `json:"checksum"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+}
+
+type checksumKey struct{ path, algorithm string }
+
+// checksums caches computed checksums. An entry is valid while the file's
+// size and modification time are those it was computed for, so a change
+// is noticed without watching the file.
+var checksums = struct {
+	sync.Mutex
+	m map[checksumKey]fileChecksum
+}{m: make(map[checksumKey]fileChecksum)}
+
+// checksumFile returns the checksum of the file at p, from the cache if the
+// file hasn't changed since it was computed.
+func checksumFile(p, algorithm string) (fileChecksum, error) {
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return fileChecksum{}, fmt.Errorf("%w %q: want sha256, sha512, sha1 or md5", errInvalidChecksum, algorithm)
+	}
+	f, fi, err := openFile(p)
+	if err != nil {
+		return fileChecksum{}, err
+	}
+	defer f.Close()
+	key := checksumKey{fi.Path, algorithm}
+	checksums.Lock()
+	c, ok := checksums.m[key]
+	checksums.Unlock()
+	if ok && c.Size == fi.Size && c.ModTime.Equal(fi.ModTime) {
+		checksumLookups.add(1, "result", "hit")
+		return c, nil
+	}
+	checksumLookups.add(1, "result", "miss")
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return fileChecksum{}, err
+	}
+	c = fileChecksum{Path: fi.Path, Algorithm: algorithm, Checksum: hex.EncodeToString(h.Sum(nil)), Size: fi.Size, ModTime: fi.ModTime}
+	// A file written to while it was read has no one checksum to remember.
+	if after, err := f.Stat(); err == nil && after.Size() == fi.Size && after.ModTime().Equal(fi.ModTime) {
+		checksums.Lock()
+		if len(checksums.m) >= maxChecksumCache {
+			for k := range checksums.m {
+				delete(checksums.m, k)
+				break
+			}
+		}
+		checksums.m[key] = c
+		checksums.Unlock()
+	}
+	return c, nil
+}
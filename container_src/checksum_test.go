@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChecksum(t *testing.T) {
+	c := dialTest(t)
+	ctx := context.Background()
+	if _, err := c.Upload(ctx, "sums/a.txt", strings.NewReader("hello\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	const helloSHA256 = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	hits := checksumLookups.get("result", "hit")
+	for range 2 {
+		sum, err := c.Checksum(ctx, "sums/a.txt", "sha256")
+		if err != nil || sum != helloSHA256 {
+			t.Fatalf("Checksum = %q, %v", sum, err)
+		}
+	}
+	if checksumLookups.get("result", "hit") != hits+1 {
+		t.Error("second checksum wasn't served from the cache")
+	}
+	if sum, _ := c.Checksum(ctx, "sums/a.txt", "md5"); sum != "b1946ac92492d2347c6235b4d2611184" {
+		t.Errorf("md5 = %q", sum)
+	}
+
+	// A change of size or modification time invalidates the cached sum.
+	full := filepath.Join(dataDir, "sums", "a.txt")
+	os.WriteFile(full, []byte("world\n"), 0644)
+	os.Chtimes(full, time.Now(), time.Now().Add(time.Hour))
+	if sum, _ := c.Checksum(ctx, "sums/a.txt", "sha256"); sum == helloSHA256 {
+		t.Error("checksum of a changed file came from the cache")
+	}
+
+	if _, err := c.Checksum(ctx, "sums/a.txt", "crc7"); !isStatus(err, http.StatusBadRequest) {
+		t.Errorf("unknown algorithm: %v, want 400", err)
+	}
+	if _, err := c.Checksum(ctx, "sums", "sha256"); !isStatus(err, http.StatusBadRequest) {
+		t.Errorf("checksum of a directory: %v, want 400", err)
+	}
+	if _, err := c.Checksum(ctx, "sums/missing", "sha256"); !isStatus(err, http.StatusNotFound) {
+		t.Errorf("checksum of a missing file: %v, want 404", err)
+	}
+}
@@ -0,0 +1,551 @@
+// Package client is a Go client for the container's terminal server. It
+// speaks the same protocols as the web frontend: the /ws WebSocket for
+// interactive sessions and the /v1 REST API for everything else.
+//
+//	c, err := client.Dial(ctx, "https://do-s3.example.workers.dev", &client.Options{Name: "dev"})
+//	res, err := c.Exec(ctx, client.ExecRequest{Argv: []string{"ls", "-la"}})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"server/container_src/errcode"
+)
+
+// Options configures a Client. The zero value is usable.
+type Options struct {
+	// Name selects the workspace when connecting through the Worker, which
+	// routes ?name= to a Terminal Durable Object. It is ignored by a
+	// container reached directly.
+	Name string
+	// Header is sent with every request, e.g. for authentication.
+	Header http.Header
+	// HTTPClient is used for REST calls; http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// Client talks to one workspace. It is safe for concurrent use.
+type Client struct {
+	base url.URL
+	opts Options
+	http *http.Client
+}
+
+// Error is a non-2xx response from the server.
+type Error struct {
+	StatusCode int
+	// Type names the failure, as a URI such as urn:do-s3:problem:not-found,
+	// when the server described it as a problem (RFC 9457).
+	Type string
+	// Code is the failure's stable code, for those package errcode names;
+	// errors.Is matches an Error against it.
+	Code    errcode.Code
+	Message string
+	// RequestID identifies the request in the server's logs.
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	if e.Code == "" {
+		return nil
+	}
+	return e.Code
+}
+
+// Health is the server's /v1/health report.
+type Health struct {
+	// Status is "ok", or "degraded" when the container couldn't mount its
+	// bucket and /data is on local disk; Degraded says why.
+	Status     string `json:"status"`
+	Degraded   string `json:"degraded,omitempty"`
+	InstanceID string `json:"instance_id"`
+	Mounted    bool   `json:"mounted"`
+	Sessions   int    `json:"sessions"`
+	Uptime     string `json:"uptime"`
+
+	// PendingWrites are file writes and deletes queued on the container
+	// while its mount is failing, not yet in the bucket.
+	PendingWrites     int   `json:"pending_writes"`
+	PendingWriteBytes int64 `json:"pending_write_bytes"`
+
+	Version Version `json:"version"`
+}
+
+// Version identifies the server's build. Fields the build didn't record
+// are "unknown".
+type Version struct {
+	Commit          string `json:"commit"`
+	BuildTime       string `json:"build_time"`
+	GoVersion       string `json:"go_version"`
+	TigrisfsVersion string `json:"tigrisfs_version"`
+	Modified        bool   `json:"modified,omitempty"`
+}
+
+// SessionInfo describes a live terminal session.
+type SessionInfo struct {
+	ID       string            `json:"id"`
+	Created  time.Time         `json:"created"`
+	Name     string            `json:"name"`
+	Tags     []string          `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+	Modes    TerminalModes     `json:"modes"`
+	// Prompt is what the session's shell last reported through shell
+	// integration; nil until it has.
+	Prompt *Prompt `json:"prompt,omitempty"`
+}
+
+// Prompt is the state of a session's shell as of its last prompt.
+type Prompt struct {
+	Cwd string `json:"cwd,omitempty"`
+	// ExitCode is the status of the last command run.
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Running is set while a command runs.
+	Running bool `json:"running"`
+}
+
+// TerminalModes are the terminal modes a session's programs have set, so a
+// client attaching mid-session can restore them.
+type TerminalModes struct {
+	AltScreen bool `json:"alt_screen"`
+	// Mouse is "x10", "normal", "button" or "any"; empty when off.
+	Mouse string `json:"mouse,omitempty"`
+	// MouseEncoding is "sgr", "utf8" or "urxvt"; empty for the default.
+	MouseEncoding  string `json:"mouse_encoding,omitempty"`
+	BracketedPaste bool   `json:"bracketed_paste"`
+	AppCursorKeys  bool   `json:"app_cursor_keys"`
+	CursorHidden   bool   `json:"cursor_hidden"`
+}
+
+// SessionUpdate changes a session's labels. Nil fields are left alone; Tags
+// replaces all tags; Metadata is merged, with a nil value deleting the key.
+type SessionUpdate struct {
+	Name     *string            `json:"name,omitempty"`
+	Tags     *[]string          `json:"tags,omitempty"`
+	Metadata map[string]*string `json:"metadata,omitempty"`
+}
+
+// FileInfo describes a file under /data. Path is relative to /data.
+type FileInfo struct {
+	Path    string    `json:"path"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Mode    uint32    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir"`
+	// Queued is set when the file was written while the container's mount
+	// was failing and isn't in the bucket yet.
+	Queued bool `json:"queued,omitempty"`
+}
+
+// FileOp is one operation of a Batch: "move" or "copy" From to To, or
+// "delete" or "mkdir" Path.
+type FileOp struct {
+	Op        string `json:"op"`
+	From      string `json:"from,omitempty"`
+	To        string `json:"to,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Recursive bool   `json:"recursive,omitempty"`
+}
+
+// FileOpResult is the outcome of one FileOp: "ok", "error", "skipped" or
+// "rolled_back".
+type FileOpResult struct {
+	Op     string    `json:"op"`
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	File   *FileInfo `json:"file,omitempty"`
+}
+
+// ExecRequest runs a command without a PTY. Cwd is relative to /data.
+type ExecRequest struct {
+	Argv    []string          `json:"argv"`
+	Cwd     string            `json:"cwd,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Stdin   []byte            `json:"stdin,omitempty"`
+	Timeout time.Duration     `json:"-"`
+}
+
+// ExecResult is the outcome of a command. ExitCode is -1 and Error is set if
+// the command was killed, for example by its timeout.
+type ExecResult struct {
+	ExitCode  int    `json:"exit_code"`
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	Truncated bool   `json:"truncated"`
+	Error     string `json:"error"`
+}
+
+// Dial connects to the workspace at baseURL and checks that it is healthy.
+func Dial(ctx context.Context, baseURL string, opts *Options) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("client: unsupported scheme %q", u.Scheme)
+	}
+	c := &Client{base: *u}
+	if opts != nil {
+		c.opts = *opts
+	}
+	c.http = c.opts.HTTPClient
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	if _, err := c.Health(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// url returns the absolute URL for the unescaped path p with query merged in.
+func (c *Client) url(p string, query url.Values) *url.URL {
+	u := c.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + p
+	u.RawPath = ""
+	q := u.Query()
+	for k, v := range query {
+		q[k] = v
+	}
+	if c.opts.Name != "" {
+		q.Set("name", c.opts.Name)
+	}
+	u.RawQuery = q.Encode()
+	return &u
+}
+
+func (c *Client) do(ctx context.Context, method, p string, query url.Values, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(p, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.opts.Header {
+		req.Header[k] = v
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// responseError reads the error in a non-2xx response.
+func responseError(resp *http.Response) *Error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	e := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct == "application/problem+json" {
+		var p struct {
+			Type      string       `json:"type"`
+			Detail    string       `json:"detail"`
+			Code      errcode.Code `json:"code"`
+			RequestID string       `json:"request_id"`
+		}
+		if json.Unmarshal(msg, &p) == nil {
+			e.Type, e.Code, e.Message, e.RequestID = p.Type, p.Code, p.Detail, p.RequestID
+		}
+	}
+	return e
+}
+
+// call sends in as JSON (if non-nil) and decodes the response into out (if
+// non-nil).
+func (c *Client) call(ctx context.Context, method, p string, query url.Values, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	resp, err := c.do(ctx, method, p, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Health reports the server's status.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	var h Health
+	if err := c.call(ctx, "GET", "/v1/health", nil, nil, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// Sessions lists live terminal sessions, oldest first.
+func (c *Client) Sessions(ctx context.Context) ([]SessionInfo, error) {
+	var list struct {
+		Sessions []SessionInfo `json:"sessions"`
+	}
+	if err := c.call(ctx, "GET", "/v1/sessions", nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Sessions, nil
+}
+
+// Session describes one session.
+func (c *Client) Session(ctx context.Context, id string) (*SessionInfo, error) {
+	var info SessionInfo
+	if err := c.call(ctx, "GET", "/v1/sessions/"+id, nil, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// UpdateSession changes a session's name, tags, or metadata.
+func (c *Client) UpdateSession(ctx context.Context, id string, u SessionUpdate) (*SessionInfo, error) {
+	var info SessionInfo
+	if err := c.call(ctx, "PATCH", "/v1/sessions/"+id, nil, u, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// CloseSession terminates a session's shell.
+func (c *Client) CloseSession(ctx context.Context, id string) error {
+	return c.call(ctx, "DELETE", "/v1/sessions/"+id, nil, nil, nil)
+}
+
+// Exec runs a command to completion. A non-zero exit status is reported in
+// the result, not as an error.
+func (c *Client) Exec(ctx context.Context, req ExecRequest) (*ExecResult, error) {
+	body := struct {
+		ExecRequest
+		Timeout string `json:"timeout,omitempty"`
+	}{ExecRequest: req}
+	if req.Timeout > 0 {
+		body.Timeout = req.Timeout.String()
+	}
+	var res ExecResult
+	if err := c.call(ctx, "POST", "/v1/exec", nil, body, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func filePath(p string) string {
+	return "/v1/files/" + strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// Stat returns metadata for a file or directory.
+func (c *Client) Stat(ctx context.Context, p string) (*FileInfo, error) {
+	var fi FileInfo
+	if err := c.call(ctx, "GET", filePath(p), url.Values{"stat": {"1"}}, nil, &fi); err != nil {
+		return nil, err
+	}
+	return &fi, nil
+}
+
+// ReadDir lists a directory, sorted by name.
+func (c *Client) ReadDir(ctx context.Context, p string) ([]FileInfo, error) {
+	var list struct {
+		Entries []FileInfo `json:"entries"`
+	}
+	if err := c.call(ctx, "GET", filePath(p), nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Entries, nil
+}
+
+// Download opens a file for reading. The caller must close it.
+func (c *Client) Download(ctx context.Context, p string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, "GET", filePath(p), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Get("Content-Type") == "application/json" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("client: %s is a directory", p)
+	}
+	return resp.Body, nil
+}
+
+// Upload replaces the file at p with the contents of r, creating parent
+// directories. A zero mode means 0644.
+func (c *Client) Upload(ctx context.Context, p string, r io.Reader, mode fs.FileMode) (*FileInfo, error) {
+	var query url.Values
+	if mode != 0 {
+		query = url.Values{"mode": {strconv.FormatUint(uint64(mode.Perm()), 8)}}
+	}
+	resp, err := c.do(ctx, "PUT", filePath(p), query, r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var fi FileInfo
+	if err := json.NewDecoder(resp.Body).Decode(&fi); err != nil {
+		return nil, err
+	}
+	return &fi, nil
+}
+
+// UploadParts uploads a large file straight to the workspace's bucket as a
+// multipart upload, sending size bytes of r in parts, several at a time and
+// retrying each a few times. The upload is aborted if a part keeps failing.
+func (c *Client) UploadParts(ctx context.Context, p string, r io.ReaderAt, size int64) (*FileInfo, error) {
+	var up struct {
+		ID       string `json:"id"`
+		PartSize int64  `json:"part_size"`
+	}
+	if err := c.call(ctx, "POST", "/v1/uploads", nil, map[string]string{"path": p}, &up); err != nil {
+		return nil, err
+	}
+	base := "/v1/uploads/" + url.PathEscape(up.ID)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		ferr error
+		sem  = make(chan struct{}, 4)
+	)
+	for n, off := 1, int64(0); off < size || n == 1; n, off = n+1, off+up.PartSize {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			part := io.NewSectionReader(r, off, min(up.PartSize, size-off))
+			var err error
+			for attempt := 0; attempt < 3 && ctx.Err() == nil; attempt++ {
+				part.Seek(0, io.SeekStart)
+				var resp *http.Response
+				if resp, err = c.do(ctx, "PUT", base+"/"+strconv.Itoa(n), nil, part); err == nil {
+					resp.Body.Close()
+					return
+				}
+			}
+			once.Do(func() { ferr = fmt.Errorf("part %d: %w", n, err); cancel() })
+		}()
+	}
+	wg.Wait()
+	if ferr != nil {
+		c.call(context.Background(), "DELETE", base, nil, nil, nil)
+		return nil, ferr
+	}
+	var fi FileInfo
+	if err := c.call(ctx, "POST", base+"/complete", nil, nil, &fi); err != nil {
+		return nil, err
+	}
+	return &fi, nil
+}
+
+// Batch runs file operations in order. Unless continueOnError is set, the
+// first failure undoes the operations before it; ok reports whether all of
+// them succeeded.
+func (c *Client) Batch(ctx context.Context, ops []FileOp, continueOnError bool) (results []FileOpResult, ok bool, err error) {
+	req := struct {
+		Operations      []FileOp `json:"operations"`
+		ContinueOnError bool     `json:"continue_on_error,omitempty"`
+	}{ops, continueOnError}
+	var resp struct {
+		OK      bool           `json:"ok"`
+		Results []FileOpResult `json:"results"`
+	}
+	if err := c.call(ctx, "POST", "/v1/files:batch", nil, req, &resp); err != nil {
+		return nil, false, err
+	}
+	return resp.Results, resp.OK, nil
+}
+
+// FileVersion is a version of a file kept by the workspace bucket. Deleted
+// marks a deletion rather than contents.
+type FileVersion struct {
+	VersionID string    `json:"version_id"`
+	Latest    bool      `json:"latest"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	ETag      string    `json:"etag,omitempty"`
+}
+
+// Versions lists the versions the bucket keeps of the file at p, newest
+// first. Buckets without versioning fail with a versioning-unsupported
+// Error.
+func (c *Client) Versions(ctx context.Context, p string) ([]FileVersion, error) {
+	var list struct {
+		Versions []FileVersion `json:"versions"`
+	}
+	if err := c.call(ctx, "GET", filePath(p), url.Values{"versions": {"1"}}, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Versions, nil
+}
+
+// Restore replaces the file at p with one of its versions.
+func (c *Client) Restore(ctx context.Context, p, versionID string) (*FileInfo, error) {
+	req := struct {
+		Path      string `json:"path"`
+		VersionID string `json:"version_id"`
+	}{p, versionID}
+	var fi FileInfo
+	if err := c.call(ctx, "POST", "/v1/files:restore", nil, req, &fi); err != nil {
+		return nil, err
+	}
+	return &fi, nil
+}
+
+// Checksum returns the hex-encoded checksum of the file at p by algorithm:
+// "sha256", "sha512", "sha1" or "md5". The server caches it until the file
+// changes.
+func (c *Client) Checksum(ctx context.Context, p, algorithm string) (string, error) {
+	var sum struct {
+		Checksum string `json:"checksum"`
+	}
+	if err := c.call(ctx, "GET", filePath(p), url.Values{"checksum": {algorithm}}, nil, &sum); err != nil {
+		return "", err
+	}
+	return sum.Checksum, nil
+}
+
+// Diff returns a unified diff of two files, with 3 lines of context. It is
+// empty if the files are identical.
+func (c *Client) Diff(ctx context.Context, a, b string) (string, error) {
+	resp, err := c.do(ctx, "GET", "/v1/diff", url.Values{"a": {a}, "b": {b}}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return string(data), err
+}
+
+// Remove deletes a file, or a directory and its contents when recursive is
+// set.
+func (c *Client) Remove(ctx context.Context, p string, recursive bool) error {
+	var query url.Values
+	if recursive {
+		query = url.Values{"recursive": {"1"}}
+	}
+	return c.call(ctx, "DELETE", filePath(p), query, nil, nil)
+}
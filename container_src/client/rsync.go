@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gorilla/websocket"
+)
+
+// rsyncChannel is the /ws/mux channel Rsync opens.
+const rsyncChannel = 1
+
+// muxControl is the part of the /ws/mux control messages Rsync uses.
+type muxControl struct {
+	Type    string   `json:"type"`
+	Channel uint32   `json:"channel,omitempty"`
+	Kind    string   `json:"kind,omitempty"`
+	Cwd     string   `json:"cwd,omitempty"`
+	Argv    []string `json:"argv,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Rsync runs the remote end of an rsync transfer in the workspace, as SSH
+// would for a remote shell given to rsync -e: argv is the command rsync
+// asks the remote shell to run ("rsync --server ..."), and cwd, relative to
+// /data, is where its paths start from. It pipes stdin and stdout over a
+// /ws/mux channel until the command exits.
+func (c *Client) Rsync(ctx context.Context, argv []string, cwd string, stdin io.Reader, stdout io.Writer) error {
+	u := c.url("/ws/mux", nil)
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), c.opts.Header)
+	if err != nil {
+		if resp != nil {
+			e := responseError(resp)
+			if e.Message == "" {
+				e.Message = err.Error()
+			}
+			return e
+		}
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := conn.WriteJSON(muxControl{Type: "open", Channel: rsyncChannel, Kind: "rsync", Cwd: cwd, Argv: argv}); err != nil {
+		return err
+	}
+	opened := false
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if msgType == websocket.BinaryMessage {
+			if len(data) < 4 || binary.BigEndian.Uint32(data) != rsyncChannel {
+				continue
+			}
+			if _, err := stdout.Write(data[4:]); err != nil {
+				return err
+			}
+			continue
+		}
+		var msg muxControl
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Channel != rsyncChannel {
+			continue
+		}
+		switch msg.Type {
+		case "opened":
+			if !opened {
+				opened = true
+				// The only writer from here on: gorilla/websocket allows one.
+				go sendRsyncInput(conn, stdin)
+			}
+		case "closed":
+			if msg.Error != "" {
+				return fmt.Errorf("rsync: %s", msg.Error)
+			}
+			return nil
+		}
+	}
+}
+
+// sendRsyncInput forwards stdin on the channel, then tells the server it
+// ended.
+func sendRsyncInput(conn *websocket.Conn, stdin io.Reader) {
+	buf := make([]byte, 32<<10)
+	frame := make([]byte, 4+len(buf))
+	binary.BigEndian.PutUint32(frame, rsyncChannel)
+	for {
+		n, err := stdin.Read(buf)
+		if n > 0 {
+			copy(frame[4:], buf[:n])
+			if conn.WriteMessage(websocket.BinaryMessage, frame[:4+n]) != nil {
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			conn.WriteJSON(muxControl{Type: "eof", Channel: rsyncChannel})
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"server/container_src/errcode"
+)
+
+// resumeTimeout is how long a resumable Session keeps trying to reconnect;
+// the server keeps the session for two minutes.
+const resumeTimeout = 2 * time.Minute
+
+// Session is an interactive shell on a PTY, attached over the /ws
+// WebSocket. Read returns terminal output and io.EOF once the shell exits;
+// Write sends keystrokes. The shell is killed when the Session is closed.
+type Session struct {
+	c    *Client
+	opts SessionOptions
+
+	wmu  sync.Mutex // serializes writes, and guards conn and what follows
+	conn *websocket.Conn
+	// For resumable sessions: the session's ID, this client's input
+	// sequence, and the input not yet acknowledged, sent again after a
+	// reconnect.
+	id       string
+	clientID string
+	seq      int64
+	unacked  []inputFrame
+
+	rmu     sync.Mutex
+	pending []byte
+	// offset is the output offset read up to, for resumable sessions.
+	offset int64
+}
+
+type inputFrame struct {
+	Type   string `json:"type"` // "input"
+	Client string `json:"client"`
+	Seq    int64  `json:"seq"`
+	Data   string `json:"data"`
+}
+
+// controlMessage is the part of the server's control messages a resumable
+// Session reads.
+type controlMessage struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Offset   int64  `json:"offset"`
+	InputSeq int64  `json:"input_seq"`
+	Seq      int64  `json:"seq"`
+	Client   string `json:"client"`
+}
+
+// SessionOptions configures a new session. A zero size means 80x24.
+type SessionOptions struct {
+	Cols, Rows int
+	Name       string
+	Tags       []string
+	Metadata   map[string]string
+	// Reclaim reconnects to the session with this ID (as listed by
+	// Sessions), started by this client before the server was upgraded,
+	// instead of starting a shell.
+	Reclaim string
+	// Resumable keeps the session when the connection drops, as when the
+	// Durable Object restarts: Read then reconnects and carries on where
+	// it left off, with the output missed meanwhile and the input sent
+	// again that the server hadn't acknowledged. A resumable session's
+	// input is sent as text, so bytes that aren't valid UTF-8 are replaced.
+	Resumable bool
+}
+
+// OpenSession starts a new shell.
+func (c *Client) OpenSession(ctx context.Context, opts SessionOptions) (*Session, error) {
+	q := url.Values{}
+	if opts.Cols > 0 && opts.Rows > 0 {
+		q.Set("cols", strconv.Itoa(opts.Cols))
+		q.Set("rows", strconv.Itoa(opts.Rows))
+	}
+	if opts.Name != "" {
+		q.Set("session_name", opts.Name)
+	}
+	if opts.Reclaim != "" {
+		q.Set("session", opts.Reclaim)
+	}
+	q["tag"] = opts.Tags
+	for k, v := range opts.Metadata {
+		q.Add("meta", k+"="+v)
+	}
+	s := &Session{c: c, opts: opts}
+	if opts.Resumable {
+		var b [8]byte
+		rand.Read(b[:])
+		s.clientID = hex.EncodeToString(b[:])
+		q.Set("control", "1")
+		q.Set("resumable", "1")
+		q.Set("client", s.clientID)
+	}
+	conn, err := c.dialWS(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	return s, nil
+}
+
+func (c *Client) dialWS(ctx context.Context, q url.Values) (*websocket.Conn, error) {
+	u := c.url("/ws", q)
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), c.opts.Header)
+	if err != nil {
+		if resp != nil {
+			e := responseError(resp)
+			if e.Message == "" {
+				e.Message = err.Error()
+			}
+			return nil, e
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Read reads terminal output.
+func (s *Session) Read(p []byte) (int, error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	for len(s.pending) == 0 {
+		s.wmu.Lock()
+		conn := s.conn
+		s.wmu.Unlock()
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				if ce.Code == websocket.CloseNormalClosure {
+					return 0, io.EOF
+				}
+				// A connection closed for a failure with a stable code
+				// isn't resumed.
+				if code := errcode.FromCloseCode(ce.Code); code != "" {
+					return 0, fmt.Errorf("%w: %w", code, err)
+				}
+			}
+			if !s.opts.Resumable || s.resume(conn) != nil {
+				return 0, err
+			}
+			continue
+		}
+		if !s.opts.Resumable || typ == websocket.BinaryMessage {
+			s.pending = data
+			s.offset += int64(len(data))
+			continue
+		}
+		s.control(data)
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// control handles a control message of a resumable session.
+func (s *Session) control(data []byte) {
+	var m controlMessage
+	if json.Unmarshal(data, &m) != nil {
+		return
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	switch m.Type {
+	case "session":
+		s.id = m.ID
+	case "stream":
+		// Output picks up from the offset given, and input past the last
+		// the server applied goes again.
+		s.offset = m.Offset
+		s.ack(m.InputSeq)
+		for _, f := range s.unacked {
+			if s.conn.WriteJSON(f) != nil {
+				break
+			}
+		}
+	case "input_ack":
+		if m.Client == s.clientID {
+			s.ack(m.Seq)
+		}
+	}
+}
+
+// ack drops the input up to seq from what is to be sent again.
+func (s *Session) ack(seq int64) {
+	i := 0
+	for i < len(s.unacked) && s.unacked[i].Seq <= seq {
+		i++
+	}
+	s.unacked = s.unacked[i:]
+}
+
+// resume reconnects a resumable session whose connection, conn, failed,
+// trying until resumeTimeout runs out or the server no longer has it.
+func (s *Session) resume(conn *websocket.Conn) error {
+	s.wmu.Lock()
+	id := s.id
+	s.wmu.Unlock()
+	if id == "" {
+		return errors.New("session ID not known")
+	}
+	conn.Close()
+	q := url.Values{}
+	q.Set("session", id)
+	q.Set("offset", strconv.FormatInt(s.offset, 10))
+	q.Set("control", "1")
+	q.Set("resumable", "1")
+	q.Set("client", s.clientID)
+	deadline := time.Now().Add(resumeTimeout)
+	for delay := 250 * time.Millisecond; ; delay = min(2*delay, 5*time.Second) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		next, err := s.c.dialWS(ctx, q)
+		cancel()
+		if err == nil {
+			s.wmu.Lock()
+			s.conn = next
+			s.wmu.Unlock()
+			return nil
+		}
+		var e *Error
+		if errors.As(err, &e) && e.StatusCode == http.StatusNotFound || time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		time.Sleep(delay)
+	}
+}
+
+// Write sends input to the shell as if typed. A resumable session's input
+// is kept until the server acknowledges it, and a failed write is left to
+// be sent again once Read reconnects.
+func (s *Session) Write(p []byte) (int, error) {
+	if s.opts.Resumable {
+		s.wmu.Lock()
+		defer s.wmu.Unlock()
+		s.seq++
+		f := inputFrame{Type: "input", Client: s.clientID, Seq: s.seq, Data: string(p)}
+		s.unacked = append(s.unacked, f)
+		s.conn.WriteJSON(f)
+		return len(p), nil
+	}
+	if err := s.write(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Resize changes the terminal size.
+func (s *Session) Resize(cols, rows int) error {
+	return s.writeJSON(map[string]any{"type": "resize", "cols": cols, "rows": rows})
+}
+
+// Interrupt sends SIGINT to the program in the foreground, like Ctrl-C.
+func (s *Session) Interrupt() error {
+	return s.writeJSON(map[string]any{"type": "interrupt"})
+}
+
+// EOF types the terminal's end-of-file character, like Ctrl-D.
+func (s *Session) EOF() error {
+	return s.writeJSON(map[string]any{"type": "eof"})
+}
+
+// Suspend stops the program in the foreground, like Ctrl-Z.
+func (s *Session) Suspend() error {
+	return s.writeJSON(map[string]any{"type": "suspend"})
+}
+
+// Close ends the session.
+func (s *Session) Close() error {
+	s.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return s.conn.Close()
+}
+
+func (s *Session) write(msgType int, data []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.conn.WriteMessage(msgType, data)
+}
+
+func (s *Session) writeJSON(v any) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.conn.WriteJSON(v)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxClipboard bounds the workspace clipboard.
+const maxClipboard = 1 << 20
+
+// clipboardBuffer is the workspace's shared clipboard. Programs in any
+// session set it with OSC 52 (tmux, vim and neovim do when configured to),
+// and clients without WebSocket clipboard support read and write it over
+// /v1/clipboard. OSC 52 queries from the shell are answered from it too.
+type clipboardBuffer struct {
+	mu      sync.Mutex
+	data    []byte
+	updated time.Time
+}
+
+var clipboard = &clipboardBuffer{}
+
+func (c *clipboardBuffer) get() ([]byte, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.data, c.updated
+}
+
+func (c *clipboardBuffer) set(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = bytes.Clone(p)
+	c.updated = time.Now()
+}
+
+func handleGetClipboard(w http.ResponseWriter, r *http.Request) {
+	data, updated := clipboard.get()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !updated.IsZero() {
+		w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	}
+	w.Write(data)
+}
+
+func handleSetClipboard(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxClipboard))
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	clipboard.set(data)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var osc52Prefix = []byte("\x1b]52;")
+
+// osc52Scanner finds OSC 52 clipboard sequences ("ESC ] 52 ; c ; <base64>"
+// terminated by BEL or ST) in a session's output, which may split them
+// across reads.
+type osc52Scanner struct {
+	in      bool   // inside a sequence
+	body    []byte // payload so far
+	pending []byte // bytes that may begin a prefix or terminator
+}
+
+// scan feeds output through the scanner, calling handle with the payload
+// ("c;<base64>") of each complete sequence.
+func (sc *osc52Scanner) scan(p []byte, handle func(payload string)) {
+	data := p
+	if len(sc.pending) > 0 {
+		data = append(sc.pending, p...)
+		sc.pending = nil
+	}
+	for len(data) > 0 {
+		if !sc.in {
+			i := bytes.Index(data, osc52Prefix)
+			if i < 0 {
+				for k := min(len(osc52Prefix)-1, len(data)); k > 0; k-- {
+					if bytes.HasSuffix(data, osc52Prefix[:k]) {
+						sc.pending = bytes.Clone(data[len(data)-k:])
+						break
+					}
+				}
+				return
+			}
+			data = data[i+len(osc52Prefix):]
+			sc.in = true
+		}
+
+		j := bytes.IndexAny(data, "\a\x1b")
+		if j < 0 {
+			sc.body = append(sc.body, data...)
+			if len(sc.body) > base64.StdEncoding.EncodedLen(maxClipboard)+16 {
+				// Too big to be a clipboard we'd keep; skip it.
+				sc.in, sc.body = false, nil
+			}
+			return
+		}
+		sc.body = append(sc.body, data[:j]...)
+		n := 1
+		if data[j] == 0x1b {
+			if j+1 == len(data) {
+				sc.pending = []byte{0x1b}
+				return
+			}
+			if data[j+1] == '\\' {
+				n = 2
+			}
+		}
+		handle(string(sc.body))
+		sc.in, sc.body = false, nil
+		data = data[j+n:]
+	}
+}
+
+// handleOSC52 applies an OSC 52 payload from session s: a set updates the
+// clipboard and a query ("c;?") is answered on the PTY like a terminal would.
+func (s *session) handleOSC52(payload string) {
+	sel, data, ok := strings.Cut(payload, ";")
+	if !ok {
+		return
+	}
+	if data == "?" {
+		clip, _ := clipboard.get()
+		reply := "\x1b]52;" + sel + ";" + base64.StdEncoding.EncodeToString(clip) + "\a"
+		if err := s.write([]byte(reply)); err != nil {
+			debugf("Session %s: answering OSC 52 query: %v", s.id, err)
+		}
+		return
+	}
+	clip, err := base64.StdEncoding.DecodeString(data)
+	if err != nil || len(clip) > maxClipboard {
+		debugf("Session %s: ignoring malformed OSC 52 sequence", s.id)
+		return
+	}
+	clipboard.set(clip)
+	debugf("Session %s set the clipboard (%d bytes)", s.id, len(clip))
+}
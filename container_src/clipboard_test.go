@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// useClipboard gives the test an empty workspace clipboard.
+func useClipboard(t *testing.T) {
+	prev := clipboard
+	clipboard = &clipboardBuffer{}
+	t.Cleanup(func() { clipboard = prev })
+}
+
+func TestOSC52Scanner(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{"BEL", []string{"a\x1b]52;c;aGk=\ab"}, []string{"c;aGk="}},
+		{"ST", []string{"\x1b]52;c;aGk=\x1b\\"}, []string{"c;aGk="}},
+		{"split prefix", []string{"out\x1b]5", "2;c;aGk=\a"}, []string{"c;aGk="}},
+		{"split payload and ST", []string{"\x1b]52;c;aG", "k=\x1b", "\\"}, []string{"c;aGk="}},
+		{"two", []string{"\x1b]52;c;YQ==\a\x1b]52;p;?\a"}, []string{"c;YQ==", "p;?"}},
+		{"other OSC", []string{"\x1b]0;title\a"}, nil},
+	} {
+		var sc osc52Scanner
+		var got []string
+		for _, c := range tc.chunks {
+			sc.scan([]byte(c), func(p string) { got = append(got, p) })
+		}
+		if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("%s: payloads %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestClipboardOSC52 checks that a program copying with OSC 52 sets the
+// workspace clipboard, and that the sequence still reaches the control
+// client, for its own terminal to copy.
+func TestClipboardOSC52(t *testing.T) {
+	useClipboard(t)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws?control=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	const seq = "\x1b]52;c;aGVsbG8=\a" // "hello"
+	var out strings.Builder
+	for !strings.Contains(out.String(), seq) {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading for the OSC 52 sequence: %v; got %q", err, out.String())
+		}
+		if typ == websocket.BinaryMessage {
+			out.Write(data)
+			continue
+		}
+		var m sessionMessage
+		if json.Unmarshal(data, &m) == nil && m.Type == "session" {
+			conn.WriteMessage(websocket.TextMessage, []byte(`printf '\033]52;c;%s\a' aGVsbG8=`+"\n"))
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, _ := clipboard.get(); string(data) == "hello" {
+			break
+		}
+		if time.Now().After(deadline) {
+			data, _ := clipboard.get()
+			t.Fatalf("clipboard holds %q, want hello", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, err := http.Get(testURL + "/v1/clipboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("GET /v1/clipboard = %q, want hello", body)
+	}
+}
+
+// TestClipboardShareObserver checks that someone watching a session through
+// an observer link can't set the clipboard through the shell.
+func TestClipboardShareObserver(t *testing.T) {
+	useClipboard(t)
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	resp, err := http.Post(testURL+"/v1/sessions/"+sess.id+"/shares", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var share shareInfo
+	json.NewDecoder(resp.Body).Decode(&share)
+	resp.Body.Close()
+	if share.Mode != shareObserve {
+		t.Fatalf("share %+v, want an observer link", share)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws?share="+share.Token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`printf '\033]52;c;%s\a' b3ducmVk`+"\n")) // "owned"
+	// The owner's input, after the observer's, marks when it would have run.
+	time.Sleep(50 * time.Millisecond)
+	sess.write([]byte("echo done-$((1+1))\n"))
+	var out strings.Builder
+	for !strings.Contains(out.String(), "done-2") {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading the session: %v; got %q", err, out.String())
+		}
+		out.Write(data)
+	}
+	if strings.Contains(out.String(), "\x1b]52;") {
+		t.Errorf("the observer's OSC 52 ran in the session: %q", out.String())
+	}
+	if data, _ := clipboard.get(); len(data) != 0 {
+		t.Errorf("clipboard holds %q after an observer's copy", data)
+	}
+}
@@ -0,0 +1,52 @@
+// Command dos3-rsh is a remote shell for rsync that reaches a workspace
+// over its /ws/mux WebSocket instead of SSH, so directory trees can be
+// synced to and from /data transferring only what changed:
+//
+//	export DOS3_URL=https://do-s3.example.workers.dev
+//	rsync -av -e dos3-rsh ./project dev:project/
+//
+// The host rsync passes, "dev" above, names the workspace; paths are
+// relative to /data. DOS3_TOKEN, if set, is sent as a bearer token.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"server/container_src/client"
+)
+
+func main() {
+	// rsync runs us as: dos3-rsh [-l user] host command...
+	args := os.Args[1:]
+	for len(args) > 0 && args[0] == "-l" && len(args) > 1 {
+		args = args[2:]
+	}
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: rsync -e dos3-rsh SRC WORKSPACE:DEST (with DOS3_URL set)")
+		os.Exit(2)
+	}
+	base := os.Getenv("DOS3_URL")
+	if base == "" {
+		fmt.Fprintln(os.Stderr, "dos3-rsh: DOS3_URL is not set")
+		os.Exit(2)
+	}
+	opts := &client.Options{Name: args[0], Header: http.Header{}}
+	if token := os.Getenv("DOS3_TOKEN"); token != "" {
+		opts.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	c, err := client.Dial(ctx, base, opts)
+	if err == nil {
+		err = c.Rsync(ctx, args[1:], "", os.Stdin, os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dos3-rsh: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// minCompressSize is the smallest response worth compressing; below it
+	// the encoding's overhead outweighs the saving.
+	minCompressSize = 1024
+	// brotliLevel trades ratio for speed: responses are compressed as
+	// they're served, and levels above 5 cost much more CPU for little gain.
+	brotliLevel = 5
+)
+
+var compressedResponses = newCounter("dos3_http_compressed_responses_total",
+	"API responses sent compressed, by encoding (br or gzip).")
+
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+// compress serves h's responses with brotli or gzip when the client
+// accepts them and the body is worth it: at least minCompressSize bytes of
+// a type that isn't compressed already. Downloads are all served as
+// application/octet-stream, so their type is sniffed from the content.
+func compress(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			h(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, status: http.StatusOK}
+		defer cw.close()
+		h(cw, r)
+	}
+}
+
+// negotiateEncoding picks br or gzip from an Accept-Encoding header,
+// preferring br at equal weight, or "" for neither.
+func negotiateEncoding(accept string) string {
+	var br, gz float64 = -1, -1
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "br":
+			br = q
+		case "gzip", "x-gzip":
+			gz = q
+		case "*":
+			br, gz = max(br, q), max(gz, q)
+		}
+	}
+	switch {
+	case br > 0 && br >= gz:
+		return "br"
+	case gz > 0:
+		return "gzip"
+	}
+	return ""
+}
+
+// compressWriter holds back the status and the first minCompressSize bytes
+// of a response to decide whether to compress it.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+
+	wroteHeader bool // WriteHeader was called
+	decided     bool
+	buf         []byte
+	enc         io.WriteCloser // nil when passing the body through
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.decided || c.wroteHeader {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	// Informational responses go out as they come.
+	if code >= 100 && code < 200 {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	c.status = code
+	c.wroteHeader = true
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.decided {
+		c.buf = append(c.buf, p...)
+		if len(c.buf) < minCompressSize {
+			return len(p), nil
+		}
+		if err := c.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if c.enc != nil {
+		return c.enc.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// decide sends the header, compressed or not, and what has been held back.
+func (c *compressWriter) decide() error {
+	c.decided = true
+	h := c.Header()
+	if c.shouldCompress() {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", c.encoding)
+		// Byte ranges would refer to the encoded body.
+		h.Del("Accept-Ranges")
+		// A strong ETag promises the same bytes as the uncompressed body.
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		if c.encoding == "br" {
+			c.enc = brotli.NewWriterLevel(c.ResponseWriter, brotliLevel)
+		} else {
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(c.ResponseWriter)
+			c.enc = gz
+		}
+		compressedResponses.add(1, "encoding", c.encoding)
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	buf := c.buf
+	c.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if c.enc != nil {
+		_, err = c.enc.Write(buf)
+	} else {
+		_, err = c.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (c *compressWriter) shouldCompress() bool {
+	h := c.Header()
+	if c.status != http.StatusOK || h.Get("Content-Encoding") != "" || len(c.buf) < minCompressSize {
+		return false
+	}
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && n < minCompressSize {
+		return false
+	}
+	ct := h.Get("Content-Type")
+	if ct == "" || strings.HasPrefix(ct, "application/octet-stream") {
+		ct = http.DetectContentType(c.buf)
+	}
+	return compressibleType(ct) && !compressedMagic(c.buf)
+}
+
+// compressibleType reports whether a body of media type ct shrinks when
+// compressed: not images, audio, video, fonts or archives, which are
+// compressed already.
+func compressibleType(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mt == "image/svg+xml", mt == "image/bmp":
+		return true
+	case strings.HasPrefix(mt, "image/"), strings.HasPrefix(mt, "audio/"),
+		strings.HasPrefix(mt, "video/"), strings.HasPrefix(mt, "font/"):
+		return false
+	}
+	switch mt {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/x-bzip2",
+		"application/x-xz", "application/zstd", "application/x-7z-compressed",
+		"application/x-rar-compressed", "application/vnd.rar", "application/wasm",
+		"application/pdf", "application/x-font-woff":
+		return false
+	}
+	return true
+}
+
+// compressedMagic recognises compressed formats that DetectContentType
+// doesn't: zstd, xz, bzip2 and 7z.
+func compressedMagic(b []byte) bool {
+	for _, magic := range [][]byte{
+		{0x28, 0xb5, 0x2f, 0xfd},
+		{0xfd, '7', 'z', 'X', 'Z', 0},
+		[]byte("BZh"),
+		{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c},
+	} {
+		if bytes.HasPrefix(b, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush sends what has been held back, compressed or not, and then
+// everything written so far.
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.decide()
+	}
+	if gz, ok := c.enc.(interface{ Flush() error }); ok {
+		gz.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *compressWriter) close() {
+	if !c.decided {
+		if !c.wroteHeader && len(c.buf) == 0 {
+			// The handler wrote nothing; leave the default response to
+			// net/http.
+			return
+		}
+		c.decide()
+	}
+	if c.enc == nil {
+		return
+	}
+	c.enc.Close()
+	if gz, ok := c.enc.(*gzip.Writer); ok {
+		gz.Reset(nil)
+		gzipWriters.Put(gz)
+	}
+}
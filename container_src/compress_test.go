@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCompression(t *testing.T) {
+	text := strings.Repeat("all work and no play\n", 500)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(text))
+	zw.Close()
+	os.MkdirAll(filepath.Join(dataDir, "z"), 0755)
+	t.Cleanup(func() { os.RemoveAll(filepath.Join(dataDir, "z")) })
+	os.WriteFile(filepath.Join(dataDir, "z", "big.txt"), []byte(text), 0644)
+	os.WriteFile(filepath.Join(dataDir, "z", "small.txt"), []byte("hi\n"), 0644)
+	os.WriteFile(filepath.Join(dataDir, "z", "big.txt.gz"), append(gz.Bytes(), make([]byte, 2048)...), 0644)
+
+	get := func(path, accept string, header ...string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", testURL+"/v1/files/"+path, nil)
+		req.Header.Set("Accept-Encoding", accept)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var r io.Reader = resp.Body
+		switch resp.Header.Get("Content-Encoding") {
+		case "br":
+			r = brotli.NewReader(r)
+		case "gzip":
+			if r, err = gzip.NewReader(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		body, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+	for _, tc := range []struct {
+		path, accept, want string
+		header             []string
+	}{
+		{path: "z/big.txt", accept: "gzip, deflate, br", want: "br"},
+		{path: "z/big.txt", accept: "gzip;q=1, br;q=0.5", want: "gzip"},
+		{path: "z/big.txt", accept: "identity"},
+		{path: "z/small.txt", accept: "br"},
+		{path: "z/big.txt.gz", accept: "br"},
+		{path: "z/big.txt", accept: "br", header: []string{"Range", "bytes=0-2047"}},
+		{path: "z", accept: "br"},
+	} {
+		resp, _ := get(tc.path, tc.accept, tc.header...)
+		if got := resp.Header.Get("Content-Encoding"); got != tc.want {
+			t.Errorf("GET %s (Accept-Encoding %q, %v): Content-Encoding %q, want %q", tc.path, tc.accept, tc.header, got, tc.want)
+		}
+	}
+	if _, body := get("z/big.txt", "br"); string(body) != text {
+		t.Errorf("brotli download decoded to %d bytes, want %d", len(body), len(text))
+	}
+	// The file's strong ETag is weakened for the compressed bytes.
+	plain, _ := get("z/big.txt", "identity")
+	compressed, _ := get("z/big.txt", "br")
+	if etag := plain.Header.Get("ETag"); compressed.Header.Get("ETag") != "W/"+etag {
+		t.Errorf("compressed download's ETag %s, want W/%s", compressed.Header.Get("ETag"), etag)
+	}
+}
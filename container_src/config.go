@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// config holds the settings read from CONFIG_FILE. Every field is safe to
+// change at runtime: a SIGHUP re-reads the file and new values apply to the
+// next use without dropping live sessions.
+type config struct {
+	// LogLevel is one of debug, info, warn or error.
+	LogLevel string `json:"log_level"`
+	// TerminalTrafficLog logs sessions' input and output at debug level,
+	// "escaped" or "stripped" of escape sequences; empty disables it.
+	TerminalTrafficLog string `json:"log_terminal_traffic"`
+	// AllowedOrigins restricts WebSocket upgrades to these origins
+	// ("https://example.com"). Empty allows any origin.
+	AllowedOrigins []string `json:"allowed_origins"`
+	// MaxSessions caps concurrent terminal sessions; 0 means unlimited.
+	// Lowering it only affects new connections.
+	MaxSessions int `json:"max_sessions"`
+	// MaxCols and MaxRows bound terminal sizes from clients; larger ones
+	// are clamped to them.
+	MaxCols int `json:"max_cols"`
+	MaxRows int `json:"max_rows"`
+	// PongWait is how long a WebSocket may go without a pong.
+	PongWait duration `json:"pong_wait"`
+	// PingPeriod is how often pings are sent; it must be below PongWait.
+	PingPeriod duration `json:"ping_period"`
+	// RequestTimeout bounds an API request, and a streaming one's calls
+	// into the mount, so a stuck filesystem can't hold handlers forever.
+	RequestTimeout duration `json:"request_timeout"`
+	// LanguageServers maps the names clients may request on an lsp channel
+	// to the command run for them. Setting it replaces the defaults.
+	LanguageServers map[string][]string `json:"language_servers"`
+	// RecordingRetention is how long uploaded session recordings are kept
+	// in the bucket; 0 keeps them forever.
+	RecordingRetention duration `json:"recording_retention"`
+	// TrashRetention is how long files deleted through the file API stay
+	// in /data/.trash before they are purged; 0 keeps them until purged by
+	// hand.
+	TrashRetention duration `json:"trash_retention"`
+	// ManifestInterval is how often the workspace manifest is written to
+	// the bucket; 0 writes it only at shutdown and when asked.
+	ManifestInterval duration `json:"manifest_interval"`
+	// MultipartThreshold is the size in bytes above which a file upload
+	// goes straight to the bucket as a multipart upload instead of through
+	// the mount; 0 sends every upload through the mount.
+	MultipartThreshold int64 `json:"multipart_threshold"`
+	// ContentCacheSize bounds, in bytes, the local disk cache of file
+	// contents downloaded through the file API; 0 disables it.
+	ContentCacheSize int64 `json:"content_cache_size"`
+	// OrphanGracePeriod is how long a process may outlive whatever started
+	// it before the orphan sweeper terminates it; 0 disables the sweeper.
+	OrphanGracePeriod duration `json:"orphan_grace_period"`
+	// IdleSuspend stops the processes of sessions no client has been
+	// attached to for this long, until one attaches again; 0 disables it.
+	IdleSuspend duration `json:"idle_suspend"`
+	// ScrollbackCompressAfter compresses the scrollback of sessions no
+	// client has been attached to, and that have had no output, for this
+	// long, until it is read again; 0 disables it (see scrollback.go).
+	ScrollbackCompressAfter duration `json:"scrollback_compress_after"`
+	// ScrollbackSpillOver is the compressed size in bytes above which
+	// such scrollback goes to local disk instead of memory; 0 keeps it
+	// all in memory. ScrollbackSpillLimit bounds the scrollback on disk
+	// altogether; 0 is unlimited.
+	ScrollbackSpillOver  int64 `json:"scrollback_spill_over"`
+	ScrollbackSpillLimit int64 `json:"scrollback_spill_limit"`
+	// ShellIntegration hooks bash, as new sessions' shell, to report its
+	// prompts, directory and exit codes; see prompt.go.
+	ShellIntegration bool `json:"shell_integration"`
+	// MaxProcesses caps the processes of all sessions and exec commands
+	// together; 0 means unlimited. It needs a pids cgroup to be enforced.
+	MaxProcesses int `json:"max_processes"`
+	// ResourceWarning is the percentage of memory, disk or inodes in use
+	// at which sessions are warned that it is running out; 0 disables the
+	// warnings.
+	ResourceWarning int `json:"resource_warning"`
+	// ConcurrencyLimits caps the API requests running at once in each
+	// class of route (see limits.go), so file API bursts can't take all of
+	// the mount from terminals; further requests wait. 0 is unlimited.
+	ConcurrencyLimits map[string]int `json:"concurrency_limits"`
+	// BulkBytesPerSecond caps how fast bulk work (the bulk class of
+	// concurrency_limits) reads and writes the mount, all of it together;
+	// 0 is unlimited.
+	BulkBytesPerSecond int64 `json:"bulk_bytes_per_second"`
+	// RequireApproval names operations (restore, purge, env) that only
+	// run with a token approved from a control client attached to one of
+	// the requester's sessions (see approvals.go).
+	RequireApproval []string `json:"require_approval"`
+	// Services are supervised background processes, by name. Changes
+	// restart the services whose spec changed.
+	Services map[string]serviceSpec `json:"services"`
+	// PublishPrefix is the bucket prefix /v1/publish copies files to, and
+	// PublishURL the public URL its objects are served under, such as a
+	// Worker route or a public bucket domain; "" means the bucket's own
+	// URL.
+	PublishPrefix string `json:"publish_prefix"`
+	PublishURL    string `json:"publish_url"`
+	// NotifyURL receives POSTs of commandFinishedMessage JSON for the
+	// notifications asked for through /v1/sessions/{id}/notify, with the
+	// S3 auth token as a bearer token.
+	NotifyURL string `json:"notify_url"`
+	// ChangeEvents posts debounced filesystem changes under /data to a
+	// callback, such as the Durable Object's.
+	ChangeEvents changeEventsConfig `json:"change_events"`
+	// Auth chooses how requests are authenticated as a user (see auth.go).
+	Auth authConfig `json:"auth"`
+	// Redact are regular expressions for secrets to replace with
+	// "[redacted]" in what is kept of sessions: transcripts, recordings,
+	// command history and the terminal traffic log. Only a pattern's
+	// first group is replaced, if it has one.
+	Redact []string `json:"redact"`
+	// UnicodeNames is how file names that only differ in their Unicode
+	// normalization are told apart: nfc, reject or keep (see names.go).
+	UnicodeNames string `json:"unicode_names"`
+	// RestorePackages reinstalls the packages recorded in
+	// /data/.packages.json at boot (see packages.go).
+	RestorePackages bool `json:"restore_packages"`
+	// MOTD shows new sessions a message of the day before the shell's
+	// prompt, rendered from /data/.motd (see motd.go).
+	MOTD bool `json:"motd"`
+	// ShellEnv names, as path.Match patterns, the container's variables
+	// passed to sessions' shells, exec, jobs, services, language servers,
+	// rsync and the IDE besides those of defaultShellEnv. Secrets (see
+	// secretEnv) are only passed if named exactly.
+	ShellEnv []string `json:"shell_env"`
+	// TimelineFiles records changes to files under /data in the timeline
+	// (see timeline.go), which watches the tree with inotify from boot.
+	TimelineFiles bool `json:"timeline_files"`
+	// MountStats has tigrisfs log every FUSE operation, so /v1/cache can
+	// report hit ratios and /v1/durability see changes before their
+	// upload. It is read when the bucket is mounted.
+	MountStats bool `json:"mount_stats"`
+
+	level  logLevel
+	redact []*regexp.Regexp
+}
+
+// duration is a time.Duration written as a string ("45s") in JSON.
+type duration struct{ time.Duration }
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+var defaultConfig = config{
+	LogLevel:       "info",
+	PongWait:       duration{60 * time.Second},
+	PingPeriod:     duration{54 * time.Second},
+	RequestTimeout: duration{30 * time.Second},
+	MaxCols:        1000,
+	MaxRows:        1000,
+	LanguageServers: map[string][]string{
+		"gopls":   {"gopls", "serve"},
+		"pyright": {"pyright-langserver", "--stdio"},
+	},
+	RecordingRetention:      duration{30 * 24 * time.Hour},
+	TrashRetention:          duration{7 * 24 * time.Hour},
+	ManifestInterval:        duration{5 * time.Minute},
+	MultipartThreshold:      64 << 20,
+	ContentCacheSize:        1 << 30,
+	OrphanGracePeriod:       duration{time.Minute},
+	ScrollbackCompressAfter: duration{10 * time.Minute},
+	ScrollbackSpillLimit:    256 << 20,
+	MaxProcesses:            1024,
+	ResourceWarning:         90,
+	ConcurrencyLimits:       map[string]int{classFiles: 16, classSearch: 2, classBulk: 4},
+	ShellIntegration:        true,
+	PublishPrefix:           "public/",
+	UnicodeNames:            namesNFC,
+	RestorePackages:         true,
+	MOTD:                    true,
+	TimelineFiles:           true,
+	ChangeEvents:            changeEventsConfig{Debounce: duration{2 * time.Second}},
+	level:                   levelInfo,
+}
+
+// configPath is the optional JSON config file; without one the defaults apply
+// and SIGHUP is a no-op.
+var configPath = os.Getenv("CONFIG_FILE")
+
+var activeConfig atomic.Pointer[config]
+
+func currentConfig() *config {
+	if c := activeConfig.Load(); c != nil {
+		return c
+	}
+	return &defaultConfig
+}
+
+// loadConfig reads path over the defaults. Unknown fields are rejected so a
+// typo doesn't silently leave a setting at its default.
+func loadConfig(path string) (*config, error) {
+	c := defaultConfig
+	c.AllowedOrigins = nil
+	if path == "" {
+		return &c, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Decoding into the default maps would modify them.
+	c.LanguageServers = nil
+	c.ConcurrencyLimits = nil
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if c.LanguageServers == nil {
+		c.LanguageServers = defaultConfig.LanguageServers
+	}
+	// Classes left out keep their default limits.
+	for class, n := range defaultConfig.ConcurrencyLimits {
+		if _, ok := c.ConcurrencyLimits[class]; !ok {
+			if c.ConcurrencyLimits == nil {
+				c.ConcurrencyLimits = make(map[string]int)
+			}
+			c.ConcurrencyLimits[class] = n
+		}
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+func (c *config) validate() error {
+	var errs []error
+	level, err := parseLogLevel(c.LogLevel)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	c.level = level
+	if err := checkTrafficLogMode(c.TerminalTrafficLog); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkNamePolicy(c.UnicodeNames); err != nil {
+		errs = append(errs, err)
+	}
+	redact, err := compileRedact(c.Redact)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	c.redact = redact
+	if c.MaxSessions < 0 {
+		errs = append(errs, errors.New("max_sessions must not be negative"))
+	}
+	if c.MaxCols < 1 || c.MaxCols > math.MaxUint16 || c.MaxRows < 1 || c.MaxRows > math.MaxUint16 {
+		errs = append(errs, fmt.Errorf("max_cols and max_rows must be 1-%d", math.MaxUint16))
+	}
+	if c.RecordingRetention.Duration < 0 {
+		errs = append(errs, errors.New("recording_retention must not be negative"))
+	}
+	if c.TrashRetention.Duration < 0 {
+		errs = append(errs, errors.New("trash_retention must not be negative"))
+	}
+	if c.ManifestInterval.Duration < 0 {
+		errs = append(errs, errors.New("manifest_interval must not be negative"))
+	}
+	if c.MultipartThreshold < 0 {
+		errs = append(errs, errors.New("multipart_threshold must not be negative"))
+	}
+	if c.ContentCacheSize < 0 {
+		errs = append(errs, errors.New("content_cache_size must not be negative"))
+	}
+	if c.MaxProcesses < 0 {
+		errs = append(errs, errors.New("max_processes must not be negative"))
+	}
+	if err := checkConcurrencyLimits(c.ConcurrencyLimits); err != nil {
+		errs = append(errs, err)
+	}
+	if c.BulkBytesPerSecond < 0 {
+		errs = append(errs, errors.New("bulk_bytes_per_second must not be negative"))
+	}
+	if err := checkApprovalPolicy(c.RequireApproval); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkShellEnv(c.ShellEnv); err != nil {
+		errs = append(errs, err)
+	}
+	if c.ResourceWarning < 0 || c.ResourceWarning > 100 {
+		errs = append(errs, errors.New("resource_warning must be a percentage from 0 to 100"))
+	}
+	if c.OrphanGracePeriod.Duration < 0 {
+		errs = append(errs, errors.New("orphan_grace_period must not be negative"))
+	}
+	if c.IdleSuspend.Duration < 0 {
+		errs = append(errs, errors.New("idle_suspend must not be negative"))
+	}
+	if c.ScrollbackCompressAfter.Duration < 0 {
+		errs = append(errs, errors.New("scrollback_compress_after must not be negative"))
+	}
+	if c.ScrollbackSpillOver < 0 || c.ScrollbackSpillLimit < 0 {
+		errs = append(errs, errors.New("scrollback_spill_over and scrollback_spill_limit must not be negative"))
+	}
+	if c.PongWait.Duration <= 0 || c.PingPeriod.Duration <= 0 {
+		errs = append(errs, errors.New("pong_wait and ping_period must be positive"))
+	} else if c.PingPeriod.Duration >= c.PongWait.Duration {
+		errs = append(errs, errors.New("ping_period must be shorter than pong_wait"))
+	}
+	if c.RequestTimeout.Duration <= 0 {
+		errs = append(errs, errors.New("request_timeout must be positive"))
+	}
+	for name, argv := range c.LanguageServers {
+		if len(argv) == 0 {
+			errs = append(errs, fmt.Errorf("language_servers: %q has no command", name))
+		}
+	}
+	for name, svc := range c.Services {
+		if len(svc.Argv) == 0 {
+			errs = append(errs, fmt.Errorf("services: %q has no argv", name))
+		}
+		if svc.TTY && svc.Stdin {
+			errs = append(errs, fmt.Errorf("services: %q: stdin only applies without tty", name))
+		}
+	}
+	if p := c.PublishPrefix; p == "" || p[0] == '/' || !strings.HasSuffix(p, "/") || path.Clean(p)+"/" != p {
+		errs = append(errs, fmt.Errorf("publish_prefix %q must be a clean relative path ending in /", p))
+	}
+	if u := c.PublishURL; u != "" {
+		if pu, err := url.Parse(u); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			errs = append(errs, fmt.Errorf("publish_url %q is not an http(s) URL", u))
+		}
+	}
+	if u := c.NotifyURL; u != "" {
+		if pu, err := url.Parse(u); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			errs = append(errs, fmt.Errorf("notify_url %q is not an http(s) URL", u))
+		}
+	}
+	if u := c.ChangeEvents.URL; u != "" {
+		if pu, err := url.Parse(u); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			errs = append(errs, fmt.Errorf("change_events: url %q is not an http(s) URL", u))
+		}
+	}
+	if c.ChangeEvents.Debounce.Duration <= 0 {
+		errs = append(errs, errors.New("change_events: debounce must be positive"))
+	}
+	if err := c.Auth.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, o := range c.AllowedOrigins {
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("allowed_origins: %q is not an origin like https://example.com", o))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reloadConfig re-reads configPath, keeping the running config on error.
+func reloadConfig() {
+	if configPath == "" {
+		infof("SIGHUP received but CONFIG_FILE is not set, nothing to reload")
+		return
+	}
+	next, err := loadConfig(configPath)
+	if err != nil {
+		warnf("Config reload failed, keeping current config: %v", err)
+		return
+	}
+	prev := activeConfig.Swap(next)
+	logConfigChanges(prev, next)
+	if err := workspace.reload(); err != nil {
+		warnf("Workspace file reload failed, keeping the current one: %v", err)
+	}
+	services.sync()
+	syncChangeEvents()
+}
+
+func logConfigChanges(prev, next *config) {
+	pv, nv := reflect.ValueOf(*prev), reflect.ValueOf(*next)
+	changed := false
+	for i := 0; i < pv.NumField(); i++ {
+		f := pv.Type().Field(i)
+		if !f.IsExported() || reflect.DeepEqual(pv.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		changed = true
+		// Log unconditionally so the change is visible even when the new
+		// level would hide info messages.
+		log.Printf("Config %s changed: %v -> %v", f.Tag.Get("json"), pv.Field(i).Interface(), nv.Field(i).Interface())
+	}
+	if !changed {
+		infof("Config reloaded from %s, no changes", configPath)
+	}
+}
+
+// checkOrigin enforces AllowedOrigins. Requests without an Origin header come
+// from non-browser clients and are allowed.
+func checkOrigin(r *http.Request) bool {
+	allowed := currentConfig().AllowedOrigins
+	origin := r.Header.Get("Origin")
+	if len(allowed) == 0 || origin == "" {
+		return true
+	}
+	if slices.Contains(allowed, origin) {
+		return true
+	}
+	warnf("Rejected WebSocket from origin %q", origin)
+	return false
+}
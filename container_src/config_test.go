@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logBuffer collects the log for a test; other goroutines may log
+// meanwhile.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// take returns what was logged since the last call.
+func (b *logBuffer) take() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.buf.String()
+	b.buf.Reset()
+	return s
+}
+
+func captureLog(t *testing.T) *logBuffer {
+	b := &logBuffer{}
+	log.SetOutput(b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return b
+}
+
+// TestReloadConfig checks what a SIGHUP does: a changed file is applied and
+// its changes logged, and an invalid one is rejected, keeping the running
+// config.
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	prevPath, prev := configPath, activeConfig.Load()
+	configPath = path
+	t.Cleanup(func() {
+		configPath = prevPath
+		activeConfig.Store(prev)
+	})
+	// As main has at boot.
+	defaults := *currentConfig()
+	activeConfig.Store(&defaults)
+	logs := captureLog(t)
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"max_sessions": 7, "pong_wait": "90s"}`)
+	reloadConfig()
+	cfg := currentConfig()
+	if cfg.MaxSessions != 7 || cfg.PongWait.Seconds() != 90 {
+		t.Fatalf("after reload: max_sessions %d, pong_wait %s", cfg.MaxSessions, cfg.PongWait)
+	}
+	out := logs.take()
+	for _, want := range []string{"Config max_sessions changed:", "-> 7", "Config pong_wait changed:"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log after a change lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "max_cols") {
+		t.Errorf("unchanged setting logged as changed:\n%s", out)
+	}
+
+	reloadConfig()
+	if out := logs.take(); !strings.Contains(out, "no changes") || strings.Contains(out, "changed:") {
+		t.Errorf("log after reloading the same file:\n%s", out)
+	}
+	cfg = currentConfig()
+
+	for _, bad := range []string{
+		`{"max_sessions": 3, "max_sesions": 4}`, // unknown field
+		`{"max_sessions": 3, "log_level": "loud"}`,
+		`{"max_sessions": 3, "pong_wait": "10s", "ping_period": "20s"}`,
+		`{"max_sessions": 3`,
+	} {
+		write(bad)
+		reloadConfig()
+		if currentConfig() != cfg {
+			t.Errorf("config replaced by the invalid %s", bad)
+			activeConfig.Store(cfg)
+		}
+		if out := logs.take(); !strings.Contains(out, "Config reload failed, keeping current config") {
+			t.Errorf("log after the invalid %s:\n%s", bad, out)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// etagXattr is the extended attribute through which tigrisfs reports the
+// ETag of the object behind a file.
+const etagXattr = "s3.etag"
+
+var (
+	contentCacheLookups = newCounter("dos3_content_cache_lookups_total",
+		"File API downloads by content cache result: hit, miss, or bypass for files it can't serve.")
+	contentCacheEvictions = newCounter("dos3_content_cache_evictions_total",
+		"Files dropped from the content cache to stay within content_cache_size.")
+	_ = newGaugeFunc("dos3_content_cache_bytes",
+		"Bytes held by the content cache.",
+		func() float64 { s := content.stats(); return float64(s.Bytes) })
+)
+
+// objectETag returns the ETag of the object behind the file at full, or
+// "" if the mount doesn't say. Tests replace it.
+var objectETag = func(full string) string {
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(full, etagXattr, buf)
+	if err != nil || n <= 0 {
+		return ""
+	}
+	return strings.Trim(string(buf[:n]), `"`)
+}
+
+// contentCache keeps the contents of files downloaded through the file API
+// on local disk, keyed by their object's ETag, so that reading the same
+// contents again, at whatever path, skips the round trip to the bucket
+// that tigrisfs makes once its own cache has let them go. An ETag names
+// one version of an object's contents, so entries never go stale; the
+// least recently used are dropped to stay within content_cache_size.
+type contentCache struct {
+	dir string
+
+	mu      sync.Mutex
+	lru     *list.List // of *contentEntry, most recently used first
+	entries map[string]*list.Element
+	bytes   int64
+	filling map[string]bool
+}
+
+type contentEntry struct {
+	key  string
+	size int64
+}
+
+type contentCacheStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	// Limit is content_cache_size; 0 when the cache is off.
+	Limit  int64 `json:"limit"`
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+var content = newContentCache(filepath.Join(os.TempDir(), "dos3-content-cache"))
+
+func newContentCache(dir string) *contentCache {
+	return &contentCache{
+		dir:     dir,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		filling: make(map[string]bool),
+	}
+}
+
+// load picks up the entries left by a previous run, oldest last, and
+// removes unfinished ones.
+func (c *contentCache) load() {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		warnf("Content cache disabled: %v", err)
+		return
+	}
+	dirents, err := os.ReadDir(c.dir)
+	if err != nil {
+		warnf("Reading the content cache: %v", err)
+		return
+	}
+	var found []os.FileInfo
+	for _, d := range dirents {
+		fi, err := d.Info()
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(d.Name(), ".") || !fi.Mode().IsRegular() {
+			os.Remove(filepath.Join(c.dir, d.Name()))
+			continue
+		}
+		found = append(found, fi)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ModTime().After(found[j].ModTime()) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fi := range found {
+		c.entries[fi.Name()] = c.lru.PushBack(&contentEntry{fi.Name(), fi.Size()})
+		c.bytes += fi.Size()
+	}
+	c.evictLocked(currentConfig().ContentCacheSize)
+	if len(found) > 0 {
+		infof("Content cache has %d files (%d bytes) from a previous run", c.lru.Len(), c.bytes)
+	}
+}
+
+func contentKey(etag string) string {
+	sum := sha256.Sum256([]byte(etag))
+	return hex.EncodeToString(sum[:])
+}
+
+// open returns the cached contents of the file f, opened through the mount
+// and described by fi, or nil if it has to be read from the mount. A miss
+// fills the cache in the background for next time.
+func (c *contentCache) open(f *os.File, fi fileInfo) *os.File {
+	limit := currentConfig().ContentCacheSize
+	// Files queued for the bucket, or written since it last caught up, may
+	// not be what their object's ETag names.
+	if limit <= 0 || !mountReady.Load() || fi.Queued || durability.unsaved(fi.ModTime) {
+		contentCacheLookups.add(1, "result", "bypass")
+		return nil
+	}
+	etag := objectETag(f.Name())
+	if etag == "" {
+		contentCacheLookups.add(1, "result", "bypass")
+		return nil
+	}
+	key := contentKey(etag)
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok && el.Value.(*contentEntry).size == fi.Size {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		if cf, err := os.Open(filepath.Join(c.dir, key)); err == nil {
+			contentCacheLookups.add(1, "result", "hit")
+			return cf
+		}
+		c.mu.Lock()
+		if c.entries[key] == el {
+			c.removeLocked(el)
+		}
+	}
+	fill := fi.Size <= limit/8 && !c.filling[key]
+	if fill {
+		c.filling[key] = true
+	}
+	c.mu.Unlock()
+	contentCacheLookups.add(1, "result", "miss")
+	if fill {
+		go c.fill(key, etag, f.Name(), fi.Size)
+	}
+	return nil
+}
+
+// fill copies the file at full into the cache as key, if its object is
+// still etag once copied.
+func (c *contentCache) fill(key, etag, full string, size int64) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.filling, key)
+		c.mu.Unlock()
+	}()
+	src, err := os.Open(full)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(c.dir, ".fill-*")
+	if err != nil {
+		debugf("Content cache: %v", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || n != size || objectETag(full) != etag {
+		return
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, key)); err != nil {
+		debugf("Content cache: %v", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.removeEntryLocked(el)
+	}
+	c.entries[key] = c.lru.PushFront(&contentEntry{key, size})
+	c.bytes += size
+	c.evictLocked(currentConfig().ContentCacheSize)
+}
+
+// evictLocked drops the least recently used entries until the cache is
+// within limit.
+func (c *contentCache) evictLocked(limit int64) {
+	for c.bytes > limit && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back())
+		contentCacheEvictions.add(1)
+	}
+}
+
+// removeLocked drops an entry and its file.
+func (c *contentCache) removeLocked(el *list.Element) {
+	os.Remove(filepath.Join(c.dir, el.Value.(*contentEntry).key))
+	c.removeEntryLocked(el)
+}
+
+func (c *contentCache) removeEntryLocked(el *list.Element) {
+	e := c.lru.Remove(el).(*contentEntry)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+}
+
+func (c *contentCache) stats() contentCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return contentCacheStats{
+		Entries: c.lru.Len(),
+		Bytes:   c.bytes,
+		Limit:   max(0, currentConfig().ContentCacheSize),
+		Hits:    int64(contentCacheLookups.get("result", "hit")),
+		Misses:  int64(contentCacheLookups.get("result", "miss")),
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestContentCache(t *testing.T) {
+	prevCache, prevETag := content, objectETag
+	content = newContentCache(t.TempDir())
+	etags := map[string]string{}
+	var mu sync.Mutex
+	objectETag = func(full string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return etags[relPath(full)]
+	}
+	mountReady.Store(true)
+	cfg := *currentConfig()
+	cfg.ContentCacheSize = 16
+	prevConfig := activeConfig.Swap(&cfg)
+	t.Cleanup(func() {
+		// Let background fills finish before swapping back what they use.
+		for {
+			content.mu.Lock()
+			n := len(content.filling)
+			content.mu.Unlock()
+			if n == 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		content, objectETag = prevCache, prevETag
+		mountReady.Store(false)
+		activeConfig.Store(prevConfig)
+	})
+	put := func(p, data, etag string) {
+		t.Helper()
+		full := filepath.Join(dataDir, p)
+		os.MkdirAll(filepath.Dir(full), 0755)
+		if err := os.WriteFile(full, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		etags[p] = etag
+		mu.Unlock()
+	}
+	get := func(p string) string {
+		t.Helper()
+		resp, err := http.Get(testURL + "/v1/files/" + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return string(data)
+	}
+	waitCached := func(etag string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			content.mu.Lock()
+			_, ok := content.entries[contentKey(etag)]
+			content.mu.Unlock()
+			if ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s never reached the content cache", etag)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	before := content.stats()
+	put("cc/a.txt", "v1", "e1")
+	if got := get("cc/a.txt"); got != "v1" {
+		t.Fatalf("first read = %q", got)
+	}
+	waitCached("e1")
+	// The cache answers for the ETag, whatever the mount would read, and
+	// for any path with the same contents.
+	put("cc/a.txt", "xx", "e1")
+	put("cc/b.txt", "yy", "e1")
+	if got := get("cc/a.txt"); got != "v1" {
+		t.Errorf("cached read = %q, want v1", got)
+	}
+	if got := get("cc/b.txt"); got != "v1" {
+		t.Errorf("read of the same contents elsewhere = %q, want v1", got)
+	}
+	if s := content.stats(); s.Hits-before.Hits != 2 || s.Misses-before.Misses != 1 {
+		t.Errorf("stats = %+v from %+v, want 2 hits and 1 miss", s, before)
+	}
+	// A new version is a new ETag.
+	put("cc/a.txt", "v2", "e2")
+	if got := get("cc/a.txt"); got != "v2" {
+		t.Errorf("read of a new version = %q", got)
+	}
+	waitCached("e2")
+
+	// Past content_cache_size, the least recently used go.
+	for i := range 7 {
+		p := fmt.Sprintf("cc/f%d", i)
+		put(p, "zz", fmt.Sprint("f", i))
+		get(p)
+		waitCached(fmt.Sprint("f", i))
+	}
+	if s := content.stats(); s.Bytes > 16 {
+		t.Errorf("cache holds %d bytes, over its 16", s.Bytes)
+	}
+	put("cc/a.txt", "xx", "e1")
+	if got := get("cc/a.txt"); got != "xx" {
+		t.Errorf("read after eviction = %q, want the mount's xx", got)
+	}
+}
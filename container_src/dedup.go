@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// inputSeqWindow is how long a client's input sequence is remembered
+	// after its last sequenced input; a retransmission later than that is
+	// applied again.
+	inputSeqWindow = 10 * time.Minute
+	// maxInputClients bounds the sequences remembered per terminal; past
+	// it, the least recently used is forgotten.
+	maxInputClients = 64
+)
+
+var inputDuplicates = newCounter("dos3_input_duplicates_total",
+	"Sequenced terminal input dropped as a retransmission of input already applied.")
+
+// inputDedup drops input retransmitted by a client that can't tell whether
+// it arrived before its connection failed, so a command isn't typed
+// twice. Clients number their input frames from 1 in a sequence of their
+// own, named by a client ID so several can share a terminal, and send
+// again everything not acknowledged; frames numbered no higher than the
+// last applied are duplicates.
+type inputDedup struct {
+	mu   sync.Mutex
+	seqs map[string]inputSeq
+}
+
+type inputSeq struct {
+	Last int64     `json:"last"`
+	Seen time.Time `json:"seen"`
+}
+
+// fresh reports whether input seq from client is new, and if so records it
+// as applied.
+func (d *inputDedup) fresh(client string, seq int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if d.seqs == nil {
+		d.seqs = make(map[string]inputSeq)
+	}
+	var oldest string
+	for c, s := range d.seqs {
+		if now.Sub(s.Seen) > inputSeqWindow {
+			delete(d.seqs, c)
+		} else if oldest == "" || s.Seen.Before(d.seqs[oldest].Seen) {
+			oldest = c
+		}
+	}
+	if s, ok := d.seqs[client]; ok && seq <= s.Last {
+		inputDuplicates.add(1)
+		return false
+	}
+	if _, ok := d.seqs[client]; !ok && len(d.seqs) >= maxInputClients {
+		delete(d.seqs, oldest)
+	}
+	d.seqs[client] = inputSeq{Last: seq, Seen: now}
+	return true
+}
+
+// last returns the last input seq applied from client, 0 if none is
+// remembered.
+func (d *inputDedup) last(client string) int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.seqs[client].Last
+}
+
+// snapshot and restore carry the sequences across an upgrade.
+func (d *inputDedup) snapshot() map[string]inputSeq {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.seqs) == 0 {
+		return nil
+	}
+	out := make(map[string]inputSeq, len(d.seqs))
+	for c, s := range d.seqs {
+		out[c] = s
+	}
+	return out
+}
+
+func (d *inputDedup) restore(seqs map[string]inputSeq) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seqs = seqs
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestInputDedup(t *testing.T) {
+	before := inputDuplicates.get()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws?control=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A retransmission after a reconnect repeats the sequence number.
+	for range 2 {
+		if err := conn.WriteJSON(map[string]any{"type": "input", "client": "tab", "seq": 1, "data": "echo once\n"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var acks []inputAckMessage
+	for len(acks) < 2 {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ack inputAckMessage
+		if typ == websocket.TextMessage && json.Unmarshal(data, &ack) == nil && ack.Type == "input_ack" {
+			acks = append(acks, ack)
+		}
+	}
+	if acks[0].Duplicate || !acks[1].Duplicate || acks[1].Seq != 1 || acks[1].Client != "tab" {
+		t.Fatalf("acks = %+v, want the second marked duplicate", acks)
+	}
+
+	// Input POSTed with a sequence number is deduplicated the same way.
+	resp, err := http.Post(testURL+"/v1/poll", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var poll pollResponse
+	json.NewDecoder(resp.Body).Decode(&poll)
+	resp.Body.Close()
+	defer dialTest(t).CloseSession(context.Background(), poll.ID)
+	for _, q := range []string{"seq=1", "seq=1", "seq=1&client=other"} {
+		resp, err := http.Post(testURL+"/v1/sessions/"+poll.ID+"/input?"+q, "", strings.NewReader("true\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("input with %s: %s", q, resp.Status)
+		}
+	}
+	resp, err = http.Post(testURL+"/v1/sessions/"+poll.ID+"/input?seq=0", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("input with seq=0: %s", resp.Status)
+	}
+	if n := inputDuplicates.get() - before; n != 2 {
+		t.Fatalf("%v duplicates dropped, want 2", n)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// degradedRetryMin and degradedRetryMax bound the wait between attempts
+	// to mount the bucket after a degraded start.
+	degradedRetryMin = 15 * time.Second
+	degradedRetryMax = 5 * time.Minute
+)
+
+var degradedGauge = newGauge("dos3_degraded",
+	"1 while /data is on local disk because the bucket couldn't be mounted.")
+
+// degradedState tracks running without the bucket. When it can't be mounted
+// at boot the server starts anyway, with /data a plain directory on the
+// container's disk, and keeps trying to mount it in the background. New
+// sessions are warned that what they write there isn't being saved.
+type degradedState struct {
+	mu     sync.Mutex
+	reason error
+	since  time.Time
+}
+
+var degraded degradedState
+
+// enter switches to degraded mode after mounting opts failed with err.
+func (d *degradedState) enter(opts mountOptions, err error) {
+	warnf("Starting in degraded mode, /data is on local disk: %v", err)
+	d.mu.Lock()
+	d.reason = err
+	d.since = time.Now()
+	d.mu.Unlock()
+	degradedGauge.set(1)
+	events.publish(event{Kind: eventMountDegraded, Err: err})
+	go d.retry(opts)
+}
+
+// status is why the server is degraded, or "" when it isn't.
+func (d *degradedState) status() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.reason == nil {
+		return ""
+	}
+	return d.reason.Error()
+}
+
+// banner is the warning shown in new sessions while degraded, or "".
+func (d *degradedState) banner() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.reason == nil {
+		return ""
+	}
+	return fmt.Sprintf("The bucket is unreachable (since %s): %s is on local disk and is not being saved. "+
+		"It switches over once the bucket is back.", d.since.UTC().Format(time.RFC3339), dataDir)
+}
+
+// retry checks the bucket with backoff until it answers, then switches over
+// to it.
+func (d *degradedState) retry(opts mountOptions) {
+	wait := degradedRetryMin
+	for {
+		time.Sleep(wait)
+		if err := checkBucket(opts); err != nil {
+			debugf("Bucket still unavailable: %v", err)
+		} else if err := d.switchOver(opts); err != nil {
+			warnf("Bucket is reachable again but mounting it failed: %v", err)
+		} else {
+			return
+		}
+		wait = min(wait*2, degradedRetryMax)
+	}
+}
+
+// switchOver mounts the bucket at dataDir. Anything written to the local
+// directory meanwhile is moved aside rather than hidden under the mount or
+// merged into the bucket unasked.
+func (d *degradedState) switchOver(opts mountOptions) error {
+	var aside string
+	if entries, _ := os.ReadDir(dataDir); len(entries) > 0 {
+		aside = fmt.Sprintf("%s.degraded-%s", dataDir, time.Now().UTC().Format("20060102T150405Z"))
+		if err := os.Rename(dataDir, aside); err != nil {
+			warnf("Could not move local %s aside, mounting over it: %v", dataDir, err)
+			aside = ""
+		}
+	}
+	if err := mount(opts); err != nil {
+		if aside != "" {
+			os.Remove(dataDir)
+			if err := os.Rename(aside, dataDir); err != nil {
+				warnf("Restoring local %s from %s: %v", dataDir, aside, err)
+			}
+		}
+		return err
+	}
+	useBucket(opts)
+	instantiateTemplate(opts)
+	loadWorkspace(&opts)
+	services.sync()
+
+	d.mu.Lock()
+	since := d.since
+	d.reason = nil
+	d.mu.Unlock()
+	degradedGauge.set(0)
+	infof("Bucket mounted after %s in degraded mode", time.Since(since).Round(time.Second))
+	events.publish(event{Kind: eventMountRecovered})
+
+	msg := fmt.Sprintf("The bucket is back and mounted at %s. Run `cd %s` in shells opened before now.", dataDir, dataDir)
+	if aside != "" {
+		msg += fmt.Sprintf(" Files written meanwhile were moved to %s.", aside)
+	}
+	for _, s := range sessions.list() {
+		s.notice(msg)
+	}
+	return nil
+}
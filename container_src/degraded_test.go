@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"server/container_src/client"
+	"server/container_src/internal/termtest"
+)
+
+func TestDegradedBanner(t *testing.T) {
+	degraded.mu.Lock()
+	degraded.reason, degraded.since = errors.New("S3 endpoint is unreachable"), time.Now()
+	degraded.mu.Unlock()
+	t.Cleanup(func() {
+		degraded.mu.Lock()
+		degraded.reason = nil
+		degraded.mu.Unlock()
+	})
+
+	c := dialTest(t)
+	h, err := c.Health(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Status != "degraded" || h.Degraded != "S3 endpoint is unreachable" {
+		t.Fatalf("Health = %+v, want degraded", h)
+	}
+	term := termtest.Open(t, c, client.SessionOptions{})
+	term.Expect(`not being saved`)
+}
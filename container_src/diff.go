@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// maxDiffFile caps each side of a diff.
+	maxDiffFile = 4 << 20
+	// maxDiffEdits bounds the work spent looking for a minimal diff. Files
+	// further apart than this are still diffed, just not minimally: the
+	// part between their common prefix and suffix is replaced wholesale.
+	maxDiffEdits = 1000
+	// defaultDiffContext is diff -u's number of context lines.
+	defaultDiffContext = 3
+)
+
+var errFileTooLarge = errors.New("file too large")
+
+// devNull names the missing side of a diff.
+const devNull = "/dev/null"
+
+// diffOp is one line of an edit script: kept (' '), deleted from a ('-') or
+// inserted from b ('+'), with the line's index in its file.
+type diffOp struct {
+	kind byte
+	a, b int
+}
+
+// splitLines splits p after each newline; the last line may lack one.
+func splitLines(p []byte) [][]byte {
+	var lines [][]byte
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			lines = append(lines, p)
+			break
+		}
+		lines = append(lines, p[:i+1])
+		p = p[i+1:]
+	}
+	return lines
+}
+
+// editScript returns the ops turning a into b.
+func editScript(a, b [][]byte) []diffOp {
+	// Common prefix and suffix cost nothing to match and often make up
+	// most of the files.
+	pre := 0
+	for pre < len(a) && pre < len(b) && bytes.Equal(a[pre], b[pre]) {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && bytes.Equal(a[len(a)-1-suf], b[len(b)-1-suf]) {
+		suf++
+	}
+
+	var ops []diffOp
+	for i := range pre {
+		ops = append(ops, diffOp{' ', i, i})
+	}
+	mid, ok := myers(a[pre:len(a)-suf], b[pre:len(b)-suf])
+	if !ok {
+		mid = mid[:0]
+		for i := range len(a) - pre - suf {
+			mid = append(mid, diffOp{'-', i, 0})
+		}
+		for j := range len(b) - pre - suf {
+			mid = append(mid, diffOp{'+', 0, j})
+		}
+	}
+	for _, op := range mid {
+		ops = append(ops, diffOp{op.kind, op.a + pre, op.b + pre})
+	}
+	for i := range suf {
+		ops = append(ops, diffOp{' ', len(a) - suf + i, len(b) - suf + i})
+	}
+	return ops
+}
+
+// myers is Myers' O(ND) diff algorithm. It gives up, returning false, once
+// more than maxDiffEdits edits would be needed.
+func myers(a, b [][]byte) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	limit := min(n+m, maxDiffEdits)
+	off := limit + 1
+	v := make([]int, 2*limit+3)
+	// trace[d] holds v for diagonals -d-1..d+1 as it was before round d.
+	var trace [][]int
+	end := -1
+	for d := 0; d <= limit && end < 0; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && bytes.Equal(a[x], b[y]) {
+				x, y = x+1, y+1
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				end = d
+				break
+			}
+		}
+	}
+	if end < 0 {
+		return nil, false
+	}
+
+	// Walk back from the end, collecting ops in reverse.
+	var ops []diffOp
+	x, y := n, m
+	for d := end; d >= 0; d-- {
+		prev := trace[d]
+		at := func(k int) int { return prev[k+d+1] }
+		k := x - y
+		var pk int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := at(pk)
+		py := px - pk
+		for x > px && y > py {
+			x, y = x-1, y-1
+			ops = append(ops, diffOp{' ', x, y})
+		}
+		if d > 0 {
+			if x == px {
+				y--
+				ops = append(ops, diffOp{'+', x, y})
+			} else {
+				x--
+				ops = append(ops, diffOp{'-', x, y})
+			}
+		}
+		x, y = px, py
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops, true
+}
+
+// unifiedDiff formats the differences between a and b as diff -u does,
+// with context lines around each change. Identical inputs give no output.
+func unifiedDiff(aName, bName string, a, b []byte, context int) []byte {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	if bytes.IndexByte(a, 0) >= 0 || bytes.IndexByte(b, 0) >= 0 {
+		return fmt.Appendf(nil, "Binary files %s and %s differ\n", aName, bName)
+	}
+	al, bl := splitLines(a), splitLines(b)
+	ops := editScript(al, bl)
+
+	out := fmt.Appendf(nil, "--- %s\n+++ %s\n", aName, bName)
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// A hunk runs from context lines before this change to context
+		// lines after the last change within 2*context kept lines of it.
+		start := max(i-context, 0)
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		end = min(end+context, len(ops))
+		out = appendHunk(out, ops[start:end], al, bl)
+		i = end
+	}
+	return out
+}
+
+func appendHunk(out []byte, ops []diffOp, a, b [][]byte) []byte {
+	aStart, bStart, aLen, bLen := -1, -1, 0, 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			if aStart < 0 {
+				aStart = op.a
+			}
+			aLen++
+		}
+		if op.kind != '-' {
+			if bStart < 0 {
+				bStart = op.b
+			}
+			bLen++
+		}
+	}
+	// An empty side is numbered by the line before it, as diff -u does.
+	if aStart < 0 {
+		aStart = ops[0].a - 1
+	}
+	if bStart < 0 {
+		bStart = ops[0].b - 1
+	}
+	out = fmt.Appendf(out, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+	for _, op := range ops {
+		line := b[op.b:]
+		if op.kind == '-' {
+			line = a[op.a:]
+		}
+		out = append(append(out, op.kind), line[0]...)
+		if !bytes.HasSuffix(line[0], []byte("\n")) {
+			out = append(out, "\n\\ No newline at end of file\n"...)
+		}
+	}
+	return out
+}
+
+func hunkRange(start, n int) string {
+	if n == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// readDiffSide reads a file under /data for a diff.
+func readDiffSide(p string) ([]byte, error) {
+	f, info, err := openFile(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if info.Size > maxDiffFile {
+		return nil, fmt.Errorf("%s: %w to diff (over %d bytes)", p, errFileTooLarge, maxDiffFile)
+	}
+	return io.ReadAll(io.LimitReader(f, maxDiffFile+1))
+}
+
+// handleDiff serves a unified diff of two files under /data, ?a= and ?b=.
+// POSTing the old version as the body instead of naming a diffs it against
+// the current b, for clients that kept a snapshot of what they last saw.
+// A file that doesn't exist diffs as empty, named /dev/null as diff -N and
+// git do, so added and deleted files show up whole; both missing is 404.
+func handleDiff(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	context := defaultDiffContext
+	if v := q.Get("context"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			httpError(w, r, fmt.Sprintf("invalid context=%q", v), http.StatusBadRequest)
+			return
+		}
+		context = n
+	}
+	bPath := q.Get("b")
+	if bPath == "" {
+		httpError(w, r, "b is required", http.StatusBadRequest)
+		return
+	}
+
+	var a []byte
+	var err error
+	aName := "a/" + q.Get("a")
+	if r.Method == http.MethodPost {
+		if a, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxDiffFile)); err != nil {
+			httpError(w, r, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if q.Get("a") == "" {
+			aName = "a/" + bPath
+		}
+	} else {
+		if q.Get("a") == "" {
+			httpError(w, r, "a is required", http.StatusBadRequest)
+			return
+		}
+		a, err = fsCall(r.Context(), func() ([]byte, error) { return readDiffSide(q.Get("a")) })
+		if errors.Is(err, fs.ErrNotExist) {
+			aName = devNull
+		} else if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	bName := "b/" + bPath
+	b, err := fsCall(r.Context(), func() ([]byte, error) { return readDiffSide(bPath) })
+	if errors.Is(err, fs.ErrNotExist) && aName != devNull {
+		bName = devNull
+	} else if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	w.Write(unifiedDiff(aName, bName, a, b, context))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffHandler(t *testing.T) {
+	dir := filepath.Join(dataDir, "diff")
+	os.MkdirAll(dir, 0755)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, body := range map[string]string{
+		"old.txt":  "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\n",
+		"new.txt":  "one\ntwo\nTHREE\nfour\nfive\nsix\nseven\neight\nnine",
+		"same.txt": "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\n",
+		"img.png":  "\x89PNG\x00\x01",
+		"img2.png": "\x89PNG\x00\x02",
+		"new.go":   "package main\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name, method, query, body string
+		status                    int
+		want                      string
+	}{
+		{name: "modified", method: "GET", query: "a=diff/old.txt&b=diff/new.txt", status: 200, want: `--- a/diff/old.txt
++++ b/diff/new.txt
+@@ -1,8 +1,9 @@
+ one
+ two
+-three
++THREE
+ four
+ five
+ six
+ seven
+ eight
++nine
+\ No newline at end of file
+`},
+		{name: "modified, one line of context", method: "GET", query: "a=diff/old.txt&b=diff/new.txt&context=1", status: 200, want: `--- a/diff/old.txt
++++ b/diff/new.txt
+@@ -2,3 +2,3 @@
+ two
+-three
++THREE
+ four
+@@ -8 +8,2 @@
+ eight
++nine
+\ No newline at end of file
+`},
+		{name: "added", method: "GET", query: "a=diff/missing.go&b=diff/new.go", status: 200, want: `--- /dev/null
++++ b/diff/new.go
+@@ -0,0 +1 @@
++package main
+`},
+		{name: "deleted", method: "GET", query: "a=diff/new.go&b=diff/gone.go", status: 200, want: `--- a/diff/new.go
++++ /dev/null
+@@ -1 +0,0 @@
+-package main
+`},
+		{name: "snapshot", method: "POST", query: "b=diff/new.go", body: "package old\n", status: 200, want: `--- a/diff/new.go
++++ b/diff/new.go
+@@ -1 +1 @@
+-package old
++package main
+`},
+		{name: "binary", method: "GET", query: "a=diff/img.png&b=diff/img2.png", status: 200, want: "Binary files a/diff/img.png and b/diff/img2.png differ\n"},
+		{name: "identical", method: "GET", query: "a=diff/old.txt&b=diff/same.txt", status: 200, want: ""},
+		{name: "both missing", method: "GET", query: "a=diff/x&b=diff/y", status: 404},
+		{name: "bad context", method: "GET", query: "a=diff/old.txt&b=diff/new.txt&context=-1", status: 400},
+	} {
+		q, _ := url.ParseQuery(tc.query)
+		req, _ := http.NewRequest(tc.method, testURL+"/v1/diff?"+q.Encode(), strings.NewReader(tc.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: %s, want %d", tc.name, resp.Status, tc.status)
+			continue
+		}
+		if tc.status == 200 && string(got) != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.name, got, tc.want)
+		}
+	}
+}
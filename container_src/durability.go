@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// durabilitySettle is how long tigrisfs's uploads must have been quiet,
+// after the last write to the mount, before that write counts as saved.
+const durabilitySettle = time.Second
+
+// writeFileBytes matches the size in a WriteFile debug line:
+// `<- WriteFile (inode 5, handle 1, offset 0, 3 bytes)`.
+var writeFileBytes = regexp.MustCompile(`(\d+) bytes\)`)
+
+// durabilityTracker follows whether what was written to /data has reached
+// the bucket, for "saving…/saved" indicators. tigrisfs buffers writes and
+// uploads them in the background, so, like the cache statistics, this is
+// inferred from its debug output: writes seen through FUSE are unsaved
+// until tigrisfs has made an upload after the last of them and then gone
+// quiet. Writes queued in the journal are unsaved until replayed.
+type durabilityTracker struct {
+	mu         sync.Mutex
+	dirty      bool
+	dirtyBytes int64
+	lastWrite  time.Time
+	lastUpload time.Time
+	lastSaved  time.Time
+	settle     *time.Timer
+	changed    chan struct{} // closed and replaced when the state may have changed
+}
+
+var durability = &durabilityTracker{changed: make(chan struct{})}
+
+type durabilityStatus struct {
+	// State is "saved", "saving" while writes aren't known to be in the
+	// bucket yet, or "local" when /data isn't backed by the bucket at all
+	// (degraded, or running without a mount).
+	State string `json:"state"`
+	// DirtyBytes is how much was written through the mount since the
+	// bucket last caught up.
+	DirtyBytes int64 `json:"dirty_bytes"`
+	// PendingWrites and PendingWriteBytes are file API writes queued until
+	// the mount recovers, as in /v1/health.
+	PendingWrites     int        `json:"pending_writes"`
+	PendingWriteBytes int64      `json:"pending_write_bytes"`
+	LastWrite         *time.Time `json:"last_write,omitempty"`
+	// LastSaved is when the bucket last caught up with the mount.
+	LastSaved *time.Time `json:"last_saved,omitempty"`
+}
+
+// durabilityMessage reports a change of state to /ws control clients and
+// on /ws/mux.
+type durabilityMessage struct {
+	Type string `json:"type"` // "durability"
+	durabilityStatus
+}
+
+// wrote records a change made through the mount, of n bytes of data.
+func (d *durabilityTracker) wrote(n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dirtyBytes += n
+	d.lastWrite = time.Now()
+	if !d.dirty {
+		d.dirty = true
+		d.notifyLocked()
+	}
+}
+
+// uploaded records a write request tigrisfs made to the bucket.
+func (d *durabilityTracker) uploaded() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastUpload = time.Now()
+	if d.settle == nil {
+		d.settle = time.AfterFunc(durabilitySettle, d.check)
+	} else {
+		d.settle.Reset(durabilitySettle)
+	}
+}
+
+// check marks the mount saved once uploads have settled after the last
+// write. A write since then waits for the upload it causes.
+func (d *durabilityTracker) check() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.dirty || d.lastUpload.Before(d.lastWrite) {
+		return
+	}
+	d.dirty = false
+	d.dirtyBytes = 0
+	d.lastSaved = d.lastUpload
+	d.notifyLocked()
+}
+
+// unsaved reports whether a file last modified at mod may have changes the
+// bucket doesn't have yet.
+func (d *durabilityTracker) unsaved(mod time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dirty && !mod.Before(d.lastSaved)
+}
+
+// notify wakes followers after a change the tracker doesn't see itself:
+// the mount coming up, or the write queue filling or draining.
+func (d *durabilityTracker) notify() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.notifyLocked()
+}
+
+func (d *durabilityTracker) notifyLocked() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// status returns the current state, and a channel closed when it changes.
+func (d *durabilityTracker) status() (durabilityStatus, <-chan struct{}) {
+	pending, pendingBytes := writes.depth()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := durabilityStatus{
+		State:             "saved",
+		DirtyBytes:        d.dirtyBytes,
+		PendingWrites:     pending,
+		PendingWriteBytes: pendingBytes,
+	}
+	switch {
+	case !mountReady.Load():
+		s.State = "local"
+	case d.dirty || pending > 0:
+		s.State = "saving"
+	}
+	if !d.lastWrite.IsZero() {
+		t := d.lastWrite
+		s.LastWrite = &t
+	}
+	if !d.lastSaved.IsZero() {
+		t := d.lastSaved
+		s.LastSaved = &t
+	}
+	return s, d.changed
+}
+
+// follow sends the state, and then every change of it, until ctx is done.
+func (d *durabilityTracker) follow(ctx context.Context, send func(durabilityMessage) error) {
+	last := ""
+	for {
+		s, changed := d.status()
+		if s.State != last {
+			if send(durabilityMessage{Type: "durability", durabilityStatus: s}) != nil {
+				return
+			}
+			last = s.State
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// observeMountWrite feeds a FUSE operation from tigrisfs's debug output to
+// the tracker, if it changes the filesystem.
+func observeMountWrite(op string, line []byte) {
+	switch op {
+	case "WriteFile":
+		var n int64
+		if m := writeFileBytes.FindSubmatch(line); m != nil {
+			n, _ = strconv.ParseInt(string(m[1]), 10, 64)
+		}
+		durability.wrote(n)
+	case "CreateFile", "Rename", "Unlink":
+		// Operations that always cause a request; ones such as MkDir may
+		// not, and would leave the state "saving" for good.
+		durability.wrote(0)
+	}
+}
+
+func handleDurability(w http.ResponseWriter, r *http.Request) {
+	s, _ := durability.status()
+	writeJSON(w, http.StatusOK, s)
+}
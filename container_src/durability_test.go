@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDurability(t *testing.T) {
+	saved := durability
+	durability = &durabilityTracker{changed: make(chan struct{})}
+	mountReady.Store(true)
+	mountFuseStats.Store(true)
+	t.Cleanup(func() {
+		durability = saved
+		mountReady.Store(false)
+		mountFuseStats.Store(false)
+	})
+	get := func() durabilityStatus {
+		t.Helper()
+		resp, err := http.Get(testURL + "/v1/durability")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var s durabilityStatus
+		if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	if s := get(); s.State != "saved" {
+		t.Fatalf("state before any writes = %q, want saved", s.State)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	states := make(chan string, 10)
+	go durability.follow(ctx, func(m durabilityMessage) error {
+		states <- m.State
+		return nil
+	})
+	next := func(want string) {
+		t.Helper()
+		select {
+		case got := <-states:
+			if got != want {
+				t.Fatalf("durability message %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no durability message, want %q", want)
+		}
+	}
+	next("saved")
+
+	observeMountLine([]byte("fuse_debug: Op 0x00000010 connection.go:416] <- WriteFile (inode 5, handle 1, offset 0, 300 bytes)\n"))
+	next("saving")
+	if s := get(); s.State != "saving" || s.DirtyBytes != 300 || s.LastWrite == nil {
+		t.Fatalf("after a write: %+v", s)
+	}
+	observeMountLine([]byte("s3: PUT https://example.com/s3-test/a.txt = 200\n"))
+	next("saved")
+	if s := get(); s.DirtyBytes != 0 || s.LastSaved == nil {
+		t.Fatalf("after the upload: %+v", s)
+	}
+}
+
+// TestDurabilityWithoutFUSEStats checks that, with tigrisfs not logging FUSE
+// operations, an upload marks the mount saving until uploads go quiet.
+func TestDurabilityWithoutFUSEStats(t *testing.T) {
+	saved := durability
+	durability = &durabilityTracker{changed: make(chan struct{})}
+	mountReady.Store(true)
+	t.Cleanup(func() {
+		durability = saved
+		mountReady.Store(false)
+	})
+	observeMountLine([]byte("s3: PUT https://example.com/s3-test/a.txt = 200\n"))
+	if s, _ := durability.status(); s.State != "saving" {
+		t.Fatalf("state during an upload = %q, want saving", s.State)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, changed := durability.status()
+		if s.State == "saved" {
+			break
+		}
+		select {
+		case <-changed:
+		case <-time.After(time.Until(deadline)):
+			t.Fatalf("state after uploads went quiet = %q, want saved", s.State)
+		}
+	}
+}
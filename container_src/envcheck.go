@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// checkEnvironment verifies what the server was started with before it
+// relies on any of it, so that a broken image or deploy fails at boot with
+// a message naming the problem, instead of as a mount timeout or a
+// rejected S3 request later on. production is whether the Durable
+// Object's bucket is mounted; mount is whether any bucket is.
+func checkEnvironment(production, mount bool) error {
+	var errs []error
+	if mount {
+		if err := checkExecutable(tigrisfsPath); err != nil {
+			errs = append(errs, fmt.Errorf("tigrisfs: %w", err))
+		}
+	}
+	if production {
+		if os.Getenv("CLOUDFLARE_DURABLE_OBJECT_ID") == "" {
+			errs = append(errs, errors.New("CLOUDFLARE_DURABLE_OBJECT_ID is not set"))
+		}
+		if err := checkHost(os.Getenv("HOST")); err != nil {
+			errs = append(errs, fmt.Errorf("HOST: %w", err))
+		}
+		if err := checkJWT(os.Getenv("S3_AUTH_TOKEN"), time.Now()); err != nil {
+			errs = append(errs, fmt.Errorf("S3_AUTH_TOKEN: %w", err))
+		} else if secret := os.Getenv(s3TokenSecretEnv); secret != "" {
+			if _, err := tokenScope(os.Getenv("S3_AUTH_TOKEN"), []byte(secret), time.Now()); err != nil {
+				errs = append(errs, fmt.Errorf("S3_AUTH_TOKEN: %w", err))
+			}
+		}
+	} else if mode := os.Getenv("LOCAL_S3"); mode != "" && mode != "embedded" {
+		if err := checkHTTPURL(mode); err != nil {
+			errs = append(errs, fmt.Errorf("LOCAL_S3: want \"embedded\" or an S3 endpoint: %w", err))
+		}
+	}
+	if src := os.Getenv("WORKSPACE_TEMPLATE"); src != "" {
+		if err := checkTemplate(src); err != nil {
+			errs = append(errs, fmt.Errorf("WORKSPACE_TEMPLATE: %w", err))
+		}
+	}
+	if _, err := warmPoolSize(); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", warmSessionsEnv, err))
+	}
+	if u := os.Getenv("READY_CALLBACK_URL"); u != "" {
+		if err := checkHTTPURL(u); err != nil {
+			errs = append(errs, fmt.Errorf("READY_CALLBACK_URL: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkExecutable reports why path can't be run, if it can't.
+func checkExecutable(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not executable (mode %s)", path, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// checkHost checks that host, the Worker's Host header, makes the S3
+// endpoint https://<host>/.
+func checkHost(host string) error {
+	if host == "" {
+		return errors.New("not set")
+	}
+	u, err := url.Parse("https://" + host + "/")
+	if err != nil {
+		return err
+	}
+	if u.Host != host || u.Hostname() == "" {
+		return fmt.Errorf("%q is not a host name like example.workers.dev", host)
+	}
+	return nil
+}
+
+func checkHTTPURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http(s) URL", s)
+	}
+	return nil
+}
+
+// checkJWT checks that token is a well-formed, unexpired JWT. The signature
+// is the S3 Durable Object's to verify; this only catches tokens that would
+// certainly be rejected.
+func checkJWT(token string, now time.Time) error {
+	if token == "" {
+		return errors.New("not set")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("not a JWT: has %d parts, want 3", len(parts))
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return fmt.Errorf("invalid JWT header: %w", err)
+	}
+	if header.Alg == "" {
+		return errors.New("invalid JWT header: no alg")
+	}
+	var claims struct {
+		Exp *float64 `json:"exp"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	if claims.Exp != nil {
+		if exp := time.Unix(int64(*claims.Exp), 0); now.After(exp) {
+			return fmt.Errorf("JWT expired at %s", exp.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckEnvironment(t *testing.T) {
+	jwt := func(claims string) string {
+		enc := base64.RawURLEncoding.EncodeToString
+		return enc([]byte(`{"alg":"HS256"}`)) + "." + enc([]byte(claims)) + ".sig"
+	}
+	t.Setenv("CLOUDFLARE_DURABLE_OBJECT_ID", "abc")
+	t.Setenv("HOST", "example.workers.dev")
+	t.Setenv("S3_AUTH_TOKEN", jwt(`{"sub":"abc"}`))
+	t.Setenv("READY_CALLBACK_URL", "")
+	if err := checkEnvironment(true, false); err != nil {
+		t.Fatalf("valid environment: %v", err)
+	}
+
+	t.Setenv("HOST", "https://example.workers.dev/")
+	t.Setenv("S3_AUTH_TOKEN", jwt(`{"exp":1}`))
+	t.Setenv("READY_CALLBACK_URL", "worker/ready")
+	err := checkEnvironment(true, false)
+	for _, want := range []string{"HOST: ", "S3_AUTH_TOKEN: JWT expired", "READY_CALLBACK_URL: "} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("checkEnvironment = %v, want an error mentioning %q", err, want)
+		}
+	}
+	t.Setenv("S3_AUTH_TOKEN", "not-a-jwt")
+	if err := checkEnvironment(true, false); err == nil || !strings.Contains(err.Error(), "not a JWT") {
+		t.Errorf("checkEnvironment with a malformed token = %v", err)
+	}
+
+	bin := filepath.Join(t.TempDir(), "tool")
+	os.WriteFile(bin, []byte("#!/bin/sh\n"), 0644)
+	if err := checkExecutable(bin); err == nil {
+		t.Error("checkExecutable accepted a file without execute permission")
+	}
+	os.Chmod(bin, 0755)
+	if err := checkExecutable(bin); err != nil {
+		t.Errorf("checkExecutable(%s) = %v", bin, err)
+	}
+}
@@ -0,0 +1,54 @@
+// Package errcode names the failures the terminal server promises to report
+// the same way from one release to the next, for clients to act on without
+// matching messages. The server sends a code as the "code" member of its
+// problem responses and as the close code of a WebSocket it closes for that
+// reason; the Go client returns errors that errors.Is matches against them.
+//
+//	if errors.Is(err, errcode.SessionNotFound) {
+//		// start a new session
+//	}
+package errcode
+
+// Code is a stable failure code. It is an error, so that errors can wrap it.
+type Code string
+
+const (
+	// MountNotReady is a request that needs the bucket while it isn't
+	// mounted: the container runs without one, or in degraded mode on
+	// local disk until it can be mounted again.
+	MountNotReady Code = "mount-not-ready"
+	// SessionNotFound is a session ID the server doesn't have, or doesn't
+	// let the requester see: start a new session rather than retry.
+	SessionNotFound Code = "session-not-found"
+	// QuotaExceeded is a limit reached, such as max_sessions or the queue
+	// of writes waiting for the bucket: retry later.
+	QuotaExceeded Code = "quota-exceeded"
+	// AuthExpired is credentials that were valid but have expired: get new
+	// ones rather than retry.
+	AuthExpired Code = "auth-expired"
+)
+
+// closeCodes are the WebSocket close codes, from the range for
+// applications, that carry the codes.
+var closeCodes = map[Code]int{
+	AuthExpired:     4001,
+	SessionNotFound: 4004,
+	MountNotReady:   4009,
+	QuotaExceeded:   4029,
+}
+
+func (c Code) Error() string { return string(c) }
+
+// CloseCode is the WebSocket close code for c, or 0 if it has none.
+func (c Code) CloseCode() int { return closeCodes[c] }
+
+// FromCloseCode is the code a WebSocket close code carries, or "" if it
+// isn't one of them.
+func FromCloseCode(closeCode int) Code {
+	for c, n := range closeCodes {
+		if n == closeCode {
+			return c
+		}
+	}
+	return ""
+}
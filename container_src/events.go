@@ -0,0 +1,139 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Kinds of event published on the bus.
+const (
+	// eventSessionStarted and eventSessionEnded bracket a session's life,
+	// from when it is listed; warm sessions start when handed out.
+	eventSessionStarted = "session.started"
+	eventSessionEnded   = "session.ended"
+	// eventFileChanged is a change under /data as the change watcher sees
+	// it, before it is folded into a change_events batch. The watcher
+	// starts at boot for whatever subscribes to these by then.
+	eventFileChanged = "file.changed"
+	// eventMountReady is the bucket mounted, at boot, after a degraded
+	// start or kept over an upgrade; eventMountDegraded a boot without it,
+	// on local disk; and eventMountRecovered, after eventMountReady, the
+	// switch over to it from there.
+	eventMountReady     = "mount.ready"
+	eventMountDegraded  = "mount.degraded"
+	eventMountRecovered = "mount.recovered"
+	// eventCommandFinished is a command a session's shell finished, as
+	// its prompt markers report it.
+	eventCommandFinished = "command.finished"
+	// eventWorkspaceFrozen and eventWorkspaceUnfrozen bracket a freeze of
+	// the workspace (see freeze.go).
+	eventWorkspaceFrozen   = "workspace.frozen"
+	eventWorkspaceUnfrozen = "workspace.unfrozen"
+)
+
+// eventQueue is how many events a subscriber may fall behind by before
+// further ones are dropped for it.
+const eventQueue = 256
+
+var (
+	eventsPublished = newCounter("dos3_events_total",
+		"Events published on the internal event bus, by kind.")
+	eventsDropped = newCounter("dos3_events_dropped_total",
+		"Events dropped for a subscriber that fell behind, by subscriber.")
+)
+
+// event is something that happened that subsystems may react to. Which
+// fields are set depends on Kind.
+type event struct {
+	Kind string
+	Time time.Time
+	// Session is the session of session.* and command.finished events.
+	Session *session
+	// Command is the command of command.finished events.
+	Command commandRecord
+	// Detail is the reason given for workspace.frozen.
+	Detail string
+	// Change is the change of file.changed events.
+	Change changeEvent
+	// Err is why the mount is degraded, for mount.degraded.
+	Err error
+}
+
+// eventBus hands events to the subsystems subscribed to them. Publishing
+// never blocks: each subscriber gets its events in order on a goroutine of
+// its own, so a slow one only delays itself, and drops what it can't keep
+// up with. Subsystems subscribe, typically in a package-level var, rather
+// than being called from where things happen.
+type eventBus struct {
+	mu   sync.Mutex
+	subs []*subscription
+}
+
+type subscription struct {
+	name  string
+	kinds []string
+	queue chan event
+}
+
+var events = &eventBus{}
+
+// subscribe calls fn with every event of kinds, or of every kind if none
+// are given, and returns the function that stops it. name identifies the
+// subscriber in metrics.
+func (b *eventBus) subscribe(name string, fn func(event), kinds ...string) (cancel func()) {
+	sub := &subscription{name: name, kinds: kinds, queue: make(chan event, eventQueue)}
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+	go func() {
+		for e := range sub.queue {
+			fn(e)
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			b.subs = slices.DeleteFunc(b.subs, func(s *subscription) bool { return s == sub })
+			close(sub.queue)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// wants reports whether anything subscribes to kind.
+func (b *eventBus) wants(kind string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subs {
+		if sub.wants(kind) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *subscription) wants(kind string) bool {
+	return len(s.kinds) == 0 || slices.Contains(s.kinds, kind)
+}
+
+// publish hands e to its subscribers, stamped with the time if it isn't.
+func (b *eventBus) publish(e event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	eventsPublished.add(1, "kind", e.Kind)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subs {
+		if !sub.wants(e.Kind) {
+			continue
+		}
+		select {
+		case sub.queue <- e:
+		default:
+			eventsDropped.add(1, "subscriber", sub.name)
+		}
+	}
+}
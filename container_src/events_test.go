@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	got := make(chan event, 16)
+	cancel := events.subscribe("test", func(e event) { got <- e }, eventSessionStarted, eventSessionEnded)
+	defer cancel()
+	ended := sessionsEnded.get()
+
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.close()
+	<-sess.done
+	for _, kind := range []string{eventSessionStarted, eventSessionEnded} {
+		for {
+			select {
+			case e := <-got:
+				if e.Session != sess {
+					continue
+				}
+				if e.Kind != kind || e.Time.IsZero() {
+					t.Errorf("event %s at %v, want %s", e.Kind, e.Time, kind)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %s event", kind)
+			}
+			break
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); sessionsEnded.get() == ended; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("ended session not counted")
+		}
+	}
+
+	// Only the kinds subscribed to are delivered, and nothing once
+	// cancelled; a subscriber that falls behind loses events rather than
+	// holding up the publisher.
+	events.publish(event{Kind: eventMountDegraded})
+	block := make(chan struct{})
+	stop := events.subscribe("slow", func(event) { <-block }, eventMountDegraded)
+	for range eventQueue + 2 {
+		events.publish(event{Kind: eventMountDegraded})
+	}
+	close(block)
+	stop()
+	if n := eventsDropped.get("subscriber", "slow"); n < 1 {
+		t.Errorf("events dropped for a slow subscriber = %v", n)
+	}
+	cancel()
+	// Other tests' sessions may still have events queued from before.
+	events.publish(event{Kind: eventSessionStarted})
+	for timeout := time.After(50 * time.Millisecond); ; {
+		select {
+		case e := <-got:
+			if e.Session == nil {
+				t.Errorf("event %s delivered after cancelling", e.Kind)
+			}
+			continue
+		case <-timeout:
+		}
+		break
+	}
+}
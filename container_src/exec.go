@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxExecTimeout caps how long a single exec may run.
+	maxExecTimeout = 30 * time.Minute
+	// defaultExecTimeout applies when a request doesn't set one.
+	defaultExecTimeout = 5 * time.Minute
+)
+
+var errEmptyCommand = errors.New("argv must not be empty")
+
+// execRequest runs a command without a PTY.
+type execRequest struct {
+	Argv []string `json:"argv"`
+	// Cwd is relative to dataDir.
+	Cwd     string            `json:"cwd"`
+	Env     map[string]string `json:"env"`
+	Stdin   []byte            `json:"stdin"`
+	Timeout duration          `json:"timeout"`
+}
+
+// runExec runs req to completion, streaming its output to stdout and stderr.
+// It returns the exit code, which is -1 if the command was killed; err is set
+// only if the command could not be run or was killed.
+func runExec(ctx context.Context, req execRequest, stdout, stderr io.Writer) (int, error) {
+	return runCommand(ctx, req, stdout, stderr, defaultExecTimeout, maxExecTimeout)
+}
+
+// runCommand is runExec with the timeout applied when req doesn't set one,
+// and the most it may set.
+func runCommand(ctx context.Context, req execRequest, stdout, stderr io.Writer, defaultTimeout, maxTimeout time.Duration) (int, error) {
+	if len(req.Argv) == 0 {
+		return -1, errEmptyCommand
+	}
+	dir, err := resolvePath(req.Cwd)
+	if err != nil {
+		return -1, err
+	}
+	timeout := req.Timeout.Duration
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, min(timeout, maxTimeout))
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, req.Argv[0], req.Argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = spawnEnv()
+	for k, v := range req.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if req.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(req.Stdin)
+	}
+	// Run in its own process group so a timeout kills anything it spawned.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+
+	if err = cmd.Start(); err == nil {
+		procLimit.add(cmd.Process.Pid)
+		err = cmd.Wait()
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case ctx.Err() != nil:
+		return -1, fmt.Errorf("killed: %w", ctx.Err())
+	case errors.As(err, &exitErr) && exitErr.Exited():
+		return exitErr.ExitCode(), nil
+	default:
+		return -1, err
+	}
+}
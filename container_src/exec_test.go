@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"server/container_src/client"
+)
+
+func TestExec(t *testing.T) {
+	c := dialTest(t)
+	res, err := c.Exec(context.Background(), client.ExecRequest{Argv: []string{"sh", "-c", "echo out; echo err >&2; exit 3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ExitCode != 3 || res.Stdout != "out\n" || res.Stderr != "err\n" {
+		t.Fatalf("Exec = %+v, want exit 3 with out and err", res)
+	}
+}
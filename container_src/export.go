@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"server/container_src/internal/s3client"
+)
+
+const (
+	// exportPartSize is the part size of files exported in parts: those
+	// over multipart_threshold, or over exportPartSize when that is 0.
+	exportPartSize = 64 << 20
+
+	defaultExportConcurrency = 4
+	maxExportConcurrency     = 16
+)
+
+var errInvalidExport = errors.New("invalid export request")
+
+// bucketLocation is a bucket outside the workspace that jobs export to and
+// import from. The credentials are only held by the running job; they
+// aren't kept with its state.
+type bucketLocation struct {
+	// Endpoint is the S3-compatible service, such as
+	// "https://s3.us-east-1.amazonaws.com",
+	// "https://<account>.r2.cloudflarestorage.com" or a MinIO server.
+	// Buckets are addressed path-style.
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	// Region signs the requests; "us-east-1" by default, "auto" for R2.
+	Region string `json:"region,omitempty"`
+	// Prefix is where in the bucket the files go, or come from: a file's
+	// key is Prefix followed by its path under the job's directory.
+	Prefix          string `json:"prefix,omitempty"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+// client checks the location and returns a client for its bucket. err
+// wraps invalid.
+func (l bucketLocation) client(invalid error) (*s3client.Client, error) {
+	u, err := url.Parse(l.Endpoint)
+	switch {
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		return nil, fmt.Errorf("%w: endpoint %q must be an http or https URL", invalid, l.Endpoint)
+	case l.Bucket == "":
+		return nil, fmt.Errorf("%w: bucket is required", invalid)
+	case l.AccessKeyID == "" || l.SecretAccessKey == "":
+		return nil, fmt.Errorf("%w: access_key_id and secret_access_key are required", invalid)
+	case strings.HasPrefix(l.Prefix, "/"):
+		return nil, fmt.Errorf("%w: prefix %q must not start with /", invalid, l.Prefix)
+	}
+	c, err := s3client.New(l.Endpoint, l.Bucket, l.AccessKeyID, l.SecretAccessKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", invalid, err)
+	}
+	c.Region = l.Region
+	return c, nil
+}
+
+// exportRequest is the body of POST /v1/jobs/export.
+type exportRequest struct {
+	// Path is the file or directory under /data to copy; all of it by
+	// default.
+	Path string `json:"path,omitempty"`
+	bucketLocation
+	// Concurrency is how many files are read and uploaded at once: 4 by
+	// default, at most 16. Reads through the mount are slow one at a
+	// time, so a workspace of many small files goes much faster in
+	// parallel.
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// exportTarget is where an export job copies to, as its state records it.
+type exportTarget struct {
+	Path     string `json:"path"`
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	Prefix   string `json:"prefix,omitempty"`
+}
+
+// exportFile is a file an export job copies.
+type exportFile struct {
+	full string
+	key  string
+	size int64
+}
+
+// startExport starts a job copying req.Path to req's bucket.
+func startExport(req exportRequest) (jobInfo, error) {
+	if req.Concurrency < 0 || req.Concurrency > maxExportConcurrency {
+		return jobInfo{}, fmt.Errorf("%w: concurrency must be from 1 to %d", errInvalidExport, maxExportConcurrency)
+	}
+	concurrency := req.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultExportConcurrency
+	}
+	store, err := req.client(errInvalidExport)
+	if err != nil {
+		return jobInfo{}, err
+	}
+	full, err := resolvePath(req.Path)
+	if err != nil {
+		return jobInfo{}, err
+	}
+	if _, err := os.Stat(full); err != nil {
+		return jobInfo{}, err
+	}
+	target := &exportTarget{Path: relPath(full), Endpoint: store.Endpoint.Redacted(), Bucket: req.Bucket, Prefix: req.Prefix}
+	j, err := launchJob(jobInfo{ID: newTimeID(), Export: target}, func(ctx context.Context, rj *runningJob, stdout, stderr io.Writer) (int, error) {
+		return runExport(ctx, rj, store, full, req.Prefix, concurrency, stdout, stderr)
+	})
+	if err != nil {
+		return jobInfo{}, err
+	}
+	infof("Job %s started: exporting /%s to %s/%s/%s", j.ID, target.Path, strings.TrimSuffix(target.Endpoint, "/"), target.Bucket, target.Prefix)
+	return j, nil
+}
+
+// runExport copies the files under full to store, concurrency at a time,
+// logging each to stdout and each failure to stderr in the order they were
+// listed, whichever finishes first. It exits 1 if any file failed; the job
+// fails if the bucket can't be reached at all.
+func runExport(ctx context.Context, rj *runningJob, store *s3client.Client, full, prefix string, concurrency int, stdout, stderr io.Writer) (int, error) {
+	if err := store.HeadBucket(ctx); err != nil {
+		return -1, fmt.Errorf("bucket %s: %w", store.Bucket, err)
+	}
+	files, err := exportFiles(ctx, full, prefix)
+	if err != nil {
+		return -1, err
+	}
+	rj.updateProgress(func(p *jobProgress) {
+		p.Files = len(files)
+		for _, f := range files {
+			p.Bytes += f.size
+		}
+	})
+	type exported struct {
+		n   int64
+		err error
+	}
+	done := make([]chan exported, len(files))
+	for i := range done {
+		done[i] = make(chan exported, 1)
+	}
+	go func() {
+		sem := make(chan struct{}, concurrency)
+		for i, f := range files {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				done[i] <- exported{err: ctx.Err()}
+				continue
+			}
+			go func() {
+				defer func() { <-sem }()
+				n, err := exportObject(ctx, store, f)
+				done[i] <- exported{n, err}
+			}()
+		}
+	}()
+	code := 0
+	for i, f := range files {
+		res := <-done[i]
+		n, err := res.n, res.err
+		if err != nil {
+			if ctx.Err() != nil {
+				return -1, ctx.Err()
+			}
+			fmt.Fprintf(stderr, "%s: %v\n", relPath(f.full), err)
+			rj.updateProgress(func(p *jobProgress) { p.FilesFailed++ })
+			code = 1
+			continue
+		}
+		meterTraffic("POST /v1/jobs/export", trafficFile, "out", int(n))
+		fmt.Fprintf(stdout, "%s -> %s (%d bytes)\n", relPath(f.full), f.key, n)
+		rj.updateProgress(func(p *jobProgress) {
+			p.FilesDone++
+			p.BytesDone += n
+		})
+	}
+	return code, nil
+}
+
+// exportFiles lists the regular files under full, with the keys they go to.
+// Symlinks are skipped, not followed, and so is the server's own state:
+// jobs and the trash.
+func exportFiles(ctx context.Context, full, prefix string) ([]exportFile, error) {
+	fi, err := os.Stat(full)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []exportFile{{full: full, key: prefix + path.Base(filepath.ToSlash(full)), size: fi.Size()}}, nil
+	}
+	var files []exportFile
+	err = filepath.WalkDir(full, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() && (p == filepath.Join(dataDir, jobsDirName) || p == trashDir()) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sub, _ := filepath.Rel(full, p)
+		files = append(files, exportFile{full: p, key: prefix + filepath.ToSlash(sub), size: info.Size()})
+		return nil
+	})
+	return files, err
+}
+
+// exportObject uploads f, in parts if it's large, and returns its size. It
+// is bulk work, read at bulk_bytes_per_second.
+func exportObject(ctx context.Context, store *s3client.Client, f exportFile) (int64, error) {
+	file, err := openBulk(ctx, f.full)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	contentType := mime.TypeByExtension(path.Ext(f.key))
+	threshold := currentConfig().MultipartThreshold
+	if threshold <= 0 {
+		threshold = exportPartSize
+	}
+	if size <= threshold {
+		return size, store.PutObject(ctx, f.key, file, contentType)
+	}
+	s3ID, err := store.CreateMultipartUpload(ctx, f.key, contentType)
+	if err != nil {
+		return 0, err
+	}
+	var parts []s3client.Part
+	for n, off := 1, int64(0); off < size; n, off = n+1, off+exportPartSize {
+		etag, err := store.UploadPart(ctx, f.key, s3ID, n, io.NewSectionReader(file, off, min(exportPartSize, size-off)))
+		if err != nil {
+			abortUpload(store, f.key, s3ID)
+			return 0, fmt.Errorf("part %d: %w", n, err)
+		}
+		parts = append(parts, s3client.Part{PartNumber: n, ETag: etag})
+	}
+	if _, err := store.CompleteMultipartUpload(ctx, f.key, s3ID, parts); err != nil {
+		abortUpload(store, f.key, s3ID)
+		return 0, err
+	}
+	return size, nil
+}
+
+func handleStartExport(w http.ResponseWriter, r *http.Request) {
+	var req exportRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&req); err != nil {
+		httpError(w, r, "invalid export request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	j, err := fsCall(r.Context(), func() (jobInfo, error) { return startExport(req) })
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, j)
+}
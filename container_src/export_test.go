@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"server/container_src/internal/s3test"
+)
+
+func TestExport(t *testing.T) {
+	srv := s3test.NewServer(t)
+	store := srv.Client(t, "export-test")
+	ctx := context.Background()
+	if err := store.CreateBucket(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cfg := *currentConfig()
+	cfg.MultipartThreshold = 50
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	os.MkdirAll(filepath.Join(dataDir, "exp/sub"), 0755)
+	os.WriteFile(filepath.Join(dataDir, "exp/a.txt"), []byte("hello"), 0644)
+	os.WriteFile(filepath.Join(dataDir, "exp/sub/big.bin"), bytes.Repeat([]byte("x"), 100), 0644)
+	os.Symlink("a.txt", filepath.Join(dataDir, "exp/link"))
+
+	export := func(req exportRequest, want int) jobInfo {
+		t.Helper()
+		body, _ := json.Marshal(req)
+		resp, err := http.Post(testURL+"/v1/jobs/export", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != want {
+			t.Fatalf("export: %s %s, want %d", resp.Status, data, want)
+		}
+		var j jobInfo
+		json.Unmarshal(data, &j)
+		return j
+	}
+	wait := func(id string) jobInfo {
+		t.Helper()
+		resp, err := http.Get(testURL + "/v1/jobs/" + id + "/output?follow=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		j, err := readJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return j
+	}
+
+	req := exportRequest{Path: "exp", bucketLocation: bucketLocation{Endpoint: srv.Endpoint, Bucket: "export-test", Prefix: "backup/", AccessKeyID: "key", SecretAccessKey: "secret"}}
+	j := wait(export(req, http.StatusAccepted).ID)
+	if j.State != "exited" || j.ExitCode == nil || *j.ExitCode != 0 || j.Export == nil || j.Export.Path != "exp" {
+		t.Fatalf("export job = %+v", j)
+	}
+	if p := j.Progress; p == nil || *p != (jobProgress{Files: 2, FilesDone: 2, Bytes: 105, BytesDone: 105}) {
+		t.Errorf("progress = %+v", p)
+	}
+	objs, err := store.ListObjects(ctx, "backup/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, o := range objs {
+		keys = append(keys, o.Key)
+	}
+	if !slices.Equal(keys, []string{"backup/a.txt", "backup/sub/big.bin"}) {
+		t.Errorf("exported keys = %v", keys)
+	}
+	body, err := store.GetObject(ctx, "backup/sub/big.bin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if len(data) != 100 {
+		t.Errorf("multipart export is %d bytes, want 100", len(data))
+	}
+	saved, _ := os.ReadFile(filepath.Join(jobDir(j.ID), "job.json"))
+	if bytes.Contains(saved, []byte("secret")) {
+		t.Errorf("job state keeps the credentials: %s", saved)
+	}
+
+	// Files are uploaded several at a time, but logged in order.
+	os.MkdirAll(filepath.Join(dataDir, "exp/many"), 0755)
+	var want []string
+	for i := range 20 {
+		name := fmt.Sprintf("exp/many/f%02d", i)
+		os.WriteFile(filepath.Join(dataDir, name), []byte(name), 0644)
+		want = append(want, fmt.Sprintf("%s -> many/%s (%d bytes)", name, filepath.Base(name), len(name)))
+	}
+	many := exportRequest{Path: "exp/many", bucketLocation: req.bucketLocation, Concurrency: 8}
+	many.Prefix = "many/"
+	j = wait(export(many, http.StatusAccepted).ID)
+	stdout, _ := os.ReadFile(filepath.Join(jobDir(j.ID), "stdout"))
+	if got := strings.Split(strings.TrimSpace(string(stdout)), "\n"); j.ExitCode == nil || *j.ExitCode != 0 || !slices.Equal(got, want) {
+		t.Errorf("concurrent export = %+v, logged:\n%s", j, stdout)
+	}
+	many.Concurrency = maxExportConcurrency + 1
+	export(many, http.StatusBadRequest)
+
+	// A bucket that can't be reached fails the job.
+	req.Endpoint = "http://127.0.0.1:1/"
+	if j := wait(export(req, http.StatusAccepted).ID); j.State != "failed" {
+		t.Errorf("export to an unreachable bucket = %+v", j)
+	}
+	req.Endpoint = "ftp://example.com"
+	export(req, http.StatusBadRequest)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errOutsideData = errors.New("path escapes " + dataDir)
+	errIsDir       = errors.New("is a directory")
+)
+
+// fileInfo describes a file under dataDir. Path is relative to dataDir, with
+// "" for dataDir itself.
+type fileInfo struct {
+	Path    string    `json:"path"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Mode    uint32    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir"`
+	// Queued is set on a file written while the mount was failing, whose
+	// contents aren't in the bucket yet.
+	Queued bool `json:"queued,omitempty"`
+}
+
+// resolvePath maps an API path to a filesystem path under dataDir. Paths are
+// relative to dataDir; a leading "/" or "/data/" is accepted, and ".."
+// components that would climb out of dataDir are rejected. Names are
+// normalized as unicode_names says.
+func resolvePath(p string) (string, error) {
+	if strings.ContainsRune(p, 0) {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	p = strings.TrimPrefix(p, dataDir)
+	clean := path.Clean(strings.TrimLeft(p, "/"))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%w: %q", errOutsideData, p)
+	}
+	if clean == "." {
+		return dataDir, nil
+	}
+	return normalizeNames(filepath.Join(dataDir, filepath.FromSlash(clean)))
+}
+
+// relPath is the inverse of resolvePath.
+func relPath(full string) string {
+	rel, err := filepath.Rel(dataDir, full)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+func newFileInfo(full string, fi fs.FileInfo) fileInfo {
+	return fileInfo{
+		Path:    relPath(full),
+		Name:    fi.Name(),
+		Size:    fi.Size(),
+		Mode:    uint32(fi.Mode().Perm()),
+		ModTime: fi.ModTime(),
+		IsDir:   fi.IsDir(),
+	}
+}
+
+func statPath(p string) (fileInfo, error) {
+	full, err := resolvePath(p)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	if info, _, ok, err := writes.lookup(full); ok {
+		return info, err
+	}
+	fi, err := os.Stat(full)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	return newFileInfo(full, fi), nil
+}
+
+// listDir returns the entries of a directory sorted by name.
+func listDir(p string) ([]fileInfo, error) {
+	full, err := resolvePath(p)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(full)
+	if err != nil {
+		return nil, err
+	}
+	prefetch.visit(full, false)
+	out := make([]fileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			// Removed between ReadDir and Info.
+			continue
+		}
+		out = append(out, newFileInfo(filepath.Join(full, e.Name()), fi))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// openFile opens a regular file for reading, or the queued contents of one
+// written while the mount was failing.
+func openFile(p string) (*os.File, fileInfo, error) {
+	full, err := resolvePath(p)
+	if err != nil {
+		return nil, fileInfo{}, err
+	}
+	if info, data, ok, err := writes.lookup(full); ok {
+		if err != nil {
+			return nil, fileInfo{}, err
+		}
+		// Gone if replay applied it meanwhile; then the mount has it.
+		if f, err := os.Open(data); err == nil {
+			return f, info, nil
+		}
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		return nil, fileInfo{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fileInfo{}, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, fileInfo{}, fmt.Errorf("%s: %w", p, errIsDir)
+	}
+	return f, newFileInfo(full, fi), nil
+}
+
+// writeFile replaces p with the contents of r, creating parent directories.
+// Data goes to a temporary file that is renamed into place, so a failed
+// upload never leaves a truncated file behind. If the mount is failing the
+// write is queued instead, and the returned info has Queued set.
+func writeFile(p string, r io.Reader, mode fs.FileMode) (fileInfo, error) {
+	return writeFileCommit(p, r, mode, commitNow)
+}
+
+// A commitFunc makes the step of a write that changes what others see,
+// once its data is in place: renaming a temporary file, queuing the write
+// or completing a multipart upload. writeConditionally passes one that
+// checks the request's preconditions just before.
+type commitFunc func(step func() error) error
+
+func commitNow(step func() error) error { return step() }
+
+// writeFileCommit is writeFile, with the rename into place, or queuing the
+// write, made through commit.
+func writeFileCommit(p string, r io.Reader, mode fs.FileMode, commit commitFunc) (fileInfo, error) {
+	full, err := resolvePath(p)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	if full == dataDir {
+		return fileInfo{}, fmt.Errorf("cannot write to %s", dataDir)
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+	queue := func() (fi fileInfo, err error) {
+		err = commit(func() error {
+			fi, err = writes.write(full, r, mode)
+			return err
+		})
+		return fi, err
+	}
+	if writes.pending() {
+		return queue()
+	}
+	cr := &countingReader{r: r}
+	tmp, err := stageFile(full, cr, mode)
+	if err != nil {
+		// Only a body that hasn't been read yet can still be queued.
+		if isMountError(err) && cr.n == 0 {
+			return queue()
+		}
+		return fileInfo{}, err
+	}
+	defer os.Remove(tmp)
+	if err := commit(func() error { return os.Rename(tmp, full) }); err != nil {
+		return fileInfo{}, err
+	}
+	return statPath(p)
+}
+
+// storeFile writes r to full through a temporary file.
+func storeFile(full string, r io.Reader, mode fs.FileMode) error {
+	tmp, err := stageFile(full, r, mode)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Rename(tmp, full)
+}
+
+// stageFile writes r to a temporary file beside full, for the caller to
+// rename into place and remove if it doesn't. Nothing is left behind on
+// failure.
+func stageFile(full string, r io.Reader, mode fs.FileMode) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(full), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode.Perm())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// removePath deletes a file, or a directory tree when recursive is set. Like
+// writeFile, it queues the deletion while the mount is failing.
+func removePath(p string, recursive bool) error {
+	full, err := resolvePath(p)
+	if err != nil {
+		return err
+	}
+	if full == dataDir {
+		return fmt.Errorf("cannot remove %s", dataDir)
+	}
+	if writes.pending() {
+		return writes.remove(full, recursive)
+	}
+	err = trashPath(full, recursive)
+	if isMountError(err) {
+		return writes.remove(full, recursive)
+	}
+	return err
+}
+
+func removeDirect(full string, recursive bool) error {
+	if _, err := os.Lstat(full); err != nil {
+		return err
+	}
+	if recursive {
+		return os.RemoveAll(full)
+	}
+	return os.Remove(full)
+}
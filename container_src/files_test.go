@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"server/container_src/client"
+)
+
+func TestFileAPI(t *testing.T) {
+	c := dialTest(t)
+	ctx := context.Background()
+
+	fi, err := c.Upload(ctx, "proj/a.txt", strings.NewReader("one\ntwo\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Path != "proj/a.txt" || fi.Size != 8 || fi.Mode != 0600 || fi.Queued {
+		t.Fatalf("Upload = %+v", fi)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "proj", "a.txt")); err != nil {
+		t.Fatalf("uploaded file not on disk: %v", err)
+	}
+
+	rc, err := c.Download(ctx, "proj/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(got) != "one\ntwo\n" {
+		t.Fatalf("Download = %q", got)
+	}
+
+	results, ok, err := c.Batch(ctx, []client.FileOp{
+		{Op: "copy", From: "proj/a.txt", To: "proj/b.txt"},
+		{Op: "mkdir", Path: "proj/sub"},
+	}, false)
+	if err != nil || !ok {
+		t.Fatalf("Batch = %+v, %v, %v", results, ok, err)
+	}
+	// A failing operation undoes the whole batch.
+	results, ok, err = c.Batch(ctx, []client.FileOp{
+		{Op: "move", From: "proj/b.txt", To: "proj/c.txt"},
+		{Op: "delete", Path: "proj/missing"},
+	}, false)
+	if err != nil || ok || results[0].Status != "rolled_back" {
+		t.Fatalf("failing Batch = %+v, %v, %v; want the move rolled back", results, ok, err)
+	}
+
+	if _, err := c.Upload(ctx, "proj/b.txt", strings.NewReader("one\n2\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := c.Diff(ctx, "proj/a.txt", "proj/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "--- a/proj/a.txt\n+++ b/proj/b.txt\n@@ -1,2 +1,2 @@\n one\n-two\n+2\n"
+	if diff != want {
+		t.Fatalf("Diff = %q, want %q", diff, want)
+	}
+
+	entries, err := c.ReadDir(ctx, "proj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	if strings.Join(names, " ") != "a.txt b.txt sub" {
+		t.Fatalf("ReadDir = %v", names)
+	}
+
+	// The HTTP router cleans ".." out of URLs; paths from JSON bodies reach
+	// resolvePath as sent.
+	results, ok, err = c.Batch(ctx, []client.FileOp{{Op: "mkdir", Path: "../escaped"}}, false)
+	if !isStatus(err, http.StatusBadRequest) {
+		t.Fatalf("Batch outside /data = %+v, %v, %v; want 400", results, ok, err)
+	}
+	if err := c.Remove(ctx, "proj", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat(ctx, "proj/a.txt"); !isStatus(err, http.StatusNotFound) {
+		t.Fatalf("Stat after Remove = %v, want 404", err)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	path := filepath.Join(dataDir, "cond.txt")
+	os.WriteFile(path, []byte("v1\n"), 0644)
+	t.Cleanup(func() { os.Remove(path) })
+	get := func(p string, header ...string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", testURL+"/v1/files/"+p, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	first := get("cond.txt")
+	etag, lastMod := first.Header.Get("ETag"), first.Header.Get("Last-Modified")
+	if etag == "" || lastMod == "" {
+		t.Fatalf("download headers %v, want ETag and Last-Modified", first.Header)
+	}
+	if resp := get("cond.txt", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match with the current ETag: %s, want 304", resp.Status)
+	}
+	if resp := get("cond.txt", "If-Modified-Since", lastMod); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-Modified-Since the current version: %s, want 304", resp.Status)
+	}
+	os.WriteFile(path, []byte("version 2\n"), 0644)
+	if resp := get("cond.txt", "If-None-Match", etag); resp.StatusCode != http.StatusOK {
+		t.Errorf("If-None-Match after a change: %s, want 200", resp.Status)
+	}
+
+	listing := get("").Header.Get("ETag")
+	if resp := get("", "If-None-Match", listing); listing == "" || resp.StatusCode != http.StatusNotModified {
+		t.Errorf("listing revalidation with ETag %q: %s, want 304", listing, resp.Status)
+	}
+	os.WriteFile(filepath.Join(dataDir, "cond2.txt"), nil, 0644)
+	defer os.Remove(filepath.Join(dataDir, "cond2.txt"))
+	if resp := get("", "If-None-Match", listing); resp.StatusCode != http.StatusOK {
+		t.Errorf("listing revalidation after a new file: %s, want 200", resp.Status)
+	}
+}
+
+func TestConditionalPut(t *testing.T) {
+	path := filepath.Join(dataDir, "edit.txt")
+	t.Cleanup(func() { os.Remove(path) })
+	send := func(method, body string, header ...string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, testURL+"/v1/files/edit.txt", strings.NewReader(body))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := send("PUT", "v0\n", "If-Match", `W/"1-1"`); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("If-Match on a missing file: %s, want 412", resp.Status)
+	}
+	created := send("PUT", "v1\n", "If-None-Match", "*")
+	etag := created.Header.Get("ETag")
+	if created.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("create with If-None-Match: *: %s, ETag %q", created.Status, etag)
+	}
+	if resp := send("PUT", "v1\n", "If-None-Match", "*"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("If-None-Match: * on an existing file: %s, want 412", resp.Status)
+	}
+
+	// Two clients edit from the same version; the second is refused.
+	time.Sleep(10 * time.Millisecond)
+	first := send("PUT", "client A\n", "If-Match", etag)
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("first edit: %s", first.Status)
+	}
+	second := send("PUT", "client B\n", "If-Match", etag)
+	if second.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("second edit: %s, want 412", second.Status)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "client A\n" {
+		t.Errorf("file holds %q after the conflict", data)
+	}
+	// If-Match compares strongly: a weakened ETag, as compressed downloads
+	// carry, doesn't match.
+	etag = first.Header.Get("ETag")
+	if strings.HasPrefix(etag, "W/") {
+		t.Errorf("file ETag %s is weak", etag)
+	}
+	if resp := send("PUT", "client B\n", "If-Match", "W/"+etag); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("If-Match with a weak ETag: %s, want 412", resp.Status)
+	}
+
+	// The ETag of the object in the bucket is accepted too.
+	prev := objectETag
+	objectETag = func(string) string { return "abc123" }
+	defer func() { objectETag = prev }()
+	if resp := send("PUT", "client B\n", "If-Match", `"abc123"`); resp.StatusCode != http.StatusOK {
+		t.Errorf("If-Match with the object's ETag: %s", resp.Status)
+	}
+	if resp := send("DELETE", "", "If-Match", etag); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with a stale ETag: %s, want 412", resp.Status)
+	}
+}
+
+// TestConditionalPutStaged checks that a conditional upload is checked when
+// its body has arrived, not held against others while it streams in.
+func TestConditionalPutStaged(t *testing.T) {
+	path := filepath.Join(dataDir, "staged.txt")
+	if err := os.WriteFile(path, []byte("v1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(path) })
+	put := func(body io.Reader, etag string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("PUT", testURL+"/v1/files/staged.txt", body)
+		req.Header.Set("If-Match", etag)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	resp, err := http.Get(testURL + "/v1/files/staged.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+
+	pr, pw := io.Pipe()
+	slow := make(chan *http.Response, 1)
+	go func() { slow <- put(pr, etag) }()
+	pw.Write([]byte("slow "))
+
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan *http.Response, 1)
+	go func() { done <- put(strings.NewReader("fast\n"), etag) }()
+	select {
+	case resp := <-done:
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("fast edit: %s", resp.Status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fast edit held up by an upload still streaming")
+	}
+
+	pw.Write([]byte("edit\n"))
+	pw.Close()
+	if resp := <-slow; resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("slow edit of the old version: %s, want 412", resp.Status)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "fast\n" {
+		t.Errorf("file holds %q", data)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dataDir, ".upload-*")); len(matches) > 0 {
+		t.Errorf("staged uploads left behind: %v", matches)
+	}
+}
+
+func TestPathLocks(t *testing.T) {
+	l := &pathLocks{locks: map[string]*pathLock{}}
+	unlockA := l.lock("a")
+	locked := make(chan struct{})
+	go func() {
+		unlock := l.lock("b")
+		unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("locking b waited for a")
+	}
+	go func() {
+		unlock := l.lock("a")
+		unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	unlockA()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		n := len(l.locks)
+		l.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d locks kept after being released", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Runtime feature flags. They default to the image's normal behaviour and can
+// be flipped on a live container through /debug/flags; nothing is persisted.
+const (
+	// flagVerboseMountLogging forwards tigrisfs debug output to the log.
+	flagVerboseMountLogging = "verbose_mount_logging"
+	// flagOutputCoalescing batches PTY output into fewer WebSocket frames.
+	flagOutputCoalescing = "output_coalescing"
+	// flagRecording records new sessions as asciicasts under recordingsDir.
+	flagRecording = "recording"
+	// flagDirPrefetch lists directories next to the ones being browsed to
+	// warm the mount's metadata cache.
+	flagDirPrefetch = "dir_prefetch"
+)
+
+type featureFlags struct {
+	mu     sync.RWMutex
+	values map[string]bool
+}
+
+var flags = &featureFlags{
+	values: map[string]bool{
+		flagVerboseMountLogging: true,
+		flagOutputCoalescing:    false,
+		flagRecording:           false,
+		flagDirPrefetch:         true,
+	},
+}
+
+func (f *featureFlags) enabled(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.values[name]
+}
+
+// update applies all changes or none of them.
+func (f *featureFlags) update(changes map[string]bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name := range changes {
+		if _, ok := f.values[name]; !ok {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+	}
+	for name, v := range changes {
+		if f.values[name] != v {
+			infof("Feature flag %s set to %t", name, v)
+		}
+		f.values[name] = v
+	}
+	return nil
+}
+
+func (f *featureFlags) snapshot() map[string]bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	out := make(map[string]bool, len(f.values))
+	for k, v := range f.values {
+		out[k] = v
+	}
+	return out
+}
+
+func (f *featureFlags) names() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	names := make([]string, 0, len(f.values))
+	for k := range f.values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handleFlags serves the current flags on GET and applies a JSON object of
+// {"flag": bool} on PATCH.
+func handleFlags(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var changes map[string]bool
+		if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+			httpError(w, r, fmt.Sprintf("invalid JSON body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := flags.update(changes); err != nil {
+			httpError(w, r, fmt.Sprintf("%v (known flags: %v)", err, flags.names()), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		httpError(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flags.snapshot())
+}
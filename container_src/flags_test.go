@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setFlag sets a feature flag for the rest of the test.
+func setFlag(t *testing.T, name string, v bool) {
+	prev := flags.enabled(name)
+	if err := flags.update(map[string]bool{name: v}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flags.update(map[string]bool{name: prev}) })
+}
+
+func TestFlagsEndpoint(t *testing.T) {
+	call := func(method, token, body string) (int, string) {
+		req, _ := http.NewRequest(method, testURL+"/debug/flags", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	if code, _ := call("GET", "", ""); code != http.StatusForbidden {
+		t.Errorf("flags without CONTROL_TOKEN set: %d, want 403", code)
+	}
+	t.Setenv("CONTROL_TOKEN", "secret")
+	if code, _ := call("PATCH", "wrong", `{"recording": true}`); code != http.StatusUnauthorized {
+		t.Errorf("flags with the wrong token: %d, want 401", code)
+	}
+	t.Cleanup(func() { flags.update(map[string]bool{flagRecording: false}) })
+
+	code, body := call("GET", "secret", "")
+	var got map[string]bool
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &got) != nil {
+		t.Fatalf("GET /debug/flags: %d %s", code, body)
+	}
+	for _, name := range []string{flagVerboseMountLogging, flagOutputCoalescing, flagRecording, flagDirPrefetch} {
+		if _, ok := got[name]; !ok {
+			t.Errorf("flag %s not listed: %s", name, body)
+		}
+	}
+
+	// Changes are applied all or nothing.
+	if code, body := call("PATCH", "secret", `{"recording": true, "recordng": true}`); code != http.StatusBadRequest || !strings.Contains(body, `unknown flag \"recordng\"`) {
+		t.Errorf("PATCH of an unknown flag: %d %s", code, body)
+	}
+	if flags.enabled(flagRecording) {
+		t.Error("PATCH with an unknown flag applied the known one")
+	}
+	if code, body := call("PATCH", "secret", `{"recording": "yes"}`); code != http.StatusBadRequest {
+		t.Errorf("PATCH of a non-boolean: %d %s", code, body)
+	}
+	code, body = call("PATCH", "secret", `{"recording": true}`)
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &got) != nil || !got[flagRecording] {
+		t.Errorf("PATCH recording on: %d %s", code, body)
+	}
+	if !flags.enabled(flagRecording) {
+		t.Error("recording still off after PATCH")
+	}
+	if code, _ := call("DELETE", "secret", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE /debug/flags: %d, want 405", code)
+	}
+}
+
+// TestFlagVerboseMountLogging checks that tigrisfs debug lines are only
+// logged with verbose_mount_logging on, and other lines always are.
+func TestFlagVerboseMountLogging(t *testing.T) {
+	const lines = "s3 DEBUG HEAD /bucket/a\nmount ready\n"
+	for _, tc := range []struct {
+		on   bool
+		want string
+	}{
+		{true, lines},
+		{false, "mount ready\n"},
+	} {
+		setFlag(t, flagVerboseMountLogging, tc.on)
+		var out bytes.Buffer
+		w := &mountLogWriter{w: &out, uncounted: true}
+		// Split mid-line, as pipe reads are.
+		w.Write([]byte(lines[:10]))
+		w.Write([]byte(lines[10:]))
+		if out.String() != tc.want {
+			t.Errorf("verbose_mount_logging %t: logged %q, want %q", tc.on, out.String(), tc.want)
+		}
+	}
+}
+
+// TestFlagRecording checks that sessions started with the recording flag on
+// are recorded as asciicasts, and others aren't.
+func TestFlagRecording(t *testing.T) {
+	prev := recordingsDir
+	recordingsDir = t.TempDir()
+	t.Cleanup(func() { recordingsDir = prev })
+
+	setFlag(t, flagRecording, false)
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	if sess.rec != nil {
+		t.Error("session recorded with the recording flag off")
+	}
+
+	setFlag(t, flagRecording, true)
+	sess, err = sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	if sess.rec == nil {
+		t.Fatal("session not recorded with the recording flag on")
+	}
+	if filepath.Dir(sess.rec.path) != recordingsDir || !strings.HasSuffix(sess.rec.path, sess.id+".cast") {
+		t.Errorf("recording at %s", sess.rec.path)
+	}
+	sess.rec.flush()
+	data, err := os.ReadFile(sess.rec.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header struct{ Version, Width, Height int }
+	if first, _, _ := bytes.Cut(data, []byte("\n")); json.Unmarshal(first, &header) != nil || header.Version != 2 || header.Width != 80 || header.Height != 24 {
+		t.Errorf("asciicast header %q", first)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Input policies decide whose typing reaches a session several /ws
+// connections are attached to, such as its owner's and guests' with write
+// share links:
+const (
+	// inputFree lets everyone who can write type at once.
+	inputFree = "free"
+	// inputSingle lets one connection type at a time. Another asks for
+	// control, and has it once nobody holds it or the holder hands it over.
+	inputSingle = "single"
+	// inputHost lets the owner's connections, the hosts, always type, and
+	// guests only once a host has granted them control.
+	inputHost = "host"
+)
+
+// Actions a connection takes on control, in input_control messages.
+const (
+	floorRequest = "request"
+	floorRelease = "release"
+	floorGrant   = "grant"
+	floorRevoke  = "revoke"
+)
+
+var errInvalidInputPolicy = errors.New("invalid input policy")
+
+var inputWithoutControl = newCounter("dos3_input_without_control_total",
+	"Input from /ws connections dropped because they didn't have control, by input policy.")
+
+// floorParticipant is a /ws connection attached to a session.
+type floorParticipant struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Host is set for the owner's connections, as opposed to guests'.
+	Host bool `json:"host,omitempty"`
+	// Observer is set for connections that can't type at all.
+	Observer bool `json:"observer,omitempty"`
+}
+
+// inputControlMessage tells a session's control clients whose input goes
+// through, whenever that changes.
+type inputControlMessage struct {
+	Type   string `json:"type"` // "input_control"
+	Policy string `json:"policy"`
+	// Holder is the participant with control under the single and host
+	// policies, if any, and Requests those asking for it, oldest first.
+	Holder       string             `json:"holder,omitempty"`
+	Requests     []string           `json:"requests,omitempty"`
+	Participants []floorParticipant `json:"participants"`
+	// You is the participant the message is for, and CanWrite whether
+	// its input goes through now.
+	You      string `json:"you,omitempty"`
+	CanWrite bool   `json:"can_write"`
+}
+
+// inputFloor arbitrates input between a session's participants. The zero
+// value is the free policy.
+type inputFloor struct {
+	mu           sync.Mutex
+	policy       string
+	holder       string
+	requests     []string
+	participants []floorParticipant
+	// changed is closed and replaced on every change.
+	changed chan struct{}
+}
+
+// changedLocked returns the channel closed on the next change.
+func (f *inputFloor) changedLocked() chan struct{} {
+	if f.changed == nil {
+		f.changed = make(chan struct{})
+	}
+	return f.changed
+}
+
+func (f *inputFloor) notifyLocked() {
+	close(f.changedLocked())
+	f.changed = make(chan struct{})
+}
+
+func (f *inputFloor) policyLocked() string {
+	if f.policy == "" {
+		return inputFree
+	}
+	return f.policy
+}
+
+func (f *inputFloor) participantLocked(id string) (floorParticipant, bool) {
+	i := slices.IndexFunc(f.participants, func(p floorParticipant) bool { return p.ID == id })
+	if i < 0 {
+		return floorParticipant{}, false
+	}
+	return f.participants[i], true
+}
+
+// join adds p to the participants; the returned func takes it out again,
+// releasing control if it has it.
+func (f *inputFloor) join(p floorParticipant) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.participants = append(f.participants, p)
+	f.notifyLocked()
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.participants = slices.DeleteFunc(f.participants, func(q floorParticipant) bool { return q.ID == p.ID })
+		f.requests = slices.DeleteFunc(f.requests, func(id string) bool { return id == p.ID })
+		if f.holder == p.ID {
+			f.holder = ""
+		}
+		f.notifyLocked()
+	}
+}
+
+// setPolicy switches the policy. Under single, control starts with the
+// first host attached; under host, no guest has it.
+func (f *inputFloor) setPolicy(policy string) error {
+	switch policy {
+	case inputFree, inputSingle, inputHost:
+	default:
+		return fmt.Errorf("%w: %q, want %s, %s or %s", errInvalidInputPolicy, policy, inputFree, inputSingle, inputHost)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.policyLocked() == policy {
+		return nil
+	}
+	f.policy, f.holder, f.requests = policy, "", nil
+	if policy == inputSingle {
+		for _, p := range f.participants {
+			if p.Host {
+				f.holder = p.ID
+				break
+			}
+		}
+	}
+	f.notifyLocked()
+	return nil
+}
+
+// currentPolicy is the policy in force.
+func (f *inputFloor) currentPolicy() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.policyLocked()
+}
+
+// mayWrite reports whether participant id's input goes through.
+func (f *inputFloor) mayWrite(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.mayWriteLocked(id)
+}
+
+func (f *inputFloor) mayWriteLocked(id string) bool {
+	p, ok := f.participantLocked(id)
+	switch {
+	case !ok || p.Observer:
+		return false
+	case f.policyLocked() == inputHost && p.Host:
+		return true
+	case f.policyLocked() == inputFree:
+		return true
+	}
+	return f.holder == id
+}
+
+// act carries out participant id's action on control. Actions that don't
+// apply, under the policy or to the participant, do nothing.
+func (f *inputFloor) act(id, action, to string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.participantLocked(id)
+	policy := f.policyLocked()
+	if !ok || p.Observer || policy == inputFree {
+		return
+	}
+	switch action {
+	case floorRequest:
+		switch {
+		case f.holder == id, policy == inputHost && p.Host:
+			return
+		case f.holder == "" && policy == inputSingle:
+			f.holder = id
+		case !slices.Contains(f.requests, id):
+			f.requests = append(f.requests, id)
+		default:
+			return
+		}
+	case floorRelease:
+		if f.holder == id {
+			f.holder = ""
+		} else if i := slices.Index(f.requests, id); i >= 0 {
+			f.requests = slices.Delete(f.requests, i, i+1)
+		} else {
+			return
+		}
+	case floorGrant:
+		// The holder hands control over under single; hosts give it
+		// under either.
+		q, ok := f.participantLocked(to)
+		if !ok || q.Observer || (!p.Host && (policy == inputHost || f.holder != id)) || (policy == inputHost && q.Host) {
+			return
+		}
+		f.holder = to
+		f.requests = slices.DeleteFunc(f.requests, func(r string) bool { return r == to })
+	case floorRevoke:
+		if !p.Host || f.holder == "" {
+			return
+		}
+		f.holder = ""
+	default:
+		return
+	}
+	f.notifyLocked()
+}
+
+// status is the state as participant you sees it.
+func (f *inputFloor) status(you string) (inputControlMessage, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return inputControlMessage{
+		Type:         "input_control",
+		Policy:       f.policyLocked(),
+		Holder:       f.holder,
+		Requests:     slices.Clone(f.requests),
+		Participants: slices.Clone(f.participants),
+		You:          you,
+		CanWrite:     f.mayWriteLocked(you),
+	}, f.changedLocked()
+}
+
+// follow sends participant you the state, and then every change of it,
+// until ctx is done or the session ends.
+func (s *session) followFloor(ctx context.Context, you string, send func(inputControlMessage)) {
+	for {
+		m, changed := s.floor.status(you)
+		send(m)
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// floorTarget is a session as one of its participants drives it: input
+// without control is dropped.
+type floorTarget struct {
+	terminalTarget
+	floor *inputFloor
+	id    string
+}
+
+func (t floorTarget) write(p []byte) error {
+	if !t.floor.mayWrite(t.id) {
+		inputWithoutControl.add(1, "policy", t.floor.currentPolicy())
+		return nil
+	}
+	return t.terminalTarget.write(p)
+}
+
+func (t floorTarget) key(key string) error {
+	if !t.floor.mayWrite(t.id) {
+		inputWithoutControl.add(1, "policy", t.floor.currentPolicy())
+		return nil
+	}
+	return t.terminalTarget.key(key)
+}
+
+// inputPolicyRequest is the body of PUT /v1/sessions/{id}/input-policy.
+type inputPolicyRequest struct {
+	Policy string `json:"policy"`
+}
+
+func handleGetInputPolicy(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	m, _ := sess.floor.status("")
+	writeJSON(w, http.StatusOK, m)
+}
+
+func handleSetInputPolicy(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	var req inputPolicyRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&req); err != nil {
+		writeError(w, r, fmt.Errorf("%w: %v", errInvalidInputPolicy, err))
+		return
+	}
+	if err := sess.floor.setPolicy(req.Policy); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	infof("Session %s input policy set to %s", sess.id, req.Policy)
+	m, _ := sess.floor.status("")
+	writeJSON(w, http.StatusOK, m)
+}
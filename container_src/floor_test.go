@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestInputPolicy(t *testing.T) {
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	setPolicy := func(policy string) int {
+		t.Helper()
+		req, _ := http.NewRequest("PUT", testURL+"/v1/sessions/"+sess.id+"/input-policy", strings.NewReader(`{"policy": "`+policy+`"}`))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := setPolicy("everyone"); status != http.StatusBadRequest {
+		t.Errorf("policy everyone: %d", status)
+	}
+	if status := setPolicy(inputSingle); status != http.StatusOK {
+		t.Fatalf("policy single: %d", status)
+	}
+	info, _ := shares.create(sess, shareRequest{Mode: shareWrite})
+
+	// Two guests, typing into the session and reading what it prints.
+	type guest struct {
+		conn *websocket.Conn
+		out  strings.Builder
+		last inputControlMessage
+	}
+	dial := func(name string) *guest {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws?control=1&display_name="+name+"&share="+info.Token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		return &guest{conn: conn}
+	}
+	// await reads g's connection until the last input_control message
+	// satisfies ok, and the output contains want.
+	await := func(g *guest, want string, ok func(inputControlMessage) bool) {
+		t.Helper()
+		for !ok(g.last) || !strings.Contains(g.out.String(), want) {
+			typ, data, err := g.conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for %q: %v; last %+v", want, err, g.last)
+			}
+			if typ == websocket.BinaryMessage {
+				g.out.Write(data)
+			} else if strings.Contains(string(data), `"input_control"`) {
+				g.last = inputControlMessage{}
+				json.Unmarshal(data, &g.last)
+			}
+		}
+	}
+	act := func(g *guest, action, to string) {
+		data, _ := json.Marshal(clientMessage{Type: "input_control", Action: action, To: to})
+		g.conn.WriteMessage(websocket.TextMessage, data)
+	}
+	ada, bob := dial("ada"), dial("bob")
+	defer ada.conn.Close()
+	defer bob.conn.Close()
+	await(ada, "", func(m inputControlMessage) bool { return len(m.Participants) == 2 })
+	await(bob, "", func(m inputControlMessage) bool { return len(m.Participants) == 2 })
+
+	// Nobody holds control, so ada's request gets it, and bob's input is
+	// dropped until ada hands it over.
+	act(ada, floorRequest, "")
+	await(bob, "", func(m inputControlMessage) bool { return m.Holder == ada.last.You })
+	bob.conn.WriteMessage(websocket.TextMessage, []byte("echo bob-$((1+1))\n"))
+	ada.conn.WriteMessage(websocket.TextMessage, []byte("echo ada-$((2+3))\n"))
+	await(ada, "ada-5", func(m inputControlMessage) bool { return m.CanWrite })
+	act(bob, floorRequest, "")
+	await(ada, "", func(m inputControlMessage) bool { return len(m.Requests) == 1 })
+	act(ada, floorGrant, bob.last.You)
+	await(bob, "", func(m inputControlMessage) bool { return m.CanWrite })
+	bob.conn.WriteMessage(websocket.TextMessage, []byte("echo bob-$((3+4))\n"))
+	await(ada, "bob-7", func(m inputControlMessage) bool { return !m.CanWrite })
+	if strings.Contains(ada.out.String(), "bob-2") {
+		t.Errorf("input without control reached the session: %q", ada.out.String())
+	}
+
+	// Under host, guests type only with a host's grant, which they can't
+	// give each other.
+	if status := setPolicy(inputHost); status != http.StatusOK {
+		t.Fatalf("policy host: %d", status)
+	}
+	await(bob, "", func(m inputControlMessage) bool { return m.Policy == inputHost && !m.CanWrite })
+	act(bob, floorGrant, bob.last.You)
+	act(bob, floorRequest, "")
+	await(ada, "", func(m inputControlMessage) bool { return len(m.Requests) == 1 && m.Holder == "" })
+	if sess.floor.mayWrite(bob.last.You) {
+		t.Error("a guest gave itself control under the host policy")
+	}
+	sess.floor.join(floorParticipant{ID: "host", Host: true})
+	sess.floor.act("host", floorGrant, bob.last.You)
+	await(bob, "", func(m inputControlMessage) bool { return m.CanWrite })
+	if got := newSessionInfo(sess).InputPolicy; got != inputHost {
+		t.Errorf("session input_policy %q", got)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultFreezeTimeout and maxFreezeTimeout bound how long a freeze
+	// waits for writes to finish and reach the bucket.
+	defaultFreezeTimeout = 30 * time.Second
+	maxFreezeTimeout     = 5 * time.Minute
+	// freezePoll is how often a freeze checks whether the bucket caught up.
+	freezePoll = 100 * time.Millisecond
+)
+
+var (
+	errFrozen        = errors.New("workspace is frozen")
+	errInvalidFreeze = errors.New("invalid freeze request")
+)
+
+// freezeRequest is the body of POST /v1/freeze.
+type freezeRequest struct {
+	// Reason is shown in the status and in the errors of refused writes.
+	Reason string `json:"reason,omitempty"`
+	// Timeout bounds the wait for writes to finish, 30s by default.
+	Timeout duration `json:"timeout"`
+}
+
+// freezeStatus is the body of /v1/freeze and /v1/unfreeze.
+type freezeStatus struct {
+	Frozen bool       `json:"frozen"`
+	Since  *time.Time `json:"since,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+	// MountReadOnly is set when the mount was made read-only as well, so
+	// shells can't write to /data either. MountError is why it couldn't
+	// be, typically a file a program holds open for writing.
+	MountReadOnly bool   `json:"mount_read_only"`
+	MountError    string `json:"mount_error,omitempty"`
+	// Durability is the mount's state when the freeze completed: saved
+	// once the bucket has every write, or local without a bucket.
+	Durability string `json:"durability,omitempty"`
+}
+
+// freezeState is the workspace's freeze: while frozen, the routes that
+// change /data are refused (see route.Writes) and the mount is read-only.
+// Freezing waits for writes in flight, which then count as done.
+type freezeState struct {
+	mu     sync.Mutex
+	status freezeStatus
+	// freezing is set while a freeze waits; writes are refused already.
+	freezing bool
+	inflight int
+	// idle is closed when inflight drops to 0, for a freeze waiting on it.
+	idle chan struct{}
+}
+
+var workspaceFreeze = &freezeState{}
+
+// remountData makes the mount read-only, or writable again.
+var remountData = func(readOnly bool) error {
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND)
+	if readOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	return syscall.Mount("", dataDir, "", flags, "")
+}
+
+// frozen reports whether writes are refused.
+func (f *freezeState) frozen() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status.Frozen || f.freezing
+}
+
+func (f *freezeState) current() freezeStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// enter counts a write in flight, or returns errFrozen.
+func (f *freezeState) enter() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status.Frozen || f.freezing {
+		if f.status.Reason != "" {
+			return fmt.Errorf("%w: %s", errFrozen, f.status.Reason)
+		}
+		return errFrozen
+	}
+	f.inflight++
+	return nil
+}
+
+func (f *freezeState) leave() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inflight--
+	if f.inflight == 0 && f.idle != nil {
+		close(f.idle)
+		f.idle = nil
+	}
+}
+
+// freeze refuses new writes, waits for those in flight, makes the mount
+// read-only and waits for the bucket to catch up, undoing it all if ctx is
+// done first. Freezing a frozen workspace returns its status.
+func (f *freezeState) freeze(ctx context.Context, reason string) (freezeStatus, error) {
+	f.mu.Lock()
+	if f.status.Frozen {
+		defer f.mu.Unlock()
+		return f.status, nil
+	}
+	if f.freezing {
+		f.mu.Unlock()
+		return freezeStatus{}, fmt.Errorf("%w: another freeze is under way", errFrozen)
+	}
+	f.freezing = true
+	f.status.Reason = reason
+	var idle chan struct{}
+	if f.inflight > 0 {
+		f.idle = make(chan struct{})
+		idle = f.idle
+	}
+	f.mu.Unlock()
+
+	status, err := f.settle(ctx, idle)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.freezing = false
+	if err != nil {
+		f.status = freezeStatus{}
+		return freezeStatus{}, err
+	}
+	now := time.Now().UTC()
+	status.Frozen, status.Since, status.Reason = true, &now, reason
+	f.status = status
+	infof("Workspace frozen (%s): mount read-only %v, %s", reason, status.MountReadOnly, status.Durability)
+	events.publish(event{Kind: eventWorkspaceFrozen, Time: now, Detail: reason})
+	return status, nil
+}
+
+// settle waits for idle, then makes the mount read-only and waits for the
+// bucket to have what was written.
+func (f *freezeState) settle(ctx context.Context, idle <-chan struct{}) (freezeStatus, error) {
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return freezeStatus{}, fmt.Errorf("waiting for writes in flight: %w", ctx.Err())
+		}
+	}
+	var status freezeStatus
+	if mountReady.Load() {
+		if err := remountData(true); err != nil {
+			status.MountError = err.Error()
+			warnf("Freezing: /data stays writable for shells: %v", err)
+		} else {
+			status.MountReadOnly = true
+		}
+	}
+	syscall.Sync()
+	for {
+		durable, changed := durability.status()
+		if durable.State != "saving" {
+			status.Durability = durable.State
+			return status, nil
+		}
+		select {
+		case <-changed:
+		case <-time.After(freezePoll):
+		case <-ctx.Done():
+			if status.MountReadOnly {
+				if err := remountData(false); err != nil {
+					warnf("Unfreezing /data after a failed freeze: %v", err)
+				}
+			}
+			return freezeStatus{}, fmt.Errorf("waiting for the bucket to catch up: %w", ctx.Err())
+		}
+	}
+}
+
+// unfreeze lets writes through again.
+func (f *freezeState) unfreeze() (freezeStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status.MountReadOnly {
+		if err := remountData(false); err != nil {
+			return f.status, fmt.Errorf("making /data writable: %w", err)
+		}
+	}
+	if f.status.Frozen {
+		infof("Workspace unfrozen after %s", time.Since(*f.status.Since).Round(time.Second))
+		events.publish(event{Kind: eventWorkspaceUnfrozen})
+	}
+	f.status = freezeStatus{}
+	return f.status, nil
+}
+
+// inherit carries a freeze over an upgrade: the mount stayed as it was.
+func (f *freezeState) inherit(status *freezeStatus) {
+	if status == nil || !status.Frozen {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = *status
+}
+
+// refuseWhenFrozen runs h, a route that writes to /data, unless the
+// workspace is frozen, and counts it as in flight meanwhile.
+func refuseWhenFrozen(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := workspaceFreeze.enter(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer workspaceFreeze.leave()
+		h(w, r)
+	}
+}
+
+func handleFreeze(w http.ResponseWriter, r *http.Request) {
+	var req freezeRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, r, fmt.Errorf("%w: %v", errInvalidFreeze, err))
+		return
+	}
+	timeout := req.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultFreezeTimeout
+	}
+	if timeout < 0 || timeout > maxFreezeTimeout {
+		writeError(w, r, fmt.Errorf("%w: timeout must be positive and at most %s", errInvalidFreeze, maxFreezeTimeout))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	status, err := workspaceFreeze.freeze(ctx, req.Reason)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func handleUnfreeze(w http.ResponseWriter, r *http.Request) {
+	status, err := workspaceFreeze.unfreeze()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func handleFreezeStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, workspaceFreeze.current())
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFreeze(t *testing.T) {
+	t.Setenv("CONTROL_TOKEN", "secret")
+	prevRemount := remountData
+	defer func() { remountData = prevRemount }()
+	var remounts []bool
+	remountData = func(readOnly bool) error {
+		remounts = append(remounts, readOnly)
+		return nil
+	}
+	defer workspaceFreeze.unfreeze()
+	control := func(method, path, body string) (int, freezeStatus) {
+		t.Helper()
+		req, _ := http.NewRequest(method, testURL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return 0, freezeStatus{}
+		}
+		defer resp.Body.Close()
+		var status freezeStatus
+		json.NewDecoder(resp.Body).Decode(&status)
+		return resp.StatusCode, status
+	}
+	put := func(name string, body io.Reader) (int, string) {
+		req, _ := http.NewRequest("PUT", testURL+"/v1/files/"+name, body)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		var p problem
+		json.NewDecoder(resp.Body).Decode(&p)
+		return resp.StatusCode, p.Type
+	}
+	defer os.Remove(filepath.Join(dataDir, "frozen-slow.txt"))
+	defer os.Remove(filepath.Join(dataDir, "frozen-after.txt"))
+
+	// A write in flight when the freeze starts finishes before it completes.
+	pr, pw := io.Pipe()
+	slow := make(chan int, 1)
+	go func() {
+		code, _ := put("frozen-slow.txt", pr)
+		slow <- code
+	}()
+	pw.Write([]byte("first half, "))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		workspaceFreeze.mu.Lock()
+		inflight := workspaceFreeze.inflight
+		workspaceFreeze.mu.Unlock()
+		if inflight > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the slow upload never started")
+		}
+	}
+	type result struct {
+		code   int
+		status freezeStatus
+	}
+	frozen := make(chan result, 1)
+	go func() {
+		code, status := control("POST", "/v1/freeze", `{"reason": "snapshot"}`)
+		frozen <- result{code, status}
+	}()
+	for !workspaceFreeze.frozen() {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if code, typ := put("frozen-after.txt", strings.NewReader("x")); code != http.StatusConflict || typ != problemTypePrefix+"workspace-frozen" {
+		t.Errorf("write while freezing: %d %s", code, typ)
+	}
+	select {
+	case <-frozen:
+		t.Fatal("freeze completed with a write in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	pw.Write([]byte("second half"))
+	pw.Close()
+	if code := <-slow; code != http.StatusOK {
+		t.Errorf("write in flight: %d", code)
+	}
+	r := <-frozen
+	if r.code != http.StatusOK || !r.status.Frozen || r.status.Reason != "snapshot" || r.status.Since == nil || r.status.Durability != "local" {
+		t.Fatalf("POST /v1/freeze = %d %+v", r.code, r.status)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dataDir, "frozen-slow.txt")); string(data) != "first half, second half" {
+		t.Errorf("write in flight left %q", data)
+	}
+
+	// Frozen, writes are refused, reads aren't, and freezing again is a no-op.
+	if code, typ := put("frozen-after.txt", strings.NewReader("x")); code != http.StatusConflict || typ != problemTypePrefix+"workspace-frozen" {
+		t.Errorf("write while frozen: %d %s", code, typ)
+	}
+	if resp, err := http.Get(testURL + "/v1/files/frozen-slow.txt"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("read while frozen: %v %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+	if code, status := control("POST", "/v1/freeze", ""); code != http.StatusOK || !status.Since.Equal(*r.status.Since) {
+		t.Errorf("freezing again: %d %+v", code, status)
+	}
+	if code, status := control("GET", "/v1/freeze", ""); code != http.StatusOK || !status.Frozen {
+		t.Errorf("GET /v1/freeze = %d %+v", code, status)
+	}
+	if code, _ := control("POST", "/v1/freeze", `{"timeout": "1h"}`); code != http.StatusBadRequest {
+		t.Errorf("timeout=1h: %d", code)
+	}
+
+	// Unfreezing lets writes through again.
+	if code, status := control("POST", "/v1/unfreeze", ""); code != http.StatusOK || status.Frozen {
+		t.Errorf("POST /v1/unfreeze = %d %+v", code, status)
+	}
+	if code, typ := put("frozen-after.txt", strings.NewReader("x")); code != http.StatusOK {
+		t.Errorf("write after unfreezing: %d %s", code, typ)
+	}
+	if len(remounts) != 0 {
+		t.Errorf("remounted %v without a mount", remounts)
+	}
+}
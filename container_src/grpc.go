@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"server/container_src/terminalpb"
+)
+
+// grpcChunkSize bounds the data in a single streamed file or exec message.
+const grpcChunkSize = 64 * 1024
+
+// terminalServer implements the gRPC mirror of the HTTP APIs.
+type terminalServer struct {
+	terminalpb.UnimplementedTerminalServer
+}
+
+// serveGRPC listens on addr and serves the Terminal service until Stop.
+// It keeps a port of its own, though the main server speaks HTTP/2 too:
+// gRPC requests arriving there are for workspace servers behind /proxy.
+func serveGRPC(addr string) (*grpc.Server, error) {
+	ln, err := listen("grpc", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := newGRPCServer()
+	go func() {
+		infof("gRPC listening on %s", ln.Addr())
+		if err := srv.Serve(ln); err != nil {
+			errorf("gRPC server failed: %v", err)
+		}
+	}()
+	return srv, nil
+}
+
+// newGRPCServer returns a server for the Terminal service. Calls are
+// authenticated as HTTP requests are (see withUser), and those from a user
+// scoped the same way.
+func newGRPCServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unaryRequestID, unaryUser),
+		grpc.ChainStreamInterceptor(streamRequestID, streamUser))
+	terminalpb.RegisterTerminalServer(srv, &terminalServer{})
+	return srv
+}
+
+// grpcRequest stands in for an HTTP request with ctx, and its metadata as
+// headers, for the auth provider and the scoping helpers to read.
+func grpcRequest(ctx context.Context) *http.Request {
+	header := make(http.Header)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for k, vs := range md {
+			for _, v := range vs {
+				header.Add(k, v)
+			}
+		}
+	}
+	r := &http.Request{Method: http.MethodPost, URL: &url.URL{}, Header: header}
+	return r.WithContext(ctx)
+}
+
+// grpcUser does for gRPC calls what withUser does for HTTP, with the
+// credentials in the call's metadata.
+func grpcUser(ctx context.Context) (context.Context, error) {
+	id, err := currentConfig().Auth.authenticate(grpcRequest(ctx))
+	switch {
+	case errors.Is(err, errAuthDisabled):
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	case err != nil:
+		return nil, status.Errorf(codes.Unauthenticated, "invalid credentials: %v", err)
+	}
+	return withIdentity(ctx, id), nil
+}
+
+func unaryUser(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := grpcUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func streamUser(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcUser(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ss, ctx})
+}
+
+// scopeGRPCPath is scopePathFor for a gRPC call.
+func scopeGRPCPath(ctx context.Context, p string, write bool) (string, error) {
+	return scopePathFor(grpcRequest(ctx), p, write)
+}
+
+// grpcError maps the server's errors onto gRPC status codes.
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	code := codes.Internal
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, errSessionNotFound):
+		code = codes.NotFound
+	case errors.Is(err, fs.ErrExist), errors.Is(err, errNameConflict):
+		code = codes.AlreadyExists
+	case errors.Is(err, fs.ErrPermission):
+		code = codes.PermissionDenied
+	case errors.Is(err, errOutsideData), errors.Is(err, errEmptyCommand), errors.Is(err, errInvalidMetadata),
+		errors.Is(err, errInvalidSize), errors.Is(err, errUnknownKey):
+		code = codes.InvalidArgument
+	case errors.Is(err, errIsDir):
+		code = codes.FailedPrecondition
+	case errors.Is(err, errTooManySessions), errors.Is(err, errJournalFull):
+		code = codes.ResourceExhausted
+	case errors.Is(err, errSessionClosed), errors.Is(err, errFrozen):
+		code = codes.FailedPrecondition
+	case errors.Is(err, errUserScope):
+		code = codes.PermissionDenied
+	case errors.Is(err, errUpgrading):
+		code = codes.Unavailable
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, err.Error())
+}
+
+func sessionProto(s *session) *terminalpb.Session {
+	meta := s.metadata()
+	modes := s.terminalModes()
+	return &terminalpb.Session{
+		Id:       s.id,
+		Created:  timestamppb.New(s.created),
+		Name:     meta.Name,
+		Tags:     meta.Tags,
+		Metadata: meta.Metadata,
+		Modes: &terminalpb.TerminalModes{
+			AltScreen:      modes.AltScreen,
+			Mouse:          modes.Mouse,
+			MouseEncoding:  modes.MouseEncoding,
+			BracketedPaste: modes.BracketedPaste,
+			AppCursorKeys:  modes.AppCursorKeys,
+			CursorHidden:   modes.CursorHidden,
+		},
+	}
+}
+
+// lookupSession returns the session with id, if the call's user owns it.
+func lookupSession(ctx context.Context, id string) (*session, error) {
+	if sess := sessions.get(id); sess != nil && ownsSession(grpcRequest(ctx), sess) {
+		return sess, nil
+	}
+	return nil, grpcError(fmt.Errorf("session %q: %w", id, errSessionNotFound))
+}
+
+func windowSize(ws *terminalpb.WindowSize) (cols, rows int) {
+	cols, rows = int(ws.GetCols()), int(ws.GetRows())
+	if cols == 0 {
+		cols = 80
+	}
+	if rows == 0 {
+		rows = 24
+	}
+	return cols, rows
+}
+
+func (t *terminalServer) ListSessions(ctx context.Context, req *terminalpb.ListSessionsRequest) (*terminalpb.ListSessionsResponse, error) {
+	resp := &terminalpb.ListSessionsResponse{}
+	for _, s := range sessions.list() {
+		if !ownsSession(grpcRequest(ctx), s) {
+			continue
+		}
+		resp.Sessions = append(resp.Sessions, sessionProto(s))
+	}
+	return resp, nil
+}
+
+func (t *terminalServer) Attach(stream terminalpb.Terminal_AttachServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	var sess *session
+	switch m := first.Msg.(type) {
+	case *terminalpb.AttachRequest_Start:
+		cols, rows := windowSize(m.Start.GetSize())
+		meta := sessionMeta{Name: m.Start.GetName(), Tags: m.Start.GetTags(), Metadata: m.Start.GetMetadata()}
+		if err := meta.validate(); err != nil {
+			return grpcError(err)
+		}
+		if sess, err = sessions.startFor(stream.Context(), cols, rows, meta); err != nil {
+			return grpcError(err)
+		}
+		defer sess.close()
+	case *terminalpb.AttachRequest_SessionId:
+		if sess, err = lookupSession(stream.Context(), m.SessionId); err != nil {
+			return err
+		}
+		if err := sess.restoreSize(0, 0); err != nil {
+			return grpcError(err)
+		}
+	default:
+		return status.Error(codes.InvalidArgument, "first message must set start or session_id")
+	}
+
+	if err := stream.Send(&terminalpb.AttachResponse{Msg: &terminalpb.AttachResponse_Session{Session: sessionProto(sess)}}); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err == io.EOF {
+				// The client is done sending; keep streaming output.
+				return
+			}
+			if err != nil {
+				cancel()
+				return
+			}
+			switch m := req.Msg.(type) {
+			case *terminalpb.AttachRequest_Input:
+				err = sess.write(m.Input)
+				meterTraffic("grpc", trafficTerminal, "in", len(m.Input))
+				sess.meterTraffic(trafficTerminal, "in", len(m.Input))
+			case *terminalpb.AttachRequest_Resize:
+				cols, rows := windowSize(m.Resize)
+				err = sess.resize(cols, rows)
+			case *terminalpb.AttachRequest_Key:
+				err = sess.key(controlKey(m.Key))
+			}
+			if err != nil {
+				ptyWarnf(err, "gRPC attach to %s: %v", sess.id, err)
+			}
+		}
+	}()
+
+	err = sess.follow(ctx, 0, func(data []byte, _ int64) error {
+		if err := stream.Send(&terminalpb.AttachResponse{Msg: &terminalpb.AttachResponse_Output{Output: data}}); err != nil {
+			return err
+		}
+		meterTraffic("grpc", trafficTerminal, "out", len(data))
+		sess.meterTraffic(trafficTerminal, "out", len(data))
+		return nil
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return grpcError(err)
+}
+
+func (t *terminalServer) SendInput(ctx context.Context, req *terminalpb.SendInputRequest) (*terminalpb.SendInputResponse, error) {
+	sess, err := lookupSession(ctx, req.GetSessionId())
+	if err != nil {
+		return nil, err
+	}
+	return &terminalpb.SendInputResponse{}, grpcError(sess.write(req.GetData()))
+}
+
+func (t *terminalServer) ResizeSession(ctx context.Context, req *terminalpb.ResizeSessionRequest) (*terminalpb.ResizeSessionResponse, error) {
+	sess, err := lookupSession(ctx, req.GetSessionId())
+	if err != nil {
+		return nil, err
+	}
+	cols, rows := windowSize(req.GetSize())
+	return &terminalpb.ResizeSessionResponse{}, grpcError(sess.resize(cols, rows))
+}
+
+func (t *terminalServer) SendKey(ctx context.Context, req *terminalpb.SendKeyRequest) (*terminalpb.SendKeyResponse, error) {
+	sess, err := lookupSession(ctx, req.GetSessionId())
+	if err != nil {
+		return nil, err
+	}
+	return &terminalpb.SendKeyResponse{}, grpcError(sess.key(controlKey(req.GetKey())))
+}
+
+// controlKey maps a ControlKey onto the names the other transports use;
+// unspecified keys fail checkKey.
+func controlKey(k terminalpb.ControlKey) string {
+	switch k {
+	case terminalpb.ControlKey_CONTROL_KEY_INTERRUPT:
+		return keyInterrupt
+	case terminalpb.ControlKey_CONTROL_KEY_EOF:
+		return keyEOF
+	case terminalpb.ControlKey_CONTROL_KEY_SUSPEND:
+		return keySuspend
+	}
+	return k.String()
+}
+
+func (t *terminalServer) UpdateSession(ctx context.Context, req *terminalpb.UpdateSessionRequest) (*terminalpb.Session, error) {
+	sess, err := lookupSession(ctx, req.GetSessionId())
+	if err != nil {
+		return nil, err
+	}
+	patch := sessionMetaPatch{Name: req.Name, Metadata: make(map[string]*string)}
+	if req.Tags != nil {
+		tags := req.Tags.GetValues()
+		patch.Tags = &tags
+	}
+	for k, v := range req.GetSetMetadata() {
+		patch.Metadata[k] = &v
+	}
+	for _, k := range req.GetDeleteMetadata() {
+		patch.Metadata[k] = nil
+	}
+	if _, err := sess.updateMetadata(patch); err != nil {
+		return nil, grpcError(err)
+	}
+	return sessionProto(sess), nil
+}
+
+func (t *terminalServer) CloseSession(ctx context.Context, req *terminalpb.CloseSessionRequest) (*terminalpb.CloseSessionResponse, error) {
+	sess, err := lookupSession(ctx, req.GetSessionId())
+	if err != nil {
+		return nil, err
+	}
+	sess.close()
+	return &terminalpb.CloseSessionResponse{}, nil
+}
+
+// execStreamWriter sends exec output as ExecResponse messages. stdout and
+// stderr are copied from separate goroutines, hence the lock.
+type execStreamWriter struct {
+	mu     *sync.Mutex
+	stream terminalpb.Terminal_ExecServer
+	stderr bool
+}
+
+func (w execStreamWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for off := 0; off < len(p); off += grpcChunkSize {
+		chunk := append([]byte(nil), p[off:min(off+grpcChunkSize, len(p))]...)
+		msg := &terminalpb.ExecResponse{Msg: &terminalpb.ExecResponse_Stdout{Stdout: chunk}}
+		if w.stderr {
+			msg.Msg = &terminalpb.ExecResponse_Stderr{Stderr: chunk}
+		}
+		if err := w.stream.Send(msg); err != nil {
+			return off, err
+		}
+	}
+	return len(p), nil
+}
+
+func (t *terminalServer) Exec(req *terminalpb.ExecRequest, stream terminalpb.Terminal_ExecServer) error {
+	er := execRequest{
+		Argv:  req.GetArgv(),
+		Cwd:   req.GetCwd(),
+		Env:   req.GetEnv(),
+		Stdin: req.GetStdin(),
+	}
+	if req.GetTimeout() != nil {
+		er.Timeout.Duration = req.GetTimeout().AsDuration()
+	}
+	if user := userFromContext(stream.Context()); user != "" {
+		if err := scopeExec(grpcRequest(stream.Context()), user, &er); err != nil {
+			return grpcError(err)
+		}
+	}
+	var mu sync.Mutex
+	code, err := runExec(stream.Context(), er,
+		execStreamWriter{mu: &mu, stream: stream},
+		execStreamWriter{mu: &mu, stream: stream, stderr: true})
+	if errors.Is(err, errEmptyCommand) || errors.Is(err, errOutsideData) || errors.Is(err, fs.ErrNotExist) {
+		return grpcError(err)
+	}
+	exit := &terminalpb.ExecExit{Code: int32(code)}
+	if err != nil {
+		exit.Error = err.Error()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return stream.Send(&terminalpb.ExecResponse{Msg: &terminalpb.ExecResponse_Exit{Exit: exit}})
+}
+
+// fileInfoProto returns fi as the call's user sees it.
+func fileInfoProto(ctx context.Context, fi fileInfo) *terminalpb.FileInfo {
+	return &terminalpb.FileInfo{
+		Path:    unscopePath(grpcRequest(ctx), fi.Path),
+		Size:    fi.Size,
+		Mode:    fi.Mode,
+		ModTime: timestamppb.New(fi.ModTime),
+		IsDir:   fi.IsDir,
+		Queued:  fi.Queued,
+	}
+}
+
+func (t *terminalServer) Stat(ctx context.Context, req *terminalpb.StatRequest) (*terminalpb.FileInfo, error) {
+	p, err := scopeGRPCPath(ctx, req.GetPath(), false)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	fi, err := statPath(p)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return fileInfoProto(ctx, fi), nil
+}
+
+func (t *terminalServer) ListDir(ctx context.Context, req *terminalpb.ListDirRequest) (*terminalpb.ListDirResponse, error) {
+	p, err := scopeGRPCPath(ctx, req.GetPath(), false)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	entries, err := listDir(p)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &terminalpb.ListDirResponse{}
+	for _, e := range entries {
+		resp.Entries = append(resp.Entries, fileInfoProto(ctx, e))
+	}
+	return resp, nil
+}
+
+func (t *terminalServer) ReadFile(req *terminalpb.ReadFileRequest, stream terminalpb.Terminal_ReadFileServer) error {
+	p, err := scopeGRPCPath(stream.Context(), req.GetPath(), false)
+	if err != nil {
+		return grpcError(err)
+	}
+	f, _, err := openFile(p)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer f.Close()
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&terminalpb.ReadFileResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return grpcError(err)
+		}
+	}
+}
+
+func (t *terminalServer) WriteFile(stream terminalpb.Terminal_WriteFileServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	start := first.GetStart()
+	if start == nil {
+		return status.Error(codes.InvalidArgument, "first message must set start")
+	}
+	p, err := scopeGRPCPath(stream.Context(), start.GetPath(), true)
+	if err != nil {
+		return grpcError(err)
+	}
+	if err := workspaceFreeze.enter(); err != nil {
+		return grpcError(err)
+	}
+	defer workspaceFreeze.leave()
+
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err == io.EOF {
+				pw.Close()
+				return
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := pw.Write(req.GetData()); err != nil {
+				return
+			}
+		}
+	}()
+	fi, err := writeFile(p, pr, fs.FileMode(start.GetMode()))
+	pr.CloseWithError(err)
+	if err != nil {
+		return grpcError(err)
+	}
+	return stream.SendAndClose(fileInfoProto(stream.Context(), fi))
+}
+
+func (t *terminalServer) Remove(ctx context.Context, req *terminalpb.RemoveRequest) (*terminalpb.RemoveResponse, error) {
+	p, err := scopeGRPCPath(ctx, req.GetPath(), true)
+	if err == nil && isUserRoot(grpcRequest(ctx), p) {
+		err = fmt.Errorf("%w: cannot remove the user's directory", errOutsideData)
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if err := workspaceFreeze.enter(); err != nil {
+		return nil, grpcError(err)
+	}
+	defer workspaceFreeze.leave()
+	return &terminalpb.RemoveResponse{}, grpcError(removePath(p, req.GetRecursive()))
+}
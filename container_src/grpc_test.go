@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"server/container_src/terminalpb"
+)
+
+// TestGRPCUsers checks that gRPC calls with a user token are scoped to the
+// user's namespace, as HTTP requests are.
+func TestGRPCUsers(t *testing.T) {
+	t.Setenv("USER_TOKEN_SECRET", "grpc-secret")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newGRPCServer()
+	go srv.Serve(ln)
+	defer srv.Stop()
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tc := terminalpb.NewTerminalClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	as := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, userTokenHeader, token)
+	}
+	alice := as(userToken("grpc-secret", "grpc-alice"))
+
+	if _, err := tc.ListSessions(as("not-a-token"), &terminalpb.ListSessionsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("bad token: %v, want Unauthenticated", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dataDir, "grpc-secret.txt"), []byte("unscoped"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tc.Stat(alice, &terminalpb.StatRequest{Path: "/grpc-secret.txt"}); status.Code(err) != codes.NotFound {
+		t.Errorf("stat outside the namespace: %v, want NotFound", err)
+	}
+
+	ws, err := tc.WriteFile(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Send(&terminalpb.WriteFileRequest{Msg: &terminalpb.WriteFileRequest_Start{Start: &terminalpb.WriteFileStart{Path: "/notes.txt"}}})
+	ws.Send(&terminalpb.WriteFileRequest{Msg: &terminalpb.WriteFileRequest_Data{Data: []byte("hi")}})
+	fi, err := ws.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if fi.GetPath() != "notes.txt" {
+		t.Errorf("written path %q, want notes.txt", fi.GetPath())
+	}
+	if b, err := os.ReadFile(filepath.Join(userRoot("grpc-alice"), "notes.txt")); err != nil || string(b) != "hi" {
+		t.Errorf("user's file: %q %v", b, err)
+	}
+
+	if _, err := tc.Remove(alice, &terminalpb.RemoveRequest{Path: "/", Recursive: true}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("remove the user's directory: %v, want InvalidArgument", err)
+	}
+
+	es, err := tc.Exec(alice, &terminalpb.ExecRequest{Argv: []string{"pwd"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	for {
+		msg, err := es.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("exec: %v", err)
+		}
+		out.Write(msg.GetStdout())
+	}
+	if want, _ := filepath.EvalSymlinks(userRoot("grpc-alice")); strings.TrimSpace(out.String()) != want {
+		t.Errorf("exec ran in %q, want %q", strings.TrimSpace(out.String()), want)
+	}
+}
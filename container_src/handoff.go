@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/container_src/internal/s3client"
+)
+
+const (
+	// handoffPrefix is where sessions are handed off to the next container
+	// in the bucket: the manifest, and the recordings it continues.
+	handoffPrefix = ".session-handoff/"
+	handoffKey    = handoffPrefix + "sessions.json"
+	// handoffMaxAge is how old a handoff may be for sessions to be
+	// recreated from it; an older one is from a container that stopped
+	// long before this one started, whose clients are long gone.
+	handoffMaxAge = 10 * time.Minute
+	// handoffTimeout bounds the handoff made on SIGTERM, and its pickup at
+	// boot.
+	handoffTimeout = 10 * time.Second
+)
+
+// handoffState is the sessions a container handed off before it was
+// replaced.
+type handoffState struct {
+	Exported   time.Time        `json:"exported"`
+	InstanceID string           `json:"instance_id,omitempty"`
+	Sessions   []handoffSession `json:"sessions"`
+}
+
+// handoffSession is what a session needs to be recreated elsewhere. Unlike
+// an upgrade's handoverSession it can't keep the shell, only start another
+// like it.
+type handoffSession struct {
+	ID      string      `json:"id"`
+	User    string      `json:"user,omitempty"`
+	Created time.Time   `json:"created"`
+	Meta    sessionMeta `json:"meta"`
+	// Cwd is the shell's directory, and Env the variables it was started
+	// with other than those the server sets itself.
+	Cwd     string          `json:"cwd,omitempty"`
+	Env     []string        `json:"env,omitempty"`
+	Cols    int             `json:"cols"`
+	Rows    int             `json:"rows"`
+	Output  logSnapshot     `json:"output"`
+	History []commandRecord `json:"history,omitempty"`
+	// Injections is its audit trail of injected input.
+	Injections []injectionRecord `json:"injections,omitempty"`
+	// Recording names the session's asciicast under handoffPrefix, as
+	// recorded up to RecordingOffset bytes.
+	Recording       string    `json:"recording,omitempty"`
+	RecordingStart  time.Time `json:"recording_start,omitzero"`
+	RecordingOffset int64     `json:"recording_offset,omitempty"`
+
+	// rec continues the recording, once it has been fetched.
+	rec *recorder
+}
+
+// handoffResult is the response to POST /v1/handoff.
+type handoffResult struct {
+	Key      string    `json:"key"`
+	Exported time.Time `json:"exported"`
+	// Sessions are the IDs of the sessions handed off.
+	Sessions []string `json:"sessions"`
+}
+
+// exportHandoff writes the live sessions to the bucket for the container
+// that replaces this one. They go on running here until it stops.
+func exportHandoff(ctx context.Context) (handoffResult, error) {
+	store := bucketStore.Load()
+	if store == nil {
+		return handoffResult{}, errNoBucket
+	}
+	st := handoffState{
+		Exported:   time.Now().UTC(),
+		InstanceID: os.Getenv("CLOUDFLARE_DURABLE_OBJECT_ID"),
+		Sessions:   []handoffSession{},
+	}
+	res := handoffResult{Key: handoffKey, Exported: st.Exported, Sessions: []string{}}
+	for _, s := range sessions.list() {
+		if s.isClosed() || s.exited.Load() || s.cmd == nil {
+			continue
+		}
+		hs, err := s.handoff(ctx, store)
+		if err != nil {
+			warnf("Session %s not handed off: %v", s.id, err)
+			continue
+		}
+		st.Sessions = append(st.Sessions, hs)
+		res.Sessions = append(res.Sessions, hs.ID)
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return handoffResult{}, err
+	}
+	if err := store.PutObject(ctx, handoffKey, bytes.NewReader(data), "application/json"); err != nil {
+		return handoffResult{}, fmt.Errorf("writing %s: %w", handoffKey, err)
+	}
+	infof("Handed off %d sessions to %s", len(st.Sessions), handoffKey)
+	return res, nil
+}
+
+// handoff describes s for another container, uploading its recording so
+// far if it is recorded.
+func (s *session) handoff(ctx context.Context, store *s3client.Client) (handoffSession, error) {
+	pid := s.cmd.Process.Pid
+	cols, rows := s.size()
+	hs := handoffSession{
+		ID:         s.id,
+		User:       s.user,
+		Created:    s.created,
+		Meta:       s.metadata(),
+		Env:        shellEnv(pid),
+		Cols:       cols,
+		Rows:       rows,
+		Output:     s.output.snapshot(),
+		History:    s.commandHistory(),
+		Injections: s.injectionTrail(),
+	}
+	hs.Cwd, _ = os.Readlink("/proc/" + strconv.Itoa(pid) + "/cwd")
+	if prompt, _ := s.promptStatus(); hs.Cwd == "" && prompt != nil {
+		hs.Cwd = prompt.Cwd
+	}
+	if s.rec == nil {
+		return hs, nil
+	}
+	if err := s.rec.flush(); err != nil {
+		return hs, fmt.Errorf("recording: %w", err)
+	}
+	f, err := os.Open(s.rec.path)
+	if err != nil {
+		return hs, fmt.Errorf("recording: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return hs, fmt.Errorf("recording: %w", err)
+	}
+	// Only what was flushed: the pump may be writing more.
+	name := filepath.Base(s.rec.path)
+	if err := store.PutObject(ctx, handoffPrefix+name, io.NewSectionReader(f, 0, fi.Size()), "application/x-asciicast"); err != nil {
+		return hs, fmt.Errorf("recording: %w", err)
+	}
+	hs.Recording, hs.RecordingStart, hs.RecordingOffset = name, s.rec.start, fi.Size()
+	return hs, nil
+}
+
+// shellEnv returns the variables in pid's environment that the server
+// didn't start it with, which are those a session's shell got from its
+// user or .env file. Variables it exported since can't be seen from
+// outside.
+func shellEnv(pid int) []string {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/environ")
+	if err != nil {
+		return nil
+	}
+	own := os.Environ()
+	var env []string
+	for _, kv := range strings.Split(string(data), "\x00") {
+		name, _, ok := strings.Cut(kv, "=")
+		if !ok || slices.Contains(own, kv) || slices.Contains(reservedEnv, name) {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// restoreHandoff recreates the sessions handed off by the container this
+// one replaces, if it did so recently, each with a new shell, for their
+// clients to reclaim as after an upgrade. The handoff is removed either
+// way, so that it is only picked up once.
+func restoreHandoff() {
+	store := bucketStore.Load()
+	if store == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), handoffTimeout)
+	defer cancel()
+	body, err := store.GetObject(ctx, handoffKey, "")
+	if s3client.IsNotFound(err) {
+		return
+	}
+	if err != nil {
+		warnf("Reading session handoff: %v", err)
+		return
+	}
+	var st handoffState
+	err = json.NewDecoder(body).Decode(&st)
+	body.Close()
+	defer func() {
+		for _, hs := range st.Sessions {
+			if hs.Recording != "" {
+				store.DeleteObject(ctx, handoffPrefix+filepath.Base(hs.Recording))
+			}
+		}
+		if err := store.DeleteObject(ctx, handoffKey); err != nil {
+			warnf("Removing session handoff: %v", err)
+		}
+	}()
+	if err != nil {
+		warnf("Reading session handoff: %v", err)
+		return
+	}
+	if age := time.Since(st.Exported); age > handoffMaxAge {
+		infof("Not recreating %d sessions handed off %s ago", len(st.Sessions), age.Round(time.Second))
+		return
+	}
+	n := 0
+	for _, hs := range st.Sessions {
+		if hs.ID == "" || sessions.get(hs.ID) != nil {
+			continue
+		}
+		if hs.Recording != "" {
+			if hs.rec, err = fetchHandoffRecording(ctx, store, hs); err != nil {
+				warnf("Session %s: recording not continued after handoff: %v", hs.ID, err)
+			}
+		}
+		s, err := sessions.spawn(hs.Cols, hs.Rows, hs.Meta, hs.User, spawnOptions{from: &hs})
+		if err != nil {
+			warnf("Session %s not recreated after handoff: %v", hs.ID, err)
+			if hs.rec != nil {
+				hs.rec.close()
+			}
+			continue
+		}
+		s.notice("This session moved to a new container: its shell was started again, without the programs it was running.")
+		n++
+	}
+	infof("Recreated %d of %d sessions handed off %s ago", n, len(st.Sessions), time.Since(st.Exported).Round(time.Second))
+}
+
+// fetchHandoffRecording downloads the recording hs continues and opens it
+// to be continued.
+func fetchHandoffRecording(ctx context.Context, store *s3client.Client, hs handoffSession) (*recorder, error) {
+	name := filepath.Base(hs.Recording)
+	body, err := store.GetObject(ctx, handoffPrefix+name, "")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if err := os.MkdirAll(recordingsDir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(recordingsDir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != hs.RecordingOffset {
+		err = fmt.Errorf("got %d bytes of %d", n, hs.RecordingOffset)
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return reopenRecorder(path, hs.RecordingStart)
+}
+
+// shellDir is the directory the recreated shell starts in: the last one's,
+// if it is still there and, for a user's session, in their namespace, or
+// else def.
+func (hs *handoffSession) shellDir(def string) string {
+	if hs.Cwd == "" || (hs.User != "" && !strings.HasPrefix(hs.Cwd+"/", userRoot(hs.User)+"/")) {
+		return def
+	}
+	if fi, err := os.Stat(hs.Cwd); err != nil || !fi.IsDir() {
+		return def
+	}
+	return hs.Cwd
+}
+
+// restore gives s, before it is listed, the identity and scrollback of the
+// session handed off, so clients carry on reading from their offsets.
+func (hs *handoffSession) restore(s *session) {
+	s.id = hs.ID
+	s.created = hs.Created
+	s.output = restoreOutputLog(scrollbackLimit, hs.Output)
+	s.history = hs.History
+	s.commandsRun = len(hs.History)
+	s.injections = hs.Injections
+	s.awaitReclaim()
+}
+
+func handleHandoff(w http.ResponseWriter, r *http.Request) {
+	res, err := exportHandoff(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"server/container_src/internal/s3client"
+	"server/container_src/internal/s3test"
+)
+
+func TestSessionHandoff(t *testing.T) {
+	t.Cleanup(func() { bucketStore.Store(nil) })
+	store := s3test.NewServer(t).Client(t, "s3-test")
+	bucketStore.Store(store)
+	dir := filepath.Join(dataDir, "handoff-cwd")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := sessions.start(90, 20, sessionMeta{Name: "moving"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.write([]byte("cd " + dir + " && echo moved-in\n"))
+	// Once the echo has run and the shell prompted again, it has no more
+	// output to add.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, _, _ := sess.output.read(0, 1<<20); bytes.Count(data, []byte("moved-in")) == 2 && bytes.HasSuffix(data, []byte("$ ")) {
+			break
+		}
+	}
+	res, err := exportHandoff(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(res.Sessions, sess.id) {
+		t.Fatalf("handoff %+v left out %s", res, sess.id)
+	}
+	before := sess.output.snapshot()
+
+	// The container is replaced: the session ends here, and the next one
+	// recreates it from the bucket for its client to reclaim.
+	sess.close()
+	<-sess.done
+	restoreHandoff()
+	moved := sessions.get(sess.id)
+	if moved == nil {
+		t.Fatal("session not recreated")
+	}
+	defer moved.close()
+	if moved.metadata().Name != "moving" {
+		t.Errorf("recreated session's metadata: %+v", moved.metadata())
+	}
+	if cols, rows := moved.size(); cols != 90 || rows != 20 {
+		t.Errorf("recreated at %dx%d", cols, rows)
+	}
+	if after := moved.output.snapshot(); after.Start != before.Start || !bytes.HasPrefix(after.Data, before.Data) {
+		t.Error("scrollback not carried over")
+	}
+	if p, _ := os.Readlink("/proc/" + strconv.Itoa(moved.cmd.Process.Pid) + "/cwd"); p != dir {
+		t.Errorf("recreated shell in %s, want %s", p, dir)
+	}
+	if sessions.reclaim(sess.id, "") != moved {
+		t.Error("recreated session can't be reclaimed")
+	}
+	if _, err := store.GetObject(context.Background(), handoffKey, ""); !s3client.IsNotFound(err) {
+		t.Errorf("handoff left in the bucket: %v", err)
+	}
+}
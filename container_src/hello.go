@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+)
+
+// protocolVersion is the version of the WebSocket protocols, /ws with
+// control=1 and /ws/mux, announced in their hello message. It goes up
+// when a change would break a client written against the previous one;
+// additions are announced as features instead.
+const protocolVersion = 1
+
+// helloMessage is the first message a control client receives, so that it
+// can feature-detect instead of guessing from the server's version.
+type helloMessage struct {
+	Type     string `json:"type"` // "hello"
+	Protocol int    `json:"protocol"`
+	// Features names the optional parts of the protocol this server
+	// speaks; see helloFeatures.
+	Features []string `json:"features"`
+	// Session and Shell describe the session a /ws client is attached
+	// to, Service the service instead.
+	Session string `json:"session,omitempty"`
+	Shell   string `json:"shell,omitempty"`
+	Service string `json:"service,omitempty"`
+	// Share is the mode, observe or write, of the share link a guest
+	// attached with.
+	Share string `json:"share,omitempty"`
+	// Mounted and Degraded are as in GET /v1/health.
+	Mounted  bool   `json:"mounted"`
+	Degraded string `json:"degraded,omitempty"`
+	Version  string `json:"version"`
+}
+
+// helloFeatures lists the features a client connecting with r can use:
+//
+//   - binary_frames: output arrives in binary frames, control messages in
+//     text frames.
+//   - mux: /ws/mux is available.
+//   - reclaim: sessions survive an upgrade, for reclaiming with ?session=.
+//   - paste_file, paste_confirm: binary file pastes and ?confirm_paste=.
+//   - probe, durability: the probe/rtt and durability messages.
+//   - prompt: prompt messages from sessions whose shell reports them.
+//   - notify: {"type": "notify"} requests for command_finished messages.
+//   - alerts: bell and notification messages from sessions.
+//   - rsync: /ws/mux opens rsync channels; rsync is installed.
+//   - exec: /ws/mux opens exec channels, commands run on a PTY.
+//   - recording: new sessions are being recorded.
+//   - share: /ws?share= attaches with a share link.
+//   - screen_sync: observers are sent screen repaints and screen_size
+//     messages.
+//   - input_control: input_control messages say who may type into a
+//     session, and clients send them to ask for and hand over control.
+//   - search: search messages find text in a session's transcript.
+func helloFeatures(r *http.Request) []string {
+	features := []string{"binary_frames"}
+	if userFromContext(r.Context()) == "" {
+		features = append(features, "mux", "exec")
+		if _, err := exec.LookPath("rsync"); err == nil {
+			features = append(features, "rsync")
+		}
+	}
+	features = append(features, "reclaim", "paste_file", "paste_confirm", "probe", "durability", "prompt", "notify", "alerts", "share", "screen_sync", "shutdown", "resume", "input_control", "search")
+	if flags.enabled(flagRecording) {
+		features = append(features, "recording")
+	}
+	return features
+}
+
+func newHello(r *http.Request) helloMessage {
+	return helloMessage{
+		Type:     "hello",
+		Protocol: protocolVersion,
+		Features: helloFeatures(r),
+		Mounted:  mountReady.Load(),
+		Degraded: degraded.status(),
+		Version:  buildVersion.Commit,
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHello(t *testing.T) {
+	wsURL := "ws" + strings.TrimPrefix(testURL, "http")
+	hello := func(path string) helloMessage {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var h helloMessage
+		if err := conn.ReadJSON(&h); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	h := hello("/ws?control=1")
+	if h.Type != "hello" || h.Protocol != protocolVersion || h.Session == "" || h.Shell != "/bin/sh" || h.Version == "" {
+		t.Fatalf("/ws hello = %+v", h)
+	}
+	if !slices.Contains(h.Features, "binary_frames") || !slices.Contains(h.Features, "mux") {
+		t.Fatalf("/ws features = %v", h.Features)
+	}
+	if h := hello("/ws/mux"); h.Type != "hello" || h.Session != "" || h.Protocol != protocolVersion {
+		t.Fatalf("/ws/mux hello = %+v", h)
+	}
+}
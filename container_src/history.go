@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// maxCommandHistory bounds the commands a session remembers; older ones
+// are dropped first.
+const maxCommandHistory = 1000
+
+// commandRecord is a command a session's shell ran, as its prompt markers
+// reported it.
+type commandRecord struct {
+	// Command is the command line, if the shell reported it.
+	Command    string    `json:"command,omitempty"`
+	Cwd        string    `json:"cwd,omitempty"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	DurationMS int64     `json:"duration_ms"`
+	ExitCode   *int      `json:"exit_code,omitempty"`
+}
+
+type commandHistory struct {
+	Commands []commandRecord `json:"commands"`
+}
+
+// addHistory records commands that finished, oldest first.
+func (s *session) addHistory(cmds []commandRecord) {
+	for i := range cmds {
+		cmds[i].Command = redactString(cmds[i].Command)
+		events.publish(event{Kind: eventCommandFinished, Session: s, Command: cmds[i]})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append(s.history, cmds...)
+	if n := len(s.history) - maxCommandHistory; n > 0 {
+		s.history = append(s.history[:0:0], s.history[n:]...)
+	}
+	s.commandsRun += len(cmds)
+	if s.commandDone != nil {
+		close(s.commandDone)
+		s.commandDone = nil
+	}
+}
+
+// nextCommand waits for the next command to finish, from when it is
+// called, and returns it. It fails if ctx is done or the session ends
+// first.
+func (s *session) nextCommand(ctx context.Context) (commandRecord, bool) {
+	s.mu.Lock()
+	from := s.commandsRun
+	for s.commandsRun == from {
+		if s.commandDone == nil {
+			s.commandDone = make(chan struct{})
+		}
+		done := s.commandDone
+		s.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return commandRecord{}, false
+		case <-s.done:
+			return commandRecord{}, false
+		}
+		s.mu.Lock()
+	}
+	defer s.mu.Unlock()
+	// The first to finish, unless it has already been dropped.
+	i := max(len(s.history)-(s.commandsRun-from), 0)
+	return s.history[i], true
+}
+
+// commandHistory returns the commands the session has run, oldest first.
+func (s *session) commandHistory() []commandRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]commandRecord{}, s.history...)
+}
+
+func handleSessionHistory(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	cmds := sess.commandHistory()
+	if r.URL.Query().Get("failed") != "" {
+		failed := cmds[:0]
+		for _, c := range cmds {
+			if c.ExitCode != nil && *c.ExitCode != 0 {
+				failed = append(failed, c)
+			}
+		}
+		cmds = failed
+	}
+	writeJSON(w, http.StatusOK, commandHistory{Commands: cmds})
+}
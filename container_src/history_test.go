@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCommandHistory(t *testing.T) {
+	var sc promptScanner
+	sc.feed([]byte("\x1b]133;D;0\a\x1b]133;A\a$ \x1b]133;C\aok\r\n\x1b]633;E;make test\a\x1b]133;D;2\a"))
+	cmds := sc.takeFinished()
+	if len(cmds) != 1 || cmds[0].Command != "make test" || cmds[0].ExitCode == nil || *cmds[0].ExitCode != 2 {
+		t.Fatalf("finished commands = %+v, want only make test", cmds)
+	}
+
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("no bash")
+	}
+	t.Setenv("SHELL", bash)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws?control=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var id string
+	for exit := 0; exit != 3; {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m struct {
+			Type string `json:"type"`
+			ID   string `json:"id"`
+			promptState
+		}
+		if typ != websocket.TextMessage || json.Unmarshal(data, &m) != nil {
+			continue
+		}
+		switch {
+		case m.Type == "session":
+			id = m.ID
+			conn.WriteMessage(websocket.TextMessage, []byte("true\n(sleep 0.2; exit 3)\n"))
+		case m.Type == "prompt" && m.ExitCode != nil:
+			exit = *m.ExitCode
+		}
+	}
+
+	resp, err := http.Get(testURL + "/v1/sessions/" + id + "/history?failed=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var h commandHistory
+	json.NewDecoder(resp.Body).Decode(&h)
+	if len(h.Commands) != 1 {
+		t.Fatalf("failed commands = %+v, want one", h.Commands)
+	}
+	c := h.Commands[0]
+	if c.Command != "(sleep 0.2; exit 3)" || c.ExitCode == nil || *c.ExitCode != 3 || c.DurationMS < 200 || c.Cwd != dataDir {
+		t.Errorf("failed command = %+v", c)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// ideStartTimeout is how long POST /v1/ide waits for the IDE to listen.
+	ideStartTimeout = 30 * time.Second
+	// ideMaxRestarts bounds how often a crashing IDE is restarted before the
+	// supervisor gives up.
+	ideMaxRestarts = 5
+)
+
+type ideFlavor struct {
+	binary string
+	args   func(port int, prefix string) []string
+}
+
+var errNoIDE = errors.New("neither code-server nor openvscode-server is installed")
+
+// ideFlavors are the supported browser IDEs, tried in order. args returns
+// the flags that bind the server to 127.0.0.1:port without its own auth
+// (the Worker already authenticates) and serve it under prefix.
+var ideFlavors = []ideFlavor{
+	{"code-server", func(port int, prefix string) []string {
+		return []string{"--bind-addr", fmt.Sprintf("127.0.0.1:%d", port), "--auth", "none",
+			"--disable-telemetry", "--disable-update-check", dataDir}
+	}},
+	{"openvscode-server", func(port int, prefix string) []string {
+		return []string{"--host", "127.0.0.1", "--port", strconv.Itoa(port),
+			"--without-connection-token", "--server-base-path", prefix, "--default-folder", dataDir}
+	}},
+}
+
+type ideStatus struct {
+	Running  bool   `json:"running"`
+	Flavor   string `json:"flavor,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	URL      string `json:"url,omitempty"`
+	PID      int    `json:"pid,omitempty"`
+	Restarts int    `json:"restarts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ideSupervisor runs at most one IDE, restarting it if it crashes.
+type ideSupervisor struct {
+	mu       sync.Mutex
+	flavor   string
+	port     int
+	cmd      *exec.Cmd
+	restarts int
+	lastErr  error
+	stop     context.CancelFunc
+	ready    chan struct{} // closed once the current process is listening
+}
+
+var ide = &ideSupervisor{}
+
+func (s *ideSupervisor) status() ideStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := ideStatus{Running: s.stop != nil, Flavor: s.flavor, Restarts: s.restarts}
+	if s.stop != nil {
+		st.Port = s.port
+		st.URL = fmt.Sprintf("/proxy/%d/", s.port)
+		if s.cmd != nil && s.cmd.Process != nil {
+			st.PID = s.cmd.Process.Pid
+		}
+	}
+	if s.lastErr != nil {
+		st.Error = s.lastErr.Error()
+	}
+	return st
+}
+
+// start launches the IDE if it isn't running and waits until it accepts
+// connections.
+func (s *ideSupervisor) start(ctx context.Context) (ideStatus, error) {
+	s.mu.Lock()
+	if s.stop == nil {
+		i := slices.IndexFunc(ideFlavors, func(f ideFlavor) bool {
+			_, err := exec.LookPath(f.binary)
+			return err == nil
+		})
+		if i < 0 {
+			s.mu.Unlock()
+			return ideStatus{}, errNoIDE
+		}
+		port, err := freePort()
+		if err != nil {
+			s.mu.Unlock()
+			return ideStatus{}, err
+		}
+		var runCtx context.Context
+		runCtx, s.stop = context.WithCancel(context.Background())
+		s.flavor, s.port, s.restarts, s.lastErr = ideFlavors[i].binary, port, 0, nil
+		s.ready = make(chan struct{})
+		go s.supervise(runCtx, i, port)
+	}
+	ready := s.ready
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return ideStatus{}, ctx.Err()
+	case <-time.After(ideStartTimeout):
+		return ideStatus{}, fmt.Errorf("IDE did not start listening within %s", ideStartTimeout)
+	}
+	return s.status(), nil
+}
+
+// supervise runs the IDE until ctx is cancelled, restarting it with backoff
+// when it exits.
+func (s *ideSupervisor) supervise(ctx context.Context, flavor, port int) {
+	f := ideFlavors[flavor]
+	prefix := fmt.Sprintf("/proxy/%d", port)
+	backoff := time.Second
+	for {
+		cmd := exec.CommandContext(ctx, f.binary, f.args(port, prefix)...)
+		cmd.Dir = dataDir
+		cmd.Env = spawnEnv()
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM) }
+		cmd.WaitDelay = 10 * time.Second
+
+		err := cmd.Start()
+		if err == nil {
+			s.mu.Lock()
+			s.cmd = cmd
+			ready := s.ready
+			s.mu.Unlock()
+			infof("IDE %s started (pid %d) on port %d", f.binary, cmd.Process.Pid, port)
+			go waitListening(ctx, port, ready)
+			err = cmd.Wait()
+		}
+		if ctx.Err() != nil {
+			infof("IDE %s stopped", f.binary)
+			return
+		}
+		warnf("IDE %s exited: %v", f.binary, err)
+
+		s.mu.Lock()
+		s.lastErr = err
+		if s.restarts >= ideMaxRestarts {
+			errorf("IDE %s crashed %d times, giving up", f.binary, s.restarts+1)
+			s.stop = nil
+			s.mu.Unlock()
+			return
+		}
+		s.restarts++
+		s.mu.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// waitListening closes ready once something accepts connections on port.
+func waitListening(ctx context.Context, port int, ready chan struct{}) {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	for ctx.Err() == nil {
+		if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			c.Close()
+			select {
+			case <-ready:
+			default:
+				close(ready)
+			}
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func (s *ideSupervisor) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		s.stop()
+		s.stop = nil
+	}
+}
+
+// freePort asks the kernel for an unused loopback port.
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func handleStartIDE(w http.ResponseWriter, r *http.Request) {
+	st, err := ide.start(r.Context())
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNoIDE) {
+			status = http.StatusNotImplemented
+		}
+		writeProblem(w, r, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+func handleIDEStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ide.status())
+}
+
+func handleStopIDE(w http.ResponseWriter, r *http.Request) {
+	ide.shutdown()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"server/container_src/internal/s3client"
+)
+
+const (
+	defaultImportConcurrency = 4
+	maxImportConcurrency     = 16
+	maxImportURLs            = 10000
+	// maxImportBody leaves room for maxImportURLs URLs.
+	maxImportBody = 1 << 20
+)
+
+var errInvalidImport = errors.New("invalid import request")
+
+// importRequest is the body of POST /v1/jobs/import: a bucket or a list of
+// URLs to copy into the workspace.
+type importRequest struct {
+	// Path is the directory under /data the files go into; /data itself by
+	// default.
+	Path string `json:"path,omitempty"`
+	// S3 copies the objects under its prefix to their keys' paths under
+	// it.
+	S3 *bucketLocation `json:"s3,omitempty"`
+	// URLs are downloaded, each to the last element of its path.
+	URLs []string `json:"urls,omitempty"`
+	// Concurrency is how many files are fetched at once: 4 by default, at
+	// most 16.
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// importSource is where an import job copies from, as its state records it.
+type importSource struct {
+	Path     string `json:"path"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Bucket   string `json:"bucket,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	// URLs is how many URLs are downloaded; they aren't kept, as they may
+	// carry tokens.
+	URLs int `json:"urls,omitempty"`
+}
+
+// importResult is a line of an import job's stdout, which is its manifest:
+// one for each file, as it's done.
+type importResult struct {
+	// Source is the object's key, or the URL without its query.
+	Source string `json:"source"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Error  string `json:"error,omitempty"`
+}
+
+// importFile is a file an import job fetches.
+type importFile struct {
+	source string
+	rel    string // under the job's directory
+	size   int64  // if known beforehand
+	open   func(ctx context.Context) (io.ReadCloser, error)
+}
+
+// startImport starts a job copying req's bucket or URLs into req.Path.
+func startImport(req importRequest) (jobInfo, error) {
+	switch {
+	case (req.S3 == nil) == (len(req.URLs) == 0):
+		return jobInfo{}, fmt.Errorf("%w: give either s3 or urls", errInvalidImport)
+	case len(req.URLs) > maxImportURLs:
+		return jobInfo{}, fmt.Errorf("%w: at most %d urls", errInvalidImport, maxImportURLs)
+	case req.Concurrency < 0 || req.Concurrency > maxImportConcurrency:
+		return jobInfo{}, fmt.Errorf("%w: concurrency must be from 1 to %d", errInvalidImport, maxImportConcurrency)
+	}
+	concurrency := req.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultImportConcurrency
+	}
+	dest, err := resolvePath(req.Path)
+	if err != nil {
+		return jobInfo{}, err
+	}
+	if fi, err := os.Stat(dest); err == nil && !fi.IsDir() {
+		return jobInfo{}, fmt.Errorf("%w: %s is not a directory", errInvalidImport, relPath(dest))
+	}
+	src := &importSource{Path: relPath(dest)}
+	var list func(ctx context.Context) ([]importFile, error)
+	if req.S3 != nil {
+		store, err := req.S3.client(errInvalidImport)
+		if err != nil {
+			return jobInfo{}, err
+		}
+		src.Endpoint, src.Bucket, src.Prefix = store.Endpoint.Redacted(), store.Bucket, req.S3.Prefix
+		list = func(ctx context.Context) ([]importFile, error) { return bucketImportFiles(ctx, store, req.S3.Prefix) }
+	} else {
+		files, err := urlImportFiles(req.URLs)
+		if err != nil {
+			return jobInfo{}, err
+		}
+		src.URLs = len(files)
+		list = func(context.Context) ([]importFile, error) { return files, nil }
+	}
+	j, err := launchJob(jobInfo{ID: newTimeID(), Import: src}, func(ctx context.Context, rj *runningJob, stdout, stderr io.Writer) (int, error) {
+		files, err := list(ctx)
+		if err != nil {
+			return -1, err
+		}
+		return runImport(ctx, rj, dest, files, concurrency, stdout, stderr)
+	})
+	if err != nil {
+		return jobInfo{}, err
+	}
+	if src.Bucket != "" {
+		infof("Job %s started: importing %s/%s/%s into /%s", j.ID, strings.TrimSuffix(src.Endpoint, "/"), src.Bucket, src.Prefix, src.Path)
+	} else {
+		infof("Job %s started: importing %d URLs into /%s", j.ID, src.URLs, src.Path)
+	}
+	return j, nil
+}
+
+// bucketImportFiles lists the objects under prefix in store. Keys ending in
+// a slash, directory markers, are skipped. A key that is another's name in
+// another Unicode normalization form fails rather than overwrite it.
+func bucketImportFiles(ctx context.Context, store *s3client.Client, prefix string) ([]importFile, error) {
+	objs, err := store.ListObjects(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("bucket %s: %w", store.Bucket, err)
+	}
+	var files []importFile
+	keys := make(map[string]string)
+	for _, o := range objs {
+		rel := strings.TrimPrefix(o.Key, prefix)
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			continue
+		}
+		open := func(ctx context.Context) (io.ReadCloser, error) {
+			return store.GetObject(ctx, o.Key, "")
+		}
+		if prev, ok := keys[nameKey(rel)]; ok {
+			open = func(context.Context) (io.ReadCloser, error) {
+				return nil, fmt.Errorf("%w: %s goes to the same file as %s", errNameConflict, o.Key, prev)
+			}
+		} else {
+			keys[nameKey(rel)] = o.Key
+		}
+		files = append(files, importFile{source: o.Key, rel: rel, size: o.Size, open: open})
+	}
+	return files, nil
+}
+
+// urlImportFiles checks urls and names the file each is downloaded to.
+func urlImportFiles(urls []string) ([]importFile, error) {
+	files := make([]importFile, 0, len(urls))
+	names := make(map[string]string)
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%w: %s is not an http or https URL", errInvalidImport, redactURL(raw))
+		}
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			return nil, fmt.Errorf("%w: %s has no file name", errInvalidImport, redactURL(raw))
+		}
+		if prev, ok := names[nameKey(name)]; ok {
+			return nil, fmt.Errorf("%w: %s and %s both go to %s", errInvalidImport, prev, redactURL(raw), name)
+		}
+		names[nameKey(name)] = redactURL(raw)
+		files = append(files, importFile{source: redactURL(raw), rel: name, size: -1, open: func(ctx context.Context) (io.ReadCloser, error) {
+			return download(ctx, raw)
+		}})
+	}
+	return files, nil
+}
+
+// download GETs u, which must answer 200.
+func download(ctx context.Context, u string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if ue := (*url.Error)(nil); errors.As(err, &ue) {
+		return nil, fmt.Errorf("GET %s: %w", redactURL(u), ue.Err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", redactURL(u), resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// runImport fetches files into dest, concurrency at a time, writing a
+// result for each to stdout and each failure to stderr too. It exits 1 if
+// any file failed.
+func runImport(ctx context.Context, rj *runningJob, dest string, files []importFile, concurrency int, stdout, stderr io.Writer) (int, error) {
+	rj.updateProgress(func(p *jobProgress) {
+		p.Files = len(files)
+		for _, f := range files {
+			p.Bytes += max(f.size, 0)
+		}
+	})
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		enc    = json.NewEncoder(stdout)
+		failed bool
+		sem    = make(chan struct{}, concurrency)
+	)
+	for _, f := range files {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res := importResult{Source: f.source, Path: path.Join(relPath(dest), f.rel)}
+			n, err := importOne(ctx, dest, f)
+			res.Size = n
+			if err != nil {
+				res.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			enc.Encode(res)
+			if err != nil {
+				failed = true
+				fmt.Fprintf(stderr, "%s: %v\n", f.source, err)
+				rj.updateProgress(func(p *jobProgress) { p.FilesFailed++ })
+				return
+			}
+			meterTraffic("POST /v1/jobs/import", trafficFile, "in", int(n))
+			rj.updateProgress(func(p *jobProgress) {
+				p.FilesDone++
+				p.BytesDone += n
+				// Downloads' sizes aren't known until they're done.
+				if f.size < 0 {
+					p.Bytes += n
+				}
+			})
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	if failed {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// importOne writes f under dest and returns its size. It is bulk work,
+// written at bulk_bytes_per_second.
+func importOne(ctx context.Context, dest string, f importFile) (int64, error) {
+	full, err := resolvePath(path.Join(relPath(dest), f.rel))
+	if err != nil {
+		return 0, err
+	}
+	if !strings.HasPrefix(full, dest+string(filepath.Separator)) {
+		return 0, fmt.Errorf("%s: %w", f.rel, errOutsideData)
+	}
+	if dir := symlinkAbove(full); dir != "" {
+		return 0, fmt.Errorf("%s is under the symlink %s: %w", f.rel, relPath(dir), errOutsideData)
+	}
+	release, err := acquireSlot(ctx, classBulk)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	body, err := f.open(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	cr := &countingReader{r: bulkReader{ctx, body}}
+	if err := storeFile(full, cr, 0644); err != nil {
+		return 0, err
+	}
+	return cr.n, nil
+}
+
+func handleStartImport(w http.ResponseWriter, r *http.Request) {
+	var req importRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxImportBody)).Decode(&req); err != nil {
+		httpError(w, r, "invalid import request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	j, err := fsCall(r.Context(), func() (jobInfo, error) { return startImport(req) })
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, j)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"server/container_src/internal/s3test"
+)
+
+func TestImport(t *testing.T) {
+	srv := s3test.NewServer(t)
+	store := srv.Client(t, "import-test")
+	ctx := context.Background()
+	if err := store.CreateBucket(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for key, body := range map[string]string{"proj/a.txt": "alpha", "proj/sub/b.txt": "beta", "other/c.txt": "gamma"} {
+		if err := store.PutObject(ctx, key, strings.NewReader(body), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dl/notes.md" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "# notes")
+	}))
+	defer web.Close()
+
+	run := func(req importRequest, want int) (jobInfo, []importResult) {
+		t.Helper()
+		body, _ := json.Marshal(req)
+		resp, err := http.Post(testURL+"/v1/jobs/import", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("import: %s %s, want %d", resp.Status, data, want)
+		}
+		if want != http.StatusAccepted {
+			return jobInfo{}, nil
+		}
+		var j jobInfo
+		json.Unmarshal(data, &j)
+		// Following the output returns once the job is done.
+		resp, err = http.Get(testURL + "/v1/jobs/" + j.ID + "/output?follow=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var results []importResult
+		for dec := json.NewDecoder(resp.Body); ; {
+			var r importResult
+			if dec.Decode(&r) != nil {
+				break
+			}
+			results = append(results, r)
+		}
+		resp.Body.Close()
+		slices.SortFunc(results, func(a, b importResult) int { return strings.Compare(a.Path, b.Path) })
+		if j, err = readJob(j.ID); err != nil {
+			t.Fatal(err)
+		}
+		return j, results
+	}
+
+	j, results := run(importRequest{Path: "imported", S3: &bucketLocation{Endpoint: srv.Endpoint, Bucket: "import-test", Prefix: "proj/", AccessKeyID: "key", SecretAccessKey: "secret"}}, http.StatusAccepted)
+	want := []importResult{{Source: "proj/a.txt", Path: "imported/a.txt", Size: 5}, {Source: "proj/sub/b.txt", Path: "imported/sub/b.txt", Size: 4}}
+	if j.State != "exited" || *j.ExitCode != 0 || j.Import == nil || j.Import.Bucket != "import-test" || !slices.Equal(results, want) {
+		t.Fatalf("bucket import = %+v, manifest %+v", j, results)
+	}
+	if p := j.Progress; p == nil || *p != (jobProgress{Files: 2, FilesDone: 2, Bytes: 9, BytesDone: 9}) {
+		t.Errorf("progress = %+v", p)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dataDir, "imported/sub/b.txt")); string(data) != "beta" {
+		t.Errorf("imported/sub/b.txt = %q", data)
+	}
+
+	// A URL that fails is in the manifest, and makes the job exit 1.
+	j, results = run(importRequest{Path: "imported", URLs: []string{web.URL + "/dl/notes.md?token=x", web.URL + "/dl/gone.md"}, Concurrency: 2}, http.StatusAccepted)
+	if j.State != "exited" || *j.ExitCode != 1 || len(results) != 2 || results[1].Error != "" || results[1].Source != web.URL+"/dl/notes.md" || results[0].Error == "" {
+		t.Fatalf("URL import = %+v, manifest %+v", j, results)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dataDir, "imported/notes.md")); string(data) != "# notes" {
+		t.Errorf("imported/notes.md = %q", data)
+	}
+	if p := j.Progress; p.FilesDone != 1 || p.FilesFailed != 1 || p.BytesDone != 7 {
+		t.Errorf("progress = %+v", p)
+	}
+
+	run(importRequest{URLs: []string{web.URL + "/a/x", web.URL + "/b/x"}}, http.StatusBadRequest)
+	run(importRequest{}, http.StatusBadRequest)
+}
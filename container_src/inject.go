@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// maxInjections bounds the injections a session's audit trail keeps;
+	// older ones are still in the server's log.
+	maxInjections = 100
+	// maxInjectionText is how much of what was injected the audit trail
+	// quotes.
+	maxInjectionText = 256
+)
+
+var errInvalidInjection = errors.New("invalid injection")
+
+var validSource = regexp.MustCompile(`^[A-Za-z0-9._:@/-]{1,64}$`)
+
+var injections = newCounter("dos3_injections_total",
+	"Input injected into sessions through /v1/sessions/{id}/inject.")
+
+// injectRequest is the body of POST /v1/sessions/{id}/inject: one of Data
+// or Command.
+type injectRequest struct {
+	// Data is written to the terminal as it is, escape sequences and all.
+	Data string `json:"data,omitempty"`
+	// Command is a line typed at the prompt and entered.
+	Command string `json:"command,omitempty"`
+	// Source names the automation injecting it, for the audit trail.
+	Source string `json:"source"`
+	// Announce shows a notice naming Source in the terminal first, so
+	// whoever is watching knows the input isn't theirs.
+	Announce bool `json:"announce,omitempty"`
+}
+
+func (req injectRequest) validate() error {
+	switch {
+	case !validSource.MatchString(req.Source):
+		return fmt.Errorf("%w: source %q: want 1 to 64 letters, digits or ._:@/-", errInvalidInjection, req.Source)
+	case (req.Data == "") == (req.Command == ""):
+		return fmt.Errorf("%w: give one of data or command", errInvalidInjection)
+	case strings.ContainsFunc(req.Command, unicode.IsControl):
+		return fmt.Errorf("%w: command must be one line without control characters; send those as data", errInvalidInjection)
+	}
+	return nil
+}
+
+// injectionRecord is an entry of a session's audit trail.
+type injectionRecord struct {
+	Time      time.Time `json:"time"`
+	Source    string    `json:"source"`
+	RequestID string    `json:"request_id,omitempty"`
+	// Kind is "data" or "command".
+	Kind string `json:"kind"`
+	// Text is what was injected, redacted and cut to 256 bytes; Bytes is
+	// its full length.
+	Text  string `json:"text"`
+	Bytes int    `json:"bytes"`
+}
+
+type injectionLog struct {
+	Injections []injectionRecord `json:"injections"`
+}
+
+// addInjection records an injection in s's audit trail.
+func (s *session) addInjection(rec injectionRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.injections = append(s.injections, rec)
+	if n := len(s.injections) - maxInjections; n > 0 {
+		s.injections = append(s.injections[:0:0], s.injections[n:]...)
+	}
+}
+
+// injectionTrail returns s's audit trail, oldest first.
+func (s *session) injectionTrail() []injectionRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]injectionRecord{}, s.injections...)
+}
+
+// handleSessionInject writes automation's input into a session, as if
+// typed, and records it in the session's audit trail.
+func handleSessionInject(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	var req injectRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxInputBody)).Decode(&req); err != nil {
+		httpError(w, r, "invalid injection: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	rec := injectionRecord{Time: time.Now().UTC(), Source: req.Source, RequestID: requestID(r), Kind: "data"}
+	data := req.Data
+	if req.Command != "" {
+		rec.Kind, data = "command", req.Command+"\r"
+	}
+	rec.Bytes = len(data)
+	// Cutting may split a rune, which is dropped.
+	rec.Text = redactString(strings.ToValidUTF8(data[:min(len(data), maxInjectionText)], ""))
+	if req.Announce {
+		sess.notice(fmt.Sprintf("%s is typing in this terminal.", req.Source))
+	}
+	if err := sess.write([]byte(data)); err != nil {
+		writeProblem(w, r, http.StatusGone, err)
+		return
+	}
+	sess.addInjection(rec)
+	injections.add(1)
+	sess.meterTraffic(trafficTerminal, "in", len(data))
+	infof("Session %s: %s injected %d bytes of %s (request %s)", sess.id, req.Source, rec.Bytes, rec.Kind, rec.RequestID)
+	writeJSON(w, http.StatusOK, rec)
+}
+
+func handleSessionInjections(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, injectionLog{Injections: sess.injectionTrail()})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionInject(t *testing.T) {
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	inject := func(token, body string) (int, string) {
+		req, _ := http.NewRequest("POST", testURL+"/v1/sessions/"+sess.id+"/inject", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	const body = `{"source": "onboarding", "command": "echo inj''ected"}`
+	if code, _ := inject("", body); code != http.StatusForbidden {
+		t.Errorf("injection without CONTROL_TOKEN set: %d, want 403", code)
+	}
+	t.Setenv("CONTROL_TOKEN", "secret")
+	if code, _ := inject("wrong", body); code != http.StatusUnauthorized {
+		t.Errorf("injection with the wrong token: %d, want 401", code)
+	}
+	if code, resp := inject("secret", `{"source": "onboarding", "command": "ls", "data": "ls\r"}`); code != http.StatusBadRequest || !strings.Contains(resp, "invalid-injection") {
+		t.Errorf("injection of both data and a command: %d %s", code, resp)
+	}
+	if code, resp := inject("secret", `{"source": "onboarding", "command": "ls\nrm -rf /"}`); code != http.StatusBadRequest {
+		t.Errorf("command of two lines: %d %s", code, resp)
+	}
+	if code, resp := inject("secret", body); code != http.StatusOK {
+		t.Fatalf("injection: %d %s", code, resp)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if data, _, _ := sess.output.read(0, 1<<20); bytes.Contains(data, []byte("injected")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("injected command didn't run")
+		}
+	}
+
+	// The audit trail is open to whoever may see the session.
+	resp, err := http.Get(testURL + "/v1/sessions/" + sess.id + "/injections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var trail injectionLog
+	json.NewDecoder(resp.Body).Decode(&trail)
+	if len(trail.Injections) != 1 {
+		t.Fatalf("audit trail: %+v", trail)
+	}
+	if rec := trail.Injections[0]; rec.Source != "onboarding" || rec.Kind != "command" || rec.Text != "echo inj''ected\r" || rec.Bytes != 16 || rec.RequestID == "" {
+		t.Errorf("audit record: %+v", rec)
+	}
+}
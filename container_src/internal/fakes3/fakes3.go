@@ -0,0 +1,728 @@
+// Package fakes3 implements a small filesystem-backed S3-compatible server.
+//
+// It covers the subset of the S3 API that tigrisfs relies on (path-style
+// addressing, ListObjects v1/v2, Get/Head/Put/Copy/Delete, DeleteObjects and
+// multipart uploads) so the container can mount a bucket locally without the
+// S3 Durable Object. Authentication is not checked and buckets are created
+// implicitly on first use, mirroring the DO's behaviour.
+package fakes3
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object is the metadata stored for every key.
+type Object struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	ETag         string            `json:"etag"`
+	ContentType  string            `json:"content_type"`
+	LastModified time.Time         `json:"last_modified"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+type upload struct {
+	bucket   string
+	key      string
+	created  time.Time
+	meta     map[string]string
+	ctype    string
+	partETag map[int]string
+}
+
+// Server is an http.Handler serving the S3 API out of a directory.
+//
+// Each bucket is a directory under root; objects are stored as <sha256(key)>
+// with a JSON sidecar so that keys like "a" and "a/b" can coexist.
+type Server struct {
+	root string
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*Object
+	uploads map[string]*upload
+}
+
+// New returns a Server storing its data under root, loading any objects that
+// were written by a previous run.
+func New(root string) (*Server, error) {
+	if err := os.MkdirAll(filepath.Join(root, ".uploads"), 0755); err != nil {
+		return nil, err
+	}
+	s := &Server{
+		root:    root,
+		buckets: make(map[string]map[string]*Object),
+		uploads: make(map[string]*upload),
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		objects := make(map[string]*Object)
+		metas, err := filepath.Glob(filepath.Join(root, e.Name(), "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range metas {
+			data, err := os.ReadFile(m)
+			if err != nil {
+				return nil, err
+			}
+			var obj Object
+			if err := json.Unmarshal(data, &obj); err != nil {
+				return nil, fmt.Errorf("corrupt metadata %s: %w", m, err)
+			}
+			objects[obj.Key] = &obj
+		}
+		s.buckets[e.Name()] = objects
+	}
+	return s, nil
+}
+
+func (s *Server) objectPath(bucket, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.root, bucket, hex.EncodeToString(sum[:]))
+}
+
+// bucket returns the object index for name, creating it if needed. Callers
+// must hold s.mu.
+func (s *Server) bucket(name string) (map[string]*Object, error) {
+	if b, ok := s.buckets[name]; ok {
+		return b, nil
+	}
+	if err := os.MkdirAll(filepath.Join(s.root, name), 0755); err != nil {
+		return nil, err
+	}
+	b := make(map[string]*Object)
+	s.buckets[name] = b
+	return b, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("x-amz-request-id", randomID())
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		if r.Method == http.MethodGet {
+			s.listBuckets(w)
+			return
+		}
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "No bucket specified")
+		return
+	}
+	if strings.HasPrefix(bucket, ".") {
+		writeError(w, http.StatusBadRequest, "InvalidBucketName", "Invalid bucket name")
+		return
+	}
+
+	q := r.URL.Query()
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead || r.Method == http.MethodPut:
+			s.mu.Lock()
+			_, err := s.bucket(bucket)
+			s.mu.Unlock()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+			}
+		case r.Method == http.MethodGet && q.Has("uploads"):
+			s.listUploads(w, bucket)
+		case r.Method == http.MethodGet:
+			s.listObjects(w, r, bucket)
+		case r.Method == http.MethodPost && q.Has("delete"):
+			s.deleteObjects(w, r, bucket)
+		default:
+			writeError(w, http.StatusNotImplemented, "NotImplemented", "Operation not implemented")
+		}
+		return
+	}
+
+	uploadID := q.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		s.createUpload(w, r, bucket, key)
+	case r.Method == http.MethodPut && uploadID != "" && q.Has("partNumber"):
+		s.uploadPart(w, r, uploadID, q.Get("partNumber"))
+	case r.Method == http.MethodPost && uploadID != "":
+		s.completeUpload(w, r, bucket, key, uploadID)
+	case r.Method == http.MethodDelete && uploadID != "":
+		s.abortUpload(w, uploadID)
+	case r.Method == http.MethodPut && r.Header.Get("x-amz-copy-source") != "":
+		s.copyObject(w, r, bucket, key)
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, bucket, key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.getObject(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		s.deleteObject(w, bucket, key)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "Operation not implemented")
+	}
+}
+
+// writeObject streams body into storage for bucket/key and records obj.
+func (s *Server) writeObject(bucket, key string, body io.Reader, obj *Object) error {
+	s.mu.Lock()
+	_, err := s.bucket(bucket)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := s.objectPath(bucket, key)
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	obj.Key = key
+	obj.Size = n
+	if obj.ETag == "" {
+		obj.ETag = hex.EncodeToString(h.Sum(nil))
+	}
+	if obj.ContentType == "" {
+		obj.ContentType = "application/octet-stream"
+	}
+	obj.LastModified = time.Now().UTC()
+
+	meta, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".json", meta, 0644); err != nil {
+		return err
+	}
+	s.buckets[bucket][key] = obj
+	return nil
+}
+
+func (s *Server) lookup(bucket, key string) *Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.buckets[bucket]; ok {
+		return b[key]
+	}
+	return nil
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	obj := &Object{
+		ContentType: r.Header.Get("Content-Type"),
+		Metadata:    userMetadata(r.Header),
+	}
+	if err := s.writeObject(bucket, key, requestBody(r), obj); err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("ETag", quote(obj.ETag))
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	obj := s.lookup(bucket, key)
+	if obj == nil {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	f, err := os.Open(s.objectPath(bucket, key))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	defer f.Close()
+
+	h := w.Header()
+	h.Set("ETag", quote(obj.ETag))
+	h.Set("Content-Type", obj.ContentType)
+	h.Set("Accept-Ranges", "bytes")
+	for k, v := range obj.Metadata {
+		h.Set("X-Amz-Meta-"+k, v)
+	}
+	http.ServeContent(w, r, "", obj.LastModified, f)
+}
+
+func (s *Server) deleteObject(w http.ResponseWriter, bucket, key string) {
+	if err := s.remove(bucket, key); err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) remove(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucket]
+	if !ok || b[key] == nil {
+		return nil
+	}
+	path := s.objectPath(bucket, key)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(path + ".json"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	delete(b, key)
+	return nil
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	srcBucket, srcKey, ok := parseCopySource(r.Header.Get("x-amz-copy-source"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+		return
+	}
+	src := s.lookup(srcBucket, srcKey)
+	if src == nil {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	f, err := os.Open(s.objectPath(srcBucket, srcKey))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	defer f.Close()
+
+	obj := &Object{ContentType: src.ContentType, Metadata: src.Metadata, ETag: src.ETag}
+	if strings.EqualFold(r.Header.Get("x-amz-metadata-directive"), "REPLACE") {
+		obj.ContentType = r.Header.Get("Content-Type")
+		obj.Metadata = userMetadata(r.Header)
+	}
+	if err := s.writeObject(bucket, key, f, obj); err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	writeXML(w, http.StatusOK, copyObjectResult{
+		ETag:         quote(obj.ETag),
+		LastModified: formatTime(obj.LastModified),
+	})
+}
+
+func (s *Server) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	var req struct {
+		Quiet   bool `xml:"Quiet"`
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(requestBody(r)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	var res deleteResult
+	for _, o := range req.Objects {
+		if err := s.remove(bucket, o.Key); err != nil {
+			res.Errors = append(res.Errors, deleteError{Key: o.Key, Code: "InternalError", Message: err.Error()})
+			continue
+		}
+		if !req.Quiet {
+			res.Deleted = append(res.Deleted, deletedObject{Key: o.Key})
+		}
+	}
+	writeXML(w, http.StatusOK, res)
+}
+
+func (s *Server) listBuckets(w http.ResponseWriter) {
+	s.mu.Lock()
+	var res listAllMyBucketsResult
+	for name := range s.buckets {
+		res.Buckets = append(res.Buckets, bucketEntry{Name: name, CreationDate: formatTime(time.Now())})
+	}
+	s.mu.Unlock()
+	sort.Slice(res.Buckets, func(i, j int) bool { return res.Buckets[i].Name < res.Buckets[j].Name })
+	writeXML(w, http.StatusOK, res)
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	v2 := q.Get("list-type") == "2"
+	urlEncode := q.Get("encoding-type") == "url"
+
+	maxKeys := 1000
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid max-keys")
+			return
+		}
+		maxKeys = min(n, 1000)
+	}
+
+	marker := q.Get("marker")
+	if v2 {
+		marker = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			decoded, err := hex.DecodeString(token)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid continuation token")
+				return
+			}
+			marker = string(decoded)
+		}
+	}
+
+	s.mu.Lock()
+	var keys []string
+	objects := make(map[string]Object)
+	for k, o := range s.buckets[bucket] {
+		if strings.HasPrefix(k, prefix) && k > marker {
+			keys = append(keys, k)
+			objects[k] = *o
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(keys)
+
+	enc := func(s string) string {
+		if urlEncode {
+			return strings.ReplaceAll(url.QueryEscape(s), "%2F", "/")
+		}
+		return s
+	}
+
+	res := listBucketResult{
+		Name:      bucket,
+		Prefix:    enc(prefix),
+		Delimiter: enc(delimiter),
+		MaxKeys:   maxKeys,
+	}
+	if urlEncode {
+		res.EncodingType = "url"
+	}
+
+	var last, lastPrefix string
+	count := 0
+	for _, k := range keys {
+		// A marker that is itself a common prefix means everything under it
+		// has already been returned.
+		if delimiter != "" && strings.HasSuffix(marker, delimiter) && strings.HasPrefix(k, marker) {
+			continue
+		}
+		cp := ""
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				cp = k[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if cp != "" && cp == lastPrefix {
+			continue
+		}
+		if count == maxKeys {
+			res.IsTruncated = true
+			break
+		}
+		count++
+		if cp != "" {
+			lastPrefix = cp
+			last = cp
+			res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{Prefix: enc(cp)})
+			continue
+		}
+		last = k
+		o := objects[k]
+		res.Contents = append(res.Contents, listEntry{
+			Key:          enc(k),
+			LastModified: formatTime(o.LastModified),
+			ETag:         quote(o.ETag),
+			Size:         o.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+
+	if v2 {
+		res.KeyCount = count
+		res.ContinuationToken = q.Get("continuation-token")
+		res.StartAfter = q.Get("start-after")
+		if res.IsTruncated {
+			res.NextContinuationToken = hex.EncodeToString([]byte(last))
+		}
+	} else {
+		res.Marker = enc(marker)
+		if res.IsTruncated {
+			res.NextMarker = enc(last)
+		}
+	}
+	writeXML(w, http.StatusOK, res)
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	id := randomID()
+	if err := os.MkdirAll(filepath.Join(s.root, ".uploads", id), 0755); err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	s.mu.Lock()
+	s.uploads[id] = &upload{
+		bucket:   bucket,
+		key:      key,
+		created:  time.Now().UTC(),
+		meta:     userMetadata(r.Header),
+		ctype:    r.Header.Get("Content-Type"),
+		partETag: make(map[int]string),
+	}
+	s.mu.Unlock()
+	writeXML(w, http.StatusOK, initiateMultipartUploadResult{Bucket: bucket, Key: key, UploadID: id})
+}
+
+func (s *Server) getUpload(id string) *upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploads[id]
+}
+
+func (s *Server) partPath(id string, part int) string {
+	return filepath.Join(s.root, ".uploads", id, strconv.Itoa(part))
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, id, partNumber string) {
+	part, err := strconv.Atoi(partNumber)
+	if err != nil || part < 1 || part > 10000 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid part number")
+		return
+	}
+	up := s.getUpload(id)
+	if up == nil {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+
+	body := requestBody(r)
+	if src := r.Header.Get("x-amz-copy-source"); src != "" {
+		f, err := s.openCopySource(src, r.Header.Get("x-amz-copy-source-range"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	f, err := os.Create(s.partPath(id, part))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, h), body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	etag := hex.EncodeToString(h.Sum(nil))
+	s.mu.Lock()
+	up.partETag[part] = etag
+	s.mu.Unlock()
+
+	if r.Header.Get("x-amz-copy-source") != "" {
+		writeXML(w, http.StatusOK, copyPartResult{ETag: quote(etag), LastModified: formatTime(time.Now())})
+		return
+	}
+	w.Header().Set("ETag", quote(etag))
+}
+
+// openCopySource opens the object named by an x-amz-copy-source header,
+// limited to the optional "bytes=a-b" range.
+func (s *Server) openCopySource(src, rng string) (io.ReadCloser, error) {
+	bucket, key, ok := parseCopySource(src)
+	if !ok || s.lookup(bucket, key) == nil {
+		return nil, fmt.Errorf("invalid copy source %q", src)
+	}
+	f, err := os.Open(s.objectPath(bucket, key))
+	if err != nil {
+		return nil, err
+	}
+	if rng == "" {
+		return f, nil
+	}
+	var start, end int64
+	if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || end < start {
+		f.Close()
+		return nil, fmt.Errorf("invalid copy source range %q", rng)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, start, end-start+1), f}, nil
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) {
+	up := s.getUpload(id)
+	if up == nil || up.bucket != bucket || up.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(requestBody(r)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	var readers []io.Reader
+	sums := md5.New()
+	for _, p := range req.Parts {
+		s.mu.Lock()
+		etag, ok := up.partETag[p.PartNumber]
+		s.mu.Unlock()
+		if !ok || (p.ETag != "" && strings.Trim(p.ETag, `"`) != etag) {
+			writeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d not found", p.PartNumber))
+			return
+		}
+		f, err := os.Open(s.partPath(id, p.PartNumber))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		defer f.Close()
+		readers = append(readers, f)
+		raw, _ := hex.DecodeString(etag)
+		sums.Write(raw)
+	}
+
+	obj := &Object{
+		ContentType: up.ctype,
+		Metadata:    up.meta,
+		ETag:        fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), len(req.Parts)),
+	}
+	if err := s.writeObject(bucket, key, io.MultiReader(readers...), obj); err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	s.dropUpload(id)
+	writeXML(w, http.StatusOK, completeMultipartUploadResult{Bucket: bucket, Key: key, ETag: quote(obj.ETag)})
+}
+
+func (s *Server) abortUpload(w http.ResponseWriter, id string) {
+	if s.getUpload(id) == nil {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	s.dropUpload(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) dropUpload(id string) {
+	s.mu.Lock()
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	os.RemoveAll(filepath.Join(s.root, ".uploads", id))
+}
+
+func (s *Server) listUploads(w http.ResponseWriter, bucket string) {
+	res := listMultipartUploadsResult{Bucket: bucket}
+	s.mu.Lock()
+	for id, up := range s.uploads {
+		if up.bucket == bucket {
+			res.Uploads = append(res.Uploads, uploadEntry{Key: up.key, UploadID: id, Initiated: formatTime(up.created)})
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(res.Uploads, func(i, j int) bool { return res.Uploads[i].Key < res.Uploads[j].Key })
+	writeXML(w, http.StatusOK, res)
+}
+
+func userMetadata(h http.Header) map[string]string {
+	meta := make(map[string]string)
+	for k, v := range h {
+		if name, ok := strings.CutPrefix(strings.ToLower(k), "x-amz-meta-"); ok && len(v) > 0 {
+			meta[name] = v[0]
+		}
+	}
+	return meta
+}
+
+// requestBody returns the request payload, decoding the aws-chunked framing
+// that SDKs use for streaming signatures.
+func requestBody(r *http.Request) io.Reader {
+	if strings.HasPrefix(r.Header.Get("x-amz-content-sha256"), "STREAMING-") {
+		return &chunkedReader{r: bufio.NewReader(r.Body)}
+	}
+	return r.Body
+}
+
+func parseCopySource(src string) (bucket, key string, ok bool) {
+	src, _, _ = strings.Cut(src, "?")
+	if unescaped, err := url.PathUnescape(src); err == nil {
+		src = unescaped
+	}
+	bucket, key, ok = strings.Cut(strings.TrimPrefix(src, "/"), "/")
+	return bucket, key, ok && bucket != "" && key != ""
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeXML(w, status, errorResponse{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func quote(etag string) string {
+	return `"` + etag + `"`
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,564 @@
+// Package s3client is a minimal S3 client for talking to the workspace
+// bucket directly rather than through the FUSE mount. Requests are
+// path-style and signed with SigV4, which works against MinIO, the embedded
+// fakes3 server, and the S3 Durable Object (which reads the JWT passed as
+// the access key ID out of the Credential field).
+package s3client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Client talks to one bucket.
+type Client struct {
+	Endpoint        *url.URL
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Region is used in the signature; "us-east-1" if empty.
+	Region string
+	// Prefix, if set, is prepended to every key, so the client sees only
+	// the part of the bucket under it; keys listed come back without it.
+	Prefix string
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// New returns a client for bucket at endpoint ("https://host/").
+func New(endpoint, bucket, accessKeyID, secretAccessKey string) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("s3client: endpoint %q must be an absolute URL", endpoint)
+	}
+	return &Client{Endpoint: u, Bucket: bucket, AccessKeyID: accessKeyID, SecretAccessKey: secretAccessKey}, nil
+}
+
+// Error is an S3 error response.
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from S3.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// Object is an entry from ListObjects.
+type Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+}
+
+// PutObject uploads body as key. body is read twice: once to hash it for
+// the signature and once to send it.
+func (c *Client) PutObject(ctx context.Context, key string, body io.ReadSeeker, contentType string) error {
+	h := sha256.New()
+	size, err := io.Copy(h, body)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, "PUT", key, nil, io.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.do(req, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DeleteObject removes key. Deleting a missing key is not an error.
+func (c *Client) DeleteObject(ctx context.Context, key string) error {
+	req, err := c.newRequest(ctx, "DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, emptyHash)
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// HeadBucket checks that the bucket exists and the credentials may use it.
+func (c *Client) HeadBucket(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "HEAD", "", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, emptyHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// CreateBucket creates the bucket. A bucket these credentials already own
+// is not an error.
+func (c *Client) CreateBucket(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "PUT", "", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, emptyHash)
+	var e *Error
+	if errors.As(err, &e) && e.Code == "BucketAlreadyOwnedByYou" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListObjects returns every object whose key starts with prefix, following
+// continuation tokens.
+func (c *Client) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
+	var all []Object
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {c.Prefix + prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		req, err := c.newRequest(ctx, "GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req, emptyHash)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents              []Object `xml:"Contents"`
+			IsTruncated           bool     `xml:"IsTruncated"`
+			NextContinuationToken string   `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3client: decoding listing: %w", err)
+		}
+		for _, o := range page.Contents {
+			o.Key = strings.TrimPrefix(o.Key, c.Prefix)
+			all = append(all, o)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return all, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// ErrVersioningUnsupported is returned by ListObjectVersions when the
+// server doesn't keep object versions.
+var ErrVersioningUnsupported = errors.New("s3client: bucket does not support versioning")
+
+// ObjectVersion is an entry from ListObjectVersions: a version of an
+// object's contents, or a delete marker recording its deletion.
+type ObjectVersion struct {
+	Key          string
+	VersionID    string
+	IsLatest     bool
+	DeleteMarker bool
+	Size         int64
+	LastModified time.Time
+	ETag         string
+}
+
+// ListObjectVersions returns every version of the objects whose keys start
+// with prefix, newest first for each key, following the markers.
+func (c *Client) ListObjectVersions(ctx context.Context, prefix string) ([]ObjectVersion, error) {
+	type entry struct {
+		Key          string    `xml:"Key"`
+		VersionID    string    `xml:"VersionId"`
+		IsLatest     bool      `xml:"IsLatest"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+	}
+	var all []ObjectVersion
+	keyMarker, versionMarker := "", ""
+	for {
+		q := url.Values{"versions": {""}, "prefix": {c.Prefix + prefix}}
+		if keyMarker != "" {
+			q.Set("key-marker", keyMarker)
+			q.Set("version-id-marker", versionMarker)
+		}
+		req, err := c.newRequest(ctx, "GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req, emptyHash)
+		var e *Error
+		if errors.As(err, &e) && e.StatusCode == http.StatusNotImplemented {
+			return nil, ErrVersioningUnsupported
+		}
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			XMLName             xml.Name
+			Versions            []entry `xml:"Version"`
+			DeleteMarkers       []entry `xml:"DeleteMarker"`
+			IsTruncated         bool    `xml:"IsTruncated"`
+			NextKeyMarker       string  `xml:"NextKeyMarker"`
+			NextVersionIDMarker string  `xml:"NextVersionIdMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3client: decoding version listing: %w", err)
+		}
+		// Servers without versioning ignore the parameter and answer with
+		// an ordinary listing.
+		if page.XMLName.Local != "ListVersionsResult" {
+			return nil, ErrVersioningUnsupported
+		}
+		for _, v := range page.Versions {
+			v.Key = strings.TrimPrefix(v.Key, c.Prefix)
+			all = append(all, ObjectVersion{Key: v.Key, VersionID: v.VersionID, IsLatest: v.IsLatest,
+				Size: v.Size, LastModified: v.LastModified, ETag: v.ETag})
+		}
+		for _, v := range page.DeleteMarkers {
+			v.Key = strings.TrimPrefix(v.Key, c.Prefix)
+			all = append(all, ObjectVersion{Key: v.Key, VersionID: v.VersionID, IsLatest: v.IsLatest,
+				DeleteMarker: true, LastModified: v.LastModified})
+		}
+		if !page.IsTruncated || page.NextKeyMarker == "" {
+			break
+		}
+		keyMarker, versionMarker = page.NextKeyMarker, page.NextVersionIDMarker
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].Key != all[j].Key {
+			return all[i].Key < all[j].Key
+		}
+		return all[i].LastModified.After(all[j].LastModified)
+	})
+	return all, nil
+}
+
+// GetObject returns the contents of key, or of one of its versions if
+// versionID isn't empty. The caller closes the body.
+func (c *Client) GetObject(ctx context.Context, key, versionID string) (io.ReadCloser, error) {
+	var q url.Values
+	if versionID != "" {
+		q = url.Values{"versionId": {versionID}}
+	}
+	req, err := c.newRequest(ctx, "GET", key, q, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, emptyHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Part is an uploaded part of a multipart upload.
+type Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// CreateMultipartUpload starts a multipart upload of key and returns its
+// upload ID.
+func (c *Client) CreateMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+	req, err := c.newRequest(ctx, "POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.do(req, emptyHash)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("s3client: decoding CreateMultipartUpload: %w", err)
+	}
+	if res.UploadID == "" {
+		return "", errors.New("s3client: CreateMultipartUpload returned no upload ID")
+	}
+	return res.UploadID, nil
+}
+
+// UploadPart uploads part n (from 1) of an upload and returns its ETag.
+// Like PutObject's, body is read twice.
+func (c *Client) UploadPart(ctx context.Context, key, uploadID string, n int, body io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, body)
+	if err != nil {
+		return "", err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	q := url.Values{"partNumber": {fmt.Sprint(n)}, "uploadId": {uploadID}}
+	req, err := c.newRequest(ctx, "PUT", key, q, io.NopCloser(body))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	resp, err := c.do(req, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// CompleteMultipartUpload assembles the parts, in order, into key and
+// returns its ETag.
+func (c *Client) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) (string, error) {
+	var buf bytes.Buffer
+	err := xml.NewEncoder(&buf).Encode(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []Part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	req, err := c.newRequest(ctx, "POST", key, url.Values{"uploadId": {uploadID}}, io.NopCloser(&buf))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = int64(buf.Len())
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := c.do(req, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	// S3 may answer 200 with an error document once it has started
+	// assembling the object.
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		XMLName xml.Name
+		ETag    string `xml:"ETag"`
+	}
+	if err := xml.Unmarshal(data, &res); err != nil {
+		return "", fmt.Errorf("s3client: decoding CompleteMultipartUpload: %w", err)
+	}
+	if res.XMLName.Local == "Error" {
+		e := &Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(data, e)
+		return "", e
+	}
+	return res.ETag, nil
+}
+
+// AbortMultipartUpload discards an upload and its parts. Aborting one that
+// no longer exists is not an error.
+func (c *Client) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	req, err := c.newRequest(ctx, "DELETE", key, url.Values{"uploadId": {uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, emptyHash)
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, key string, query url.Values, body io.ReadCloser) (*http.Request, error) {
+	u := *c.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.Bucket
+	if key != "" {
+		u.Path += "/" + c.Prefix + key
+	}
+	// S3 signs the path with every byte outside the unreserved set escaped,
+	// which is stricter than url.URL's own escaping.
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	return req, nil
+}
+
+func (c *Client) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	c.sign(req, payloadHash, time.Now().UTC())
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := &Error{StatusCode: resp.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(data, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+var emptyHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// sign adds a SigV4 Authorization header.
+func (c *Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	region := c.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "content-type" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKeyID, scope, signedHeaders, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key with RFC 3986 escaping, as both
+// the URL and the signature need it.
+func canonicalQuery(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			if b.Len() > 0 {
+				b.WriteByte('&')
+			}
+			b.WriteString(uriEncode(k) + "=" + uriEncode(v))
+		}
+	}
+	return b.String()
+}
+
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = uriEncode(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,46 @@
+// Package s3test runs an S3-compatible server over a temporary directory, for
+// tests that need a bucket without Cloudflare or MinIO. It is the fakes3
+// server behind an httptest.Server.
+package s3test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"server/container_src/internal/fakes3"
+	"server/container_src/internal/s3client"
+)
+
+// Server is a running fake S3 endpoint, shut down when the test ends.
+type Server struct {
+	*httptest.Server
+	// Dir holds the buckets, one directory each.
+	Dir string
+	// Endpoint is the server's URL as tigrisfs and s3client expect it,
+	// with a trailing slash.
+	Endpoint string
+}
+
+// NewServer starts a server storing its data in a fresh temporary directory.
+func NewServer(tb testing.TB) *Server {
+	tb.Helper()
+	dir := tb.TempDir()
+	backend, err := fakes3.New(dir)
+	if err != nil {
+		tb.Fatalf("s3test: %v", err)
+	}
+	srv := httptest.NewServer(backend)
+	tb.Cleanup(srv.Close)
+	return &Server{Server: srv, Dir: dir, Endpoint: srv.URL + "/"}
+}
+
+// Client returns a client for bucket. Credentials aren't checked, so any
+// will do.
+func (s *Server) Client(tb testing.TB, bucket string) *s3client.Client {
+	tb.Helper()
+	c, err := s3client.New(s.Endpoint, bucket, "test", "test")
+	if err != nil {
+		tb.Fatalf("s3test: %v", err)
+	}
+	return c
+}
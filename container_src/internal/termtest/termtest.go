@@ -0,0 +1,122 @@
+// Package termtest drives a terminal session headlessly for tests: it reads
+// a client.Session's output in the background and waits for patterns to
+// appear in it, like expect(1).
+package termtest
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"server/container_src/client"
+)
+
+// Timeout is how long Expect waits for output.
+var Timeout = 10 * time.Second
+
+// escapes matches what a terminal interprets rather than displays: CSI and
+// OSC sequences, charset selection, keypad modes and carriage returns.
+var escapes = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[()][0-9A-Za-z]|\x1b[=>]|\r`)
+
+// Term is a session whose output is collected for matching.
+type Term struct {
+	tb   testing.TB
+	sess *client.Session
+
+	mu      sync.Mutex
+	raw     []byte
+	pos     int // into the stripped output, after the last match
+	changed chan struct{}
+	err     error // from reading, once the session ends
+}
+
+// Open starts a session on c. It is closed when the test ends.
+func Open(tb testing.TB, c *client.Client, opts client.SessionOptions) *Term {
+	tb.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	sess, err := c.OpenSession(ctx, opts)
+	if err != nil {
+		tb.Fatalf("termtest: opening session: %v", err)
+	}
+	t := &Term{tb: tb, sess: sess, changed: make(chan struct{})}
+	tb.Cleanup(func() { sess.Close() })
+	go t.read()
+	return t
+}
+
+func (t *Term) read() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.sess.Read(buf)
+		t.mu.Lock()
+		t.raw = append(t.raw, buf[:n]...)
+		if err != nil {
+			t.err = err
+		}
+		close(t.changed)
+		t.changed = make(chan struct{})
+		t.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Session is the underlying session, for resizing or sending control keys.
+func (t *Term) Session() *client.Session { return t.sess }
+
+// Send types s into the terminal.
+func (t *Term) Send(s string) {
+	t.tb.Helper()
+	if _, err := t.sess.Write([]byte(s)); err != nil {
+		t.tb.Fatalf("termtest: sending %q: %v", s, err)
+	}
+}
+
+// Output is everything the terminal has shown so far, without escape
+// sequences.
+func (t *Term) Output() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return escapes.ReplaceAllString(string(t.raw), "")
+}
+
+// Expect waits for output matching the regular expression pattern after
+// the previous match, and returns the match. It fails the test if none
+// arrives within Timeout or the session ends first.
+func (t *Term) Expect(pattern string) string {
+	t.tb.Helper()
+	re := regexp.MustCompile(pattern)
+	deadline := time.After(Timeout)
+	for {
+		t.mu.Lock()
+		out := escapes.ReplaceAllString(string(t.raw), "")
+		changed, err := t.changed, t.err
+		if t.pos > len(out) {
+			t.pos = len(out)
+		}
+		if loc := re.FindStringIndex(out[t.pos:]); loc != nil {
+			match := out[t.pos+loc[0] : t.pos+loc[1]]
+			t.pos += loc[1]
+			t.mu.Unlock()
+			return match
+		}
+		t.mu.Unlock()
+		if err != nil {
+			t.tb.Fatalf("termtest: session ended (%v) before %q appeared; output:\n%s", err, pattern, out)
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.tb.Fatalf("termtest: no %q after %s; output:\n%s", pattern, Timeout, out)
+		}
+	}
+}
+
+// Close ends the session.
+func (t *Term) Close() error {
+	return t.sess.Close()
+}
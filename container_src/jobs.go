@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// jobsDirName is the directory under /data holding each job's state
+	// and output, in a subdirectory named by its ID.
+	jobsDirName = ".jobs"
+	// maxJobTimeout caps how long a job may run, and is how long it runs
+	// without a timeout of its own.
+	maxJobTimeout = 24 * time.Hour
+	// jobFollowInterval is how often a followed job's output is checked
+	// for more.
+	jobFollowInterval = 250 * time.Millisecond
+	// jobEnv is set in a job's environment to its ID, so its processes can
+	// be found after the server that started it is gone.
+	jobEnv = "DO_S3_JOB"
+)
+
+var errJobRunning = errors.New("job is running")
+
+var jobsFinished = newCounter("dos3_jobs_finished_total",
+	"Exec jobs finished, by state: exited, failed, canceled or interrupted.")
+
+// jobInfo is a job's state, kept in its directory as job.json.
+type jobInfo struct {
+	ID string `json:"id"`
+	// Argv is the command a job runs; an export or import job has Export
+	// or Import instead.
+	Argv   []string      `json:"argv,omitempty"`
+	Cwd    string        `json:"cwd,omitempty"`
+	Export *exportTarget `json:"export,omitempty"`
+	Import *importSource `json:"import,omitempty"`
+	// State is running, exited (see ExitCode), failed if the command
+	// couldn't be run or timed out, canceled, or interrupted by the server
+	// restarting.
+	State    string     `json:"state"`
+	ExitCode *int       `json:"exit_code,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// StdoutBytes and StderrBytes are how much output there is so far.
+	StdoutBytes int64 `json:"stdout_bytes"`
+	StderrBytes int64 `json:"stderr_bytes"`
+	// Progress is how far an export or import job has got.
+	Progress *jobProgress `json:"progress,omitempty"`
+}
+
+// jobProgress counts the files an export or import job copies.
+type jobProgress struct {
+	Files       int   `json:"files"`
+	FilesDone   int   `json:"files_done"`
+	FilesFailed int   `json:"files_failed"`
+	Bytes       int64 `json:"bytes"`
+	BytesDone   int64 `json:"bytes_done"`
+}
+
+type jobList struct {
+	Jobs []jobInfo `json:"jobs"`
+}
+
+// runningJob is a job started by this server.
+type runningJob struct {
+	cancel   context.CancelFunc
+	canceled bool         // under jobs.mu
+	progress *jobProgress // under jobs.mu
+	done     chan struct{}
+}
+
+// jobWork is what a job does, writing its output to stdout and stderr, and
+// returning its exit code. It stops when ctx is done.
+type jobWork func(ctx context.Context, rj *runningJob, stdout, stderr io.Writer) (int, error)
+
+// updateProgress changes the progress a running job reports.
+func (rj *runningJob) updateProgress(f func(p *jobProgress)) {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	if rj.progress == nil {
+		rj.progress = &jobProgress{}
+	}
+	f(rj.progress)
+}
+
+var jobs = struct {
+	mu      sync.Mutex
+	running map[string]*runningJob
+}{running: make(map[string]*runningJob)}
+
+func jobDir(id string) string { return filepath.Join(dataDir, jobsDirName, id) }
+
+// checkJobID refuses IDs that aren't a single path element.
+func checkJobID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return fmt.Errorf("job %q: %w", id, fs.ErrNotExist)
+	}
+	return nil
+}
+
+// startJob starts req in the background as a job whose output is kept under
+// /data/.jobs, where it outlives the request and the client.
+func startJob(req execRequest) (jobInfo, error) {
+	if len(req.Argv) == 0 {
+		return jobInfo{}, errEmptyCommand
+	}
+	if _, err := resolvePath(req.Cwd); err != nil {
+		return jobInfo{}, err
+	}
+	j := jobInfo{ID: newTimeID(), Argv: req.Argv, Cwd: req.Cwd}
+	env := maps.Clone(req.Env)
+	if env == nil {
+		env = make(map[string]string)
+	}
+	env[jobEnv] = j.ID
+	req.Env = env
+	j, err := launchJob(j, func(ctx context.Context, _ *runningJob, stdout, stderr io.Writer) (int, error) {
+		return runCommand(ctx, req, stdout, stderr, maxJobTimeout, maxJobTimeout)
+	})
+	if err != nil {
+		return jobInfo{}, err
+	}
+	infof("Job %s started: %s", j.ID, req.Argv[0])
+	return j, nil
+}
+
+// launchJob starts work in the background as job j, keeping its state and
+// output under /data/.jobs.
+func launchJob(j jobInfo, work jobWork) (jobInfo, error) {
+	j.State, j.Started = "running", time.Now().UTC()
+	dir := jobDir(j.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return jobInfo{}, err
+	}
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		return jobInfo{}, err
+	}
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		stdout.Close()
+		return jobInfo{}, err
+	}
+	if err := writeJob(j); err != nil {
+		stdout.Close()
+		stderr.Close()
+		os.RemoveAll(dir)
+		return jobInfo{}, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rj := &runningJob{cancel: cancel, done: make(chan struct{})}
+	jobs.mu.Lock()
+	jobs.running[j.ID] = rj
+	jobs.mu.Unlock()
+	go func() {
+		defer cancel()
+		code, err := work(ctx, rj, stdout, stderr)
+		stdout.Close()
+		stderr.Close()
+		jobs.mu.Lock()
+		canceled := rj.canceled
+		j.Progress = rj.progress
+		jobs.mu.Unlock()
+		now := time.Now().UTC()
+		j.Finished = &now
+		switch {
+		case canceled:
+			j.State = "canceled"
+		case err != nil:
+			j.State, j.Error = "failed", err.Error()
+		default:
+			j.State, j.ExitCode = "exited", &code
+		}
+		jobOutputSizes(&j)
+		if err := writeJob(j); err != nil {
+			warnf("Job %s: recording its end: %v", j.ID, err)
+		}
+		jobsFinished.add(1, "state", j.State)
+		infof("Job %s %s (%s)", j.ID, j.State, time.Since(j.Started).Round(time.Millisecond))
+		jobs.mu.Lock()
+		delete(jobs.running, j.ID)
+		jobs.mu.Unlock()
+		close(rj.done)
+	}()
+	return j, nil
+}
+
+func writeJob(j jobInfo) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if err := state.recordJob(j); err != nil {
+		warnf("Job %s: recording it in the state database: %v", j.ID, err)
+	}
+	return storeFile(filepath.Join(jobDir(j.ID), "job.json"), strings.NewReader(string(data)+"\n"), 0644)
+}
+
+func readJob(id string) (jobInfo, error) {
+	if err := checkJobID(id); err != nil {
+		return jobInfo{}, err
+	}
+	data, err := os.ReadFile(filepath.Join(jobDir(id), "job.json"))
+	if err != nil {
+		return jobInfo{}, fmt.Errorf("job %s: %w", id, err)
+	}
+	var j jobInfo
+	if err := json.Unmarshal(data, &j); err != nil {
+		return jobInfo{}, fmt.Errorf("job %s: %w", id, err)
+	}
+	if j.State == "running" {
+		jobOutputSizes(&j)
+		jobs.mu.Lock()
+		if rj := jobs.running[id]; rj != nil && rj.progress != nil {
+			p := *rj.progress
+			j.Progress = &p
+		}
+		jobs.mu.Unlock()
+	}
+	return j, nil
+}
+
+func jobOutputSizes(j *jobInfo) {
+	if fi, err := os.Stat(filepath.Join(jobDir(j.ID), "stdout")); err == nil {
+		j.StdoutBytes = fi.Size()
+	}
+	if fi, err := os.Stat(filepath.Join(jobDir(j.ID), "stderr")); err == nil {
+		j.StderrBytes = fi.Size()
+	}
+}
+
+// listJobs returns every job kept, oldest first.
+func listJobs() ([]jobInfo, error) {
+	dirs, err := os.ReadDir(filepath.Join(dataDir, jobsDirName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []jobInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := []jobInfo{}
+	for _, d := range dirs {
+		j, err := readJob(d.Name())
+		if err != nil {
+			// Removed meanwhile, or not a job.
+			continue
+		}
+		out = append(out, j)
+	}
+	// IDs only order jobs to the second.
+	sort.SliceStable(out, func(i, k int) bool { return out[i].Started.Before(out[k].Started) })
+	return out, nil
+}
+
+// cancelJob kills a running job's command and everything it started.
+func cancelJob(id string) (jobInfo, error) {
+	jobs.mu.Lock()
+	rj := jobs.running[id]
+	if rj != nil {
+		rj.canceled = true
+		rj.cancel()
+	}
+	jobs.mu.Unlock()
+	if rj != nil {
+		<-rj.done
+	}
+	return readJob(id)
+}
+
+// removeJob deletes a finished job's state and output.
+func removeJob(id string) error {
+	if err := checkJobID(id); err != nil {
+		return err
+	}
+	jobs.mu.Lock()
+	running := jobs.running[id] != nil
+	jobs.mu.Unlock()
+	if running {
+		return fmt.Errorf("job %s: %w; cancel it first", id, errJobRunning)
+	}
+	if _, err := os.Stat(filepath.Join(jobDir(id), "job.json")); err != nil {
+		return fmt.Errorf("job %s: %w", id, err)
+	}
+	return os.RemoveAll(jobDir(id))
+}
+
+// interruptJobs marks the jobs a previous server left running as
+// interrupted, killing what is left of them: nothing is waiting for them
+// any more.
+func interruptJobs() {
+	list, err := listJobs()
+	if err != nil {
+		warnf("Reading jobs: %v", err)
+		return
+	}
+	for _, j := range list {
+		if j.State != "running" {
+			continue
+		}
+		if n := killJobProcesses(j.ID); n > 0 {
+			infof("Job %s: killed %d process(es) left by the previous server", j.ID, n)
+		}
+		now := time.Now().UTC()
+		j.State, j.Finished = "interrupted", &now
+		if err := writeJob(j); err != nil {
+			warnf("Job %s: %v", j.ID, err)
+			continue
+		}
+		jobsFinished.add(1, "state", j.State)
+		warnf("Job %s was interrupted by the server restarting", j.ID)
+	}
+}
+
+// killJobProcesses kills the processes carrying job id's jobEnv.
+func killJobProcesses(id string) int {
+	procs, err := listProcs()
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, p := range procs {
+		if procEnv(p.pid, jobEnv) == id && syscall.Kill(p.pid, syscall.SIGKILL) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func handleStartJob(w http.ResponseWriter, r *http.Request) {
+	var req execRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&req); err != nil {
+		httpError(w, r, "invalid job request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	j, err := fsCall(r.Context(), func() (jobInfo, error) { return startJob(req) })
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	list, err := fsCall(r.Context(), listJobs)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobList{Jobs: list})
+}
+
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	j, err := fsCall(r.Context(), func() (jobInfo, error) { return readJob(r.PathValue("id")) })
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+func handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	j, err := fsCall(r.Context(), func() (jobInfo, error) { return cancelJob(r.PathValue("id")) })
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+func handleRemoveJob(w http.ResponseWriter, r *http.Request) {
+	_, err := fsCall(r.Context(), func() (struct{}, error) {
+		return struct{}{}, removeJob(r.PathValue("id"))
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleJobOutput serves a job's stdout, or stderr with ?stream=stderr.
+// With ?follow=1 the response streams output as the job produces it,
+// from ?offset=, until the job finishes or the client goes away.
+func handleJobOutput(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	stream := r.URL.Query().Get("stream")
+	if stream == "" {
+		stream = "stdout"
+	}
+	if stream != "stdout" && stream != "stderr" {
+		httpError(w, r, fmt.Sprintf("invalid stream=%q: want stdout or stderr", stream), http.StatusBadRequest)
+		return
+	}
+	var offset int64
+	if v := r.URL.Query().Get("offset"); v != "" {
+		var err error
+		if offset, err = strconv.ParseInt(v, 10, 64); err != nil || offset < 0 {
+			httpError(w, r, fmt.Sprintf("invalid offset=%q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx, cancel := mountContext(r)
+	defer cancel()
+	f, err := fsCall(ctx, func() (*os.File, error) {
+		if err := checkJobID(id); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(filepath.Join(jobDir(id), "job.json")); err != nil {
+			return nil, fmt.Errorf("job %s: %w", id, err)
+		}
+		return os.Open(filepath.Join(jobDir(id), stream))
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if r.URL.Query().Get("follow") == "" {
+		fi, err := f.Stat()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		http.ServeContent(w, r, stream, fi.ModTime(), f)
+		return
+	}
+
+	jobs.mu.Lock()
+	rj := jobs.running[id]
+	jobs.mu.Unlock()
+	var done <-chan struct{}
+	if rj != nil {
+		done = rj.done
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	tick := time.NewTicker(jobFollowInterval)
+	defer tick.Stop()
+	for {
+		if _, err := io.Copy(w, f); err != nil {
+			return
+		}
+		if done == nil {
+			return
+		}
+		rc.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-done:
+			// One more read picks up what came after the last.
+			done = nil
+		case <-tick.C:
+		}
+	}
+}
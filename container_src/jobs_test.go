@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobs(t *testing.T) {
+	do := func(method, path, body string, want int) []byte {
+		t.Helper()
+		req, _ := http.NewRequest(method, testURL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != want {
+			t.Fatalf("%s %s: %s %s, want %d", method, path, resp.Status, data, want)
+		}
+		return data
+	}
+	start := func(script string) jobInfo {
+		t.Helper()
+		var j jobInfo
+		body, _ := json.Marshal(execRequest{Argv: []string{"sh", "-c", script}})
+		if err := json.Unmarshal(do("POST", "/v1/jobs", string(body), http.StatusAccepted), &j); err != nil {
+			t.Fatal(err)
+		}
+		if j.ID == "" || j.State != "running" {
+			t.Fatalf("started job = %+v", j)
+		}
+		return j
+	}
+
+	// Following the output streams it until the job ends.
+	j := start("echo one; sleep 0.3; echo two; echo err >&2; exit 4")
+	if out := string(do("GET", "/v1/jobs/"+j.ID+"/output?follow=1", "", http.StatusOK)); out != "one\ntwo\n" {
+		t.Errorf("followed output = %q", out)
+	}
+	var got jobInfo
+	json.Unmarshal(do("GET", "/v1/jobs/"+j.ID, "", http.StatusOK), &got)
+	if got.State != "exited" || got.ExitCode == nil || *got.ExitCode != 4 || got.StdoutBytes != 8 || got.Finished == nil {
+		t.Errorf("finished job = %+v", got)
+	}
+	if out := string(do("GET", "/v1/jobs/"+j.ID+"/output?stream=stderr", "", http.StatusOK)); out != "err\n" {
+		t.Errorf("stderr = %q", out)
+	}
+	if out := string(do("GET", "/v1/jobs/"+j.ID+"/output?follow=1&offset=4", "", http.StatusOK)); out != "two\n" {
+		t.Errorf("output from offset 4 = %q", out)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, jobsDirName, j.ID, "job.json")); err != nil {
+		t.Errorf("job state not kept under /data: %v", err)
+	}
+
+	// A running job can't be removed, but can be canceled.
+	long := start("sleep 60")
+	do("DELETE", "/v1/jobs/"+long.ID, "", http.StatusConflict)
+	json.Unmarshal(do("POST", "/v1/jobs/"+long.ID+"/cancel", "", http.StatusOK), &got)
+	if got.State != "canceled" {
+		t.Errorf("canceled job = %+v", got)
+	}
+
+	var l jobList
+	json.Unmarshal(do("GET", "/v1/jobs", "", http.StatusOK), &l)
+	if i := slices.IndexFunc(l.Jobs, func(x jobInfo) bool { return x.ID == j.ID }); i < 0 || i > slices.IndexFunc(l.Jobs, func(x jobInfo) bool { return x.ID == long.ID }) {
+		t.Errorf("jobs = %+v, want %s before %s", l.Jobs, j.ID, long.ID)
+	}
+
+	// One left running by a previous server is interrupted.
+	stale := jobInfo{ID: newTimeID(), Argv: []string{"true"}, State: "running", Started: time.Now().UTC()}
+	if err := writeJob(stale); err != nil {
+		t.Fatal(err)
+	}
+	interruptJobs()
+	json.Unmarshal(do("GET", "/v1/jobs/"+stale.ID, "", http.StatusOK), &got)
+	if got.State != "interrupted" {
+		t.Errorf("job left running = %+v, want interrupted", got)
+	}
+
+	for _, id := range []string{j.ID, long.ID, stale.ID} {
+		do("DELETE", "/v1/jobs/"+id, "", http.StatusNoContent)
+	}
+	do("GET", "/v1/jobs/"+j.ID, "", http.StatusNotFound)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxJournalBytes caps the data queued while the mount is down.
+	maxJournalBytes = 1 << 30
+	// journalRetry is how often replay is retried while the mount keeps
+	// failing.
+	journalRetry = 5 * time.Second
+)
+
+var errJournalFull = errors.New("write queue full")
+
+var (
+	journalDepth = newGaugeFunc("dos3_write_queue_depth",
+		"File API writes and deletes queued until the mount recovers.",
+		func() float64 { n, _ := writes.depth(); return float64(n) })
+	journalBytes = newGaugeFunc("dos3_write_queue_bytes",
+		"Bytes of queued file API writes.",
+		func() float64 { _, b := writes.depth(); return float64(b) })
+	journalReplayed = newCounter("dos3_write_queue_replayed_total",
+		"Queued writes and deletes applied to the mount.")
+	journalFailed = newCounter("dos3_write_queue_failed_total",
+		"Queued writes and deletes dropped because they failed for a reason other than the mount.")
+)
+
+// isMountError reports whether err is the mount failing, rather than the
+// operation: tigrisfs down (ENOTCONN) or S3 erroring (EIO, ETIMEDOUT).
+func isMountError(err error) bool {
+	return errors.Is(err, syscall.ENOTCONN) || errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ETIMEDOUT)
+}
+
+// journalEntry is a queued write or delete, stored as <seq>.json with the
+// data of a write in <seq>.data.
+type journalEntry struct {
+	Seq       int64       `json:"seq"`
+	Op        string      `json:"op"`   // write or delete
+	Path      string      `json:"path"` // relative to dataDir
+	Mode      fs.FileMode `json:"mode,omitempty"`
+	Recursive bool        `json:"recursive,omitempty"`
+	Size      int64       `json:"size,omitempty"`
+	Queued    time.Time   `json:"queued"`
+}
+
+// writeJournal queues file API writes that the mount can't take, on the
+// container's local disk, and replays them in order once it recovers. Once
+// anything is queued every later write and delete queues behind it, so
+// replay can't apply an old write over a newer one. The queued data isn't
+// durable: it survives tigrisfs or S3 failing, not the container going away.
+type writeJournal struct {
+	dir string
+
+	mu      sync.Mutex
+	entries []journalEntry
+	bytes   int64
+	next    int64
+	kick    chan struct{}
+}
+
+var writes = &writeJournal{
+	dir:  envOr("WRITE_JOURNAL_DIR", "/var/lib/do-s3/journal"),
+	kick: make(chan struct{}, 1),
+}
+
+// start loads entries left by an earlier run and begins replaying.
+func (j *writeJournal) start() {
+	if err := os.MkdirAll(j.dir, 0700); err != nil {
+		warnf("Write queue unavailable: %v", err)
+	}
+	names, _ := filepath.Glob(filepath.Join(j.dir, "*.json"))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		var e journalEntry
+		if err == nil {
+			err = json.Unmarshal(data, &e)
+		}
+		if err != nil {
+			warnf("Skipping queued write %s: %v", name, err)
+			continue
+		}
+		j.entries = append(j.entries, e)
+		j.bytes += e.Size
+		j.next = max(j.next, e.Seq+1)
+	}
+	sort.Slice(j.entries, func(a, b int) bool { return j.entries[a].Seq < j.entries[b].Seq })
+	if len(j.entries) > 0 {
+		infof("Replaying %d queued writes from %s", len(j.entries), j.dir)
+	}
+	go j.replay()
+}
+
+// depth is the number of queued operations and the bytes they hold.
+func (j *writeJournal) depth() (int, int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.entries), j.bytes
+}
+
+func (j *writeJournal) pending() bool {
+	n, _ := j.depth()
+	return n > 0
+}
+
+func (j *writeJournal) file(seq int64, ext string) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%012d.%s", seq, ext))
+}
+
+// write queues full's new contents.
+func (j *writeJournal) write(full string, r io.Reader, mode fs.FileMode) (fileInfo, error) {
+	// The body is copied outside the lock so a slow upload doesn't hold up
+	// the others; it's numbered once complete, as a direct write lands.
+	tmp, err := os.CreateTemp(j.dir, ".incoming-*")
+	if err != nil {
+		return fileInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	_, queued := j.depth()
+	n, err := io.Copy(tmp, io.LimitReader(r, maxJournalBytes-queued+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fileInfo{}, err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.bytes+n > maxJournalBytes {
+		return fileInfo{}, fmt.Errorf("%w: more than %d bytes waiting for the mount", errJournalFull, maxJournalBytes)
+	}
+	e := journalEntry{Seq: j.next, Op: "write", Path: relPath(full), Mode: mode.Perm(), Size: n, Queued: time.Now()}
+	if err := os.Rename(tmp.Name(), j.file(e.Seq, "data")); err != nil {
+		return fileInfo{}, err
+	}
+	if err := j.append(e); err != nil {
+		os.Remove(j.file(e.Seq, "data"))
+		return fileInfo{}, err
+	}
+	return e.info(), nil
+}
+
+// remove queues full's deletion.
+func (j *writeJournal) remove(full string, recursive bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.append(journalEntry{Seq: j.next, Op: "delete", Path: relPath(full), Recursive: recursive, Queued: time.Now()})
+}
+
+// append records e. Called with j.mu held.
+func (j *writeJournal) append(e journalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(j.file(e.Seq, "json"), data, 0600); err != nil {
+		return err
+	}
+	j.next++
+	j.entries = append(j.entries, e)
+	j.bytes += e.Size
+	if len(j.entries) == 1 {
+		warnf("Mount unavailable, queueing file writes in %s", j.dir)
+		durability.notify()
+	}
+	select {
+	case j.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (e journalEntry) info() fileInfo {
+	return fileInfo{
+		Path:    e.Path,
+		Name:    path.Base(e.Path),
+		Size:    e.Size,
+		Mode:    uint32(e.Mode),
+		ModTime: e.Queued,
+		Queued:  true,
+	}
+}
+
+// lookup finds the newest queued operation affecting full, so reads see
+// queued writes. A write returns the file holding its data; a delete
+// returns fs.ErrNotExist.
+func (j *writeJournal) lookup(full string) (fileInfo, string, bool, error) {
+	rel := relPath(full)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		e := j.entries[i]
+		switch {
+		case e.Path == rel && e.Op == "write":
+			return e.info(), j.file(e.Seq, "data"), true, nil
+		case e.Op == "delete" && (e.Path == rel || strings.HasPrefix(rel, e.Path+"/")):
+			return fileInfo{}, "", true, fmt.Errorf("%s: %w (deletion queued)", rel, fs.ErrNotExist)
+		}
+	}
+	return fileInfo{}, "", false, nil
+}
+
+// replay applies queued operations in order, waiting while the mount
+// keeps failing.
+func (j *writeJournal) replay() {
+	for {
+		j.mu.Lock()
+		if len(j.entries) == 0 {
+			j.mu.Unlock()
+			<-j.kick
+			continue
+		}
+		e := j.entries[0]
+		j.mu.Unlock()
+
+		err := j.apply(e)
+		if isMountError(err) {
+			debugf("Mount still unavailable, %s %s stays queued: %v", e.Op, e.Path, err)
+			time.Sleep(journalRetry)
+			continue
+		}
+		if err != nil {
+			warnf("Dropping queued %s of %s: %v", e.Op, e.Path, err)
+			journalFailed.add(1)
+		} else {
+			journalReplayed.add(1)
+		}
+		j.mu.Lock()
+		j.entries = j.entries[1:]
+		j.bytes -= e.Size
+		done := len(j.entries) == 0
+		j.mu.Unlock()
+		os.Remove(j.file(e.Seq, "json"))
+		os.Remove(j.file(e.Seq, "data"))
+		if done {
+			infof("Write queue drained")
+			durability.notify()
+		}
+	}
+}
+
+func (j *writeJournal) apply(e journalEntry) error {
+	full := filepath.Join(dataDir, filepath.FromSlash(e.Path))
+	if e.Op == "delete" {
+		err := trashPath(full, e.Recursive)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	f, err := os.Open(j.file(e.Seq, "data"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return storeFile(full, f, e.Mode)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useJournal replaces the server's write queue with an empty one in a
+// temporary directory for the rest of the test.
+func useJournal(t *testing.T) *writeJournal {
+	t.Helper()
+	j := &writeJournal{dir: t.TempDir(), kick: make(chan struct{}, 1)}
+	prev := writes
+	writes = j
+	t.Cleanup(func() { writes = prev })
+	return j
+}
+
+// waitDrained waits for j to replay everything queued.
+func waitDrained(t *testing.T, j *writeJournal) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for j.pending() {
+		if time.Now().After(deadline) {
+			n, _ := j.depth()
+			t.Fatalf("%d queued writes not replayed", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestJournalQueueWhileDegraded checks that once a write is queued, file
+// API writes queue behind it and reads see them before they reach the mount.
+func TestJournalQueueWhileDegraded(t *testing.T) {
+	j := useJournal(t)
+	dir := filepath.Join(dataDir, "journal-queued")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	// What a write failing with the mount down leaves behind.
+	if _, err := j.write(filepath.Join(dir, "first.txt"), strings.NewReader("first\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("PUT", testURL+"/v1/files/journal-queued/second.txt", strings.NewReader("second\n"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fi fileInfo
+	json.NewDecoder(resp.Body).Decode(&fi)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !fi.Queued {
+		t.Fatalf("PUT behind a queued write: %s, queued %t", resp.Status, fi.Queued)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "second.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("queued write reached the mount: %v", err)
+	}
+	if n, size := j.depth(); n != 2 || size != int64(len("first\nsecond\n")) {
+		t.Errorf("queue holds %d writes of %d bytes, want 2 of %d", n, size, len("first\nsecond\n"))
+	}
+
+	resp, err = http.Get(testURL + "/v1/files/journal-queued/second.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "second\n" {
+		t.Errorf("read of a queued write: %s %q", resp.Status, body)
+	}
+
+	req, _ = http.NewRequest("DELETE", testURL+"/v1/files/journal-queued/first.txt", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE behind a queued write: %v %v", resp, err)
+	}
+	resp, err = http.Get(testURL + "/v1/files/journal-queued/first.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("read of a file with its deletion queued: %s, want 404", resp.Status)
+	}
+}
+
+// TestJournalReplayOrder checks that queued writes and deletes reach the
+// mount in the order they were made.
+func TestJournalReplayOrder(t *testing.T) {
+	j := useJournal(t)
+	dir := filepath.Join(dataDir, "journal-order")
+	os.MkdirAll(dir, 0755)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	if err := os.WriteFile(b, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []func() error{
+		func() error { _, err := j.write(a, strings.NewReader("1\n"), 0644); return err },
+		func() error { _, err := j.write(a, strings.NewReader("2\n"), 0600); return err },
+		func() error { return j.remove(b, false) },
+		func() error { _, err := j.write(b, strings.NewReader("3\n"), 0644); return err },
+		func() error { return j.remove(a, false) },
+		func() error { _, err := j.write(a, strings.NewReader("4\n"), 0644); return err },
+	} {
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, _ := os.ReadFile(b); string(data) != "old\n" {
+		t.Fatalf("b.txt changed before replay: %q", data)
+	}
+	j.start()
+	waitDrained(t, j)
+
+	if data, err := os.ReadFile(a); string(data) != "4\n" {
+		t.Errorf("a.txt after replay: %q %v, want the last write", data, err)
+	}
+	if data, err := os.ReadFile(b); string(data) != "3\n" {
+		t.Errorf("b.txt after replay: %q %v, want the write after its deletion", data, err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(j.dir, "*")); len(left) > 0 {
+		t.Errorf("replayed entries left in the queue's directory: %v", left)
+	}
+}
+
+// TestJournalFull checks that a write that would take the queue past
+// maxJournalBytes is refused, and the queue left as it was.
+func TestJournalFull(t *testing.T) {
+	j := useJournal(t)
+	full := filepath.Join(dataDir, "journal-full", "big.txt")
+	if _, err := j.write(full, strings.NewReader("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Stand in for a queue that is nearly full.
+	j.mu.Lock()
+	j.bytes = maxJournalBytes - 4
+	j.mu.Unlock()
+
+	if _, err := j.write(full, strings.NewReader("too much"), 0644); !errors.Is(err, errJournalFull) {
+		t.Fatalf("write past the limit: %v, want errJournalFull", err)
+	}
+	if n, size := j.depth(); n != 1 || size != maxJournalBytes-4 {
+		t.Errorf("queue after the refused write: %d writes of %d bytes", n, size)
+	}
+	if left, _ := filepath.Glob(filepath.Join(j.dir, ".incoming-*")); len(left) > 0 {
+		t.Errorf("refused write's data left behind: %v", left)
+	}
+
+	req, _ := http.NewRequest("PUT", testURL+"/v1/files/journal-full/big.txt", strings.NewReader("too much"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p problem
+	json.NewDecoder(resp.Body).Decode(&p)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInsufficientStorage || p.Type != problemTypePrefix+"journal-full" {
+		t.Errorf("PUT with the queue full: %s %q, want 507 journal-full", resp.Status, p.Type)
+	}
+}
+
+// TestJournalReplayAfterRestart checks that writes queued by one run are
+// loaded and replayed by the next, which numbers new ones after them.
+func TestJournalReplayAfterRestart(t *testing.T) {
+	qdir := t.TempDir()
+	dir := filepath.Join(dataDir, "journal-restart")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	before := &writeJournal{dir: qdir, kick: make(chan struct{}, 1)}
+	for i, body := range []string{"one\n", "two\n"} {
+		if _, err := before.write(filepath.Join(dir, "f.txt"), strings.NewReader(body), 0644); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	// A stray file, as a crash mid-append could leave, is skipped.
+	if err := os.WriteFile(filepath.Join(qdir, "000000000099.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	after := &writeJournal{dir: qdir, kick: make(chan struct{}, 1)}
+	prev := writes
+	writes = after
+	t.Cleanup(func() { writes = prev })
+	after.mu.Lock()
+	after.start()
+	if n := len(after.entries); n != 2 || after.next != 2 || after.bytes != int64(len("one\ntwo\n")) {
+		t.Errorf("loaded %d entries of %d bytes, next %d; want 2 of %d, next 2", n, after.bytes, after.next, len("one\ntwo\n"))
+	}
+	after.mu.Unlock()
+	waitDrained(t, after)
+	if data, err := os.ReadFile(filepath.Join(dir, "f.txt")); string(data) != "two\n" {
+		t.Errorf("f.txt after replay: %q %v, want the later write", data, err)
+	}
+}
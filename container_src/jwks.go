@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefresh is how often keys are fetched again, so rotated ones are
+	// picked up; a token signed with a key not yet seen fetches them
+	// sooner, but not more than once every jwksMinRefresh.
+	jwksRefresh    = time.Hour
+	jwksMinRefresh = time.Minute
+)
+
+// jwksClient fetches key sets. Tests replace it.
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// jwks is the key set published at a URL, fetched when first needed.
+type jwks struct {
+	url     string
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// jwksCache holds a jwks for each URL, kept across config reloads.
+var jwksCache sync.Map
+
+func jwksFor(url string) *jwks {
+	k, _ := jwksCache.LoadOrStore(url, &jwks{url: url})
+	return k.(*jwks)
+}
+
+// key returns the key named kid, or the only key if kid is "".
+func (k *jwks) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	lookup := func() crypto.PublicKey {
+		if kid == "" && len(k.keys) == 1 {
+			for _, key := range k.keys {
+				return key
+			}
+		}
+		return k.keys[kid]
+	}
+	key := lookup()
+	if since := time.Since(k.fetched); since > jwksRefresh || (key == nil && since > jwksMinRefresh) {
+		if err := k.fetchLocked(ctx); err != nil {
+			if key != nil {
+				warnf("Refreshing keys from %s: %v", k.url, err)
+				return key, nil
+			}
+			return nil, err
+		}
+		key = lookup()
+	}
+	if key == nil {
+		return nil, fmt.Errorf("no key %q at %s", kid, k.url)
+	}
+	return key, nil
+}
+
+func (k *jwks) fetchLocked(ctx context.Context) error {
+	k.fetched = time.Now()
+	req, err := http.NewRequestWithContext(ctx, "GET", k.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := jwksClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching keys: %s", resp.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decoding keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			debugf("Skipping key %q from %s: %v", jwk.Kid, k.url, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	k.keys = keys
+	debugf("Fetched %d keys from %s", len(keys), k.url)
+	return nil
+}
+
+// jsonWebKey is an RSA or P-256 key of a JWKS.
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (j jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid %s key", j.Kty)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch j.Kty {
+	case "RSA":
+		n, err := num(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := num(j.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, fmt.Errorf("curve %q, want P-256", j.Crv)
+		}
+		x, err := num(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := num(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on P-256")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("key type %q, want RSA or EC", j.Kty)
+}
+
+// verify checks token's RS256 or ES256 signature with the key it names,
+// and its expiry and not-before times, and returns its claims.
+func (k *jwks) verify(ctx context.Context, token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("not a JWT: has %d parts, want 3", len(parts))
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %w", err)
+	}
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return nil, fmt.Errorf("alg %q, want RS256 or ES256", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT signature: %w", err)
+	}
+	key, err := k.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("bad signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("bad signature")
+		}
+	}
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("%w at %s", errAuthExpired, time.Unix(int64(exp), 0).UTC().Format(time.RFC3339))
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("not valid before %s", time.Unix(int64(nbf), 0).UTC().Format(time.RFC3339))
+	}
+	return claims, nil
+}
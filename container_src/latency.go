@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// rttProbeInterval is how often probe messages are sent on connections
+	// that speak JSON control messages, in addition to the pings. Flaky
+	// links are probed more often and stable ones less.
+	rttProbeInterval       = 10 * time.Second
+	flakyRTTProbeInterval  = 5 * time.Second
+	stableRTTProbeInterval = 30 * time.Second
+	// minPingPeriod bounds how often a flaky link is pinged.
+	minPingPeriod = 5 * time.Second
+	// flakyLoss is the smoothed fraction of unanswered pings and probes
+	// above which a link counts as flaky.
+	flakyLoss = 0.1
+	// maxCoalesceWindow bounds the latency-scaled output coalescing window.
+	maxCoalesceWindow = 40 * time.Millisecond
+)
+
+// linkQuality tracks a connection's round-trip time, measured from
+// timestamped WebSocket pings and from probe messages, smoothed the way TCP
+// does (RFC 6298), along with how many pings and probes go unanswered. The
+// keepalive adapts to both.
+type linkQuality struct {
+	mu           sync.Mutex
+	last         time.Duration
+	srtt, rttvar time.Duration
+	samples      int
+	probes       int // probes sent
+	acked        int // probe replies received
+	// pinging and probing are set while a ping or probe awaits its reply;
+	// one still unanswered when the next is sent counts as lost.
+	pinging, probing bool
+	loss             float64 // smoothed fraction lost
+}
+
+// rttReport is the control message sent to the client after each
+// measurement.
+type rttReport struct {
+	Type   string  `json:"type"` // "rtt"
+	RTT    float64 `json:"rtt_ms"`
+	SRTT   float64 `json:"srtt_ms"`
+	RTTVar float64 `json:"rttvar_ms"`
+	// Loss is the smoothed fraction of pings and probes left unanswered.
+	Loss float64 `json:"loss"`
+}
+
+// probeMessage may be sent by either side; the receiver answers at once
+// with a probe_ack carrying the same T, which only the sender interprets.
+type probeMessage struct {
+	Type string `json:"type"` // "probe" or "probe_ack"
+	T    int64  `json:"t"`
+}
+
+func (q *linkQuality) observe(rtt time.Duration) rttReport {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.last = rtt
+	q.samples++
+	if q.srtt == 0 {
+		q.srtt, q.rttvar = rtt, rtt/2
+	} else {
+		q.rttvar = (3*q.rttvar + (q.srtt - rtt).Abs()) / 4
+		q.srtt = (7*q.srtt + rtt) / 8
+	}
+	return rttReport{Type: "rtt", RTT: ms(rtt), SRTT: ms(q.srtt), RTTVar: ms(q.rttvar), Loss: q.loss}
+}
+
+// answered records whether a ping or probe got its reply. Called with q.mu
+// held.
+func (q *linkQuality) answered(ok bool) {
+	sample := 0.0
+	if !ok {
+		sample = 1
+	}
+	q.loss = (3*q.loss + sample) / 4
+}
+
+// pingSent records a ping about to be sent.
+func (q *linkQuality) pingSent() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pinging {
+		q.answered(false)
+	}
+	q.pinging = true
+}
+
+// pong handles a pong, returning the report for its round trip if it
+// echoed one of our timestamps.
+func (q *linkQuality) pong(payload string) (rttReport, bool) {
+	q.mu.Lock()
+	if q.pinging {
+		q.pinging = false
+		q.answered(true)
+	}
+	q.mu.Unlock()
+	rtt, ok := pongRTT(payload)
+	if !ok {
+		return rttReport{}, false
+	}
+	return q.observe(rtt), true
+}
+
+// flaky reports whether replies are going missing or the round trip varies
+// as much as it lasts. Called with q.mu held.
+func (q *linkQuality) flaky() bool {
+	return q.loss > flakyLoss || (q.samples > 1 && q.rttvar > q.srtt)
+}
+
+// stable reports whether enough replies have arrived, all of them, at a
+// steady round trip. Called with q.mu held.
+func (q *linkQuality) stable() bool {
+	return q.samples >= 4 && q.loss < 0.01 && q.rttvar <= q.srtt/4
+}
+
+// pingPeriod is how long to wait before the next ping: ping_period, or a
+// quarter of it on a flaky link so that losing a pong or two doesn't
+// starve the deadline.
+func (q *linkQuality) pingPeriod() time.Duration {
+	period := currentConfig().PingPeriod.Duration
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.flaky() {
+		return min(max(period/4, minPingPeriod), period)
+	}
+	return period
+}
+
+// pongWait is how long the connection may stay silent before it's given up
+// on. It never drops below pong_wait, but stretches to cover a slow or
+// jittery round trip on top of the ping period, and a few lost pongs on a
+// flaky link.
+func (q *linkQuality) pongWait() time.Duration {
+	wait := currentConfig().PongWait.Duration
+	period := q.pingPeriod()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	rto := max(q.srtt+4*q.rttvar, time.Second)
+	misses := time.Duration(1)
+	if q.flaky() {
+		misses = 3
+	}
+	return max(wait, misses*period+rto)
+}
+
+// deadline is the read deadline to set on hearing from the peer.
+func (q *linkQuality) deadline() time.Time {
+	return time.Now().Add(q.pongWait())
+}
+
+// probeInterval is how long to wait before the next probe.
+func (q *linkQuality) probeInterval() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch {
+	case q.flaky():
+		return flakyRTTProbeInterval
+	case q.stable():
+		return stableRTTProbeInterval
+	}
+	return rttProbeInterval
+}
+
+func (q *linkQuality) smoothed() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.srtt
+}
+
+// probe returns a probe message to send now.
+func (q *linkQuality) probe() probeMessage {
+	q.mu.Lock()
+	q.probes++
+	if q.probing {
+		q.answered(false)
+	}
+	q.probing = true
+	q.mu.Unlock()
+	return probeMessage{Type: "probe", T: time.Now().UnixNano()}
+}
+
+// probeAcked handles the reply to one of our probes, returning false if its
+// timestamp isn't one we could have sent.
+func (q *linkQuality) probeAcked(t int64) (rttReport, bool) {
+	rtt, ok := rttSince(t)
+	if !ok {
+		return rttReport{}, false
+	}
+	q.mu.Lock()
+	q.acked++
+	if q.probing {
+		q.probing = false
+		q.answered(true)
+	}
+	q.mu.Unlock()
+	return q.observe(rtt), true
+}
+
+// keepalive pings c, and probes it with sendProbe if that's set, at the
+// intervals q calls for, until ctx is done or a ping can't be sent. The
+// intervals are recomputed after each one, so they follow both the link
+// and config reloads.
+func keepalive(ctx context.Context, c *wsConn, q *linkQuality, sendProbe func(probeMessage)) error {
+	ping := time.NewTimer(q.pingPeriod())
+	defer ping.Stop()
+	probe := time.NewTimer(q.probeInterval())
+	defer probe.Stop()
+	probes := probe.C
+	if sendProbe == nil {
+		probes = nil
+	}
+	for {
+		select {
+		case <-ping.C:
+			q.pingSent()
+			if err := c.control(websocket.PingMessage, pingPayload()); err != nil {
+				return err
+			}
+			ping.Reset(q.pingPeriod())
+		case <-probes:
+			sendProbe(q.probe())
+			probe.Reset(q.probeInterval())
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// pingPayload timestamps a ping; the peer echoes it in the pong.
+func pingPayload() []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+}
+
+// pongRTT measures the round trip of a pong answering pingPayload.
+func pongRTT(payload string) (time.Duration, bool) {
+	if len(payload) != 8 {
+		return 0, false
+	}
+	return rttSince(int64(binary.BigEndian.Uint64([]byte(payload))))
+}
+
+func rttSince(unixNano int64) (time.Duration, bool) {
+	rtt := time.Since(time.Unix(0, unixNano))
+	return rtt, rtt >= 0 && rtt < time.Minute
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+type linkQualityKey struct{}
+
+// withLinkQuality lets output followed with ctx adapt to the connection.
+func withLinkQuality(ctx context.Context, q *linkQuality) context.Context {
+	return context.WithValue(ctx, linkQualityKey{}, q)
+}
+
+// coalesceWindowFor is how long output is held to batch bursts for the
+// connection behind ctx. On a slow link an extra few milliseconds go
+// unnoticed next to the round trip and save frames, so the window grows
+// with the smoothed RTT.
+func coalesceWindowFor(ctx context.Context) time.Duration {
+	if q, ok := ctx.Value(linkQualityKey{}).(*linkQuality); ok {
+		return min(max(q.smoothed()/8, coalesceWindow), maxCoalesceWindow)
+	}
+	return coalesceWindow
+}
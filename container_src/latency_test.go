@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLinkQualityObserve(t *testing.T) {
+	var q linkQuality
+	r := q.observe(100 * time.Millisecond)
+	if r.Type != "rtt" || r.RTT != 100 || r.SRTT != 100 || r.RTTVar != 50 {
+		t.Errorf("first sample: %+v, want rtt 100, srtt 100, rttvar 50", r)
+	}
+	// RFC 6298: rttvar = 3/4 rttvar + 1/4 |srtt - rtt|, srtt = 7/8 srtt + 1/8 rtt.
+	r = q.observe(20 * time.Millisecond)
+	if r.RTT != 20 || r.SRTT != 90 || r.RTTVar != 57.5 {
+		t.Errorf("second sample: %+v, want rtt 20, srtt 90, rttvar 57.5", r)
+	}
+}
+
+func TestPongRTT(t *testing.T) {
+	stamp := func(at time.Time) string {
+		return string(binary.BigEndian.AppendUint64(nil, uint64(at.UnixNano())))
+	}
+	if rtt, ok := pongRTT(stamp(time.Now().Add(-5 * time.Millisecond))); !ok || rtt < 5*time.Millisecond || rtt > time.Second {
+		t.Errorf("pong of a ping 5ms ago: %s %t", rtt, ok)
+	}
+	for name, payload := range map[string]string{
+		"empty":    "",
+		"short":    "1234",
+		"future":   stamp(time.Now().Add(time.Hour)),
+		"too old":  stamp(time.Now().Add(-time.Hour)),
+		"not ours": "keepalive",
+	} {
+		if _, ok := pongRTT(payload); ok {
+			t.Errorf("%s pong measured", name)
+		}
+	}
+}
+
+// TestLatencyReport checks that a control client hears the round trip of
+// the server's pings as rtt messages, and that its own probes are answered.
+func TestLatencyReport(t *testing.T) {
+	cfg := *currentConfig()
+	cfg.PingPeriod = duration{50 * time.Millisecond}
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws?control=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	const probeT = 12345
+	conn.WriteJSON(probeMessage{Type: "probe", T: probeT})
+	var rtt, acked bool
+	for !rtt || !acked {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading (rtt report %t, probe acked %t): %v", rtt, acked, err)
+		}
+		if typ != websocket.TextMessage {
+			continue
+		}
+		var m struct {
+			Type string  `json:"type"`
+			T    int64   `json:"t"`
+			RTT  float64 `json:"rtt_ms"`
+			SRTT float64 `json:"srtt_ms"`
+		}
+		json.Unmarshal(data, &m)
+		switch m.Type {
+		case "rtt":
+			if m.RTT <= 0 || m.SRTT <= 0 {
+				t.Errorf("rtt report %s", data)
+			}
+			rtt = true
+		case "probe_ack":
+			if m.T != probeT {
+				t.Errorf("probe_ack %s, want t %d", data, probeT)
+			}
+			acked = true
+		}
+	}
+}
+
+// TestKeepaliveAdapts checks that the keepalive follows the link: pinging
+// a flaky link more often, allowing a slow one longer to answer, and
+// probing a stable one less.
+func TestKeepaliveAdapts(t *testing.T) {
+	cfg := *currentConfig()
+	cfg.PingPeriod, cfg.PongWait = duration{20 * time.Second}, duration{30 * time.Second}
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+
+	var q linkQuality
+	if p, w, i := q.pingPeriod(), q.pongWait(), q.probeInterval(); p != 20*time.Second || w != 30*time.Second || i != rttProbeInterval {
+		t.Errorf("new link: ping every %s, pong wait %s, probe every %s; want the configured 20s and 30s, and %s", p, w, i, rttProbeInterval)
+	}
+
+	// Pings going unanswered make the link flaky.
+	for range 3 {
+		q.pingSent()
+	}
+	if p, i := q.pingPeriod(), q.probeInterval(); p != minPingPeriod || i != flakyRTTProbeInterval {
+		t.Errorf("after 2 lost pings: ping every %s, probe every %s; want %s and %s", p, i, minPingPeriod, flakyRTTProbeInterval)
+	}
+	// And it recovers once they're answered again.
+	for n := 0; q.pingPeriod() != 20*time.Second; n++ {
+		if n == 10 {
+			t.Fatalf("still pinging every %s after %d pongs", q.pingPeriod(), n)
+		}
+		q.pong("")
+		q.pingSent()
+	}
+
+	// A slow round trip stretches the pong wait past pong_wait.
+	q = linkQuality{}
+	q.observe(8 * time.Second)
+	// The ping period, then srtt + 4 rttvar: 8s + 4 * 4s.
+	if w := q.pongWait(); w != 44*time.Second {
+		t.Errorf("pong wait with an 8s round trip: %s, want 44s", w)
+	}
+
+	// Lost probes count as much as lost pings.
+	q = linkQuality{}
+	q.probe()
+	q.probe()
+	q.probe()
+	if p := q.pingPeriod(); p != minPingPeriod {
+		t.Errorf("after 2 lost probes: ping every %s, want %s", p, minPingPeriod)
+	}
+
+	q = linkQuality{}
+	for range 4 {
+		q.probe()
+		q.probeAcked(time.Now().Add(-50 * time.Millisecond).UnixNano())
+	}
+	if i := q.probeInterval(); i != stableRTTProbeInterval {
+		t.Errorf("after 4 steady probes: probe every %s, want %s", i, stableRTTProbeInterval)
+	}
+}
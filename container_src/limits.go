@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Classes of work whose concurrency concurrency_limits bounds. File API
+// requests all queue on the mount, so a burst of them can leave terminals,
+// whose shells use the same mount, waiting behind it; search walks whole
+// trees and is bounded tighter. Bulk is the files that exports, imports,
+// publishing and search read or write, one slot a file, across every job
+// and request; its bytes are also held to bulk_bytes_per_second. Anything
+// else, above all the terminals, is interactive and isn't held back.
+const (
+	classFiles  = "files"
+	classSearch = "search"
+	classBulk   = "bulk"
+)
+
+var concurrencyClasses = []string{classFiles, classSearch, classBulk}
+
+var (
+	concurrencyActive = newGauge("dos3_concurrency_active",
+		"API requests running, by concurrency_limits class.")
+	concurrencyWaiting = newGauge("dos3_concurrency_waiting",
+		"API requests waiting for a slot under concurrency_limits, by class.")
+	bulkThrottled = newCounter("dos3_bulk_throttled_seconds_total",
+		"Time bulk reads and writes of the mount waited under bulk_bytes_per_second.")
+)
+
+// limiter counts the requests running in each class. The limits are read
+// from the config on each request, so a reload applies to the next one.
+var limiter = struct {
+	mu     sync.Mutex
+	active map[string]int
+	// freed is closed, and replaced, whenever a request finishes.
+	freed chan struct{}
+}{active: make(map[string]int), freed: make(chan struct{})}
+
+// checkConcurrencyLimits checks concurrency_limits names known classes.
+func checkConcurrencyLimits(limits map[string]int) error {
+	for class, n := range limits {
+		if !slices.Contains(concurrencyClasses, class) {
+			return fmt.Errorf("concurrency_limits: unknown class %q; classes are %v", class, concurrencyClasses)
+		}
+		if n < 0 {
+			return fmt.Errorf("concurrency_limits: %s must not be negative", class)
+		}
+	}
+	return nil
+}
+
+// acquireSlot waits until a request of class may run, or ctx is done, and
+// returns the function that gives the slot back.
+func acquireSlot(ctx context.Context, class string) (func(), error) {
+	waiting := false
+	defer func() {
+		if waiting {
+			concurrencyWaiting.add(-1, "class", class)
+		}
+	}()
+	for {
+		limiter.mu.Lock()
+		if limit := currentConfig().ConcurrencyLimits[class]; limit <= 0 || limiter.active[class] < limit {
+			limiter.active[class]++
+			concurrencyActive.set(float64(limiter.active[class]), "class", class)
+			limiter.mu.Unlock()
+			return func() { releaseSlot(class) }, nil
+		}
+		freed := limiter.freed
+		limiter.mu.Unlock()
+		if !waiting {
+			waiting = true
+			concurrencyWaiting.add(1, "class", class)
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func releaseSlot(class string) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.active[class]--
+	concurrencyActive.set(float64(limiter.active[class]), "class", class)
+	close(limiter.freed)
+	limiter.freed = make(chan struct{})
+}
+
+// limitConcurrency runs h once a slot of class is free. A request waits up
+// to request_timeout for one, then fails with 504 as one waiting on the
+// mount would.
+func limitConcurrency(class string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := mountContext(r)
+		release, err := acquireSlot(ctx, class)
+		cancel()
+		if err != nil {
+			writeError(w, r, fmt.Errorf("waiting for a %s slot: %w", class, err))
+			return
+		}
+		defer release()
+		h(w, r)
+	}
+}
+
+// routeClass is the concurrency_limits class rt counts against, if any.
+func routeClass(rt route) string {
+	switch {
+	case rt.Class != "":
+		return rt.Class
+	case rt.Tag == "files":
+		return classFiles
+	}
+	return ""
+}
+
+// bulkRate is the token bucket bulk I/O draws on, holding up to a second
+// of bulk_bytes_per_second.
+var bulkRate struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// bulkWait takes n bytes from the bulk rate, waiting for the bucket to
+// refill if that leaves it in debt. It returns at once if the rate isn't
+// capped.
+func bulkWait(ctx context.Context, n int64) error {
+	rate := float64(currentConfig().BulkBytesPerSecond)
+	if rate <= 0 || n <= 0 {
+		return nil
+	}
+	bulkRate.mu.Lock()
+	now := time.Now()
+	if bulkRate.last.IsZero() {
+		bulkRate.tokens = rate
+	} else {
+		bulkRate.tokens = min(rate, bulkRate.tokens+rate*now.Sub(bulkRate.last).Seconds())
+	}
+	bulkRate.last = now
+	bulkRate.tokens -= float64(n)
+	wait := time.Duration(-bulkRate.tokens / rate * float64(time.Second))
+	bulkRate.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	bulkThrottled.add(wait.Seconds())
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// bulkReader is r with its reads charged to the bulk rate.
+type bulkReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (b bulkReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if werr := bulkWait(b.ctx, int64(n)); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// bulkFile is a file of the mount opened for bulk work: it holds a bulk
+// slot until closed, and its reads are charged to the bulk rate. It
+// doesn't embed the *os.File, whose WriteTo io.Copy would read through.
+type bulkFile struct {
+	f       *os.File
+	ctx     context.Context
+	release func()
+}
+
+// openBulk opens name once a bulk slot is free.
+func openBulk(ctx context.Context, name string) (*bulkFile, error) {
+	release, err := acquireSlot(ctx, classBulk)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &bulkFile{f: f, ctx: ctx, release: release}, nil
+}
+
+func (f *bulkFile) Read(p []byte) (int, error) {
+	return bulkReader{f.ctx, f.f}.Read(p)
+}
+
+func (f *bulkFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.f.ReadAt(p, off)
+	if werr := bulkWait(f.ctx, int64(n)); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+func (f *bulkFile) Seek(offset int64, whence int) (int64, error) {
+	return f.f.Seek(offset, whence)
+}
+
+func (f *bulkFile) Stat() (os.FileInfo, error) { return f.f.Stat() }
+
+func (f *bulkFile) Close() error {
+	err := f.f.Close()
+	f.release()
+	return err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimits(t *testing.T) {
+	cfg := *currentConfig()
+	cfg.ConcurrencyLimits = map[string]int{"archive": 1}
+	if err := cfg.validate(); err == nil {
+		t.Error("unknown concurrency class accepted")
+	}
+	cfg.ConcurrencyLimits = map[string]int{classFiles: 1}
+	cfg.RequestTimeout = duration{100 * time.Millisecond}
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	os.WriteFile(filepath.Join(dataDir, "limited.txt"), []byte("hi"), 0644)
+	get := func(path string) int {
+		resp, err := http.Get(testURL + path)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// With the only slot taken, file requests wait, then time out; others
+	// go ahead.
+	release, err := acquireSlot(context.Background(), classFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get("/v1/files/limited.txt"); code != http.StatusGatewayTimeout {
+		t.Errorf("file request with no slot: %d, want 504", code)
+	}
+	if code := get("/v1/health"); code != http.StatusOK {
+		t.Errorf("health with the file slots taken: %d", code)
+	}
+	// One waiting gets the slot when it's given back.
+	patient := cfg
+	patient.RequestTimeout = duration{5 * time.Second}
+	activeConfig.Store(&patient)
+	done := make(chan int)
+	go func() { done <- get("/v1/files/limited.txt") }()
+	for concurrencyWaiting.get("class", classFiles) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("file request after the slot was freed: %d", code)
+	}
+	if n := concurrencyActive.get("class", classFiles); n != 0 {
+		t.Errorf("%v file requests still active", n)
+	}
+}
+
+func TestBulkLane(t *testing.T) {
+	cfg := *currentConfig()
+	cfg.BulkBytesPerSecond = -1
+	if err := cfg.validate(); err == nil {
+		t.Error("negative bulk_bytes_per_second accepted")
+	}
+	cfg.BulkBytesPerSecond = 1 << 20
+	cfg.ConcurrencyLimits = map[string]int{classBulk: 1}
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	bulkRate.mu.Lock()
+	bulkRate.last = time.Time{}
+	bulkRate.mu.Unlock()
+	name := filepath.Join(dataDir, "bulk.bin")
+	if err := os.WriteFile(name, make([]byte, 3<<19), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second's worth is read at once, the rest at the capped rate.
+	start := time.Now()
+	f, err := openBulk(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := io.Copy(io.Discard, f); err != nil || n != 3<<19 {
+		t.Fatalf("bulk read: %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("1.5MiB read at 1MiB/s in %v", elapsed)
+	}
+	// The only bulk slot is held while the file is open; interactive reads
+	// don't wait for it.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := openBulk(ctx, name); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("second bulk open with the slot taken: %v", err)
+	}
+	start = time.Now()
+	if _, err := os.ReadFile(name); err != nil || time.Since(start) > 200*time.Millisecond {
+		t.Errorf("interactive read during bulk work: %v in %v", err, time.Since(start))
+	}
+	f.Close()
+	if n := concurrencyActive.get("class", classBulk); n != 0 {
+		t.Errorf("%v bulk files still open", n)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// locksManifest records, in /data, the locks held, so they outlive the
+	// server.
+	locksManifest  = ".locks.json"
+	defaultLockTTL = time.Minute
+	maxLockTTL     = time.Hour
+	maxLocks       = 4096
+	maxLockOwner   = 128
+)
+
+var (
+	errLocked      = errors.New("locked")
+	errInvalidLock = errors.New("invalid lock")
+)
+
+// lockRequest is the body of POST /v1/locks.
+type lockRequest struct {
+	Path string `json:"path"`
+	// Owner names who holds the lock, for others to show; acquiring a lock
+	// one already holds renews it.
+	Owner string   `json:"owner"`
+	TTL   duration `json:"ttl"`
+}
+
+// lockInfo is an advisory lock on a path under /data. Nothing enforces
+// it: it is for editors and scripts that agree to check.
+type lockInfo struct {
+	Path  string `json:"path"`
+	Owner string `json:"owner"`
+	// Token releases the lock; it is only returned to whoever acquired it.
+	Token    string    `json:"token,omitempty"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+type lockList struct {
+	Locks []lockInfo `json:"locks"`
+}
+
+// locks are the locks held, by path relative to /data. Expired ones are
+// dropped when next looked at.
+var locks = struct {
+	sync.Mutex
+	m map[string]lockInfo
+}{m: make(map[string]lockInfo)}
+
+// acquireLock takes the lock on req.Path for req.Owner, or renews it if
+// req.Owner holds it already.
+func acquireLock(req lockRequest) (lockInfo, error) {
+	full, err := resolvePath(req.Path)
+	if err != nil {
+		return lockInfo{}, err
+	}
+	if req.Owner == "" || len(req.Owner) > maxLockOwner {
+		return lockInfo{}, fmt.Errorf("%w: owner must be 1-%d bytes", errInvalidLock, maxLockOwner)
+	}
+	ttl := req.TTL.Duration
+	if ttl == 0 {
+		ttl = defaultLockTTL
+	}
+	if ttl < 0 || ttl > maxLockTTL {
+		return lockInfo{}, fmt.Errorf("%w: ttl must be positive and at most %s", errInvalidLock, maxLockTTL)
+	}
+	p := relPath(full)
+	now := time.Now().UTC()
+	locks.Lock()
+	defer locks.Unlock()
+	pruneLocksLocked(now)
+	l, held := locks.m[p]
+	switch {
+	case held && l.Owner != req.Owner:
+		return lockInfo{}, fmt.Errorf("%s: %w by %s until %s", p, errLocked, l.Owner, l.Expires.Format(time.RFC3339))
+	case !held && len(locks.m) >= maxLocks:
+		return lockInfo{}, fmt.Errorf("%w: %d locks are held", errInvalidLock, maxLocks)
+	case !held:
+		l = lockInfo{Path: p, Owner: req.Owner, Token: randomID(), Acquired: now}
+	}
+	l.Expires = now.Add(ttl)
+	locks.m[p] = l
+	saveLocksLocked()
+	return l, nil
+}
+
+// releaseLock drops the lock on p if token is its.
+func releaseLock(p, token string) error {
+	full, err := resolvePath(p)
+	if err != nil {
+		return err
+	}
+	p = relPath(full)
+	locks.Lock()
+	defer locks.Unlock()
+	pruneLocksLocked(time.Now())
+	l, ok := locks.m[p]
+	if !ok {
+		return fmt.Errorf("lock on %s: %w", p, fs.ErrNotExist)
+	}
+	if token != l.Token {
+		return fmt.Errorf("%s: %w by %s; releasing it takes its token", p, errLocked, l.Owner)
+	}
+	delete(locks.m, p)
+	saveLocksLocked()
+	return nil
+}
+
+// listLocks returns the locks held, by path, without their tokens.
+func listLocks() []lockInfo {
+	locks.Lock()
+	defer locks.Unlock()
+	pruneLocksLocked(time.Now())
+	out := make([]lockInfo, 0, len(locks.m))
+	for _, l := range locks.m {
+		l.Token = ""
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+func pruneLocksLocked(now time.Time) {
+	for p, l := range locks.m {
+		if !now.Before(l.Expires) {
+			delete(locks.m, p)
+		}
+	}
+}
+
+// saveLocksLocked writes the manifest. Failing to is logged, not returned:
+// the locks still hold for this server's life.
+func saveLocksLocked() {
+	list := make([]lockInfo, 0, len(locks.m))
+	for _, l := range locks.m {
+		list = append(list, l)
+	}
+	data, err := json.Marshal(list)
+	if err == nil {
+		err = storeFile(filepath.Join(dataDir, locksManifest), strings.NewReader(string(data)+"\n"), 0600)
+	}
+	if err != nil {
+		warnf("Writing the lock manifest: %v", err)
+	}
+	if err := state.saveLocks(list); err != nil {
+		warnf("Recording locks in the state database: %v", err)
+	}
+}
+
+// loadLocks picks up the unexpired locks from the manifest, or without one
+// (as on local disk while the mount is down) from the state database.
+func loadLocks() {
+	var list []lockInfo
+	data, err := os.ReadFile(filepath.Join(dataDir, locksManifest))
+	if errors.Is(err, fs.ErrNotExist) {
+		list, err = state.locks(time.Now())
+	} else if err == nil {
+		err = json.Unmarshal(data, &list)
+	}
+	if err != nil {
+		warnf("Reading locks: %v", err)
+		return
+	}
+	now := time.Now()
+	locks.Lock()
+	defer locks.Unlock()
+	for _, l := range list {
+		if now.Before(l.Expires) {
+			locks.m[l.Path] = l
+		}
+	}
+	if len(locks.m) > 0 {
+		infof("Restored %d file locks", len(locks.m))
+	}
+}
+
+func handleAcquireLock(w http.ResponseWriter, r *http.Request) {
+	var req lockRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&req); err != nil {
+		httpError(w, r, "invalid lock request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	l, err := fsCall(r.Context(), func() (lockInfo, error) { return acquireLock(req) })
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, l)
+}
+
+func handleListLocks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, lockList{Locks: listLocks()})
+}
+
+func handleReleaseLock(w http.ResponseWriter, r *http.Request) {
+	_, err := fsCall(r.Context(), func() (struct{}, error) {
+		return struct{}{}, releaseLock(r.PathValue("path"), r.URL.Query().Get("token"))
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocks(t *testing.T) {
+	acquire := func(body string, want int) lockInfo {
+		t.Helper()
+		resp, err := http.Post(testURL+"/v1/locks", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("acquire %s: %s, want %d", body, resp.Status, want)
+		}
+		var l lockInfo
+		json.NewDecoder(resp.Body).Decode(&l)
+		return l
+	}
+	release := func(p, token string) int {
+		t.Helper()
+		req, _ := http.NewRequest("DELETE", testURL+"/v1/locks/"+p+"?token="+token, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	l := acquire(`{"path": "src/../src/main.go", "owner": "editor-1", "ttl": "10s"}`, http.StatusOK)
+	if l.Path != "src/main.go" || l.Token == "" || time.Until(l.Expires) > 10*time.Second {
+		t.Fatalf("lock = %+v", l)
+	}
+	acquire(`{"path": "src/main.go", "owner": "script"}`, http.StatusConflict)
+	// Acquiring it again renews it, keeping the token.
+	if renewed := acquire(`{"path": "src/main.go", "owner": "editor-1", "ttl": "30s"}`, http.StatusOK); renewed.Token != l.Token || !renewed.Expires.After(l.Expires) {
+		t.Errorf("renewed lock = %+v", renewed)
+	}
+	acquire(`{"path": "src/main.go", "owner": "x", "ttl": "2h"}`, http.StatusBadRequest)
+
+	// The manifest brings them back after a restart.
+	locks.Lock()
+	clear(locks.m)
+	locks.Unlock()
+	loadLocks()
+	resp, err := http.Get(testURL + "/v1/locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list lockList
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Locks) != 1 || list.Locks[0].Owner != "editor-1" || list.Locks[0].Token != "" {
+		t.Fatalf("locks after reloading = %+v", list.Locks)
+	}
+
+	if code := release("src/main.go", "wrong"); code != http.StatusConflict {
+		t.Errorf("release with the wrong token: %d", code)
+	}
+	if code := release("src/main.go", l.Token); code != http.StatusNoContent {
+		t.Errorf("release: %d", code)
+	}
+	if code := release("src/main.go", l.Token); code != http.StatusNotFound {
+		t.Errorf("release again: %d", code)
+	}
+
+	// An expired lock is free to take.
+	acquire(`{"path": "short", "owner": "a", "ttl": "1ms"}`, http.StatusOK)
+	time.Sleep(5 * time.Millisecond)
+	acquire(`{"path": "short", "owner": "b"}`, http.StatusOK)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch s {
+	case "debug":
+		return levelDebug, nil
+	case "info", "":
+		return levelInfo, nil
+	case "warn":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+func logAt(level logLevel, format string, args ...any) {
+	if level >= currentConfig().level {
+		log.Printf(format, args...)
+	}
+}
+
+func debugf(format string, args ...any) { logAt(levelDebug, format, args...) }
+func infof(format string, args ...any)  { logAt(levelInfo, format, args...) }
+func warnf(format string, args ...any)  { logAt(levelWarn, format, args...) }
+func errorf(format string, args ...any) { logAt(levelError, format, args...) }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// openLSPChannel runs a language server from the language_servers config
+// with its working directory under dataDir. The client speaks LSP's
+// Content-Length framing itself.
+func openLSPChannel(msg muxMessage, reply *muxMessage) (muxChannel, error) {
+	argv, ok := currentConfig().LanguageServers[msg.Server]
+	if !ok {
+		return nil, fmt.Errorf("unknown language server %q", msg.Server)
+	}
+	dir, err := resolvePath(msg.Cwd)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = spawnEnv()
+	cmd.Stderr = &pipeLogWriter{name: msg.Server}
+	ch, err := startPipe(msg.Server, trafficLSP, cmd)
+	if err != nil {
+		return nil, err
+	}
+	infof("Language server %s started (pid %d) in %s", msg.Server, cmd.Process.Pid, dir)
+	reply.Server = msg.Server
+	return ch, nil
+}
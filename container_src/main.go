@@ -2,76 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
-	"encoding/json"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"runtime"
-	"strconv"
-	"sync"
 	"syscall"
 	"time"
-
-	"github.com/creack/pty"
-	"github.com/gorilla/websocket"
-)
-
-const (
-	pongWait   = 60 * time.Second
-	pingPeriod = (pongWait * 9) / 10
-	dataDir    = "/data"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for development
-		return true
-	},
-}
-
-type ptySession struct {
-	cmd    *exec.Cmd
-	ptmx   *os.File
-	ws     *websocket.Conn
-	mu     sync.Mutex
-	closed bool
-}
-
-type resizeMessage struct {
-	Type string `json:"type"`
-	Cols uint16 `json:"cols"`
-	Rows uint16 `json:"rows"`
-}
-
-// waitForMount polls until the directory is a FUSE mount (not a regular directory)
-func waitForMount(path string, timeout time.Duration) error {
-	deadline := time.Now().Add(timeout)
-	ticker := time.NewTicker(50 * time.Millisecond)
-	defer ticker.Stop()
-
-	const FUSE_SUPER_MAGIC = 0x65735546 // FUSE filesystem magic number
-
-	for range ticker.C {
-		var stat syscall.Statfs_t
-		if err := syscall.Statfs(path, &stat); err == nil {
-			// Check if it's a FUSE filesystem
-			if stat.Type == FUSE_SUPER_MAGIC {
-				log.Printf("Mount at %s is ready (FUSE detected)", path)
-				return nil
-			}
-		}
-
-		if time.Now().After(deadline) {
-			return fmt.Errorf("timeout waiting for FUSE mount at %s", path)
-		}
-	}
-	return fmt.Errorf("ticker closed unexpectedly")
-}
+// dataDir is where the bucket is mounted. Tests point it at a temporary
+// directory.
+var dataDir = "/data"
 
 func getShell() string {
 	if runtime.GOOS == "windows" {
@@ -86,272 +33,274 @@ func getShell() string {
 	return "/bin/bash"
 }
 
-func (s *ptySession) close() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if s.closed {
-		return
-	}
-	s.closed = true
-
-	if s.ptmx != nil {
-		s.ptmx.Close()
-	}
-	if s.cmd != nil && s.cmd.Process != nil {
-		s.cmd.Process.Kill()
-	}
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Parse query params
-	cols := 80
-	rows := 24
-
-	if colsStr := r.URL.Query().Get("cols"); colsStr != "" {
-		if c, err := strconv.Atoi(colsStr); err == nil {
-			cols = c
-		}
-	}
-	if rowsStr := r.URL.Query().Get("rows"); rowsStr != "" {
-		if rowsValue, err := strconv.Atoi(rowsStr); err == nil {
-			rows = rowsValue
-		}
-	}
-
-	// Upgrade to WebSocket
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
-		return
-	}
-	defer ws.Close()
-
-	// Set up pong handler
-	ws.SetReadDeadline(time.Now().Add(pongWait))
-	ws.SetPongHandler(func(string) error {
-		ws.SetReadDeadline(time.Now().Add(pongWait))
-		return nil
-	})
+func shaString(str string) string {
+	h := sha256.New()
+	h.Write([]byte(str))
+	hashBytes := h.Sum(nil)
+	return fmt.Sprintf("%x", hashBytes)[:10]
+}
 
-	// Create shell command
-	shell := getShell()
-	cmd := exec.Command(shell)
-	cmd.Dir = dataDir
-	cmd.Env = append(os.Environ(),
-		"TERM=xterm-256color",
-		"COLORTERM=truecolor",
-	)
-
-	// Start PTY
-	ptmx, err := pty.Start(cmd)
-	if err != nil {
-		log.Printf("Failed to start PTY: %v", err)
-		return
-	}
+// httpProtocols are what the server speaks on its port: HTTP/1 and HTTP/2
+// without TLS (h2c, with prior knowledge), which the Worker's connection to
+// the container is. gRPC and other HTTP/2 traffic for workspace servers
+// then goes through the proxy without falling back to HTTP/1.
+func httpProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
 
-	session := &ptySession{
-		cmd:  cmd,
-		ptmx: ptmx,
-		ws:   ws,
-	}
-	defer session.close()
-
-	// Set initial size
-	if err := pty.Setsize(ptmx, &pty.Winsize{
-		Rows: uint16(rows),
-		Cols: uint16(cols),
-	}); err != nil {
-		log.Printf("Failed to set PTY size: %v", err)
-	}
+// newRouter returns the container's HTTP handler.
+func newRouter() *http.ServeMux {
+	router := http.NewServeMux()
 
-	// Start ping ticker to keep connection alive
-	ticker := time.NewTicker(pingPeriod)
-	defer ticker.Stop()
+	// WebSocket endpoint for PTY
+	router.HandleFunc("/ws", handleWebSocket)
 
-	go func() {
-		for range ticker.C {
-			session.mu.Lock()
-			if session.closed {
-				session.mu.Unlock()
-				return
-			}
-			if err := ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second)); err != nil {
-				log.Printf("Ping error: %v", err)
-				session.mu.Unlock()
-				return
-			}
-			session.mu.Unlock()
-		}
-	}()
+	// Multiplexed WebSocket carrying terminal and language server channels
+	router.HandleFunc("/ws/mux", unscopedOnly(handleMux))
 
-	// PTY -> WebSocket (read from PTY, send to browser)
-	go func() {
-		buf := make([]byte, 8192)
-		for {
-			n, err := ptmx.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("PTY read error: %v", err)
-				}
-				return
-			}
+	// Versioned REST API: sessions (including the SSE and long-polling
+	// fallbacks for networks that block WebSockets), exec, and files
+	registerAPI(router)
 
-			session.mu.Lock()
-			if !session.closed {
-				if err := ws.WriteMessage(websocket.TextMessage, buf[:n]); err != nil {
-					log.Printf("WebSocket write error: %v", err)
-					session.mu.Unlock()
-					return
-				}
-			}
-			session.mu.Unlock()
-		}
-	}()
+	// Servers running inside the workspace, such as the IDE
+	router.HandleFunc("/proxy/{port}/", meterHTTP("/proxy/{port}/", trafficProxy, unscopedOnly(handleProxy)))
+	router.HandleFunc("/proxy/{port}", func(w http.ResponseWriter, r *http.Request) {
+		u := *r.URL
+		u.Path += "/"
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
 
-	// WebSocket -> PTY (read from browser, write to PTY)
-	for {
-		msgType, data, err := ws.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket read error: %v", err)
-			}
-			break
-		}
+	// Build metadata, for confirming which build a container runs
+	router.HandleFunc("GET /version", handleVersion)
 
-		if msgType == websocket.TextMessage {
-			msg := string(data)
-
-			// Check if it's a resize message
-			if len(msg) > 0 && msg[0] == '{' {
-				var resize resizeMessage
-				if err := json.Unmarshal(data, &resize); err == nil && resize.Type == "resize" {
-					if err := pty.Setsize(ptmx, &pty.Winsize{
-						Rows: resize.Rows,
-						Cols: resize.Cols,
-					}); err != nil {
-						log.Printf("Failed to resize PTY: %v", err)
-					}
-					continue
-				}
-			}
+	// Standalone terminal page for debugging without the frontend
+	router.HandleFunc("/term", handleTermPage)
+	router.HandleFunc("/term/term.js", handleTermScript)
 
-			// Regular input - write to PTY
-			if _, err := ptmx.Write(data); err != nil {
-				log.Printf("PTY write error: %v", err)
-				break
-			}
-		}
-	}
+	// Operator-only runtime toggles for debugging a live container
+	router.HandleFunc("/debug/flags", requireControlToken(handleFlags))
+	router.HandleFunc("GET /debug/boot", requireControlToken(handleBoot))
+	router.HandleFunc("POST /debug/upgrade", requireControlToken(handleUpgrade))
 
-	// Wait for command to finish
-	cmd.Wait()
-}
-
-func shaString(str string) string {
-	h := sha256.New()
-	h.Write([]byte(str))
-	hashBytes := h.Sum(nil)
-	return fmt.Sprintf("%x", hashBytes)[:10]
+	// Simple health check endpoint
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		instanceId := os.Getenv("CLOUDFLARE_DURABLE_OBJECT_ID")
+		fmt.Fprintf(w, "Terminal server ready. Instance ID: %s", instanceId)
+	})
+	return router
 }
 
 func main() {
-	loc := os.Getenv("CLOUDFLARE_LOCATION")
-
-	// Don't mount fuse in local docker
-	if loc != "" && loc != "loc01" {
-		// Get Durable Object ID to use as S3 bucket name for isolation
-		doID := os.Getenv("CLOUDFLARE_DURABLE_OBJECT_ID")
-		if doID == "" {
-			log.Fatalf("CLOUDFLARE_DURABLE_OBJECT_ID not set")
-		}
-		log.Printf("Using Durable Object ID as S3 bucket: %s", shaString(doID))
-
-		// Get S3 auth token
-		s3Token := os.Getenv("S3_AUTH_TOKEN")
-		if s3Token == "" {
-			log.Fatalf("S3_AUTH_TOKEN not set")
-		}
+	if len(os.Args) > 1 && os.Args[1] == "env" {
+		os.Exit(runEnvCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "packages" {
+		os.Exit(runPackagesCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "--self-check" {
+		os.Exit(runSelfCheckCommand(os.Args[2:]))
+	}
+	loadHandover()
+	infof("Starting server %s (built %s, %s, tigrisfs %s)", buildVersion.Commit, buildVersion.BuildTime, buildVersion.GoVersion, buildVersion.Tigrisfs)
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	activeConfig.Store(cfg)
+	boot.mark(bootConfigLoaded)
 
-		// Create mount point directory
-		if err := os.MkdirAll(dataDir, 0755); err != nil {
-			log.Fatalf("Failed to create directory: %v", err)
-		}
+	// Before anything else is started, as it may move the server's cgroup.
+	setupProcLimit()
 
-		bucket := fmt.Sprintf("s3-%s", shaString(doID))
-
-		go func() {
-			// Use Durable Object ID as the S3 bucket name for per-computer isolation
-			cmd := exec.Command("/usr/local/bin/tigrisfs",
-				"--endpoint", fmt.Sprintf("https://%s/", os.Getenv("HOST")),
-				"--debug_s3",
-				"--debug",
-				"-f",
-				bucket,
-				dataDir)
-			// Pass JWT token as AWS access key ID
-			// tigrisfs will include this in the Authorization header's Credential field
-			// Format: "AWS4-HMAC-SHA256 Credential=<jwt>/20231201/auto/s3/aws4_request, ..."
-			// Our S3 DO extracts the JWT from the Credential field
-			cmd.Env = append(os.Environ(),
-				"AWS_ACCESS_KEY_ID="+s3Token,
-				"AWS_SECRET_ACCESS_KEY=not-used", // Required by tigrisfs but ignored by S3 DO
-			)
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-
-			if err := cmd.Run(); err != nil {
-				log.Fatalf("tigrisfs failed: %v", err)
-			}
-			log.Fatalf("tigrisfs exited unexpectedly")
-		}()
+	loc := os.Getenv("CLOUDFLARE_LOCATION")
+	production := loc != "" && loc != "loc01"
+	if err := checkEnvironment(production, production || os.Getenv("LOCAL_S3") != ""); err != nil {
+		log.Fatalf("Startup checks failed:\n%v", err)
+	}
 
-		// Wait for FUSE mount to be ready before proceeding
-		log.Printf("Waiting for FUSE mount at %s...", dataDir)
-		if err := waitForMount(dataDir, 10*time.Second); err != nil {
-			log.Fatalf("Failed to wait for mount: %v", err)
+	var opts *mountOptions
+	switch {
+	case production:
+		o := productionMountOptions()
+		opts = &o
+	case os.Getenv("LOCAL_S3") != "":
+		// Outside Cloudflare (or in local docker) only mount when asked to,
+		// so the mount-plus-terminal path can be exercised without the DO.
+		o := localMountOptions(os.Getenv("LOCAL_S3"))
+		opts = &o
+	}
+	boot.mark(bootEnvValidated)
+	if opts != nil {
+		go probeUpstreamForever(*opts)
+	}
+	switch {
+	case opts == nil:
+	case inherited.MountPid != 0:
+		adoptMount(inherited.MountPid, inherited.MountLogs)
+		useBucket(*opts)
+	case inherited.Degraded != "":
+		degraded.enter(*opts, errors.New(inherited.Degraded))
+	case reuseMount(*opts):
+		useBucket(*opts)
+		instantiateTemplate(*opts)
+	default:
+		if err := mount(*opts); err != nil {
+			degraded.enter(*opts, err)
+		} else {
+			useBucket(*opts)
+			instantiateTemplate(*opts)
 		}
 	}
+	workspaceFreeze.inherit(inherited.Frozen)
+	sessions.resume(inherited.Sessions)
+	if degraded.status() == "" {
+		restoreHandoff()
+	}
+	loadWorkspace(opts)
+	sweepSessionTmp()
+	// Shells aren't warmed over local disk, which the bucket would later be
+	// mounted over under their feet.
+	if n, _ := warmPoolSize(); n > 0 && degraded.status() == "" {
+		go sessions.warm(n)
+	}
+	loadState()
+	interruptJobs()
+	loadLocks()
+	installEnvCommand()
+	go restorePackagesAtBoot()
 
 	// Listen for SIGINT and SIGTERM
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
-	router := http.NewServeMux()
+	// Re-read the config file on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig()
+		}
+	}()
 
-	// WebSocket endpoint for PTY
-	router.HandleFunc("/ws", handleWebSocket)
+	// Upgrade to the binary at the same path on SIGUSR2
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			select {
+			case upgrades <- upgradeBinary():
+			default:
+			}
+		}
+	}()
 
-	// Simple health check endpoint
-	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		instanceId := os.Getenv("CLOUDFLARE_DURABLE_OBJECT_ID")
-		fmt.Fprintf(w, "Terminal server ready. Instance ID: %s", instanceId)
-	})
+	router := newRouter()
+	go polls.reap()
+	go sweepOrphans()
+	go suspendIdleSessions()
+	go packIdleScrollback()
+	go watchResources()
+	go purgeTrashForever()
+	go writeManifestsForever()
+	go backupStateForever()
+	go abortIdleUploadsForever()
+	content.load()
+	services.sync()
+	startTimeline()
+	syncChangeEvents()
+	writes.start()
+	prefetch.start()
+
+	grpcServer, err := serveGRPC(envOr("GRPC_ADDR", ":8284"))
+	if err != nil {
+		log.Fatalf("Failed to start gRPC server: %v", err)
+	}
 
 	server := &http.Server{
-		Addr:    ":8283",
-		Handler: router,
+		Addr:      ":8283",
+		Handler:   withRequestID(withUser(router)),
+		Protocols: httpProtocols(),
+		// No WriteTimeout: WebSockets, SSE and downloads run for as long
+		// as they need; API requests get theirs from withTimeout.
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
 	}
 
+	ln, err := listen("http", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	infof("Server listening on %s", server.Addr)
+	boot.mark(bootListening)
+	go notifyReady()
 	go func() {
-		log.Printf("Server listening on %s\n", server.Addr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatal(err)
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			fatalf("Serving: %v", err)
 		}
 	}()
 
-	// Wait to receive a signal
-	sig := <-stop
-
-	log.Printf("Received signal (%s), shutting down server...", sig)
+	// Wait to receive a signal or a shutdown request, upgrading in place
+	// when asked to
+	var notice shutdownNotice
+	handoff := true
+	for notice.Reason == "" {
+		select {
+		case sig := <-stop:
+			infof("Received signal (%s), shutting down server...", sig)
+			notice, handoff = signalShutdown(sig), sig == syscall.SIGTERM
+		case notice = <-shutdowns:
+			infof("Shutdown requested (%s), shutting down server...", notice.Reason)
+		case binary := <-upgrades:
+			if err := upgrade(binary, server, grpcServer); err != nil {
+				errorf("Upgrade to %s failed: %v", binary, err)
+			}
+		}
+	}
+	shutdownNotices.announce(notice)
+
+	// SIGTERM is how the container is stopped to be replaced, and a
+	// shutdown request how it is put to sleep: its successor recreates
+	// the sessions if it starts soon enough.
+	if handoff && len(sessions.list()) > 0 && bucketStore.Load() != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), handoffTimeout)
+		if _, err := exportHandoff(ctx); err != nil {
+			warnf("Handing off sessions: %v", err)
+		}
+		cancel()
+	}
 
 	// Give the server 5 seconds to shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal(err)
+		fatalf("Shutting down: %v", err)
+	}
+	grpcServer.Stop()
+	ide.shutdown()
+	services.shutdown()
+
+	// The last manifest is marked clean, so one that isn't tells whoever
+	// reads it after the container is gone that it died.
+	if bucketStore.Load() != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), handoffTimeout)
+		if _, err := writeManifest(ctx, true); err != nil {
+			warnf("Writing the workspace manifest: %v", err)
+		}
+		if err := state.backup(ctx); err != nil {
+			warnf("Backing up the state database: %v", err)
+		}
+		cancel()
 	}
 
-	log.Println("Server shutdown successfully")
+	infof("Server shutdown successfully")
 }
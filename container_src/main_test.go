@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"server/container_src/client"
+)
+
+// testURL is the server under test, serving newRouter with dataDir in a
+// temporary directory.
+var testURL string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "dos3-data-")
+	if err != nil {
+		panic(err)
+	}
+	dataDir = dir
+	writes.dir = filepath.Join(dir, ".journal")
+	// A plain shell with a fixed prompt keeps session output predictable.
+	os.Setenv("SHELL", "/bin/sh")
+	os.Setenv("PS1", "$ ")
+
+	srv := httptest.NewUnstartedServer(withRequestID(withUser(newRouter())))
+	srv.Config.Protocols = httpProtocols()
+	srv.Start()
+	testURL = srv.URL
+	code := m.Run()
+	srv.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func dialTest(t *testing.T) *client.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := client.Dial(ctx, testURL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	return c
+}
+
+func isStatus(err error, code int) bool {
+	var e *client.Error
+	return errors.As(err, &e) && e.StatusCode == code
+}
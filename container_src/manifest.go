@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// manifestKey is where the workspace manifest is kept in the bucket.
+	manifestKey = ".workspace-manifest.json"
+	// maxManifestFiles bounds the files a manifest lists.
+	maxManifestFiles = 100000
+	// manifestTimeout bounds writing one.
+	manifestTimeout = time.Minute
+)
+
+var manifestsWritten = newCounter("dos3_manifests_written_total",
+	"Workspace manifests written to the bucket, by outcome.")
+
+// lastManifest is when this server last wrote the manifest.
+var lastManifest atomic.Pointer[time.Time]
+
+// workspaceManifest lists the workspace's files as the bucket has them,
+// written straight to the bucket every manifest_interval and at shutdown.
+// After the container dies, the Durable Object or frontend can read it to
+// show the workspace without mounting it, and to tell which files may have
+// been cut short.
+type workspaceManifest struct {
+	Written    time.Time `json:"written"`
+	InstanceID string    `json:"instance_id,omitempty"`
+	// Clean is set on the manifest written as the server shut down; one
+	// without it was followed by a crash or kill if it is the last.
+	Clean bool `json:"clean"`
+	// Durability is the mount's state as in /v1/durability.
+	Durability string `json:"durability"`
+	// PendingWrites are file API writes queued for the mount, which the
+	// bucket doesn't have at all.
+	PendingWrites int            `json:"pending_writes"`
+	Files         []manifestFile `json:"files"`
+	// Truncated is set when there were more than 100000 files to list.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// manifestFile is a file as the bucket has it.
+type manifestFile struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	ETag     string    `json:"etag"`
+	Modified time.Time `json:"modified"`
+	// State is "saved", "unsaved" if the mount has changes to it the
+	// bucket may not (so what the bucket has may be partly written), or
+	// "deleted" if it is gone from the mount but not yet from the bucket.
+	State string `json:"state"`
+}
+
+// manifestResult is the response to POST /v1/manifest.
+type manifestResult struct {
+	Key     string    `json:"key"`
+	Written time.Time `json:"written"`
+	Files   int       `json:"files"`
+	Unsaved int       `json:"unsaved"`
+}
+
+// writeManifest lists the bucket, checks each file against the mount and
+// writes the manifest. clean marks it as written at shutdown.
+func writeManifest(ctx context.Context, clean bool) (manifestResult, error) {
+	store := bucketStore.Load()
+	if store == nil {
+		return manifestResult{}, errNoBucket
+	}
+	objs, err := store.ListObjects(ctx, "")
+	if err != nil {
+		return manifestResult{}, fmt.Errorf("listing the bucket: %w", err)
+	}
+	durable, _ := durability.status()
+	m := workspaceManifest{
+		Written:       time.Now().UTC(),
+		InstanceID:    os.Getenv("CLOUDFLARE_DURABLE_OBJECT_ID"),
+		Clean:         clean,
+		Durability:    durable.State,
+		PendingWrites: durable.PendingWrites,
+		Files:         []manifestFile{},
+	}
+	for _, o := range objs {
+		if strings.HasSuffix(o.Key, "/") || o.Key == manifestKey || o.Key == stateBackupKey ||
+			strings.HasPrefix(o.Key, handoffPrefix) || strings.HasPrefix(o.Key, trashDirName+"/") {
+			continue
+		}
+		if len(m.Files) == maxManifestFiles {
+			m.Truncated = true
+			break
+		}
+		m.Files = append(m.Files, manifestFile{
+			Path:     o.Key,
+			Size:     o.Size,
+			ETag:     strings.Trim(o.ETag, `"`),
+			Modified: o.LastModified.UTC(),
+			State:    "saved",
+		})
+	}
+	if mountReady.Load() {
+		if _, err := fsCall(ctx, func() (struct{}, error) { return struct{}{}, checkManifest(m.Files) }); err != nil {
+			return manifestResult{}, fmt.Errorf("checking files against the mount: %w", err)
+		}
+	}
+	res := manifestResult{Key: manifestKey, Written: m.Written, Files: len(m.Files)}
+	for _, f := range m.Files {
+		if f.State != "saved" {
+			res.Unsaved++
+		}
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return manifestResult{}, err
+	}
+	if err := store.PutObject(ctx, manifestKey, bytes.NewReader(data), "application/json"); err != nil {
+		return manifestResult{}, fmt.Errorf("writing %s: %w", manifestKey, err)
+	}
+	lastManifest.Store(&m.Written)
+	debugf("Wrote the workspace manifest: %d files, %d unsaved", res.Files, res.Unsaved)
+	return res, nil
+}
+
+// checkManifest marks the files the mount has changed since the bucket
+// last caught up, or removed.
+func checkManifest(files []manifestFile) error {
+	for i := range files {
+		f := &files[i]
+		fi, err := os.Stat(filepath.Join(dataDir, filepath.FromSlash(f.Path)))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			f.State = "deleted"
+		case err != nil:
+			return err
+		case fi.Size() != f.Size || durability.unsaved(fi.ModTime()):
+			f.State = "unsaved"
+		}
+	}
+	return nil
+}
+
+// writeManifestsForever writes the manifest every manifest_interval while a
+// bucket is mounted.
+func writeManifestsForever() {
+	for {
+		interval := currentConfig().ManifestInterval.Duration
+		if interval <= 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(interval)
+		if currentConfig().ManifestInterval.Duration <= 0 || bucketStore.Load() == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), manifestTimeout)
+		_, err := writeManifest(ctx, false)
+		cancel()
+		if err != nil {
+			manifestsWritten.add(1, "outcome", "error")
+			warnf("Writing the workspace manifest: %v", err)
+			continue
+		}
+		manifestsWritten.add(1, "outcome", "ok")
+	}
+}
+
+func handleWriteManifest(w http.ResponseWriter, r *http.Request) {
+	res, err := writeManifest(r.Context(), false)
+	if err != nil {
+		manifestsWritten.add(1, "outcome", "error")
+		writeError(w, r, err)
+		return
+	}
+	manifestsWritten.add(1, "outcome", "ok")
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"server/container_src/internal/s3test"
+)
+
+func TestWorkspaceManifest(t *testing.T) {
+	t.Cleanup(func() { bucketStore.Store(nil) })
+	store := s3test.NewServer(t).Client(t, "s3-test")
+	ctx := context.Background()
+	store.CreateBucket(ctx)
+	bucketStore.Store(store)
+	mountReady.Store(true)
+	t.Cleanup(func() { mountReady.Store(false) })
+	for key, body := range map[string]string{
+		"manifest/saved.txt": "abc", "manifest/cut.txt": "abc", "manifest/gone.txt": "abc",
+		".trash/old": "x", handoffPrefix + "state.json": "{}",
+	} {
+		if err := store.PutObject(ctx, key, strings.NewReader(body), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := filepath.Join(dataDir, "manifest")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// cut.txt is larger on the mount than in the bucket, as if the upload
+	// of it hadn't finished.
+	for name, body := range map[string]string{"saved.txt": "abc", "cut.txt": "abcdef"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := http.Post(testURL+"/v1/manifest", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res manifestResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || res.Key != manifestKey {
+		t.Fatalf("POST /v1/manifest: %d %+v", resp.StatusCode, res)
+	}
+
+	// The manifest is read straight from the bucket, as it would be with
+	// the container gone.
+	body, err := store.GetObject(ctx, manifestKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	var m workspaceManifest
+	if err := json.NewDecoder(body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	states := map[string]string{}
+	for _, f := range m.Files {
+		if strings.HasPrefix(f.Path, ".trash/") || strings.HasPrefix(f.Path, handoffPrefix) || f.Path == manifestKey {
+			t.Errorf("manifest lists %s", f.Path)
+		}
+		if f.ETag == "" || f.Size != 3 {
+			t.Errorf("%s: size %d, etag %q", f.Path, f.Size, f.ETag)
+		}
+		states[f.Path] = f.State
+	}
+	want := map[string]string{"manifest/saved.txt": "saved", "manifest/cut.txt": "unsaved", "manifest/gone.txt": "deleted"}
+	if !maps.Equal(states, want) {
+		t.Errorf("states %v, want %v", states, want)
+	}
+	if m.Clean || res.Files != 3 || res.Unsaved != 2 {
+		t.Errorf("manifest clean=%v, result %+v", m.Clean, res)
+	}
+
+	if _, err := writeManifest(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	body, err = store.GetObject(ctx, manifestKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(&m); err != nil || !m.Clean {
+		t.Errorf("shutdown manifest clean=%v, err %v", m.Clean, err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is a counter or gauge served at /v1/metrics in the Prometheus text
+// format. Values are keyed by their label set, so one metric can be split by
+// label without declaring the values up front.
+type metric struct {
+	name, help, kind string
+
+	mu     sync.Mutex
+	values map[string]float64
+	// value, if set, computes an unlabelled gauge at scrape time.
+	value func() float64
+}
+
+var metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+func registerMetric(m *metric) *metric {
+	metricsRegistry.mu.Lock()
+	defer metricsRegistry.mu.Unlock()
+	metricsRegistry.metrics = append(metricsRegistry.metrics, m)
+	return m
+}
+
+// newCounter registers a monotonically increasing metric.
+func newCounter(name, help string) *metric {
+	return registerMetric(&metric{name: name, help: help, kind: "counter", values: make(map[string]float64)})
+}
+
+// newGauge registers a metric that can go up and down.
+func newGauge(name, help string) *metric {
+	return registerMetric(&metric{name: name, help: help, kind: "gauge", values: make(map[string]float64)})
+}
+
+// newGaugeFunc registers a gauge read from fn on every scrape.
+func newGaugeFunc(name, help string, fn func() float64) *metric {
+	return registerMetric(&metric{name: name, help: help, kind: "gauge", value: fn})
+}
+
+// add adds v to the value for labels, given as alternating names and values.
+func (m *metric) add(v float64, labels ...string) {
+	key := labelKey(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] += v
+}
+
+// set replaces the value for labels.
+func (m *metric) set(v float64, labels ...string) {
+	key := labelKey(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = v
+}
+
+// get returns the value for labels.
+func (m *metric) get(labels ...string) float64 {
+	key := labelKey(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[key]
+}
+
+func labelKey(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%s", labels[i], strconv.Quote(labels[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (m *metric) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.value != nil {
+		fmt.Fprintf(w, "%s %s\n", m.name, formatMetric(m.value()))
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, k, formatMetric(m.values[k]))
+	}
+}
+
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// handleMetrics serves every registered metric: GET /v1/metrics.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsRegistry.mu.Lock()
+	ms := slices.Clone(metricsRegistry.metrics)
+	metricsRegistry.mu.Unlock()
+	slices.SortFunc(ms, func(a, b *metric) int { return strings.Compare(a.name, b.name) })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range ms {
+		m.writeTo(w)
+	}
+}
+
+var _ = newGaugeFunc("dos3_sessions", "Live terminal sessions.", func() float64 {
+	return float64(len(sessions.list()))
+})
+
+// Sessions' lifetimes, counted from the event bus as they end.
+var (
+	sessionsEnded = newCounter("dos3_sessions_ended_total",
+		"Terminal sessions that have ended.")
+	sessionSeconds = newCounter("dos3_session_seconds_total",
+		"The lifetimes of the terminal sessions that have ended, in seconds.")
+	_ = events.subscribe("session_metrics", func(e event) {
+		sessionsEnded.add(1)
+		sessionSeconds.add(e.Time.Sub(e.Session.created).Seconds())
+	}, eventSessionEnded)
+)
+
+// drop removes the values whose label name is value.
+func (m *metric) drop(name, value string) {
+	match := name + "=" + strconv.Quote(value)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range m.values {
+		if strings.Contains(k, "{"+match+",") || strings.Contains(k, ","+match+",") ||
+			strings.Contains(k, "{"+match+"}") || strings.Contains(k, ","+match+"}") {
+			delete(m.values, k)
+		}
+	}
+}
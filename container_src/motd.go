@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// motdFileName is the template, at the root of /data or of a user's
+	// namespace, that new sessions' message of the day is rendered from.
+	motdFileName = ".motd"
+	// maxMOTDTemplate and maxMOTD bound the template and what it renders.
+	maxMOTDTemplate = 64 << 10
+	maxMOTD         = 4 << 10
+)
+
+var errInvalidMOTD = errors.New("invalid message of the day")
+
+// defaultMOTD is the message of the day without a .motd template.
+const defaultMOTD = `{{if .Mounted}}/data is saved to the bucket ({{.Durability}}{{with .LastSaved}}, caught up {{ago .}}{{end}}){{else}}/data is on local disk{{end}}
+{{- with .LastManifest}}; manifest written {{ago .}}{{end}}.
+{{- with .Resources}}
+Disk {{.DiskPercent}}% used ({{.DiskUsed}} of {{.DiskTotal}}), memory {{.MemoryPercent}}%
+{{- end}}
+Tip: {{.Tip}}
+`
+
+// motdTips are shown by the default message, one picked at random.
+var motdTips = []string{
+	"dos3-env set NAME keeps an exported variable for every new terminal.",
+	"dos3-packages save keeps the apt, pip and npm packages you installed when the container is replaced.",
+	"Files outside /data are lost when the container is replaced.",
+	"Write your own message of the day in /data/" + motdFileName + ", a Go text/template.",
+	"Share this terminal, read-only or not, with POST /v1/sessions/{id}/shares.",
+}
+
+// motdData is what a .motd template is rendered with.
+type motdData struct {
+	// User is the session's user, "" unless it is scoped to one.
+	User string
+	// Mounted is set when /data is the bucket. Degraded says why it isn't,
+	// if it should be.
+	Mounted  bool
+	Degraded string
+	// Durability is saved, saving or local, as in /v1/durability.
+	Durability    string
+	PendingWrites int
+	// LastSaved is when the bucket last caught up with the mount, and
+	// LastManifest when the workspace manifest was last written; nil if
+	// not since the server started.
+	LastSaved    *time.Time
+	LastManifest *time.Time
+	Sessions     int
+	// Resources is the container's resource use, nil before it is measured.
+	Resources *motdResources
+	Tip       string
+}
+
+type motdResources struct {
+	DiskPercent, MemoryPercent float64
+	DiskUsed, DiskTotal        string
+	MemoryUsed, MemoryLimit    string
+}
+
+var motdFuncs = template.FuncMap{
+	// ago is how long before now t was, roughly.
+	"ago": func(t time.Time) string {
+		d := time.Since(t)
+		switch {
+		case d < time.Minute:
+			return "just now"
+		case d < time.Hour:
+			return fmt.Sprintf("%dm ago", int(d.Minutes()))
+		case d < 48*time.Hour:
+			return fmt.Sprintf("%dh ago", int(d.Hours()))
+		}
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	},
+}
+
+// currentMOTDData gathers the server's state for user's message.
+func currentMOTDData(user string) motdData {
+	durable, _ := durability.status()
+	d := motdData{
+		User:          user,
+		Mounted:       mountReady.Load(),
+		Degraded:      degraded.status(),
+		Durability:    durable.State,
+		PendingWrites: durable.PendingWrites,
+		LastSaved:     durable.LastSaved,
+		LastManifest:  lastManifest.Load(),
+		Sessions:      len(sessions.list()),
+		Tip:           motdTips[rand.IntN(len(motdTips))],
+	}
+	if u := currentResources(); u != nil {
+		d.Resources = &motdResources{
+			DiskPercent:   u.percent("disk"),
+			MemoryPercent: u.percent("memory"),
+			DiskUsed:      formatSize(u.DiskBytes),
+			DiskTotal:     formatSize(u.DiskTotalBytes),
+			MemoryUsed:    formatSize(u.MemoryBytes),
+			MemoryLimit:   formatSize(u.MemoryLimitBytes),
+		}
+	}
+	return d
+}
+
+// readMOTDTemplate returns user's .motd, or the root's, or the default.
+func readMOTDTemplate(user string) (name, text string, err error) {
+	paths := []string{filepath.Join(dataDir, motdFileName)}
+	if user != "" {
+		paths = append([]string{filepath.Join(userRoot(user), motdFileName)}, paths...)
+	}
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", "", err
+		}
+		data, err := io.ReadAll(io.LimitReader(f, maxMOTDTemplate+1))
+		f.Close()
+		if err != nil {
+			return "", "", err
+		}
+		if len(data) > maxMOTDTemplate {
+			return "", "", fmt.Errorf("%s is over %d bytes", relPath(p), maxMOTDTemplate)
+		}
+		return relPath(p), string(data), nil
+	}
+	return "default", defaultMOTD, nil
+}
+
+// renderMOTD renders user's message of the day. A template that fails
+// gives the default message, with the error.
+func renderMOTD(user string) (string, error) {
+	name, text, err := readMOTDTemplate(user)
+	if err == nil {
+		var out string
+		if out, err = executeMOTD(name, text, currentMOTDData(user)); err == nil {
+			return out, nil
+		}
+	}
+	out, _ := executeMOTD("default", defaultMOTD, currentMOTDData(user))
+	return out, err
+}
+
+func executeMOTD(name, text string, data motdData) (string, error) {
+	tmpl, err := template.New(name).Funcs(motdFuncs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidMOTD, err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidMOTD, err)
+	}
+	out := strings.TrimRight(b.String(), "\n")
+	if len(out) > maxMOTD {
+		out = strings.ToValidUTF8(out[:maxMOTD], "")
+	}
+	return out, nil
+}
+
+// showMOTD writes the message of the day to a new session's terminal,
+// ahead of its shell's prompt.
+func (s *session) showMOTD() {
+	if !currentConfig().MOTD {
+		return
+	}
+	msg, err := renderMOTD(s.user)
+	if err != nil {
+		warnf("Message of the day for session %s: %v", s.id, err)
+	}
+	if msg == "" {
+		return
+	}
+	text := "\x1b[2m" + strings.ReplaceAll(strings.ReplaceAll(msg, "\r\n", "\n"), "\n", "\r\n") + "\x1b[0m\r\n"
+	s.output.append([]byte(text))
+	s.transcript.write([]byte(text))
+}
+
+// handleMOTD renders the message of the day new sessions of the requester
+// are shown, to try out a .motd template.
+func handleMOTD(w http.ResponseWriter, r *http.Request) {
+	msg, err := fsCall(r.Context(), func() (string, error) { return renderMOTD(userFromContext(r.Context())) })
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, msg+"\n")
+}
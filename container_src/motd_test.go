@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMOTD(t *testing.T) {
+	motd := filepath.Join(dataDir, motdFileName)
+	defer os.Remove(motd)
+	os.WriteFile(motd, []byte("Hello{{with .User}} {{.}}{{end}}: {{if .Mounted}}bucket{{else}}local disk{{end}}, {{.Durability}}\n\n"), 0644)
+
+	resp, err := http.Get(testURL + "/v1/motd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "Hello: local disk, local\n" {
+		t.Errorf("GET /v1/motd = %q", body)
+	}
+
+	// New sessions show it before anything from the shell.
+	output := func() string {
+		t.Helper()
+		sess, err := sessions.start(80, 24, sessionMeta{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.close()
+		data, _, _ := sess.output.read(0, scrollbackLimit)
+		return string(data)
+	}
+	if out := output(); !strings.HasPrefix(out, "\x1b[2mHello: local disk, local\x1b[0m\r\n") {
+		t.Errorf("session output starts %q", out)
+	}
+
+	// A broken template is refused by the API, and sessions get the default.
+	os.WriteFile(motd, []byte("{{.Nope}}"), 0644)
+	resp, err = http.Get(testURL + "/v1/motd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("broken template: %s", resp.Status)
+	}
+	if out := output(); !strings.Contains(out, "/data is on local disk") || !strings.Contains(out, "Tip: ") {
+		t.Errorf("default message: %q", out)
+	}
+
+	cfg := *currentConfig()
+	cfg.MOTD = false
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	if out := output(); strings.Contains(out, "Tip: ") {
+		t.Errorf("motd off: %q", out)
+	}
+}
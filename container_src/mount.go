@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"server/container_src/internal/fakes3"
+	"server/container_src/internal/s3client"
+)
+
+// mountOptions describes the S3 endpoint and bucket that tigrisfs mounts at
+// dataDir.
+type mountOptions struct {
+	endpoint string
+	bucket   string
+	// prefix is the part of the bucket mounted, "" for all of it (see
+	// tenant.go).
+	prefix          string
+	accessKeyID     string
+	secretAccessKey string
+	// fuseStats has tigrisfs log every FUSE operation, for the cache
+	// statistics (see mountstats.go).
+	fuseStats bool
+}
+
+// s3Client returns a client for direct access to the mounted bucket.
+func (o mountOptions) s3Client() (*s3client.Client, error) {
+	c, err := s3client.New(o.endpoint, o.bucket, o.accessKeyID, o.secretAccessKey)
+	if err != nil {
+		return nil, err
+	}
+	c.Region = os.Getenv("AWS_REGION")
+	c.Prefix = o.prefix
+	return c, nil
+}
+
+// mountReady is set once the FUSE mount at dataDir is up. It stays false when
+// running without a mount.
+var mountReady atomic.Bool
+
+// fuseSuperMagic is the filesystem type statfs reports for FUSE mounts.
+const fuseSuperMagic = 0x65735546
+
+// waitForMount polls until the directory is a FUSE mount (not a regular directory)
+func waitForMount(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(path, &stat); err == nil {
+			// Check if it's a FUSE filesystem
+			if stat.Type == fuseSuperMagic {
+				infof("Mount at %s is ready (FUSE detected)", path)
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for FUSE mount at %s", path)
+		}
+	}
+	return fmt.Errorf("ticker closed unexpectedly")
+}
+
+const (
+	// bucketCheckAttempts is how many times checkBucket tries an endpoint
+	// that is unreachable or erroring, which it may briefly be at boot.
+	bucketCheckAttempts = 4
+	bucketCheckTimeout  = 10 * time.Second
+)
+
+// bucketCheckBackoff is the wait after the first failed attempt, doubling
+// after each one. Tests shorten it.
+var bucketCheckBackoff = time.Second
+
+// checkBucket makes sure opts' bucket can be mounted before tigrisfs is
+// started, creating it if it doesn't exist. Otherwise a bad token or an
+// unreachable endpoint only shows up as a mount timeout; the error says which
+// it was.
+func checkBucket(opts mountOptions) error {
+	c, err := opts.s3Client()
+	if err != nil {
+		return err
+	}
+	backoff := bucketCheckBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), bucketCheckTimeout)
+		err = c.HeadBucket(ctx)
+		if s3client.IsNotFound(err) {
+			infof("Bucket %s does not exist, creating it", opts.bucket)
+			err = c.CreateBucket(ctx)
+		}
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		var se *s3client.Error
+		isS3 := errors.As(err, &se)
+		switch {
+		case isS3 && (se.StatusCode == http.StatusUnauthorized || se.StatusCode == http.StatusForbidden):
+			return fmt.Errorf("S3 endpoint %s rejected the credentials for bucket %s (%d %s); check S3_AUTH_TOKEN",
+				opts.endpoint, opts.bucket, se.StatusCode, se.Code)
+		case isS3 && se.StatusCode < 500:
+			return fmt.Errorf("bucket %s at %s: %w", opts.bucket, opts.endpoint, err)
+		}
+		if attempt == bucketCheckAttempts {
+			if isS3 {
+				return fmt.Errorf("S3 endpoint %s is failing (%d attempts): %w", opts.endpoint, attempt, err)
+			}
+			return fmt.Errorf("S3 endpoint %s is unreachable (%d attempts): %w", opts.endpoint, attempt, err)
+		}
+		warnf("Checking bucket %s at %s: %v; retrying in %s", opts.bucket, opts.endpoint, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// tigrisfsPath is the tigrisfs binary installed in the image.
+const tigrisfsPath = "/usr/local/bin/tigrisfs"
+
+// fuseStatsArg is the tigrisfs option mountOptions.fuseStats adds.
+const fuseStatsArg = "--debug_fuse"
+
+// command returns the tigrisfs command mounting opts at dir in the
+// foreground.
+func (o mountOptions) command(dir string) *exec.Cmd {
+	args := []string{"--endpoint", o.endpoint, "--debug_s3"}
+	if o.fuseStats {
+		args = append(args, fuseStatsArg)
+	}
+	args = append(args, "--debug", "-f", o.source(), dir)
+	cmd := exec.Command(tigrisfsPath, args...)
+	cmd.Env = append(os.Environ(),
+		"AWS_ACCESS_KEY_ID="+o.accessKeyID,
+		"AWS_SECRET_ACCESS_KEY="+o.secretAccessKey,
+	)
+	return cmd
+}
+
+// source names what tigrisfs mounts: the bucket, or bucket:prefix.
+func (o mountOptions) source() string {
+	if o.prefix == "" {
+		return o.bucket
+	}
+	return o.bucket + ":" + strings.TrimSuffix(o.prefix, "/")
+}
+
+// mount checks opts' bucket, starts tigrisfs for it in the background and
+// waits until the FUSE mount at dataDir is ready. Failing to get that far is
+// returned, leaving dataDir a plain directory; once mounted, tigrisfs exiting
+// is fatal.
+func mount(opts mountOptions) error {
+	// Create mount point directory
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		log.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := checkBucket(opts); err != nil {
+		return fmt.Errorf("cannot mount bucket: %w", err)
+	}
+	boot.mark(bootBucketChecked)
+
+	opts.fuseStats = currentConfig().MountStats
+	cmd := opts.command(dataDir)
+	var logs []*os.File
+	for _, out := range []*io.Writer{&cmd.Stdout, &cmd.Stderr} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return fmt.Errorf("starting tigrisfs: %w", err)
+		}
+		defer w.Close()
+		*out = w
+		logs = append(logs, r)
+	}
+	if err := cmd.Start(); err != nil {
+		for _, r := range logs {
+			r.Close()
+		}
+		return fmt.Errorf("starting tigrisfs: %w", err)
+	}
+	forwardMountLogs(logs)
+	setMountPid(cmd.Process.Pid)
+	boot.mark(bootMountStarted)
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// Wait for FUSE mount to be ready before proceeding
+	infof("Waiting for FUSE mount at %s...", dataDir)
+	ready := make(chan error, 1)
+	go func() { ready <- waitForMount(dataDir, 10*time.Second) }()
+	select {
+	case err := <-exited:
+		mountPid.Store(0)
+		return fmt.Errorf("tigrisfs exited before mounting: %v", err)
+	case err := <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			<-exited
+			mountPid.Store(0)
+			return err
+		}
+	}
+	go func() {
+		err := <-exited
+		log.Fatalf("tigrisfs exited unexpectedly: %v", err)
+	}()
+	mountReady.Store(true)
+	durability.notify()
+	boot.mark(bootMountReady)
+	events.publish(event{Kind: eventMountReady})
+	return nil
+}
+
+// mountLogs are the read ends of tigrisfs's stdout and stderr. They are the
+// server's own pipes rather than ones exec.Cmd copies from, so that they can
+// be handed over in a binary upgrade: tigrisfs dies of SIGPIPE if they close.
+var mountLogs []*os.File
+
+// forwardMountLogs copies tigrisfs's stdout and stderr from logs to the
+// server's through mountLogWriter.
+func forwardMountLogs(logs []*os.File) {
+	mountLogs = logs
+	for i, r := range logs {
+		w := &mountLogWriter{w: os.Stdout}
+		if i == 1 {
+			w.w = os.Stderr
+		}
+		go io.Copy(w, r)
+	}
+}
+
+// adoptMount takes over the tigrisfs process pid, started by the server
+// before a binary upgrade, with its mount at dataDir already up.
+func adoptMount(pid int, logFDs []int) {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		log.Fatalf("tigrisfs (pid %d) not found after upgrade: %v", pid, err)
+	}
+	var logs []*os.File
+	for _, fd := range logFDs {
+		logs = append(logs, os.NewFile(uintptr(fd), "tigrisfs output"))
+	}
+	forwardMountLogs(logs)
+	setMountPid(pid)
+	if len(logs) == 0 {
+		// A mount the server found running rather than started (see
+		// reuseMount): tigrisfs isn't its child, and its output goes
+		// elsewhere.
+		go watchMountProcess(pid)
+	} else {
+		go func() {
+			st, err := p.Wait()
+			log.Fatalf("tigrisfs exited unexpectedly: %v %v", st, err)
+		}()
+	}
+	mountReady.Store(true)
+	infof("Kept the mount at %s (tigrisfs pid %d)", dataDir, pid)
+	events.publish(event{Kind: eventMountReady})
+}
+
+// mountCheckTimeout bounds the statfs reuseMount makes of a mount it finds.
+// A FUSE call blocks for as long as the process serving it does, so one
+// that hasn't answered by then is taken as hung.
+const mountCheckTimeout = 2 * time.Second
+
+// reuseMount takes over a healthy mount of opts at dataDir that a tigrisfs
+// the server didn't start is serving, such as one left running when the
+// server restarted, instead of mounting the bucket again. It reports
+// whether it did; a mount that isn't answering is left to mount to fail on.
+func reuseMount(opts mountOptions) bool {
+	pid := opts.findMountProcess("/proc", dataDir)
+	if pid == 0 {
+		return false
+	}
+	if !servesFUSE(pid) || !isFUSEMount(dataDir, mountCheckTimeout) {
+		warnf("Not reusing the mount at %s: tigrisfs (pid %d) is running but not serving it", dataDir, pid)
+		return false
+	}
+	setMountPid(pid)
+	go watchMountProcess(pid)
+	mountReady.Store(true)
+	durability.notify()
+	boot.mark(bootMountReady)
+	infof("Reusing the mount at %s (tigrisfs pid %d)", dataDir, pid)
+	events.publish(event{Kind: eventMountReady})
+	return true
+}
+
+// findMountProcess returns the pid of a tigrisfs process, listed under
+// procDir, mounting o at dir, or 0 if there is none. The process is
+// recognised by the command line command gives it.
+func (o mountOptions) findMountProcess(procDir, dir string) int {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return 0
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(procDir, e.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		args := strings.Split(strings.TrimSuffix(string(b), "\x00"), "\x00")
+		n := len(args)
+		if n < 4 || filepath.Base(args[0]) != filepath.Base(tigrisfsPath) ||
+			args[n-1] != dir || args[n-2] != o.source() {
+			continue
+		}
+		if i := slices.Index(args, "--endpoint"); i > 0 && i+1 < n && args[i+1] == o.endpoint {
+			return pid
+		}
+	}
+	return 0
+}
+
+// servesFUSE reports whether process pid is alive and has /dev/fuse open,
+// as the process serving a FUSE mount does.
+func servesFUSE(pid int) bool {
+	dir := fmt.Sprintf("/proc/%d/fd", pid)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if target, _ := os.Readlink(filepath.Join(dir, e.Name())); target == "/dev/fuse" {
+			return true
+		}
+	}
+	return false
+}
+
+// isFUSEMount reports whether path is a FUSE mount whose process answers a
+// statfs within timeout. One that doesn't leaves a goroutine blocked until
+// it does.
+func isFUSEMount(path string, timeout time.Duration) bool {
+	ok := make(chan bool, 1)
+	go func() {
+		var stat syscall.Statfs_t
+		ok <- syscall.Statfs(path, &stat) == nil && stat.Type == fuseSuperMagic
+	}()
+	select {
+	case v := <-ok:
+		return v
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// watchMountProcess exits the server once tigrisfs, pid, is gone, as it
+// does when the tigrisfs it started exits. The process isn't the server's
+// child, so it can't be waited for.
+func watchMountProcess(pid int) {
+	for range time.Tick(time.Second) {
+		if !servesFUSE(pid) {
+			log.Fatalf("tigrisfs (pid %d) exited unexpectedly", pid)
+		}
+	}
+}
+
+// bucketStore talks to the mounted bucket directly, bypassing the FUSE
+// mount: finished recordings are uploaded through it so a half-written cast
+// never shows up in /data, and file versions are read from it. It is nil
+// when no bucket is mounted; recordings then stay in recordingsDir.
+var bucketStore atomic.Pointer[s3client.Client]
+
+// useBucket sets up what talks to the mounted bucket directly.
+func useBucket(opts mountOptions) {
+	c, err := opts.s3Client()
+	if err != nil {
+		warnf("Recordings will not be uploaded: %v", err)
+		return
+	}
+	bucketStore.Store(c)
+}
+
+// mountLogWriter forwards tigrisfs output line by line, dropping debug lines
+// unless the verbose_mount_logging flag is on. tigrisfs always runs with
+// its S3 debug output enabled so the flag can take effect without a
+// remount, and so uploads can be counted for /v1/durability; its FUSE debug
+// output only with mount_stats.
+type mountLogWriter struct {
+	w   io.Writer
+	buf []byte
+	// uncounted leaves the lines out of the cache statistics, which are
+	// the /data mount's, for the workspace file's mounts.
+	uncounted bool
+}
+
+func (m *mountLogWriter) Write(p []byte) (int, error) {
+	m.buf = append(m.buf, p...)
+	for {
+		i := bytes.IndexByte(m.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := m.buf[:i+1]
+		if !m.uncounted {
+			observeMountLine(line)
+		}
+		if flags.enabled(flagVerboseMountLogging) || !isDebugLine(line) {
+			if _, err := m.w.Write(line); err != nil {
+				return len(p), err
+			}
+		}
+		m.buf = m.buf[i+1:]
+	}
+}
+
+func isDebugLine(line []byte) bool {
+	s := strings.ToLower(string(line))
+	return strings.Contains(s, "debug") || strings.Contains(s, " dbg ")
+}
+
+// productionMountOptions mounts the per-Durable-Object bucket served by the
+// S3 DO behind the Worker at $HOST, or the part of a bucket that a verified
+// S3_AUTH_TOKEN scopes the workspace to (see tenant.go).
+func productionMountOptions() mountOptions {
+	// Get Durable Object ID to use as S3 bucket name for isolation
+	doID := os.Getenv("CLOUDFLARE_DURABLE_OBJECT_ID")
+	if doID == "" {
+		log.Fatalf("CLOUDFLARE_DURABLE_OBJECT_ID not set")
+	}
+
+	// Get S3 auth token
+	s3Token := os.Getenv("S3_AUTH_TOKEN")
+	if s3Token == "" {
+		log.Fatalf("S3_AUTH_TOKEN not set")
+	}
+
+	// Use Durable Object ID as the S3 bucket name for per-computer isolation.
+	// The JWT is passed as the AWS access key ID: tigrisfs will include it in
+	// the Authorization header's Credential field
+	// ("AWS4-HMAC-SHA256 Credential=<jwt>/20231201/auto/s3/aws4_request, ...")
+	// and our S3 DO extracts the JWT from there.
+	opts := mountOptions{
+		endpoint:        fmt.Sprintf("https://%s/", os.Getenv("HOST")),
+		bucket:          fmt.Sprintf("s3-%s", shaString(doID)),
+		accessKeyID:     s3Token,
+		secretAccessKey: "not-used", // Required by tigrisfs but ignored by S3 DO
+	}
+	if err := opts.scope(s3Token, os.Getenv(s3TokenSecretEnv)); err != nil {
+		log.Fatalf("S3_AUTH_TOKEN: %v", err)
+	}
+	if opts.prefix != "" {
+		infof("Using S3 bucket %s, scoped to %s by the token", opts.bucket, opts.prefix)
+	} else {
+		infof("Using S3 bucket: %s", opts.bucket)
+	}
+	return opts
+}
+
+// localMountOptions configures local development mode from LOCAL_S3, which is
+// either "embedded" to serve a filesystem-backed fake S3 on LOCAL_S3_ADDR
+// (default 127.0.0.1:9000) out of LOCAL_S3_DIR, or the URL of an existing
+// S3-compatible server such as MinIO.
+func localMountOptions(mode string) mountOptions {
+	opts := mountOptions{
+		endpoint:        mode,
+		bucket:          envOr("LOCAL_S3_BUCKET", "s3-local"),
+		accessKeyID:     envOr("AWS_ACCESS_KEY_ID", "minioadmin"),
+		secretAccessKey: envOr("AWS_SECRET_ACCESS_KEY", "minioadmin"),
+	}
+	if mode != "embedded" {
+		infof("Local mode: mounting bucket %s from %s", opts.bucket, opts.endpoint)
+		return opts
+	}
+
+	dir := envOr("LOCAL_S3_DIR", filepath.Join(os.TempDir(), "do-s3"))
+	backend, err := fakes3.New(dir)
+	if err != nil {
+		log.Fatalf("Failed to open local S3 storage: %v", err)
+	}
+	addr := envOr("LOCAL_S3_ADDR", "127.0.0.1:9000")
+	ln, err := listen("local_s3", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen for local S3: %v", err)
+	}
+	go func() {
+		if err := http.Serve(ln, backend); err != nil {
+			log.Fatalf("Local S3 server failed: %v", err)
+		}
+	}()
+
+	opts.endpoint = fmt.Sprintf("http://%s/", ln.Addr())
+	infof("Local mode: serving bucket %s from %s at %s", opts.bucket, dir, opts.endpoint)
+	return opts
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
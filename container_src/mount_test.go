@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"server/container_src/internal/s3test"
+)
+
+func TestWaitForMountTimesOutWithoutFUSE(t *testing.T) {
+	err := waitForMount(t.TempDir(), 200*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("waitForMount on a plain directory = %v, want a timeout", err)
+	}
+}
+
+// TestFindMountProcess checks that a tigrisfs left running is recognised
+// by its command line, and not reused unless it is serving a mount.
+func TestFindMountProcess(t *testing.T) {
+	opts := mountOptions{endpoint: "http://s3.test", bucket: "b", prefix: "users/alice/"}
+	dir := t.TempDir()
+	cmd := &exec.Cmd{Path: "/bin/sh",
+		Args: []string{tigrisfsPath, "-c", "sleep 30; :", "sh", "--endpoint", opts.endpoint, "-f", opts.source(), dir}}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for opts.findMountProcess("/proc", dir) != cmd.Process.Pid {
+		if time.Now().After(deadline) {
+			t.Fatalf("findMountProcess didn't find pid %d", cmd.Process.Pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	other := opts
+	other.endpoint = "http://elsewhere.test"
+	if pid := other.findMountProcess("/proc", dir); pid != 0 {
+		t.Errorf("findMountProcess for another endpoint = %d, want 0", pid)
+	}
+	if pid := opts.findMountProcess("/proc", t.TempDir()); pid != 0 {
+		t.Errorf("findMountProcess for another directory = %d, want 0", pid)
+	}
+	if servesFUSE(cmd.Process.Pid) {
+		t.Error("servesFUSE is true for a process without /dev/fuse open")
+	}
+	if isFUSEMount(dir, time.Second) {
+		t.Error("isFUSEMount is true for a plain directory")
+	}
+}
+
+// TestMountFUSEStats checks that tigrisfs only logs FUSE operations with
+// mount_stats, and that a running one is recognised as doing so.
+func TestMountFUSEStats(t *testing.T) {
+	t.Cleanup(func() {
+		mountPid.Store(0)
+		mountFuseStats.Store(false)
+	})
+	for _, stats := range []bool{true, false} {
+		opts := mountOptions{endpoint: "http://s3.test", bucket: "b", fuseStats: stats}
+		args := opts.command(t.TempDir()).Args
+		cmd := &exec.Cmd{Path: "/bin/sh",
+			Args: append([]string{tigrisfsPath, "-c", "sleep 30; :", "sh"}, args[1:]...)}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		setMountPid(cmd.Process.Pid)
+		cmd.Process.Kill()
+		cmd.Wait()
+		if got := mountFuseStats.Load(); got != stats {
+			t.Errorf("fuseStats %t: running mount recognised as %t", stats, got)
+		}
+	}
+}
+
+// TestMountEmbeddedS3 mounts a bucket from the test S3 server. It needs
+// tigrisfs and /dev/fuse, as in the container image.
+func TestMountEmbeddedS3(t *testing.T) {
+	if _, err := exec.LookPath(tigrisfsPath); err != nil {
+		t.Skip("tigrisfs not installed")
+	}
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("no /dev/fuse")
+	}
+	s3 := s3test.NewServer(t)
+	opts := mountOptions{endpoint: s3.Endpoint, bucket: "s3-test", accessKeyID: "test", secretAccessKey: "test"}
+	dir := t.TempDir()
+	cmd := opts.command(dir)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		exec.Command("fusermount", "-u", dir).Run()
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	if err := waitForMount(dir, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hi\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := opts.s3Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tigrisfs uploads asynchronously once the file is closed.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		objs, err := c.ListObjects(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objs) == 1 && objs[0].Key == "hello.txt" && objs[0].Size == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bucket has %v, want hello.txt", objs)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestS3ClientAgainstTestServer(t *testing.T) {
+	s3 := s3test.NewServer(t)
+	c, err := mountOptions{endpoint: s3.Endpoint, bucket: "s3-test", accessKeyID: "test", secretAccessKey: "test"}.s3Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := c.PutObject(ctx, "recordings/a.cast", strings.NewReader("{}\n"), "application/x-asciicast"); err != nil {
+		t.Fatal(err)
+	}
+	objs, err := c.ListObjects(ctx, "recordings/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].Key != "recordings/a.cast" {
+		t.Fatalf("ListObjects = %v, want recordings/a.cast", objs)
+	}
+	if err := c.DeleteObject(ctx, "recordings/a.cast"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckBucket(t *testing.T) {
+	bucketCheckBackoff = time.Millisecond
+	t.Cleanup(func() { bucketCheckBackoff = time.Second })
+	opts := func(endpoint string) mountOptions {
+		return mountOptions{endpoint: endpoint, bucket: "s3-test", accessKeyID: "test", secretAccessKey: "test"}
+	}
+
+	if err := checkBucket(opts(s3test.NewServer(t).Endpoint)); err != nil {
+		t.Fatalf("existing bucket: %v", err)
+	}
+
+	var created bool
+	missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/s3-test":
+			created = true
+		case r.Method == http.MethodHead && !created:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer missing.Close()
+	if err := checkBucket(opts(missing.URL + "/")); err != nil || !created {
+		t.Fatalf("missing bucket: err %v, created %t", err, created)
+	}
+
+	denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer denied.Close()
+	if err := checkBucket(opts(denied.URL + "/")); err == nil || !strings.Contains(err.Error(), "rejected the credentials") {
+		t.Fatalf("forbidden: %v, want a credentials error", err)
+	}
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	if err := checkBucket(opts(down.URL + "/")); err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Fatalf("endpoint down: %v, want unreachable", err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// The mount's cache is inferred from tigrisfs's debug output (see
+// mountLogWriter): every S3 request it makes and, with mount_stats, every
+// FUSE operation it serves. An operation that needed no request was a cache
+// hit. The kernel's own caches answer some operations before they reach
+// tigrisfs, so these are hits in tigrisfs's cache only. Logging each FUSE
+// operation costs tigrisfs time on every access, hence the setting.
+var (
+	mountFuseOps = newCounter("dos3_mount_fuse_ops_total",
+		"FUSE operations served by tigrisfs, by kind (metadata or data).")
+	mountS3Requests = newCounter("dos3_mount_s3_requests_total",
+		"S3 requests made by tigrisfs, by kind (metadata, data or write).")
+	_ = newGaugeFunc("dos3_mount_memory_bytes",
+		"Resident memory of tigrisfs, most of which is its cache.",
+		func() float64 { return float64(mountMemory()) })
+)
+
+var (
+	// fuseOpLine matches jacobsa/fuse debug lines: `<- LookUpInode (parent 1, name "x")`.
+	fuseOpLine = regexp.MustCompile(`<- (\w+)`)
+	// s3RequestLine matches the AWS SDK's request debug lines ("Request
+	// s3/HeadObject") and tigrisfs's own ("HEAD https://... = 200").
+	s3RequestLine = regexp.MustCompile(`Request s3/(\w+)|\b(GET|HEAD|PUT|POST|DELETE) (https?://\S+)`)
+)
+
+// mountPid is tigrisfs's pid once it has started.
+var mountPid atomic.Int64
+
+// mountFuseStats is whether the running tigrisfs logs FUSE operations,
+// which one adopted across an upgrade or restart may do whatever the
+// current config says.
+var mountFuseStats atomic.Bool
+
+// setMountPid records pid as the tigrisfs serving dataDir.
+func setMountPid(pid int) {
+	b, _ := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	mountFuseStats.Store(slices.Contains(strings.Split(string(b), "\x00"), fuseStatsArg))
+	mountPid.Store(int64(pid))
+}
+
+// observeMountLine counts the FUSE operation or S3 request a tigrisfs log
+// line records, if any.
+func observeMountLine(line []byte) {
+	if m := fuseOpLine.FindSubmatch(line); m != nil {
+		switch string(m[1]) {
+		case "LookUpInode", "GetInodeAttributes", "OpenDir", "ReadDir", "ReadDirPlus":
+			mountFuseOps.add(1, "kind", "metadata")
+		case "ReadFile":
+			mountFuseOps.add(1, "kind", "data")
+		default:
+			observeMountWrite(string(m[1]), line)
+		}
+		return
+	}
+	m := s3RequestLine.FindSubmatch(line)
+	if m == nil {
+		return
+	}
+	kind := s3RequestKind(string(m[1]), string(m[2]), m[3])
+	mountS3Requests.add(1, "kind", kind)
+	if kind == "write" {
+		if !mountFuseStats.Load() {
+			// No FUSE operations to see the change itself by: the
+			// upload is the first the tracker hears of it.
+			durability.wrote(0)
+		}
+		durability.uploaded()
+	}
+}
+
+func s3RequestKind(op, method string, url []byte) string {
+	switch op {
+	case "HeadObject", "ListObjects", "ListObjectsV2", "HeadBucket":
+		return "metadata"
+	case "GetObject":
+		return "data"
+	case "":
+	default:
+		return "write"
+	}
+	switch method {
+	case "HEAD":
+		return "metadata"
+	case "GET":
+		if bytes.Contains(url, []byte("list-type=")) || bytes.Contains(url, []byte("prefix=")) {
+			return "metadata"
+		}
+		return "data"
+	}
+	return "write"
+}
+
+// mountMemory is tigrisfs's resident set size, or 0 without a mount.
+func mountMemory() int64 {
+	pid := mountPid.Load()
+	if pid == 0 {
+		return 0
+	}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if rest, ok := bytes.CutPrefix(sc.Bytes(), []byte("VmRSS:")); ok {
+			kb, _ := strconv.ParseInt(string(bytes.TrimSuffix(bytes.TrimSpace(rest), []byte(" kB"))), 10, 64)
+			return kb << 10
+		}
+	}
+	return 0
+}
+
+type cacheKindStats struct {
+	Operations int64 `json:"operations"`
+	Requests   int64 `json:"requests"`
+	// HitRatio is the share of operations served without an S3 request,
+	// or null before any.
+	HitRatio *float64 `json:"hit_ratio"`
+}
+
+type cacheStats struct {
+	Mounted bool `json:"mounted"`
+	// FUSEStats is whether tigrisfs logs FUSE operations (mount_stats);
+	// without, operations stay at 0 and hit ratios null.
+	FUSEStats bool           `json:"fuse_stats"`
+	Metadata  cacheKindStats `json:"metadata"`
+	Data      cacheKindStats `json:"data"`
+	// Writes counts uploads and deletes, which the cache doesn't absorb.
+	Writes      int64 `json:"writes"`
+	MemoryBytes int64 `json:"memory_bytes"`
+	// Content is the server's own cache of file API downloads.
+	Content contentCacheStats `json:"content"`
+}
+
+func newCacheKindStats(kind string) cacheKindStats {
+	s := cacheKindStats{
+		Operations: int64(mountFuseOps.get("kind", kind)),
+		Requests:   int64(mountS3Requests.get("kind", kind)),
+	}
+	if s.Operations > 0 {
+		r := max(0, float64(s.Operations-s.Requests)) / float64(s.Operations)
+		s.HitRatio = &r
+	}
+	return s
+}
+
+func handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, cacheStats{
+		Mounted:     mountReady.Load(),
+		FUSEStats:   mountFuseStats.Load(),
+		Metadata:    newCacheKindStats("metadata"),
+		Data:        newCacheKindStats("data"),
+		Writes:      int64(mountS3Requests.get("kind", "write")),
+		MemoryBytes: mountMemory(),
+		Content:     content.stats(),
+	})
+}
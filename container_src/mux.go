@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"server/container_src/errcode"
+)
+
+// The multiplexed WebSocket at /ws/mux carries any number of independent
+// channels over one connection:
+//
+//   - Binary frames are channel data: a 4-byte big-endian channel ID
+//     followed by the payload, in either direction.
+//   - Text frames are JSON muxMessages that open, resize and close channels,
+//     and send control keys ("interrupt", "eof", "suspend") to terminals.
+//
+// The client picks channel IDs. It sends {"type":"open","channel":1,
+// "kind":"terminal"} and the server answers "opened" or "closed" with an
+// error; either side may close a channel, and the server always reports
+// "closed" once a channel is gone. Either side may send a "probe", answered
+// with a "probe_ack", and the server reports each round-trip measurement
+// with an "rtt" message (see rttReport), whether writes under /data are
+// saved with a "durability" message (see durabilityMessage), and why the
+// server is going away with a "shutdown" message (see shutdownNotice).
+type muxMessage struct {
+	Type    string `json:"type"`
+	Channel uint32 `json:"channel"`
+	Kind    string `json:"kind,omitempty"`
+
+	// terminal: attach to an existing session instead of starting one, or
+	// the size and labels of a new one.
+	Session string       `json:"session,omitempty"`
+	Cols    int          `json:"cols,omitempty"`
+	Rows    int          `json:"rows,omitempty"`
+	Meta    *sessionMeta `json:"meta,omitempty"`
+
+	// service: the name of the supervised service to attach to.
+	Service string `json:"service,omitempty"`
+
+	// lsp: a key of the language_servers config, and the working directory
+	// relative to /data.
+	Server string `json:"server,omitempty"`
+	Cwd    string `json:"cwd,omitempty"`
+
+	// rsync: the command rsync runs its remote end with, as it passes it to
+	// its remote shell, starting "rsync --server". Cwd applies too.
+	// exec: the command to run on a PTY, in Cwd, sized Cols by Rows, with
+	// Env added to its environment.
+	Argv []string          `json:"argv,omitempty"`
+	Env  map[string]string `json:"env,omitempty"`
+
+	// opened, for a terminal attached to an existing session: the modes
+	// its programs have set, for the client to restore.
+	Modes *terminalModes `json:"modes,omitempty"`
+
+	// probe, probe_ack: the sender's timestamp (see probeMessage).
+	T int64 `json:"t,omitempty"`
+
+	// closed: why the channel failed, and its stable code if it has one
+	// (see package errcode); for an exec channel whose command exited,
+	// its exit code instead.
+	Error    string       `json:"error,omitempty"`
+	Code     errcode.Code `json:"code,omitempty"`
+	ExitCode *int         `json:"exit_code,omitempty"`
+}
+
+// muxChannel is one open channel.
+type muxChannel interface {
+	// pump forwards the channel's output with send until it ends on its
+	// own, returning why if it failed, or until ctx is done.
+	pump(ctx context.Context, send func([]byte) error) error
+	// write delivers data the client sent on the channel.
+	write(p []byte) error
+	// resize handles a resize message; channels without a size ignore it.
+	resize(cols, rows int) error
+	// key handles a control key message; channels without a terminal
+	// ignore it.
+	key(key string) error
+	// close tears the channel down when the client closes it or leaves.
+	close()
+}
+
+// muxOpener creates a channel for an open message. It may annotate the
+// "opened" reply, e.g. with the session ID.
+type muxOpener func(msg muxMessage, reply *muxMessage) (muxChannel, error)
+
+// muxKinds are the channel types clients may open.
+var muxKinds = map[string]muxOpener{
+	"terminal": openTerminalChannel,
+	"lsp":      openLSPChannel,
+	"rsync":    openRsyncChannel,
+	"service":  openServiceChannel,
+	"exec":     openExecChannel,
+}
+
+type muxConn struct {
+	ws   *wsConn
+	link linkQuality
+
+	mu       sync.Mutex
+	channels map[uint32]muxChannel
+}
+
+func handleMux(w http.ResponseWriter, r *http.Request) {
+	raw, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		warnf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	m := &muxConn{ws: &wsConn{Conn: raw}, channels: make(map[uint32]muxChannel)}
+	defer m.ws.Close()
+	// Data frames carry at most maxWSMessage of payload.
+	m.ws.SetReadLimit(maxWSMessage + 4)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	ctx = withLinkQuality(ctx, &m.link)
+	defer m.closeAll()
+
+	m.ws.SetReadDeadline(m.link.deadline())
+	m.ws.SetPongHandler(func(payload string) error {
+		if report, ok := m.link.pong(payload); ok {
+			m.sendJSON(report)
+		}
+		m.ws.SetReadDeadline(m.link.deadline())
+		return nil
+	})
+	m.sendJSON(newHello(r))
+	go keepalive(ctx, m.ws, &m.link, func(p probeMessage) { m.sendJSON(p) })
+	go durability.follow(ctx, func(d durabilityMessage) error { return m.sendJSON(d) })
+	go announceShutdown(ctx, m.ws, func(n shutdownNotice) { m.sendJSON(n) })
+
+	for {
+		msgType, data, err := m.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure) {
+				warnf("Mux read error: %v", err)
+			}
+			return
+		}
+		m.ws.SetReadDeadline(m.link.deadline())
+		switch msgType {
+		case websocket.BinaryMessage:
+			if len(data) < 4 {
+				m.ws.protocolError("data frame shorter than its channel ID")
+				return
+			}
+			id := binary.BigEndian.Uint32(data)
+			ch := m.get(id)
+			if ch == nil {
+				continue
+			}
+			m.meter(ch, "in", len(data))
+			if err := ch.write(data[4:]); err != nil {
+				m.closeChannel(id, err)
+			}
+		case websocket.TextMessage:
+			meterTraffic("/ws/mux", trafficControl, "in", len(data))
+			var msg muxMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				m.ws.protocolError("invalid control message: " + err.Error())
+				return
+			}
+			if err := m.handleControl(ctx, msg); err != nil {
+				m.ws.protocolError(err.Error())
+				return
+			}
+		}
+	}
+}
+
+// handleControl acts on a control message. Refusing to open a channel is
+// reported on the channel; an error return is a protocol violation.
+func (m *muxConn) handleControl(ctx context.Context, msg muxMessage) error {
+	switch msg.Type {
+	case "open":
+		open, ok := muxKinds[msg.Kind]
+		if !ok {
+			m.sendControl(muxMessage{Type: "closed", Channel: msg.Channel, Error: fmt.Sprintf("unknown channel kind %q", msg.Kind)})
+			return nil
+		}
+		if m.get(msg.Channel) != nil {
+			return fmt.Errorf("channel %d is already open", msg.Channel)
+		}
+		reply := muxMessage{Type: "opened", Channel: msg.Channel, Kind: msg.Kind}
+		ch, err := open(msg, &reply)
+		if err != nil {
+			m.sendControl(muxMessage{Type: "closed", Channel: msg.Channel, Kind: msg.Kind, Error: err.Error(), Code: errorCode(err)})
+			return nil
+		}
+		m.mu.Lock()
+		m.channels[msg.Channel] = ch
+		m.mu.Unlock()
+		m.sendControl(reply)
+		debugf("Mux channel %d opened (%s)", msg.Channel, msg.Kind)
+
+		ctx, cancel := context.WithCancel(ctx)
+		go func() {
+			defer cancel()
+			err := ch.pump(ctx, func(p []byte) error {
+				if err := m.send(msg.Channel, p); err != nil {
+					return err
+				}
+				m.meter(ch, "out", 4+len(p))
+				return nil
+			})
+			if ctx.Err() == nil {
+				m.closed(msg.Channel, err)
+			}
+		}()
+	case "resize":
+		if _, _, err := fitSize(msg.Cols, msg.Rows); err != nil {
+			return err
+		}
+		if ch := m.get(msg.Channel); ch != nil {
+			if err := ch.resize(msg.Cols, msg.Rows); err != nil {
+				warnf("Failed to resize mux channel %d: %v", msg.Channel, err)
+			}
+		}
+	case keyInterrupt, keyEOF, keySuspend:
+		if ch := m.get(msg.Channel); ch != nil {
+			if err := ch.key(msg.Type); err != nil {
+				ptyWarnf(err, "Failed to send %s to mux channel %d: %v", msg.Type, msg.Channel, err)
+			}
+		}
+	case "close":
+		m.closeChannel(msg.Channel, nil)
+	case "probe":
+		m.sendJSON(probeMessage{Type: "probe_ack", T: msg.T})
+	case "probe_ack":
+		if report, ok := m.link.probeAcked(msg.T); ok {
+			m.sendJSON(report)
+		}
+	default:
+		return fmt.Errorf("unknown message type %q", msg.Type)
+	}
+	return nil
+}
+
+func (m *muxConn) get(id uint32) muxChannel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.channels[id]
+}
+
+// send writes channel data to the client.
+func (m *muxConn) send(id uint32, p []byte) error {
+	frame := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(frame, id)
+	copy(frame[4:], p)
+	return m.ws.write(websocket.BinaryMessage, frame)
+}
+
+func (m *muxConn) sendControl(msg muxMessage) error {
+	return m.sendJSON(msg)
+}
+
+// sendJSON writes any control message, such as an rttReport.
+func (m *muxConn) sendJSON(msg any) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := m.ws.write(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	meterTraffic("/ws/mux", trafficControl, "out", len(data))
+	return nil
+}
+
+// meter counts a data frame of ch: a terminal's, also against its session,
+// an interactive exec's, or a piped program's.
+func (m *muxConn) meter(ch muxChannel, dir string, n int) {
+	switch ch := ch.(type) {
+	case *pipeChannel:
+		meterTraffic("/ws/mux", ch.traffic, dir, n)
+	case *terminalChannel:
+		meterTraffic("/ws/mux", trafficTerminal, dir, n)
+		if sess, ok := ch.term.(*session); ok {
+			sess.meterTraffic(trafficTerminal, dir, n)
+		}
+	default:
+		meterTraffic("/ws/mux", trafficTerminal, dir, n)
+	}
+}
+
+// closed reports that a channel ended on its own, with err describing why
+// if it failed.
+func (m *muxConn) closed(id uint32, err error) {
+	m.mu.Lock()
+	_, ok := m.channels[id]
+	delete(m.channels, id)
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	msg := muxMessage{Type: "closed", Channel: id}
+	var exit *execExit
+	if errors.As(err, &exit) {
+		msg.ExitCode = &exit.code
+	} else if err != nil {
+		msg.Error, msg.Code = err.Error(), errorCode(err)
+	}
+	m.sendControl(msg)
+}
+
+// closeChannel tears down a channel at the client's request or after a write
+// error.
+func (m *muxConn) closeChannel(id uint32, err error) {
+	ch := m.get(id)
+	if ch == nil {
+		return
+	}
+	ch.close()
+	m.closed(id, err)
+}
+
+func (m *muxConn) closeAll() {
+	m.mu.Lock()
+	chans := m.channels
+	m.channels = make(map[uint32]muxChannel)
+	m.mu.Unlock()
+	for _, ch := range chans {
+		ch.close()
+	}
+}
+
+// terminalChannel is a PTY session, or a service, on a mux channel. Sessions
+// it started are closed with the channel; attached sessions and services are
+// left running.
+type terminalChannel struct {
+	term  terminalTarget
+	owned *session
+	done  chan struct{}
+	once  sync.Once
+}
+
+func openTerminalChannel(msg muxMessage, reply *muxMessage) (muxChannel, error) {
+	ch := &terminalChannel{done: make(chan struct{})}
+	if msg.Session != "" {
+		sess := sessions.get(msg.Session)
+		if sess == nil {
+			return nil, errSessionNotFound
+		}
+		if err := sess.restoreSize(msg.Cols, msg.Rows); err != nil {
+			return nil, err
+		}
+		ch.term = sess
+		reply.Session = sess.id
+		modes := sess.terminalModes()
+		reply.Modes = &modes
+		return ch, nil
+	}
+	cols, rows := msg.Cols, msg.Rows
+	if cols == 0 && rows == 0 {
+		cols, rows = 80, 24
+	}
+	var meta sessionMeta
+	if msg.Meta != nil {
+		if err := msg.Meta.validate(); err != nil {
+			return nil, err
+		}
+		meta = *msg.Meta
+	}
+	sess, err := sessions.start(cols, rows, meta, "")
+	if err != nil {
+		return nil, err
+	}
+	ch.term, ch.owned = sess, sess
+	reply.Session = sess.id
+	return ch, nil
+}
+
+func openServiceChannel(msg muxMessage, reply *muxMessage) (muxChannel, error) {
+	svc := services.get(msg.Service)
+	if svc == nil {
+		return nil, errors.New("service not found")
+	}
+	if err := svc.restoreSize(msg.Cols, msg.Rows); err != nil {
+		return nil, err
+	}
+	reply.Service = svc.name
+	return &terminalChannel{term: svc, done: make(chan struct{})}, nil
+}
+
+func (t *terminalChannel) pump(ctx context.Context, send func([]byte) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-t.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return t.term.follow(ctx, 0, func(data []byte, _ int64) error { return send(data) })
+}
+
+func (t *terminalChannel) write(p []byte) error { return t.term.write(p) }
+
+func (t *terminalChannel) resize(cols, rows int) error { return t.term.resize(cols, rows) }
+
+func (t *terminalChannel) key(key string) error { return t.term.key(key) }
+
+func (t *terminalChannel) close() {
+	t.once.Do(func() { close(t.done) })
+	if t.owned != nil {
+		t.owned.close()
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Policies for file names that are the same text in another Unicode
+// normalization form, such as "café" with a precomposed é (NFC, as most
+// systems write it) and with an e and a combining accent (NFD, as macOS
+// uploads often do). S3 keys are bytes, so without a policy the two are
+// different files that look alike.
+const (
+	// namesNFC writes new names in NFC, and takes a name that matches an
+	// existing one once normalized to mean that one.
+	namesNFC = "nfc"
+	// namesReject writes names as given, and refuses one that matches an
+	// existing name only once normalized.
+	namesReject = "reject"
+	// namesKeep leaves names alone, as the bucket does.
+	namesKeep = "keep"
+)
+
+var errNameConflict = errors.New("name conflict")
+
+var nameConflicts = newCounter("dos3_name_conflicts_total",
+	"File names that matched an existing name in another Unicode normalization form, by what was done: matched or rejected.")
+
+func checkNamePolicy(policy string) error {
+	switch policy {
+	case namesNFC, namesReject, namesKeep:
+		return nil
+	}
+	return fmt.Errorf("unicode_names must be %q, %q or %q, not %q", namesNFC, namesReject, namesKeep, policy)
+}
+
+// isASCII reports whether s has nothing normalization could change.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// nameKey is what two names have in common when the unicode_names policy
+// makes them the same file.
+func nameKey(name string) string {
+	if isASCII(name) || currentConfig().UnicodeNames == namesKeep {
+		return name
+	}
+	return norm.NFC.String(name)
+}
+
+// normalizeNames applies the unicode_names policy to full, a clean path
+// under dataDir, one element at a time: an element that doesn't exist but
+// matches a sibling once normalized is that sibling, or a conflict.
+// Elements that don't exist at all are written in NFC under the nfc
+// policy. ASCII names, most of them, are returned without a look.
+func normalizeNames(full string) (string, error) {
+	policy := currentConfig().UnicodeNames
+	rel := relPath(full)
+	if rel == "" || isASCII(rel) || policy == namesKeep {
+		return full, nil
+	}
+	dir := dataDir
+	for _, elem := range strings.Split(rel, "/") {
+		if isASCII(elem) {
+			dir = filepath.Join(dir, elem)
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(dir, elem)); err == nil {
+			dir = filepath.Join(dir, elem)
+			continue
+		}
+		want := norm.NFC.String(elem)
+		var match string
+		if entries, err := os.ReadDir(dir); err == nil {
+			for _, e := range entries {
+				if e.Name() != elem && norm.NFC.String(e.Name()) == want {
+					match = e.Name()
+					break
+				}
+			}
+		}
+		switch {
+		case match != "" && policy == namesReject:
+			nameConflicts.add(1, "outcome", "rejected")
+			return "", fmt.Errorf("%w: %q is already %q in another Unicode normalization form",
+				errNameConflict, relPath(filepath.Join(dir, elem)), relPath(filepath.Join(dir, match)))
+		case match != "":
+			nameConflicts.add(1, "outcome", "matched")
+			elem = match
+		case policy == namesNFC:
+			elem = want
+		}
+		dir = filepath.Join(dir, elem)
+	}
+	return dir, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"server/container_src/internal/s3test"
+)
+
+func TestUnicodeNames(t *testing.T) {
+	const nfc, nfd = "caf\u00e9.txt", "cafe\u0301.txt"
+	os.RemoveAll(filepath.Join(dataDir, "names"))
+	put := func(name, body string) (fi fileInfo, status int, problemType string) {
+		t.Helper()
+		req, _ := http.NewRequest("PUT", testURL+"/v1/files/names/"+url.PathEscape(name), strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			var p problem
+			json.NewDecoder(resp.Body).Decode(&p)
+			return fi, resp.StatusCode, p.Type
+		}
+		json.NewDecoder(resp.Body).Decode(&fi)
+		return fi, resp.StatusCode, ""
+	}
+	names := func() []string {
+		t.Helper()
+		entries, _ := os.ReadDir(filepath.Join(dataDir, "names"))
+		var list []string
+		for _, e := range entries {
+			list = append(list, e.Name())
+		}
+		return list
+	}
+
+	// By default a macOS-style name is written in NFC, and the same name in
+	// either form is the same file.
+	if fi, status, _ := put(nfd, "one"); status >= 300 || fi.Path != "names/"+nfc {
+		t.Fatalf("PUT %q: %d %+v", nfd, status, fi)
+	}
+	put(nfc, "two")
+	if got := names(); !slices.Equal(got, []string{nfc}) {
+		t.Errorf("names = %q", got)
+	}
+	if fi, err := statPath("names/" + nfd); err != nil || fi.Size != 3 {
+		t.Errorf("stat %q = %+v, %v", nfd, fi, err)
+	}
+
+	// A file already in the bucket in NFD is matched, not duplicated.
+	os.Remove(filepath.Join(dataDir, "names", nfc))
+	os.WriteFile(filepath.Join(dataDir, "names", nfd), []byte("old"), 0644)
+	put(nfc, "new")
+	if data, _ := os.ReadFile(filepath.Join(dataDir, "names", nfd)); string(data) != "new" || len(names()) != 1 {
+		t.Errorf("names = %q, %q = %q", names(), nfd, data)
+	}
+
+	cfg := *currentConfig()
+	cfg.UnicodeNames = namesReject
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	if _, status, typ := put(nfc, "x"); status != http.StatusConflict || typ != problemTypePrefix+"name-conflict" {
+		t.Errorf("PUT %q under reject: %d %s", nfc, status, typ)
+	}
+	if _, status, _ := put(nfd, "y"); status >= 300 {
+		t.Errorf("PUT %q under reject: %d", nfd, status)
+	}
+	cfg.UnicodeNames = namesKeep
+	put(nfc, "z")
+	if got := names(); len(got) != 2 {
+		t.Errorf("names under keep = %q", got)
+	}
+	if checkNamePolicy("nfd") == nil {
+		t.Error("unicode_names accepted nfd")
+	}
+
+	// An import with both forms of a name copies one and fails the other.
+	activeConfig.Store(prev)
+	srv := s3test.NewServer(t)
+	store := srv.Client(t, "names-test")
+	ctx := context.Background()
+	if err := store.CreateBucket(ctx); err != nil {
+		t.Fatal(err)
+	}
+	store.PutObject(ctx, "u/"+nfc, strings.NewReader("a"), "")
+	store.PutObject(ctx, "u/"+nfd, strings.NewReader("b"), "")
+	files, err := bucketImportFiles(ctx, store, "u/")
+	if err != nil || len(files) != 2 {
+		t.Fatalf("bucketImportFiles = %v, %v", files, err)
+	}
+	_, err = files[1].open(ctx)
+	if !errors.Is(err, errNameConflict) {
+		t.Errorf("importing %q after %q: %v", files[1].source, files[0].source, err)
+	}
+}
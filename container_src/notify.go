@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// maxPendingNotifications bounds the webhooks waiting on one session's
+	// commands.
+	maxPendingNotifications = 16
+	maxNotifyTag            = 128
+	notifyAttempts          = 3
+)
+
+var (
+	errNoNotifyURL    = errors.New("no notify_url configured")
+	errInvalidNotify  = errors.New("invalid notification request")
+	notificationsSent = newCounter("dos3_command_notifications_total",
+		"Finished commands reported to clients that asked, via websocket or webhook.")
+)
+
+// notifyRequest is the body of POST /v1/sessions/{id}/notify.
+type notifyRequest struct {
+	// Tag is passed back in the notification, for the receiver to route
+	// it, such as to the tab that asked.
+	Tag string `json:"tag,omitempty"`
+}
+
+// notifyPending answers POST /v1/sessions/{id}/notify.
+type notifyPending struct {
+	Session string `json:"session"`
+	Tag     string `json:"tag,omitempty"`
+	// Running is whether a command is running now; if not, the
+	// notification is for the next one run.
+	Running bool `json:"running"`
+}
+
+// commandFinishedMessage reports a finished command, to a /ws control
+// client that sent {"type": "notify"} or to notify_url.
+type commandFinishedMessage struct {
+	Type    string `json:"type"` // "command_finished"
+	Session string `json:"session"`
+	Name    string `json:"name,omitempty"`
+	Tag     string `json:"tag,omitempty"`
+	commandRecord
+}
+
+// notifyWhenFinished calls send with the next command s finishes, unless
+// ctx is done or s ends first.
+func (s *session) notifyWhenFinished(ctx context.Context, tag string, send func(commandFinishedMessage)) {
+	c, ok := s.nextCommand(ctx)
+	if !ok {
+		return
+	}
+	send(commandFinishedMessage{Type: "command_finished", Session: s.id, Name: s.metadata().Name, Tag: tag, commandRecord: c})
+}
+
+// postNotification sends m to url, retrying failures a few times.
+func postNotification(url string, m commandFinishedMessage) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		warnf("Command notification: %v", err)
+		return
+	}
+	id := randomID()
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := postNotify(url, id, body)
+		if err == nil {
+			notificationsSent.add(1, "via", "webhook")
+			return
+		}
+		if attempt == notifyAttempts {
+			warnf("Command notification for session %s failed after %d attempts: %v (request %s)", m.Session, attempt, err, id)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postNotify(url, id string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(requestIDHeader, id)
+	if token := os.Getenv("S3_AUTH_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// handleSessionNotify registers a webhook to notify_url for when the
+// session's running command, or the next one, finishes. Clients can't
+// name the URL: the notification carries the server's auth token.
+func handleSessionNotify(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	var req notifyRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&req); err != nil {
+			httpError(w, r, "invalid notify request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	url := currentConfig().NotifyURL
+	var err error
+	switch {
+	case url == "":
+		err = errNoNotifyURL
+	case len(req.Tag) > maxNotifyTag:
+		err = fmt.Errorf("%w: tag is longer than %d bytes", errInvalidNotify, maxNotifyTag)
+	case sess.notifyPending.Add(1) > maxPendingNotifications:
+		sess.notifyPending.Add(-1)
+		err = fmt.Errorf("%w: %d notifications are pending for session %s", errInvalidNotify, maxPendingNotifications, sess.id)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	go func() {
+		defer sess.notifyPending.Add(-1)
+		sess.notifyWhenFinished(context.Background(), req.Tag, func(m commandFinishedMessage) {
+			postNotification(url, m)
+		})
+	}()
+	prompt, _ := sess.promptStatus()
+	writeJSON(w, http.StatusAccepted, notifyPending{Session: sess.id, Tag: req.Tag, Running: prompt != nil && prompt.Running})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCommandNotify(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("no bash")
+	}
+	t.Setenv("SHELL", bash)
+	hooks := make(chan commandFinishedMessage, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m commandFinishedMessage
+		json.NewDecoder(r.Body).Decode(&m)
+		hooks <- m
+	}))
+	defer hook.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws?control=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var id string
+	var finished commandFinishedMessage
+	for finished.Type == "" {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m struct {
+			commandFinishedMessage
+			ID string `json:"id"`
+		}
+		if typ != websocket.TextMessage || json.Unmarshal(data, &m) != nil {
+			continue
+		}
+		switch m.Type {
+		case "session":
+			id = m.ID
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "notify", "tag": "tab-1"}`))
+			conn.WriteMessage(websocket.TextMessage, []byte("(sleep 0.2; exit 5)\n"))
+		case "command_finished":
+			finished = m.commandFinishedMessage
+		}
+	}
+	if finished.Session != id || finished.Tag != "tab-1" || finished.ExitCode == nil || *finished.ExitCode != 5 {
+		t.Errorf("command_finished = %+v", finished)
+	}
+
+	notify := func(want int) {
+		t.Helper()
+		resp, err := http.Post(testURL+"/v1/sessions/"+id+"/notify", "application/json", strings.NewReader(`{"tag": "build"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("notify: %s, want %d", resp.Status, want)
+		}
+	}
+	notify(http.StatusConflict)
+	cfg := *currentConfig()
+	cfg.NotifyURL = hook.URL
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	notify(http.StatusAccepted)
+	conn.WriteMessage(websocket.TextMessage, []byte("true\n"))
+	select {
+	case m := <-hooks:
+		if m.Type != "command_finished" || m.Session != id || m.Tag != "build" || m.Command != "true" || m.ExitCode == nil || *m.ExitCode != 0 {
+			t.Errorf("webhook = %+v", m)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no webhook")
+	}
+}
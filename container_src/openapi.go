@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPIVersion is the version of the /v1 API reported in the document.
+// Bump the minor version for additive changes; breaking changes get /v2.
+const openAPIVersion = "1.46.0"
+
+// openAPIHandler serves the OpenAPI document for routes.
+func openAPIHandler(routes []route) http.HandlerFunc {
+	doc, err := json.MarshalIndent(buildOpenAPI(routes), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}
+}
+
+// buildOpenAPI describes routes as an OpenAPI 3.0 document, deriving request
+// and response schemas from the Go types in the route table.
+func buildOpenAPI(routes []route) map[string]any {
+	g := &schemaGen{schemas: map[string]any{}}
+	paths := map[string]map[string]any{}
+	for _, rt := range routes {
+		p := strings.ReplaceAll(rt.Path, "...}", "}")
+		if paths[p] == nil {
+			paths[p] = map[string]any{}
+		}
+		op := map[string]any{
+			"summary":     rt.Summary,
+			"operationId": operationID(rt),
+			"tags":        []string{rt.Tag},
+		}
+		var params []any
+		for _, name := range pathParams(p) {
+			params = append(params, map[string]any{
+				"name": name, "in": "path", "required": true,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		for _, q := range rt.Query {
+			params = append(params, map[string]any{
+				"name": q.Name, "in": "query", "description": q.Description,
+				"schema": map[string]any{"type": q.Type},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if rt.Control {
+			op["security"] = []any{map[string]any{"controlToken": []string{}}}
+		}
+		if rt.Body != nil {
+			op["requestBody"] = map[string]any{"required": true, "content": g.content(rt.Body)}
+		}
+		status := rt.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		resp := map[string]any{"description": http.StatusText(status)}
+		if rt.Result == nil {
+			status = http.StatusNoContent
+			resp["description"] = http.StatusText(status)
+		} else {
+			resp["content"] = g.content(rt.Result)
+		}
+		op["responses"] = map[string]any{
+			strconv.Itoa(status): resp,
+			"default": map[string]any{
+				"description": "Error, as RFC 9457 problem details",
+				"content": map[string]any{"application/problem+json": map[string]any{
+					"schema": g.schema(reflect.TypeOf(problem{})),
+				}},
+			},
+		}
+		paths[p][strings.ToLower(rt.Method)] = op
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "do-s3 terminal server",
+			"version": openAPIVersion,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]any{
+				"controlToken": map[string]any{"type": "http", "scheme": "bearer", "description": "CONTROL_TOKEN"},
+			},
+		},
+	}
+}
+
+func operationID(rt route) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(rt.Method))
+	for _, part := range strings.Split(strings.TrimPrefix(rt.Path, "/v1/"), "/") {
+		part = strings.Trim(part, "{.}")
+		part = strings.ReplaceAll(part, ".json", "")
+		if part == "" {
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+func pathParams(p string) []string {
+	var names []string
+	for _, part := range strings.Split(p, "/") {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			names = append(names, part[1:len(part)-1])
+		}
+	}
+	return names
+}
+
+type schemaGen struct {
+	schemas map[string]any
+}
+
+func (g *schemaGen) content(v any) map[string]any {
+	if raw, ok := v.(rawBody); ok {
+		return map[string]any{raw.ContentType: map[string]any{
+			"schema": map[string]any{"type": "string", "format": "binary"},
+		}}
+	}
+	return map[string]any{"application/json": map[string]any{
+		"schema": g.schema(reflect.TypeOf(v)),
+	}}
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(duration{})
+)
+
+// schema returns the JSON Schema for t as encoding/json would marshal it.
+// Named structs are registered under components/schemas and referenced.
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]any{"type": "string", "example": "30s"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := g.schemas[name]; !ok {
+			g.schemas[name] = nil // guard against recursive types
+			g.schemas[name] = g.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+func (g *schemaGen) structSchema(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			// Promoted fields, as encoding/json flattens them.
+			for k, v := range g.structSchema(f.Type)["properties"].(map[string]any) {
+				props[k] = v
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s := g.schema(f.Type)
+		if strings.Contains(opts, "string") {
+			s = map[string]any{"type": "string"}
+		}
+		props[name] = s
+	}
+	return map[string]any{"type": "object", "properties": props}
+}
+
+// schemaName turns execRequest into ExecRequest.
+func schemaName(t reflect.Type) string {
+	n := t.Name()
+	return strings.ToUpper(n[:1]) + n[1:]
+}
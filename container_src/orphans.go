@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// orphanSweepInterval is how often the sweeper looks for orphaned processes.
+const orphanSweepInterval = 15 * time.Second
+
+// sessionEnv is set in every session shell's environment to the session ID.
+// Children inherit it, so it still says where a daemonized process came from
+// after it has left the session's process tree.
+const sessionEnv = "DO_S3_SESSION"
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER from <linux/prctl.h>.
+const prSetChildSubreaper = 36
+
+var (
+	orphansReaped = newCounter("dos3_orphan_processes_reaped_total",
+		"Orphaned processes signalled by the sweeper, by signal.")
+	orphansPending = newGauge("dos3_orphan_processes",
+		"Orphaned processes waiting out orphan_grace_period.")
+)
+
+// procKey identifies a process across pid reuse.
+type procKey struct {
+	pid   int
+	start uint64
+}
+
+type orphan struct {
+	since   time.Time
+	session string // sessionEnv of the process, if any
+	termed  bool
+}
+
+// orphanSweeper terminates processes nothing owns any more: daemons left by
+// closed sessions, and background jobs of exec commands that have finished.
+// The server makes itself a child subreaper, so such processes are
+// reparented to it instead of escaping to init, and an orphan is any direct
+// child of the server without an owner (see owned).
+type orphanSweeper struct {
+	self int
+	seen map[procKey]*orphan
+}
+
+// sweepOrphans runs the sweeper forever.
+func sweepOrphans() {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		warnf("Orphans outside the server's own children won't be collected: PR_SET_CHILD_SUBREAPER: %v", errno)
+	}
+	sw := &orphanSweeper{self: os.Getpid(), seen: make(map[procKey]*orphan)}
+	for range time.Tick(orphanSweepInterval) {
+		sw.sweep()
+	}
+}
+
+// sweep makes one pass. An orphan is sent SIGTERM, with its descendants,
+// once it has been orphaned for orphan_grace_period, and SIGKILL if it is
+// still around on the next pass. Orphans that already exited are reaped.
+func (sw *orphanSweeper) sweep() {
+	grace := currentConfig().OrphanGracePeriod.Duration
+	if grace <= 0 {
+		clear(sw.seen)
+		orphansPending.set(0)
+		return
+	}
+	procs, err := listProcs()
+	if err != nil {
+		warnf("Orphan sweep: listing processes: %v", err)
+		return
+	}
+	var me procInfo
+	children := make(map[int][]int)
+	for _, p := range procs {
+		if p.pid == sw.self {
+			me = p
+		}
+		children[p.ppid] = append(children[p.ppid], p.pid)
+	}
+	leaders := sessions.shells()
+	live := make(map[string]bool, len(leaders))
+	for _, id := range leaders {
+		live[id] = true
+	}
+	for pid, name := range services.leaders() {
+		leaders[pid] = name
+	}
+
+	now := time.Now()
+	next := make(map[procKey]*orphan)
+	for _, p := range procs {
+		if p.ppid != sw.self || sw.owned(p, me, leaders, live) {
+			continue
+		}
+		if p.state == 'Z' {
+			// It exited after being reparented; nobody else will wait for it.
+			var ws syscall.WaitStatus
+			syscall.Wait4(p.pid, &ws, syscall.WNOHANG, nil)
+			continue
+		}
+		key := procKey{p.pid, p.start}
+		o := sw.seen[key]
+		if o == nil {
+			o = &orphan{since: now, session: procSession(p.pid)}
+			debugf("Process %d (%s) is orphaned%s", p.pid, p.comm, o.origin())
+		}
+		next[key] = o
+		switch {
+		case now.Sub(o.since) < grace:
+		case !o.termed:
+			n := signalTree(p.pid, children, syscall.SIGTERM)
+			orphansReaped.add(float64(n), "signal", "SIGTERM")
+			infof("Terminating orphaned process %d (%s)%s and %d descendant(s), orphaned for %s",
+				p.pid, p.comm, o.origin(), n-1, now.Sub(o.since).Round(time.Second))
+			o.termed = true
+		default:
+			n := signalTree(p.pid, children, syscall.SIGKILL)
+			orphansReaped.add(float64(n), "signal", "SIGKILL")
+			warnf("Killed orphaned process %d (%s)%s and %d descendant(s) that ignored SIGTERM",
+				p.pid, p.comm, o.origin(), n-1)
+		}
+	}
+	sw.seen = next
+	orphansPending.set(float64(len(next)))
+}
+
+// owned reports whether a direct child of the server still belongs to
+// something: a live session or PTY service, as its leader or a job in its
+// Unix session, a live session going by its sessionEnv, or the server
+// itself. Everything else the server starts (exec commands, language
+// servers, the IDE, piped services, tigrisfs) stays in the server's Unix
+// session and leads its own process group or shares the server's, whereas a
+// job left behind by an exec command is in the group of a leader that has
+// exited, and a daemon has a session of its own.
+//
+// Zombies have no environment left to read, but a session's shell waiting to
+// be reaped is still matched by its Unix session.
+func (sw *orphanSweeper) owned(p, me procInfo, leaders map[int]string, live map[string]bool) bool {
+	if p.sid == me.sid && (p.pgrp == p.pid || p.pgrp == me.pgrp) {
+		return true
+	}
+	if _, ok := leaders[p.sid]; ok {
+		return true
+	}
+	return live[procSession(p.pid)]
+}
+
+func (o *orphan) origin() string {
+	if o.session == "" {
+		return ""
+	}
+	return " from session " + o.session
+}
+
+// procSession returns the sessionEnv value in pid's environment.
+func procSession(pid int) string {
+	return procEnv(pid, sessionEnv)
+}
+
+// procEnv returns the value of key in pid's environment.
+func procEnv(pid int, key string) string {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/environ")
+	if err != nil {
+		return ""
+	}
+	for _, kv := range bytes.Split(data, []byte{0}) {
+		if v, ok := strings.CutPrefix(string(kv), key+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// signalTree sends sig to pid and all its descendants, returning how many
+// were signalled.
+func signalTree(pid int, children map[int][]int, sig syscall.Signal) int {
+	n := 0
+	if syscall.Kill(pid, sig) == nil {
+		n++
+	}
+	for _, c := range children[pid] {
+		n += signalTree(c, children, sig)
+	}
+	return n
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startDaemon starts sh -c script as a child of the test, in a Unix session
+// of its own as a daemon would be, with sessionEnv set to session if any.
+func startDaemon(t *testing.T, script, session string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if session != "" {
+		cmd.Env = append(os.Environ(), sessionEnv+"="+session)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Wait()
+	})
+	return cmd
+}
+
+// alive reports whether pid is running, and not a zombie.
+func alive(pid int) bool {
+	procs, _ := listProcs()
+	for _, p := range procs {
+		if p.pid == pid {
+			return p.state != 'Z'
+		}
+	}
+	return false
+}
+
+// TestOrphanSweep checks that an orphaned process is terminated with its
+// descendants once orphan_grace_period is up, and that processes a live
+// session owns are left alone.
+func TestOrphanSweep(t *testing.T) {
+	cfg := *currentConfig()
+	cfg.OrphanGracePeriod = duration{time.Millisecond}
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	// A daemon started from the live session, and one from a session that
+	// has ended.
+	kept := startDaemon(t, "sleep 60; :", sess.id)
+	stray := startDaemon(t, "sleep 60 & sleep 60; :", "ended-session")
+	var descendants []int
+	for deadline := time.Now().Add(5 * time.Second); len(descendants) < 2; {
+		descendants = descendants[:0]
+		procs, _ := listProcs()
+		for _, p := range procs {
+			if p.ppid == stray.Process.Pid {
+				descendants = append(descendants, p.pid)
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("orphan's children: %v, want 2", descendants)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sw := &orphanSweeper{self: os.Getpid(), seen: make(map[procKey]*orphan)}
+	sw.sweep()
+	if !alive(stray.Process.Pid) {
+		t.Fatal("orphan terminated on the pass that found it, before its grace period")
+	}
+	time.Sleep(10 * time.Millisecond)
+	sw.sweep()
+
+	exited := make(chan error, 1)
+	go func() { exited <- stray.Wait() }()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("orphan still running after its grace period")
+	}
+	for _, pid := range descendants {
+		for deadline := time.Now().Add(5 * time.Second); alive(pid); {
+			if time.Now().After(deadline) {
+				t.Fatalf("orphan's child %d still running", pid)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if !alive(kept.Process.Pid) {
+		t.Error("the live session's daemon was terminated")
+	}
+	if sess.isClosed() || !alive(sess.cmd.Process.Pid) {
+		t.Error("the live session's shell was terminated")
+	}
+	for key := range sw.seen {
+		if key.pid == kept.Process.Pid || key.pid == sess.cmd.Process.Pid {
+			t.Errorf("process %d counted as orphaned", key.pid)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// outputLog buffers the most recent PTY output of a session. Positions are
+// absolute byte offsets since the session started, so each reader (WebSocket,
+// SSE, long-poll) tracks its own cursor and a slow reader that falls behind
+// the retained window skips ahead instead of blocking the PTY.
+type outputLog struct {
+	mu      sync.Mutex
+	buf     []byte
+	start   int64 // offset of buf[0]
+	limit   int
+	closed  bool
+	changed chan struct{} // closed and replaced on every append or close
+	// lastAppend is when output last came. While the log is packed (see
+	// scrollback.go), buf is empty and its size bytes are compressed in
+	// packed, or in spill on local disk.
+	lastAppend time.Time
+	packed     []byte
+	spill      *os.File
+	size       int
+}
+
+func newOutputLog(limit int) *outputLog {
+	return &outputLog{limit: limit, changed: make(chan struct{}), lastAppend: time.Now()}
+}
+
+func (l *outputLog) append(p []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.unpackLocked()
+	l.lastAppend = time.Now()
+	l.buf = append(l.buf, p...)
+	if over := len(l.buf) - l.limit; over > 0 {
+		l.buf = append(l.buf[:0:0], l.buf[over:]...)
+		l.start += int64(over)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *outputLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	close(l.changed)
+}
+
+// logSnapshot is an outputLog's retained output and where it starts, carried
+// across a binary upgrade.
+type logSnapshot struct {
+	Start int64  `json:"start"`
+	Data  []byte `json:"data"`
+}
+
+func (l *outputLog) snapshot() logSnapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.unpackLocked()
+	return logSnapshot{Start: l.start, Data: append([]byte(nil), l.buf...)}
+}
+
+// restoreOutputLog returns a log continuing from snap, so readers' offsets
+// stay valid.
+func restoreOutputLog(limit int, snap logSnapshot) *outputLog {
+	l := newOutputLog(limit)
+	l.start = snap.Start
+	l.buf = snap.Data
+	return l
+}
+
+// read returns up to max bytes starting at off (or at the oldest retained
+// byte if off has been discarded) and the offset following them. When no data
+// is available, wait is closed once there is more; it is nil if the log is
+// closed and fully read.
+func (l *outputLog) read(off int64, max int) (data []byte, next int64, wait <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// A reader that's caught up doesn't need the output unpacked.
+	if off < l.start+int64(l.lenLocked()) {
+		l.unpackLocked()
+	}
+	if off < l.start {
+		off = l.start
+	}
+	end := l.start + int64(l.lenLocked())
+	if off >= end {
+		if l.closed {
+			return nil, end, nil
+		}
+		return nil, end, l.changed
+	}
+	data = l.buf[off-l.start:]
+	if len(data) > max {
+		data = data[:max]
+	}
+	return append([]byte(nil), data...), off + int64(len(data)), nil
+}
+
+// end returns the offset just past the newest byte.
+func (l *outputLog) end() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.start + int64(l.lenLocked())
+}
+
+// lenLocked is how many bytes the log retains, packed or not.
+func (l *outputLog) lenLocked() int {
+	if l.packed != nil || l.spill != nil {
+		return l.size
+	}
+	return len(l.buf)
+}
+
+// follow calls send with the log from offset off onwards until the log is
+// closed and fully read (returning nil), ctx is done, or send fails.
+func (l *outputLog) follow(ctx context.Context, off int64, send func(data []byte, next int64) error) error {
+	for {
+		data, next, wait := l.read(off, maxOutputFrame)
+		if len(data) > 0 {
+			if err := send(data, next); err != nil {
+				return err
+			}
+			off = next
+			continue
+		}
+		if wait == nil {
+			return nil
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if flags.enabled(flagOutputCoalescing) {
+			// Let a burst accumulate so it goes out as one frame.
+			select {
+			case <-time.After(coalesceWindowFor(ctx)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
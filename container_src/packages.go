@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// packagesFileName is the manifest, at the root of /data, of the
+	// packages installed on top of the image.
+	packagesFileName = ".packages.json"
+	// packagesTimeout bounds listing a manager's packages.
+	packagesTimeout = 2 * time.Minute
+)
+
+// packagesBaselinePath keeps what the image came with, recorded at the
+// container's first boot. It is on the root filesystem, so it goes with
+// the container, as what was installed since does.
+var packagesBaselinePath = envOr("PACKAGES_BASELINE", "/var/lib/do-s3/packages-baseline.json")
+
+var packagesRestored = newCounter("dos3_packages_restored_total",
+	"Packages reinstalled from /data/.packages.json, by manager and outcome.")
+
+// packageManifest is /data/.packages.json: the packages installed since the
+// image was built, by manager, with their versions.
+type packageManifest struct {
+	Recorded time.Time                    `json:"recorded"`
+	Packages map[string]map[string]string `json:"packages"`
+}
+
+// packageManager lists and installs one kind of package.
+type packageManager struct {
+	name string
+	// list returns the installed packages' versions by name.
+	list func(ctx context.Context) (map[string]string, error)
+	// install installs pkgs, versions by name, writing its output to out.
+	install func(ctx context.Context, pkgs map[string]string, out io.Writer) error
+	// pins is set if install installs the versions given rather than the
+	// latest, so a package at another version is reinstalled.
+	pins bool
+}
+
+// packageManagers are the managers recorded and restored, in order. One
+// that isn't installed is skipped.
+var packageManagers = []packageManager{
+	{name: "apt", list: listAptPackages, install: installAptPackages},
+	{name: "pip", list: listPipPackages, install: installPipPackages, pins: true},
+	{name: "npm", list: listNpmPackages, install: installNpmPackages, pins: true},
+}
+
+// listAptPackages lists the packages installed by hand, rather than as
+// dependencies, which apt would bring back with them.
+func listAptPackages(ctx context.Context) (map[string]string, error) {
+	out, err := exec.CommandContext(ctx, "apt-mark", "showmanual").Output()
+	if err != nil {
+		return nil, err
+	}
+	pkgs := make(map[string]string)
+	for _, name := range strings.Fields(string(out)) {
+		pkgs[name] = ""
+	}
+	if len(pkgs) == 0 {
+		return pkgs, nil
+	}
+	out, err = exec.CommandContext(ctx, "dpkg-query", "-W", "-f", "${Package} ${Version}\n").Output()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if name, version, ok := strings.Cut(line, " "); ok {
+			if _, manual := pkgs[name]; manual {
+				pkgs[name] = version
+			}
+		}
+	}
+	return pkgs, nil
+}
+
+// installAptPackages installs the latest versions: the mirrors seldom keep
+// the old ones.
+func installAptPackages(ctx context.Context, pkgs map[string]string, out io.Writer) error {
+	if err := runPackageCommand(ctx, out, "apt-get", "update"); err != nil {
+		return err
+	}
+	return runPackageCommand(ctx, out, append([]string{"apt-get", "install", "-y", "--no-install-recommends"}, slices.Sorted(maps.Keys(pkgs))...)...)
+}
+
+func listPipPackages(ctx context.Context) (map[string]string, error) {
+	out, err := exec.CommandContext(ctx, "python3", "-m", "pip", "list", "--format=json", "--disable-pip-version-check").Output()
+	if err != nil {
+		return nil, err
+	}
+	var list []struct{ Name, Version string }
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("pip list: %w", err)
+	}
+	pkgs := make(map[string]string, len(list))
+	for _, p := range list {
+		pkgs[p.Name] = p.Version
+	}
+	return pkgs, nil
+}
+
+func installPipPackages(ctx context.Context, pkgs map[string]string, out io.Writer) error {
+	argv := []string{"python3", "-m", "pip", "install", "--disable-pip-version-check"}
+	for _, name := range slices.Sorted(maps.Keys(pkgs)) {
+		argv = append(argv, name+"=="+pkgs[name])
+	}
+	return runPackageCommand(ctx, out, argv...)
+}
+
+func listNpmPackages(ctx context.Context) (map[string]string, error) {
+	// npm ls exits 1 over problems it still lists the packages despite.
+	out, err := exec.CommandContext(ctx, "npm", "ls", "--global", "--json", "--depth=0").Output()
+	var exit *exec.ExitError
+	if err != nil && !(errors.As(err, &exit) && len(out) > 0) {
+		return nil, err
+	}
+	var list struct {
+		Dependencies map[string]struct{ Version string }
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("npm ls: %w", err)
+	}
+	pkgs := make(map[string]string, len(list.Dependencies))
+	for name, p := range list.Dependencies {
+		pkgs[name] = p.Version
+	}
+	return pkgs, nil
+}
+
+func installNpmPackages(ctx context.Context, pkgs map[string]string, out io.Writer) error {
+	argv := []string{"npm", "install", "--global"}
+	for _, name := range slices.Sorted(maps.Keys(pkgs)) {
+		argv = append(argv, name+"@"+pkgs[name])
+	}
+	return runPackageCommand(ctx, out, argv...)
+}
+
+func runPackageCommand(ctx context.Context, out io.Writer, argv ...string) error {
+	fmt.Fprintf(out, "$ %s\n", strings.Join(argv, " "))
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdout, cmd.Stderr = out, out
+	// The packages come from a file users can write, and their install
+	// scripts run with the environment shells get.
+	cmd.Env = append(spawnEnv(), "DEBIAN_FRONTEND=noninteractive", "PIP_BREAK_SYSTEM_PACKAGES=1")
+	return cmd.Run()
+}
+
+// installedPackages lists every manager's packages, leaving out those that
+// aren't installed.
+func installedPackages(ctx context.Context) map[string]map[string]string {
+	ctx, cancel := context.WithTimeout(ctx, packagesTimeout)
+	defer cancel()
+	all := make(map[string]map[string]string)
+	for _, m := range packageManagers {
+		pkgs, err := m.list(ctx)
+		if errors.Is(err, exec.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			warnf("Listing %s packages: %v", m.name, err)
+			continue
+		}
+		all[m.name] = pkgs
+	}
+	return all
+}
+
+// recordPackageBaseline notes what the image came with, once per
+// container.
+func recordPackageBaseline() {
+	if _, err := os.Stat(packagesBaselinePath); err == nil {
+		return
+	}
+	data, _ := json.Marshal(installedPackages(context.Background()))
+	err := os.MkdirAll(filepath.Dir(packagesBaselinePath), 0755)
+	if err == nil {
+		err = storeFile(packagesBaselinePath, strings.NewReader(string(data)), 0644)
+	}
+	if err != nil {
+		warnf("Packages installed in the image are not recorded; dos3-packages will record them all: %v", err)
+	}
+}
+
+func readPackageBaseline() map[string]map[string]string {
+	base := make(map[string]map[string]string)
+	if data, err := os.ReadFile(packagesBaselinePath); err == nil {
+		json.Unmarshal(data, &base)
+	}
+	return base
+}
+
+// recordPackages writes the packages installed or upgraded since the image
+// to /data/.packages.json, and returns them.
+func recordPackages(ctx context.Context) (packageManifest, error) {
+	base := readPackageBaseline()
+	m := packageManifest{Recorded: time.Now().UTC(), Packages: make(map[string]map[string]string)}
+	for name, pkgs := range installedPackages(ctx) {
+		added := make(map[string]string)
+		for pkg, version := range pkgs {
+			if was, ok := base[name][pkg]; !ok || was != version {
+				added[pkg] = version
+			}
+		}
+		if len(added) > 0 {
+			m.Packages[name] = added
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return packageManifest{}, err
+	}
+	if err := storeFile(filepath.Join(dataDir, packagesFileName), strings.NewReader(string(data)+"\n"), 0644); err != nil {
+		return packageManifest{}, err
+	}
+	return m, nil
+}
+
+// readPackages reads /data/.packages.json.
+func readPackages() (packageManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, packagesFileName))
+	if err != nil {
+		return packageManifest{}, err
+	}
+	var m packageManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return packageManifest{}, fmt.Errorf("%s: %w", packagesFileName, err)
+	}
+	return m, nil
+}
+
+// restorePackages installs what the manifest lists and isn't installed at
+// its version, writing the managers' output to out. It returns how many
+// packages it couldn't install.
+func restorePackages(ctx context.Context, m packageManifest, out io.Writer) int {
+	installed := installedPackages(ctx)
+	failed := 0
+	for _, pm := range packageManagers {
+		missing := make(map[string]string)
+		for pkg, version := range m.Packages[pm.name] {
+			if have, ok := installed[pm.name][pkg]; !ok || (pm.pins && have != version) {
+				missing[pkg] = version
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if _, ok := installed[pm.name]; !ok {
+			fmt.Fprintf(out, "%s isn't installed; skipping %d packages\n", pm.name, len(missing))
+			failed += len(missing)
+			packagesRestored.add(float64(len(missing)), "manager", pm.name, "outcome", "skipped")
+			continue
+		}
+		if err := pm.install(ctx, missing, out); err != nil {
+			fmt.Fprintf(out, "installing %s packages: %v\n", pm.name, err)
+			failed += len(missing)
+			packagesRestored.add(float64(len(missing)), "manager", pm.name, "outcome", "failed")
+			continue
+		}
+		packagesRestored.add(float64(len(missing)), "manager", pm.name, "outcome", "installed")
+	}
+	return failed
+}
+
+// startPackageRestore reinstalls the manifest's packages as a job.
+func startPackageRestore() (jobInfo, error) {
+	m, err := readPackages()
+	if err != nil {
+		return jobInfo{}, err
+	}
+	j, err := launchJob(jobInfo{ID: newTimeID(), Argv: []string{"dos3-packages", "restore"}}, func(ctx context.Context, _ *runningJob, stdout, stderr io.Writer) (int, error) {
+		if failed := restorePackages(ctx, m, stdout); failed > 0 {
+			fmt.Fprintf(stderr, "%d packages were not restored\n", failed)
+			return 1, nil
+		}
+		return 0, ctx.Err()
+	})
+	if err != nil {
+		return jobInfo{}, err
+	}
+	infof("Job %s started: restoring the packages recorded on %s", j.ID, m.Recorded.Format(time.RFC3339))
+	return j, nil
+}
+
+// restorePackagesAtBoot notes the image's packages, then reinstalls those
+// recorded in /data, if restore_packages allows and the workspace is
+// there.
+func restorePackagesAtBoot() {
+	recordPackageBaseline()
+	if !currentConfig().RestorePackages || degraded.status() != "" {
+		return
+	}
+	if _, err := startPackageRestore(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		warnf("Not restoring packages: %v", err)
+	}
+}
+
+func handleGetPackages(w http.ResponseWriter, r *http.Request) {
+	m, err := fsCall(r.Context(), readPackages)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+func handleRecordPackages(w http.ResponseWriter, r *http.Request) {
+	m, err := fsCall(r.Context(), func() (packageManifest, error) { return recordPackages(r.Context()) })
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+func handleRestorePackages(w http.ResponseWriter, r *http.Request) {
+	j, err := fsCall(r.Context(), startPackageRestore)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// runPackagesCommand is dos3-packages, run in a session as "server
+// packages".
+//
+//	dos3-packages save     record the packages installed since the image
+//	dos3-packages list     print the recorded packages
+//	dos3-packages restore  install the recorded packages that are missing
+func runPackagesCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: dos3-packages save | list | restore")
+		return 2
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "save":
+		m, err := recordPackages(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "dos3-packages:", err)
+			return 1
+		}
+		for _, name := range slices.Sorted(maps.Keys(m.Packages)) {
+			fmt.Printf("%s: %d packages\n", name, len(m.Packages[name]))
+		}
+		fmt.Printf("Recorded in %s; they are reinstalled when the container is replaced.\n", filepath.Join(dataDir, packagesFileName))
+	case "list":
+		m, err := readPackages()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "dos3-packages:", err)
+			return 1
+		}
+		for _, name := range slices.Sorted(maps.Keys(m.Packages)) {
+			for _, pkg := range slices.Sorted(maps.Keys(m.Packages[name])) {
+				fmt.Printf("%s\t%s\t%s\n", name, pkg, m.Packages[name][pkg])
+			}
+		}
+	case "restore":
+		m, err := readPackages()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "dos3-packages:", err)
+			return 1
+		}
+		if failed := restorePackages(ctx, m, os.Stdout); failed > 0 {
+			fmt.Fprintf(os.Stderr, "dos3-packages: %d packages were not restored\n", failed)
+			return 1
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "usage: dos3-packages save | list | restore")
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPackageSnapshot(t *testing.T) {
+	var mu sync.Mutex
+	installed := map[string]string{"git": "2.39", "curl": "7.88"}
+	var installs []map[string]string
+	prevManagers, prevBaseline := packageManagers, packagesBaselinePath
+	packageManagers = []packageManager{{
+		name: "fake",
+		list: func(context.Context) (map[string]string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return maps.Clone(installed), nil
+		},
+		install: func(_ context.Context, pkgs map[string]string, out io.Writer) error {
+			mu.Lock()
+			defer mu.Unlock()
+			installs = append(installs, pkgs)
+			maps.Copy(installed, pkgs)
+			fmt.Fprintln(out, "installed", len(pkgs))
+			return nil
+		},
+		pins: true,
+	}, {
+		name: "missing",
+		list: func(context.Context) (map[string]string, error) { return nil, exec.ErrNotFound },
+	}}
+	packagesBaselinePath = filepath.Join(t.TempDir(), "baseline.json")
+	defer func() { packageManagers, packagesBaselinePath = prevManagers, prevBaseline }()
+	defer os.Remove(filepath.Join(dataDir, packagesFileName))
+
+	// What the image has is the baseline; only what comes after is kept.
+	recordPackageBaseline()
+	mu.Lock()
+	installed["ripgrep"] = "14.1"
+	installed["curl"] = "8.5"
+	mu.Unlock()
+	resp, err := http.Post(testURL+"/v1/packages", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m packageManifest
+	json.NewDecoder(resp.Body).Decode(&m)
+	resp.Body.Close()
+	if want := map[string]map[string]string{"fake": {"ripgrep": "14.1", "curl": "8.5"}}; !maps.EqualFunc(m.Packages, want, maps.Equal) {
+		t.Fatalf("recorded %v, want %v", m.Packages, want)
+	}
+	if got, err := readPackages(); err != nil || !maps.EqualFunc(got.Packages, m.Packages, maps.Equal) {
+		t.Errorf("/data/%s = %+v, %v", packagesFileName, got, err)
+	}
+
+	// A new container has only the image's packages: the restore job puts
+	// back the rest.
+	mu.Lock()
+	installed = map[string]string{"git": "2.39", "curl": "7.88"}
+	mu.Unlock()
+	resp, err = http.Post(testURL+"/v1/packages/restore", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j jobInfo
+	json.NewDecoder(resp.Body).Decode(&j)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("restore: %s", resp.Status)
+	}
+	resp, err = http.Get(testURL + "/v1/jobs/" + j.ID + "/output?follow=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if j, err = readJob(j.ID); err != nil || j.ExitCode == nil || *j.ExitCode != 0 || !strings.Contains(string(out), "installed 2") {
+		t.Fatalf("restore job %+v, %v: %s", j, err, out)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(installs) != 1 || !maps.Equal(installs[0], map[string]string{"ripgrep": "14.1", "curl": "8.5"}) {
+		t.Errorf("installs = %v", installs)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// maxPasteFile caps a pasted file such as a screenshot.
+	maxPasteFile = 10 << 20
+	// pastesDir is where pasted files are written, relative to dataDir.
+	pastesDir = "pastes"
+)
+
+var errInvalidPaste = errors.New("invalid paste-file message")
+
+// pasteHeader starts a binary paste-file message on /ws: the JSON header, a
+// newline, then the file's bytes.
+//
+//	{"type":"paste-file","name":"screenshot.png","mime":"image/png"}\n<bytes>
+type pasteHeader struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	MIME string `json:"mime"`
+}
+
+func parsePasteMessage(data []byte) (pasteHeader, []byte, error) {
+	line, body, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return pasteHeader{}, nil, fmt.Errorf("%w: missing header", errInvalidPaste)
+	}
+	var h pasteHeader
+	if err := json.Unmarshal(line, &h); err != nil {
+		return pasteHeader{}, nil, fmt.Errorf("%w: %v", errInvalidPaste, err)
+	}
+	if h.Type != "paste-file" {
+		return pasteHeader{}, nil, fmt.Errorf("%w: unknown type %q", errInvalidPaste, h.Type)
+	}
+	return h, body, nil
+}
+
+// preferredExt overrides mime.ExtensionsByType, which returns extensions in
+// alphabetical order (".jfif" for JPEG).
+var preferredExt = map[string]string{
+	"image/jpeg": ".jpg",
+	"text/plain": ".txt",
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// pasteName builds a unique, shell-friendly file name from what the client
+// called the file and its type.
+func pasteName(name, mimeType string, data []byte) string {
+	base := strings.TrimSuffix(path.Base(filepath.ToSlash(name)), path.Ext(name))
+	base = strings.Trim(unsafeNameChars.ReplaceAllString(base, "-"), "-.")
+	if base == "" {
+		base = "paste"
+	}
+	if len(base) > 64 {
+		base = base[:64]
+	}
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" || unsafeNameChars.MatchString(ext[1:]) {
+		if mimeType == "" {
+			mimeType = http.DetectContentType(data)
+		}
+		mediaType, _, _ := mime.ParseMediaType(mimeType)
+		ext = preferredExt[mediaType]
+		if exts, _ := mime.ExtensionsByType(mediaType); ext == "" && len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	return fmt.Sprintf("%s-%s-%s%s", time.Now().UTC().Format("20060102T150405Z"), randomID()[:6], base, ext)
+}
+
+// pasteDir is where files pasted by r's user are saved: /data/pastes, or
+// for a user, pastes in their namespace or under their grants' home, which
+// they must be able to write.
+func pasteDir(r *http.Request) (string, error) {
+	dir := pastesDir
+	if grants := pathGrantsFromContext(r.Context()); grants != nil {
+		dir = path.Join(grants.home(), pastesDir)
+	}
+	return scopePathFor(r, dir, true)
+}
+
+// pasteFile saves a pasted file in dir, relative to /data, and types its
+// path into the PTY, followed by a space, so the user can hand it to the
+// program they are running.
+func (s *session) pasteFile(dir string, h pasteHeader, data []byte) (fileInfo, error) {
+	p := path.Join(dir, pasteName(h.Name, h.MIME, data))
+	fi, err := writeFile(p, bytes.NewReader(data), 0644)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	infof("Session %s pasted %s (%d bytes)", s.id, fi.Path, fi.Size)
+	return fi, s.write([]byte(dataDir + "/" + fi.Path + " "))
+}
+
+// handleSessionPaste is the HTTP form of a paste-file message for the SSE and
+// long-poll transports: the body is the file.
+func handleSessionPaste(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPasteFile))
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	h := pasteHeader{Name: r.URL.Query().Get("name"), MIME: r.Header.Get("Content-Type")}
+	ctx, cancel := mountContext(r)
+	defer cancel()
+	fi, err := fsCall(ctx, func() (fileInfo, error) { return sess.pasteFile(pastesDir, h, data) })
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, fi)
+}
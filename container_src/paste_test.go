@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// TestPasteDir checks that files pasted over /ws by a user stay where the
+// user may write.
+func TestPasteDir(t *testing.T) {
+	for _, tt := range []struct {
+		user, want string
+		paths      []string
+	}{
+		{"", pastesDir, nil},
+		{"alice", "users/alice/pastes", nil},
+		{"alice", "projects/foo/pastes", []string{"/data/shared/**:ro", "/data/projects/foo/**:rw"}},
+		{"alice", "", []string{"/data/shared/**:ro"}},
+	} {
+		grants, err := parsePathGrants(tt.paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r = r.WithContext(withIdentity(r.Context(), identity{User: tt.user, Paths: grants}))
+		dir, err := pasteDir(r)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s %v: pasted into %q, want refused", tt.user, tt.paths, dir)
+			}
+			continue
+		}
+		if err != nil || dir != tt.want {
+			t.Errorf("%s %v: %q %v, want %q", tt.user, tt.paths, dir, err, tt.want)
+		}
+	}
+}
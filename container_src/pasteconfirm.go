@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pasteConfirmTimeout is how long held input waits for the client's
+	// answer before it is discarded.
+	pasteConfirmTimeout = 2 * time.Minute
+	// maxPastePreview bounds the excerpt of held input shown to the user.
+	maxPastePreview = 512
+)
+
+// pasteConfirm asks a /ws client whether held input should be written to
+// the terminal ("paste_confirm"), or tells it the question lapsed
+// ("paste_expired"). The client answers a paste_confirm with the same ID
+// and accept set (see clientMessage).
+type pasteConfirm struct {
+	Type    string `json:"type"`
+	ID      int    `json:"id"`
+	Lines   int    `json:"lines,omitempty"`
+	Bytes   int    `json:"bytes,omitempty"`
+	Preview string `json:"preview,omitempty"`
+}
+
+// pasteGuard holds back input with at least lines line breaks until the
+// client confirms it, so a script pasted by accident isn't run one line at
+// a time. Input arriving while a paste is held queues behind it, so what
+// the user typed next still arrives in order whatever the answer.
+type pasteGuard struct {
+	lines int
+	write func([]byte) error
+	ask   func(pasteConfirm)
+
+	mu     sync.Mutex
+	next   int
+	id     int // of the held input; 0 when nothing is held
+	held   []byte
+	queued [][]byte
+	expiry *time.Timer
+}
+
+func newPasteGuard(lines int, write func([]byte) error, ask func(pasteConfirm)) *pasteGuard {
+	return &pasteGuard{lines: lines, write: write, ask: ask}
+}
+
+// input writes p, or holds it if it needs confirming.
+func (g *pasteGuard) input(p []byte) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.id != 0 {
+		g.queued = append(g.queued, bytes.Clone(p))
+		return nil
+	}
+	if n := lineBreaks(p); n >= g.lines {
+		g.hold(p, n)
+		return nil
+	}
+	return g.write(p)
+}
+
+// confirm handles the client's answer. Answers to anything but the held
+// input are stale and ignored.
+func (g *pasteGuard) confirm(id int, accept bool) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if id == 0 || id != g.id {
+		return nil
+	}
+	if !accept {
+		debugf("Discarding paste %d at the client's request", id)
+	}
+	return g.release(accept)
+}
+
+// stop discards anything held when the connection ends.
+func (g *pasteGuard) stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.expiry != nil {
+		g.expiry.Stop()
+	}
+	g.id, g.held, g.queued = 0, nil, nil
+}
+
+// hold keeps p and asks the client about it. Called with g.mu held.
+func (g *pasteGuard) hold(p []byte, lines int) {
+	g.next++
+	id := g.next
+	g.id, g.held = id, bytes.Clone(p)
+	g.expiry = time.AfterFunc(pasteConfirmTimeout, func() { g.expire(id) })
+	preview := p[:min(len(p), maxPastePreview)]
+	g.ask(pasteConfirm{
+		Type:    "paste_confirm",
+		ID:      id,
+		Lines:   lines,
+		Bytes:   len(p),
+		Preview: strings.ToValidUTF8(string(preview), ""),
+	})
+}
+
+func (g *pasteGuard) expire(id int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.id != id {
+		return
+	}
+	debugf("Discarding paste %d: not confirmed within %s", id, pasteConfirmTimeout)
+	g.ask(pasteConfirm{Type: "paste_expired", ID: id})
+	if err := g.release(false); err != nil {
+		ptyWarnf(err, "PTY write error: %v", err)
+	}
+}
+
+// release writes the held input if accepted, then the queued input up to
+// the next paste that needs confirming. Called with g.mu held.
+func (g *pasteGuard) release(accept bool) error {
+	held := g.held
+	g.id, g.held = 0, nil
+	g.expiry.Stop()
+	var err error
+	if accept {
+		err = g.write(held)
+	}
+	for err == nil && g.id == 0 && len(g.queued) > 0 {
+		p := g.queued[0]
+		g.queued = g.queued[1:]
+		if n := lineBreaks(p); n >= g.lines {
+			g.hold(p, n)
+		} else {
+			err = g.write(p)
+		}
+	}
+	return err
+}
+
+// lineBreaks counts the line breaks in terminal input, where Enter is CR
+// but pasted text may use LF or CRLF.
+func lineBreaks(p []byte) int {
+	n := 0
+	for i, b := range p {
+		if b == '\n' || (b == '\r' && (i+1 == len(p) || p[i+1] != '\n')) {
+			n++
+		}
+	}
+	return n
+}
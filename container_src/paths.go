@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A token's "paths" claim limits its user to parts of /data, in place of
+// their namespace, for sharing a subdirectory of the workspace:
+//
+//	"paths": ["/data/projects/foo/**:rw", "/data/shared/**:ro"]
+//
+// Each grant is a pattern over paths under /data, whose elements match as
+// in path.Match and where ** matches any number of them, then :rw to read
+// and write or :ro to read only. The file API and exec's cwd are held to
+// the grants; sessions and commands start in the first writable grant's
+// directory, which is also their HOME, but what shells do is not checked.
+const (
+	grantRead  = "ro"
+	grantWrite = "rw"
+	// authPathsHeader carries the grants, separated by commas, for the
+	// shared_secret provider.
+	authPathsHeader = "X-Auth-Paths"
+)
+
+var errPathNotGranted = errors.New("path not granted")
+
+type pathsKey struct{}
+
+// pathGrant is one element of a paths claim.
+type pathGrant struct {
+	// Pattern is relative to /data, split into elements.
+	Pattern []string
+	Write   bool
+}
+
+// pathGrants limits a user to some paths; nil doesn't limit them.
+type pathGrants []pathGrant
+
+// parsePathGrants reads a paths claim.
+func parsePathGrants(claim []string) (pathGrants, error) {
+	if claim == nil {
+		return nil, nil
+	}
+	grants := pathGrants{}
+	for _, c := range claim {
+		i := strings.LastIndexByte(c, ':')
+		if i < 0 || (c[i+1:] != grantRead && c[i+1:] != grantWrite) {
+			return nil, fmt.Errorf("path grant %q: want a pattern then :%s or :%s", c, grantRead, grantWrite)
+		}
+		rel, ok := strings.CutPrefix(c[:i], "/data")
+		if !ok || (rel != "" && rel[0] != '/') {
+			return nil, fmt.Errorf("path grant %q: want a path under /data", c)
+		}
+		g := pathGrant{Write: c[i+1:] == grantWrite}
+		if rel = strings.Trim(rel, "/"); rel != "" {
+			g.Pattern = strings.Split(rel, "/")
+		}
+		for _, elem := range g.Pattern {
+			if elem == "" || elem == "." || elem == ".." {
+				return nil, fmt.Errorf("path grant %q: want a clean path", c)
+			}
+			if _, err := path.Match(elem, ""); err != nil {
+				return nil, fmt.Errorf("path grant %q: %w", c, err)
+			}
+		}
+		grants = append(grants, g)
+	}
+	return grants, nil
+}
+
+// pathGrantsFromContext returns the grants a request is limited to, nil if
+// it isn't.
+func pathGrantsFromContext(ctx context.Context) pathGrants {
+	g, _ := ctx.Value(pathsKey{}).(pathGrants)
+	return g
+}
+
+// matchElems reports whether the path elements match pattern.
+func matchElems(pattern, elems []string) bool {
+	if len(pattern) == 0 {
+		return len(elems) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(elems); i++ {
+			if matchElems(pattern[1:], elems[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elems) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], elems[0])
+	return ok && matchElems(pattern[1:], elems[1:])
+}
+
+// allows reports whether rel, a path relative to /data, may be read, or
+// written too.
+func (gs pathGrants) allows(rel string, write bool) bool {
+	var elems []string
+	if rel != "" {
+		elems = strings.Split(rel, "/")
+	}
+	for _, g := range gs {
+		if (g.Write || !write) && matchElems(g.Pattern, elems) {
+			return true
+		}
+	}
+	return false
+}
+
+// base is the directory a grant's pattern starts with, relative to /data.
+func (g pathGrant) base() string {
+	var elems []string
+	for _, e := range g.Pattern {
+		if strings.ContainsAny(e, `*?[\`) {
+			break
+		}
+		elems = append(elems, e)
+	}
+	return strings.Join(elems, "/")
+}
+
+// isBase reports whether rel is the directory of one of the grants.
+func (gs pathGrants) isBase(rel string) bool {
+	for _, g := range gs {
+		if g.base() == rel {
+			return true
+		}
+	}
+	return false
+}
+
+// home is where the user's shells and commands start: the directory of the
+// first writable grant, or else of the first one.
+func (gs pathGrants) home() string {
+	for _, g := range gs {
+		if g.Write {
+			return g.base()
+		}
+	}
+	if len(gs) > 0 {
+		return gs[0].base()
+	}
+	return ""
+}
+
+// scope checks p, a file API path, against the grants, for writing or
+// just reading, and returns it relative to /data. A symlink is followed to
+// where it leads, which must be granted too.
+func (gs pathGrants) scope(p string, write bool) (string, error) {
+	if strings.ContainsRune(p, 0) {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	if rest, ok := strings.CutPrefix(p, dataDir); ok && (rest == "" || rest[0] == '/') {
+		p = rest
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+p), "/")
+	full, err := resolvePath(rel)
+	if err != nil {
+		return "", err
+	}
+	rel = relPath(full)
+	real, err := realRelPath(full)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range []string{rel, real} {
+		if !gs.allows(r, write) {
+			access := "reading"
+			if write {
+				access = "writing"
+			}
+			return "", fmt.Errorf("%w: %s /data/%s", errPathNotGranted, access, r)
+		}
+	}
+	return rel, nil
+}
+
+// realRelPath is full with the symlinks along it followed, relative to
+// /data; the part that doesn't exist yet is taken as it is. A link leading
+// out of /data is refused.
+func realRelPath(full string) (string, error) {
+	realData, err := filepath.EvalSymlinks(dataDir)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for p := full; ; p = filepath.Dir(p) {
+		real, err := filepath.EvalSymlinks(p)
+		if errors.Is(err, fs.ErrNotExist) && p != dataDir {
+			rest = filepath.Join(filepath.Base(p), rest)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		real = filepath.Join(real, rest)
+		if real == realData {
+			return "", nil
+		}
+		rel, ok := strings.CutPrefix(real, realData+string(filepath.Separator))
+		if !ok {
+			return "", fmt.Errorf("%w: %s leads outside /data", errOutsideData, relPath(full))
+		}
+		return filepath.ToSlash(rel), nil
+	}
+}
+
+// isWrite reports whether r changes the paths it names, as far as the
+// grants go: whatever isn't a GET or HEAD.
+func isWrite(r *http.Request) bool {
+	return r.Method != http.MethodGet && r.Method != http.MethodHead
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPathGrants(t *testing.T) {
+	t.Setenv("USER_TOKEN_SECRET", "s3cret")
+	for _, d := range []string{"projects/foo", "projects/bar", "shared"} {
+		if err := os.MkdirAll(filepath.Join(dataDir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.RemoveAll(filepath.Join(dataDir, "projects"))
+	defer os.RemoveAll(filepath.Join(dataDir, "shared"))
+	if err := os.WriteFile(filepath.Join(dataDir, "shared", "readme"), []byte("shared\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "projects", "bar", "secret"), []byte("bar's\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	token := signUserToken("s3cret", `{"user":"carol","paths":["/data/projects/foo/**:rw","/data/shared/**:ro"]}`)
+	do := func(method, path, body string, v any) int {
+		t.Helper()
+		req, err := http.NewRequest(method, testURL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(userTokenHeader, token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil && resp.StatusCode < 300 {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var fi fileInfo
+	if code := do("PUT", "/v1/files/projects/foo/main.go", "package main\n", &fi); code != http.StatusOK || fi.Path != "projects/foo/main.go" {
+		t.Fatalf("PUT in a rw grant = %d, %+v", code, fi)
+	}
+	if code := do("GET", "/v1/files/shared/readme", "", nil); code != http.StatusOK {
+		t.Fatalf("GET in a ro grant: %d", code)
+	}
+	if code := do("PUT", "/v1/files/shared/readme", "mine\n", nil); code != http.StatusForbidden {
+		t.Fatalf("PUT in a ro grant: %d, want 403", code)
+	}
+	if code := do("GET", "/v1/files/projects/bar/secret", "", nil); code != http.StatusForbidden {
+		t.Fatalf("GET outside the grants: %d, want 403", code)
+	}
+	if code := do("GET", "/v1/files/projects/foo/../bar/secret", "", nil); code != http.StatusForbidden {
+		t.Fatalf("GET climbing out of a grant: %d, want 403", code)
+	}
+	if code := do("DELETE", "/v1/files/projects/foo?recursive=1", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("deleting a grant's directory: %d", code)
+	}
+	// Copying only needs to read its source; a symlink leads only where the
+	// grants do.
+	var batch batchResponse
+	ops := `{"operations":[{"op":"copy","from":"shared/readme","to":"projects/foo/readme"}]}`
+	if code := do("POST", "/v1/files:batch", ops, &batch); code != http.StatusOK || !batch.OK {
+		t.Fatalf("copying from a ro grant = %d, %+v", code, batch)
+	}
+	if err := os.Symlink(filepath.Join(dataDir, "projects", "bar"), filepath.Join(dataDir, "projects", "foo", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if code := do("GET", "/v1/files/projects/foo/link/secret", "", nil); code != http.StatusForbidden {
+		t.Fatalf("GET through a symlink out of the grants: %d, want 403", code)
+	}
+
+	var res execResponse
+	if code := do("POST", "/v1/exec", `{"argv":["sh","-c","pwd; echo $HOME"]}`, &res); code != http.StatusOK {
+		t.Fatalf("exec: %d", code)
+	}
+	foo := filepath.Join(dataDir, "projects", "foo")
+	if want := foo + "\n" + foo + "\n"; res.Stdout != want {
+		t.Fatalf("exec printed %q, want %q", res.Stdout, want)
+	}
+	if code := do("POST", "/v1/exec", `{"argv":["true"],"cwd":"shared"}`, nil); code != http.StatusForbidden {
+		t.Fatalf("exec in a ro grant: %d, want 403", code)
+	}
+
+	bad := signUserToken("s3cret", `{"user":"carol","paths":["/etc/**:rw"]}`)
+	req, _ := http.NewRequest("GET", testURL+"/v1/files/shared/readme", nil)
+	req.Header.Set(userTokenHeader, bad)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("grant outside /data: %v, %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// envFileName is the file, at the root of /data or of a user's
+	// namespace, holding the variables persisted there.
+	envFileName = ".env"
+	// envFileVar names the file in a session's environment, for dos3-env.
+	envFileVar     = "DO_S3_ENV_FILE"
+	maxEnvVars     = 256
+	maxEnvValueLen = 32 << 10
+)
+
+var errInvalidEnv = errors.New("invalid environment variable")
+
+var validEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedEnv are the variables the server sets for each session, which
+// persisting would override.
+var reservedEnv = []string{"HOME", "PATH", "TERM", "COLORTERM", "TMPDIR", sessionEnv, jobEnv, envFileVar}
+
+// envVars is the body of GET and PATCH /v1/env. In a PATCH, variables are
+// merged, with null deleting one.
+type envVars struct {
+	Vars map[string]*string `json:"vars"`
+}
+
+// envFileMu serializes the server's changes to env files; dos3-env, run
+// from a shell, may still race with it, and the last write wins.
+var envFileMu sync.Mutex
+
+// envFile is the env file of user's namespace, or of /data.
+func envFile(user string) string {
+	if user != "" {
+		return filepath.Join(userRoot(user), envFileName)
+	}
+	return filepath.Join(dataDir, envFileName)
+}
+
+// readEnvFile returns the variables persisted in the file at p, none if it
+// doesn't exist.
+func readEnvFile(p string) (map[string]string, error) {
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseEnv(f)
+}
+
+// parseEnv reads the dotenv format formatEnv writes, and the common
+// hand-written variations: "export " prefixes, comments, and values in
+// double or single quotes or bare.
+func parseEnv(r io.Reader) (map[string]string, error) {
+	vars := make(map[string]string)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxEnvValueLen+1024)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		k, v, ok := strings.Cut(line, "=")
+		if !ok || !validEnvName.MatchString(k) {
+			return nil, fmt.Errorf("%w: line %d is not NAME=value", errInvalidEnv, n)
+		}
+		switch {
+		case len(v) >= 2 && v[0] == '\'' && strings.HasSuffix(v, "'"):
+			v = strings.ReplaceAll(v[1:len(v)-1], `'\''`, "'")
+		case len(v) >= 2 && v[0] == '"' && strings.HasSuffix(v, `"`):
+			v = unquoteEnv(v[1 : len(v)-1])
+		default:
+			if i := strings.Index(v, " #"); i >= 0 {
+				v = v[:i]
+			}
+			v = strings.TrimSpace(v)
+		}
+		vars[k] = v
+	}
+	return vars, sc.Err()
+}
+
+// unquoteEnv undoes the escapes of a double-quoted value.
+func unquoteEnv(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// envFileHeader starts every env file the server writes.
+const envFileHeader = "# Persisted environment, loaded into new sessions. Managed with dos3-env and /v1/env.\n"
+
+// formatEnv writes vars sorted by name, each value single-quoted, so the
+// file is also a shell script that can be sourced.
+func formatEnv(vars map[string]string) string {
+	var b strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(vars)) {
+		v := vars[k]
+		if strings.ContainsAny(v, "\n\r") {
+			// Single quotes can't hold a line break on one line.
+			r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`, "`", "\\`")
+			fmt.Fprintf(&b, "%s=\"%s\"\n", k, r.Replace(v))
+			continue
+		}
+		fmt.Fprintf(&b, "%s='%s'\n", k, strings.ReplaceAll(v, "'", `'\''`))
+	}
+	return b.String()
+}
+
+// checkEnvVar refuses names that aren't variable names or that the server
+// sets itself, and oversized values.
+func checkEnvVar(k, v string) error {
+	if !validEnvName.MatchString(k) {
+		return fmt.Errorf("%w: %q is not a variable name", errInvalidEnv, k)
+	}
+	if slices.Contains(reservedEnv, k) {
+		return fmt.Errorf("%w: %s is set by the server", errInvalidEnv, k)
+	}
+	if len(v) > maxEnvValueLen {
+		return fmt.Errorf("%w: %s is longer than %d bytes", errInvalidEnv, k, maxEnvValueLen)
+	}
+	return nil
+}
+
+// updateEnvFile merges patch into the file at p, nil values deleting, and
+// returns the variables it then holds.
+func updateEnvFile(p string, patch map[string]*string) (map[string]string, error) {
+	envFileMu.Lock()
+	defer envFileMu.Unlock()
+	vars, err := readEnvFile(p)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(vars, k)
+			continue
+		}
+		if err := checkEnvVar(k, *v); err != nil {
+			return nil, err
+		}
+		vars[k] = *v
+	}
+	if len(vars) > maxEnvVars {
+		return nil, fmt.Errorf("%w: more than %d variables", errInvalidEnv, maxEnvVars)
+	}
+	// Values are often secrets.
+	return vars, storeFile(p, strings.NewReader(envFileHeader+formatEnv(vars)), 0600)
+}
+
+// sessionEnvVars returns the persisted variables for a new session of
+// user's, as NAME=value. A file that can't be read is logged and skipped:
+// a shell without them beats no shell.
+func sessionEnvVars(user string) []string {
+	p := envFile(user)
+	vars, err := readEnvFile(p)
+	if err != nil {
+		warnf("Not loading persisted environment from %s: %v", relPath(p), err)
+		return nil
+	}
+	var env []string
+	for _, k := range slices.Sorted(maps.Keys(vars)) {
+		if checkEnvVar(k, vars[k]) == nil {
+			env = append(env, k+"="+vars[k])
+		}
+	}
+	return append(env, envFileVar+"="+p)
+}
+
+func handleGetEnv(w http.ResponseWriter, r *http.Request) {
+	vars, err := fsCall(r.Context(), func() (map[string]string, error) {
+		return readEnvFile(envFile(userFromContext(r.Context())))
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toEnvVars(vars))
+}
+
+func handlePatchEnv(w http.ResponseWriter, r *http.Request) {
+	var patch envVars
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&patch); err != nil {
+		httpError(w, r, "invalid env patch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	vars, err := fsCall(r.Context(), func() (map[string]string, error) {
+		return updateEnvFile(envFile(userFromContext(r.Context())), patch.Vars)
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toEnvVars(vars))
+}
+
+func toEnvVars(vars map[string]string) envVars {
+	out := envVars{Vars: make(map[string]*string, len(vars))}
+	for k, v := range vars {
+		out.Vars[k] = &v
+	}
+	return out
+}
+
+// runEnvCommand is dos3-env, run in a session as "server env": it edits
+// the session's env file, so variables set in one terminal are there in
+// every new one, and after restarts.
+//
+//	dos3-env set NAME[=VALUE]...  persist NAME, by default with its current value
+//	dos3-env unset NAME...        stop persisting NAME
+//	dos3-env list                 print the persisted variables
+func runEnvCommand(args []string) int {
+	p := os.Getenv(envFileVar)
+	if p == "" {
+		p = envFile("")
+	}
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "usage: dos3-env set NAME[=VALUE]... | unset NAME... | list")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	patch := make(map[string]*string)
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return usage()
+		}
+		vars, err := readEnvFile(p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "dos3-env:", err)
+			return 1
+		}
+		fmt.Print(formatEnv(vars))
+		return 0
+	case "set":
+		for _, arg := range args[1:] {
+			k, v, ok := strings.Cut(arg, "=")
+			if !ok {
+				if v, ok = os.LookupEnv(k); !ok {
+					fmt.Fprintf(os.Stderr, "dos3-env: %s is not set; export it first or give NAME=VALUE\n", k)
+					return 1
+				}
+			}
+			patch[k] = &v
+		}
+	case "unset":
+		for _, k := range args[1:] {
+			patch[k] = nil
+		}
+	default:
+		return usage()
+	}
+	if len(patch) == 0 {
+		return usage()
+	}
+	if _, err := updateEnvFile(p, patch); err != nil {
+		fmt.Fprintln(os.Stderr, "dos3-env:", err)
+		return 1
+	}
+	return 0
+}
+
+// envCommandDir holds the dos3-env and dos3-packages wrappers, put first
+// on every session's PATH.
+var envCommandDir = filepath.Join(os.TempDir(), "dos3-bin")
+
+// installEnvCommand writes the dos3-env and dos3-packages wrappers around
+// this binary.
+func installEnvCommand() {
+	exe, err := os.Executable()
+	if err == nil {
+		err = os.MkdirAll(envCommandDir, 0755)
+	}
+	for _, sub := range []string{"env", "packages"} {
+		if err == nil {
+			script := fmt.Sprintf("#!/bin/sh\nexec '%s' %s \"$@\"\n", strings.ReplaceAll(exe, "'", `'\''`), sub)
+			err = storeFile(filepath.Join(envCommandDir, "dos3-"+sub), strings.NewReader(script), 0755)
+		}
+		if err != nil {
+			warnf("dos3-%s will not be available in sessions: %v", sub, err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"server/container_src/client"
+	"server/container_src/internal/termtest"
+)
+
+func TestPersistedEnv(t *testing.T) {
+	t.Cleanup(func() { os.Remove(filepath.Join(dataDir, envFileName)) })
+	patch := func(body string) (envVars, int) {
+		t.Helper()
+		req, _ := http.NewRequest("PATCH", testURL+"/v1/env", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var v envVars
+		json.NewDecoder(resp.Body).Decode(&v)
+		return v, resp.StatusCode
+	}
+	v, code := patch(`{"vars": {"GREETING": "it's \"quoted\" $HOME", "MULTI": "a\nb", "GONE": "x"}}`)
+	if code != http.StatusOK || len(v.Vars) != 3 {
+		t.Fatalf("PATCH /v1/env: %d %+v", code, v.Vars)
+	}
+	if v, _ = patch(`{"vars": {"GONE": null}}`); len(v.Vars) != 2 || v.Vars["GONE"] != nil {
+		t.Errorf("after deleting GONE: %+v", v.Vars)
+	}
+	for _, body := range []string{`{"vars": {"1BAD": "x"}}`, `{"vars": {"TMPDIR": "/x"}}`} {
+		if _, code := patch(body); code != http.StatusBadRequest {
+			t.Errorf("PATCH %s: %d, want 400", body, code)
+		}
+	}
+
+	// The file round-trips, and is what dos3-env edits.
+	t.Setenv(envFileVar, filepath.Join(dataDir, envFileName))
+	t.Setenv("DATABASE_URL", "postgres://db/app")
+	if code := runEnvCommand([]string{"set", "DATABASE_URL", "MODE=dev"}); code != 0 {
+		t.Fatalf("dos3-env set exited %d", code)
+	}
+	vars, err := readEnvFile(filepath.Join(dataDir, envFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"GREETING": `it's "quoted" $HOME`, "MULTI": "a\nb", "DATABASE_URL": "postgres://db/app", "MODE": "dev"}
+	if !maps.Equal(vars, want) {
+		t.Errorf("env file holds %q, want %q", vars, want)
+	}
+	if code := runEnvCommand([]string{"unset", "MODE"}); code != 0 {
+		t.Fatalf("dos3-env unset exited %d", code)
+	}
+
+	// New sessions get them.
+	term := termtest.Open(t, dialTest(t), client.SessionOptions{})
+	term.Expect(`\$ `)
+	term.Send("echo \"[$DATABASE_URL|$GREETING|${MODE-unset}]\"\n")
+	term.Expect(regexp.QuoteMeta(`[postgres://db/app|it's "quoted" $HOME|unset]`))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// pipeChannel runs a program and pipes its stdin and stdout over a mux
+// channel, untouched: language servers and rsync speak their own protocols
+// over it, as they would over a local pipe or SSH.
+type pipeChannel struct {
+	name    string
+	traffic string // the kind its bytes are counted as
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	out     io.ReadCloser
+
+	once   sync.Once
+	exited chan struct{} // closed once the program has been reaped
+}
+
+// startPipe starts cmd, in its own process group so closing the channel
+// also stops anything it spawned.
+func startPipe(name, traffic string, cmd *exec.Cmd) (*pipeChannel, error) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.WaitDelay = 5 * time.Second
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s: %w", name, err)
+	}
+	return &pipeChannel{name: name, traffic: traffic, cmd: cmd, stdin: stdin, out: out, exited: make(chan struct{})}, nil
+}
+
+func (p *pipeChannel) pump(ctx context.Context, send func([]byte) error) error {
+	stop := context.AfterFunc(ctx, p.close)
+	defer stop()
+
+	buf := make([]byte, maxOutputFrame)
+	var err error
+	for {
+		n, rerr := p.out.Read(buf)
+		if n > 0 {
+			if err = send(buf[:n]); err != nil {
+				break
+			}
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	p.close()
+	werr := p.cmd.Wait()
+	close(p.exited)
+	infof("%s (pid %d) exited: %v", p.name, p.cmd.Process.Pid, p.cmd.ProcessState)
+	if err == nil && werr != nil && ctx.Err() == nil {
+		err = fmt.Errorf("%s exited: %w", p.name, werr)
+	}
+	return err
+}
+
+// write sends b to the program's stdin. Once the program has exited or
+// closed its stdin, writes are dropped: they'd only fail with EPIPE, and
+// pump reports how it ended.
+func (p *pipeChannel) write(b []byte) error {
+	_, err := p.stdin.Write(b)
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (p *pipeChannel) resize(cols, rows int) error { return nil }
+
+// key closes the program's stdin on "eof", for a client whose own input
+// has ended.
+func (p *pipeChannel) key(key string) error {
+	if key == keyEOF {
+		return p.stdin.Close()
+	}
+	return nil
+}
+
+// close asks the program to exit by closing its stdin, then kills its
+// process group if it is still running after a grace period.
+func (p *pipeChannel) close() {
+	p.once.Do(func() {
+		p.stdin.Close()
+		go func() {
+			select {
+			case <-p.exited:
+			case <-time.After(2 * time.Second):
+				syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+			}
+		}()
+	})
+}
+
+// pipeLogWriter logs a piped program's stderr at debug level.
+type pipeLogWriter struct {
+	name string
+}
+
+func (w *pipeLogWriter) Write(p []byte) (int, error) {
+	debugf("%s: %s", w.name, p)
+	return len(p), nil
+}
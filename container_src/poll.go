@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// pollWait is how long GET /poll/{id} holds a request open for output.
+	pollWait = 25 * time.Second
+	// pollIdleTimeout closes long-poll sessions whose client stopped polling.
+	pollIdleTimeout = 2 * time.Minute
+)
+
+// pollTracker remembers long-poll sessions so they can be reaped once their
+// client goes away, and so output is still readable after the shell exits.
+type pollTracker struct {
+	mu      sync.Mutex
+	entries map[string]*pollEntry
+}
+
+type pollEntry struct {
+	sess     *session
+	lastPoll time.Time
+}
+
+var polls = &pollTracker{entries: make(map[string]*pollEntry)}
+
+func (p *pollTracker) add(sess *session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries[sess.id] = &pollEntry{sess: sess, lastPoll: time.Now()}
+}
+
+// touch returns the session for id and marks it as recently polled. A
+// request scoped to a user only finds that user's sessions.
+func (p *pollTracker) touch(id, user string) *session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[id]
+	if !ok || (user != "" && e.sess.user != user) {
+		return nil
+	}
+	e.lastPoll = time.Now()
+	e.sess.active()
+	return e.sess
+}
+
+func (p *pollTracker) remove(id, user string) *session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[id]
+	if !ok || (user != "" && e.sess.user != user) {
+		return nil
+	}
+	delete(p.entries, id)
+	return e.sess
+}
+
+// reap closes sessions that haven't been polled within pollIdleTimeout.
+func (p *pollTracker) reap() {
+	for range time.Tick(pollIdleTimeout / 4) {
+		p.mu.Lock()
+		for id, e := range p.entries {
+			if time.Since(e.lastPoll) > pollIdleTimeout {
+				infof("Closing long-poll session %s: idle for %s", id, time.Since(e.lastPoll).Round(time.Second))
+				e.sess.close()
+				delete(p.entries, id)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+type pollResponse struct {
+	ID string `json:"id"`
+	// From is the offset of the first byte in Data. It is greater than the
+	// requested seq if older output was discarded.
+	From int64 `json:"from"`
+	// Seq is the offset to request next.
+	Seq  int64  `json:"seq"`
+	Data []byte `json:"data"`
+	// Exited is set once the shell has exited and all output was returned.
+	Exited bool `json:"exited"`
+}
+
+// handlePollStart starts a long-poll session: POST /v1/poll?cols=&rows=.
+// Output is read with GET /v1/poll/{id}?seq=N and input sent to
+// POST /v1/sessions/{id}/input, as for SSE.
+func handlePollStart(w http.ResponseWriter, r *http.Request) {
+	cols, rows, err := parseSize(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	meta, err := sessionMetaFromQuery(r.URL.Query())
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sess, err := sessions.startFor(r.Context(), cols, rows, meta)
+	if err != nil {
+		warnf("Failed to start session: %v (request %s)", err, requestID(r))
+		writeError(w, r, err)
+		return
+	}
+	polls.add(sess)
+	writeJSON(w, http.StatusCreated, pollResponse{ID: sess.id})
+}
+
+// handlePoll returns output after seq, waiting up to pollWait for some.
+func handlePoll(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	sess := polls.touch(id, userFromContext(r.Context()))
+	if sess == nil {
+		writeError(w, r, errSessionNotFound)
+		return
+	}
+	seq, err := strconv.ParseInt(r.URL.Query().Get("seq"), 10, 64)
+	if err != nil || seq < 0 {
+		httpError(w, r, "seq must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), pollWait)
+	defer cancel()
+	for {
+		data, next, wait := sess.output.read(seq, maxOutputFrame)
+		if len(data) > 0 || wait == nil {
+			sess.meterTraffic(trafficTerminal, "out", len(data))
+			writeJSON(w, http.StatusOK, pollResponse{
+				ID:     id,
+				From:   next - int64(len(data)),
+				Seq:    next,
+				Data:   data,
+				Exited: len(data) == 0,
+			})
+			return
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			writeJSON(w, http.StatusOK, pollResponse{ID: id, From: next, Seq: next})
+			return
+		}
+	}
+}
+
+// handlePollClose ends a long-poll session.
+func handlePollClose(w http.ResponseWriter, r *http.Request) {
+	sess := polls.remove(r.PathValue("id"), userFromContext(r.Context()))
+	if sess == nil {
+		writeError(w, r, errSessionNotFound)
+		return
+	}
+	sess.close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// prefetchFresh is how long a prefetched directory is left alone,
+	// roughly how long tigrisfs caches what it learned.
+	prefetchFresh = 30 * time.Second
+	// prefetchWorkers bounds the listings in flight, so prefetching doesn't
+	// crowd out what the user is actually doing.
+	prefetchWorkers = 4
+	// maxPrefetchSubdirs caps the subdirectories prefetched from one
+	// directory.
+	maxPrefetchSubdirs = 64
+	// cwdPoll is how often shells' working directories are checked.
+	cwdPoll = time.Second
+)
+
+var dirsPrefetched = newCounter("dos3_dir_prefetch_total",
+	"Directories listed ahead of use to warm the mount's metadata cache.")
+
+// dirPrefetcher lists directories the user is likely to visit next, so
+// the mount has their metadata cached by the time ls or cd gets there.
+// Every uncached lookup through tigrisfs is a round trip to the Durable
+// Object, which is what makes browsing a fresh directory feel slow. From
+// a directory being looked at, the likely next ones are its subdirectories
+// and its parent.
+type dirPrefetcher struct {
+	queue chan string
+
+	mu     sync.Mutex
+	recent map[string]time.Time
+}
+
+var prefetch = &dirPrefetcher{
+	queue:  make(chan string, 256),
+	recent: make(map[string]time.Time),
+}
+
+func (p *dirPrefetcher) start() {
+	for range prefetchWorkers {
+		go func() {
+			for dir := range p.queue {
+				p.warm(dir)
+			}
+		}()
+	}
+	go p.followShells()
+}
+
+// visit notes that dir is being looked at. With self set (after a cd, say)
+// dir itself is prefetched too.
+func (p *dirPrefetcher) visit(dir string, self bool) {
+	if !mountReady.Load() || !flags.enabled(flagDirPrefetch) {
+		return
+	}
+	go func() {
+		if self {
+			p.enqueue(dir)
+		}
+		if dir != dataDir {
+			p.enqueue(filepath.Dir(dir))
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		n := 0
+		for _, e := range entries {
+			if !e.IsDir() || skipDir(e.Name()) {
+				continue
+			}
+			if n++; n > maxPrefetchSubdirs {
+				break
+			}
+			p.enqueue(filepath.Join(dir, e.Name()))
+		}
+	}()
+}
+
+// enqueue schedules dir unless it was prefetched recently. The queue is
+// bounded; what doesn't fit is skipped.
+func (p *dirPrefetcher) enqueue(dir string) {
+	p.mu.Lock()
+	now := time.Now()
+	if t, ok := p.recent[dir]; ok && now.Sub(t) < prefetchFresh {
+		p.mu.Unlock()
+		return
+	}
+	p.recent[dir] = now
+	if len(p.recent) > 4096 {
+		for d, t := range p.recent {
+			if now.Sub(t) >= prefetchFresh {
+				delete(p.recent, d)
+			}
+		}
+	}
+	p.mu.Unlock()
+	select {
+	case p.queue <- dir:
+	default:
+		p.mu.Lock()
+		delete(p.recent, dir)
+		p.mu.Unlock()
+	}
+}
+
+// warm lists dir and stats its entries, as ls -l would.
+func (p *dirPrefetcher) warm(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		e.Info()
+	}
+	dirsPrefetched.add(1)
+}
+
+// followShells prefetches around each session's working directory when
+// its shell changes directory.
+func (p *dirPrefetcher) followShells() {
+	cwds := make(map[int]string)
+	for range time.Tick(cwdPoll) {
+		shells := sessions.shells()
+		for pid := range cwds {
+			if _, ok := shells[pid]; !ok {
+				delete(cwds, pid)
+			}
+		}
+		for pid := range shells {
+			cwd, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/cwd")
+			if err != nil || cwd == cwds[pid] {
+				continue
+			}
+			cwds[pid] = cwd
+			if cwd == dataDir || strings.HasPrefix(cwd, dataDir+"/") {
+				p.visit(cwd, true)
+			}
+		}
+	}
+}
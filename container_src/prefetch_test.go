@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestDirPrefetch checks which directories are queued from one being
+// looked at: its parent and subdirectories, itself after a cd, each once
+// while fresh, and none with the dir_prefetch flag off.
+func TestDirPrefetch(t *testing.T) {
+	mountReady.Store(true)
+	t.Cleanup(func() { mountReady.Store(false) })
+	setFlag(t, flagDirPrefetch, true)
+	dir := filepath.Join(dataDir, "prefetch")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for _, d := range []string{"src", "docs", ".git", "src/deep"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "README"), nil, 0644)
+
+	// No workers: the test takes what's queued.
+	p := &dirPrefetcher{queue: make(chan string, 256), recent: make(map[string]time.Time)}
+	queued := func(n int) []string {
+		t.Helper()
+		var got []string
+		for len(got) < n {
+			select {
+			case d := <-p.queue:
+				got = append(got, d)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("queued %v, want %d directories", got, n)
+			}
+		}
+		select {
+		case d := <-p.queue:
+			t.Errorf("queued %s as well as %v", d, got)
+		case <-time.After(100 * time.Millisecond):
+		}
+		slices.Sort(got)
+		return got
+	}
+
+	p.visit(dir, true)
+	want := []string{dataDir, dir, filepath.Join(dir, "docs"), filepath.Join(dir, "src")}
+	if got := queued(len(want)); !slices.Equal(got, want) {
+		t.Errorf("visiting %s queued %v, want %v", dir, got, want)
+	}
+	// Only what wasn't queued just now.
+	p.visit(filepath.Join(dir, "src"), false)
+	want = []string{filepath.Join(dir, "src", "deep")}
+	if got := queued(len(want)); !slices.Equal(got, want) {
+		t.Errorf("visiting src queued %v, want %v", got, want)
+	}
+
+	setFlag(t, flagDirPrefetch, false)
+	p = &dirPrefetcher{queue: make(chan string, 256), recent: make(map[string]time.Time)}
+	p.visit(dir, true)
+	queued(0)
+
+	before := dirsPrefetched.get()
+	p.warm(dir)
+	if n := dirsPrefetched.get() - before; n != 1 {
+		t.Errorf("dos3_dir_prefetch_total went up by %g, want 1", n)
+	}
+}
+
+// TestDirPrefetchQueueFull checks that a directory that didn't fit in the
+// queue can be queued again later, rather than counting as fresh.
+func TestDirPrefetchQueueFull(t *testing.T) {
+	p := &dirPrefetcher{queue: make(chan string, 1), recent: make(map[string]time.Time)}
+	p.enqueue("/data/a")
+	p.enqueue("/data/b")
+	<-p.queue
+	p.enqueue("/data/b")
+	if got := <-p.queue; got != "/data/b" {
+		t.Errorf("queued %s, want /data/b", got)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"server/container_src/errcode"
+)
+
+// problem is an error response in the RFC 9457 problem details format,
+// served as application/problem+json. Type identifies the failure for
+// clients to map to their own messages; Detail is for people, and may
+// change between releases. Code is set for the failures package errcode
+// names, which can be more precise than Type.
+type problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Code      errcode.Code `json:"code,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+// problemTypePrefix is prepended to a failure's name to form the problem
+// type URI.
+const problemTypePrefix = "urn:do-s3:problem:"
+
+// errorProblems names the server's errors more precisely than their status
+// codes do. The names are part of the API: add to them, don't rename.
+var errorProblems = []struct {
+	err  error
+	name string
+}{
+	{fs.ErrNotExist, "not-found"},
+	{fs.ErrExist, "already-exists"},
+	{fs.ErrPermission, "permission-denied"},
+	{errOutsideData, "outside-data"},
+	{errIsDir, "is-directory"},
+	{errEmptyCommand, "empty-command"},
+	{exec.ErrNotFound, "command-not-found"},
+	{errInvalidMetadata, "invalid-metadata"},
+	{errInvalidSize, "invalid-size"},
+	{errUnknownKey, "unknown-key"},
+	{errInvalidBatch, "invalid-batch"},
+	{errInvalidReplace, "invalid-replace"},
+	{errFileTooLarge, "file-too-large"},
+	{errJournalFull, "journal-full"},
+	{errTooManySessions, "too-many-sessions"},
+	{errUpgrading, "upgrading"},
+	{errSessionClosed, "session-closed"},
+	{errNoIDE, "ide-not-installed"},
+	{errNoBucket, "no-bucket"},
+	{errVersioningUnsupported, "versioning-unsupported"},
+	{errInvalidRestore, "invalid-restore"},
+	{errInvalidUpload, "invalid-upload"},
+	{errUploadOffset, "upload-offset-mismatch"},
+	{errInvalidChecksum, "invalid-checksum"},
+	{errInvalidPublish, "invalid-publish"},
+	{errInvalidEnv, "invalid-env"},
+	{errInvalidLock, "invalid-lock"},
+	{errLocked, "locked"},
+	{errPreconditionFailed, "precondition-failed"},
+	{errUserScope, "user-scoped"},
+	{errJobRunning, "job-running"},
+	{errNoNotifyURL, "no-notify-url"},
+	{errInvalidNotify, "invalid-notify"},
+	{errInvalidExport, "invalid-export"},
+	{errInvalidImport, "invalid-import"},
+	{errInvalidInjection, "invalid-injection"},
+	{errInvalidApproval, "invalid-approval"},
+	{errNoApprover, "no-approver"},
+	{errApprovalRequired, "approval-required"},
+	{errInvalidStateQuery, "invalid-state-query"},
+	{errNoState, "no-state"},
+	{errInvalidShare, "invalid-share"},
+	{errInvalidInputPolicy, "invalid-input-policy"},
+	{errInvalidSearch, "invalid-search"},
+	{errNameConflict, "name-conflict"},
+	{errInvalidMOTD, "invalid-motd"},
+	{errFrozen, "workspace-frozen"},
+	{errInvalidFreeze, "invalid-freeze"},
+	{errInvalidShutdown, "invalid-shutdown"},
+	{errInvalidWorkspaceFile, "invalid-workspace-file"},
+	{errPathNotGranted, "path-not-granted"},
+}
+
+// errorCodes gives the server's errors their stable codes (see package
+// errcode), shared with the Go client.
+var errorCodes = []struct {
+	err  error
+	code errcode.Code
+}{
+	{errNoBucket, errcode.MountNotReady},
+	{errSessionNotFound, errcode.SessionNotFound},
+	{errTooManySessions, errcode.QuotaExceeded},
+	{errJournalFull, errcode.QuotaExceeded},
+	{errAuthExpired, errcode.AuthExpired},
+}
+
+// errorCode is the stable code for err, "" if it has none.
+func errorCode(err error) errcode.Code {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return ""
+}
+
+// statusProblems names failures that are only known by their status code.
+var statusProblems = map[int]string{
+	http.StatusBadRequest:            "invalid-request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not-found",
+	http.StatusMethodNotAllowed:      "method-not-allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusRequestEntityTooLarge: "too-large",
+	http.StatusNotImplemented:        "not-implemented",
+	http.StatusBadGateway:            "bad-gateway",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "timeout",
+	http.StatusInsufficientStorage:   "insufficient-storage",
+}
+
+// problemName is the name of the failure behind err, answered with status.
+func problemName(err error, status int) string {
+	for _, p := range errorProblems {
+		if errors.Is(err, p.err) {
+			return p.name
+		}
+	}
+	if name, ok := statusProblems[status]; ok {
+		return name
+	}
+	return "internal"
+}
+
+// writeProblem sends a problem response for err, answered with status, named
+// and coded as above.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, err error) {
+	name, detail := problemName(err, status), err.Error()
+	h := w.Header()
+	// Headers set for the response that was meant to be sent don't apply.
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Del("ETag")
+	h.Set("Content-Type", "application/problem+json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if status >= 500 {
+		warnf("%s %s: %d %s (request %s)", r.Method, r.URL.Path, status, detail, requestID(r))
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{
+		Type:      problemTypePrefix + name,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    strings.TrimSpace(detail),
+		Code:      errorCode(err),
+		RequestID: requestID(r),
+	})
+}
+
+// httpError is http.Error as a problem response.
+func httpError(w http.ResponseWriter, r *http.Request, detail string, status int) {
+	writeProblem(w, r, status, errors.New(detail))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"server/container_src/client"
+	"server/container_src/errcode"
+)
+
+func TestProblemResponses(t *testing.T) {
+	req, _ := http.NewRequest("GET", testURL+"/v1/files/no/such/file", nil)
+	req.Header.Set("X-Request-Id", "req-123")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var p problem
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", ct)
+	}
+	want := problem{Type: "urn:do-s3:problem:not-found", Title: "Not Found", Status: 404, RequestID: "req-123"}
+	if p.Detail == "" {
+		t.Error("problem has no detail")
+	}
+	if p.Detail = ""; p != want {
+		t.Errorf("problem = %+v, want %+v", p, want)
+	}
+
+	// The client reports the problem's type.
+	_, err = dialTest(t).Stat(context.Background(), "no/such/file")
+	var e *client.Error
+	if !errors.As(err, &e) || e.Type != want.Type || e.Message == "" {
+		t.Errorf("Stat of a missing file: %#v, want a not-found problem", err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	ctx := context.Background()
+	c := dialTest(t)
+	_, err := c.Session(ctx, "no-such-session")
+	var e *client.Error
+	if !errors.As(err, &e) || e.Type != problemTypePrefix+"not-found" || !errors.Is(err, errcode.SessionNotFound) {
+		t.Errorf("missing session: %#v, want a not-found problem coded session-not-found", err)
+	}
+	if _, err := c.Versions(ctx, "anything"); !errors.Is(err, errcode.MountNotReady) {
+		t.Errorf("versions without a bucket: %v, want mount-not-ready", err)
+	}
+	if _, err := c.Stat(ctx, "no/such/file"); !errors.As(err, &e) || e.Code != "" {
+		t.Errorf("missing file: %#v, want no code", err)
+	}
+
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	cfg := *currentConfig()
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	// sess fills it, however many other tests' sessions are still closing.
+	cfg.MaxSessions = 1
+	if _, err := c.OpenSession(ctx, client.SessionOptions{}); !errors.Is(err, errcode.QuotaExceeded) {
+		t.Errorf("session over max_sessions: %v, want quota-exceeded", err)
+	}
+	if code := errorCode(errTooManySessions).CloseCode(); errcode.FromCloseCode(code) != errcode.QuotaExceeded {
+		t.Errorf("close code %d doesn't carry quota-exceeded", code)
+	}
+
+	t.Setenv("USER_TOKEN_SECRET", "s3cret")
+	_, err = client.Dial(ctx, testURL, &client.Options{Header: http.Header{
+		userTokenHeader: {signUserToken("s3cret", `{"user":"alice","exp":1}`)},
+	}})
+	if !errors.As(err, &e) || e.StatusCode != http.StatusUnauthorized || !errors.Is(err, errcode.AuthExpired) {
+		t.Errorf("expired token: %#v, want a 401 coded auth-expired", err)
+	}
+}
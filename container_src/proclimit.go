@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cgroupRoot is where cgroupfs is mounted: the v2 hierarchy itself, or a
+// directory of v1 hierarchies including pids/.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// procLimitNoticeInterval rate-limits the terminal notice while sessions
+// keep running into max_processes.
+const procLimitNoticeInterval = 10 * time.Second
+
+// procLimiter caps the number of processes across all sessions and exec
+// commands with a pids cgroup they're moved into, so a fork bomb in one
+// shell fails its forks instead of taking the container down. RLIMIT_NPROC
+// would be simpler but is per user and ignored for root, which is what
+// everything here runs as.
+type procLimiter struct {
+	// dir is the cgroup user processes are moved into.
+	dir string
+
+	mu       sync.Mutex
+	limit    int
+	failures int64 // fork failures counted in pids.events so far
+	noticed  time.Time
+}
+
+// procLimit is nil when no pids cgroup could be set up.
+var procLimit *procLimiter
+
+var forkFailures = newCounter("dos3_fork_failures_total",
+	"Forks that failed because max_processes was reached.")
+
+// setupProcLimit creates the cgroup for user processes. It must run before
+// anything else is started: on cgroup v2 the server moves itself into a leaf
+// cgroup first, since a cgroup with processes of its own can't delegate the
+// pids controller to its children.
+func setupProcLimit() {
+	dir, err := createProcCgroup()
+	if err != nil {
+		warnf("max_processes will not be enforced: %v", err)
+		return
+	}
+	procLimit = &procLimiter{dir: dir, limit: -1}
+	procLimit.apply()
+	go procLimit.watch()
+	debugf("Limiting user processes with cgroup %s", dir)
+}
+
+func createProcCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	var v1, v2 string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// hierarchy-ID:controller-list:path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		switch {
+		case parts[0] == "0" && parts[1] == "":
+			v2 = parts[2]
+		case strings.Contains(","+parts[1]+",", ",pids,"):
+			v1 = parts[2]
+		}
+	}
+
+	if v1 != "" {
+		dir := filepath.Join(cgroupRoot, "pids", v1, "do-s3-user")
+		return dir, os.MkdirAll(dir, 0755)
+	}
+	if v2 == "" {
+		return "", errors.New("no pids cgroup")
+	}
+	// After a binary upgrade the server is already in its leaf cgroup.
+	v2 = strings.TrimSuffix(v2, "/do-s3-server")
+	base := filepath.Join(cgroupRoot, v2)
+	controllers, err := os.ReadFile(filepath.Join(base, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(" "+strings.TrimSpace(string(controllers))+" ", " pids ") {
+		return "", fmt.Errorf("pids controller not available in %s", base)
+	}
+	server := filepath.Join(base, "do-s3-server")
+	if err := os.MkdirAll(server, 0755); err != nil {
+		return "", err
+	}
+	if err := writeCgroupFile(server, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+		return "", fmt.Errorf("moving the server out of %s: %w", base, err)
+	}
+	if err := writeCgroupFile(base, "cgroup.subtree_control", "+pids"); err != nil {
+		return "", fmt.Errorf("enabling the pids controller: %w", err)
+	}
+	dir := filepath.Join(base, "do-s3-user")
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	return os.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
+
+// add moves pid, just started, into the limited cgroup. Its children follow
+// it; anything it forked before the move is rare enough to ignore.
+func (l *procLimiter) add(pid int) {
+	if l == nil {
+		return
+	}
+	if err := writeCgroupFile(l.dir, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+		warnf("Moving process %d into %s: %v", pid, l.dir, err)
+	}
+}
+
+// apply writes max_processes to pids.max if it changed.
+func (l *procLimiter) apply() {
+	limit := currentConfig().MaxProcesses
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit == l.limit {
+		return
+	}
+	value := "max"
+	if limit > 0 {
+		value = strconv.Itoa(limit)
+	}
+	if err := writeCgroupFile(l.dir, "pids.max", value); err != nil {
+		warnf("Setting max_processes: %v", err)
+		return
+	}
+	l.limit = limit
+}
+
+// watch applies config reloads and tells every session when forks start
+// failing. The limit is shared, so every session is affected at once.
+func (l *procLimiter) watch() {
+	for range time.Tick(time.Second) {
+		l.apply()
+		n, err := l.forkFailures()
+		if err != nil {
+			continue
+		}
+		l.mu.Lock()
+		failed := n - l.failures
+		l.failures = n
+		notify := failed > 0 && time.Since(l.noticed) >= procLimitNoticeInterval
+		if notify {
+			l.noticed = time.Now()
+		}
+		limit := l.limit
+		l.mu.Unlock()
+
+		if failed <= 0 {
+			continue
+		}
+		forkFailures.add(float64(failed))
+		if notify {
+			warnf("Process limit reached: %d fork(s) failed with max_processes=%d", failed, limit)
+			for _, s := range sessions.list() {
+				s.notice(fmt.Sprintf("Process limit reached (max_processes=%d): new processes cannot be started until some exit.", limit))
+			}
+		}
+	}
+}
+
+// forkFailures reads the "max" count from pids.events.
+func (l *procLimiter) forkFailures() (int64, error) {
+	f, err := os.Open(filepath.Join(l.dir, "pids.events"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "max "); ok {
+			return strconv.ParseInt(v, 10, 64)
+		}
+	}
+	return 0, sc.Err()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// procInfo is the part of /proc/<pid>/stat the process sweeps need.
+type procInfo struct {
+	pid, ppid, pgrp, sid int
+	comm                 string
+	state                byte
+	// start is the start time in clock ticks since boot; with pid it
+	// identifies a process across pid reuse.
+	start uint64
+}
+
+// listProcs returns every process visible in /proc.
+func listProcs() ([]procInfo, error) {
+	paths, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return nil, err
+	}
+	procs := make([]procInfo, 0, len(paths))
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue // exited while we looked
+		}
+		if pi, ok := parseProcStat(string(data)); ok {
+			procs = append(procs, pi)
+		}
+	}
+	return procs, nil
+}
+
+// procStat returns the process pid, if it is still around.
+func procStat(pid int) (procInfo, bool) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return procInfo{}, false
+	}
+	return parseProcStat(string(data))
+}
+
+// parseProcStat parses "pid (comm) state ppid pgrp session ...". comm may
+// itself contain spaces and parentheses, so it runs to the last ')'.
+func parseProcStat(s string) (procInfo, bool) {
+	open, end := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if open < 0 || end < open {
+		return procInfo{}, false
+	}
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 20 || fields[0] == "" {
+		return procInfo{}, false
+	}
+	pi := procInfo{comm: s[open+1 : end], state: fields[0][0]}
+	var err error
+	if pi.pid, err = strconv.Atoi(strings.TrimSpace(s[:open])); err != nil {
+		return procInfo{}, false
+	}
+	pi.ppid, _ = strconv.Atoi(fields[1])
+	pi.pgrp, _ = strconv.Atoi(fields[2])
+	pi.sid, _ = strconv.Atoi(fields[3])
+	pi.start, _ = strconv.ParseUint(fields[19], 10, 64)
+	return pi, true
+}
+
+// signalSession sends sig to every process in the Unix session sid, which
+// includes background jobs the shell moved into their own process groups.
+// It returns how many processes were signalled.
+func signalSession(sid int, sig syscall.Signal) int {
+	procs, err := listProcs()
+	if err != nil {
+		warnf("Listing processes: %v", err)
+		return 0
+	}
+	n := 0
+	self := os.Getpid()
+	for _, p := range procs {
+		if p.sid == sid && p.pid != self {
+			if syscall.Kill(p.pid, sig) == nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// sessionSweeps are the delays after a session ends at which leftover
+// processes from it are killed again, catching anything forked while the
+// first kill was in progress.
+var sessionSweeps = []time.Duration{10 * time.Second, time.Minute}
+
+// killSessionProcesses tears down everything the shell of session id (Unix
+// session sid) left running: SIGTERM, SIGKILL for anything still alive two
+// seconds later, then the follow-up sweeps.
+func killSessionProcesses(id string, sid int) {
+	n := signalSession(sid, syscall.SIGTERM)
+	if n == 0 {
+		return
+	}
+	infof("Session %s: terminating %d leftover process(es)", id, n)
+	time.Sleep(2 * time.Second)
+	if n := signalSession(sid, syscall.SIGKILL); n > 0 {
+		warnf("Session %s: killed %d process(es) that ignored SIGTERM", id, n)
+	}
+	go func() {
+		prev := time.Duration(0)
+		for _, d := range sessionSweeps {
+			time.Sleep(d - prev)
+			prev = d
+			if n := signalSession(sid, syscall.SIGKILL); n > 0 {
+				warnf("Session %s: sweep killed %d straggler process(es)", id, n)
+			}
+		}
+	}()
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxOSCBody bounds the OSC sequences the prompt scanner keeps; the
+// markers it wants are short, and longer ones (OSC 52 clipboards) are
+// someone else's.
+const maxOSCBody = 4096
+
+// bashPromptCommand and bashPS0 make bash mark its prompts with OSC 133,
+// the semantic prompt sequences of FinalTerm that iTerm2, VS Code and
+// others understand, and report its directory with OSC 7: after each
+// command, "D;<status>", the directory, then "A" as the prompt starts;
+// "C" as a command starts running. Before "D" the command line, from
+// history, goes out as VS Code's OSC 633 "E", when history has a new
+// entry. $? is restored for PS1.
+const (
+	bashPromptCommand = `__dos3_s=$?; __dos3_h=$(HISTTIMEFORMAT= history 1); __dos3_c=; [ "${__dos3_h%%[!0-9 ]*}" = "$__dos3_n" ] || __dos3_c=${__dos3_h#*[0-9]  }; __dos3_n=${__dos3_h%%[!0-9 ]*}; ` +
+		`printf '\033]633;E;%s\007\033]133;D;%s\007\033]7;file://%s%s\007\033]133;A\007' "${__dos3_c//[[:cntrl:]]/ }" "$__dos3_s" "${HOSTNAME:-localhost}" "$PWD"; (exit $__dos3_s)`
+	bashPS0 = `\e]133;C\a`
+)
+
+// promptState is what shell integration has reported about a session's
+// shell.
+type promptState struct {
+	// Cwd is the shell's directory as of its last prompt.
+	Cwd string `json:"cwd,omitempty"`
+	// ExitCode is the status of the last command run.
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Running is set from when a command starts until the shell prompts
+	// again.
+	Running bool `json:"running"`
+}
+
+// promptMessage reports a change of promptState to /ws control clients.
+type promptMessage struct {
+	Type string `json:"type"` // "prompt"
+	promptState
+}
+
+// shellIntegrationEnv returns the environment that makes shell report its
+// prompts, if it is one the server knows how to hook.
+func shellIntegrationEnv(shell string) []string {
+	if !currentConfig().ShellIntegration || filepath.Base(shell) != "bash" {
+		return nil
+	}
+	return []string{"PROMPT_COMMAND=" + bashPromptCommand, "PS0=" + bashPS0}
+}
+
+// promptScanner follows OSC 133 and OSC 7 sequences in a session's output,
+// which may split them across reads, and picks out the bells and the
+// OSC 9 and 777 notifications programs send for attention (see alerts.go).
+// Other OSC sequences, and other strings, are skipped.
+type promptScanner struct {
+	state   promptState
+	known   bool       // state has been reported at least once
+	scan    stripState // reuses the stripper's states
+	body    []byte
+	skipped bool // body outgrew maxOSCBody
+
+	// started is when the running command started, zero if none is, and
+	// command its command line once reported; finished collects the
+	// commands that ended until taken.
+	started  time.Time
+	command  string
+	finished []commandRecord
+	// alerts collects bells and notifications until taken.
+	alerts []alertMessage
+}
+
+// takeAlerts returns the bells and notifications seen since it was last
+// called.
+func (sc *promptScanner) takeAlerts() []alertMessage {
+	alerts := sc.alerts
+	sc.alerts = nil
+	return alerts
+}
+
+// takeFinished returns the commands that ended since it was last called.
+func (sc *promptScanner) takeFinished() []commandRecord {
+	cmds := sc.finished
+	sc.finished = nil
+	return cmds
+}
+
+// feed runs output through the scanner and reports whether the state
+// changed.
+func (sc *promptScanner) feed(p []byte) bool {
+	changed := false
+	for _, c := range p {
+		switch sc.scan {
+		case stripGround:
+			switch c {
+			case 0x1b:
+				sc.scan = stripEsc
+			case 0x07:
+				// A run of bells is one.
+				if n := len(sc.alerts); n == 0 || sc.alerts[n-1].Type != "bell" {
+					sc.alerts = append(sc.alerts, alertMessage{Type: "bell"})
+				}
+			}
+		case stripEsc:
+			switch c {
+			case ']':
+				sc.scan, sc.body, sc.skipped = stripString, sc.body[:0], false
+			case 'P', 'X', '^', '_':
+				// DCS, SOS, PM and APC strings, whose BELs aren't bells.
+				sc.scan, sc.body, sc.skipped = stripString, sc.body[:0], true
+			case 0x1b:
+			default:
+				sc.scan = stripGround
+			}
+		case stripString:
+			switch {
+			case c == 0x07:
+				changed = sc.end() || changed
+				sc.scan = stripGround
+			case c == 0x1b:
+				// ESC \ ends it; anything else after ESC aborts it.
+				sc.scan = stripStringEsc
+			case len(sc.body) < maxOSCBody:
+				sc.body = append(sc.body, c)
+			default:
+				sc.skipped = true
+			}
+		case stripStringEsc:
+			if c == '\\' {
+				changed = sc.end() || changed
+				sc.scan = stripGround
+			} else if c == ']' {
+				sc.scan, sc.body, sc.skipped = stripString, sc.body[:0], false
+			} else {
+				sc.scan = stripGround
+			}
+		}
+	}
+	return changed
+}
+
+// end applies a complete OSC sequence and reports whether it changed the
+// state.
+func (sc *promptScanner) end() bool {
+	if sc.skipped {
+		return false
+	}
+	before := sc.state
+	num, arg, _ := bytes.Cut(sc.body, []byte(";"))
+	switch string(num) {
+	case "7":
+		u, err := url.Parse(string(arg))
+		if err != nil || u.Scheme != "file" {
+			return false
+		}
+		sc.state.Cwd = u.Path
+	case "133":
+		kind, rest, _ := strings.Cut(string(arg), ";")
+		switch kind {
+		case "A":
+			sc.state.Running = false
+		case "C":
+			sc.state.Running = true
+			sc.started, sc.command = time.Now().UTC(), ""
+		case "D":
+			sc.state.Running = false
+			code, _, _ := strings.Cut(rest, ";")
+			var exit *int
+			if n, err := strconv.Atoi(code); err == nil {
+				exit = &n
+				sc.state.ExitCode = exit
+			}
+			sc.finish(exit)
+		default:
+			return false
+		}
+	case "9", "777":
+		if m, ok := parseNotification(string(num), string(arg)); ok {
+			sc.alerts = append(sc.alerts, m)
+		}
+		return false
+	case "633":
+		// Only the command line; the rest of VS Code's protocol repeats
+		// OSC 133.
+		if cmd, ok := strings.CutPrefix(string(arg), "E;"); ok && !sc.started.IsZero() {
+			sc.command = strings.TrimSpace(cmd)
+		}
+		return false
+	default:
+		return false
+	}
+	first := !sc.known
+	sc.known = true
+	return first || !samePrompt(before, sc.state)
+}
+
+// finish records the running command as ended, with exit if the shell
+// reported its status.
+// A "D" without a "C" before it ends nothing: it is the first prompt, or
+// a prompt after an empty line.
+func (sc *promptScanner) finish(exit *int) {
+	if sc.started.IsZero() {
+		return
+	}
+	now := time.Now().UTC()
+	sc.finished = append(sc.finished, commandRecord{
+		Command:    sc.command,
+		Cwd:        sc.state.Cwd,
+		Started:    sc.started,
+		Finished:   now,
+		DurationMS: now.Sub(sc.started).Milliseconds(),
+		ExitCode:   exit,
+	})
+	sc.started, sc.command = time.Time{}, ""
+}
+
+func samePrompt(a, b promptState) bool {
+	if a.Cwd != b.Cwd || a.Running != b.Running || (a.ExitCode == nil) != (b.ExitCode == nil) {
+		return false
+	}
+	return a.ExitCode == nil || *a.ExitCode == *b.ExitCode
+}
+
+// promptStatus returns what shell integration has reported, nil if it
+// hasn't, and a channel closed when that changes.
+func (s *session) promptStatus() (*promptState, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.promptChanged == nil {
+		s.promptChanged = make(chan struct{})
+	}
+	if s.prompt == nil {
+		return nil, s.promptChanged
+	}
+	p := *s.prompt
+	return &p, s.promptChanged
+}
+
+// setPrompt records a change reported by the session's shell.
+func (s *session) setPrompt(p promptState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prompt = &p
+	if s.promptChanged != nil {
+		close(s.promptChanged)
+		s.promptChanged = nil
+	}
+}
+
+// followPrompt sends the session's prompt state, once known, and every
+// change of it until ctx is done.
+func (s *session) followPrompt(ctx context.Context, send func(promptMessage)) {
+	for {
+		p, changed := s.promptStatus()
+		if p != nil {
+			send(promptMessage{Type: "prompt", promptState: *p})
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShellIntegration(t *testing.T) {
+	// Sequences split across reads are still followed, and others skipped.
+	var sc promptScanner
+	out := "\x1b]0;title\a\x1b]133;D;2\a\x1b]7;file://host/data/my%20dir\x1b\\\x1b]13"
+	if !sc.feed([]byte(out)) || sc.feed([]byte("3;A\a$ ")) {
+		t.Fatal("scanner missed the change, or reported one for a repeated state")
+	}
+	if sc.state.Cwd != "/data/my dir" || sc.state.ExitCode == nil || *sc.state.ExitCode != 2 || sc.state.Running {
+		t.Fatalf("scanned state = %+v", sc.state)
+	}
+
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("no bash")
+	}
+	t.Setenv("SHELL", bash)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws?control=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var id string
+	next := func() promptMessage {
+		t.Helper()
+		for {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m struct {
+				Type string `json:"type"`
+				ID   string `json:"id"`
+				promptState
+			}
+			if typ != websocket.TextMessage || json.Unmarshal(data, &m) != nil {
+				continue
+			}
+			if m.Type == "session" {
+				id = m.ID
+			}
+			if m.Type == "prompt" && !m.Running {
+				return promptMessage{m.Type, m.promptState}
+			}
+		}
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("cd /tmp; false\n"))
+	for m := next(); m.Cwd != "/tmp"; m = next() {
+		if m.Cwd != dataDir {
+			t.Fatalf("prompt = %+v", m)
+		}
+	}
+	info, err := dialTest(t).Session(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Prompt == nil || info.Prompt.Cwd != "/tmp" || info.Prompt.ExitCode == nil || *info.Prompt.ExitCode != 1 {
+		t.Errorf("session prompt = %+v", info.Prompt)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// h2cTransport talks HTTP/2 without TLS to workspace servers. It is used for
+// gRPC, which needs HTTP/2 end to end; everything else is proxied over
+// HTTP/1.1, which any server understands.
+var h2cTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return t
+}()
+
+// handleProxy forwards /proxy/{port}/... to a server listening on that port
+// inside the container, so apps users run in the workspace (and the managed
+// IDE) are reachable through the container's single exposed port. {port} may
+// also be a name the workspace file gives a port. The /proxy/{port} prefix
+// is stripped; WebSocket upgrades are passed through, and gRPC requests
+// (over h2c) are forwarded over h2c.
+func handleProxy(w http.ResponseWriter, r *http.Request) {
+	port, err := strconv.Atoi(r.PathValue("port"))
+	if err != nil {
+		if port = workspace.current().Ports[r.PathValue("port")]; port == 0 {
+			httpError(w, r, "no port is named "+r.PathValue("port"), http.StatusNotFound)
+			return
+		}
+	}
+	if port <= 0 || port > 65535 {
+		httpError(w, r, "invalid port", http.StatusBadRequest)
+		return
+	}
+	prefix := "/proxy/" + r.PathValue("port")
+	target := &url.URL{Scheme: "http", Host: "127.0.0.1:" + strconv.Itoa(port)}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+			pr.Out.URL.RawPath = ""
+			pr.Out.Host = r.Host
+			pr.SetXForwarded()
+			pr.Out.Header.Set("X-Forwarded-Prefix", prefix)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			debugf("Proxy to port %d failed: %v", port, err)
+			httpError(w, r, "nothing is listening on port "+strconv.Itoa(port), http.StatusBadGateway)
+		},
+	}
+	if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		proxy.Transport = h2cTransport
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	"server/container_src/terminalpb"
+)
+
+// TestProxyGRPC calls a gRPC server in the workspace through /proxy over
+// h2c, as a user app's gRPC client behind the Worker would.
+func TestProxyGRPC(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	terminalpb.RegisterTerminalServer(srv, &terminalServer{})
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	// An empty ListSessionsRequest, in gRPC's length-prefixed framing.
+	req, _ := http.NewRequest("POST", testURL+"/proxy/"+port+"/dos3.terminal.v1.Terminal/ListSessions",
+		bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := (&http.Client{Transport: h2cTransport}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK || resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Fatalf("gRPC through the proxy: %s %s, grpc-status %q %q", resp.Proto, resp.Status,
+			resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message"))
+	}
+}
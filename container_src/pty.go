@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/creack/pty"
+)
+
+// pollablePTY re-opens a PTY master from pty.Start in non-blocking mode so
+// it goes through the runtime poller. pty leaves the descriptor blocking,
+// and closing a blocking file doesn't interrupt a Read in progress: a shell
+// that ignores SIGHUP (or a background job holding the terminal) would then
+// keep the session's reader, and so its teardown, stuck forever.
+func pollablePTY(f *os.File) (*os.File, error) {
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+// setWinsize is pty.Setsize without calling f.Fd(), which would switch the
+// descriptor back to blocking mode.
+func setWinsize(f *os.File, cols, rows int) error {
+	sc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ws := pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)}
+	var errno syscall.Errno
+	if err := sc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// resizePTY sets the size of the terminal on PTY master f, the same way for
+// every channel backed by a PTY. The kernel signals SIGWINCH to the
+// terminal's foreground process group only when the size changes; redraw
+// signals it regardless, for a client attaching, which needs the screen
+// drawn for it even at the size it already had.
+func resizePTY(f *os.File, cols, rows int, redraw bool) error {
+	if err := setWinsize(f, cols, rows); err != nil {
+		return err
+	}
+	if redraw {
+		return signalForeground(f, syscall.SIGWINCH)
+	}
+	return nil
+}
+
+// Control keys a client can send by name instead of as the raw bytes, which
+// depend on the terminal's settings and are awkward to type on mobile.
+const (
+	keyInterrupt = "interrupt" // Ctrl-C
+	keyEOF       = "eof"       // Ctrl-D
+	keySuspend   = "suspend"   // Ctrl-Z
+)
+
+var errUnknownKey = errors.New("unknown control key")
+
+// checkKey rejects names other than the control keys above.
+func checkKey(key string) error {
+	switch key {
+	case keyInterrupt, keyEOF, keySuspend:
+		return nil
+	}
+	return fmt.Errorf("%w %q: must be %s, %s or %s", errUnknownKey, key, keyInterrupt, keyEOF, keySuspend)
+}
+
+// sendKey delivers a control key to the terminal on PTY master f. Interrupt
+// and suspend signal the foreground process group directly, so they work
+// even when the program has turned off ISIG or remapped the keys. EOF is
+// typed as the terminal's VEOF character: it only means end of file to a
+// line-buffered reader, and line editors such as readline treat it the
+// same way.
+func sendKey(f *os.File, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	switch key {
+	case keyInterrupt:
+		return signalForeground(f, syscall.SIGINT)
+	case keySuspend:
+		return signalForeground(f, syscall.SIGTSTP)
+	}
+	var t syscall.Termios
+	if err := ioctl(f, syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		return err
+	}
+	eof := t.Cc[syscall.VEOF]
+	if eof == 0 { // disabled
+		eof = 0x04
+	}
+	_, err := f.Write([]byte{eof})
+	return err
+}
+
+// signalForeground sends sig to the foreground process group of the
+// terminal on PTY master f.
+func signalForeground(f *os.File, sig syscall.Signal) error {
+	var pgrp int32
+	if err := ioctl(f, syscall.TIOCGPGRP, unsafe.Pointer(&pgrp)); err != nil {
+		return err
+	}
+	return syscall.Kill(-int(pgrp), sig)
+}
+
+// ioctl makes the ioctl req on f without calling f.Fd(), as setWinsize does.
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	sc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := sc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
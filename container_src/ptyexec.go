@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// execExit is how an interactive exec's command ended, reported as the
+// exit_code of its channel's "closed" message rather than as an error.
+type execExit struct{ code int }
+
+func (e *execExit) Error() string { return fmt.Sprintf("exited with code %d", e.code) }
+
+// execChannel is a command run on a PTY for a mux "exec" channel: an
+// interactive exec, such as an editor or a REPL, that resizes like a
+// session but ends with its command.
+type execChannel struct {
+	cmd  *exec.Cmd
+	ptmx *os.File
+
+	once   sync.Once
+	exited chan struct{} // closed once the command has been reaped
+}
+
+func openExecChannel(msg muxMessage, reply *muxMessage) (muxChannel, error) {
+	if len(msg.Argv) == 0 {
+		return nil, errEmptyCommand
+	}
+	dir, err := resolvePath(msg.Cwd)
+	if err != nil {
+		return nil, err
+	}
+	cols, rows := msg.Cols, msg.Rows
+	if cols == 0 && rows == 0 {
+		cols, rows = 80, 24
+	}
+	if cols, rows, err = fitSize(cols, rows); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(msg.Argv[0], msg.Argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(spawnEnv(), "TERM=xterm-256color", "COLORTERM=truecolor")
+	for k, v := range msg.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Cols: uint16(cols), Rows: uint16(rows)})
+	if err == nil {
+		if ptmx, err = pollablePTY(ptmx); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("starting %s: %w", msg.Argv[0], err)
+	}
+	procLimit.add(cmd.Process.Pid)
+	infof("Interactive exec of %s started (pid %d, %dx%d) in %s", msg.Argv[0], cmd.Process.Pid, cols, rows, dir)
+	reply.Cols, reply.Rows = cols, rows
+	return &execChannel{cmd: cmd, ptmx: ptmx, exited: make(chan struct{})}, nil
+}
+
+// pump sends the command's output until it and everything holding its
+// terminal is gone, then reports its exit code as an execExit.
+func (e *execChannel) pump(ctx context.Context, send func([]byte) error) error {
+	stop := context.AfterFunc(ctx, e.close)
+	defer stop()
+
+	buf := make([]byte, maxOutputFrame)
+	var err error
+	for {
+		n, rerr := e.ptmx.Read(buf)
+		if n > 0 {
+			if err = send(buf[:n]); err != nil {
+				e.close()
+				break
+			}
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	werr := e.cmd.Wait()
+	close(e.exited)
+	e.ptmx.Close()
+	infof("Interactive exec (pid %d) exited: %v", e.cmd.Process.Pid, e.cmd.ProcessState)
+	var exitErr *exec.ExitError
+	switch {
+	case err != nil:
+		return err
+	case werr == nil:
+		return &execExit{0}
+	case errors.As(werr, &exitErr) && exitErr.Exited():
+		return &execExit{exitErr.ExitCode()}
+	}
+	return werr
+}
+
+// write types p into the command's terminal, dropping it once the command
+// has gone, as pump reports how it ended.
+func (e *execChannel) write(p []byte) error {
+	_, err := e.ptmx.Write(p)
+	if ptyGone(err) {
+		return nil
+	}
+	return err
+}
+
+func (e *execChannel) resize(cols, rows int) error {
+	cols, rows, err := fitSize(cols, rows)
+	if err != nil {
+		return err
+	}
+	if err := resizePTY(e.ptmx, cols, rows, false); err != nil && !ptyGone(err) {
+		return err
+	}
+	return nil
+}
+
+func (e *execChannel) key(key string) error {
+	if err := sendKey(e.ptmx, key); err != nil && !ptyGone(err) {
+		return err
+	}
+	return nil
+}
+
+// close hangs up the command's terminal, as closing a session does, and
+// kills its process group if it is still running after a grace period.
+func (e *execChannel) close() {
+	e.once.Do(func() {
+		select {
+		case <-e.exited:
+			return
+		default:
+		}
+		pid := e.cmd.Process.Pid
+		syscall.Kill(-pid, syscall.SIGHUP)
+		go func() {
+			select {
+			case <-e.exited:
+			case <-time.After(2 * time.Second):
+				syscall.Kill(-pid, syscall.SIGKILL)
+			}
+		}()
+	})
+}
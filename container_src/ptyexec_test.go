@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMuxExec(t *testing.T) {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws/mux", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	// The command prints its size, then again on SIGWINCH, and exits 3.
+	script := `stty size; trap 'stty size; exit 3' WINCH; echo ready; while :; do sleep 0.05; done`
+	conn.WriteJSON(muxMessage{Type: "open", Channel: 7, Kind: "exec", Argv: []string{"sh", "-c", script}, Cols: 90, Rows: 20})
+	var out strings.Builder
+	var closed *muxMessage
+	readUntil := func(want string) {
+		t.Helper()
+		for !strings.Contains(out.String(), want) && closed == nil {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for %q: %v; got %q", want, err, out.String())
+			}
+			if typ == websocket.BinaryMessage {
+				if binary.BigEndian.Uint32(data) == 7 {
+					out.Write(data[4:])
+				}
+				continue
+			}
+			var msg muxMessage
+			json.Unmarshal(data, &msg)
+			if msg.Type == "closed" {
+				closed = &msg
+			}
+		}
+	}
+	readUntil("ready")
+	if !strings.Contains(out.String(), "20 90") {
+		t.Fatalf("started at %q, want 20 90", out.String())
+	}
+	conn.WriteJSON(muxMessage{Type: "resize", Channel: 7, Cols: 100, Rows: 30})
+	readUntil("30 100")
+	readUntil("never printed")
+	if closed == nil || closed.ExitCode == nil || *closed.ExitCode != 3 || closed.Error != "" {
+		t.Fatalf("closed %+v after %q", closed, out.String())
+	}
+
+	conn.WriteJSON(muxMessage{Type: "open", Channel: 8, Kind: "exec"})
+	closed = nil
+	readUntil("never printed")
+	if closed.Channel != 8 || closed.Error == "" {
+		t.Errorf("exec without argv: %+v", closed)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errInvalidPublish = errors.New("invalid publish request")
+
+type publishRequest struct {
+	// Path is the file or directory under /data to publish.
+	Path string `json:"path"`
+	// Name is where under publish_prefix it goes; Path by default.
+	Name string `json:"name,omitempty"`
+}
+
+type publishResult struct {
+	Path string `json:"path"`
+	// Key is the bucket key the file, or the directory's files, went to.
+	Key string `json:"key"`
+	// URL serves the file, or is the directory's files' common base.
+	URL   string `json:"url"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"`
+}
+
+// publish copies the file or directory at req.Path to publish_prefix in the
+// bucket, replacing what was published under the same name, so that its
+// URL stays the same as it is published again.
+func publish(ctx context.Context, req publishRequest) (publishResult, error) {
+	store := bucketStore.Load()
+	if store == nil {
+		return publishResult{}, errNoBucket
+	}
+	cfg := currentConfig()
+	full, err := resolvePath(req.Path)
+	if err != nil {
+		return publishResult{}, err
+	}
+	if full == dataDir {
+		return publishResult{}, fmt.Errorf("%w: cannot publish all of %s", errInvalidPublish, dataDir)
+	}
+	rel := relPath(full)
+	if rel+"/" == cfg.PublishPrefix || strings.HasPrefix(rel, cfg.PublishPrefix) {
+		return publishResult{}, fmt.Errorf("%w: %s is already under %s", errInvalidPublish, rel, cfg.PublishPrefix)
+	}
+	name := rel
+	if req.Name != "" {
+		name = path.Clean("/" + req.Name)[1:]
+		if name == "" {
+			return publishResult{}, fmt.Errorf("%w: name %q", errInvalidPublish, req.Name)
+		}
+	}
+	fi, err := os.Stat(full)
+	if err != nil {
+		return publishResult{}, err
+	}
+	res := publishResult{Path: rel, Key: cfg.PublishPrefix + name, URL: publicURL(cfg, cfg.PublishPrefix+name)}
+	put := func(src, key string) error {
+		f, err := openBulk(ctx, src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := store.PutObject(ctx, key, f, mime.TypeByExtension(path.Ext(key))); err != nil {
+			return fmt.Errorf("publishing %s: %w", relPath(src), err)
+		}
+		if fi, err := f.Stat(); err == nil {
+			res.Size += fi.Size()
+		}
+		res.Files++
+		return nil
+	}
+	if !fi.IsDir() {
+		return res, put(full, res.Key)
+	}
+	res.Key += "/"
+	res.URL += "/"
+	err = filepath.WalkDir(full, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Symlinks are skipped, not followed out of the directory.
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		sub, _ := filepath.Rel(full, p)
+		return put(p, res.Key+filepath.ToSlash(sub))
+	})
+	return res, err
+}
+
+// publicURL is where key is served: under publish_url, or by default the
+// bucket's own path-style URL, which only a public bucket serves, under the
+// prefix the workspace is scoped to.
+func publicURL(cfg *config, key string) string {
+	base, rest := cfg.PublishURL, strings.TrimPrefix(key, cfg.PublishPrefix)
+	if base == "" {
+		if store := bucketStore.Load(); store != nil {
+			base = store.Endpoint.JoinPath(store.Bucket).String()
+			key = store.Prefix + key
+		}
+		rest = key
+	}
+	segs := strings.Split(rest, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.Join(segs, "/")
+}
+
+func handlePublish(w http.ResponseWriter, r *http.Request) {
+	var req publishRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&req); err != nil {
+		httpError(w, r, "invalid publish request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := fsCall(r.Context(), func() (publishResult, error) { return publish(r.Context(), req) })
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	infof("Published %s as %s (%d files)", res.Path, res.Key, res.Files)
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"server/container_src/internal/s3test"
+)
+
+func TestPublish(t *testing.T) {
+	t.Cleanup(func() { bucketStore.Store(nil) })
+	publish := func(body string) (publishResult, *http.Response) {
+		t.Helper()
+		resp, err := http.Post(testURL+"/v1/publish", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var res publishResult
+		json.NewDecoder(resp.Body).Decode(&res)
+		return res, resp
+	}
+	if _, resp := publish(`{"path": "dist"}`); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("publishing without a bucket: %s", resp.Status)
+	}
+
+	store := s3test.NewServer(t).Client(t, "s3-test")
+	bucketStore.Store(store)
+	for name, data := range map[string]string{"dist/app.js": "js\n", "dist/css/a b.css": "css\n"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dataDir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dataDir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, resp := publish(`{"path": "dist"}`)
+	want := store.Endpoint.JoinPath("s3-test").String() + "/public/dist/"
+	if resp.StatusCode != http.StatusOK || res.Key != "public/dist/" || res.URL != want || res.Files != 2 || res.Size != 7 {
+		t.Fatalf("publishing a directory: %s %+v, want URL %s", resp.Status, res, want)
+	}
+	body, err := store.GetObject(context.Background(), "public/dist/css/a b.css", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "css\n" {
+		t.Errorf("published file has %q", data)
+	}
+
+	cfg := *currentConfig()
+	cfg.PublishURL = "https://files.example.com/"
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	res, resp = publish(`{"path": "dist/css/a b.css", "name": "latest/site.css"}`)
+	if resp.StatusCode != http.StatusOK || res.Key != "public/latest/site.css" || res.URL != "https://files.example.com/latest/site.css" {
+		t.Errorf("publishing a file by name: %s %+v", resp.Status, res)
+	}
+
+	for _, body := range []string{`{"path": "/"}`, `{"path": "../etc/passwd"}`} {
+		if _, resp := publish(body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("publish %s: %s, want 400", body, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// recordingsDir holds asciicast files for sessions started while the
+// recording flag is on. It is local scratch space, not the S3 mount.
+var recordingsDir = envOr("RECORDINGS_DIR", filepath.Join(os.TempDir(), "recordings"))
+
+// recordingsPrefix is where finished recordings are uploaded in the
+// workspace bucket.
+const recordingsPrefix = "recordings/"
+
+// recorder writes a session's output in asciicast v2 format.
+type recorder struct {
+	path  string
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	start time.Time
+	// pending is output held back until its line ends, so that redact
+	// patterns see secrets whole rather than split between PTY reads.
+	pending []byte
+}
+
+func newRecorder(name string, cols, rows int) (*recorder, error) {
+	if err := os.MkdirAll(recordingsDir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(recordingsDir, name+".cast")
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	rec := &recorder{path: path, f: f, w: bufio.NewWriter(f), start: time.Now()}
+	header, _ := json.Marshal(map[string]any{
+		"version":   2,
+		"width":     cols,
+		"height":    rows,
+		"timestamp": rec.start.Unix(),
+		"env":       map[string]string{"SHELL": getShell(), "TERM": "xterm-256color"},
+	})
+	rec.w.Write(header)
+	rec.w.WriteByte('\n')
+	return rec, nil
+}
+
+// reopenRecorder continues the recording at path, started at start, after
+// a binary upgrade.
+func reopenRecorder(path string, start time.Time) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{path: path, f: f, w: bufio.NewWriter(f), start: start}, nil
+}
+
+// flush writes out buffered events.
+func (r *recorder) flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	r.outputLocked(len(r.pending))
+	return r.w.Flush()
+}
+
+func (r *recorder) eventLocked(kind, data string) {
+	if r.f == nil {
+		return
+	}
+	line, _ := json.Marshal([]any{time.Since(r.start).Seconds(), kind, data})
+	r.w.Write(line)
+	r.w.WriteByte('\n')
+}
+
+// output records data, redacted. With redact patterns set it is recorded a
+// line at a time.
+func (r *recorder) output(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending = append(r.pending, data...)
+	n := len(r.pending)
+	if len(currentConfig().redact) > 0 && n < maxStripLine {
+		n = bytes.LastIndexByte(r.pending, '\n') + 1
+	}
+	r.outputLocked(n)
+}
+
+// outputLocked records the first n bytes of pending.
+func (r *recorder) outputLocked(n int) {
+	if n == 0 {
+		return
+	}
+	r.eventLocked("o", string(redact(r.pending[:n])))
+	r.pending = append(r.pending[:0], r.pending[n:]...)
+}
+
+func (r *recorder) resize(cols, rows int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outputLocked(len(r.pending))
+	r.eventLocked("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (r *recorder) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	r.outputLocked(len(r.pending))
+	err := r.w.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	r.f = nil
+	return err
+}
+
+// uploadRecording copies a finished recording to the bucket, retrying with
+// backoff, then removes the local copy and prunes expired recordings.
+func uploadRecording(path string) {
+	key := recordingsPrefix + filepath.Base(path)
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := putRecording(key, path)
+		if err == nil {
+			break
+		}
+		if attempt == 5 {
+			errorf("Giving up uploading recording %s, keeping it at %s: %v", key, path, err)
+			return
+		}
+		warnf("Uploading recording %s failed (attempt %d): %v", key, attempt, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	infof("Uploaded recording to %s", key)
+	if err := os.Remove(path); err != nil {
+		warnf("Failed to remove uploaded recording: %v", err)
+	}
+	pruneRecordings()
+}
+
+func putRecording(key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	return bucketStore.Load().PutObject(ctx, key, f, "application/x-asciicast")
+}
+
+// pruneRecordings deletes uploaded recordings older than recording_retention.
+func pruneRecordings() {
+	retention := currentConfig().RecordingRetention.Duration
+	if retention == 0 {
+		return
+	}
+	store := bucketStore.Load()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	objs, err := store.ListObjects(ctx, recordingsPrefix)
+	if err != nil {
+		warnf("Listing recordings for retention failed: %v", err)
+		return
+	}
+	cutoff := time.Now().Add(-retention)
+	for _, o := range objs {
+		if o.LastModified.IsZero() || o.LastModified.After(cutoff) {
+			continue
+		}
+		if err := store.DeleteObject(ctx, o.Key); err != nil {
+			warnf("Deleting expired recording %s failed: %v", o.Key, err)
+			continue
+		}
+		infof("Deleted recording %s (older than %s)", o.Key, retention)
+	}
+}
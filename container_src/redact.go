@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// redactPlaceholder replaces what a redact pattern matches.
+var redactPlaceholder = []byte("[redacted]")
+
+// compileRedact compiles the redact patterns from the config.
+func compileRedact(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %q: %w", p, err)
+		}
+		if re.MatchString("") {
+			return nil, fmt.Errorf("redact pattern %q matches empty text", p)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// redact replaces secrets in p, as the redact patterns find them, with
+// [redacted]: what a pattern's first group matched if it has groups, so
+// "password=(\S+)" keeps the "password=", or else its whole match. p is
+// returned as it is when nothing matches.
+func redact(p []byte) []byte {
+	for _, re := range currentConfig().redact {
+		matches := re.FindAllSubmatchIndex(p, -1)
+		if matches == nil {
+			continue
+		}
+		var out []byte
+		last := 0
+		for _, m := range matches {
+			start, end := m[0], m[1]
+			if len(m) > 2 {
+				start, end = m[2], m[3]
+			}
+			if start < last {
+				// The group didn't take part in the match.
+				continue
+			}
+			out = append(append(out, p[last:start]...), redactPlaceholder...)
+			last = end
+		}
+		p = append(out, p[last:]...)
+	}
+	return p
+}
+
+// redactString is redact for strings.
+func redactString(s string) string {
+	if len(currentConfig().redact) == 0 {
+		return s
+	}
+	return string(redact([]byte(s)))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxReplaceFiles caps the files a find-and-replace changes, or reports in
+// a dry run, unless the request asks for fewer.
+const maxReplaceFiles = 1000
+
+var errInvalidReplace = errors.New("invalid find-and-replace")
+
+type replaceRequest struct {
+	// Pattern is an RE2 regular expression, or plain text with Literal.
+	Pattern string `json:"pattern"`
+	// Replacement may refer to groups as $1 or ${name}, unless Literal.
+	Replacement string `json:"replacement"`
+	Literal     bool   `json:"literal,omitempty"`
+	// Path is the directory to search, relative to /data; empty for all of
+	// it.
+	Path string `json:"path,omitempty"`
+	// Glob selects files, matched against the path relative to Path, with
+	// ** for any number of directories ("src/**/*.ts"). A glob without a
+	// slash matches file names anywhere ("*.go"). Empty matches every file.
+	Glob string `json:"glob,omitempty"`
+	// DryRun reports the changes without writing them.
+	DryRun   bool `json:"dry_run,omitempty"`
+	MaxFiles int  `json:"max_files,omitempty"`
+}
+
+type replaceFile struct {
+	Path    string `json:"path"`
+	Matches int    `json:"matches"`
+	// Diff is the change as a unified diff, in dry runs.
+	Diff  string `json:"diff,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type replaceResponse struct {
+	Files   []replaceFile `json:"files"`
+	Matches int           `json:"matches"`
+	// Truncated is set when max_files stopped the search early.
+	Truncated bool `json:"truncated,omitempty"`
+	DryRun    bool `json:"dry_run,omitempty"`
+}
+
+// matchGlob reports whether rel, a slash-separated path, matches pattern.
+func matchGlob(pattern, rel string) bool {
+	if pattern == "" {
+		return true
+	}
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/"))
+}
+
+func matchSegments(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// skipDir reports whether a directory is never searched: version control
+// internals, and batches' trash.
+func skipDir(name string) bool {
+	return name == ".git" || strings.HasPrefix(name, batchTrashPrefix)
+}
+
+// handleReplace runs a regex find-and-replace over the files under path
+// matching glob. Doing it here saves clients reading every file over the
+// network; against the FUSE mount even that is slow enough to matter. Files
+// that look binary or exceed the diff limit are left alone.
+func handleReplace(w http.ResponseWriter, r *http.Request) {
+	var req replaceRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxInputBody)).Decode(&req); err != nil {
+		httpError(w, r, fmt.Sprintf("invalid JSON body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Pattern == "" {
+		writeError(w, r, fmt.Errorf("%w: pattern is required", errInvalidReplace))
+		return
+	}
+	pattern := req.Pattern
+	if req.Literal {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("%w: %v", errInvalidReplace, err))
+		return
+	}
+	if _, err := path.Match(strings.ReplaceAll(req.Glob, "**", "*"), ""); err != nil {
+		writeError(w, r, fmt.Errorf("%w: glob: %v", errInvalidReplace, err))
+		return
+	}
+	limit := maxReplaceFiles
+	if req.MaxFiles > 0 {
+		limit = min(req.MaxFiles, maxReplaceFiles)
+	}
+	root, err := resolvePath(req.Path)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// The walk runs to the end, or to the next file once the request is
+	// over; a stuck mount gets it abandoned here.
+	resp, err := fsCall(r.Context(), func() (replaceResponse, error) {
+		resp := replaceResponse{Files: []replaceFile{}, DryRun: req.DryRun}
+		errLimit := errors.New("limit reached")
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if p == root {
+					return err
+				}
+				return nil
+			}
+			if cerr := r.Context().Err(); cerr != nil {
+				return cerr
+			}
+			if d.IsDir() {
+				if p != root && skipDir(d.Name()) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, _ := filepath.Rel(root, p)
+			if !d.Type().IsRegular() || !matchGlob(req.Glob, filepath.ToSlash(rel)) {
+				return nil
+			}
+			if len(resp.Files) >= limit {
+				resp.Truncated = true
+				return errLimit
+			}
+			// Each file read is bulk work, charged at its size.
+			release, err := acquireSlot(r.Context(), classBulk)
+			if err != nil {
+				return err
+			}
+			defer release()
+			if info, err := d.Info(); err == nil {
+				if err := bulkWait(r.Context(), info.Size()); err != nil {
+					return err
+				}
+			}
+			if f, ok := replaceInFile(re, req, relPath(p)); ok {
+				resp.Files = append(resp.Files, f)
+				resp.Matches += f.Matches
+			}
+			return nil
+		})
+		if errors.Is(err, errLimit) {
+			err = nil
+		}
+		return resp, err
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// replaceInFile applies the replacement to one file, reporting false if it
+// has no matches or isn't a text file within the size limit.
+func replaceInFile(re *regexp.Regexp, req replaceRequest, p string) (replaceFile, bool) {
+	data, err := readDiffSide(p)
+	if err != nil {
+		if errors.Is(err, errFileTooLarge) {
+			return replaceFile{}, false
+		}
+		return replaceFile{Path: p, Error: err.Error()}, true
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return replaceFile{}, false
+	}
+	n := len(re.FindAllIndex(data, -1))
+	if n == 0 {
+		return replaceFile{}, false
+	}
+	var out []byte
+	if req.Literal {
+		out = re.ReplaceAllLiteral(data, []byte(req.Replacement))
+	} else {
+		out = re.ReplaceAll(data, []byte(req.Replacement))
+	}
+	f := replaceFile{Path: p, Matches: n}
+	if req.DryRun {
+		f.Diff = string(unifiedDiff("a/"+p, "b/"+p, data, out, defaultDiffContext))
+		return f, true
+	}
+	if bytes.Equal(data, out) {
+		return f, true
+	}
+	fi, err := statPath(p)
+	if err == nil {
+		_, err = writeFile(p, bytes.NewReader(out), os.FileMode(fi.Mode))
+	}
+	if err != nil {
+		f.Error = err.Error()
+	}
+	return f, true
+}
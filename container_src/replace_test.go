@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplace(t *testing.T) {
+	dir := filepath.Join(dataDir, "replace")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	files := map[string]string{
+		"a.go":         "x := foo(1)\ny := foo(22)\n",
+		"sub/b.go":     "return foo(3) + foo.Bar\n",
+		"sub/c.txt":    "foo(4)\n",
+		"image.bin":    "foo(5)\x00\x01",
+		".git/HEAD.go": "foo(6)\n",
+	}
+	write := func() {
+		for name, body := range files {
+			p := filepath.Join(dir, name)
+			os.MkdirAll(filepath.Dir(p), 0755)
+			if err := os.WriteFile(p, []byte(body), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	read := func(name string) string {
+		b, _ := os.ReadFile(filepath.Join(dir, name))
+		return string(b)
+	}
+	replace := func(req replaceRequest) (int, replaceResponse) {
+		t.Helper()
+		body, _ := json.Marshal(req)
+		resp, err := http.Post(testURL+"/v1/replace", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out replaceResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, out
+	}
+
+	// A regex with a group, over the Go files only.
+	write()
+	code, resp := replace(replaceRequest{Pattern: `foo\((\d+)\)`, Replacement: "bar($1)", Path: "replace", Glob: "*.go"})
+	if code != http.StatusOK || resp.Matches != 3 || len(resp.Files) != 2 {
+		t.Fatalf("regex replace: %d %+v", code, resp)
+	}
+	if got := read("a.go"); got != "x := bar(1)\ny := bar(22)\n" {
+		t.Errorf("a.go after the regex replace: %q", got)
+	}
+	if got := read("sub/b.go"); got != "return bar(3) + foo.Bar\n" {
+		t.Errorf("sub/b.go after the regex replace: %q", got)
+	}
+	if got := read("sub/c.txt"); got != files["sub/c.txt"] {
+		t.Errorf("file outside the glob changed: %q", got)
+	}
+	if got := read(".git/HEAD.go"); got != files[".git/HEAD.go"] {
+		t.Errorf("file under .git changed: %q", got)
+	}
+
+	// Literal: metacharacters match themselves and $1 isn't expanded.
+	write()
+	code, resp = replace(replaceRequest{Pattern: "foo(", Replacement: "$1(", Literal: true, Path: "replace/sub"})
+	if code != http.StatusOK || resp.Matches != 2 {
+		t.Fatalf("literal replace: %d %+v", code, resp)
+	}
+	if got := read("sub/b.go"); got != "return $1(3) + foo.Bar\n" {
+		t.Errorf("sub/b.go after the literal replace: %q", got)
+	}
+	if code, _ := replace(replaceRequest{Pattern: "foo(", Path: "replace"}); code != http.StatusBadRequest {
+		t.Errorf("the same pattern as a regex: %d, want 400", code)
+	}
+
+	// A dry run reports the diff and writes nothing.
+	write()
+	code, resp = replace(replaceRequest{Pattern: "foo", Replacement: "baz", Path: "replace", Glob: "sub/*.txt", DryRun: true})
+	if code != http.StatusOK || !resp.DryRun || len(resp.Files) != 1 {
+		t.Fatalf("dry run: %d %+v", code, resp)
+	}
+	if f := resp.Files[0]; f.Path != "replace/sub/c.txt" || !strings.Contains(f.Diff, "-foo(4)\n+baz(4)\n") {
+		t.Errorf("dry run's file: %+v", f)
+	}
+	if got := read("sub/c.txt"); got != files["sub/c.txt"] {
+		t.Errorf("dry run changed sub/c.txt: %q", got)
+	}
+
+	// Binary files are neither reported nor changed.
+	code, resp = replace(replaceRequest{Pattern: "foo", Replacement: "baz", Path: "replace", Glob: "*.bin"})
+	if code != http.StatusOK || len(resp.Files) != 0 {
+		t.Errorf("replace in a binary file: %d %+v", code, resp)
+	}
+	if got := read("image.bin"); got != files["image.bin"] {
+		t.Errorf("binary file changed: %q", got)
+	}
+}
+
+// TestReplaceUserScoped checks that users confined to a namespace can't
+// reach files outside it through a replace over all of /data.
+func TestReplaceUserScoped(t *testing.T) {
+	t.Setenv("USER_TOKEN_SECRET", "s3cret")
+	p := filepath.Join(dataDir, "replace-shared.txt")
+	if err := os.WriteFile(p, []byte("secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(p) })
+	for _, dryRun := range []bool{false, true} {
+		body, _ := json.Marshal(replaceRequest{Pattern: "secret", Replacement: "leaked", DryRun: dryRun})
+		req, _ := http.NewRequest("POST", testURL+"/v1/replace", bytes.NewReader(body))
+		req.Header.Set(userTokenHeader, userToken("s3cret", "mallory"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pr problem
+		json.NewDecoder(resp.Body).Decode(&pr)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden || pr.Type != problemTypePrefix+"user-scoped" {
+			t.Errorf("replace as a user (dry run %t): %s %q, want 403 user-scoped", dryRun, resp.Status, pr.Type)
+		}
+	}
+	if b, _ := os.ReadFile(p); string(b) != "secret\n" {
+		t.Errorf("file outside the user's namespace holds %q", b)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// requestIDHeader carries a request's ID, so a failure can be followed
+// through the Worker's, the Durable Object's and the container's logs. An
+// ID set upstream is kept; otherwise the server makes one.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLen bounds the IDs taken from clients, which end up in logs.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// withRequestID gives every request an ID: the client's X-Request-Id if it
+// sent a usable one, or a new one. It is echoed in the response, passed on
+// by the workspace proxy, and available to handlers from requestID.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = randomID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		debugf("%s %s (request %s)", r.Method, r.URL.Path, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID accepts IDs of printable ASCII, without spaces, that are
+// safe to log and to send on.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFrom is the ID of the request ctx belongs to, or "".
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID is r's ID, given it by withRequestID.
+func requestID(r *http.Request) string {
+	if id := requestIDFrom(r.Context()); id != "" {
+		return id
+	}
+	return r.Header.Get(requestIDHeader)
+}
+
+// grpcRequestID does for gRPC calls what withRequestID does for HTTP,
+// with the x-request-id metadata key.
+func grpcRequestID(ctx context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(requestIDHeader); len(v) > 0 {
+			id = v[0]
+		}
+	}
+	if !validRequestID(id) {
+		id = randomID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, id))
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func unaryRequestID(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx = grpcRequestID(ctx)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		debugf("%s failed: %v (request %s)", info.FullMethod, err, requestIDFrom(ctx))
+	}
+	return resp, err
+}
+
+func streamRequestID(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx := grpcRequestID(ss.Context())
+	err := handler(srv, &contextStream{ss, ctx})
+	if err != nil {
+		debugf("%s failed: %v (request %s)", info.FullMethod, err, requestIDFrom(ctx))
+	}
+	return err
+}
+
+// contextStream is a stream with ctx, which carries its request ID and
+// user, in place of its own context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context { return s.ctx }
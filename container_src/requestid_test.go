@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	get := func(id string) string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", testURL+"/v1/health", nil)
+		if id != "" {
+			req.Header.Set("X-Request-Id", id)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("X-Request-Id")
+	}
+	if id := get("from-the-worker"); id != "from-the-worker" {
+		t.Errorf("incoming ID answered with %q", id)
+	}
+	for _, sent := range []string{"", "has spaces", strings.Repeat("x", 200)} {
+		if id := get(sent); id == "" || id == sent {
+			t.Errorf("request with ID %q answered with %q, want a new ID", sent, id)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// resourceInterval is how often resource use is measured.
+	resourceInterval = 10 * time.Second
+	// resourceClearMargin is how far under resource_warning a resource must
+	// fall before rising again warns again.
+	resourceClearMargin = 5
+)
+
+var (
+	resourceUsed = newGauge("dos3_resource_used_percent",
+		"Container-wide use of cpu, memory, disk and inodes, as a percentage of what the container may use.")
+	resourceWarnings = newCounter("dos3_resource_warnings_total",
+		"Warnings shown in sessions that a resource is running out, by resource.")
+)
+
+// resourceUsage is the container's resource headroom, as last measured.
+type resourceUsage struct {
+	Measured time.Time `json:"measured"`
+	// CPUPercent is the CPU used over the last interval, as a percentage of
+	// CPUs: the container's CPU quota, or the machine's CPUs.
+	CPUPercent float64 `json:"cpu_percent"`
+	CPUs       float64 `json:"cpus"`
+	// MemoryBytes is the working set: memory in use, less page cache that
+	// can be reclaimed. MemoryLimitBytes is the container's limit, or the
+	// machine's memory.
+	MemoryBytes      int64 `json:"memory_bytes"`
+	MemoryLimitBytes int64 `json:"memory_limit_bytes"`
+	// Disk and inodes are of the container's root filesystem, where
+	// sessions' TMPDIRs and anything outside /data are kept.
+	DiskBytes      int64 `json:"disk_bytes"`
+	DiskTotalBytes int64 `json:"disk_total_bytes"`
+	Inodes         int64 `json:"inodes"`
+	InodesTotal    int64 `json:"inodes_total"`
+	// Low names the resources at or over resource_warning: memory, disk
+	// or inodes.
+	Low []string `json:"low,omitempty"`
+}
+
+// percent is how much of resource is used.
+func (u resourceUsage) percent(resource string) float64 {
+	ratio := func(used, total int64) float64 {
+		if total <= 0 {
+			return 0
+		}
+		return math.Round(1000*float64(used)/float64(total)) / 10
+	}
+	switch resource {
+	case "cpu":
+		return u.CPUPercent
+	case "memory":
+		return ratio(u.MemoryBytes, u.MemoryLimitBytes)
+	case "disk":
+		return ratio(u.DiskBytes, u.DiskTotalBytes)
+	case "inodes":
+		return ratio(u.Inodes, u.InodesTotal)
+	}
+	return 0
+}
+
+var resources struct {
+	mu       sync.Mutex
+	last     *resourceUsage
+	cpuTotal time.Duration // CPU used, cumulatively, at last
+	low      map[string]bool
+}
+
+// currentResources returns the last measurement, or nil before the first.
+func currentResources() *resourceUsage {
+	resources.mu.Lock()
+	defer resources.mu.Unlock()
+	if resources.last == nil {
+		return nil
+	}
+	u := *resources.last
+	return &u
+}
+
+// watchResources measures resource use forever.
+func watchResources() {
+	measureResources(time.Now())
+	for range time.Tick(resourceInterval) {
+		measureResources(time.Now())
+	}
+}
+
+// measureResources records the container's resource use, warning sessions
+// of any resource that has started running out.
+func measureResources(now time.Time) {
+	u := resourceUsage{Measured: now.UTC()}
+	cpuTotal, cpus := cpuUsage()
+	u.CPUs = cpus
+	u.MemoryBytes, u.MemoryLimitBytes = memoryUsage()
+	var st syscall.Statfs_t
+	if err := syscall.Statfs("/", &st); err == nil {
+		u.DiskTotalBytes = int64(st.Blocks) * st.Bsize
+		u.DiskBytes = u.DiskTotalBytes - int64(st.Bfree)*st.Bsize
+		u.InodesTotal = int64(st.Files)
+		u.Inodes = u.InodesTotal - int64(st.Ffree)
+	}
+
+	resources.mu.Lock()
+	if last := resources.last; last != nil && cpuTotal > 0 && cpus > 0 {
+		if elapsed := now.Sub(last.Measured); elapsed > 0 {
+			u.CPUPercent = math.Round(1000*float64(cpuTotal-resources.cpuTotal)/float64(elapsed)/cpus) / 10
+		}
+	}
+	resources.cpuTotal = cpuTotal
+	resources.mu.Unlock()
+	checkResources(&u, currentConfig().ResourceWarning)
+	for _, r := range []string{"cpu", "memory", "disk", "inodes"} {
+		resourceUsed.set(u.percent(r), "resource", r)
+	}
+}
+
+// checkResources fills in u.Low and records u as the latest measurement,
+// telling every session about resources that crossed threshold percent
+// since the last.
+func checkResources(u *resourceUsage, threshold int) {
+	resources.mu.Lock()
+	defer resources.mu.Unlock()
+	if resources.low == nil {
+		resources.low = make(map[string]bool)
+	}
+	var newlyLow []string
+	for _, r := range []string{"memory", "disk", "inodes"} {
+		p := u.percent(r)
+		switch {
+		case threshold > 0 && p >= float64(threshold):
+			u.Low = append(u.Low, r)
+			if !resources.low[r] {
+				resources.low[r] = true
+				newlyLow = append(newlyLow, r)
+			}
+		case threshold == 0 || p < float64(threshold-resourceClearMargin):
+			resources.low[r] = false
+		}
+	}
+	resources.last = u
+	for _, r := range newlyLow {
+		msg := resourceNotice(*u, r)
+		warnf("%s", msg)
+		resourceWarnings.add(1, "resource", r)
+		for _, s := range sessions.list() {
+			s.notice(msg)
+		}
+	}
+}
+
+// resourceNotice is the warning shown when resource runs low.
+func resourceNotice(u resourceUsage, resource string) string {
+	switch resource {
+	case "memory":
+		return fmt.Sprintf("Workspace is almost out of memory (%s of %s used): programs may be killed. Stop some to free memory.",
+			formatSize(u.MemoryBytes), formatSize(u.MemoryLimitBytes))
+	case "disk":
+		return fmt.Sprintf("Workspace disk is almost full (%s of %s used): writes outside /data may fail.",
+			formatSize(u.DiskBytes), formatSize(u.DiskTotalBytes))
+	default:
+		return fmt.Sprintf("Workspace is almost out of inodes (%d of %d files): creating files outside /data may fail.",
+			u.Inodes, u.InodesTotal)
+	}
+}
+
+// formatSize writes n bytes in binary units.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// cpuUsage returns the CPU time the container has used and how many CPUs it
+// may use, from cgroup v2 or v1, or else the machine's.
+func cpuUsage() (time.Duration, float64) {
+	cpus := float64(runtime.NumCPU())
+	var used time.Duration
+	if v, ok := readKeyed(filepath.Join(cgroupRoot, "cpu.stat"), "usage_usec"); ok {
+		used = time.Duration(v) * time.Microsecond
+		if f := strings.Fields(readString(filepath.Join(cgroupRoot, "cpu.max"))); len(f) == 2 && f[0] != "max" {
+			quota, _ := strconv.ParseFloat(f[0], 64)
+			period, _ := strconv.ParseFloat(f[1], 64)
+			if quota > 0 && period > 0 {
+				cpus = min(cpus, quota/period)
+			}
+		}
+		return used, cpus
+	}
+	if v, err := strconv.ParseInt(readString(filepath.Join(cgroupRoot, "cpuacct", "cpuacct.usage")), 10, 64); err == nil {
+		used = time.Duration(v)
+	}
+	quota, _ := strconv.ParseFloat(readString(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_quota_us")), 64)
+	period, _ := strconv.ParseFloat(readString(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_period_us")), 64)
+	if quota > 0 && period > 0 {
+		cpus = min(cpus, quota/period)
+	}
+	return used, cpus
+}
+
+// memoryUsage returns the container's working set and memory limit, from
+// cgroup v2 or v1, or else the machine's.
+func memoryUsage() (used, limit int64) {
+	total, available := meminfo()
+	limit, used = total, total-available
+	if cur, err := strconv.ParseInt(readString(filepath.Join(cgroupRoot, "memory.current")), 10, 64); err == nil {
+		inactive, _ := readKeyed(filepath.Join(cgroupRoot, "memory.stat"), "inactive_file")
+		used = cur - inactive
+		if l, err := strconv.ParseInt(readString(filepath.Join(cgroupRoot, "memory.max")), 10, 64); err == nil && l < limit {
+			limit = l
+		}
+	} else if cur, err := strconv.ParseInt(readString(filepath.Join(cgroupRoot, "memory", "memory.usage_in_bytes")), 10, 64); err == nil {
+		inactive, _ := readKeyed(filepath.Join(cgroupRoot, "memory", "memory.stat"), "total_inactive_file")
+		used = cur - inactive
+		// Unlimited is a huge number rather than "max".
+		if l, err := strconv.ParseInt(readString(filepath.Join(cgroupRoot, "memory", "memory.limit_in_bytes")), 10, 64); err == nil && l < limit {
+			limit = l
+		}
+	}
+	return max(used, 0), limit
+}
+
+// meminfo returns the machine's MemTotal and MemAvailable in bytes.
+func meminfo() (total, available int64) {
+	total, _ = readKeyed("/proc/meminfo", "MemTotal:")
+	available, _ = readKeyed("/proc/meminfo", "MemAvailable:")
+	return total * 1024, available * 1024
+}
+
+func readString(name string) string {
+	data, _ := os.ReadFile(name)
+	return strings.TrimSpace(string(data))
+}
+
+// readKeyed reads the number after key in a file of "key value" lines.
+func readKeyed(name, key string) (int64, bool) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if f := strings.Fields(sc.Text()); len(f) >= 2 && f[0] == key {
+			v, err := strconv.ParseInt(f[1], 10, 64)
+			return v, err == nil
+		}
+	}
+	return 0, false
+}
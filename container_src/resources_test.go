@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResourceHeadroom(t *testing.T) {
+	measureResources(time.Now())
+	u := currentResources()
+	if u == nil || u.CPUs <= 0 || u.MemoryBytes <= 0 || u.MemoryLimitBytes < u.MemoryBytes || u.DiskTotalBytes <= 0 || u.InodesTotal <= 0 {
+		t.Fatalf("measured %+v", u)
+	}
+	resp, err := http.Get(testURL + "/v1/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var health healthResponse
+	err = json.NewDecoder(resp.Body).Decode(&health)
+	resp.Body.Close()
+	if err != nil || health.Resources == nil || health.Resources.DiskTotalBytes != u.DiskTotalBytes {
+		t.Errorf("health resources = %+v, want %+v", health.Resources, u)
+	}
+
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	warnings := func() int {
+		data, _, _ := sess.output.read(0, 1<<20)
+		return strings.Count(string(data), "almost full")
+	}
+	disk := func(percent int64) *resourceUsage {
+		return &resourceUsage{DiskBytes: percent, DiskTotalBytes: 100}
+	}
+	defer checkResources(disk(0), 90)
+	for _, step := range []struct {
+		percent  int64
+		low      bool
+		warnings int
+	}{
+		{50, false, 0},
+		{95, true, 1},
+		// Still low: warned once.
+		{92, true, 1},
+		// Under the threshold but not by enough to warn again on rising.
+		{87, false, 1},
+		{91, true, 1},
+		{80, false, 1},
+		{90, true, 2},
+	} {
+		u := disk(step.percent)
+		checkResources(u, 90)
+		if low := slices.Contains(u.Low, "disk"); low != step.low || warnings() != step.warnings {
+			t.Fatalf("at %d%%: low %v and %d warnings, want %v and %d", step.percent, low, warnings(), step.low, step.warnings)
+		}
+	}
+	u = disk(99)
+	if checkResources(u, 0); len(u.Low) != 0 || warnings() != 2 {
+		t.Errorf("resource_warning 0: low %v and %d warnings", u.Low, warnings())
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// resumableStream is a /ws connection to a session opened with
+// ?resumable=1. When it drops without the client closing it, because the
+// Durable Object restarted or the network path changed, the session waits
+// handoverReclaim for the client to reconnect with ?session= instead of
+// closing. The client resumes output from ?offset=, the offset it has
+// read up to, and sends again its sequenced input past the input_seq it is
+// told was applied, so neither side loses bytes.
+type resumableStream struct {
+	// kick disconnects the connection when another takes it over.
+	kick func()
+}
+
+// streamMessage tells a control client of a session where the output
+// frames that follow start, and which of its input was applied, for
+// resuming after a reconnect.
+type streamMessage struct {
+	Type    string `json:"type"` // "stream"
+	Session string `json:"session"`
+	// Offset is the output offset of the next output frame's first byte.
+	// Gap is set when it is past the ?offset= asked for, the output in
+	// between having left the scrollback.
+	Offset int64 `json:"offset"`
+	Gap    bool  `json:"gap,omitempty"`
+	// InputSeq is the last sequenced input applied from ?client=.
+	InputSeq  int64 `json:"input_seq"`
+	Resumable bool  `json:"resumable"`
+}
+
+var streamsResumed = newCounter("dos3_streams_resumed_total",
+	"Connections that reconnected to a session at an output offset, by whether output was lost from the scrollback in between: gap or none.")
+
+// parseResumeOffset reads ?offset=, the output offset a client reconnecting
+// to a session resumes from; -1 without one.
+func parseResumeOffset(q url.Values) (int64, error) {
+	v := q.Get("offset")
+	if v == "" {
+		return -1, nil
+	}
+	if q.Get("session") == "" {
+		return 0, fmt.Errorf("offset requires session")
+	}
+	off, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || off < 0 {
+		return 0, fmt.Errorf("invalid offset=%q: must be a byte offset in the session's output", v)
+	}
+	return off, nil
+}
+
+// resumeAt returns the offset to follow s's output from for a client
+// resuming at off, -1 for one that isn't, and whether output was lost.
+func (s *session) resumeAt(off int64) (start int64, gap bool) {
+	if off < 0 {
+		_, start, _ = s.output.read(0, 0)
+		return start, false
+	}
+	_, start, _ = s.output.read(off, 0)
+	gap = start > off
+	outcome := "none"
+	if gap {
+		outcome = "gap"
+	}
+	streamsResumed.add(1, "outcome", outcome)
+	return start, gap
+}
+
+// attachStream makes the connection kicked by kick s's resumable stream.
+func (s *session) attachStream(kick func()) *resumableStream {
+	rs := &resumableStream{kick: kick}
+	s.stream.Store(rs)
+	return rs
+}
+
+// detachStream is rs ending: s closes if the client closed it, and
+// otherwise waits to be reclaimed, unless another connection has taken
+// it over already.
+func (s *session) detachStream(rs *resumableStream, clientClosed bool) {
+	if !s.stream.CompareAndSwap(rs, nil) {
+		return
+	}
+	if clientClosed || s.isClosed() {
+		s.close()
+		return
+	}
+	infof("Session %s lost its connection; keeping it %s to be resumed", s.id, handoverReclaim)
+	s.awaitReclaim()
+}
+
+// takeOverStream disconnects s's resumable stream, if it has one, for
+// another connection to have the session.
+func (s *session) takeOverStream() bool {
+	rs := s.stream.Swap(nil)
+	if rs == nil {
+		return false
+	}
+	rs.kick()
+	return true
+}
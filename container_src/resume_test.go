@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestResumableStream(t *testing.T) {
+	wsURL := "ws" + strings.TrimPrefix(testURL, "http") + "/ws?control=1&resumable=1&client=c1"
+	dial := func(query string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		return conn
+	}
+	// readUntil reads output up to want, returning it and the stream
+	// message, if one came first.
+	readUntil := func(conn *websocket.Conn, want string) (string, streamMessage) {
+		t.Helper()
+		var out strings.Builder
+		var stream streamMessage
+		for !strings.Contains(out.String(), want) {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("reading until %q: %v; read %q", want, err, out.String())
+			}
+			if typ == websocket.BinaryMessage {
+				out.Write(data)
+			} else if bytes.Contains(data, []byte(`"type":"stream"`)) {
+				json.Unmarshal(data, &stream)
+			}
+		}
+		return out.String(), stream
+	}
+
+	conn := dial("")
+	conn.WriteJSON(map[string]any{"type": "input", "client": "c1", "seq": 1, "data": "echo fir''st\n"})
+	out, stream := readUntil(conn, "first")
+	if stream.Session == "" || stream.Offset != 0 || !stream.Resumable {
+		t.Fatalf("stream message = %+v", stream)
+	}
+	sess := sessions.get(stream.Session)
+	// The first connection drops without a close frame, and output goes
+	// on meanwhile.
+	offset := int64(len(out))
+	conn.UnderlyingConn().Close()
+	for deadline := time.Now().Add(5 * time.Second); !sess.unclaimed.Load(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the session wasn't kept for resuming")
+		}
+	}
+	sess.write([]byte("echo mis''sed\n"))
+
+	// Resuming replays the output from the offset, and says which input
+	// was applied.
+	conn = dial(fmt.Sprintf("&session=%s&offset=%d", sess.id, offset))
+	out, stream = readUntil(conn, "missed")
+	if stream.Offset != offset || stream.Gap || stream.InputSeq != 1 {
+		t.Errorf("stream message on resuming = %+v", stream)
+	}
+	if strings.Contains(out, "first") {
+		t.Errorf("output before the offset was replayed: %q", out)
+	}
+
+	// Reconnecting while the server still thinks the last connection is
+	// there takes it over.
+	next := dial(fmt.Sprintf("&session=%s&offset=%d", sess.id, offset))
+	var err error
+	for err == nil {
+		_, _, err = conn.ReadMessage()
+	}
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("taken-over connection ended with %v", err)
+	}
+	conn.Close()
+
+	// Closing the connection ends the session.
+	next.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	next.Close()
+	for deadline := time.Now().Add(5 * time.Second); !sess.isClosed(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("closing the connection left the session open")
+		}
+	}
+
+	if _, resp, _ := websocket.DefaultDialer.Dial(wsURL+"&offset=5", nil); resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("offset without session: %v", resp)
+	}
+}
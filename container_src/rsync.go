@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"slices"
+)
+
+// openRsyncChannel runs the remote end of an rsync transfer on a mux
+// channel, as SSH would: a client passes `rsync -e` a remote shell that
+// opens the channel with the command it is given and pipes its stdio over
+// it, so only the deltas rsync computes cross the network. The command runs
+// in Cwd, /data by default, with a terminal's access.
+func openRsyncChannel(msg muxMessage, reply *muxMessage) (muxChannel, error) {
+	argv := msg.Argv
+	if len(argv) < 2 || path.Base(argv[0]) != "rsync" || !slices.Contains(argv[1:], "--server") {
+		return nil, errors.New(`argv must be an "rsync --server" command`)
+	}
+	bin, err := exec.LookPath("rsync")
+	if err != nil {
+		return nil, fmt.Errorf("rsync is not installed: %w", err)
+	}
+	dir, err := resolvePath(msg.Cwd)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(bin, argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = spawnEnv()
+	cmd.Stderr = &pipeLogWriter{name: "rsync"}
+	ch, err := startPipe("rsync", trafficFile, cmd)
+	if err != nil {
+		return nil, err
+	}
+	infof("rsync started (pid %d) in %s", cmd.Process.Pid, dir)
+	return ch, nil
+}
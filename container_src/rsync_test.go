@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRsync(t *testing.T) {
+	// A stand-in for rsync's server end, which echoes its input back.
+	bin := t.TempDir()
+	os.WriteFile(filepath.Join(bin, "rsync"), []byte("#!/bin/sh\necho \"args: $*\"\necho \"cwd: $PWD\"\ncat\n"), 0755)
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	os.MkdirAll(filepath.Join(dataDir, "synced"), 0755)
+
+	c := dialTest(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var out bytes.Buffer
+	err := c.Rsync(ctx, []string{"rsync", "--server", "-vlogDtpre.iLsfxCIvu", ".", "dest/"}, "synced", strings.NewReader("file list\n"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "args: --server -vlogDtpre.iLsfxCIvu . dest/\ncwd: " + filepath.Join(dataDir, "synced") + "\nfile list\n"
+	if out.String() != want {
+		t.Errorf("rsync output = %q, want %q", out.String(), want)
+	}
+
+	if err := c.Rsync(ctx, []string{"sh", "-c", "id"}, "", strings.NewReader(""), io.Discard); err == nil || !strings.Contains(err.Error(), "rsync --server") {
+		t.Errorf("non-rsync command: %v", err)
+	}
+}
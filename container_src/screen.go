@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hinshun/vt10x"
+)
+
+const (
+	// defaultScreenWait and maxScreenWait bound how long GET
+	// /v1/sessions/{id}/screen?contains= waits for the text.
+	defaultScreenWait = 10 * time.Second
+	maxScreenWait     = 25 * time.Second
+)
+
+// terminalScreen is a session's screen as a terminal emulator sees it, fed
+// from the session's scrollback and brought up to date whenever it is
+// looked at. The emulator starts at the oldest output kept, so a screen
+// drawn before that is lost; anything since is as a user would see it.
+type terminalScreen struct {
+	sess *session
+	mu   sync.Mutex
+	vt   vt10x.Terminal
+	// off is the offset in the session's output the emulator has reached.
+	off        int64
+	cols, rows int
+	// gen counts the times the screen was started afresh or resized, which
+	// invalidates anything rendered from it before.
+	gen int
+}
+
+// screens are the emulators of sessions whose screen was looked at, by ID.
+var screens = struct {
+	sync.Mutex
+	m map[string]*terminalScreen
+}{m: make(map[string]*terminalScreen)}
+
+// An emulator goes with its session.
+var _ = events.subscribe("screens", func(e event) {
+	if e.Session != nil {
+		screens.Lock()
+		delete(screens.m, e.Session.id)
+		screens.Unlock()
+	}
+}, eventSessionEnded)
+
+// screenOf returns sess's emulator, starting it if need be. One for a
+// session that has ended is not kept.
+func screenOf(sess *session) *terminalScreen {
+	screens.Lock()
+	defer screens.Unlock()
+	sc := screens.m[sess.id]
+	if sc == nil {
+		sc = &terminalScreen{sess: sess}
+		select {
+		case <-sess.done:
+		default:
+			screens.m[sess.id] = sc
+		}
+	}
+	return sc
+}
+
+// updateLocked feeds the emulator the session's output since it last did,
+// at the session's size. Called with sc.mu held.
+func (sc *terminalScreen) updateLocked() {
+	if cols, rows := sc.sess.size(); sc.vt == nil || cols != sc.cols || rows != sc.rows {
+		if sc.vt == nil {
+			sc.vt = vt10x.New(vt10x.WithSize(cols, rows))
+		} else {
+			sc.vt.Resize(cols, rows)
+		}
+		sc.cols, sc.rows = cols, rows
+		sc.gen++
+	}
+	for {
+		data, next, _ := sc.sess.output.read(sc.off, screenSyncRead)
+		if len(data) == 0 {
+			sc.off = next
+			return
+		}
+		// Output the emulator never saw was dropped from the scrollback:
+		// start again from what is left.
+		if next-int64(len(data)) != sc.off && sc.off != 0 {
+			sc.vt = vt10x.New(vt10x.WithSize(sc.cols, sc.rows))
+			sc.gen++
+		}
+		sc.vt.Write(data)
+		sc.off = next
+	}
+}
+
+// screenSnapshot is the body of GET /v1/sessions/{id}/screen.
+type screenSnapshot struct {
+	Cols int `json:"cols"`
+	Rows int `json:"rows"`
+	// Lines is the screen's text, a line per row without trailing spaces.
+	Lines  []string       `json:"lines"`
+	Cursor cursorPosition `json:"cursor"`
+	// AltScreen is set while a full-screen program such as vim or less has
+	// the alternate screen.
+	AltScreen bool   `json:"alt_screen"`
+	Title     string `json:"title,omitempty"`
+	// Offset is the offset in the session's output the screen reflects.
+	Offset int64 `json:"offset"`
+	// Matched is whether ?contains= was found on the screen.
+	Matched *bool `json:"matched,omitempty"`
+}
+
+type cursorPosition struct {
+	X       int  `json:"x"`
+	Y       int  `json:"y"`
+	Visible bool `json:"visible"`
+}
+
+// snapshot returns the screen as it is now.
+func (sc *terminalScreen) snapshot() screenSnapshot {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.updateLocked()
+	sc.vt.Lock()
+	defer sc.vt.Unlock()
+	snap := screenSnapshot{
+		Cols:      sc.cols,
+		Rows:      sc.rows,
+		Lines:     make([]string, sc.rows),
+		AltScreen: sc.vt.Mode()&vt10x.ModeAltScreen != 0,
+		Title:     sc.vt.Title(),
+		Offset:    sc.off,
+	}
+	cur := sc.vt.Cursor()
+	snap.Cursor = cursorPosition{X: cur.X, Y: cur.Y, Visible: sc.vt.CursorVisible()}
+	var b strings.Builder
+	for y := range snap.Lines {
+		b.Reset()
+		for x := range sc.cols {
+			if c := sc.vt.Cell(x, y).Char; c == 0 {
+				b.WriteByte(' ')
+			} else {
+				b.WriteRune(c)
+			}
+		}
+		snap.Lines[y] = strings.TrimRight(b.String(), " ")
+	}
+	return snap
+}
+
+// handleSessionScreen answers with the rendered screen. With ?contains= it
+// first waits, up to ?timeout=, for the text to appear on it.
+func handleSessionScreen(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	q := r.URL.Query()
+	want := q.Get("contains")
+	wait := defaultScreenWait
+	if v := q.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxScreenWait {
+			httpError(w, r, "timeout must be a duration of at most "+maxScreenWait.String(), http.StatusBadRequest)
+			return
+		}
+		wait = d
+	}
+	sc := screenOf(sess)
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	for {
+		snap := sc.snapshot()
+		if want == "" {
+			writeJSON(w, http.StatusOK, snap)
+			return
+		}
+		matched := strings.Contains(strings.Join(snap.Lines, "\n"), want)
+		snap.Matched = &matched
+		if matched {
+			writeJSON(w, http.StatusOK, snap)
+			return
+		}
+		_, _, more := sess.output.read(snap.Offset, 1)
+		select {
+		case <-more:
+			continue
+		case <-deadline.C:
+		case <-sess.done:
+		case <-r.Context().Done():
+			return
+		}
+		// One last look, for output that came with the session ending.
+		snap = sc.snapshot()
+		matched = strings.Contains(strings.Join(snap.Lines, "\n"), want)
+		snap.Matched = &matched
+		writeJSON(w, http.StatusOK, snap)
+		return
+	}
+}
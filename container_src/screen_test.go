@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSessionScreen(t *testing.T) {
+	sess, err := sessions.start(60, 10, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	sess.write([]byte("clear; printf '\\033]0;build\\007'; for i in 1 2 3; do printf 'step %d\\r\\033[K' $i; done; printf 'all %s  \\n' done\n"))
+	screen := func(query string) (snap screenSnapshot, status int) {
+		resp, err := http.Get(testURL + "/v1/sessions/" + sess.id + "/screen?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&snap)
+		return snap, resp.StatusCode
+	}
+	snap, _ := screen("contains=all+done")
+	if snap.Matched == nil || !*snap.Matched {
+		t.Fatalf("screen never showed 'all done':\n%s", strings.Join(snap.Lines, "\n"))
+	}
+	if snap.Cols != 60 || snap.Rows != 10 || len(snap.Lines) != 10 || snap.Title != "build" || snap.AltScreen {
+		t.Errorf("screen %+v", snap)
+	}
+	for _, line := range snap.Lines {
+		if strings.Contains(line, "step") {
+			t.Errorf("overwritten line on the screen: %q", line)
+		}
+		if line == "all done  " {
+			t.Errorf("trailing spaces kept: %q", line)
+		}
+	}
+	if snap.Offset == 0 || snap.Cursor.Y == 0 {
+		t.Errorf("offset %d, cursor %+v", snap.Offset, snap.Cursor)
+	}
+
+	// A full-screen program has the alternate screen; text that never shows
+	// up times out.
+	sess.write([]byte("printf '\\033[?1049h'\n"))
+	snap, _ = screen("contains=nowhere&timeout=300ms")
+	if snap.Matched == nil || *snap.Matched || !snap.AltScreen {
+		t.Errorf("matched %v, alt_screen %v", snap.Matched, snap.AltScreen)
+	}
+
+	if _, status := screen("contains=x&timeout=1h"); status != http.StatusBadRequest {
+		t.Errorf("timeout=1h: %d", status)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hinshun/vt10x"
+)
+
+const (
+	// screenSyncInterval is how often observers are sent what changed on
+	// the screen: output between two frames costs them one repaint.
+	screenSyncInterval = 100 * time.Millisecond
+	// screenSyncQueue is how many frames an observer may fall behind by
+	// before it is skipped, to be sent the whole screen once it catches up.
+	screenSyncQueue = 8
+	// screenSyncRead bounds the output fed to the emulator at a time.
+	screenSyncRead = 64 << 10
+)
+
+// Glyph attributes as vt10x sets them in Glyph.Mode, which it doesn't
+// export.
+const (
+	glyphReverse   = 1 << 0
+	glyphUnderline = 1 << 1
+	glyphBold      = 1 << 2
+	glyphItalic    = 1 << 4
+	glyphBlink     = 1 << 5
+	glyphAttrs     = glyphReverse | glyphUnderline | glyphBold | glyphItalic | glyphBlink
+)
+
+var screenFramesSent = newCounter("dos3_screen_frames_total",
+	"Screen repaints sent to observers, by kind: diff, or full for a new or lagging observer.")
+
+// screenFrame is a repaint: escape sequences that bring an observer's
+// terminal from the previous frame to the session's screen.
+type screenFrame struct {
+	data       []byte
+	cols, rows int
+}
+
+// screenSub is an observer following a screenSync.
+type screenSub struct {
+	frames chan screenFrame
+	// resync is set until the observer has been sent the whole screen, as
+	// it is when it joins or after it fell behind. Guarded by screenSync.mu.
+	resync bool
+}
+
+// screenSync renders a session's terminalScreen and sends the observers
+// following it the rows that changed every screenSyncInterval, rendered
+// once for all of them. A shared
+// session's raw output is typically many times what ends up on the screen
+// (progress bars, full-screen programs redrawing), so observers on a
+// popular session cost far less this way, at the price of losing what
+// scrolls past between frames.
+type screenSync struct {
+	sess *session
+	mu   sync.Mutex
+	subs map[*screenSub]struct{}
+}
+
+// screenSyncs are the sessions with observers, by ID.
+var screenSyncs = struct {
+	sync.Mutex
+	m map[string]*screenSync
+}{m: make(map[string]*screenSync)}
+
+// subscribeScreen follows sess's screen, starting its emulator for the
+// first observer.
+func subscribeScreen(sess *session) (*screenSync, *screenSub) {
+	sub := &screenSub{frames: make(chan screenFrame, screenSyncQueue), resync: true}
+	screenSyncs.Lock()
+	defer screenSyncs.Unlock()
+	ss := screenSyncs.m[sess.id]
+	if ss == nil {
+		ss = &screenSync{sess: sess, subs: make(map[*screenSub]struct{})}
+		screenSyncs.m[sess.id] = ss
+		go ss.run()
+	}
+	ss.mu.Lock()
+	ss.subs[sub] = struct{}{}
+	ss.mu.Unlock()
+	return ss, sub
+}
+
+func (ss *screenSync) unsubscribe(sub *screenSub) {
+	ss.mu.Lock()
+	delete(ss.subs, sub)
+	ss.mu.Unlock()
+}
+
+// followScreen sends sess's screen to an observer with send until ctx is
+// done, returning nil if the session ends first, as outputLog.follow does.
+// size, if not nil, is told the screen's size when it changes.
+func followScreen(ctx context.Context, sess *session, send func(data []byte) error, size func(cols, rows int)) error {
+	ss, sub := subscribeScreen(sess)
+	defer ss.unsubscribe(sub)
+	cols, rows := 0, 0
+	for {
+		select {
+		case f, ok := <-sub.frames:
+			if !ok {
+				return nil
+			}
+			if (f.cols != cols || f.rows != rows) && size != nil {
+				cols, rows = f.cols, f.rows
+				size(cols, rows)
+			}
+			if err := send(f.data); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// run renders the session's screen and sends frames until the last
+// observer leaves or the session ends.
+func (ss *screenSync) run() {
+	sc := screenOf(ss.sess)
+	gen := -1
+	var prev []string
+	ticker := time.NewTicker(screenSyncInterval)
+	defer ticker.Stop()
+	for {
+		sc.mu.Lock()
+		sc.updateLocked()
+		if sc.gen != gen {
+			gen, prev = sc.gen, nil
+		}
+		cols, rows := sc.cols, sc.rows
+		sc.vt.Lock()
+		lines := make([]string, rows)
+		for y := range lines {
+			lines[y] = renderScreenRow(sc.vt, y, cols)
+		}
+		tail := screenCursor(sc.vt)
+		sc.vt.Unlock()
+		sc.mu.Unlock()
+
+		diff := screenDiff(prev, lines, tail)
+		var full []byte
+		if ss.idle() {
+			return
+		}
+		ss.mu.Lock()
+		for sub := range ss.subs {
+			data, kind := diff, "diff"
+			if sub.resync {
+				if full == nil {
+					full = screenDiff(nil, lines, tail)
+				}
+				data, kind = full, "full"
+			}
+			if len(data) == 0 {
+				continue
+			}
+			select {
+			case sub.frames <- screenFrame{data: data, cols: cols, rows: rows}:
+				sub.resync = false
+				screenFramesSent.add(1, "kind", kind)
+			default:
+				sub.resync = true
+			}
+		}
+		ss.mu.Unlock()
+		prev = lines
+
+		select {
+		case <-ticker.C:
+		case <-ss.sess.done:
+			screenSyncs.Lock()
+			ss.forgetLocked()
+			ss.mu.Lock()
+			for sub := range ss.subs {
+				close(sub.frames)
+			}
+			ss.subs = nil
+			ss.mu.Unlock()
+			screenSyncs.Unlock()
+			return
+		}
+	}
+}
+
+// idle forgets ss if no observer is left. Observers subscribe with
+// screenSyncs locked, so none can join one being forgotten.
+func (ss *screenSync) idle() bool {
+	screenSyncs.Lock()
+	defer screenSyncs.Unlock()
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if len(ss.subs) > 0 {
+		return false
+	}
+	ss.forgetLocked()
+	return true
+}
+
+// forgetLocked removes ss from screenSyncs. Called with screenSyncs locked.
+func (ss *screenSync) forgetLocked() {
+	if screenSyncs.m[ss.sess.id] == ss {
+		delete(screenSyncs.m, ss.sess.id)
+	}
+}
+
+// screenDiff returns the escape sequences that repaint the lines that
+// differ from prev, or every line if prev is nil, followed by tail.
+func screenDiff(prev, lines []string, tail string) []byte {
+	var b strings.Builder
+	if prev == nil {
+		b.WriteString("\x1b[0m\x1b[H\x1b[2J")
+	}
+	changed := prev == nil
+	for y, line := range lines {
+		if prev != nil && y < len(prev) && prev[y] == line {
+			continue
+		}
+		fmt.Fprintf(&b, "\x1b[%dH", y+1)
+		b.WriteString(line)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	b.WriteString(tail)
+	return []byte(b.String())
+}
+
+// renderScreenRow renders row y with its attributes, cleared past its last
+// non-blank cell.
+func renderScreenRow(vt vt10x.View, y, cols int) string {
+	end := cols
+	for end > 0 {
+		g := vt.Cell(end-1, y)
+		if (g.Char != ' ' && g.Char != 0) || g.BG != vt10x.DefaultBG || g.Mode&glyphReverse != 0 {
+			break
+		}
+		end--
+	}
+	var b strings.Builder
+	var cur vt10x.Glyph
+	for x := range end {
+		g := vt.Cell(x, y)
+		if x == 0 || g.FG != cur.FG || g.BG != cur.BG || g.Mode&glyphAttrs != cur.Mode&glyphAttrs {
+			b.WriteString(glyphSGR(g))
+			cur = g
+		}
+		if g.Char == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteRune(g.Char)
+		}
+	}
+	b.WriteString("\x1b[0m\x1b[K")
+	return b.String()
+}
+
+// glyphSGR is the SGR sequence setting g's colours and attributes.
+func glyphSGR(g vt10x.Glyph) string {
+	params := []string{"0"}
+	for _, a := range []struct {
+		bit   int16
+		param string
+	}{{glyphBold, "1"}, {glyphItalic, "3"}, {glyphUnderline, "4"}, {glyphBlink, "5"}, {glyphReverse, "7"}} {
+		if g.Mode&a.bit != 0 {
+			params = append(params, a.param)
+		}
+	}
+	params = append(params, sgrColor(g.FG, vt10x.DefaultFG, 30)...)
+	params = append(params, sgrColor(g.BG, vt10x.DefaultBG, 40)...)
+	return "\x1b[" + strings.Join(params, ";") + "m"
+}
+
+// sgrColor returns the SGR parameters for c as a foreground (base 30) or
+// background (base 40) colour.
+func sgrColor(c, def vt10x.Color, base int) []string {
+	switch {
+	case c == def || c >= 1<<24:
+		return nil
+	case c < 8:
+		return []string{fmt.Sprint(base + int(c))}
+	case c < 16:
+		return []string{fmt.Sprint(base + 60 + int(c) - 8)}
+	case c < 256:
+		return []string{fmt.Sprint(base + 8), "5", fmt.Sprint(int(c))}
+	}
+	return []string{fmt.Sprint(base + 8), "2", fmt.Sprint(int(c >> 16 & 0xff)), fmt.Sprint(int(c >> 8 & 0xff)), fmt.Sprint(int(c & 0xff))}
+}
+
+// screenCursor places and shows or hides the cursor as it is on vt.
+func screenCursor(vt vt10x.View) string {
+	cur := vt.Cursor()
+	show := "\x1b[?25l"
+	if vt.CursorVisible() {
+		show = "\x1b[?25h"
+	}
+	return fmt.Sprintf("\x1b[%d;%dH%s", cur.Y+1, cur.X+1, show)
+}
+
+// screenSizeMessage tells a control client following a screen its size,
+// which the repaints assume, when it changes.
+type screenSizeMessage struct {
+	Type string `json:"type"` // "screen_size"
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hinshun/vt10x"
+)
+
+func TestScreenSync(t *testing.T) {
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	link, err := shares.create(sess, shareRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws?control=1&share="+link.Token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	// A counter redrawn in place is hundreds of writes, but only its last
+	// value is on the screen.
+	sess.write([]byte("i=0; while [ $i -lt 2000 ]; do i=$((i+1)); printf '\\r%05d' $i; done; echo; printf '\\033[1;31mdone\\033[0m-%d\\n' $((1+1))\n"))
+	screen := vt10x.New(vt10x.WithSize(80, 24))
+	var got int
+	var size *screenSizeMessage
+	for !strings.Contains(screen.String(), "done-2") {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading the screen: %v; have\n%s", err, screen.String())
+		}
+		if typ == websocket.TextMessage {
+			var m screenSizeMessage
+			if json.Unmarshal(data, &m) == nil && m.Type == "screen_size" {
+				size = &m
+			}
+			continue
+		}
+		got += len(data)
+		screen.Write(data)
+	}
+	if !strings.Contains(screen.String(), "02000") {
+		t.Errorf("screen lacks the counter's last value:\n%s", screen.String())
+	}
+	if size == nil || size.Cols != 80 || size.Rows != 24 {
+		t.Errorf("screen_size %+v", size)
+	}
+	_, raw, _ := sess.output.read(0, scrollbackLimit)
+	if int64(got) >= raw {
+		t.Errorf("observer was sent %d bytes for %d of output", got, raw)
+	}
+	// Attributes survive the repaint.
+	screen.Lock()
+	defer screen.Unlock()
+	for y := range 24 {
+		if strings.HasPrefix(screenLine(screen, y), "done-2") {
+			// vt10x brightens bold colours.
+			if g := screen.Cell(0, y); g.FG != vt10x.LightRed || g.Mode&glyphBold == 0 {
+				t.Errorf("'done' drawn as %+v, want bold red", g)
+			}
+			return
+		}
+	}
+	t.Errorf("no line starts with done-2:\n%s", screen.String())
+}
+
+// screenLine is row y of v as text.
+func screenLine(v vt10x.View, y int) string {
+	cols, _ := v.Size()
+	var b strings.Builder
+	for x := range cols {
+		b.WriteRune(v.Cell(x, y).Char)
+	}
+	return b.String()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// A session nobody is attached to can hold a megabyte of scrollback for
+// days. Once it has gone scrollback_compress_after without a client or any
+// output, its scrollback is compressed, and spilled to local disk if that
+// still leaves more than scrollback_spill_over bytes; the first read from
+// it, typically a client reattaching, or more output unpacks it again.
+
+// minPackSize is the least scrollback worth compressing.
+const minPackSize = 4 << 10
+
+// scrollbackSpillDir is local scratch space, not the S3 mount. Spilled
+// files are unlinked as soon as they are created, so they go with the
+// process.
+var scrollbackSpillDir = envOr("SCROLLBACK_SPILL_DIR", filepath.Join(os.TempDir(), "dos3-scrollback"))
+
+var (
+	// scrollbackPacked and scrollbackSpilled are the compressed bytes of
+	// packed scrollback held in memory and on disk.
+	scrollbackPacked  atomic.Int64
+	scrollbackSpilled atomic.Int64
+
+	scrollbackPacks = newCounter("dos3_scrollback_packs_total",
+		"Idle sessions' scrollback compressed, by where it was kept: memory or disk.")
+	scrollbackUnpacks = newCounter("dos3_scrollback_unpacks_total",
+		"Packed scrollback decompressed again, by outcome: ok or lost.")
+	scrollbackSaved = newCounter("dos3_scrollback_saved_bytes_total",
+		"Bytes of memory freed by compressing or spilling scrollback.")
+	_ = newGaugeFunc("dos3_scrollback_packed_bytes",
+		"Compressed scrollback of idle sessions held in memory.",
+		func() float64 { return float64(scrollbackPacked.Load()) })
+	_ = newGaugeFunc("dos3_scrollback_spilled_bytes",
+		"Compressed scrollback of idle sessions spilled to local disk.",
+		func() float64 { return float64(scrollbackSpilled.Load()) })
+)
+
+// packIdleScrollback runs the scrollback sweeper forever.
+func packIdleScrollback() {
+	for range time.Tick(idleSweepInterval) {
+		sweepIdleScrollback(time.Now())
+	}
+}
+
+// sweepIdleScrollback packs the scrollback of sessions no client has been
+// attached to, and that have had no output, for scrollback_compress_after.
+func sweepIdleScrollback(now time.Time) {
+	cfg := currentConfig()
+	idle := cfg.ScrollbackCompressAfter.Duration
+	if idle <= 0 {
+		return
+	}
+	for _, s := range sessions.list() {
+		s.mu.Lock()
+		last := s.lastActive
+		if last.IsZero() {
+			last = s.created
+		}
+		detached := !s.closed && s.attached == 0 && now.Sub(last) >= idle
+		s.mu.Unlock()
+		if detached {
+			s.output.pack(now, idle, cfg.ScrollbackSpillOver, cfg.ScrollbackSpillLimit)
+		}
+	}
+}
+
+// pack compresses the log if it has had no output for idle, spilling it to
+// disk if it is still over spillOver bytes (0 never spills) and the spilled
+// scrollback stays within spillLimit (0 is unlimited).
+func (l *outputLog) pack(now time.Time, idle time.Duration, spillOver, spillLimit int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.packed != nil || l.spill != nil || len(l.buf) < minPackSize || now.Sub(l.lastAppend) < idle {
+		return
+	}
+	var z bytes.Buffer
+	zw, _ := flate.NewWriter(&z, flate.BestSpeed)
+	zw.Write(l.buf)
+	zw.Close()
+	if z.Len() >= len(l.buf) {
+		return
+	}
+	if n := int64(z.Len()); spillOver > 0 && n > spillOver {
+		if f, err := spillScrollback(z.Bytes(), spillLimit); err != nil {
+			warnf("Keeping scrollback in memory: %v", err)
+		} else if f != nil {
+			l.spill, l.size = f, len(l.buf)
+			scrollbackPacks.add(1, "where", "disk")
+			scrollbackSaved.add(float64(len(l.buf)))
+			l.buf = nil
+			return
+		}
+	}
+	l.packed, l.size = bytes.Clone(z.Bytes()), len(l.buf)
+	scrollbackPacked.Add(int64(len(l.packed)))
+	scrollbackPacks.add(1, "where", "memory")
+	scrollbackSaved.add(float64(len(l.buf) - len(l.packed)))
+	l.buf = nil
+}
+
+// spillScrollback writes compressed scrollback to an unlinked file, or
+// returns nil if that would take the spilled scrollback over limit.
+func spillScrollback(data []byte, limit int64) (*os.File, error) {
+	n := int64(len(data))
+	if total := scrollbackSpilled.Add(n); limit > 0 && total > limit {
+		scrollbackSpilled.Add(-n)
+		return nil, nil
+	}
+	f, err := func() (*os.File, error) {
+		if err := os.MkdirAll(scrollbackSpillDir, 0700); err != nil {
+			return nil, err
+		}
+		f, err := os.CreateTemp(scrollbackSpillDir, "scrollback-")
+		if err != nil {
+			return nil, err
+		}
+		os.Remove(f.Name())
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}()
+	if err != nil {
+		scrollbackSpilled.Add(-n)
+	}
+	return f, err
+}
+
+// unpackLocked decompresses the log if it's packed. Scrollback that can't
+// be read back is dropped, as if it had scrolled out.
+func (l *outputLog) unpackLocked() {
+	if l.packed == nil && l.spill == nil {
+		return
+	}
+	var zr io.Reader
+	if l.spill != nil {
+		if fi, err := l.spill.Stat(); err == nil {
+			scrollbackSpilled.Add(-fi.Size())
+		}
+		defer l.spill.Close()
+		zr = flate.NewReader(io.NewSectionReader(l.spill, 0, 1<<62))
+	} else {
+		scrollbackPacked.Add(-int64(len(l.packed)))
+		zr = flate.NewReader(bytes.NewReader(l.packed))
+	}
+	buf, err := io.ReadAll(zr)
+	if err == nil && len(buf) != l.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		warnf("Dropping %d bytes of packed scrollback: %v", l.size, err)
+		scrollbackUnpacks.add(1, "outcome", "lost")
+		l.start += int64(l.size)
+		buf = nil
+	} else {
+		scrollbackUnpacks.add(1, "outcome", "ok")
+	}
+	l.buf, l.packed, l.spill, l.size = buf, nil, nil, 0
+}
+
+// discardPacked drops the log's packed scrollback unread, for a session
+// that's gone.
+func (l *outputLog) discardPacked() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.spill != nil {
+		if fi, err := l.spill.Stat(); err == nil {
+			scrollbackSpilled.Add(-fi.Size())
+		}
+		l.spill.Close()
+	}
+	scrollbackPacked.Add(-int64(len(l.packed)))
+	if l.packed != nil || l.spill != nil {
+		l.start += int64(l.size)
+	}
+	l.packed, l.spill, l.size = nil, nil, 0
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestScrollbackPacking(t *testing.T) {
+	out := bytes.Repeat([]byte("$ make\nok  \tserver\t0.1s\n"), 4000)
+	now := time.Now().Add(time.Hour)
+	for _, tc := range []struct {
+		name                  string
+		spillOver, spillLimit int64
+		spilled               bool
+	}{
+		{"memory", 0, 0, false},
+		{"disk", 1, 0, true},
+		{"over the spill limit", 1, 1, false},
+	} {
+		l := newOutputLog(1 << 20)
+		l.append([]byte("dropped"))
+		l.append(out)
+		end := l.end()
+		l.pack(time.Now(), time.Minute, tc.spillOver, tc.spillLimit)
+		if l.packed != nil || l.spill != nil {
+			t.Fatalf("%s: packed with recent output", tc.name)
+		}
+		l.pack(now, time.Minute, tc.spillOver, tc.spillLimit)
+		if l.buf != nil || (l.spill != nil) != tc.spilled || (l.packed != nil) == tc.spilled {
+			t.Fatalf("%s: after packing, %d bytes raw, %d packed, spilled %v", tc.name, len(l.buf), len(l.packed), l.spill != nil)
+		}
+		if tc.spilled && scrollbackSpilled.Load() == 0 {
+			t.Fatalf("%s: no spilled bytes counted", tc.name)
+		}
+		if l.end() != end {
+			t.Fatalf("%s: end %d after packing, want %d", tc.name, l.end(), end)
+		}
+		// Reading where output is caught up leaves it packed.
+		if data, _, wait := l.read(end, maxOutputFrame); data != nil || wait == nil || l.buf != nil {
+			t.Fatalf("%s: reading at the end unpacked the log", tc.name)
+		}
+		var got []byte
+		for off := int64(0); off < end; {
+			var data []byte
+			data, off, _ = l.read(off, maxOutputFrame)
+			got = append(got, data...)
+		}
+		if !bytes.HasSuffix(got, out) || len(got) != int(end) {
+			t.Fatalf("%s: read back %d bytes, want %d", tc.name, len(got), end)
+		}
+		if l.packed != nil || l.spill != nil || scrollbackSpilled.Load() != 0 || scrollbackPacked.Load() != 0 {
+			t.Fatalf("%s: still packed after reading: %d in memory, %d on disk", tc.name, scrollbackPacked.Load(), scrollbackSpilled.Load())
+		}
+	}
+
+	// The sweeper packs only sessions nobody is attached to.
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	cfg := *currentConfig()
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	cfg.ScrollbackCompressAfter = duration{time.Minute}
+	sess.output.append(out)
+	detach := sess.attach()
+	sweepIdleScrollback(now)
+	if sess.output.packed != nil {
+		t.Fatal("attached session's scrollback packed")
+	}
+	detach()
+	cfg.ScrollbackCompressAfter = duration{}
+	sweepIdleScrollback(now)
+	if sess.output.packed != nil {
+		t.Fatal("scrollback packed with scrollback_compress_after off")
+	}
+	cfg.ScrollbackCompressAfter = duration{time.Minute}
+	sweepIdleScrollback(now)
+	if sess.output.packed == nil {
+		t.Fatal("idle session's scrollback not packed")
+	}
+	sess.output.append([]byte("more"))
+	if sess.output.packed != nil || !bytes.Contains(sess.output.buf, out) {
+		t.Fatal("output to a packed session didn't unpack its scrollback")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+const (
+	// defaultSearchMatches and maxSearchMatches bound the matches a search
+	// returns.
+	defaultSearchMatches = 100
+	maxSearchMatches     = 1000
+	// maxSearchPattern bounds a search's pattern.
+	maxSearchPattern = 1024
+	// maxSearchLine bounds the line returned with a match.
+	maxSearchLine = 512
+)
+
+var errInvalidSearch = errors.New("invalid search")
+
+var transcriptSearches = newCounter("dos3_transcript_searches_total",
+	"Searches of session transcripts, by how they were asked for: websocket or api.")
+
+// searchQuery is what to look for in a transcript.
+type searchQuery struct {
+	Pattern string
+	// Regex makes Pattern a Go regular expression rather than text, and
+	// IgnoreCase matches it regardless of case.
+	Regex      bool
+	IgnoreCase bool
+	// Limit is how many matches to return, oldest first (default 100).
+	Limit int
+}
+
+// compile returns q's pattern as a regular expression.
+func (q searchQuery) compile() (*regexp.Regexp, error) {
+	switch {
+	case q.Pattern == "":
+		return nil, fmt.Errorf("%w: empty pattern", errInvalidSearch)
+	case len(q.Pattern) > maxSearchPattern:
+		return nil, fmt.Errorf("%w: pattern longer than %d bytes", errInvalidSearch, maxSearchPattern)
+	case q.Limit < 0 || q.Limit > maxSearchMatches:
+		return nil, fmt.Errorf("%w: limit must be 1 to %d", errInvalidSearch, maxSearchMatches)
+	}
+	expr := q.Pattern
+	if !q.Regex {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if q.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSearch, err)
+	}
+	return re, nil
+}
+
+// searchMatch is a match in a transcript. Offsets are positions in the
+// session's plain-text transcript since it started, so they stay valid as
+// it grows, and the same text found twice has the same offset.
+type searchMatch struct {
+	Offset int64 `json:"offset"`
+	Length int   `json:"length"`
+	// Line is the text of the line the match starts on, cut to 512 bytes,
+	// and LineOffset where that line starts.
+	Line       string `json:"line"`
+	LineOffset int64  `json:"line_offset"`
+}
+
+// searchResults answers a search, as GET /v1/sessions/{id}/search and as a
+// search_results message to a /ws search message with the same ID.
+type searchResults struct {
+	Type    string        `json:"type,omitempty"` // "search_results" on /ws
+	ID      int           `json:"id,omitempty"`
+	Matches []searchMatch `json:"matches"`
+	// Truncated is set if there were more matches than the limit.
+	Truncated bool `json:"truncated,omitempty"`
+	// Start and End are the offsets of the transcript searched: older
+	// output has been discarded.
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// Error says why a /ws search failed.
+	Error string `json:"error,omitempty"`
+}
+
+// search finds q in the retained transcript, including the line in
+// progress.
+func (t *transcript) search(q searchQuery) (searchResults, error) {
+	re, err := q.compile()
+	if err != nil {
+		return searchResults{}, err
+	}
+	limit := q.Limit
+	if limit == 0 {
+		limit = defaultSearchMatches
+	}
+	t.mu.Lock()
+	snap := t.log.snapshot()
+	text := append(snap.Data, redact(t.strip.line)...)
+	t.mu.Unlock()
+
+	res := searchResults{Matches: []searchMatch{}, Start: snap.Start, End: snap.Start + int64(len(text))}
+	for _, m := range re.FindAllIndex(text, limit+1) {
+		if len(res.Matches) == limit {
+			res.Truncated = true
+			break
+		}
+		if m[0] == m[1] {
+			continue
+		}
+		lineStart := bytes.LastIndexByte(text[:m[0]], '\n') + 1
+		line := text[lineStart:]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		if len(line) > maxSearchLine {
+			line = line[:maxSearchLine]
+		}
+		res.Matches = append(res.Matches, searchMatch{
+			Offset:     snap.Start + int64(m[0]),
+			Length:     m[1] - m[0],
+			Line:       string(bytes.ToValidUTF8(line, nil)),
+			LineOffset: snap.Start + int64(lineStart),
+		})
+	}
+	return res, nil
+}
+
+// handleSessionSearch searches a session's transcript:
+// GET /v1/sessions/{id}/search?q=.
+func handleSessionSearch(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	v := r.URL.Query()
+	q := searchQuery{Pattern: v.Get("q"), Regex: v.Get("regex") == "1", IgnoreCase: v.Get("ignore_case") == "1"}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeError(w, r, fmt.Errorf("%w: limit=%q", errInvalidSearch, s))
+			return
+		}
+		q.Limit = n
+	}
+	res, err := sess.transcript.search(q)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	transcriptSearches.add(1, "via", "api")
+	writeJSON(w, http.StatusOK, res)
+}
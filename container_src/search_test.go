@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTranscriptSearch(t *testing.T) {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws?control=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	conn.WriteMessage(websocket.TextMessage, []byte("for i in 1 2 3; do echo \"needle-$((i*7))\"; done; echo done-$((6*7))\r"))
+	var id string
+	search := func(q clientMessage) searchResults {
+		t.Helper()
+		q.Type = "search"
+		data, _ := json.Marshal(q)
+		conn.WriteMessage(websocket.TextMessage, data)
+		for {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var res searchResults
+			if typ == websocket.TextMessage && json.Unmarshal(data, &res) == nil && res.Type == "search_results" {
+				return res
+			}
+		}
+	}
+	for {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m sessionMessage
+		if typ == websocket.TextMessage && json.Unmarshal(data, &m) == nil && m.Type == "session" {
+			id = m.ID
+		}
+		if typ == websocket.BinaryMessage && strings.Contains(string(data), "done-42") {
+			break
+		}
+	}
+
+	res := search(clientMessage{ID: 1, Pattern: `needle-\d+`, Regex: true})
+	if res.ID != 1 || len(res.Matches) != 3 || res.Matches[2].Line != "needle-21" || res.Matches[0].Length != len("needle-7") {
+		t.Fatalf("regex search: %+v", res)
+	}
+	if m := res.Matches[1]; m.Offset != m.LineOffset || m.Offset <= res.Matches[0].Offset || res.End < m.Offset {
+		t.Errorf("offsets %+v", res)
+	}
+	if res := search(clientMessage{ID: 2, Pattern: "NEEDLE-", IgnoreCase: true, Limit: 2}); len(res.Matches) != 2 || !res.Truncated {
+		t.Errorf("limited search: %+v", res)
+	}
+	if res := search(clientMessage{ID: 3, Pattern: "(", Regex: true}); res.Error == "" || res.ID != 3 {
+		t.Errorf("bad pattern: %+v", res)
+	}
+
+	resp, err := http.Get(testURL + "/v1/sessions/" + id + "/search?q=needle-14")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got searchResults
+	json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if len(got.Matches) != 1 || got.Matches[0].Offset != res.Matches[1].Offset {
+		t.Errorf("GET search: %d %+v", resp.StatusCode, got)
+	}
+	resp, err = http.Get(testURL + "/v1/sessions/" + id + "/search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("empty search: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+)
+
+// A self-check exercises what a workspace needs to work, end to end: the
+// mount takes a write and reads it back, a shell starts on a PTY, and a
+// WebSocket to the server runs a command in a session. `server --self-check`
+// runs it against the server in the same container, for developers after
+// changing the image; POST /v1/self-check runs it in the server, as a deep
+// health probe for the Durable Object.
+
+// selfCheckTimeout bounds each check.
+const selfCheckTimeout = 10 * time.Second
+
+// selfCheckAddr is where `server --self-check` finds the server by default.
+const selfCheckAddr = "127.0.0.1:8283"
+
+const (
+	checkMount     = "mount"
+	checkPTY       = "pty"
+	checkWebSocket = "websocket"
+)
+
+var selfChecks = newCounter("dos3_self_checks_total",
+	"Self-check runs through the API, by outcome: ok or failed.")
+
+// selfCheckResult is the outcome of one check.
+type selfCheckResult struct {
+	Name       string  `json:"name"`
+	OK         bool    `json:"ok"`
+	DurationMS float64 `json:"duration_ms"`
+	// Detail says what was checked, Error what went wrong.
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// selfCheckReport is the result of a self-check.
+type selfCheckReport struct {
+	OK      bool              `json:"ok"`
+	Version versionInfo       `json:"version"`
+	Checks  []selfCheckResult `json:"checks"`
+}
+
+// runSelfChecks checks the mount, a PTY, and a WebSocket to the server at
+// addr.
+func runSelfChecks(ctx context.Context, addr string) selfCheckReport {
+	report := selfCheckReport{OK: true, Version: buildVersion}
+	for _, c := range []struct {
+		name string
+		run  func(ctx context.Context, marker string) (string, error)
+	}{
+		{checkMount, checkMountReadWrite},
+		{checkPTY, checkPTYSpawn},
+		{checkWebSocket, func(ctx context.Context, marker string) (string, error) {
+			return checkWebSocketLoopback(ctx, addr, marker)
+		}},
+	} {
+		b := make([]byte, 8)
+		rand.Read(b)
+		ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+		start := time.Now()
+		detail, err := c.run(ctx, "dos3-self-check-"+hex.EncodeToString(b))
+		cancel()
+		res := selfCheckResult{Name: c.name, OK: err == nil, Detail: detail,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			res.Error = err.Error()
+			report.OK = false
+		}
+		report.Checks = append(report.Checks, res)
+	}
+	return report
+}
+
+// checkMountReadWrite writes a file under /data, reads it back and removes
+// it. A frozen workspace is only read.
+func checkMountReadWrite(ctx context.Context, marker string) (string, error) {
+	kind := "local disk"
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dataDir, &st); err != nil {
+		return "", err
+	} else if st.Type == fuseSuperMagic {
+		kind = "FUSE mount"
+	}
+	if workspaceFreeze.frozen() {
+		_, err := fsCall(ctx, func() ([]os.DirEntry, error) { return os.ReadDir(dataDir) })
+		return kind + ", frozen: read only", err
+	}
+	p := filepath.Join(dataDir, "."+marker)
+	_, err := fsCall(ctx, func() (struct{}, error) {
+		defer os.Remove(p)
+		if err := os.WriteFile(p, []byte(marker), 0644); err != nil {
+			return struct{}{}, err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return struct{}{}, err
+		}
+		if string(data) != marker {
+			return struct{}{}, fmt.Errorf("read back %q, wrote %q", data, marker)
+		}
+		return struct{}{}, os.Remove(p)
+	})
+	return kind + ": wrote, read and removed a file", err
+}
+
+// checkPTYSpawn runs the shell on a PTY to print marker.
+func checkPTYSpawn(ctx context.Context, marker string) (string, error) {
+	cmd := exec.CommandContext(ctx, getShell(), "-c", "echo "+marker)
+	cmd.Dir = dataDir
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Cols: 80, Rows: 24})
+	if err != nil {
+		return "", err
+	}
+	defer ptmx.Close()
+	out, err := readUntil(ctx, ptmx.Read, marker)
+	cmd.Wait()
+	if err != nil {
+		return "", fmt.Errorf("%w; the shell printed %q", err, out)
+	}
+	return getShell() + " printed on a PTY", nil
+}
+
+// checkWebSocketLoopback opens a session over /ws at addr and runs a
+// command in it, whose output only the shell could have produced.
+func checkWebSocketLoopback(ctx context.Context, addr, marker string) (string, error) {
+	u := url.URL{Scheme: "ws", Host: addr, Path: "/ws", RawQuery: url.Values{"session_name": {"self-check"}}.Encode()}
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%w (%s)", err, resp.Status)
+		}
+		return "", err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+	// The shell expands what is typed, so the echo of the input doesn't
+	// match.
+	half := len(marker) / 2
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("echo %s''%s\r", marker[:half], marker[half:]))); err != nil {
+		return "", err
+	}
+	out, err := readUntil(ctx, func(p []byte) (int, error) {
+		_, data, err := conn.ReadMessage()
+		return copy(p, data), err
+	}, marker)
+	// Closing normally closes the session; wait for the server to answer.
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w; the session printed %q", err, out)
+	}
+	return "ran a command in a session over " + u.String(), nil
+}
+
+// readUntil reads with read until the output contains marker, returning
+// the output so far if it fails first.
+func readUntil(ctx context.Context, read func([]byte) (int, error), marker string) (string, error) {
+	var out bytes.Buffer
+	buf := make([]byte, 32<<10)
+	for !strings.Contains(out.String(), marker) {
+		n, err := read(buf)
+		out.Write(buf[:n])
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return out.String(), err
+		}
+	}
+	return out.String(), nil
+}
+
+// handleSelfCheck runs a self-check against this server, answering 503 if
+// it failed.
+func handleSelfCheck(w http.ResponseWriter, r *http.Request) {
+	addr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if addr == nil {
+		writeError(w, r, errors.New("no local address to connect to"))
+		return
+	}
+	report := runSelfChecks(r.Context(), addr.String())
+	status, outcome := http.StatusOK, "ok"
+	if !report.OK {
+		status, outcome = http.StatusServiceUnavailable, "failed"
+	}
+	selfChecks.add(1, "outcome", outcome)
+	writeJSON(w, status, report)
+}
+
+// runSelfCheckCommand is `server --self-check [addr]`: it prints the report
+// as JSON, and exits 1 if a check failed.
+func runSelfCheckCommand(args []string) int {
+	addr := selfCheckAddr
+	switch len(args) {
+	case 0:
+	case 1:
+		addr = args[0]
+	default:
+		fmt.Fprintln(os.Stderr, "usage: server --self-check [host:port]")
+		return 2
+	}
+	report := runSelfChecks(context.Background(), addr)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSelfCheck(t *testing.T) {
+	t.Setenv("CONTROL_TOKEN", "secret")
+	req, _ := http.NewRequest("POST", testURL+"/v1/self-check", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report selfCheckReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !report.OK || len(report.Checks) != 3 {
+		t.Fatalf("self-check = %d, %+v", resp.StatusCode, report)
+	}
+	for i, name := range []string{checkMount, checkPTY, checkWebSocket} {
+		if c := report.Checks[i]; c.Name != name || !c.OK || c.Detail == "" {
+			t.Errorf("check %d = %+v, want %s passing", i, c, name)
+		}
+	}
+	if entries, _ := filepath.Glob(filepath.Join(dataDir, ".dos3-self-check-*")); len(entries) != 0 {
+		t.Errorf("self-check left %v behind", entries)
+	}
+	// The session closes once the server has seen the connection close.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		open := false
+		for _, s := range sessions.list() {
+			open = open || s.metadata().Name == "self-check"
+		}
+		if !open {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("self-check left its session open")
+		}
+	}
+
+	// A server that isn't there fails the WebSocket check, and the rest
+	// still run.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	report = runSelfChecks(context.Background(), addr)
+	if report.OK || !report.Checks[0].OK || !report.Checks[1].OK || report.Checks[2].OK || report.Checks[2].Error == "" {
+		t.Fatalf("self-check without a server = %+v", report)
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+const (
+	// serviceStableRun is how long a service must stay up for its restart
+	// backoff to reset.
+	serviceStableRun = time.Minute
+	// serviceStopTimeout is how long a stopping service gets after SIGTERM.
+	serviceStopTimeout = 10 * time.Second
+)
+
+// serviceSpec is one entry of the services config: a long-running process
+// the server starts at boot and restarts whenever it exits.
+type serviceSpec struct {
+	Argv []string `json:"argv"`
+	// Cwd is relative to /data.
+	Cwd string            `json:"cwd,omitempty"`
+	Env map[string]string `json:"env,omitempty"`
+	// TTY runs the service on a PTY of its own, for REPLs and other
+	// programs that only behave interactively on a terminal. Otherwise its
+	// stdout and stderr are captured through pipes.
+	TTY bool `json:"tty,omitempty"`
+	// Stdin keeps a pipe to a non-TTY service's standard input for attached
+	// terminals to write to; without it the service reads /dev/null.
+	Stdin bool `json:"stdin,omitempty"`
+}
+
+type serviceInfo struct {
+	Name     string      `json:"name"`
+	Spec     serviceSpec `json:"spec"`
+	Running  bool        `json:"running"`
+	PID      int         `json:"pid,omitempty"`
+	Started  time.Time   `json:"started,omitzero"`
+	Restarts int         `json:"restarts"`
+	Error    string      `json:"error,omitempty"`
+}
+
+type serviceList struct {
+	Services []serviceInfo `json:"services"`
+}
+
+// service is a supervised process. Its output, including notices of exits
+// and restarts, is kept in one log across restarts, so terminals attached
+// with /ws?service= follow it like a session.
+type service struct {
+	name   string
+	spec   serviceSpec
+	output *outputLog
+	stop   context.CancelFunc
+	done   chan struct{}
+	dedup  inputDedup
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser // the PTY master for TTY services
+	ptmx    *os.File
+	started time.Time
+	// cols and rows are the size terminals last set for a TTY service,
+	// which it keeps over restarts.
+	cols, rows int
+	restarts   int
+	lastErr    error
+	kick       chan struct{} // restarts the service immediately
+}
+
+// serviceManager runs the services config, starting, stopping and
+// restarting services as it changes.
+type serviceManager struct {
+	mu       sync.Mutex
+	services map[string]*service
+}
+
+var services = &serviceManager{services: make(map[string]*service)}
+
+// sync makes the running services match the config and the workspace
+// file.
+func (m *serviceManager) sync() {
+	want := wantedServices()
+	m.mu.Lock()
+	var stopping []*service
+	for name, svc := range m.services {
+		if spec, ok := want[name]; !ok || !reflect.DeepEqual(spec, svc.spec) {
+			stopping = append(stopping, svc)
+			delete(m.services, name)
+		}
+	}
+	var starting []*service
+	for name, spec := range want {
+		if _, ok := m.services[name]; !ok {
+			svc := &service{
+				name:   name,
+				spec:   spec,
+				output: newOutputLog(scrollbackLimit),
+				done:   make(chan struct{}),
+				kick:   make(chan struct{}, 1),
+			}
+			m.services[name] = svc
+			starting = append(starting, svc)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, svc := range stopping {
+		svc.shutdown()
+	}
+	for _, svc := range starting {
+		ctx, cancel := context.WithCancel(context.Background())
+		svc.stop = cancel
+		go svc.supervise(ctx)
+	}
+}
+
+// wantedServices are the services config's services, and the workspace
+// file's it doesn't name.
+func wantedServices() map[string]serviceSpec {
+	want := workspace.current().services()
+	for name, spec := range currentConfig().Services {
+		if _, ok := want[name]; ok {
+			warnf("Service %s is in both the config and the workspace file; running the config's", name)
+		}
+		want[name] = spec
+	}
+	return want
+}
+
+func (m *serviceManager) get(name string) *service {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.services[name]
+}
+
+// list returns the services sorted by name.
+func (m *serviceManager) list() []*service {
+	m.mu.Lock()
+	out := make([]*service, 0, len(m.services))
+	for _, svc := range m.services {
+		out = append(out, svc)
+	}
+	m.mu.Unlock()
+	slices.SortFunc(out, func(a, b *service) int { return strings.Compare(a.name, b.name) })
+	return out
+}
+
+// leaders maps the pid of each service running on a PTY to its name. Like a
+// session's shell, such a service leads its own Unix session.
+func (m *serviceManager) leaders() map[int]string {
+	out := make(map[int]string)
+	for _, svc := range m.list() {
+		svc.mu.Lock()
+		if svc.spec.TTY && svc.cmd != nil {
+			out[svc.cmd.Process.Pid] = svc.name
+		}
+		svc.mu.Unlock()
+	}
+	return out
+}
+
+func (m *serviceManager) shutdown() {
+	for _, svc := range m.list() {
+		svc.shutdown()
+	}
+}
+
+func (s *service) info() serviceInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := serviceInfo{Name: s.name, Spec: s.spec, Restarts: s.restarts}
+	if s.cmd != nil {
+		info.Running = true
+		info.PID = s.cmd.Process.Pid
+		info.Started = s.started
+	}
+	if s.lastErr != nil {
+		info.Error = s.lastErr.Error()
+	}
+	return info
+}
+
+// notice adds a line from the server to the service's output.
+func (s *service) notice(msg string) {
+	s.output.append([]byte("\r\n\x1b[1;33m[do-s3] " + msg + "\x1b[0m\r\n"))
+}
+
+// supervise runs the service until ctx is cancelled, restarting it with
+// backoff whenever it exits.
+func (s *service) supervise(ctx context.Context) {
+	defer close(s.done)
+	defer s.output.close()
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := s.run(ctx)
+		if ctx.Err() != nil {
+			infof("Service %s stopped", s.name)
+			return
+		}
+		if time.Since(started) >= serviceStableRun {
+			backoff = time.Second
+		}
+		s.mu.Lock()
+		s.lastErr = err
+		s.restarts++
+		s.mu.Unlock()
+		select {
+		case <-s.kick:
+			infof("Service %s restarted on request", s.name)
+			s.notice(s.name + " restarted")
+			continue
+		default:
+		}
+		warnf("Service %s exited: %v; restarting in %s", s.name, err, backoff)
+		s.notice(fmt.Sprintf("%s exited (%v), restarting in %s", s.name, err, backoff))
+
+		select {
+		case <-time.After(backoff):
+			backoff = min(backoff*2, 30*time.Second)
+		case <-s.kick:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// run starts the service once and waits for it to exit.
+func (s *service) run(ctx context.Context) error {
+	dir, err := resolvePath(s.spec.Cwd)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, s.spec.Argv[0], s.spec.Argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = spawnEnv()
+	for k, v := range s.spec.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM) }
+	cmd.WaitDelay = serviceStopTimeout
+
+	var ptmx *os.File
+	var stdin io.WriteCloser
+	if s.spec.TTY {
+		cols, rows := s.size()
+		if ptmx, err = pty.StartWithSize(cmd, &pty.Winsize{Cols: uint16(cols), Rows: uint16(rows)}); err == nil {
+			if ptmx, err = pollablePTY(ptmx); err != nil {
+				cmd.Process.Kill()
+				cmd.Wait()
+			}
+		}
+		stdin = ptmx
+	} else {
+		out := outputWriter{s.output}
+		cmd.Stdout, cmd.Stderr = out, out
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if s.spec.Stdin {
+			if stdin, err = cmd.StdinPipe(); err != nil {
+				return err
+			}
+		}
+		err = cmd.Start()
+	}
+	if err != nil {
+		return err
+	}
+	procLimit.add(cmd.Process.Pid)
+	infof("Service %s started (pid %d)", s.name, cmd.Process.Pid)
+
+	s.mu.Lock()
+	s.cmd, s.stdin, s.ptmx, s.started = cmd, stdin, ptmx, time.Now()
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.cmd, s.stdin, s.ptmx = nil, nil, nil
+		s.mu.Unlock()
+	}()
+
+	if ptmx != nil {
+		copied := make(chan struct{})
+		go func() {
+			io.Copy(outputWriter{s.output}, ptmx)
+			close(copied)
+		}()
+		err = cmd.Wait()
+		// The PTY reads EIO once the service and everything holding the
+		// terminal is gone; don't wait on stragglers past the timeout.
+		select {
+		case <-copied:
+		case <-time.After(time.Second):
+		}
+		ptmx.Close()
+		return err
+	}
+	return cmd.Wait()
+}
+
+// outputWriter appends a service's output to its log.
+type outputWriter struct{ l *outputLog }
+
+func (w outputWriter) Write(p []byte) (int, error) {
+	w.l.append(p)
+	return len(p), nil
+}
+
+// restart kills the running process so the supervisor starts a new one
+// without waiting out the backoff.
+func (s *service) restart() {
+	s.mu.Lock()
+	cmd := s.cmd
+	s.mu.Unlock()
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+	if cmd != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+}
+
+// shutdown stops the service for good and waits for it to exit.
+func (s *service) shutdown() {
+	if s.stop != nil {
+		s.stop()
+	}
+	<-s.done
+}
+
+// follow streams the service's output to an attached terminal. Pipe output
+// uses bare newlines, which a terminal needs as CRLF.
+func (s *service) follow(ctx context.Context, off int64, send func(data []byte, next int64) error) error {
+	if s.spec.TTY {
+		return s.output.follow(ctx, off, send)
+	}
+	return s.output.follow(ctx, off, func(data []byte, next int64) error {
+		return send(bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n")), next)
+	})
+}
+
+// write sends terminal input to the service's stdin. A terminal sends CR
+// for Enter, which programs reading a pipe expect as LF. Input to a service
+// without stdin is dropped.
+func (s *service) write(p []byte) error {
+	s.mu.Lock()
+	stdin, tty := s.stdin, s.spec.TTY
+	s.mu.Unlock()
+	if stdin == nil {
+		return nil
+	}
+	if !tty {
+		p = bytes.ReplaceAll(p, []byte("\r"), []byte("\n"))
+	}
+	_, err := stdin.Write(p)
+	return err
+}
+
+// key sends a control key to the service. Without a PTY, interrupt and
+// suspend signal its process group and EOF closes its stdin.
+func (s *service) key(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.cmd == nil:
+		return nil
+	case s.ptmx != nil:
+		return sendKey(s.ptmx, key)
+	case key == keyInterrupt:
+		return syscall.Kill(-s.cmd.Process.Pid, syscall.SIGINT)
+	case key == keySuspend:
+		return syscall.Kill(-s.cmd.Process.Pid, syscall.SIGTSTP)
+	case s.stdin != nil:
+		err := s.stdin.Close()
+		s.stdin = nil
+		return err
+	}
+	return nil
+}
+
+// resize applies a terminal's size to a TTY service.
+func (s *service) resize(cols, rows int) error {
+	return s.setSize(cols, rows, false)
+}
+
+// restoreSize is session.restoreSize for a service.
+func (s *service) restoreSize(cols, rows int) error {
+	if cols == 0 && rows == 0 {
+		cols, rows = s.size()
+	}
+	return s.setSize(cols, rows, true)
+}
+
+// setSize resizes the terminal as resizePTY does.
+func (s *service) setSize(cols, rows int, redraw bool) error {
+	cols, rows, err := fitSize(cols, rows)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.cols, s.rows = cols, rows
+	ptmx := s.ptmx
+	s.mu.Unlock()
+	if ptmx == nil {
+		return nil
+	}
+	return resizePTY(ptmx, cols, rows, redraw)
+}
+
+// size is the service's terminal size, 80x24 until one is set.
+func (s *service) size() (cols, rows int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cols == 0 {
+		return 80, 24
+	}
+	return s.cols, s.rows
+}
+
+func handleListServices(w http.ResponseWriter, r *http.Request) {
+	resp := serviceList{Services: []serviceInfo{}}
+	for _, svc := range services.list() {
+		resp.Services = append(resp.Services, svc.info())
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func handleGetService(w http.ResponseWriter, r *http.Request) {
+	svc := services.get(r.PathValue("name"))
+	if svc == nil {
+		httpError(w, r, "service not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, svc.info())
+}
+
+func handleRestartService(w http.ResponseWriter, r *http.Request) {
+	svc := services.get(r.PathValue("name"))
+	if svc == nil {
+		httpError(w, r, "service not found", http.StatusNotFound)
+		return
+	}
+	svc.restart()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+const (
+	maxSessionNameLen = 128
+	maxSessionTags    = 32
+	maxSessionTagLen  = 64
+	maxMetadataKeys   = 64
+	maxMetadataKeyLen = 128
+	maxMetadataValLen = 1024
+)
+
+var errInvalidMetadata = errors.New("invalid session metadata")
+
+// sessionMeta is the client-supplied label of a session, so UIs can show
+// "build" or "db shell" rather than an ID. The server never interprets it.
+type sessionMeta struct {
+	Name     string            `json:"name"`
+	Tags     []string          `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// sessionMetaPatch is the body of PATCH /v1/sessions/{id}. Absent fields are
+// left alone, tags are replaced as a whole, and metadata keys are merged,
+// with null deleting a key.
+type sessionMetaPatch struct {
+	Name     *string            `json:"name"`
+	Tags     *[]string          `json:"tags"`
+	Metadata map[string]*string `json:"metadata"`
+}
+
+// sessionMetaFromQuery reads metadata given when a transport starts a
+// session: ?session_name=build&tag=ci&meta=branch=main. (The Worker already
+// uses ?name= to pick the workspace.)
+func sessionMetaFromQuery(q url.Values) (sessionMeta, error) {
+	m := sessionMeta{Name: q.Get("session_name"), Tags: q["tag"]}
+	for _, kv := range q["meta"] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return sessionMeta{}, fmt.Errorf("%w: meta %q must be key=value", errInvalidMetadata, kv)
+		}
+		if m.Metadata == nil {
+			m.Metadata = make(map[string]string)
+		}
+		m.Metadata[k] = v
+	}
+	return m, m.validate()
+}
+
+func (m sessionMeta) validate() error {
+	var errs []error
+	if len(m.Name) > maxSessionNameLen {
+		errs = append(errs, fmt.Errorf("name is longer than %d bytes", maxSessionNameLen))
+	}
+	if len(m.Tags) > maxSessionTags {
+		errs = append(errs, fmt.Errorf("more than %d tags", maxSessionTags))
+	}
+	for _, t := range m.Tags {
+		if t == "" || len(t) > maxSessionTagLen {
+			errs = append(errs, fmt.Errorf("tag %q must be 1-%d bytes", t, maxSessionTagLen))
+		}
+	}
+	if len(m.Metadata) > maxMetadataKeys {
+		errs = append(errs, fmt.Errorf("more than %d metadata keys", maxMetadataKeys))
+	}
+	for k, v := range m.Metadata {
+		if k == "" || len(k) > maxMetadataKeyLen {
+			errs = append(errs, fmt.Errorf("metadata key %q must be 1-%d bytes", k, maxMetadataKeyLen))
+		}
+		if len(v) > maxMetadataValLen {
+			errs = append(errs, fmt.Errorf("metadata %q is longer than %d bytes", k, maxMetadataValLen))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidMetadata, err)
+	}
+	return nil
+}
+
+// apply returns m with p applied, leaving m unchanged.
+func (m sessionMeta) apply(p sessionMetaPatch) (sessionMeta, error) {
+	out := sessionMeta{Name: m.Name, Tags: slices.Clone(m.Tags), Metadata: maps.Clone(m.Metadata)}
+	if p.Name != nil {
+		out.Name = *p.Name
+	}
+	if p.Tags != nil {
+		out.Tags = slices.Clone(*p.Tags)
+	}
+	for k, v := range p.Metadata {
+		if v == nil {
+			delete(out.Metadata, k)
+			continue
+		}
+		if out.Metadata == nil {
+			out.Metadata = make(map[string]string)
+		}
+		out.Metadata[k] = *v
+	}
+	return out, out.validate()
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+const (
+	// scrollbackLimit is how much output each session retains for readers
+	// that fall behind or (re)attach.
+	scrollbackLimit = 1 << 20
+	// maxOutputFrame bounds a single frame sent to a client.
+	maxOutputFrame = 32 * 1024
+	// coalesceWindow is how long output is held to batch bursts when the
+	// output_coalescing flag is on.
+	coalesceWindow = 5 * time.Millisecond
+	// shellExitTimeout is how long a closed session's shell gets to exit
+	// after the hangup before its process group is killed.
+	shellExitTimeout = 5 * time.Second
+)
+
+var (
+	errTooManySessions = errors.New("too many sessions")
+	errSessionNotFound = errors.New("session not found")
+	errSessionClosed   = errors.New("session closed")
+	errInvalidSize     = errors.New("invalid terminal size")
+)
+
+// fitSize rejects terminal sizes that are zero or negative and clamps
+// larger ones than max_cols and max_rows, which would leave programs
+// allocating screens for sizes nobody can see.
+func fitSize(cols, rows int) (int, int, error) {
+	if cols < 1 || rows < 1 {
+		return 0, 0, fmt.Errorf("%w %dx%d: cols and rows must be positive", errInvalidSize, cols, rows)
+	}
+	cfg := currentConfig()
+	return min(cols, cfg.MaxCols), min(rows, cfg.MaxRows), nil
+}
+
+// session is a shell running on a PTY. It outlives any single client
+// connection; transports attach to it to stream output and send input.
+type session struct {
+	id         string
+	user       string // set if the session is scoped to a user
+	cmd        *exec.Cmd
+	ptmx       *os.File
+	created    time.Time
+	rec        *recorder
+	output     *outputLog
+	osc52      osc52Scanner  // only used by pump
+	modeScan   modeScanner   // only used by pump
+	promptScan promptScanner // only used by pump
+	transcript *transcript
+	inputLog   trafficLog
+	outputLog  trafficLog // only used by pump
+
+	// done is closed once the shell has exited and been reaped, parked
+	// once pump has stopped for an upgrade.
+	done   chan struct{}
+	parked chan struct{}
+	// exited is set once the PTY is known to be gone: pump read its end,
+	// or a write failed on it. dropOnce logs the first input dropped.
+	exited   atomic.Bool
+	dropOnce sync.Once
+	// unclaimed is set on sessions resumed after an upgrade, or left by a
+	// resumable connection that dropped, until a client attaches to them
+	// again; claims counts the waits, so only the latest one's timer
+	// closes the session. stream is the resumable connection attached.
+	unclaimed atomic.Bool
+	claims    atomic.Int64
+	stream    atomic.Pointer[resumableStream]
+	// warm is set while the session waits in the warm pool, unlisted, for
+	// start to hand it out (see warmpool.go).
+	warm  atomic.Bool
+	dedup inputDedup
+	// floor arbitrates input between its /ws connections.
+	floor inputFloor
+	// notifyPending counts the webhooks waiting on its commands.
+	notifyPending atomic.Int32
+
+	mu     sync.Mutex
+	closed bool
+	meta   sessionMeta
+	modes  terminalModes
+	// prompt is what shell integration reported, nil until it has;
+	// promptChanged is closed when it changes.
+	prompt        *promptState
+	promptChanged chan struct{}
+	// history is the commands the shell reported running, oldest first;
+	// commandsRun counts them all, and commandDone is closed when another
+	// finishes.
+	history     []commandRecord
+	commandsRun int
+	commandDone chan struct{}
+	// injections is the audit trail of input injected through the API
+	// (see inject.go), oldest first.
+	injections []injectionRecord
+	// alerts are the last bells and notifications raised, of alertsSent
+	// in all; alertChanged is closed when another is. lastBell,
+	// notifyWindow and notifyCount limit their rate.
+	alerts       []alertMessage
+	alertsSent   int
+	alertChanged chan struct{}
+	lastBell     time.Time
+	notifyWindow time.Time
+	notifyCount  int
+	// cols and rows are the terminal's size as last set.
+	cols, rows int
+	// attached counts the clients following the output, and lastActive
+	// is when one last detached or sent anything; suspended lists the
+	// processes idle_suspend stopped, nil unless it has (see suspend.go).
+	attached   int
+	lastActive time.Time
+	suspended  []procKey
+}
+
+type sessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	// warmTarget is how many warm sessions the pool keeps; warming is set
+	// while it's being filled.
+	warmTarget int
+	warming    bool
+}
+
+var sessions = &sessionManager{sessions: make(map[string]*session)}
+
+// full reports whether starting another session would exceed max_sessions.
+// Warm sessions don't count: one is handed out or makes way.
+func (m *sessionManager) full() bool {
+	limit := currentConfig().MaxSessions
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return limit > 0 && m.countLocked(false) >= limit
+}
+
+// countLocked counts the sessions that are warm, or that aren't.
+func (m *sessionManager) countLocked(warm bool) int {
+	n := 0
+	for _, s := range m.sessions {
+		if s.warm.Load() == warm {
+			n++
+		}
+	}
+	return n
+}
+
+// start spawns a shell in dataDir, or in user's namespace if set, on a new PTY
+// of the given size. A session without a user is taken from the warm pool
+// if one is waiting there.
+func (m *sessionManager) start(cols, rows int, meta sessionMeta, user string) (*session, error) {
+	cols, rows, err := fitSize(cols, rows)
+	if err != nil {
+		return nil, err
+	}
+	if user == "" {
+		if s := m.takeWarm(cols, rows, meta); s != nil {
+			return s, nil
+		}
+	}
+	return m.spawn(cols, rows, meta, user, spawnOptions{})
+}
+
+// startFor starts a session for the user a request is from: one limited to
+// paths starts in, and has as HOME, its grants' home rather than the user's
+// namespace.
+func (m *sessionManager) startFor(ctx context.Context, cols, rows int, meta sessionMeta) (*session, error) {
+	user, grants := userFromContext(ctx), pathGrantsFromContext(ctx)
+	if user == "" || grants == nil {
+		return m.start(cols, rows, meta, user)
+	}
+	cols, rows, err := fitSize(cols, rows)
+	if err != nil {
+		return nil, err
+	}
+	return m.spawn(cols, rows, meta, user, spawnOptions{home: filepath.Join(dataDir, grants.home())})
+}
+
+// spawnOptions are how a session is started other than for a client.
+type spawnOptions struct {
+	// warm starts it for the warm pool.
+	warm bool
+	// from recreates a session handed off by another container.
+	from *handoffSession
+	// home is the user's directory in place of their namespace.
+	home string
+}
+
+// spawn starts a new shell for start, or as opts say.
+func (m *sessionManager) spawn(cols, rows int, meta sessionMeta, user string, opts spawnOptions) (*session, error) {
+	var err error
+	warm := opts.warm
+	// A user's shell starts in, and has as HOME, the user's namespace.
+	dir, env := dataDir, spawnEnv()
+	if user != "" {
+		dir = userRoot(user)
+		if opts.home != "" {
+			dir = opts.home
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		env = append(env, "HOME="+dir)
+	}
+	// A handed-off session's shell starts where the last one was, with
+	// the variables it was started with; those the server sets win.
+	if opts.from != nil {
+		dir, env = opts.from.shellDir(dir), append(env, opts.from.Env...)
+	}
+	m.mu.Lock()
+	if handingOver.Load() {
+		m.mu.Unlock()
+		return nil, errUpgrading
+	}
+	limit := currentConfig().MaxSessions
+	if warm && limit > 0 && len(m.sessions) >= limit {
+		m.mu.Unlock()
+		return nil, errTooManySessions
+	}
+	if limit > 0 && m.countLocked(false) >= limit {
+		m.mu.Unlock()
+		warnf("Rejecting session: max_sessions=%d reached", limit)
+		return nil, errTooManySessions
+	}
+	if limit > 0 && len(m.sessions) >= limit {
+		m.evictWarmLocked()
+	}
+	s := &session{
+		id:         randomID(),
+		user:       user,
+		created:    time.Now(),
+		output:     newOutputLog(scrollbackLimit),
+		transcript: newTranscript(),
+		done:       make(chan struct{}),
+		parked:     make(chan struct{}),
+		meta:       meta,
+		cols:       cols,
+		rows:       rows,
+	}
+	s.warm.Store(warm)
+	if opts.from != nil {
+		opts.from.restore(s)
+	}
+	s.inputLog = trafficLog{session: s.id, dir: "input"}
+	s.outputLog = trafficLog{session: s.id, dir: "output"}
+	// Reserve the slot before spawning so concurrent starts can't overshoot.
+	m.sessions[s.id] = s
+	m.mu.Unlock()
+
+	// Create shell command
+	shell := getShell()
+	cmd := exec.Command(shell)
+	cmd.Dir = dir
+	cmd.Env = append(env,
+		"TERM=xterm-256color",
+		"COLORTERM=truecolor",
+		// Marks everything the shell starts, even after it daemonizes, so
+		// the orphan sweeper can tell whose it is.
+		sessionEnv+"="+s.id,
+		"PATH="+envCommandDir+string(os.PathListSeparator)+os.Getenv("PATH"),
+	)
+	cmd.Env = append(cmd.Env, workspace.current().env()...)
+	cmd.Env = append(cmd.Env, sessionEnvVars(user)...)
+	cmd.Env = append(cmd.Env, shellIntegrationEnv(shell)...)
+	if tmp := makeSessionTmp(s.id); tmp != "" {
+		cmd.Env = append(cmd.Env, "TMPDIR="+tmp)
+	}
+
+	// Start PTY
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{
+		Rows: uint16(rows),
+		Cols: uint16(cols),
+	})
+	if err == nil {
+		if ptmx, err = pollablePTY(ptmx); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}
+	if err != nil {
+		m.remove(s)
+		removeSessionTmp(s.id)
+		return nil, fmt.Errorf("starting PTY: %w", err)
+	}
+	procLimit.add(cmd.Process.Pid)
+	// Under m.mu so shells() can read it while the session is listed.
+	m.mu.Lock()
+	s.cmd = cmd
+	m.mu.Unlock()
+	s.ptmx = ptmx
+
+	if opts.from != nil {
+		s.rec = opts.from.rec
+	} else if flags.enabled(flagRecording) {
+		name := fmt.Sprintf("%s-%s", s.created.UTC().Format("20060102T150405Z"), s.id)
+		if s.rec, err = newRecorder(name, cols, rows); err != nil {
+			warnf("Failed to start recording: %v", err)
+		} else {
+			infof("Recording session %s to %s.cast", s.id, name)
+		}
+	}
+
+	go s.pump(m)
+	if msg := degraded.banner(); msg != "" {
+		s.notice(msg)
+	}
+	// A handed-off session carries on where it was.
+	if opts.from == nil {
+		s.showMOTD()
+	}
+	if warm {
+		debugf("Warm session %s started (%s)", s.id, shell)
+	} else {
+		infof("Session %s started (%s, %dx%d)", s.id, shell, cols, rows)
+		events.publish(event{Kind: eventSessionStarted, Session: s})
+	}
+	return s, nil
+}
+
+// get returns the live session id; warm sessions aren't anyone's yet.
+func (m *sessionManager) get(id string) *session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.sessions[id]; s != nil && !s.warm.Load() {
+		return s
+	}
+	return nil
+}
+
+func (m *sessionManager) remove(s *session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, s.id)
+	s.output.discardPacked()
+}
+
+// list returns live sessions, oldest first, leaving out warm ones.
+func (m *sessionManager) list() []*session {
+	m.mu.Lock()
+	out := make([]*session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		if !s.warm.Load() {
+			out = append(out, s)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].created.Before(out[j].created) })
+	return out
+}
+
+// shells maps the pid of each live session's shell to the session ID. A
+// shell is its own Unix session, so the pid is also the session ID of its
+// jobs.
+func (m *sessionManager) shells() map[int]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[int]string, len(m.sessions))
+	for id, s := range m.sessions {
+		if s.cmd != nil {
+			out[s.cmd.Process.Pid] = id
+		}
+	}
+	return out
+}
+
+// pump copies PTY output into the session's log until the shell exits, then
+// reaps it and unregisters the session.
+func (s *session) pump(m *sessionManager) {
+	buf := make([]byte, 8192)
+	for {
+		n, err := s.ptmx.Read(buf)
+		if n > 0 {
+			if s.rec != nil {
+				s.rec.output(buf[:n])
+			}
+			s.output.append(buf[:n])
+			s.osc52.scan(buf[:n], s.handleOSC52)
+			if s.modeScan.scan(buf[:n]) {
+				s.mu.Lock()
+				s.modes = s.modeScan.modes
+				s.mu.Unlock()
+			}
+			if s.promptScan.feed(buf[:n]) {
+				s.setPrompt(s.promptScan.state)
+			}
+			if cmds := s.promptScan.takeFinished(); len(cmds) > 0 {
+				s.addHistory(cmds)
+			}
+			if alerts := s.promptScan.takeAlerts(); len(alerts) > 0 {
+				s.addAlerts(alerts)
+			}
+			s.transcript.write(buf[:n])
+			s.outputLog.log(buf[:n])
+		}
+		if err != nil {
+			if handingOver.Load() && errors.Is(err, os.ErrDeadlineExceeded) {
+				close(s.parked)
+				return
+			}
+			s.exited.Store(true)
+			// Reading a PTY whose shell exited fails with EIO rather than EOF.
+			if err != io.EOF && !s.isClosed() && !errors.Is(err, os.ErrClosed) {
+				debugf("Session %s PTY read ended: %v", s.id, err)
+			}
+			break
+		}
+	}
+	s.close()
+	s.reap()
+	// The PTY started the shell as the leader of a new Unix session, so its
+	// pid is also the session ID of every job it started.
+	// Its TMPDIR goes once they're gone.
+	go func() {
+		killSessionProcesses(s.id, s.cmd.Process.Pid)
+		removeSessionTmp(s.id)
+	}()
+	if s.rec != nil {
+		if err := s.rec.close(); err != nil {
+			warnf("Session %s: closing recording: %v", s.id, err)
+		} else if bucketStore.Load() != nil {
+			go uploadRecording(s.rec.path)
+		}
+	}
+	s.output.close()
+	m.remove(s)
+	dropSessionTraffic(s.id)
+	close(s.done)
+	if !s.warm.Load() {
+		events.publish(event{Kind: eventSessionEnded, Session: s})
+	}
+}
+
+// reap waits for the shell to exit, killing its process group if it ignores
+// the hangup, and logs how the session ended.
+func (s *session) reap() {
+	waited := make(chan error, 1)
+	go func() { waited <- s.cmd.Wait() }()
+
+	killed := false
+	select {
+	case <-waited:
+	case <-time.After(shellExitTimeout):
+		warnf("Session %s: shell did not exit within %s, killing its process group", s.id, shellExitTimeout)
+		// pty.Start runs the shell with Setsid, which also makes it the
+		// leader of its own process group.
+		syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+		killed = true
+		select {
+		case <-waited:
+		case <-time.After(shellExitTimeout):
+			errorf("Session %s: shell (pid %d) still running after SIGKILL, abandoning it", s.id, s.cmd.Process.Pid)
+			return
+		}
+	}
+
+	st := s.cmd.ProcessState
+	if st == nil {
+		infof("Session %s ended", s.id)
+		return
+	}
+	switch ws, _ := st.Sys().(syscall.WaitStatus); {
+	case killed:
+		infof("Session %s ended: shell killed after ignoring the hangup", s.id)
+	case ws.Signaled():
+		infof("Session %s ended: shell killed by signal %v", s.id, ws.Signal())
+	default:
+		infof("Session %s ended: shell exited with status %d", s.id, st.ExitCode())
+	}
+}
+
+func (s *session) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// close hangs up the terminal, as closing a terminal window does; pump
+// notices and finishes the teardown.
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	// Stopped processes wouldn't handle the hangup.
+	s.resumeLocked()
+
+	if s.ptmx != nil {
+		s.ptmx.Close()
+	}
+	if s.cmd != nil && s.cmd.Process != nil {
+		// Hang up the shell and anything in its process group; the kernel
+		// hangs up the foreground job when the master closes.
+		syscall.Kill(-s.cmd.Process.Pid, syscall.SIGHUP)
+	}
+}
+
+func (s *session) metadata() sessionMeta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.meta
+}
+
+// terminalModes returns the modes the session's programs have set.
+func (s *session) terminalModes() terminalModes {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.modes
+}
+
+func (s *session) size() (cols, rows int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cols, s.rows
+}
+
+// updateMetadata applies p and returns the result.
+func (s *session) updateMetadata(p sessionMetaPatch) (sessionMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next, err := s.meta.apply(p)
+	if err != nil {
+		return sessionMeta{}, err
+	}
+	s.meta = next
+	return next, nil
+}
+
+// notice shows msg in the session's terminal, on a line of its own, as a
+// message from the server rather than from the shell.
+func (s *session) notice(msg string) {
+	line := []byte("\r\n\x1b[1;33m[do-s3] " + msg + "\x1b[0m\r\n")
+	s.output.append(line)
+	s.transcript.write(line)
+}
+
+func (s *session) write(p []byte) error {
+	return s.usePTY("input", func(f *os.File) error {
+		s.active()
+		s.inputLog.log(p)
+		_, err := f.Write(p)
+		return err
+	})
+}
+
+// usePTY calls fn with the session's PTY unless the shell is gone. What
+// races the shell's exit fails on the PTY with EIO, or with os.ErrClosed
+// once close has run; any of them is errSessionClosed, so transports treat
+// it as the session ending rather than an I/O error, and only the first is
+// logged.
+func (s *session) usePTY(op string, fn func(f *os.File) error) error {
+	if !s.isClosed() && !s.exited.Load() {
+		err := fn(s.ptmx)
+		if err == nil || !(ptyGone(err) || s.isClosed()) {
+			return err
+		}
+		s.exited.Store(true)
+	}
+	s.dropOnce.Do(func() { debugf("Session %s has ended: dropping %s and anything sent after it", s.id, op) })
+	return errSessionClosed
+}
+
+// ptyWarnf logs a failure to use a terminal, unless it's only that the
+// session has ended, which usePTY logs itself.
+func ptyWarnf(err error, format string, args ...any) {
+	if !errors.Is(err, errSessionClosed) {
+		warnf(format, args...)
+	}
+}
+
+// ptyGone reports whether err is from a PTY whose other end has gone.
+func ptyGone(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.EBADF) || errors.Is(err, os.ErrClosed)
+}
+
+func (s *session) resize(cols, rows int) error {
+	return s.setSize(cols, rows, false)
+}
+
+// setSize resizes the terminal as resizePTY does.
+func (s *session) setSize(cols, rows int, redraw bool) error {
+	cols, rows, err := fitSize(cols, rows)
+	if err != nil {
+		return err
+	}
+	if err := s.usePTY("resize", func(f *os.File) error { return resizePTY(f, cols, rows, redraw) }); err != nil {
+		return err
+	}
+	s.active()
+	s.mu.Lock()
+	s.cols, s.rows = cols, rows
+	s.mu.Unlock()
+	if s.rec != nil {
+		s.rec.resize(cols, rows)
+	}
+	return nil
+}
+
+// restoreSize sets the terminal to the size reported by a client attaching
+// to the session, or back to the size last set if it reported none, and
+// signals SIGWINCH even when that leaves the size unchanged: the kernel only
+// signals a change, and full-screen programs must redraw for the new client
+// either way, or it sees a screen drawn for the last one.
+func (s *session) restoreSize(cols, rows int) error {
+	if cols == 0 && rows == 0 {
+		cols, rows = s.size()
+	}
+	return s.setSize(cols, rows, true)
+}
+
+// key sends one of the named control keys to the shell's terminal.
+func (s *session) key(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return s.usePTY(key, func(f *os.File) error {
+		s.active()
+		return sendKey(f, key)
+	})
+}
+
+// follow calls send with the session's output from offset off onwards until
+// the session ends (returning nil), ctx is done, or send fails.
+func (s *session) follow(ctx context.Context, off int64, send func(data []byte, next int64) error) error {
+	s.unclaimed.Store(false)
+	defer s.attach()()
+	return s.output.follow(ctx, off, send)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"server/container_src/client"
+	"server/container_src/internal/termtest"
+)
+
+func TestSession(t *testing.T) {
+	c := dialTest(t)
+	term := termtest.Open(t, c, client.SessionOptions{Name: "test-shell", Cols: 100, Rows: 30})
+	term.Expect(`\$ `)
+	term.Send("echo $((6*7)) && pwd\n")
+	term.Expect(`\n42\n`)
+	term.Expect(regexp.QuoteMeta(dataDir))
+
+	ctx := context.Background()
+	list, err := c.Sessions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	for _, s := range list {
+		if s.Name == "test-shell" {
+			id = s.ID
+		}
+	}
+	if id == "" {
+		t.Fatalf("Sessions = %+v, want one named test-shell", list)
+	}
+
+	// Ctrl-C interrupts the foreground program, not the shell.
+	term.Send("sleep 30\n")
+	time.Sleep(300 * time.Millisecond)
+	if err := term.Session().Interrupt(); err != nil {
+		t.Fatal(err)
+	}
+	term.Send("echo status=$?\n")
+	term.Expect(`status=130`)
+
+	if err := c.CloseSession(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Session(ctx, id); !isStatus(err, http.StatusNotFound) {
+		t.Fatalf("Session after close = %v, want 404", err)
+	}
+}
+
+func TestSessionResize(t *testing.T) {
+	cfg := *currentConfig()
+	cfg.MaxCols = 300
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	ctx := context.Background()
+	c := dialTest(t)
+	post := func(path, body string) *http.Response {
+		t.Helper()
+		resp, err := http.Post(testURL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	if resp := post("/v1/poll?cols=wide", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("poll with cols=wide: %s", resp.Status)
+	}
+	resp := post("/v1/poll?cols=5000&rows=30", "")
+	var poll pollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&poll); err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseSession(ctx, poll.ID)
+	size := func() (int, int) {
+		t.Helper()
+		resp, err := http.Get(testURL + "/v1/sessions/" + poll.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var info sessionInfo
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		return info.Cols, info.Rows
+	}
+	if cols, rows := size(); cols != 300 || rows != 30 {
+		t.Fatalf("session started at 5000x30 is %dx%d, want it clamped to 300x30", cols, rows)
+	}
+	if resp := post("/v1/sessions/"+poll.ID+"/resize", `{"cols": 120, "rows": 100000}`); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("resize: %s", resp.Status)
+	}
+	if cols, rows := size(); cols != 120 || rows != 1000 {
+		t.Fatalf("size after resizing to 120x100000 = %dx%d, want 120x1000", cols, rows)
+	}
+	if resp := post("/v1/sessions/"+poll.ID+"/resize", `{"cols": 0, "rows": 40}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("resize to 0x40: %s", resp.Status)
+	}
+	if cols, rows := size(); cols != 120 || rows != 1000 {
+		t.Fatalf("size after a rejected resize = %dx%d", cols, rows)
+	}
+}
+
+func TestRestoreSize(t *testing.T) {
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	winches := func(want int) {
+		t.Helper()
+		var n int
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			data, _, _ := sess.output.read(0, 1<<20)
+			if n = strings.Count(string(data), "winch "); n >= want {
+				break
+			}
+		}
+		if n != want {
+			t.Fatalf("%d SIGWINCHes handled, want %d", n, want)
+		}
+	}
+	// A full-screen program stands in the foreground; the quotes keep the
+	// echoed command line from matching.
+	if err := sess.write([]byte(`sh -c 'trap "echo win""ch \$(stty size)" WINCH; echo rea""dy; while :; do sleep 0.05; done'` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	for data := []byte{}; !strings.Contains(string(data), "ready\r\n"); time.Sleep(10 * time.Millisecond) {
+		data, _, _ = sess.output.read(0, 1<<20)
+	}
+
+	// A client with no size of its own gets the last one, redrawn.
+	if err := sess.restoreSize(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	winches(1)
+	if err := sess.restoreSize(100, 30); err != nil {
+		t.Fatal(err)
+	}
+	winches(2)
+	if cols, rows := sess.size(); cols != 100 || rows != 30 {
+		t.Errorf("size %dx%d after attaching at 100x30", cols, rows)
+	}
+	if data, _, _ := sess.output.read(0, 1<<20); !strings.Contains(string(data), "winch 24 80") || !strings.Contains(string(data), "winch 30 100") {
+		t.Errorf("output %q", data)
+	}
+}
+
+func TestWriteAfterExit(t *testing.T) {
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	// The PTY going away under a write that has checked the session is
+	// still open, as when the shell exits between the two.
+	sess.ptmx.Close()
+	for name, err := range map[string]error{
+		"write":  sess.write([]byte("echo hi\n")),
+		"resize": sess.resize(100, 30),
+		"key":    sess.key(keyInterrupt),
+	} {
+		if !errors.Is(err, errSessionClosed) {
+			t.Errorf("%s after exit: %v, want errSessionClosed", name, err)
+		}
+	}
+	if err := sess.key("bogus"); !errors.Is(err, errUnknownKey) {
+		t.Errorf("unknown key after exit: %v", err)
+	}
+	select {
+	case <-sess.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not torn down")
+	}
+
+	p, err := startPipe("true", trafficLSP, exec.Command("true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.pump(context.Background(), func([]byte) error { return nil })
+	if err := p.write([]byte("more\n")); err != nil {
+		t.Errorf("write to an exited program: %v", err)
+	}
+}
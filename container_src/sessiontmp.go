@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// sessionTmpRoot holds a TMPDIR for each session, removed when the session
+// ends, so temporary files from interactive work don't pile up. Like
+// recordingsDir, it is local scratch space, not the S3 mount.
+var sessionTmpRoot = envOr("SESSION_TMP_DIR", filepath.Join(os.TempDir(), "dos3-session-tmp"))
+
+func sessionTmpDir(id string) string {
+	return filepath.Join(sessionTmpRoot, id)
+}
+
+// makeSessionTmp creates session id's TMPDIR and returns it, or "" if it
+// can't, leaving the session with the system's.
+func makeSessionTmp(id string) string {
+	dir := sessionTmpDir(id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		warnf("Session %s: no temporary directory: %v", id, err)
+		return ""
+	}
+	return dir
+}
+
+// removeSessionTmp deletes session id's TMPDIR with whatever was left in
+// it.
+func removeSessionTmp(id string) {
+	if err := os.RemoveAll(sessionTmpDir(id)); err != nil {
+		warnf("Session %s: removing its temporary directory: %v", id, err)
+	}
+}
+
+// sweepSessionTmp removes the TMPDIRs of sessions that aren't live, left by
+// a server that crashed or was replaced without handing its sessions over.
+func sweepSessionTmp() {
+	entries, err := os.ReadDir(sessionTmpRoot)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		warnf("Reading %s: %v", sessionTmpRoot, err)
+		return
+	}
+	live := make(map[string]bool)
+	for _, s := range sessions.list() {
+		live[s.id] = true
+	}
+	n := 0
+	for _, e := range entries {
+		if live[e.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(sessionTmpRoot, e.Name())); err != nil {
+			warnf("Removing an abandoned session temporary directory: %v", err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		infof("Removed %d abandoned session temporary directories", n)
+	}
+}
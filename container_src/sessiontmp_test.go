@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"server/container_src/client"
+	"server/container_src/internal/termtest"
+)
+
+func TestSessionTmpDir(t *testing.T) {
+	prev := sessionTmpRoot
+	sessionTmpRoot = t.TempDir()
+	defer func() { sessionTmpRoot = prev }()
+	// A directory left by a previous server is swept.
+	if err := os.Mkdir(filepath.Join(sessionTmpRoot, "gone"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	sweepSessionTmp()
+	if _, err := os.Stat(filepath.Join(sessionTmpRoot, "gone")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("abandoned directory after the sweep: %v", err)
+	}
+
+	c := dialTest(t)
+	ctx := context.Background()
+	term := termtest.Open(t, c, client.SessionOptions{Name: "tmp-shell"})
+	term.Expect(`\$ `)
+	term.Send("touch $TMPDIR/scratch && echo tmp=$TMPDIR\n")
+	term.Expect(`tmp=` + regexp.QuoteMeta(sessionTmpRoot) + `/\w+`)
+	list, err := c.Sessions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	for _, s := range list {
+		if s.Name == "tmp-shell" {
+			id = s.ID
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sessionTmpDir(id), "scratch")); err != nil {
+		t.Fatalf("session temp file: %v", err)
+	}
+	if err := c.CloseSession(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if _, err := os.Stat(sessionTmpDir(id)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session temp directory still there after the session ended")
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Modes a share link grants: observers see the terminal, writers can also
+// type into it.
+const (
+	shareObserve = "observe"
+	shareWrite   = "write"
+)
+
+const (
+	defaultShareTTL = time.Hour
+	maxShareTTL     = 7 * 24 * time.Hour
+	// maxShares bounds the links live at once, across sessions.
+	maxShares = 256
+)
+
+var errInvalidShare = errors.New("invalid share")
+
+var shareConnections = newCounter("dos3_share_connections_total",
+	"Connections to /ws made with a share link, by mode.")
+
+// shareRequest is the body of POST /v1/sessions/{id}/shares.
+type shareRequest struct {
+	// Mode is observe (the default) or write.
+	Mode string   `json:"mode"`
+	TTL  duration `json:"ttl"`
+}
+
+// shareInfo is a link letting someone else attach to a session until it
+// expires or is revoked.
+type shareInfo struct {
+	ID      string    `json:"id"`
+	Session string    `json:"session"`
+	Mode    string    `json:"mode"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// Token and Fragment are only returned when the link is made: Token
+	// attaches with /ws?share=, and Fragment carries it as a URL fragment,
+	// which browsers don't send on, for the frontend to build the link from.
+	Token    string `json:"token,omitempty"`
+	Fragment string `json:"fragment,omitempty"`
+}
+
+type shareList struct {
+	Shares []shareInfo `json:"shares"`
+}
+
+// share is a live share link. Only a hash of its token is kept.
+type share struct {
+	info shareInfo
+	// revoked is closed when the link is revoked or its session ends.
+	revoked chan struct{}
+}
+
+type shareBook struct {
+	mu sync.Mutex
+	// byHash holds the links by shaString of their token.
+	byHash map[string]*share
+}
+
+var shares = &shareBook{byHash: make(map[string]*share)}
+
+// Links go with the session they're for.
+var _ = events.subscribe("shares", func(e event) {
+	if e.Session != nil {
+		shares.revokeSession(e.Session.id)
+	}
+}, eventSessionEnded)
+
+// dropExpiredLocked forgets links past their expiry. Called with b.mu held.
+func (b *shareBook) dropExpiredLocked(now time.Time) {
+	for h, sh := range b.byHash {
+		if !now.Before(sh.info.Expires) {
+			delete(b.byHash, h)
+		}
+	}
+}
+
+// create makes a link to sess.
+func (b *shareBook) create(sess *session, req shareRequest) (shareInfo, error) {
+	switch req.Mode {
+	case "":
+		req.Mode = shareObserve
+	case shareObserve, shareWrite:
+	default:
+		return shareInfo{}, fmt.Errorf("%w: mode %q, want %s or %s", errInvalidShare, req.Mode, shareObserve, shareWrite)
+	}
+	ttl := req.TTL.Duration
+	if ttl == 0 {
+		ttl = defaultShareTTL
+	}
+	if ttl < 0 || ttl > maxShareTTL {
+		return shareInfo{}, fmt.Errorf("%w: ttl must be positive and at most %s", errInvalidShare, maxShareTTL)
+	}
+	token := randomID() + randomID()
+	now := time.Now().UTC()
+	sh := &share{
+		info: shareInfo{
+			ID:      randomID(),
+			Session: sess.id,
+			Mode:    req.Mode,
+			Created: now,
+			Expires: now.Add(ttl),
+		},
+		revoked: make(chan struct{}),
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dropExpiredLocked(now)
+	if len(b.byHash) >= maxShares {
+		return shareInfo{}, fmt.Errorf("%w: %d share links are live already", errInvalidShare, maxShares)
+	}
+	b.byHash[shaString(token)] = sh
+	info := sh.info
+	info.Token, info.Fragment = token, "share="+token
+	return info, nil
+}
+
+// list returns the live links to session id, oldest first.
+func (b *shareBook) list(id string) []shareInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dropExpiredLocked(time.Now())
+	list := []shareInfo{}
+	for _, sh := range b.byHash {
+		if sh.info.Session == id {
+			list = append(list, sh.info)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// revoke ends link shareID to session id, disconnecting whoever it let in.
+func (b *shareBook) revoke(id, shareID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for h, sh := range b.byHash {
+		if sh.info.Session == id && sh.info.ID == shareID {
+			delete(b.byHash, h)
+			close(sh.revoked)
+			return true
+		}
+	}
+	return false
+}
+
+// revokeSession ends every link to session id.
+func (b *shareBook) revokeSession(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for h, sh := range b.byHash {
+		if sh.info.Session == id {
+			delete(b.byHash, h)
+			close(sh.revoked)
+		}
+	}
+}
+
+// resolve returns the link token is for and its session, if both are live.
+func (b *shareBook) resolve(token string) (*share, *session, bool) {
+	b.mu.Lock()
+	sh := b.byHash[shaString(token)]
+	b.mu.Unlock()
+	if sh == nil || !time.Now().Before(sh.info.Expires) {
+		return nil, nil, false
+	}
+	sess := sessions.get(sh.info.Session)
+	if sess == nil {
+		return nil, nil, false
+	}
+	return sh, sess, true
+}
+
+// wait returns true once the link is revoked or expires, or false if ctx
+// is done first.
+func (sh *share) wait(ctx context.Context) bool {
+	timer := time.NewTimer(time.Until(sh.info.Expires))
+	defer timer.Stop()
+	select {
+	case <-sh.revoked:
+		return true
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// guestTarget is a shared session as a share link's guest drives it: the
+// terminal keeps its owner's size, and observers can't type.
+type guestTarget struct {
+	*session
+	observe bool
+}
+
+func (g guestTarget) write(p []byte) error {
+	if g.observe {
+		return nil
+	}
+	return g.session.write(p)
+}
+
+func (g guestTarget) key(key string) error {
+	if g.observe {
+		return nil
+	}
+	return g.session.key(key)
+}
+
+func (g guestTarget) resize(cols, rows int) error { return nil }
+
+func handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	var req shareRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, r, fmt.Errorf("%w: %v", errInvalidShare, err))
+		return
+	}
+	info, err := shares.create(sess, req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	infof("Session %s shared (%s) until %s", sess.id, info.Mode, info.Expires.Format(time.RFC3339))
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func handleListShares(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, shareList{Shares: shares.list(sess.id)})
+}
+
+func handleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	if !shares.revoke(sess.id, r.PathValue("share")) {
+		httpError(w, r, "share not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShareLinks(t *testing.T) {
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	create := func(body string) (shareInfo, int) {
+		t.Helper()
+		resp, err := http.Post(testURL+"/v1/sessions/"+sess.id+"/shares", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var info shareInfo
+		json.NewDecoder(resp.Body).Decode(&info)
+		return info, resp.StatusCode
+	}
+	observe, status := create(`{"ttl": "10m"}`)
+	if status != http.StatusCreated || observe.Mode != shareObserve || observe.Token == "" || observe.Fragment != "share="+observe.Token {
+		t.Fatalf("observer link: %d %+v", status, observe)
+	}
+	write, _ := create(`{"mode": "write"}`)
+	if _, status := create(`{"mode": "admin"}`); status != http.StatusBadRequest {
+		t.Errorf("mode admin: %d", status)
+	}
+	resp, err := http.Get(testURL + "/v1/sessions/" + sess.id + "/shares")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list shareList
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Shares) != 2 || list.Shares[0].Token != "" || list.Shares[1].Mode != shareWrite {
+		t.Errorf("links %+v", list.Shares)
+	}
+
+	wsBase := "ws" + strings.TrimPrefix(testURL, "http") + "/ws?share="
+	dial := func(token string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(wsBase+token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		return conn
+	}
+	// readFor reads conn's output until it has want.
+	readFor := func(conn *websocket.Conn, want string) string {
+		t.Helper()
+		var out strings.Builder
+		for !strings.Contains(out.String(), want) {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("reading for %q: %v; got %q", want, err, out.String())
+			}
+			out.Write(data)
+		}
+		return out.String()
+	}
+	observer := dial(observe.Token)
+	defer observer.Close()
+	writer := dial(write.Token)
+	defer writer.Close()
+
+	observer.WriteMessage(websocket.TextMessage, []byte("echo observer-$((1+1))\n"))
+	writer.WriteMessage(websocket.TextMessage, []byte("echo writer-$((2+3))\n"))
+	if out := readFor(observer, "writer-5"); strings.Contains(out, "observer") {
+		t.Errorf("an observer's input reached the session: %q", out)
+	}
+	if cols, rows := sess.size(); cols != 80 || rows != 24 {
+		t.Errorf("size %dx%d after guests attached", cols, rows)
+	}
+
+	req, _ := http.NewRequest("DELETE", testURL+"/v1/sessions/"+sess.id+"/shares/"+observe.ID, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke: %d", resp.StatusCode)
+	}
+	for {
+		if _, _, err := observer.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("observer after revoking: %v", err)
+			}
+			break
+		}
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(wsBase+observe.Token, nil); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("revoked link: %v", err)
+	}
+
+	// The writer leaving leaves the session be; the session ending takes
+	// the remaining link with it.
+	writer.Close()
+	time.Sleep(50 * time.Millisecond)
+	if sess.isClosed() {
+		t.Fatal("session closed when a guest left")
+	}
+	sess.close()
+	<-sess.done
+	if _, resp, err := websocket.DefaultDialer.Dial(wsBase+write.Token, nil); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("link to an ended session: %v", err)
+	}
+}
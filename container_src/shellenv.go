@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Shells, commands and the other processes the server starts on users'
+// behalf don't inherit the container's environment: it holds the bucket's
+// credentials and the server's secrets. They get the variables named by
+// defaultShellEnv and the shell_env setting, and never the secrets of
+// secretEnv unless shell_env names them outright.
+
+// defaultShellEnv are the container's variables passed to spawned
+// processes, as path.Match patterns.
+var defaultShellEnv = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "SHELL", "HOSTNAME",
+	"LANG", "LANGUAGE", "LC_*", "TZ", "TERM", "PS1", "EDITOR", "VISUAL", "PAGER",
+	"CLOUDFLARE_LOCATION", "CLOUDFLARE_DURABLE_OBJECT_ID",
+}
+
+// secretEnv are the variables a pattern in shell_env, even "*", doesn't
+// pass on.
+var secretEnv = []string{
+	"S3_AUTH_TOKEN", s3TokenSecretEnv, "CONTROL_TOKEN", "USER_TOKEN_SECRET", "AUTH_SHARED_SECRET",
+	"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", handoverEnv,
+}
+
+// checkShellEnv validates the shell_env setting.
+func checkShellEnv(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil || p == "" || strings.Contains(p, "=") {
+			return fmt.Errorf("shell_env: %q is not a variable name or pattern", p)
+		}
+	}
+	return nil
+}
+
+// spawnEnv is the environment for a process started on a user's behalf:
+// the server's own, scrubbed of what isn't allowed.
+func spawnEnv() []string {
+	allowed := currentConfig().ShellEnv
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if passEnv(name, allowed) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// passEnv reports whether the variable name is passed on, given the
+// shell_env setting.
+func passEnv(name string, allowed []string) bool {
+	if slices.Contains(secretEnv, name) {
+		return slices.Contains(allowed, name)
+	}
+	for _, p := range slices.Concat(defaultShellEnv, allowed) {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestShellEnv(t *testing.T) {
+	t.Setenv("S3_AUTH_TOKEN", "bucket-secret")
+	t.Setenv("DOS3_TEST_SETTING", "kept")
+	t.Setenv("LC_TEST", "C")
+	cfg := *currentConfig()
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	run := func() string {
+		t.Helper()
+		resp, err := http.Post(testURL+"/v1/exec", "application/json",
+			strings.NewReader(`{"argv":["sh","-c","echo \"$S3_AUTH_TOKEN|$DOS3_TEST_SETTING|$LC_TEST|$PATH\""]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var res execResponse
+		json.NewDecoder(resp.Body).Decode(&res)
+		return strings.TrimSpace(res.Stdout)
+	}
+	if got, want := run(), "||C|"+os.Getenv("PATH"); got != want {
+		t.Errorf("default environment: %q, want %q", got, want)
+	}
+	cfg.ShellEnv = []string{"*"}
+	if got := run(); !strings.HasPrefix(got, "|kept|") {
+		t.Errorf(`with "*": %q`, got)
+	}
+	cfg.ShellEnv = []string{"DOS3_TEST_*", "S3_AUTH_TOKEN"}
+	if got := run(); !strings.HasPrefix(got, "bucket-secret|kept|") {
+		t.Errorf("with the secret named: %q", got)
+	}
+	if err := checkShellEnv([]string{"A=B"}); err == nil {
+		t.Error("shell_env accepted A=B")
+	}
+
+	cfg.ShellEnv = nil
+	// Package installs run scripts from the packages users list.
+	var out strings.Builder
+	if err := runPackageCommand(context.Background(), &out, "sh", "-c", `echo "[$S3_AUTH_TOKEN|$DOS3_TEST_SETTING|$PIP_BREAK_SYSTEM_PACKAGES]"`); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "\n[||1]\n") {
+		t.Errorf("package install environment: %q", out.String())
+	}
+
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	environ, _ := os.ReadFile(fmt.Sprintf("/proc/%d/environ", sess.cmd.Process.Pid))
+	if strings.Contains(string(environ), "bucket-secret") || strings.Contains(string(environ), "DOS3_TEST_SETTING") || !strings.Contains(string(environ), sessionEnv+"="+sess.id) {
+		t.Errorf("session environment %q", environ)
+	}
+}
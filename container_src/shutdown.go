@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reasons the server shuts down, as reported to clients in a shutdown
+// message, for the frontend to choose what to show.
+const (
+	// shutdownUpgrade is a binary upgrade in place: reconnect, and the
+	// sessions are still there.
+	shutdownUpgrade = "upgrade"
+	// shutdownSignal is the container being stopped, typically to replace
+	// it: reconnect, which starts its successor.
+	shutdownSignal = "signal"
+	// shutdownIdle is the workspace hibernating once nobody uses it; it
+	// starts again on the next visit rather than by reconnecting.
+	shutdownIdle = "idle"
+	// shutdownError is the server failing.
+	shutdownError = "error"
+)
+
+// shutdownFlush is how long a shutdown waits for its message to reach the
+// connected clients before going ahead.
+const shutdownFlush = time.Second
+
+var errInvalidShutdown = errors.New("invalid shutdown request")
+
+var shutdownsAnnounced = newCounter("dos3_shutdowns_total",
+	"Shutdowns announced to clients, by reason.")
+
+// shutdownNotice is the "shutdown" message sent to /ws control clients,
+// /ws/mux and SSE streams just before their connections go.
+type shutdownNotice struct {
+	Type    string `json:"type"` // "shutdown"
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"`
+	// ExpectedDowntimeMS is roughly how long until a reconnect succeeds,
+	// judged by how long this server took to start; 0 if unknown.
+	ExpectedDowntimeMS int64 `json:"expected_downtime_ms,omitempty"`
+	// Reconnect says whether reconnecting right away makes sense: not for
+	// a hibernating workspace.
+	Reconnect bool `json:"reconnect"`
+}
+
+func newShutdownNotice(reason, message string) shutdownNotice {
+	n := shutdownNotice{Type: "shutdown", Reason: reason, Message: message, Reconnect: reason != shutdownIdle}
+	if n.Reconnect {
+		n.ExpectedDowntimeMS = startupTime().Milliseconds()
+	}
+	return n
+}
+
+// startupTime is how long this server took from starting to listening.
+func startupTime() time.Duration {
+	for _, s := range boot.report().Stages {
+		if s.Stage == bootListening {
+			return time.Duration(s.SinceStartMS * float64(time.Millisecond))
+		}
+	}
+	return 0
+}
+
+// closeCode is the WebSocket close code that goes with the notice, its
+// reason being the close frame's text.
+func (n shutdownNotice) closeCode() int {
+	switch {
+	case n.Reason == shutdownError:
+		return websocket.CloseInternalServerErr
+	case n.Reconnect:
+		return websocket.CloseServiceRestart
+	}
+	return websocket.CloseGoingAway
+}
+
+// shutdownAnnouncer tells the connected clients why the server is going
+// away. Only the first shutdown is announced.
+type shutdownAnnouncer struct {
+	mu        sync.Mutex
+	notice    *shutdownNotice
+	announced chan struct{}
+	// waiting is how many clients follow and haven't been told yet; told
+	// is closed when the last of them has, after the announcement.
+	waiting int
+	told    chan struct{}
+}
+
+func newShutdownAnnouncer() *shutdownAnnouncer {
+	return &shutdownAnnouncer{announced: make(chan struct{})}
+}
+
+var shutdownNotices = newShutdownAnnouncer()
+
+// announce sends n to every client following, and waits a moment for it
+// to be sent.
+func (a *shutdownAnnouncer) announce(n shutdownNotice) {
+	a.mu.Lock()
+	if a.notice != nil {
+		a.mu.Unlock()
+		return
+	}
+	a.notice = &n
+	close(a.announced)
+	var told chan struct{}
+	if a.waiting > 0 {
+		a.told = make(chan struct{})
+		told = a.told
+	}
+	a.mu.Unlock()
+	infof("Shutting down (%s): telling connected clients", n.Reason)
+	shutdownsAnnounced.add(1, "reason", n.Reason)
+	if told != nil {
+		select {
+		case <-told:
+		case <-time.After(shutdownFlush):
+		}
+	}
+}
+
+// follow calls send with the shutdown notice once there is one, unless ctx
+// is done first.
+func (a *shutdownAnnouncer) follow(ctx context.Context, send func(shutdownNotice)) {
+	a.mu.Lock()
+	a.waiting++
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.waiting--
+		if a.waiting == 0 && a.told != nil {
+			close(a.told)
+			a.told = nil
+		}
+	}()
+	select {
+	case <-a.announced:
+		a.mu.Lock()
+		n := *a.notice
+		a.mu.Unlock()
+		send(n)
+	case <-ctx.Done():
+	}
+}
+
+// announceShutdown sends the shutdown notice to the WebSocket client on ws,
+// once there is one, and closes the connection with the notice's code.
+func announceShutdown(ctx context.Context, ws *wsConn, send func(shutdownNotice)) {
+	shutdownNotices.follow(ctx, func(n shutdownNotice) {
+		send(n)
+		ws.control(websocket.CloseMessage, websocket.FormatCloseMessage(n.closeCode(), n.Reason))
+	})
+}
+
+// fatalf announces the server failing, then logs and exits as log.Fatalf.
+func fatalf(format string, args ...any) {
+	shutdownNotices.announce(newShutdownNotice(shutdownError, fmt.Sprintf(format, args...)))
+	log.Fatalf(format, args...)
+}
+
+// signalShutdown is the notice for a stop signal.
+func signalShutdown(sig os.Signal) shutdownNotice {
+	return newShutdownNotice(shutdownSignal, "the container is stopping ("+sig.String()+")")
+}
+
+// shutdowns carries shutdowns requested through the API to main, which
+// owns the servers.
+var shutdowns = make(chan shutdownNotice, 1)
+
+// shutdownRequest is the body of POST /v1/shutdown.
+type shutdownRequest struct {
+	// Reason is idle or signal, signal by default.
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+	// ExpectedDowntime overrides the estimate of how long until a
+	// reconnect succeeds.
+	ExpectedDowntime duration `json:"expected_downtime"`
+}
+
+// handleShutdown stops the server as SIGTERM does, telling clients why:
+// for the Durable Object to say it is putting the workspace to sleep.
+func handleShutdown(w http.ResponseWriter, r *http.Request) {
+	var req shutdownRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, r, fmt.Errorf("%w: %v", errInvalidShutdown, err))
+		return
+	}
+	switch req.Reason {
+	case "":
+		req.Reason = shutdownSignal
+	case shutdownSignal, shutdownIdle:
+	default:
+		writeError(w, r, fmt.Errorf("%w: reason must be %q or %q, not %q", errInvalidShutdown, shutdownSignal, shutdownIdle, req.Reason))
+		return
+	}
+	if req.ExpectedDowntime.Duration < 0 {
+		writeError(w, r, fmt.Errorf("%w: negative expected_downtime", errInvalidShutdown))
+		return
+	}
+	if req.Message == "" {
+		req.Message = "the container is stopping"
+		if req.Reason == shutdownIdle {
+			req.Message = "the workspace is going to sleep"
+		}
+	}
+	n := newShutdownNotice(req.Reason, req.Message)
+	if req.ExpectedDowntime.Duration > 0 {
+		n.ExpectedDowntimeMS = req.ExpectedDowntime.Milliseconds()
+	}
+	select {
+	case shutdowns <- n:
+		writeJSON(w, http.StatusAccepted, n)
+	default:
+		httpError(w, r, "a shutdown is already in progress", http.StatusConflict)
+	}
+}
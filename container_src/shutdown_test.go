@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdownNotice(t *testing.T) {
+	prev := shutdownNotices
+	shutdownNotices = newShutdownAnnouncer()
+	defer func() { shutdownNotices = prev }()
+	wsURL := "ws" + strings.TrimPrefix(testURL, "http")
+	control, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?control=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	plain, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		shutdownNotices.mu.Lock()
+		waiting := shutdownNotices.waiting
+		shutdownNotices.mu.Unlock()
+		if waiting == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections waiting for a shutdown, want 2", waiting)
+		}
+	}
+	shutdownNotices.announce(newShutdownNotice(shutdownUpgrade, "the server is upgrading"))
+
+	// Control clients get the reason as a message, and everyone as the
+	// close frame's code and text.
+	control.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var notice shutdownNotice
+	for notice.Type != "shutdown" {
+		typ, data, err := control.ReadMessage()
+		if err != nil {
+			t.Fatalf("control client: %v before a shutdown message", err)
+		}
+		if typ == websocket.TextMessage {
+			json.Unmarshal(data, &notice)
+		}
+	}
+	if notice.Reason != shutdownUpgrade || !notice.Reconnect || notice.Message == "" {
+		t.Errorf("shutdown message = %+v", notice)
+	}
+	for _, conn := range []*websocket.Conn{control, plain} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var err error
+		for err == nil {
+			_, _, err = conn.ReadMessage()
+		}
+		var ce *websocket.CloseError
+		if !errors.As(err, &ce) || ce.Code != websocket.CloseServiceRestart || ce.Text != shutdownUpgrade {
+			t.Errorf("connection ended with %v, want close %d %q", err, websocket.CloseServiceRestart, shutdownUpgrade)
+		}
+	}
+
+	// The Durable Object can say why it stops the server.
+	t.Setenv("CONTROL_TOKEN", "secret")
+	request := func(body string) (int, shutdownNotice) {
+		t.Helper()
+		req, _ := http.NewRequest("POST", testURL+"/v1/shutdown", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var n shutdownNotice
+		json.NewDecoder(resp.Body).Decode(&n)
+		return resp.StatusCode, n
+	}
+	if code, _ := request(`{"reason": "upgrade"}`); code != http.StatusBadRequest {
+		t.Errorf("reason upgrade: %d", code)
+	}
+	code, n := request(`{"reason": "idle"}`)
+	if code != http.StatusAccepted || n.Reason != shutdownIdle || n.Reconnect || n.ExpectedDowntimeMS != 0 {
+		t.Errorf("POST /v1/shutdown = %d %+v", code, n)
+	}
+	if code, _ := request(`{}`); code != http.StatusConflict {
+		t.Errorf("second shutdown: %d", code)
+	}
+	if n := <-shutdowns; n.Reason != shutdownIdle || n.Message != "the workspace is going to sleep" {
+		t.Errorf("shutdown handed to main = %+v", n)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxInputBody bounds a single POSTed input chunk.
+const maxInputBody = 64 * 1024
+
+// handleSSE is the fallback transport for networks that block WebSockets. It
+// starts a session and streams its output as Server-Sent Events:
+//
+//	event: session       data: {"id": "..."}   first, so the client can POST input
+//	event: output        data: <base64 PTY bytes>
+//	event: bell          data: {"type": "bell"}
+//	event: notification  data: {"type": "notification", "title": "...", "body": "..."}
+//	event: exit          data: {}               the shell exited
+//	event: shutdown      data: {"type": "shutdown", "reason": "upgrade", ...}   the server is going away
+//
+// Input and resizes go to POST /v1/sessions/{id}/input and /v1/sessions/{id}/resize.
+// As with /ws, the session is closed when the stream disconnects.
+func handleSSE(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	cols, rows, err := parseSize(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	meta, err := sessionMetaFromQuery(r.URL.Query())
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sess, err := sessions.startFor(r.Context(), cols, rows, meta)
+	if err != nil {
+		warnf("Failed to start session: %v (request %s)", err, requestID(r))
+		writeError(w, r, err)
+		return
+	}
+	defer sess.close()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// Ask buffering proxies (nginx and friends) to pass events through.
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Writes come from both the output loop and the heartbeat; events is
+	// the only writer so they can't interleave.
+	events := make(chan string, 16)
+	go func() {
+		defer close(events)
+		sess.follow(r.Context(), 0, func(data []byte, _ int64) error {
+			select {
+			case events <- sseEvent("output", base64.StdEncoding.EncodeToString(data)):
+				return nil
+			case <-r.Context().Done():
+				return r.Context().Err()
+			}
+		})
+	}()
+
+	// Alerts have their own channel, as events is closed with the output.
+	alerts := make(chan string, 4)
+	sess.followAlerts(r.Context(), func(m alertMessage) {
+		data, _ := json.Marshal(m)
+		select {
+		case alerts <- sseEvent(m.Type, string(data)):
+		case <-r.Context().Done():
+		}
+	})
+
+	// The stream ends with the server, saying why.
+	shutdown := make(chan string, 1)
+	go shutdownNotices.follow(r.Context(), func(n shutdownNotice) {
+		data, _ := json.Marshal(n)
+		shutdown <- sseEvent("shutdown", string(data))
+	})
+
+	id, _ := json.Marshal(map[string]string{"id": sess.id})
+	io.WriteString(w, sseEvent("session", string(id)))
+	rc.Flush()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				io.WriteString(w, sseEvent("exit", "{}"))
+				rc.Flush()
+				return
+			}
+			if _, err := io.WriteString(w, ev); err != nil {
+				return
+			}
+			sess.meterTraffic(trafficTerminal, "out", len(ev))
+		case ev := <-shutdown:
+			io.WriteString(w, ev)
+			rc.Flush()
+			return
+		case ev := <-alerts:
+			if _, err := io.WriteString(w, ev); err != nil {
+				return
+			}
+			sess.meterTraffic(trafficControl, "out", len(ev))
+		case <-time.After(currentConfig().PingPeriod.Duration):
+			// Comment lines keep idle connections from being reaped.
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func sseEvent(name, data string) string {
+	return fmt.Sprintf("event: %s\ndata: %s\n\n", name, data)
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/container_src/internal/s3client"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// stateBackupKey is where the state database is backed up in the
+	// bucket.
+	stateBackupKey = ".server-state.db"
+	// stateBackupInterval is how often it is.
+	stateBackupInterval = 10 * time.Minute
+	// defaultStateRecords and maxStateRecords bound the records a query of
+	// the state database returns.
+	defaultStateRecords = 100
+	maxStateRecords     = 1000
+)
+
+// stateDBPath is the SQLite database the server keeps its state in, on the
+// container's local disk beside the write journal.
+var stateDBPath = envOr("STATE_DB", "/var/lib/do-s3/state.db")
+
+var (
+	errNoState           = errors.New("state store unavailable")
+	errInvalidStateQuery = errors.New("invalid state query")
+)
+
+// state records sessions, jobs, locks and the timeline as they come and go, so what
+// happened is still known after a restart. It is nil when the database
+// couldn't be opened, which only loses the history: every method is a no-op
+// then.
+var state *stateStore
+
+type stateStore struct {
+	db   *sql.DB
+	path string
+}
+
+const stateSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	user TEXT NOT NULL,
+	name TEXT NOT NULL,
+	started INTEGER NOT NULL,
+	ended INTEGER,
+	exit_code INTEGER,
+	end_reason TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS sessions_started ON sessions (started);
+CREATE TABLE IF NOT EXISTS jobs (
+	id TEXT PRIMARY KEY,
+	command TEXT NOT NULL,
+	state TEXT NOT NULL,
+	started INTEGER NOT NULL,
+	finished INTEGER,
+	exit_code INTEGER
+);
+CREATE INDEX IF NOT EXISTS jobs_started ON jobs (started);
+CREATE TABLE IF NOT EXISTS timeline (
+	time INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	op TEXT NOT NULL,
+	session TEXT NOT NULL,
+	user TEXT NOT NULL,
+	path TEXT NOT NULL,
+	detail TEXT NOT NULL,
+	exit_code INTEGER,
+	duration_ms INTEGER
+);
+CREATE INDEX IF NOT EXISTS timeline_time ON timeline (time);
+CREATE TABLE IF NOT EXISTS locks (
+	path TEXT PRIMARY KEY,
+	owner TEXT NOT NULL,
+	token TEXT NOT NULL,
+	acquired INTEGER NOT NULL,
+	expires INTEGER NOT NULL
+);
+`
+
+// openState opens the database at path, creating it if need be.
+func openState(path string) (*stateStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// One connection serialises writes, which SQLite would anyway.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(stateSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating tables: %w", err)
+	}
+	return &stateStore{db: db, path: path}, nil
+}
+
+// loadState opens the state database, first fetching its backup from the
+// bucket if the container's disk has none, as on a new container.
+func loadState() {
+	if _, err := os.Stat(stateDBPath); errors.Is(err, os.ErrNotExist) {
+		if err := restoreStateBackup(stateDBPath); err != nil {
+			warnf("Restoring the state database: %v", err)
+		}
+	}
+	s, err := openState(stateDBPath)
+	if err != nil {
+		warnf("Opening the state database %s, history won't be kept: %v", stateDBPath, err)
+		return
+	}
+	state = s
+	live := make([]string, 0)
+	for _, sess := range sessions.list() {
+		live = append(live, sess.id)
+	}
+	if n, err := s.endLostSessions(live, time.Now()); err != nil {
+		warnf("Recovering session state: %v", err)
+	} else if n > 0 {
+		infof("Marked %d sessions lost in the restart as ended", n)
+	}
+}
+
+// restoreStateBackup downloads the bucket's backup to path, if there is a
+// bucket and a backup in it.
+func restoreStateBackup(path string) error {
+	store := bucketStore.Load()
+	if store == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	body, err := store.GetObject(ctx, stateBackupKey, "")
+	if s3client.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := storeFile(path, body, 0600); err != nil {
+		return err
+	}
+	infof("Restored the state database from the bucket")
+	return nil
+}
+
+// backup copies the database to the bucket. It is best effort: the local
+// database is the one read.
+func (s *stateStore) backup(ctx context.Context) error {
+	store := bucketStore.Load()
+	if s == nil || store == nil {
+		return nil
+	}
+	tmp := s.path + ".backup"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	// VACUUM INTO writes a consistent copy while the database stays in use.
+	if _, err := s.db.ExecContext(ctx, "VACUUM INTO ?", tmp); err != nil {
+		return err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return store.PutObject(ctx, stateBackupKey, f, "application/vnd.sqlite3")
+}
+
+// backupStateForever backs the database up every stateBackupInterval.
+func backupStateForever() {
+	for {
+		time.Sleep(stateBackupInterval)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := state.backup(ctx); err != nil {
+			warnf("Backing up the state database: %v", err)
+		}
+		cancel()
+	}
+}
+
+// sessionRecord is a session as the state store remembers it.
+type sessionRecord struct {
+	ID      string     `json:"id"`
+	User    string     `json:"user,omitempty"`
+	Name    string     `json:"name,omitempty"`
+	Started time.Time  `json:"started"`
+	Ended   *time.Time `json:"ended,omitempty"`
+	// ExitCode is the shell's, when it exited rather than being killed.
+	ExitCode *int `json:"exit_code,omitempty"`
+	// EndReason is "exited", or "lost" for a session the server restarted
+	// under.
+	EndReason string `json:"end_reason,omitempty"`
+}
+
+// jobRecord is a job as the state store remembers it, kept after its
+// directory is removed.
+type jobRecord struct {
+	ID       string     `json:"id"`
+	Command  string     `json:"command"`
+	State    string     `json:"state"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	ExitCode *int       `json:"exit_code,omitempty"`
+}
+
+type sessionRecords struct {
+	Sessions []sessionRecord `json:"sessions"`
+}
+
+type jobRecords struct {
+	Jobs []jobRecord `json:"jobs"`
+}
+
+// Sessions are recorded as the event bus reports them.
+var _ = events.subscribe("state", func(e event) {
+	if err := state.recordSession(e); err != nil {
+		warnf("Recording session %s: %v", e.Session.id, err)
+	}
+}, eventSessionStarted, eventSessionEnded)
+
+func (s *stateStore) recordSession(e event) error {
+	if s == nil || e.Session == nil {
+		return nil
+	}
+	sess := e.Session
+	if e.Kind == eventSessionStarted {
+		_, err := s.db.Exec(`INSERT INTO sessions (id, user, name, started) VALUES (?, ?, ?, ?)
+			ON CONFLICT (id) DO NOTHING`, sess.id, sess.user, sess.metadata().Name, sess.created.UnixMilli())
+		return err
+	}
+	var code *int
+	if st := sess.cmd.ProcessState; st != nil && st.ExitCode() >= 0 {
+		c := st.ExitCode()
+		code = &c
+	}
+	_, err := s.db.Exec(`UPDATE sessions SET name = ?, ended = ?, exit_code = ?, end_reason = 'exited' WHERE id = ?`,
+		sess.metadata().Name, e.Time.UnixMilli(), code, sess.id)
+	return err
+}
+
+// endLostSessions marks the sessions recorded as running, other than live,
+// as ended at now: the server they ran under is gone.
+func (s *stateStore) endLostSessions(live []string, now time.Time) (int64, error) {
+	if s == nil {
+		return 0, nil
+	}
+	query := `UPDATE sessions SET ended = ?, end_reason = 'lost' WHERE ended IS NULL`
+	args := []any{now.UnixMilli()}
+	if len(live) > 0 {
+		query += ` AND id NOT IN (?` + strings.Repeat(", ?", len(live)-1) + `)`
+		for _, id := range live {
+			args = append(args, id)
+		}
+	}
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// recordJob saves j's state, as writeJob does to job.json.
+func (s *stateStore) recordJob(j jobInfo) error {
+	if s == nil {
+		return nil
+	}
+	command := strings.Join(j.Argv, " ")
+	switch {
+	case j.Export != nil:
+		command = "export"
+	case j.Import != nil:
+		command = "import"
+	}
+	var finished *int64
+	if j.Finished != nil {
+		ms := j.Finished.UnixMilli()
+		finished = &ms
+	}
+	_, err := s.db.Exec(`INSERT INTO jobs (id, command, state, started, finished, exit_code) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET state = excluded.state, finished = excluded.finished, exit_code = excluded.exit_code`,
+		j.ID, command, j.State, j.Started.UnixMilli(), finished, j.ExitCode)
+	return err
+}
+
+// saveLocks replaces the locks recorded with list.
+func (s *stateStore) saveLocks(list []lockInfo) error {
+	if s == nil {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM locks`); err != nil {
+		return err
+	}
+	for _, l := range list {
+		if _, err := tx.Exec(`INSERT INTO locks (path, owner, token, acquired, expires) VALUES (?, ?, ?, ?, ?)`,
+			l.Path, l.Owner, l.Token, l.Acquired.UnixMilli(), l.Expires.UnixMilli()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// locks returns the locks recorded that haven't expired by now.
+func (s *stateStore) locks(now time.Time) ([]lockInfo, error) {
+	if s == nil {
+		return nil, nil
+	}
+	rows, err := s.db.Query(`SELECT path, owner, token, acquired, expires FROM locks WHERE expires > ?`, now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []lockInfo
+	for rows.Next() {
+		var l lockInfo
+		var acquired, expires int64
+		if err := rows.Scan(&l.Path, &l.Owner, &l.Token, &acquired, &expires); err != nil {
+			return nil, err
+		}
+		l.Acquired, l.Expires = time.UnixMilli(acquired).UTC(), time.UnixMilli(expires).UTC()
+		list = append(list, l)
+	}
+	return list, rows.Err()
+}
+
+// stateQuery is what GET /v1/state/* filters on.
+type stateQuery struct {
+	since time.Time
+	limit int
+	// match is "user" for sessions, "state" for jobs.
+	match string
+}
+
+// stateParams documents the query parameters of GET /v1/state/*, which
+// filter on field.
+func stateParams(field, desc string) []queryParam {
+	return []queryParam{
+		{field, "string", desc},
+		{"since", "string", "Only those started since this RFC 3339 time"},
+		{"limit", "integer", "At most this many (default 100, up to 1000)"},
+	}
+}
+
+func parseStateQuery(r *http.Request, field string) (stateQuery, error) {
+	q := r.URL.Query()
+	h := stateQuery{limit: defaultStateRecords, match: q.Get(field)}
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return stateQuery{}, fmt.Errorf("%w: since must be an RFC 3339 time", errInvalidStateQuery)
+		}
+		h.since = t
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxStateRecords {
+			return stateQuery{}, fmt.Errorf("%w: limit must be 1-%d", errInvalidStateQuery, maxStateRecords)
+		}
+		h.limit = n
+	}
+	return h, nil
+}
+
+// sessions returns the sessions started since h.since, newest first.
+func (s *stateStore) sessions(ctx context.Context, h stateQuery) ([]sessionRecord, error) {
+	if s == nil {
+		return nil, errNoState
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT id, user, name, started, ended, exit_code, end_reason FROM sessions
+		WHERE started >= ? AND (? = '' OR user = ?) ORDER BY started DESC LIMIT ?`,
+		h.since.UnixMilli(), h.match, h.match, h.limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []sessionRecord{}
+	for rows.Next() {
+		var rec sessionRecord
+		var started int64
+		var ended sql.NullInt64
+		var code sql.NullInt32
+		if err := rows.Scan(&rec.ID, &rec.User, &rec.Name, &started, &ended, &code, &rec.EndReason); err != nil {
+			return nil, err
+		}
+		rec.Started = time.UnixMilli(started).UTC()
+		rec.Ended = nullTime(ended)
+		if code.Valid {
+			c := int(code.Int32)
+			rec.ExitCode = &c
+		}
+		list = append(list, rec)
+	}
+	return list, rows.Err()
+}
+
+// jobs returns the jobs started since h.since, newest first.
+func (s *stateStore) jobs(ctx context.Context, h stateQuery) ([]jobRecord, error) {
+	if s == nil {
+		return nil, errNoState
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT id, command, state, started, finished, exit_code FROM jobs
+		WHERE started >= ? AND (? = '' OR state = ?) ORDER BY started DESC LIMIT ?`,
+		h.since.UnixMilli(), h.match, h.match, h.limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []jobRecord{}
+	for rows.Next() {
+		var rec jobRecord
+		var started int64
+		var finished sql.NullInt64
+		var code sql.NullInt32
+		if err := rows.Scan(&rec.ID, &rec.Command, &rec.State, &started, &finished, &code); err != nil {
+			return nil, err
+		}
+		rec.Started = time.UnixMilli(started).UTC()
+		rec.Finished = nullTime(finished)
+		if code.Valid {
+			c := int(code.Int32)
+			rec.ExitCode = &c
+		}
+		list = append(list, rec)
+	}
+	return list, rows.Err()
+}
+
+func nullTime(ms sql.NullInt64) *time.Time {
+	if !ms.Valid {
+		return nil
+	}
+	t := time.UnixMilli(ms.Int64).UTC()
+	return &t
+}
+
+func handleStateSessions(w http.ResponseWriter, r *http.Request) {
+	h, err := parseStateQuery(r, "user")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	list, err := state.sessions(r.Context(), h)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sessionRecords{Sessions: list})
+}
+
+func handleStateJobs(w http.ResponseWriter, r *http.Request) {
+	h, err := parseStateQuery(r, "state")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	list, err := state.jobs(r.Context(), h)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobRecords{Jobs: list})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"server/container_src/internal/s3test"
+)
+
+func TestStateStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openState(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := state
+	state = s
+	t.Cleanup(func() {
+		state = prev
+		s.db.Close()
+		bucketStore.Store(nil)
+	})
+	query := func(path string, v any) int {
+		t.Helper()
+		resp, err := http.Get(testURL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	sess, err := sessions.start(80, 24, sessionMeta{Name: "recorded"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.close()
+	<-sess.done
+	var got sessionRecords
+	var rec sessionRecord
+	for deadline := time.Now().Add(5 * time.Second); rec.Ended == nil && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		query("/v1/state/sessions", &got)
+		for _, r := range got.Sessions {
+			if r.ID == sess.id {
+				rec = r
+			}
+		}
+	}
+	if rec.Name != "recorded" || rec.Ended == nil || rec.EndReason != "exited" {
+		t.Fatalf("recorded %+v", got.Sessions)
+	}
+
+	// A session the previous server left running is marked lost.
+	if _, err := s.db.Exec(`INSERT INTO sessions (id, user, name, started) VALUES ('gone', 'alice', '', ?)`, time.Now().UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.endLostSessions(nil, time.Now()); err != nil || n < 1 {
+		t.Fatalf("endLostSessions: %d, %v", n, err)
+	}
+	query("/v1/state/sessions?user=alice", &got)
+	if len(got.Sessions) != 1 || got.Sessions[0].EndReason != "lost" {
+		t.Errorf("alice's sessions %+v", got.Sessions)
+	}
+
+	code, done := 3, time.Now().UTC()
+	for _, j := range []jobInfo{
+		{ID: "job-1", Argv: []string{"make", "test"}, State: "running", Started: done.Add(-time.Minute)},
+		{ID: "job-1", Argv: []string{"make", "test"}, State: "exited", ExitCode: &code, Started: done.Add(-time.Minute), Finished: &done},
+		{ID: "job-2", Argv: []string{"true"}, State: "canceled", Started: done},
+	} {
+		if err := s.recordJob(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var jobs jobRecords
+	query("/v1/state/jobs?state=exited", &jobs)
+	if len(jobs.Jobs) != 1 || jobs.Jobs[0].Command != "make test" || jobs.Jobs[0].ExitCode == nil || *jobs.Jobs[0].ExitCode != 3 {
+		t.Errorf("exited jobs %+v", jobs.Jobs)
+	}
+	if status := query("/v1/state/jobs?limit=0", &jobs); status != http.StatusBadRequest {
+		t.Errorf("limit=0: %d", status)
+	}
+
+	now := time.Now()
+	if err := s.saveLocks([]lockInfo{
+		{Path: "held", Owner: "a", Token: "t1", Acquired: now, Expires: now.Add(time.Minute)},
+		{Path: "expired", Owner: "b", Token: "t2", Acquired: now.Add(-time.Hour), Expires: now.Add(-time.Minute)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := s.locks(now); err != nil || len(l) != 1 || l[0].Path != "held" || l[0].Token != "t1" {
+		t.Errorf("locks %+v, %v", l, err)
+	}
+
+	// A new container picks the backup up from the bucket.
+	store := s3test.NewServer(t).Client(t, "s3-test")
+	store.CreateBucket(context.Background())
+	bucketStore.Store(store)
+	if err := s.backup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	restored := filepath.Join(dir, "new", "state.db")
+	if err := restoreStateBackup(restored); err != nil {
+		t.Fatal(err)
+	}
+	s2, err := openState(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.db.Close()
+	if list, err := s2.jobs(context.Background(), stateQuery{limit: 10}); err != nil || len(list) != 2 {
+		t.Errorf("restored jobs %+v, %v", list, err)
+	}
+}
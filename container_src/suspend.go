@@ -0,0 +1,129 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// idleSweepInterval is how often sessions are checked for idle_suspend.
+const idleSweepInterval = 15 * time.Second
+
+var (
+	sessionsSuspended = newCounter("dos3_sessions_suspended_total",
+		"Sessions whose processes were stopped after idle_suspend without a client.")
+	_ = newGaugeFunc("dos3_suspended_sessions",
+		"Sessions whose processes are stopped until a client comes back.",
+		func() float64 {
+			n := 0
+			for _, s := range sessions.list() {
+				if s.isSuspended() {
+					n++
+				}
+			}
+			return float64(n)
+		})
+)
+
+// suspendIdleSessions runs the idle sweeper forever.
+func suspendIdleSessions() {
+	for range time.Tick(idleSweepInterval) {
+		sweepIdleSessions(time.Now())
+	}
+}
+
+// sweepIdleSessions stops the processes of sessions no client has been
+// attached to, or sent anything, for idle_suspend.
+func sweepIdleSessions(now time.Time) {
+	idle := currentConfig().IdleSuspend.Duration
+	if idle <= 0 {
+		return
+	}
+	for pid, id := range sessions.shells() {
+		if s := sessions.get(id); s != nil {
+			s.suspendIfIdle(pid, now, idle)
+		}
+	}
+}
+
+// attach marks a client as attached, resuming the session if it was
+// suspended; the returned func detaches it.
+func (s *session) attach() func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attached++
+	s.resumeLocked()
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.attached--
+		s.lastActive = time.Now()
+	}
+}
+
+// active records input or a poll from a client, resuming the session if it
+// was suspended.
+func (s *session) active() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActive = time.Now()
+	s.resumeLocked()
+}
+
+func (s *session) isSuspended() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.suspended != nil
+}
+
+// suspendIfIdle stops the processes in the Unix session of shell, its
+// leader, if the session has been idle for idle. Processes already stopped,
+// such as jobs suspended with Ctrl-Z, are left for resuming to leave alone.
+func (s *session) suspendIfIdle(shell int, now time.Time, idle time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := s.lastActive
+	if last.IsZero() {
+		last = s.created
+	}
+	if s.closed || s.suspended != nil || s.attached > 0 || now.Sub(last) < idle {
+		return
+	}
+	procs, err := listProcs()
+	if err != nil {
+		warnf("Idle sweep: listing processes: %v", err)
+		return
+	}
+	// The shell first, so it doesn't see its jobs stop.
+	var stopped []procKey
+	for _, p := range procs {
+		if p.pid == shell && p.state != 'T' && syscall.Kill(p.pid, syscall.SIGSTOP) == nil {
+			stopped = append(stopped, procKey{p.pid, p.start})
+		}
+	}
+	for _, p := range procs {
+		if p.sid == shell && p.pid != shell && p.state != 'T' && p.state != 'Z' && syscall.Kill(p.pid, syscall.SIGSTOP) == nil {
+			stopped = append(stopped, procKey{p.pid, p.start})
+		}
+	}
+	s.suspended = stopped
+	sessionsSuspended.add(1)
+	infof("Session %s suspended (%d processes) after %s without a client", s.id, len(stopped), now.Sub(last).Round(time.Second))
+}
+
+// resumeLocked continues the processes suspendIfIdle stopped, the shell
+// last, so it doesn't see its jobs stopped.
+func (s *session) resumeLocked() {
+	if s.suspended == nil {
+		return
+	}
+	stopped := s.suspended
+	s.suspended = nil
+	for i := len(stopped) - 1; i >= 0; i-- {
+		k := stopped[i]
+		// Skip pids that have since been reused.
+		if p, ok := procStat(k.pid); ok && p.start == k.start {
+			syscall.Kill(k.pid, syscall.SIGCONT)
+		}
+	}
+	infof("Session %s resumed", s.id)
+}
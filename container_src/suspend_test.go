@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdleSuspend(t *testing.T) {
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	shell := sess.cmd.Process.Pid
+	state := func() byte {
+		p, _ := procStat(shell)
+		return p.state
+	}
+	// A signal to a running process takes effect when it's next scheduled.
+	stopped := func() bool {
+		for deadline := time.Now().Add(2 * time.Second); state() != 'T' && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return state() == 'T'
+	}
+
+	cfg := *currentConfig()
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	sweepIdleSessions(time.Now().Add(time.Hour))
+	if state() == 'T' {
+		t.Fatal("session suspended with idle_suspend off")
+	}
+	cfg.IdleSuspend = duration{time.Minute}
+	sweepIdleSessions(time.Now())
+	if state() == 'T' {
+		t.Fatal("session suspended before idle_suspend")
+	}
+	sweepIdleSessions(time.Now().Add(time.Hour))
+	if !stopped() || !newSessionInfo(sess).Suspended {
+		t.Fatalf("shell state %c after idle_suspend, want T (stopped)", state())
+	}
+
+	// Input, like a client attaching, resumes it.
+	resp, err := http.Post(testURL+"/v1/sessions/"+sess.id+"/input", "application/octet-stream", strings.NewReader("echo back\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || state() == 'T' || sess.isSuspended() {
+		t.Fatalf("input: %s; shell state %c", resp.Status, state())
+	}
+	// An attached client keeps it running however long it's been.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sess.follow(ctx, 0, func([]byte, int64) error { return nil })
+	for attached := 0; attached == 0; time.Sleep(time.Millisecond) {
+		sess.mu.Lock()
+		attached = sess.attached
+		sess.mu.Unlock()
+	}
+	sweepIdleSessions(time.Now().Add(time.Hour))
+	if state() == 'T' {
+		t.Fatal("session suspended with a client attached")
+	}
+}
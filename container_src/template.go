@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// templateMarker records, in /data, which template a workspace was
+	// created from. It keeps a workspace emptied later from being
+	// populated again, and lets an interrupted one be finished.
+	templateMarker = ".workspace-template"
+	// templateTimeout bounds fetching and unpacking a template.
+	templateTimeout = 10 * time.Minute
+)
+
+// templateState is the contents of templateMarker.
+type templateState struct {
+	Source   string    `json:"source"`
+	Started  time.Time `json:"started"`
+	Complete bool      `json:"complete"`
+	Files    int       `json:"files,omitempty"`
+}
+
+// instantiateTemplate populates a new workspace from WORKSPACE_TEMPLATE
+// once its bucket is mounted: "s3://bucket/prefix" copies the objects
+// under prefix from another bucket on the same endpoint, and an http(s)
+// URL is a tarball, gzipped or not, unpacked into /data. Only an empty
+// bucket is populated, or one whose population from the same template was
+// interrupted; failing leaves the workspace as it is.
+func instantiateTemplate(opts mountOptions) {
+	src := os.Getenv("WORKSPACE_TEMPLATE")
+	if src == "" {
+		return
+	}
+	// A template URL may carry a token; it is kept out of logs and the
+	// marker.
+	name := redactURL(src)
+	state, err := readTemplateState()
+	switch {
+	case err == nil && (state.Complete || state.Source != name):
+		return
+	case err == nil:
+		infof("Resuming the workspace template %s, interrupted on %s", name, state.Started.Format(time.RFC3339))
+	case !errors.Is(err, fs.ErrNotExist):
+		warnf("Not applying the workspace template: %v", err)
+		return
+	default:
+		if entries, err := os.ReadDir(dataDir); err != nil || len(entries) > 0 {
+			return
+		}
+		infof("Populating the new workspace from template %s", name)
+	}
+	state = templateState{Source: name, Started: time.Now().UTC()}
+	if err := writeTemplateState(state); err != nil {
+		warnf("Not applying the workspace template: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), templateTimeout)
+	defer cancel()
+	n, err := applyTemplate(ctx, src, opts)
+	if err != nil {
+		errorf("Populating the workspace from template %s (%d files written): %v", name, n, err)
+		return
+	}
+	state.Complete, state.Files = true, n
+	if err := writeTemplateState(state); err != nil {
+		warnf("Recording the workspace template: %v", err)
+	}
+	boot.mark(bootTemplateApplied)
+	infof("Populated the workspace with %d files from template %s", n, name)
+}
+
+func readTemplateState() (templateState, error) {
+	var s templateState
+	data, err := os.ReadFile(filepath.Join(dataDir, templateMarker))
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("%s: %w", templateMarker, err)
+	}
+	return s, nil
+}
+
+func writeTemplateState(s templateState) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return storeFile(filepath.Join(dataDir, templateMarker), strings.NewReader(string(data)+"\n"), 0644)
+}
+
+// applyTemplate writes src's files into /data and returns how many it
+// wrote.
+func applyTemplate(ctx context.Context, src string, opts mountOptions) (int, error) {
+	if bucket, prefix, ok := parseS3Template(src); ok {
+		return copyTemplateBucket(ctx, opts, bucket, prefix)
+	}
+	return unpackTemplate(ctx, src)
+}
+
+// parseS3Template splits "s3://bucket/prefix" into the bucket and the
+// prefix as a directory ("prefix/", or "" for the whole bucket).
+func parseS3Template(src string) (bucket, prefix string, ok bool) {
+	rest, ok := strings.CutPrefix(src, "s3://")
+	if !ok {
+		return "", "", false
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	return bucket, prefix, bucket != ""
+}
+
+// checkTemplate checks the form of a WORKSPACE_TEMPLATE.
+func checkTemplate(src string) error {
+	if strings.HasPrefix(src, "s3://") {
+		if _, _, ok := parseS3Template(src); !ok {
+			return fmt.Errorf("%q names no bucket; want s3://bucket/prefix", src)
+		}
+		return nil
+	}
+	if err := checkHTTPURL(src); err != nil {
+		return fmt.Errorf("want s3://bucket/prefix or a tarball's URL: %w", err)
+	}
+	return nil
+}
+
+// copyTemplateBucket copies the objects under prefix in bucket, reached
+// with the workspace's own endpoint and credentials, into /data.
+func copyTemplateBucket(ctx context.Context, opts mountOptions, bucket, prefix string) (int, error) {
+	opts.bucket = bucket
+	c, err := opts.s3Client()
+	if err != nil {
+		return 0, err
+	}
+	objs, err := c.ListObjects(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, o := range objs {
+		rel := strings.TrimPrefix(o.Key, prefix)
+		if rel == "" {
+			continue
+		}
+		full, err := templateTarget(rel)
+		if err != nil {
+			return n, err
+		}
+		if strings.HasSuffix(rel, "/") {
+			if err := os.MkdirAll(full, 0755); err != nil {
+				return n, err
+			}
+			continue
+		}
+		body, err := c.GetObject(ctx, o.Key, "")
+		if err != nil {
+			return n, err
+		}
+		err = storeFile(full, body, 0644)
+		body.Close()
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// unpackTemplate downloads the tarball at u and unpacks it into /data.
+func unpackTemplate(ctx context.Context, u string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if ue := (*url.Error)(nil); errors.As(err, &ue) {
+		return 0, fmt.Errorf("GET %s: %w", redactURL(u), ue.Err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET %s: %s", redactURL(u), resp.Status)
+	}
+	br := bufio.NewReader(resp.Body)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	n := 0
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("reading the template: %w", err)
+		}
+		name := strings.TrimPrefix(h.Name, "./")
+		if name == "" || name == "." {
+			continue
+		}
+		full, err := templateTarget(name)
+		if err != nil {
+			return n, err
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(full, 0755)
+		case tar.TypeReg:
+			if err = storeFile(full, tr, fs.FileMode(h.Mode).Perm()); err == nil {
+				n++
+			}
+		case tar.TypeSymlink:
+			if err = os.MkdirAll(filepath.Dir(full), 0755); err == nil {
+				os.Remove(full)
+				err = os.Symlink(h.Linkname, full)
+			}
+		default:
+			debugf("Skipping %s in the template: not a file, directory or symlink", name)
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// templateTarget resolves a path from a template under /data, refusing the
+// marker and anything outside.
+func templateTarget(name string) (string, error) {
+	full, err := resolvePath(name)
+	if err != nil {
+		return "", fmt.Errorf("template entry %q: %w", name, err)
+	}
+	if full == dataDir || full == filepath.Join(dataDir, templateMarker) {
+		return "", fmt.Errorf("template entry %q: %w", name, errOutsideData)
+	}
+	// A symlink unpacked earlier must not lead a later entry out of /data.
+	if dir := symlinkAbove(full); dir != "" {
+		return "", fmt.Errorf("template entry %q is under the symlink %s: %w", name, relPath(dir), errOutsideData)
+	}
+	return full, nil
+}
+
+// symlinkAbove returns the first directory above full, up to /data, that is
+// a symlink, or "" if none is.
+func symlinkAbove(full string) string {
+	for dir := filepath.Dir(full); dir != dataDir && dir != "/"; dir = filepath.Dir(dir) {
+		if fi, err := os.Lstat(dir); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			return dir
+		}
+	}
+	return ""
+}
+
+// redactURL drops a URL's query and credentials, which may hold tokens,
+// from messages.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "the template URL"
+	}
+	u.User, u.RawQuery = nil, ""
+	return u.String()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"server/container_src/internal/s3test"
+)
+
+func TestWorkspaceTemplate(t *testing.T) {
+	prevData := dataDir
+	t.Cleanup(func() { dataDir = prevData })
+	outside := t.TempDir()
+	type entry struct {
+		name, body, link string
+		dir              bool
+	}
+	tarball := func(entries ...entry) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for _, e := range entries {
+			h := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+			switch {
+			case e.dir:
+				h.Typeflag, h.Mode = tar.TypeDir, 0755
+			case e.link != "":
+				h.Typeflag, h.Linkname = tar.TypeSymlink, e.link
+			}
+			tw.WriteHeader(h)
+			io.WriteString(tw, e.body)
+		}
+		tw.Close()
+		gz.Close()
+		return buf.Bytes()
+	}
+	tarballs := map[string][]byte{
+		"/skeleton.tar.gz": tarball(
+			entry{name: "./README.md", body: "# New project\n"},
+			entry{name: "./src/", dir: true},
+			entry{name: "./src/main.go", body: "package main\n"},
+			entry{name: "./bin", link: "src"},
+		),
+		"/escape.tar.gz": tarball(
+			entry{name: "out", link: outside},
+			entry{name: "out/pwned", body: "x"},
+		),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if data, ok := tarballs[r.URL.Path]; ok {
+			w.Write(data)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	read := func(p string) string {
+		data, _ := os.ReadFile(filepath.Join(dataDir, p))
+		return string(data)
+	}
+
+	dataDir = t.TempDir()
+	t.Setenv("WORKSPACE_TEMPLATE", srv.URL+"/skeleton.tar.gz?token=secret")
+	instantiateTemplate(mountOptions{})
+	if read("README.md") != "# New project\n" || read("src/main.go") != "package main\n" || read("bin/main.go") != "package main\n" {
+		t.Fatalf("workspace after the template: README %q, main.go %q", read("README.md"), read("src/main.go"))
+	}
+	state, err := readTemplateState()
+	if err != nil || !state.Complete || state.Files != 2 || strings.Contains(state.Source, "secret") {
+		t.Fatalf("template state = %+v, %v", state, err)
+	}
+	// An emptied workspace isn't populated again.
+	os.Remove(filepath.Join(dataDir, "README.md"))
+	instantiateTemplate(mountOptions{})
+	if _, err := os.Stat(filepath.Join(dataDir, "README.md")); err == nil {
+		t.Error("template applied to a workspace twice")
+	}
+
+	// Nor is one that already has files.
+	dataDir = t.TempDir()
+	os.WriteFile(filepath.Join(dataDir, "mine.txt"), nil, 0644)
+	instantiateTemplate(mountOptions{})
+	if _, err := os.Stat(filepath.Join(dataDir, "README.md")); err == nil {
+		t.Error("template applied over existing files")
+	}
+
+	// An interrupted one is finished on the next boot.
+	dataDir = t.TempDir()
+	writeTemplateState(templateState{Source: redactURL(os.Getenv("WORKSPACE_TEMPLATE"))})
+	instantiateTemplate(mountOptions{})
+	if read("README.md") == "" {
+		t.Error("interrupted template not resumed")
+	}
+
+	dataDir = t.TempDir()
+	if _, err := applyTemplate(context.Background(), srv.URL+"/escape.tar.gz", mountOptions{}); !errors.Is(err, errOutsideData) {
+		t.Errorf("template writing through a symlink: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "pwned")); err == nil {
+		t.Error("template wrote outside /data")
+	}
+
+	// From a prefix of another bucket.
+	s3srv := s3test.NewServer(t)
+	store := s3srv.Client(t, "templates")
+	ctx := context.Background()
+	store.CreateBucket(ctx)
+	for key, body := range map[string]string{"starter/a.txt": "a\n", "starter/dir/b.txt": "b\n", "other/c.txt": "c\n"} {
+		if err := store.PutObject(ctx, key, strings.NewReader(body), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dataDir = t.TempDir()
+	t.Setenv("WORKSPACE_TEMPLATE", "s3://templates/starter")
+	instantiateTemplate(mountOptions{endpoint: s3srv.Endpoint, accessKeyID: "test", secretAccessKey: "test"})
+	if read("a.txt") != "a\n" || read("dir/b.txt") != "b\n" || read("c.txt") != "" {
+		t.Errorf("workspace from a bucket: a %q, b %q, c %q", read("a.txt"), read("dir/b.txt"), read("c.txt"))
+	}
+
+	for src, ok := range map[string]bool{"s3://templates/starter": true, "https://example.com/t.tgz": true, "s3://": false, "ftp://x/y": false} {
+		if err := checkTemplate(src); (err == nil) != ok {
+			t.Errorf("checkTemplate(%q) = %v", src, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// s3TokenSecretEnv is the secret the Worker signs S3_AUTH_TOKEN with (its
+// S3_JWT_SECRET). Given it, the server verifies the token and lets its
+// claims choose what is mounted: "bucket" the bucket, in place of the one
+// named after the Durable Object, and "prefix" the part of it under which
+// /data and every file API live. One image can then serve workspaces
+// scoped however the deployment splits them up. Unverified, the claims are
+// ignored.
+const s3TokenSecretEnv = "S3_JWT_SECRET"
+
+var (
+	// validBucket matches S3 bucket names.
+	validBucket = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+	// validPrefix matches the key prefixes a workspace can be scoped to.
+	validPrefix = regexp.MustCompile(`^[A-Za-z0-9._/-]{1,256}$`)
+)
+
+// bucketScope is the part of S3 a workspace is scoped to by its token.
+// Empty fields leave the default: the Durable Object's bucket, all of it.
+type bucketScope struct {
+	Bucket string `json:"bucket"`
+	// Prefix is "" or a key prefix ending in "/".
+	Prefix string `json:"prefix"`
+}
+
+// tokenScope verifies token with secret and returns the scope its claims
+// give.
+func tokenScope(token string, secret []byte, now time.Time) (bucketScope, error) {
+	var sc bucketScope
+	if err := verifyHS256(token, secret, now, &sc); err != nil {
+		return bucketScope{}, err
+	}
+	if sc.Bucket != "" && !validBucket.MatchString(sc.Bucket) {
+		return bucketScope{}, fmt.Errorf("bucket claim %q is not a bucket name", sc.Bucket)
+	}
+	if sc.Prefix == "" {
+		return sc, nil
+	}
+	clean := path.Clean("/" + sc.Prefix)
+	if !validPrefix.MatchString(sc.Prefix) || clean != "/"+strings.TrimSuffix(sc.Prefix, "/") || clean == "/" {
+		return bucketScope{}, fmt.Errorf("prefix claim %q: want a relative key prefix of letters, digits and ._/-", sc.Prefix)
+	}
+	sc.Prefix = clean[1:] + "/"
+	return sc, nil
+}
+
+// scope applies the scope S3_AUTH_TOKEN gives to o, if the token can be
+// verified.
+func (o *mountOptions) scope(token, secret string) error {
+	if secret == "" {
+		return nil
+	}
+	sc, err := tokenScope(token, []byte(secret), time.Now())
+	if err != nil {
+		return err
+	}
+	if sc.Bucket != "" {
+		o.bucket = sc.Bucket
+	}
+	o.prefix = sc.Prefix
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"server/container_src/internal/s3test"
+)
+
+func TestTokenScope(t *testing.T) {
+	sign := func(claims string) string {
+		enc := base64.RawURLEncoding
+		unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(unsigned))
+		return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+	}
+	token := sign(`{"sub":"acme","bucket":"tenants","prefix":"acme/ws-1"}`)
+	opts := mountOptions{bucket: "s3-default"}
+	if err := opts.scope(token, ""); err != nil || opts.bucket != "s3-default" || opts.prefix != "" {
+		t.Errorf("scope without a secret: %v, %+v", err, opts)
+	}
+	if err := opts.scope(token, "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	if opts.bucket != "tenants" || opts.prefix != "acme/ws-1/" || opts.source() != "tenants:acme/ws-1" {
+		t.Errorf("scoped options: %+v, source %s", opts, opts.source())
+	}
+	if err := (&mountOptions{}).scope(token, "wrong"); err == nil {
+		t.Error("token verified with the wrong secret")
+	}
+	for _, claims := range []string{`{"prefix":"../other"}`, `{"prefix":"/"}`, `{"prefix":"a//b"}`, `{"bucket":"Not_A_Bucket"}`, `{"bucket":"b","exp":1}`} {
+		if err := (&mountOptions{}).scope(sign(claims), "s3cret"); err == nil {
+			t.Errorf("claims %s accepted", claims)
+		}
+	}
+
+	// A scoped client sees only its prefix.
+	s3 := s3test.NewServer(t)
+	whole := s3.Client(t, "tenants")
+	ctx := context.Background()
+	if err := whole.CreateBucket(ctx); err != nil {
+		t.Fatal(err)
+	}
+	opts.endpoint, opts.accessKeyID, opts.secretAccessKey = s3.Endpoint, "test", "test"
+	c, err := opts.s3Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutObject(ctx, "recordings/a.cast", strings.NewReader("{}\n"), "application/x-asciicast"); err != nil {
+		t.Fatal(err)
+	}
+	whole.PutObject(ctx, "recordings/other.cast", strings.NewReader("{}\n"), "application/x-asciicast")
+	if objs, err := whole.ListObjects(ctx, "acme/"); err != nil || len(objs) != 1 || objs[0].Key != "acme/ws-1/recordings/a.cast" {
+		t.Errorf("object written through the scoped client: %v %v", objs, err)
+	}
+	if objs, err := c.ListObjects(ctx, ""); err != nil || len(objs) != 1 || objs[0].Key != "recordings/a.cast" {
+		t.Errorf("scoped listing: %v %v", objs, err)
+	}
+}
@@ -0,0 +1,5 @@
+// Package terminalpb contains the generated gRPC bindings for the terminal
+// server's API.
+package terminalpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative terminal.proto
@@ -0,0 +1,607 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: terminal.proto
+
+package terminalpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Terminal_ListSessions_FullMethodName  = "/dos3.terminal.v1.Terminal/ListSessions"
+	Terminal_Attach_FullMethodName        = "/dos3.terminal.v1.Terminal/Attach"
+	Terminal_SendInput_FullMethodName     = "/dos3.terminal.v1.Terminal/SendInput"
+	Terminal_ResizeSession_FullMethodName = "/dos3.terminal.v1.Terminal/ResizeSession"
+	Terminal_SendKey_FullMethodName       = "/dos3.terminal.v1.Terminal/SendKey"
+	Terminal_UpdateSession_FullMethodName = "/dos3.terminal.v1.Terminal/UpdateSession"
+	Terminal_CloseSession_FullMethodName  = "/dos3.terminal.v1.Terminal/CloseSession"
+	Terminal_Exec_FullMethodName          = "/dos3.terminal.v1.Terminal/Exec"
+	Terminal_Stat_FullMethodName          = "/dos3.terminal.v1.Terminal/Stat"
+	Terminal_ListDir_FullMethodName       = "/dos3.terminal.v1.Terminal/ListDir"
+	Terminal_ReadFile_FullMethodName      = "/dos3.terminal.v1.Terminal/ReadFile"
+	Terminal_WriteFile_FullMethodName     = "/dos3.terminal.v1.Terminal/WriteFile"
+	Terminal_Remove_FullMethodName        = "/dos3.terminal.v1.Terminal/Remove"
+)
+
+// TerminalClient is the client API for Terminal service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Terminal mirrors the container's HTTP APIs for sessions, exec, and files so
+// the Worker and other services can use generated clients.
+type TerminalClient interface {
+	// ListSessions returns the live PTY sessions, oldest first.
+	ListSessions(ctx context.Context, in *ListSessionsRequest, opts ...grpc.CallOption) (*ListSessionsResponse, error)
+	// Attach streams a session's output. The first request must set either
+	// start (a new session, closed when the stream ends) or session_id (an
+	// existing one); later requests carry input and resizes.
+	Attach(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AttachRequest, AttachResponse], error)
+	// SendInput writes bytes to a session's PTY, like POST /v1/sessions/{id}/input.
+	SendInput(ctx context.Context, in *SendInputRequest, opts ...grpc.CallOption) (*SendInputResponse, error)
+	// ResizeSession is POST /v1/sessions/{id}/resize.
+	ResizeSession(ctx context.Context, in *ResizeSessionRequest, opts ...grpc.CallOption) (*ResizeSessionResponse, error)
+	// SendKey is POST /v1/sessions/{id}/key.
+	SendKey(ctx context.Context, in *SendKeyRequest, opts ...grpc.CallOption) (*SendKeyResponse, error)
+	// UpdateSession changes a session's name, tags, or metadata, like
+	// PATCH /v1/sessions/{id}.
+	UpdateSession(ctx context.Context, in *UpdateSessionRequest, opts ...grpc.CallOption) (*Session, error)
+	// CloseSession kills a session's shell.
+	CloseSession(ctx context.Context, in *CloseSessionRequest, opts ...grpc.CallOption) (*CloseSessionResponse, error)
+	// Exec runs a command to completion without a PTY, streaming its output
+	// and finishing with its exit status.
+	Exec(ctx context.Context, in *ExecRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ExecResponse], error)
+	// Paths are relative to /data; paths escaping it are rejected.
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileInfo, error)
+	ListDir(ctx context.Context, in *ListDirRequest, opts ...grpc.CallOption) (*ListDirResponse, error)
+	ReadFile(ctx context.Context, in *ReadFileRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ReadFileResponse], error)
+	// WriteFile's first request must set start; the rest carry data. The file
+	// is replaced atomically once the stream completes.
+	WriteFile(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[WriteFileRequest, FileInfo], error)
+	Remove(ctx context.Context, in *RemoveRequest, opts ...grpc.CallOption) (*RemoveResponse, error)
+}
+
+type terminalClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTerminalClient(cc grpc.ClientConnInterface) TerminalClient {
+	return &terminalClient{cc}
+}
+
+func (c *terminalClient) ListSessions(ctx context.Context, in *ListSessionsRequest, opts ...grpc.CallOption) (*ListSessionsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListSessionsResponse)
+	err := c.cc.Invoke(ctx, Terminal_ListSessions_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *terminalClient) Attach(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AttachRequest, AttachResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Terminal_ServiceDesc.Streams[0], Terminal_Attach_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AttachRequest, AttachResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Terminal_AttachClient = grpc.BidiStreamingClient[AttachRequest, AttachResponse]
+
+func (c *terminalClient) SendInput(ctx context.Context, in *SendInputRequest, opts ...grpc.CallOption) (*SendInputResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SendInputResponse)
+	err := c.cc.Invoke(ctx, Terminal_SendInput_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *terminalClient) ResizeSession(ctx context.Context, in *ResizeSessionRequest, opts ...grpc.CallOption) (*ResizeSessionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ResizeSessionResponse)
+	err := c.cc.Invoke(ctx, Terminal_ResizeSession_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *terminalClient) SendKey(ctx context.Context, in *SendKeyRequest, opts ...grpc.CallOption) (*SendKeyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SendKeyResponse)
+	err := c.cc.Invoke(ctx, Terminal_SendKey_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *terminalClient) UpdateSession(ctx context.Context, in *UpdateSessionRequest, opts ...grpc.CallOption) (*Session, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Session)
+	err := c.cc.Invoke(ctx, Terminal_UpdateSession_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *terminalClient) CloseSession(ctx context.Context, in *CloseSessionRequest, opts ...grpc.CallOption) (*CloseSessionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CloseSessionResponse)
+	err := c.cc.Invoke(ctx, Terminal_CloseSession_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *terminalClient) Exec(ctx context.Context, in *ExecRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ExecResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Terminal_ServiceDesc.Streams[1], Terminal_Exec_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ExecRequest, ExecResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Terminal_ExecClient = grpc.ServerStreamingClient[ExecResponse]
+
+func (c *terminalClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileInfo, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FileInfo)
+	err := c.cc.Invoke(ctx, Terminal_Stat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *terminalClient) ListDir(ctx context.Context, in *ListDirRequest, opts ...grpc.CallOption) (*ListDirResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListDirResponse)
+	err := c.cc.Invoke(ctx, Terminal_ListDir_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *terminalClient) ReadFile(ctx context.Context, in *ReadFileRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ReadFileResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Terminal_ServiceDesc.Streams[2], Terminal_ReadFile_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ReadFileRequest, ReadFileResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Terminal_ReadFileClient = grpc.ServerStreamingClient[ReadFileResponse]
+
+func (c *terminalClient) WriteFile(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[WriteFileRequest, FileInfo], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Terminal_ServiceDesc.Streams[3], Terminal_WriteFile_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WriteFileRequest, FileInfo]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Terminal_WriteFileClient = grpc.ClientStreamingClient[WriteFileRequest, FileInfo]
+
+func (c *terminalClient) Remove(ctx context.Context, in *RemoveRequest, opts ...grpc.CallOption) (*RemoveResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RemoveResponse)
+	err := c.cc.Invoke(ctx, Terminal_Remove_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TerminalServer is the server API for Terminal service.
+// All implementations must embed UnimplementedTerminalServer
+// for forward compatibility.
+//
+// Terminal mirrors the container's HTTP APIs for sessions, exec, and files so
+// the Worker and other services can use generated clients.
+type TerminalServer interface {
+	// ListSessions returns the live PTY sessions, oldest first.
+	ListSessions(context.Context, *ListSessionsRequest) (*ListSessionsResponse, error)
+	// Attach streams a session's output. The first request must set either
+	// start (a new session, closed when the stream ends) or session_id (an
+	// existing one); later requests carry input and resizes.
+	Attach(grpc.BidiStreamingServer[AttachRequest, AttachResponse]) error
+	// SendInput writes bytes to a session's PTY, like POST /v1/sessions/{id}/input.
+	SendInput(context.Context, *SendInputRequest) (*SendInputResponse, error)
+	// ResizeSession is POST /v1/sessions/{id}/resize.
+	ResizeSession(context.Context, *ResizeSessionRequest) (*ResizeSessionResponse, error)
+	// SendKey is POST /v1/sessions/{id}/key.
+	SendKey(context.Context, *SendKeyRequest) (*SendKeyResponse, error)
+	// UpdateSession changes a session's name, tags, or metadata, like
+	// PATCH /v1/sessions/{id}.
+	UpdateSession(context.Context, *UpdateSessionRequest) (*Session, error)
+	// CloseSession kills a session's shell.
+	CloseSession(context.Context, *CloseSessionRequest) (*CloseSessionResponse, error)
+	// Exec runs a command to completion without a PTY, streaming its output
+	// and finishing with its exit status.
+	Exec(*ExecRequest, grpc.ServerStreamingServer[ExecResponse]) error
+	// Paths are relative to /data; paths escaping it are rejected.
+	Stat(context.Context, *StatRequest) (*FileInfo, error)
+	ListDir(context.Context, *ListDirRequest) (*ListDirResponse, error)
+	ReadFile(*ReadFileRequest, grpc.ServerStreamingServer[ReadFileResponse]) error
+	// WriteFile's first request must set start; the rest carry data. The file
+	// is replaced atomically once the stream completes.
+	WriteFile(grpc.ClientStreamingServer[WriteFileRequest, FileInfo]) error
+	Remove(context.Context, *RemoveRequest) (*RemoveResponse, error)
+	mustEmbedUnimplementedTerminalServer()
+}
+
+// UnimplementedTerminalServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedTerminalServer struct{}
+
+func (UnimplementedTerminalServer) ListSessions(context.Context, *ListSessionsRequest) (*ListSessionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSessions not implemented")
+}
+func (UnimplementedTerminalServer) Attach(grpc.BidiStreamingServer[AttachRequest, AttachResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Attach not implemented")
+}
+func (UnimplementedTerminalServer) SendInput(context.Context, *SendInputRequest) (*SendInputResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendInput not implemented")
+}
+func (UnimplementedTerminalServer) ResizeSession(context.Context, *ResizeSessionRequest) (*ResizeSessionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResizeSession not implemented")
+}
+func (UnimplementedTerminalServer) SendKey(context.Context, *SendKeyRequest) (*SendKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendKey not implemented")
+}
+func (UnimplementedTerminalServer) UpdateSession(context.Context, *UpdateSessionRequest) (*Session, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateSession not implemented")
+}
+func (UnimplementedTerminalServer) CloseSession(context.Context, *CloseSessionRequest) (*CloseSessionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CloseSession not implemented")
+}
+func (UnimplementedTerminalServer) Exec(*ExecRequest, grpc.ServerStreamingServer[ExecResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Exec not implemented")
+}
+func (UnimplementedTerminalServer) Stat(context.Context, *StatRequest) (*FileInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedTerminalServer) ListDir(context.Context, *ListDirRequest) (*ListDirResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDir not implemented")
+}
+func (UnimplementedTerminalServer) ReadFile(*ReadFileRequest, grpc.ServerStreamingServer[ReadFileResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ReadFile not implemented")
+}
+func (UnimplementedTerminalServer) WriteFile(grpc.ClientStreamingServer[WriteFileRequest, FileInfo]) error {
+	return status.Errorf(codes.Unimplemented, "method WriteFile not implemented")
+}
+func (UnimplementedTerminalServer) Remove(context.Context, *RemoveRequest) (*RemoveResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Remove not implemented")
+}
+func (UnimplementedTerminalServer) mustEmbedUnimplementedTerminalServer() {}
+func (UnimplementedTerminalServer) testEmbeddedByValue()                  {}
+
+// UnsafeTerminalServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TerminalServer will
+// result in compilation errors.
+type UnsafeTerminalServer interface {
+	mustEmbedUnimplementedTerminalServer()
+}
+
+func RegisterTerminalServer(s grpc.ServiceRegistrar, srv TerminalServer) {
+	// If the following call pancis, it indicates UnimplementedTerminalServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Terminal_ServiceDesc, srv)
+}
+
+func _Terminal_ListSessions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSessionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TerminalServer).ListSessions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Terminal_ListSessions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TerminalServer).ListSessions(ctx, req.(*ListSessionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Terminal_Attach_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TerminalServer).Attach(&grpc.GenericServerStream[AttachRequest, AttachResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Terminal_AttachServer = grpc.BidiStreamingServer[AttachRequest, AttachResponse]
+
+func _Terminal_SendInput_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendInputRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TerminalServer).SendInput(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Terminal_SendInput_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TerminalServer).SendInput(ctx, req.(*SendInputRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Terminal_ResizeSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResizeSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TerminalServer).ResizeSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Terminal_ResizeSession_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TerminalServer).ResizeSession(ctx, req.(*ResizeSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Terminal_SendKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TerminalServer).SendKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Terminal_SendKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TerminalServer).SendKey(ctx, req.(*SendKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Terminal_UpdateSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TerminalServer).UpdateSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Terminal_UpdateSession_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TerminalServer).UpdateSession(ctx, req.(*UpdateSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Terminal_CloseSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CloseSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TerminalServer).CloseSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Terminal_CloseSession_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TerminalServer).CloseSession(ctx, req.(*CloseSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Terminal_Exec_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExecRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TerminalServer).Exec(m, &grpc.GenericServerStream[ExecRequest, ExecResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Terminal_ExecServer = grpc.ServerStreamingServer[ExecResponse]
+
+func _Terminal_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TerminalServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Terminal_Stat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TerminalServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Terminal_ListDir_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListDirRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TerminalServer).ListDir(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Terminal_ListDir_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TerminalServer).ListDir(ctx, req.(*ListDirRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Terminal_ReadFile_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReadFileRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TerminalServer).ReadFile(m, &grpc.GenericServerStream[ReadFileRequest, ReadFileResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Terminal_ReadFileServer = grpc.ServerStreamingServer[ReadFileResponse]
+
+func _Terminal_WriteFile_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TerminalServer).WriteFile(&grpc.GenericServerStream[WriteFileRequest, FileInfo]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Terminal_WriteFileServer = grpc.ClientStreamingServer[WriteFileRequest, FileInfo]
+
+func _Terminal_Remove_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TerminalServer).Remove(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Terminal_Remove_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TerminalServer).Remove(ctx, req.(*RemoveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Terminal_ServiceDesc is the grpc.ServiceDesc for Terminal service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Terminal_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dos3.terminal.v1.Terminal",
+	HandlerType: (*TerminalServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListSessions",
+			Handler:    _Terminal_ListSessions_Handler,
+		},
+		{
+			MethodName: "SendInput",
+			Handler:    _Terminal_SendInput_Handler,
+		},
+		{
+			MethodName: "ResizeSession",
+			Handler:    _Terminal_ResizeSession_Handler,
+		},
+		{
+			MethodName: "SendKey",
+			Handler:    _Terminal_SendKey_Handler,
+		},
+		{
+			MethodName: "UpdateSession",
+			Handler:    _Terminal_UpdateSession_Handler,
+		},
+		{
+			MethodName: "CloseSession",
+			Handler:    _Terminal_CloseSession_Handler,
+		},
+		{
+			MethodName: "Stat",
+			Handler:    _Terminal_Stat_Handler,
+		},
+		{
+			MethodName: "ListDir",
+			Handler:    _Terminal_ListDir_Handler,
+		},
+		{
+			MethodName: "Remove",
+			Handler:    _Terminal_Remove_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Attach",
+			Handler:       _Terminal_Attach_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Exec",
+			Handler:       _Terminal_Exec_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ReadFile",
+			Handler:       _Terminal_ReadFile_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WriteFile",
+			Handler:       _Terminal_WriteFile_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "terminal.proto",
+}
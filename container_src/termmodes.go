@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// maxModeParams bounds the parameters of a CSI sequence the mode scanner
+// keeps; DEC private mode sets are a handful of short numbers.
+const maxModeParams = 64
+
+// terminalModes is the DEC private mode state a session's programs have
+// set, which a client attaching mid-session needs to render it correctly:
+// the scrollback it replays may no longer contain the sequences that
+// switched to the alternate screen or turned on mouse reporting.
+type terminalModes struct {
+	AltScreen bool `json:"alt_screen"`
+	// Mouse is the mouse tracking mode: "x10" (9), "normal" (1000),
+	// "button" (1002) or "any" (1003); empty when off.
+	Mouse string `json:"mouse,omitempty"`
+	// MouseEncoding is "sgr" (1006), "utf8" (1005) or "urxvt" (1015);
+	// empty for the default X10 encoding.
+	MouseEncoding  string `json:"mouse_encoding,omitempty"`
+	BracketedPaste bool   `json:"bracketed_paste"`
+	// AppCursorKeys is DECCKM (1): arrow keys send ESC O A rather than
+	// ESC [ A.
+	AppCursorKeys bool `json:"app_cursor_keys"`
+	CursorHidden  bool `json:"cursor_hidden"`
+}
+
+// set applies DEC private mode n being set (h) or reset (l).
+func (m *terminalModes) set(n int, on bool) {
+	mouse := func(name string) {
+		if on {
+			m.Mouse = name
+		} else if m.Mouse == name {
+			m.Mouse = ""
+		}
+	}
+	encoding := func(name string) {
+		if on {
+			m.MouseEncoding = name
+		} else if m.MouseEncoding == name {
+			m.MouseEncoding = ""
+		}
+	}
+	switch n {
+	case 1:
+		m.AppCursorKeys = on
+	case 25:
+		m.CursorHidden = !on
+	case 47, 1047, 1049:
+		m.AltScreen = on
+	case 9:
+		mouse("x10")
+	case 1000:
+		mouse("normal")
+	case 1002:
+		mouse("button")
+	case 1003:
+		mouse("any")
+	case 1005:
+		encoding("utf8")
+	case 1006:
+		encoding("sgr")
+	case 1015:
+		encoding("urxvt")
+	case 2004:
+		m.BracketedPaste = on
+	}
+}
+
+// modeScanner follows DEC private mode sequences ("ESC [ ? Pm h" and
+// "ESC [ ? Pm l") and full resets ("ESC c") in a session's output, which may
+// split them across reads.
+type modeScanner struct {
+	modes  terminalModes
+	state  stripState // reuses the stripper's states; only ground, esc and csi matter
+	params []byte
+}
+
+// scan feeds output through the scanner and reports whether the modes
+// changed.
+func (sc *modeScanner) scan(p []byte) bool {
+	before := sc.modes
+	for _, c := range p {
+		switch sc.state {
+		case stripGround:
+			if c == 0x1b {
+				sc.state = stripEsc
+			}
+		case stripEsc:
+			switch c {
+			case '[':
+				sc.state, sc.params = stripCSI, sc.params[:0]
+			case 'c':
+				sc.modes, sc.state = terminalModes{}, stripGround
+			case 0x1b:
+			default:
+				sc.state = stripGround
+			}
+		case stripCSI:
+			switch {
+			case c >= 0x40 && c <= 0x7e:
+				if (c == 'h' || c == 'l') && len(sc.params) > 0 && sc.params[0] == '?' {
+					for _, f := range bytes.Split(sc.params[1:], []byte(";")) {
+						if n, err := strconv.Atoi(string(f)); err == nil {
+							sc.modes.set(n, c == 'h')
+						}
+					}
+				}
+				sc.state = stripGround
+			case c == 0x1b:
+				sc.state = stripEsc
+			case len(sc.params) < maxModeParams:
+				sc.params = append(sc.params, c)
+			}
+		}
+	}
+	return sc.modes != before
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestModeScanner(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		chunks []string
+		want   terminalModes
+	}{
+		{"alternate screen", []string{"\x1b[?1049h"}, terminalModes{AltScreen: true}},
+		{"left again", []string{"\x1b[?1049h", "vim\x1b[?1049l"}, terminalModes{}},
+		{"split", []string{"\x1b", "[?10", "49h"}, terminalModes{AltScreen: true}},
+		{"several in one", []string{"\x1b[?1;1002;1006;2004h"}, terminalModes{AppCursorKeys: true, Mouse: "button", MouseEncoding: "sgr", BracketedPaste: true}},
+		{"cursor hidden", []string{"\x1b[?25l"}, terminalModes{CursorHidden: true}},
+		// Turning off a mouse mode that isn't on leaves the one that is.
+		{"other mouse mode off", []string{"\x1b[?1003h\x1b[?1000l"}, terminalModes{Mouse: "any"}},
+		{"full reset", []string{"\x1b[?1049h\x1b[?2004h", "\x1bc"}, terminalModes{}},
+		{"not private", []string{"\x1b[4h\x1b[1049h"}, terminalModes{}},
+		{"unknown mode", []string{"\x1b[?7727h"}, terminalModes{}},
+	} {
+		var sc modeScanner
+		for _, c := range tc.chunks {
+			sc.scan([]byte(c))
+		}
+		if sc.modes != tc.want {
+			t.Errorf("%s: %+v, want %+v", tc.name, sc.modes, tc.want)
+		}
+	}
+}
+
+// TestSessionModes checks that modes a session's program sets are reported
+// to clients describing the session.
+func TestSessionModes(t *testing.T) {
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	sess.write([]byte(`printf '\033[?1049h\033[?1000;1006h\033[?2004h'` + "\n"))
+	want := terminalModes{AltScreen: true, Mouse: "normal", MouseEncoding: "sgr", BracketedPaste: true}
+	for deadline := time.Now().Add(5 * time.Second); sess.terminalModes() != want; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("session modes %+v, want %+v", sess.terminalModes(), want)
+		}
+	}
+
+	resp, err := http.Get(testURL + "/v1/sessions/" + sess.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info sessionInfo
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if info.Modes != want {
+		t.Errorf("GET /v1/sessions/{id} modes %+v, want %+v", info.Modes, want)
+	}
+}
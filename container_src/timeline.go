@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The timeline is what happened in the workspace, newest first, for
+// answering "what changed here yesterday": sessions starting and ending,
+// the commands their shells ran, files changing under /data, and snapshots
+// of the workspace (freezes and export jobs). Sessions and exports come
+// from the state database's own tables; the rest is recorded in its
+// timeline table as the event bus reports it.
+
+const (
+	timelineSession  = "session"
+	timelineCommand  = "command"
+	timelineFile     = "file"
+	timelineSnapshot = "snapshot"
+)
+
+const (
+	// timelineRetention is how long commands, file changes and freezes
+	// stay in the timeline.
+	timelineRetention = 30 * 24 * time.Hour
+	// timelineFileDelay is how long file changes are coalesced for before
+	// they are recorded: a path changed repeatedly meanwhile is recorded
+	// once.
+	timelineFileDelay = 5 * time.Second
+	// maxTimelineFiles bounds the file changes waiting to be recorded;
+	// further paths are dropped until they are.
+	maxTimelineFiles = 10000
+)
+
+var timelineDropped = newCounter("dos3_timeline_files_dropped_total",
+	"File changes left out of the timeline because too many came at once.")
+
+// timelineEntry is something that happened in the workspace.
+type timelineEntry struct {
+	Time time.Time `json:"time"`
+	// Kind is session, command, file or snapshot, and Op what happened:
+	// started or ended for a session; create, modify, delete or rename
+	// for a file; frozen, unfrozen or export for a snapshot.
+	Kind string `json:"kind"`
+	Op   string `json:"op,omitempty"`
+	// Session and User are whose session it happened in, for sessions and
+	// commands.
+	Session string `json:"session,omitempty"`
+	User    string `json:"user,omitempty"`
+	// Path is the file changed, or the directory a command ran in.
+	Path string `json:"path,omitempty"`
+	// Detail is a session's name, why it ended, a command line, the path a
+	// file was renamed from, why the workspace was frozen, or an export
+	// job's ID and state.
+	Detail     string `json:"detail,omitempty"`
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	DurationMS *int64 `json:"duration_ms,omitempty"`
+}
+
+type timelineEntries struct {
+	Entries []timelineEntry `json:"entries"`
+}
+
+// Commands and freezes are recorded as the event bus reports them.
+var _ = events.subscribe("timeline", func(e event) {
+	var entry timelineEntry
+	switch e.Kind {
+	case eventCommandFinished:
+		c := e.Command
+		entry = timelineEntry{Time: c.Finished, Kind: timelineCommand, Op: "finished", Path: c.Cwd, Detail: c.Command,
+			ExitCode: c.ExitCode, DurationMS: &c.DurationMS}
+		if e.Session != nil {
+			entry.Session, entry.User = e.Session.id, e.Session.user
+		}
+	case eventWorkspaceFrozen:
+		entry = timelineEntry{Time: e.Time, Kind: timelineSnapshot, Op: "frozen", Detail: e.Detail}
+	case eventWorkspaceUnfrozen:
+		entry = timelineEntry{Time: e.Time, Kind: timelineSnapshot, Op: "unfrozen"}
+	}
+	if err := state.recordTimeline([]timelineEntry{entry}); err != nil {
+		warnf("Recording %s in the timeline: %v", e.Kind, err)
+	}
+}, eventCommandFinished, eventWorkspaceFrozen, eventWorkspaceUnfrozen)
+
+// timelineFiles coalesces file changes for the timeline.
+var timelineFiles struct {
+	mu      sync.Mutex
+	pending map[string]timelineEntry
+	order   []string
+	pruned  time.Time
+}
+
+// startTimeline records file changes in the timeline, unless
+// timeline_files is off. It must run before the change watcher starts.
+func startTimeline() {
+	if !currentConfig().TimelineFiles {
+		return
+	}
+	events.subscribe("timeline-files", func(e event) {
+		if e.Change.Path != "" {
+			addTimelineFile(e.Time, e.Change)
+		}
+	}, eventFileChanged)
+}
+
+// addTimelineFile queues a file change, folding it into one queued for the
+// same path: a file created and then written is still created.
+func addTimelineFile(t time.Time, ch changeEvent) {
+	f := &timelineFiles
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry := timelineEntry{Time: t.UTC(), Kind: timelineFile, Op: ch.Op, Path: ch.Path, Detail: ch.From}
+	prev, ok := f.pending[ch.Path]
+	switch {
+	case ok && prev.Op == "create" && ch.Op == "modify":
+		entry.Op = "create"
+	case ok:
+	case len(f.pending) >= maxTimelineFiles:
+		timelineDropped.add(1)
+		return
+	case f.pending == nil:
+		f.pending = make(map[string]timelineEntry)
+		time.AfterFunc(timelineFileDelay, flushTimelineFiles)
+		fallthrough
+	default:
+		f.order = append(f.order, ch.Path)
+	}
+	f.pending[ch.Path] = entry
+}
+
+// flushTimelineFiles records the file changes queued, and now and then
+// drops what has outlived timelineRetention.
+func flushTimelineFiles() {
+	f := &timelineFiles
+	f.mu.Lock()
+	list := make([]timelineEntry, 0, len(f.order))
+	for _, p := range f.order {
+		list = append(list, f.pending[p])
+	}
+	f.pending, f.order = nil, nil
+	prune := time.Since(f.pruned) > time.Hour
+	if prune {
+		f.pruned = time.Now()
+	}
+	f.mu.Unlock()
+	if err := state.recordTimeline(list); err != nil {
+		warnf("Recording %d file changes in the timeline: %v", len(list), err)
+	}
+	if prune {
+		if err := state.pruneTimeline(time.Now().Add(-timelineRetention)); err != nil {
+			warnf("Pruning the timeline: %v", err)
+		}
+	}
+}
+
+// recordTimeline adds entries to the timeline table.
+func (s *stateStore) recordTimeline(entries []timelineEntry) error {
+	if s == nil || len(entries) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, e := range entries {
+		if _, err := tx.Exec(`INSERT INTO timeline (time, kind, op, session, user, path, detail, exit_code, duration_ms)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			e.Time.UnixMilli(), e.Kind, e.Op, e.Session, e.User, e.Path, e.Detail, e.ExitCode, e.DurationMS); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// pruneTimeline drops the entries recorded before cutoff.
+func (s *stateStore) pruneTimeline(cutoff time.Time) error {
+	if s == nil {
+		return nil
+	}
+	_, err := s.db.Exec(`DELETE FROM timeline WHERE time < ?`, cutoff.UnixMilli())
+	return err
+}
+
+// timelineQuery is what GET /v1/timeline filters on.
+type timelineQuery struct {
+	stateQuery
+	until time.Time
+	// kinds are the kinds of entry wanted, all if empty.
+	kinds   []string
+	session string
+}
+
+// timelineUnion is every source of timeline entries as one table.
+const timelineUnion = `
+	SELECT started AS time, 'session' AS kind, 'started' AS op, id AS session, user, '' AS path, name AS detail,
+		NULL AS exit_code, NULL AS duration_ms FROM sessions
+	UNION ALL
+	SELECT ended, 'session', 'ended', id, user, '', end_reason, exit_code, ended - started FROM sessions WHERE ended IS NOT NULL
+	UNION ALL
+	SELECT started, 'snapshot', 'export', '', '', '', id || ' ' || state, exit_code, finished - started FROM jobs WHERE command = 'export'
+	UNION ALL
+	SELECT time, kind, op, session, user, path, detail, exit_code, duration_ms FROM timeline`
+
+// timeline returns the entries from h.since to h.until, newest first.
+func (s *stateStore) timeline(ctx context.Context, h timelineQuery) ([]timelineEntry, error) {
+	if s == nil {
+		return nil, errNoState
+	}
+	until := int64(1<<63 - 1)
+	if !h.until.IsZero() {
+		until = h.until.UnixMilli()
+	}
+	query := `SELECT time, kind, op, session, user, path, detail, exit_code, duration_ms FROM (` + timelineUnion + `)
+		WHERE time >= ? AND time < ? AND (? = '' OR user = ?) AND (? = '' OR session = ?)`
+	args := []any{h.since.UnixMilli(), until, h.match, h.match, h.session, h.session}
+	if len(h.kinds) > 0 {
+		query += ` AND kind IN (?` + strings.Repeat(", ?", len(h.kinds)-1) + `)`
+		for _, k := range h.kinds {
+			args = append(args, k)
+		}
+	}
+	query += ` ORDER BY time DESC LIMIT ?`
+	args = append(args, h.limit)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []timelineEntry{}
+	for rows.Next() {
+		var e timelineEntry
+		var t int64
+		var code sql.NullInt32
+		var dur sql.NullInt64
+		if err := rows.Scan(&t, &e.Kind, &e.Op, &e.Session, &e.User, &e.Path, &e.Detail, &code, &dur); err != nil {
+			return nil, err
+		}
+		e.Time = time.UnixMilli(t).UTC()
+		if code.Valid {
+			c := int(code.Int32)
+			e.ExitCode = &c
+		}
+		if dur.Valid {
+			e.DurationMS = &dur.Int64
+		}
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+func parseTimelineQuery(r *http.Request) (timelineQuery, error) {
+	sq, err := parseStateQuery(r, "user")
+	if err != nil {
+		return timelineQuery{}, err
+	}
+	q := r.URL.Query()
+	h := timelineQuery{stateQuery: sq, session: q.Get("session")}
+	if v := q.Get("until"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return timelineQuery{}, fmt.Errorf("%w: until must be an RFC 3339 time", errInvalidStateQuery)
+		}
+		h.until = t
+	}
+	for _, k := range q["kind"] {
+		switch k {
+		case timelineSession, timelineCommand, timelineFile, timelineSnapshot:
+			h.kinds = append(h.kinds, k)
+		default:
+			return timelineQuery{}, fmt.Errorf("%w: kind must be session, command, file or snapshot", errInvalidStateQuery)
+		}
+	}
+	return h, nil
+}
+
+func handleTimeline(w http.ResponseWriter, r *http.Request) {
+	h, err := parseTimelineQuery(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	list, err := state.timeline(r.Context(), h)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, timelineEntries{Entries: list})
+}
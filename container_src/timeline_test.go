@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTimeline(t *testing.T) {
+	s, err := openState(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := state
+	state = s
+	t.Cleanup(func() {
+		state = prev
+		s.db.Close()
+	})
+	start := time.Now().Add(-time.Second).UTC()
+
+	sess, err := sessions.start(80, 24, sessionMeta{Name: "build"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := 2
+	now := time.Now()
+	sess.addHistory([]commandRecord{{Command: "make test", Cwd: "/data/app", Started: now.Add(-time.Second), Finished: now, DurationMS: 1000, ExitCode: &code}})
+	sess.close()
+	<-sess.done
+	addTimelineFile(time.Now(), changeEvent{Path: "app/main.go", Op: "create"})
+	addTimelineFile(time.Now(), changeEvent{Path: "app/main.go", Op: "modify"})
+	addTimelineFile(time.Now(), changeEvent{Path: "app/new.go", Op: "rename", From: "app/old.go"})
+	flushTimelineFiles()
+	if _, err := workspaceFreeze.freeze(context.Background(), "nightly"); err != nil {
+		t.Fatal(err)
+	}
+	workspaceFreeze.unfreeze()
+
+	query := func(q string) (timelineEntries, int) {
+		t.Helper()
+		resp, err := http.Get(testURL + "/v1/timeline?since=" + start.Format(time.RFC3339) + q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var got timelineEntries
+		json.NewDecoder(resp.Body).Decode(&got)
+		return got, resp.StatusCode
+	}
+	// Events reach the timeline asynchronously.
+	var got timelineEntries
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got, _ = query(""); len(got.Entries) >= 7 {
+			break
+		}
+	}
+	kinds := map[string]timelineEntry{}
+	for _, e := range got.Entries {
+		kinds[e.Kind+"/"+e.Op] = e
+	}
+	if e := kinds["command/finished"]; e.Detail != "make test" || e.Session != sess.id || e.Path != "/data/app" || e.ExitCode == nil || *e.ExitCode != 2 {
+		t.Errorf("command %+v", e)
+	}
+	if e := kinds["session/started"]; e.Detail != "build" || e.Session != sess.id {
+		t.Errorf("session started %+v", e)
+	}
+	if e := kinds["file/create"]; e.Path != "app/main.go" {
+		t.Errorf("file %+v", e)
+	}
+	if e := kinds["file/rename"]; e.Detail != "app/old.go" {
+		t.Errorf("rename %+v", e)
+	}
+	if e := kinds["snapshot/frozen"]; e.Detail != "nightly" {
+		t.Errorf("freeze %+v", e)
+	}
+	if _, ok := kinds["file/modify"]; ok || len(got.Entries) != 7 || kinds["session/ended"].Session != sess.id || kinds["snapshot/unfrozen"].Kind == "" {
+		t.Errorf("timeline %+v", got.Entries)
+	}
+	for i := 1; i < len(got.Entries); i++ {
+		if got.Entries[i].Time.After(got.Entries[i-1].Time) {
+			t.Errorf("entries out of order: %+v", got.Entries)
+		}
+	}
+
+	files, _ := query("&kind=file&kind=snapshot")
+	if len(files.Entries) != 4 {
+		t.Errorf("files and snapshots: %+v", files.Entries)
+	}
+	if old, _ := query("&until=" + start.Format(time.RFC3339)); len(old.Entries) != 0 {
+		t.Errorf("until: %+v", old.Entries)
+	}
+	if _, status := query("&kind=weather"); status != http.StatusBadRequest {
+		t.Errorf("kind=weather: %d", status)
+	}
+}
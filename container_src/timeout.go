@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// readHeaderTimeout bounds how long a client may take to send a
+	// request's headers, and idleTimeout how long a kept-alive connection
+	// may sit between requests.
+	readHeaderTimeout = 10 * time.Second
+	idleTimeout       = 2 * time.Minute
+	// writeGrace is how much longer than request_timeout a response may
+	// take to write, so a handler that timed out can still say so.
+	writeGrace = 5 * time.Second
+)
+
+var fsCallsAbandoned = newCounter("dos3_fs_calls_abandoned_total",
+	"Filesystem operations a request stopped waiting for, because the mount didn't answer in time or the client went away.")
+
+// withTimeout bounds a request to request_timeout: its context is cancelled
+// then, and writes to a client that stopped reading fail rather than block.
+func withTimeout(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d := currentConfig().RequestTimeout.Duration
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d + writeGrace))
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// mountContext is r's context, bounded by request_timeout, for the
+// filesystem calls of a streaming request, which has no overall deadline.
+func mountContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), currentConfig().RequestTimeout.Duration)
+}
+
+// fsCall runs f, which may block on the mount, and stops waiting for it when
+// ctx is done, returning ctx's error. A FUSE operation stuck in the kernel
+// can't be interrupted, so f keeps its goroutine until the mount answers
+// (and may still take effect), but the handler and its connection are let
+// go. A result that is an io.Closer arriving after that is closed.
+func fsCall[T any](ctx context.Context, f func() (T, error)) (T, error) {
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := f()
+		done <- result{v, err}
+	}()
+	select {
+	case res := <-done:
+		return res.v, res.err
+	case <-ctx.Done():
+	}
+	fsCallsAbandoned.add(1)
+	go func() {
+		res := <-done
+		if c, ok := any(res.v).(io.Closer); ok && res.err == nil {
+			c.Close()
+		}
+	}()
+	var zero T
+	return zero, ctx.Err()
+}
+
+// openedFile is openFile's result, for fsCall.
+type openedFile struct {
+	*os.File
+	info fileInfo
+}
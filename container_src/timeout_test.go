@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	cfg := *currentConfig()
+	cfg.RequestTimeout = duration{50 * time.Millisecond}
+	prev := activeConfig.Swap(&cfg)
+	t.Cleanup(func() { activeConfig.Store(prev) })
+
+	// A mount operation that never answers, until the test lets it.
+	stuck := make(chan struct{})
+	opened := make(chan *os.File, 1)
+	h := withTimeout(func(w http.ResponseWriter, r *http.Request) {
+		_, err := fsCall(r.Context(), func() (openedFile, error) {
+			<-stuck
+			f, err := os.Open(os.DevNull)
+			opened <- f
+			return openedFile{File: f}, err
+		})
+		writeError(w, r, err)
+	})
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	h(rec, httptest.NewRequest("GET", "/v1/files/x", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("stuck request: %d %s, want 504", rec.Code, rec.Body)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("stuck request took %v to give up", d)
+	}
+
+	// The file opened after the request gave up is closed, not leaked.
+	close(stuck)
+	f := <-opened
+	deadline := time.Now().Add(5 * time.Second)
+	for _, err := f.Stat(); !errors.Is(err, os.ErrClosed); _, err = f.Stat() {
+		if time.Now().After(deadline) {
+			t.Fatal("file opened by an abandoned call was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Kinds of traffic, for attributing egress.
+const (
+	trafficTerminal = "terminal" // PTY input and output
+	trafficControl  = "control"  // JSON control messages beside terminal data
+	trafficFile     = "file"     // the file API, and files pasted into terminals
+	trafficLSP      = "lsp"      // language server channels
+	trafficProxy    = "proxy"    // /proxy/{port}
+	trafficAPI      = "api"      // the rest of /v1
+)
+
+var (
+	trafficBytes = newCounter("dos3_traffic_bytes_total",
+		"Bytes received (in) and sent (out) by endpoint and kind: terminal, control, file, lsp, proxy or api. HTTP counts bodies; WebSockets count message payloads.")
+	sessionTrafficBytes = newCounter("dos3_session_traffic_bytes_total",
+		"Terminal and control bytes of live sessions, by session, kind and direction; dropped when the session ends.")
+)
+
+// meterTraffic counts n bytes of kind traffic, in direction dir ("in" or
+// "out"), on endpoint.
+func meterTraffic(endpoint, kind, dir string, n int) {
+	if n > 0 {
+		trafficBytes.add(float64(n), "endpoint", endpoint, "kind", kind, "direction", dir)
+	}
+}
+
+// meterTraffic counts n bytes against the session, as for meterTraffic.
+func (s *session) meterTraffic(kind, dir string, n int) {
+	if n > 0 {
+		sessionTrafficBytes.add(float64(n), "session", s.id, "kind", kind, "direction", dir)
+	}
+}
+
+// routeTraffic is the kind rt's traffic is counted as.
+func routeTraffic(rt route) string {
+	switch {
+	case rt.Traffic != "":
+		return rt.Traffic
+	case rt.Tag == "files":
+		return trafficFile
+	}
+	return trafficAPI
+}
+
+// meterHTTP counts the request and response bodies of h as kind traffic on
+// endpoint. Connections hijacked for an upgrade, as proxied WebSockets are,
+// are counted as they are read and written.
+func meterHTTP(endpoint, kind string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mw := &meteredWriter{ResponseWriter: w, endpoint: endpoint, kind: kind}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &meteredBody{ReadCloser: r.Body, endpoint: endpoint, kind: kind}
+		}
+		h(mw, r)
+	}
+}
+
+type meteredBody struct {
+	io.ReadCloser
+	endpoint, kind string
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	meterTraffic(b.endpoint, b.kind, "in", n)
+	return n, err
+}
+
+type meteredWriter struct {
+	http.ResponseWriter
+	endpoint, kind string
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	meterTraffic(w.endpoint, w.kind, "out", n)
+	return n, err
+}
+
+// ReadFrom keeps the underlying writer's sendfile path for downloads.
+func (w *meteredWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, r)
+	meterTraffic(w.endpoint, w.kind, "out", int(n))
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *meteredWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack hands over the connection, still counted.
+func (w *meteredWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &meteredConn{Conn: conn, endpoint: w.endpoint, kind: w.kind}, brw, nil
+}
+
+type meteredConn struct {
+	net.Conn
+	endpoint, kind string
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	meterTraffic(c.endpoint, c.kind, "in", n)
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	meterTraffic(c.endpoint, c.kind, "out", n)
+	return n, err
+}
+
+// dropSessionTraffic forgets an ended session's counts, so the metric
+// doesn't grow with every session ever run.
+func dropSessionTraffic(id string) {
+	sessionTrafficBytes.drop("session", id)
+}
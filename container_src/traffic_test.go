@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTrafficMetrics(t *testing.T) {
+	req, _ := http.NewRequest("PUT", testURL+"/v1/files/traffic.txt", strings.NewReader(strings.Repeat("x", 1000)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := trafficBytes.get("endpoint", "PUT /v1/files/{path...}", "kind", trafficFile, "direction", "in"); got < 1000 {
+		t.Errorf("file upload traffic = %v, want at least 1000", got)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testURL, "http")+"/ws?control=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var id string
+	for id == "" {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m sessionMessage
+		if json.Unmarshal(data, &m) == nil && m.Type == "session" {
+			id = m.ID
+		}
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "resize", "cols": 100, "rows": 30}`))
+	conn.WriteMessage(websocket.TextMessage, []byte("echo traffic\n"))
+	for {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ == websocket.BinaryMessage && strings.Contains(string(data), "traffic\r\n") {
+			break
+		}
+	}
+	session := func(kind, dir string) float64 {
+		return sessionTrafficBytes.get("session", id, "kind", kind, "direction", dir)
+	}
+	if session(trafficTerminal, "in") != float64(len("echo traffic\n")) || session(trafficTerminal, "out") == 0 ||
+		session(trafficControl, "in") == 0 || session(trafficControl, "out") == 0 {
+		t.Errorf("session traffic: terminal %v in, %v out; control %v in, %v out",
+			session(trafficTerminal, "in"), session(trafficTerminal, "out"), session(trafficControl, "in"), session(trafficControl, "out"))
+	}
+	if trafficBytes.get("endpoint", "/ws", "kind", trafficTerminal, "direction", "out") < session(trafficTerminal, "out") {
+		t.Error("/ws terminal traffic is less than the session's")
+	}
+
+	// An ended session's counts are dropped.
+	sess := sessions.get(id)
+	conn.Close()
+	<-sess.done
+	if session(trafficTerminal, "out") != 0 {
+		t.Error("ended session's traffic still reported")
+	}
+}
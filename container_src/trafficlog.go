@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Modes for log_terminal_traffic. There is deliberately no raw mode: PTY
+// output is full of escape sequences that would redraw, retitle or
+// otherwise take over the terminal of whoever tails the log.
+const (
+	trafficLogOff      = ""
+	trafficLogEscaped  = "escaped"  // Go-quoted, with controls as \x1b, \r, ...
+	trafficLogStripped = "stripped" // plain text, escape sequences removed
+)
+
+func checkTrafficLogMode(mode string) error {
+	switch mode {
+	case trafficLogOff, trafficLogEscaped, trafficLogStripped:
+		return nil
+	}
+	return fmt.Errorf("log_terminal_traffic must be %q or %q, not %q", trafficLogEscaped, trafficLogStripped, mode)
+}
+
+// trafficLog logs one direction of a session's terminal data at debug
+// level, sanitized as log_terminal_traffic says.
+type trafficLog struct {
+	session, dir string
+
+	mu    sync.Mutex
+	strip ansiStripper // keeps sequences split across chunks out of the log
+}
+
+func (t *trafficLog) log(p []byte) {
+	cfg := currentConfig()
+	if cfg.TerminalTrafficLog == trafficLogOff || cfg.level > levelDebug || len(p) == 0 {
+		return
+	}
+	var text string
+	if cfg.TerminalTrafficLog == trafficLogStripped {
+		t.mu.Lock()
+		out := append(t.strip.strip(nil, p), t.strip.line...)
+		t.strip.line = t.strip.line[:0]
+		t.mu.Unlock()
+		if len(out) == 0 {
+			return
+		}
+		// Still quoted, so line breaks can't fake log entries.
+		text = strconv.Quote(string(redact(out)))
+	} else {
+		text = strconv.Quote(string(redact(p)))
+	}
+	debugf("Session %s %s (%d bytes): %s", t.session, t.dir, len(p), text)
+}
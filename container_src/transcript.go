@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+const (
+	// transcriptLimit bounds the plain-text transcript kept per session.
+	transcriptLimit = 1 << 20
+	// maxStripLine forces out a line that never ends, e.g. a progress bar
+	// redrawn with carriage returns.
+	maxStripLine = 16 * 1024
+)
+
+// transcript is a session's output as plain text, for attaching to tickets
+// without escape-code noise.
+type transcript struct {
+	mu    sync.Mutex
+	log   *outputLog
+	strip ansiStripper
+	buf   []byte
+}
+
+func newTranscript() *transcript {
+	return &transcript{log: newOutputLog(transcriptLimit)}
+}
+
+func (t *transcript) write(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = t.strip.strip(t.buf[:0], p)
+	t.log.append(redact(t.buf))
+}
+
+// WriteTo writes the retained transcript, including the line in progress.
+func (t *transcript) WriteTo(w io.Writer) (int64, error) {
+	t.mu.Lock()
+	line := redact(append([]byte(nil), t.strip.line...))
+	t.mu.Unlock()
+	var total int64
+	for off := int64(0); ; {
+		data, next, _ := t.log.read(off, maxOutputFrame)
+		if len(data) == 0 {
+			break
+		}
+		n, err := w.Write(data)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+		off = next
+	}
+	n, err := w.Write(line)
+	return total + int64(n), err
+}
+
+// ansiStripper turns a terminal byte stream into plain text by dropping
+// escape sequences (CSI, OSC, DCS and friends) and control characters, and
+// applying backspaces and CRLF line endings. State carries across writes, so
+// sequences split between PTY reads are still removed, and the current line
+// is held back until it ends so backspaces can edit it.
+type ansiStripper struct {
+	state stripState
+	line  []byte
+}
+
+type stripState uint8
+
+const (
+	stripGround    stripState = iota
+	stripEsc                  // after ESC
+	stripEscInter             // ESC followed by intermediates, e.g. ESC ( B
+	stripCSI                  // ESC [ ... final
+	stripString               // OSC/DCS/SOS/PM/APC body until BEL or ST
+	stripStringEsc            // ESC inside a string, maybe ST
+)
+
+// strip appends the lines of plain text completed by p to dst.
+func (a *ansiStripper) strip(dst, p []byte) []byte {
+	for _, c := range p {
+		switch a.state {
+		case stripGround:
+			switch {
+			case c == 0x1b:
+				a.state = stripEsc
+			case c == '\n' || len(a.line) >= maxStripLine:
+				dst = append(append(dst, a.line...), '\n')
+				a.line = a.line[:0]
+			case c == '\b':
+				// Step back over a whole UTF-8 character.
+				i := len(a.line) - 1
+				for i > 0 && a.line[i]&0xc0 == 0x80 {
+					i--
+				}
+				a.line = a.line[:max(i, 0)]
+			case c == '\t' || (c >= 0x20 && c != 0x7f):
+				a.line = append(a.line, c)
+			default:
+				// Other controls, including the CR of CRLF.
+			}
+		case stripEsc:
+			switch {
+			case c == '[':
+				a.state = stripCSI
+			case c == ']' || c == 'P' || c == 'X' || c == '^' || c == '_':
+				a.state = stripString
+			case c >= 0x20 && c <= 0x2f:
+				a.state = stripEscInter
+			default:
+				a.state = stripGround
+			}
+		case stripEscInter:
+			if c < 0x20 || c > 0x2f {
+				a.state = stripGround
+			}
+		case stripCSI:
+			if c >= 0x40 && c <= 0x7e {
+				a.state = stripGround
+			}
+		case stripString:
+			switch c {
+			case 0x07:
+				a.state = stripGround
+			case 0x1b:
+				a.state = stripStringEsc
+			}
+		case stripStringEsc:
+			if c == '\\' {
+				a.state = stripGround
+			} else {
+				a.state = stripString
+			}
+		}
+	}
+	return dst
+}
+
+// handleSessionTranscript returns the retained plain-text transcript of a
+// session: GET /v1/sessions/{id}/transcript.
+func handleSessionTranscript(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFromPath(w, r)
+	if sess == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.URL.Query().Get("download") != "" {
+		w.Header().Set("Content-Disposition", `attachment; filename="session-`+sess.id+`.txt"`)
+	}
+	sess.transcript.WriteTo(w)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// trashDirName is the directory under /data that deleted files are
+	// moved to. Each deletion gets a subdirectory holding the deleted file
+	// or tree as "item" and its entry.json.
+	trashDirName = ".trash"
+	// trashPurgeInterval is how often expired deletions are purged.
+	trashPurgeInterval = time.Hour
+)
+
+var trashPurged = newCounter("dos3_trash_purged_total",
+	"Deletions removed from the trash for good, by reason (expired or purged).")
+
+// trashEntry is a deletion kept in the trash.
+type trashEntry struct {
+	ID string `json:"id"`
+	// Path is where the file was, relative to /data.
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	Deleted time.Time `json:"deleted"`
+	// Expires is when it will be purged; absent if trash_retention is 0.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type trashList struct {
+	Entries []trashEntry `json:"entries"`
+}
+
+// trashMu serializes moves in and out of the trash with purging, so a
+// restore can't race the purger for the same entry.
+var trashMu sync.Mutex
+
+func trashDir() string { return filepath.Join(dataDir, trashDirName) }
+
+// inTrash reports whether full is the trash or inside it.
+func inTrash(full string) bool {
+	return full == trashDir() || strings.HasPrefix(full, trashDir()+string(filepath.Separator))
+}
+
+// trashPath deletes full by moving it to the trash, where it is kept for
+// trash_retention. Deleting from the trash itself removes for good. A
+// directory needs recursive unless it is empty.
+func trashPath(full string, recursive bool) error {
+	fi, err := os.Lstat(full)
+	if err != nil {
+		return err
+	}
+	if inTrash(full) {
+		return removeDirect(full, recursive)
+	}
+	if fi.IsDir() && !recursive {
+		if entries, err := os.ReadDir(full); err != nil {
+			return err
+		} else if len(entries) > 0 {
+			return fmt.Errorf("%s: directory not empty", relPath(full))
+		}
+	}
+	return moveToTrash(full, full, fi)
+}
+
+// moveToTrash moves cur into a new trash entry for a deletion of orig; they
+// differ for a batch's deletions, which are staged elsewhere first.
+func moveToTrash(cur, orig string, fi fs.FileInfo) error {
+	size := fi.Size()
+	if fi.IsDir() {
+		size = treeSize(cur)
+	}
+	trashMu.Lock()
+	defer trashMu.Unlock()
+	e := trashEntry{ID: newTimeID(), Path: relPath(orig), IsDir: fi.IsDir(), Size: size, Deleted: time.Now().UTC()}
+	dir := filepath.Join(trashDir(), e.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "entry.json"), data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(cur, filepath.Join(dir, "item"))
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	debugf("Moved %s to the trash as %s", e.Path, e.ID)
+	return nil
+}
+
+// newTimeID makes an ID, for a deletion or a job, such that IDs sort by
+// time.
+func newTimeID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+func treeSize(root string) int64 {
+	var n int64
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				n += fi.Size()
+			}
+		}
+		return nil
+	})
+	return n
+}
+
+// readTrash returns the trash's entries, oldest first.
+func readTrash() ([]trashEntry, error) {
+	dirs, err := os.ReadDir(trashDir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	retention := currentConfig().TrashRetention.Duration
+	var entries []trashEntry
+	for _, d := range dirs {
+		e, err := readTrashEntry(d.Name())
+		if err != nil {
+			warnf("Skipping trash entry %s: %v", d.Name(), err)
+			continue
+		}
+		if retention > 0 {
+			exp := e.Deleted.Add(retention)
+			e.Expires = &exp
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
+
+func readTrashEntry(id string) (trashEntry, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return trashEntry{}, fmt.Errorf("trash entry %q: %w", id, fs.ErrNotExist)
+	}
+	data, err := os.ReadFile(filepath.Join(trashDir(), id, "entry.json"))
+	if err != nil {
+		return trashEntry{}, fmt.Errorf("trash entry %s: %w", id, err)
+	}
+	var e trashEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return trashEntry{}, err
+	}
+	return e, nil
+}
+
+// restoreTrash moves an entry back to where it was deleted from, or to
+// to if it isn't empty. It won't overwrite anything there.
+func restoreTrash(id, to string) (fileInfo, error) {
+	trashMu.Lock()
+	defer trashMu.Unlock()
+	e, err := readTrashEntry(id)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	if to == "" {
+		to = e.Path
+	}
+	full, err := resolvePath(to)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	if full == dataDir || inTrash(full) {
+		return fileInfo{}, fmt.Errorf("%w: cannot restore to %s", errOutsideData, to)
+	}
+	if err := mustNotExist(full); err != nil {
+		return fileInfo{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return fileInfo{}, err
+	}
+	if err := os.Rename(filepath.Join(trashDir(), id, "item"), full); err != nil {
+		return fileInfo{}, err
+	}
+	if err := os.RemoveAll(filepath.Join(trashDir(), id)); err != nil {
+		warnf("Removing restored trash entry %s: %v", id, err)
+	}
+	infof("Restored %s from the trash to %s", e.Path, relPath(full))
+	return statPath(relPath(full))
+}
+
+// purgeTrash removes an entry for good.
+func purgeTrash(id string) error {
+	trashMu.Lock()
+	defer trashMu.Unlock()
+	if _, err := readTrashEntry(id); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(trashDir(), id)); err != nil {
+		return err
+	}
+	trashPurged.add(1, "reason", "purged")
+	return nil
+}
+
+// purgeExpiredTrash removes entries older than trash_retention.
+func purgeExpiredTrash() {
+	entries, err := readTrash()
+	if err != nil {
+		warnf("Reading the trash: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if e.Expires == nil || now.Before(*e.Expires) {
+			continue
+		}
+		trashMu.Lock()
+		err := os.RemoveAll(filepath.Join(trashDir(), e.ID))
+		trashMu.Unlock()
+		if err != nil {
+			warnf("Purging %s from the trash: %v", e.Path, err)
+			continue
+		}
+		trashPurged.add(1, "reason", "expired")
+		debugf("Purged %s from the trash (deleted %s)", e.Path, e.Deleted.Format(time.RFC3339))
+	}
+}
+
+// purgeTrashForever purges expired deletions every trashPurgeInterval.
+func purgeTrashForever() {
+	for {
+		// A frozen workspace is left as it is until it thaws.
+		if !workspaceFreeze.frozen() {
+			purgeExpiredTrash()
+		}
+		time.Sleep(trashPurgeInterval)
+	}
+}
+
+func handleListTrash(w http.ResponseWriter, r *http.Request) {
+	entries, err := fsCall(r.Context(), readTrash)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if entries == nil {
+		entries = []trashEntry{}
+	}
+	writeJSONETag(w, r, trashList{Entries: entries})
+}
+
+// handleRestoreTrash moves a deletion back: POST /v1/trash/{id}/restore,
+// with ?to= for a different path.
+func handleRestoreTrash(w http.ResponseWriter, r *http.Request) {
+	fi, err := fsCall(r.Context(), func() (fileInfo, error) {
+		return restoreTrash(r.PathValue("id"), r.URL.Query().Get("to"))
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, fi)
+}
+
+func handlePurgeTrash(w http.ResponseWriter, r *http.Request) {
+	_, err := fsCall(r.Context(), func() (struct{}, error) {
+		return struct{}{}, purgeTrash(r.PathValue("id"))
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"server/container_src/client"
+)
+
+func TestTrash(t *testing.T) {
+	c := dialTest(t)
+	ctx := context.Background()
+	list := func() []trashEntry {
+		t.Helper()
+		resp, err := http.Get(testURL + "/v1/trash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var l trashList
+		if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+			t.Fatal(err)
+		}
+		var mine []trashEntry
+		for _, e := range l.Entries {
+			if e.Path == "trashed" || strings.HasPrefix(e.Path, "trashed/") {
+				mine = append(mine, e)
+			}
+		}
+		return mine
+	}
+	post := func(path string) *http.Response {
+		t.Helper()
+		resp, err := http.Post(testURL+path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if _, err := c.Upload(ctx, "trashed/a.txt", strings.NewReader("keep me\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Remove(ctx, "trashed/a.txt", false); err != nil {
+		t.Fatal(err)
+	}
+	entries := list()
+	if len(entries) != 1 || entries[0].Path != "trashed/a.txt" || entries[0].Size != 8 || entries[0].Expires == nil {
+		t.Fatalf("trash after Remove = %+v", entries)
+	}
+	if resp := post("/v1/trash/" + entries[0].ID + "/restore"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("restore: %s", resp.Status)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dataDir, "trashed", "a.txt")); string(data) != "keep me\n" {
+		t.Fatalf("restored file has %q", data)
+	}
+	if len(list()) != 0 {
+		t.Fatal("restored file still in the trash")
+	}
+
+	// Batch deletions end up in the trash too, once the batch succeeds.
+	if _, ok, err := c.Batch(ctx, []client.FileOp{{Op: "delete", Path: "trashed", Recursive: true}}, false); err != nil || !ok {
+		t.Fatalf("Batch delete: %v, %v", ok, err)
+	}
+	entries = list()
+	if len(entries) != 1 || entries[0].Path != "trashed" || !entries[0].IsDir {
+		t.Fatalf("trash after batch delete = %+v", entries)
+	}
+	// Restoring never overwrites.
+	os.MkdirAll(filepath.Join(dataDir, "trashed"), 0755)
+	if resp := post("/v1/trash/" + entries[0].ID + "/restore"); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("restore over an existing directory: %s, want 409", resp.Status)
+	}
+	if resp := post("/v1/trash/" + entries[0].ID + "/restore?to=trashed/again"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("restore elsewhere: %s", resp.Status)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "trashed", "again", "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := *currentConfig()
+	cfg.TrashRetention = duration{time.Nanosecond}
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	if err := c.Remove(ctx, "trashed", true); err != nil {
+		t.Fatal(err)
+	}
+	purgeExpiredTrash()
+	if entries := list(); len(entries) != 0 {
+		t.Fatalf("trash after purging expired entries = %+v", entries)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// A binary upgrade replaces the running server with a new binary without
+// dropping the shells. The server execs the new binary in place: it keeps
+// the pid, so shells and tigrisfs stay its children, and every descriptor
+// without close-on-exec. The listening sockets, the PTY masters and
+// tigrisfs's log pipes are duplicated into such descriptors, and the rest of
+// the state goes in a file named by handoverEnv. Client connections are cut
+// and reconnect to the same sessions; the listeners never close, so no new
+// connection is refused meanwhile.
+
+// handoverEnv names the file an upgraded server restores its state from.
+const handoverEnv = "DOS3_HANDOVER"
+
+// handoverDrain is how long requests in flight get to finish before the
+// upgrade goes ahead.
+const handoverDrain = 10 * time.Second
+
+// handoverReclaim is how long a session resumed after an upgrade waits for
+// a client to attach to it again before it is closed, as losing its
+// connection would have closed it otherwise.
+const handoverReclaim = 2 * time.Minute
+
+// handingOver is set once an upgrade has started; new sessions are refused
+// and session pumps stop instead of tearing their sessions down.
+var handingOver atomic.Bool
+
+var errUpgrading = errors.New("server is upgrading")
+
+type handoverState struct {
+	// Listeners maps listen's names to descriptors.
+	Listeners map[string]int    `json:"listeners"`
+	Sessions  []handoverSession `json:"sessions"`
+	// MountPid is tigrisfs's pid, when mounted, and MountLogs its stdout
+	// and stderr.
+	MountPid  int    `json:"mount_pid,omitempty"`
+	MountLogs []int  `json:"mount_logs,omitempty"`
+	Degraded  string `json:"degraded,omitempty"`
+	// Frozen is the workspace's freeze, if it is frozen.
+	Frozen *freezeStatus `json:"frozen,omitempty"`
+}
+
+type handoverSession struct {
+	ID      string        `json:"id"`
+	User    string        `json:"user,omitempty"`
+	Created time.Time     `json:"created"`
+	Meta    sessionMeta   `json:"meta"`
+	Modes   terminalModes `json:"modes"`
+	Prompt  *promptState  `json:"prompt,omitempty"`
+	// History is the session's command history, and CommandStarted when
+	// the command running, if one is, started.
+	History        []commandRecord `json:"history,omitempty"`
+	CommandStarted time.Time       `json:"command_started,omitempty"`
+	// Injections is its audit trail of injected input.
+	Injections []injectionRecord `json:"injections,omitempty"`
+	Cols       int               `json:"cols"`
+	Rows       int               `json:"rows"`
+	Pid        int               `json:"pid"`
+	PTY        int               `json:"pty"`
+	Output     logSnapshot       `json:"output"`
+	Transcript logSnapshot       `json:"transcript"`
+	// InputSeqs are the session's input sequences (see inputDedup).
+	InputSeqs map[string]inputSeq `json:"input_seqs,omitempty"`
+	// InputPolicy is its input policy; who had control isn't kept, as the
+	// connections don't survive the upgrade.
+	InputPolicy string `json:"input_policy,omitempty"`
+	// Recording is the session's asciicast, if recorded, continued by the
+	// new server.
+	Recording      string    `json:"recording,omitempty"`
+	RecordingStart time.Time `json:"recording_start,omitzero"`
+}
+
+// inherited is the state handed over by the server this one upgraded, or
+// empty.
+var inherited handoverState
+
+// loadHandover reads the state left by the previous server, if this one
+// was started by an upgrade.
+func loadHandover() {
+	path := os.Getenv(handoverEnv)
+	if path == "" {
+		return
+	}
+	os.Unsetenv(handoverEnv)
+	data, err := os.ReadFile(path)
+	os.Remove(path)
+	if err == nil {
+		err = json.Unmarshal(data, &inherited)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read upgrade state: %v", err)
+	}
+	infof("Upgraded in place: resuming %d session(s)", len(inherited.Sessions))
+}
+
+var listeners struct {
+	mu sync.Mutex
+	m  map[string]net.Listener
+}
+
+// listen listens on addr, or takes over the listener the previous server
+// had under name. Listeners are kept for the next upgrade.
+func listen(name, addr string) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if fd, ok := inherited.Listeners[name]; ok {
+		f := os.NewFile(uintptr(fd), name)
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	listeners.mu.Lock()
+	if listeners.m == nil {
+		listeners.m = make(map[string]net.Listener)
+	}
+	listeners.m[name] = ln
+	listeners.mu.Unlock()
+	return ln, nil
+}
+
+// inheritable duplicates c's descriptor into one that survives exec.
+func inheritable(c syscall.Conn) (int, error) {
+	sc, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	fd := -1
+	var dupErr error
+	if err := sc.Control(func(f uintptr) {
+		// Unlike F_DUPFD_CLOEXEC and os.File.Fd, dup leaves close-on-exec
+		// and the blocking mode as they are.
+		fd, dupErr = syscall.Dup(int(f))
+	}); err != nil {
+		return 0, err
+	}
+	return fd, dupErr
+}
+
+// checkUpgradeBinary makes sure path can be exec'd, before anything is
+// torn down.
+func checkUpgradeBinary(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() || fi.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not an executable file", path)
+	}
+	return nil
+}
+
+// upgradeBinary is the binary an upgrade runs by default: the server's own
+// path, which an image update or self-update replaces.
+func upgradeBinary() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return os.Args[0]
+	}
+	return exe
+}
+
+// upgrades carries upgrade requests to main, which owns the servers.
+var upgrades = make(chan string, 1)
+
+// handleUpgrade starts a binary upgrade: POST /debug/upgrade, with
+// ?binary=path to switch to a different binary than the running one.
+func handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	binary := r.URL.Query().Get("binary")
+	if binary == "" {
+		binary = upgradeBinary()
+	}
+	if err := checkUpgradeBinary(binary); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case upgrades <- binary:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		httpError(w, r, "an upgrade is already in progress", http.StatusConflict)
+	}
+}
+
+// upgrade hands the server's state over to binary and execs it, returning
+// only if that isn't possible. Past the point where connections are cut, a
+// failure is fatal.
+func upgrade(binary string, server *http.Server, grpcServer *grpc.Server) error {
+	if err := checkUpgradeBinary(binary); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "do-s3-handover-*.json")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	state := handoverState{Listeners: make(map[string]int), Degraded: degraded.status()}
+	if frozen := workspaceFreeze.current(); frozen.Frozen {
+		state.Frozen = &frozen
+	}
+	listeners.mu.Lock()
+	for name, ln := range listeners.m {
+		fd, err := inheritable(ln.(syscall.Conn))
+		if err != nil {
+			listeners.mu.Unlock()
+			return fmt.Errorf("handing over %s listener: %w", name, err)
+		}
+		state.Listeners[name] = fd
+	}
+	listeners.mu.Unlock()
+	if pid := mountPid.Load(); pid != 0 && mountReady.Load() {
+		state.MountPid = int(pid)
+		for _, f := range mountLogs {
+			fd, err := inheritable(f)
+			if err != nil {
+				return fmt.Errorf("handing over tigrisfs output: %w", err)
+			}
+			state.MountLogs = append(state.MountLogs, fd)
+		}
+	}
+
+	infof("Upgrading to %s: draining requests", binary)
+	handingOver.Store(true)
+	shutdownNotices.announce(newShutdownNotice(shutdownUpgrade, "the server is upgrading"))
+	ctx, cancel := context.WithTimeout(context.Background(), handoverDrain)
+	defer cancel()
+	// Shutdown closes the listeners, but the descriptors handed over keep
+	// the sockets, and their backlogs, open.
+	if err := server.Shutdown(ctx); err != nil {
+		warnf("Upgrade: %v; cutting remaining requests", err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		grpcServer.Stop()
+	}
+	ide.shutdown()
+	services.shutdown()
+
+	state.Sessions = sessions.park()
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = os.WriteFile(f.Name(), data, 0600)
+	}
+	if err != nil {
+		log.Fatalf("Upgrade failed writing its state: %v", err)
+	}
+
+	infof("Upgrading to %s with %d session(s)", binary, len(state.Sessions))
+	env := append(os.Environ(), handoverEnv+"="+f.Name())
+	err = syscall.Exec(binary, append([]string{binary}, os.Args[1:]...), env)
+	log.Fatalf("Upgrade failed to exec %s: %v", binary, err)
+	return nil
+}
+
+// park stops every session's pump and describes the sessions for the new
+// server. Sessions still starting or already closing are left out; their
+// shells go with this server.
+func (m *sessionManager) park() []handoverSession {
+	var out []handoverSession
+	for _, s := range m.list() {
+		if s.isClosed() || s.ptmx == nil {
+			continue
+		}
+		// The pump sees the deadline as the end of its reads and, with
+		// handingOver set, returns without tearing the session down.
+		s.ptmx.SetReadDeadline(time.Now())
+		select {
+		case <-s.parked:
+		case <-s.done:
+			continue
+		}
+		fd, err := inheritable(s.ptmx)
+		if err != nil {
+			warnf("Upgrade: session %s can't be handed over: %v", s.id, err)
+			continue
+		}
+		// Suspended sessions go over running; the new server suspends them
+		// again if they stay idle.
+		s.mu.Lock()
+		s.resumeLocked()
+		s.mu.Unlock()
+		cols, rows := s.size()
+		prompt, _ := s.promptStatus()
+		hs := handoverSession{
+			ID:          s.id,
+			User:        s.user,
+			Created:     s.created,
+			Meta:        s.metadata(),
+			Modes:       s.terminalModes(),
+			Prompt:      prompt,
+			History:     s.commandHistory(),
+			Injections:  s.injectionTrail(),
+			Cols:        cols,
+			Rows:        rows,
+			Pid:         s.cmd.Process.Pid,
+			PTY:         fd,
+			Output:      s.output.snapshot(),
+			Transcript:  s.transcript.log.snapshot(),
+			InputSeqs:   s.dedup.snapshot(),
+			InputPolicy: s.floor.currentPolicy(),
+			// The pump is parked, so its scanner can be read.
+			CommandStarted: s.promptScan.started,
+		}
+		if s.rec != nil {
+			if err := s.rec.flush(); err != nil {
+				warnf("Upgrade: session %s recording: %v", s.id, err)
+			} else {
+				hs.Recording, hs.RecordingStart = s.rec.path, s.rec.start
+			}
+		}
+		out = append(out, hs)
+	}
+	return out
+}
+
+// resume restarts the sessions handed over by the previous server.
+func (m *sessionManager) resume(list []handoverSession) {
+	for _, hs := range list {
+		p, err := os.FindProcess(hs.Pid)
+		ptmx := os.NewFile(uintptr(hs.PTY), "/dev/ptmx")
+		if err != nil {
+			warnf("Session %s lost in upgrade: %v", hs.ID, err)
+			ptmx.Close()
+			continue
+		}
+		s := &session{
+			id:         hs.ID,
+			user:       hs.User,
+			cmd:        &exec.Cmd{Path: getShell(), Process: p},
+			ptmx:       ptmx,
+			created:    hs.Created,
+			output:     restoreOutputLog(scrollbackLimit, hs.Output),
+			transcript: newTranscript(),
+			done:       make(chan struct{}),
+			parked:     make(chan struct{}),
+			meta:       hs.Meta,
+			modes:      hs.Modes,
+			prompt:     hs.Prompt,
+			history:    hs.History,
+			injections: hs.Injections,
+			cols:       hs.Cols,
+			rows:       hs.Rows,
+		}
+		s.transcript.log = restoreOutputLog(transcriptLimit, hs.Transcript)
+		s.dedup.restore(hs.InputSeqs)
+		if hs.InputPolicy != "" {
+			s.floor.setPolicy(hs.InputPolicy)
+		}
+		s.modeScan.modes = hs.Modes
+		if hs.Prompt != nil {
+			s.promptScan.state, s.promptScan.known = *hs.Prompt, true
+			s.promptScan.started = hs.CommandStarted
+		}
+		s.inputLog = trafficLog{session: s.id, dir: "input"}
+		s.outputLog = trafficLog{session: s.id, dir: "output"}
+		if hs.Recording != "" {
+			if s.rec, err = reopenRecorder(hs.Recording, hs.RecordingStart); err != nil {
+				warnf("Session %s: recording not continued after upgrade: %v", s.id, err)
+			}
+		}
+		s.awaitReclaim()
+		m.mu.Lock()
+		m.sessions[s.id] = s
+		m.mu.Unlock()
+		go s.pump(m)
+		s.notice("The server was upgraded; this session carried on.")
+	}
+}
+
+// awaitReclaim keeps s for its client to reclaim, closing it if none has
+// within handoverReclaim.
+func (s *session) awaitReclaim() {
+	claim := s.claims.Add(1)
+	s.unclaimed.Store(true)
+	time.AfterFunc(handoverReclaim, func() {
+		if s.unclaimed.Load() && s.claims.Load() == claim {
+			infof("Session %s not reclaimed, closing it", s.id)
+			s.close()
+		}
+	})
+}
+
+// reclaim hands a session resumed after an upgrade, or left by a dropped
+// resumable connection, to the client that started it, reconnecting over
+// /ws with ?session= as the same user. A resumable connection still
+// attached is taken over, as it is likely the one the client lost without
+// the server noticing yet. It returns nil unless the session is waiting
+// for its client.
+func (m *sessionManager) reclaim(id, user string) *session {
+	s := m.get(id)
+	if s == nil || s.user != user {
+		return nil
+	}
+	if !s.unclaimed.CompareAndSwap(true, false) && !s.takeOverStream() {
+		return nil
+	}
+	return s
+}
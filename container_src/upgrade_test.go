@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"server/container_src/client"
+	"server/container_src/internal/termtest"
+)
+
+// TestSessionHandover parks a session as an upgrade would and resumes it in
+// the same process; exec in between only swaps the binary.
+func TestSessionHandover(t *testing.T) {
+	c := dialTest(t)
+	term := termtest.Open(t, c, client.SessionOptions{Name: "handover"})
+	term.Send("X=kept; echo mark$((1+1))\n")
+	term.Expect(`mark2`)
+	list, err := c.Sessions(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	for _, s := range list {
+		if s.Name == "handover" {
+			id = s.ID
+		}
+	}
+
+	handingOver.Store(true)
+	parked := sessions.park()
+	handingOver.Store(false)
+	if len(parked) != 1 || parked[0].ID != id {
+		t.Fatalf("park = %+v, want session %s", parked, id)
+	}
+	sessions.resume(parked)
+
+	again := termtest.Open(t, c, client.SessionOptions{Reclaim: id})
+	again.Expect(`mark2`)
+	again.Expect(`upgraded`)
+	again.Send("echo X=$X\n")
+	again.Expect(`X=kept`)
+	if _, err := c.OpenSession(context.Background(), client.SessionOptions{Reclaim: id}); !isStatus(err, http.StatusNotFound) {
+		t.Fatalf("second reclaim = %v, want 404", err)
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"server/container_src/internal/s3client"
+)
+
+const (
+	// multipartPartSize is the part size of uploads the server splits
+	// itself, and the one suggested to clients.
+	multipartPartSize = 16 << 20
+	// multipartConcurrency is how many parts of one upload are sent at
+	// once; it bounds the memory an upload buffers.
+	multipartConcurrency = 4
+	// maxUploadPart caps a part sent to /v1/uploads, which is spooled to
+	// local disk before it is signed and sent on.
+	maxUploadPart = 512 << 20
+	// uploadPartAttempts is how many times a part is tried against the
+	// bucket before the upload fails.
+	uploadPartAttempts = 3
+	// uploadIdleTimeout is how long an upload started through /v1/uploads
+	// may go untouched before it is aborted.
+	uploadIdleTimeout = 24 * time.Hour
+)
+
+var (
+	errInvalidUpload = errors.New("invalid upload")
+	// errUploadOffset is a chunk sent for an offset other than where the
+	// upload is; the response's Upload-Offset says where that is.
+	errUploadOffset = errors.New("upload offset mismatch")
+)
+
+var directUploadBytes = newCounter("dos3_direct_upload_bytes_total",
+	"Bytes uploaded straight to the bucket, bypassing the mount.")
+
+// Writing a large file through FUSE makes tigrisfs buffer and re-upload it,
+// slowly enough that uploads of several gigabytes time out. Uploads bigger
+// than multipart_threshold therefore go to the bucket as S3 multipart
+// uploads, in parallel parts: PUT /v1/files splits the body itself, and
+// /v1/uploads lets a client send the parts, in parallel and retrying the
+// ones that fail, and complete the upload when it has them all. A browser
+// on a flaky connection can instead PATCH the file in chunks, in order, at
+// the offset the upload has reached, as in the tus protocol: the server
+// cuts them into parts itself. Either way tigrisfs learns of the file the
+// next time it looks the path up, which the server does once the upload
+// completes.
+
+// uploadRequest starts an upload: POST /v1/uploads {"path": "big.tar"}.
+type uploadRequest struct {
+	Path string `json:"path"`
+}
+
+// uploadInfo is an upload in progress through /v1/uploads.
+type uploadInfo struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// PartSize is the suggested size of each part but the last; any size
+	// up to 512 MiB is accepted.
+	PartSize int64 `json:"part_size"`
+	// Parts are those uploaded so far, by number, for resuming.
+	Parts []uploadedPart `json:"parts"`
+	// Offset is how many bytes have been received in PATCHed chunks, where
+	// the next chunk starts.
+	Offset  int64     `json:"offset,omitempty"`
+	Started time.Time `json:"started"`
+}
+
+type uploadedPart struct {
+	Part int    `json:"part"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
+
+type uploadList struct {
+	Uploads []uploadInfo `json:"uploads"`
+}
+
+// multipartUpload is an upload's state; parts are kept here rather than
+// asked of the bucket, whose ListParts the S3 Durable Object may not have.
+type multipartUpload struct {
+	id, key, s3ID string
+	started       time.Time
+
+	mu       sync.Mutex
+	parts    map[int]uploadedPart
+	lastUsed time.Time
+	offset   int64 // bytes received in chunks
+
+	// chunkMu is held while a chunk is received or the last of them sent
+	// on. tail spools what has been received past the last whole part.
+	chunkMu  sync.Mutex
+	tail     *os.File
+	tailSize int64
+}
+
+var uploads = struct {
+	mu sync.Mutex
+	m  map[string]*multipartUpload
+}{m: make(map[string]*multipartUpload)}
+
+func (u *multipartUpload) info() uploadInfo {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	info := uploadInfo{ID: u.id, Path: u.key, PartSize: multipartPartSize, Parts: []uploadedPart{}, Offset: u.offset, Started: u.started}
+	for _, p := range u.parts {
+		info.Parts = append(info.Parts, p)
+	}
+	sort.Slice(info.Parts, func(i, j int) bool { return info.Parts[i].Part < info.Parts[j].Part })
+	return info
+}
+
+// useDirectUpload reports whether a PUT /v1/files body should bypass the
+// mount. Queued writes keep their order through the journal, and an
+// explicit mode needs the mount to set it.
+func useDirectUpload(r *http.Request) bool {
+	threshold := currentConfig().MultipartThreshold
+	return threshold > 0 && r.ContentLength > threshold && !r.URL.Query().Has("mode") &&
+		bucketStore.Load() != nil && !writes.pending()
+}
+
+// checkUploadTarget resolves p to its bucket key, refusing a directory.
+func checkUploadTarget(p string) (string, error) {
+	key, err := bucketKey(p)
+	if err != nil {
+		return "", err
+	}
+	if fi, err := statPath(p); err == nil && fi.IsDir {
+		return "", fmt.Errorf("%w: %s", errIsDir, key)
+	}
+	return key, nil
+}
+
+// putDirect uploads r to the file at p as a multipart upload, splitting it
+// into parts itself. The upload is completed through commit.
+func putDirect(ctx context.Context, p string, r io.Reader, commit commitFunc) (fileInfo, error) {
+	store := bucketStore.Load()
+	if store == nil {
+		return fileInfo{}, errNoBucket
+	}
+	key, err := checkUploadTarget(p)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	s3ID, err := store.CreateMultipartUpload(ctx, key, "")
+	if err != nil {
+		return fileInfo{}, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		parts []s3client.Part
+		errs  []error
+		size  int64
+		sem   = make(chan struct{}, multipartConcurrency)
+	)
+	for n := 1; ; n++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		buf := make([]byte, multipartPartSize)
+		k, rerr := io.ReadFull(r, buf)
+		if k == 0 && n > 1 {
+			<-sem
+			break
+		}
+		size += int64(k)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			etag, err := uploadPart(ctx, store, key, s3ID, n, bytes.NewReader(buf[:k]))
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("part %d: %w", n, err))
+				cancel()
+				return
+			}
+			parts = append(parts, s3client.Part{PartNumber: n, ETag: etag})
+		}()
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			mu.Lock()
+			errs = append(errs, rerr)
+			mu.Unlock()
+			cancel()
+			break
+		}
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		abortUpload(store, key, s3ID)
+		return fileInfo{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		abortUpload(store, key, s3ID)
+		return fileInfo{}, err
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	err = commit(func() error {
+		_, err := store.CompleteMultipartUpload(ctx, key, s3ID, parts)
+		return err
+	})
+	if err != nil {
+		abortUpload(store, key, s3ID)
+		return fileInfo{}, err
+	}
+	infof("Uploaded %s straight to the bucket (%d bytes in %d parts)", key, size, len(parts))
+	return uploadedFile(key, size), nil
+}
+
+// uploadPart sends one part, trying again if the bucket fails it.
+func uploadPart(ctx context.Context, store *s3client.Client, key, s3ID string, n int, body io.ReadSeeker) (string, error) {
+	var err error
+	for attempt := 1; attempt <= uploadPartAttempts; attempt++ {
+		if _, err = body.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		var etag string
+		etag, err = store.UploadPart(ctx, key, s3ID, n, body)
+		if err == nil {
+			size, _ := body.Seek(0, io.SeekEnd)
+			directUploadBytes.add(float64(size))
+			return etag, nil
+		}
+		if ctx.Err() != nil {
+			return "", err
+		}
+		debugf("Uploading part %d of %s (attempt %d): %v", n, key, attempt, err)
+		time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+	}
+	return "", err
+}
+
+// abortUpload discards an upload's parts in the bucket, which would
+// otherwise be kept, unseen, until the bucket's own cleanup.
+func abortUpload(store *s3client.Client, key, s3ID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := store.AbortMultipartUpload(ctx, key, s3ID); err != nil {
+		warnf("Aborting the upload of %s: %v", key, err)
+	}
+}
+
+// uploadedFile describes a file just uploaded to the bucket. Looking it up
+// through the mount makes tigrisfs notice it; if it hasn't yet, the
+// description comes from the upload.
+func uploadedFile(key string, size int64) fileInfo {
+	if fi, err := statPath(key); err == nil && fi.Size == size {
+		return fi
+	}
+	return fileInfo{Path: key, Name: path.Base(key), Size: size, Mode: 0644, ModTime: time.Now().UTC()}
+}
+
+// appendChunk adds body to the upload, sending each part on as it fills.
+// What was received is kept even if body fails part way, as when the
+// connection drops, so the client can carry on from the new offset.
+func (u *multipartUpload) appendChunk(ctx context.Context, store *s3client.Client, body io.Reader) error {
+	if u.tail == nil {
+		f, err := os.CreateTemp("", "dos3-upload-*")
+		if err != nil {
+			return err
+		}
+		u.tail = f
+	}
+	for {
+		// A part left whole by a failed send goes first.
+		if u.tailSize == multipartPartSize {
+			if err := u.sendTail(ctx, store); err != nil {
+				return err
+			}
+		}
+		room := multipartPartSize - u.tailSize
+		n, err := io.Copy(u.tail, io.LimitReader(body, room))
+		u.tailSize += n
+		u.mu.Lock()
+		u.offset += n
+		u.lastUsed = time.Now()
+		u.mu.Unlock()
+		if err != nil || n < room {
+			return err
+		}
+	}
+}
+
+// sendTail sends what is spooled in the tail as the next part.
+func (u *multipartUpload) sendTail(ctx context.Context, store *s3client.Client) error {
+	u.mu.Lock()
+	n := len(u.parts) + 1
+	u.mu.Unlock()
+	etag, err := uploadPart(ctx, store, u.key, u.s3ID, n, io.NewSectionReader(u.tail, 0, u.tailSize))
+	if err != nil {
+		return fmt.Errorf("part %d: %w", n, err)
+	}
+	u.mu.Lock()
+	u.parts[n] = uploadedPart{Part: n, Size: u.tailSize, ETag: etag}
+	u.mu.Unlock()
+	if err := u.tail.Truncate(0); err != nil {
+		return err
+	}
+	u.tailSize = 0
+	_, err = u.tail.Seek(0, io.SeekStart)
+	return err
+}
+
+// discardTail removes the upload's spooled chunks.
+func (u *multipartUpload) discardTail() {
+	u.chunkMu.Lock()
+	defer u.chunkMu.Unlock()
+	if u.tail != nil {
+		u.tail.Close()
+		os.Remove(u.tail.Name())
+		u.tail = nil
+	}
+}
+
+func newUploadID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func getUpload(id string) (*multipartUpload, error) {
+	uploads.mu.Lock()
+	defer uploads.mu.Unlock()
+	u := uploads.m[id]
+	if u == nil {
+		return nil, fmt.Errorf("upload %q: %w", id, fs.ErrNotExist)
+	}
+	return u, nil
+}
+
+// abortIdleUploads aborts uploads untouched for uploadIdleTimeout.
+func abortIdleUploads() {
+	uploads.mu.Lock()
+	var idle []*multipartUpload
+	for id, u := range uploads.m {
+		u.mu.Lock()
+		if time.Since(u.lastUsed) > uploadIdleTimeout {
+			idle = append(idle, u)
+			delete(uploads.m, id)
+		}
+		u.mu.Unlock()
+	}
+	uploads.mu.Unlock()
+	store := bucketStore.Load()
+	for _, u := range idle {
+		infof("Aborting upload %s of %s, idle since %s", u.id, u.key, u.lastUsed.Format(time.RFC3339))
+		u.discardTail()
+		if store != nil {
+			abortUpload(store, u.key, u.s3ID)
+		}
+	}
+}
+
+// abortIdleUploadsForever checks for idle uploads every hour.
+func abortIdleUploadsForever() {
+	for {
+		time.Sleep(time.Hour)
+		abortIdleUploads()
+	}
+}
+
+func handleListUploads(w http.ResponseWriter, r *http.Request) {
+	uploads.mu.Lock()
+	list := uploadList{Uploads: []uploadInfo{}}
+	for _, u := range uploads.m {
+		list.Uploads = append(list.Uploads, u.info())
+	}
+	uploads.mu.Unlock()
+	sort.Slice(list.Uploads, func(i, j int) bool { return list.Uploads[i].Started.Before(list.Uploads[j].Started) })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleStartUpload(w http.ResponseWriter, r *http.Request) {
+	var req uploadRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&req); err != nil {
+		httpError(w, r, "invalid upload request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	store := bucketStore.Load()
+	if store == nil {
+		writeError(w, r, errNoBucket)
+		return
+	}
+	key, err := fsCall(r.Context(), func() (string, error) { return checkUploadTarget(req.Path) })
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s3ID, err := store.CreateMultipartUpload(r.Context(), key, "")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	now := time.Now().UTC()
+	u := &multipartUpload{id: newUploadID(), key: key, s3ID: s3ID, started: now, parts: make(map[int]uploadedPart), lastUsed: now}
+	uploads.mu.Lock()
+	uploads.m[u.id] = u
+	uploads.mu.Unlock()
+	infof("Started upload %s of %s", u.id, key)
+	writeJSON(w, http.StatusCreated, u.info())
+}
+
+// handleGetUpload reports an upload, with its offset also in the
+// Upload-Offset header, so that a HEAD is enough to find where to resume.
+func handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	u, err := getUpload(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	info := u.info()
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handlePatchUpload receives the next chunk of an upload: PATCH
+// /v1/uploads/{id} with the Upload-Offset header saying where it starts,
+// which must be where the upload is. It answers with the new offset.
+func handlePatchUpload(w http.ResponseWriter, r *http.Request) {
+	u, err := getUpload(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	off, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || off < 0 {
+		writeError(w, r, fmt.Errorf("%w: Upload-Offset must be the offset the chunk starts at", errInvalidUpload))
+		return
+	}
+	store := bucketStore.Load()
+	if store == nil {
+		writeError(w, r, errNoBucket)
+		return
+	}
+	if !u.chunkMu.TryLock() {
+		writeError(w, r, fmt.Errorf("%w: upload %s is receiving another chunk", errUploadOffset, u.id))
+		return
+	}
+	defer u.chunkMu.Unlock()
+	info := u.info()
+	switch {
+	case info.Offset == 0 && len(info.Parts) > 0:
+		writeError(w, r, fmt.Errorf("%w: upload %s has parts sent by number", errInvalidUpload, u.id))
+		return
+	case off != info.Offset:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+		writeError(w, r, fmt.Errorf("%w: upload %s is at offset %d, not %d", errUploadOffset, u.id, info.Offset, off))
+		return
+	}
+	err = u.appendChunk(r.Context(), store, r.Body)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.info().Offset, 10))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUploadPart receives a part: PUT /v1/uploads/{id}/{part}, numbered
+// from 1. Sending a part again replaces it.
+func handleUploadPart(w http.ResponseWriter, r *http.Request) {
+	u, err := getUpload(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("part"))
+	if err != nil || n < 1 || n > 10000 {
+		writeError(w, r, fmt.Errorf("%w: part numbers run from 1 to 10000", errInvalidUpload))
+		return
+	}
+	if u.info().Offset > 0 {
+		writeError(w, r, fmt.Errorf("%w: upload %s is being sent in chunks", errInvalidUpload, u.id))
+		return
+	}
+	// The body is read twice, to sign and to send it, so it is spooled to
+	// local disk rather than held in memory.
+	spool, err := os.CreateTemp("", "dos3-part-*")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	size, err := io.Copy(spool, io.LimitReader(r.Body, maxUploadPart+1))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if size > maxUploadPart {
+		writeError(w, r, fmt.Errorf("%w: a part may be at most %d bytes", errFileTooLarge, maxUploadPart))
+		return
+	}
+	store := bucketStore.Load()
+	if store == nil {
+		writeError(w, r, errNoBucket)
+		return
+	}
+	etag, err := uploadPart(r.Context(), store, u.key, u.s3ID, n, spool)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	part := uploadedPart{Part: n, Size: size, ETag: etag}
+	u.mu.Lock()
+	u.parts[n] = part
+	u.lastUsed = time.Now()
+	u.mu.Unlock()
+	writeJSON(w, http.StatusOK, part)
+}
+
+// handleCompleteUpload assembles the parts, which must run from 1 without
+// gaps, into the file.
+func handleCompleteUpload(w http.ResponseWriter, r *http.Request) {
+	u, err := getUpload(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	store := bucketStore.Load()
+	if store == nil {
+		writeError(w, r, errNoBucket)
+		return
+	}
+	// The last chunks, short of a whole part, make the last part.
+	u.chunkMu.Lock()
+	if u.tail != nil && (u.tailSize > 0 || len(u.info().Parts) == 0) {
+		err = u.sendTail(r.Context(), store)
+	}
+	u.chunkMu.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	info := u.info()
+	var parts []s3client.Part
+	var size int64
+	for i, p := range info.Parts {
+		if p.Part != i+1 {
+			writeError(w, r, fmt.Errorf("%w: part %d is missing", errInvalidUpload, i+1))
+			return
+		}
+		parts = append(parts, s3client.Part{PartNumber: p.Part, ETag: p.ETag})
+		size += p.Size
+	}
+	if len(parts) == 0 {
+		writeError(w, r, fmt.Errorf("%w: no parts were uploaded", errInvalidUpload))
+		return
+	}
+	if _, err := store.CompleteMultipartUpload(r.Context(), u.key, u.s3ID, parts); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	uploads.mu.Lock()
+	delete(uploads.m, u.id)
+	uploads.mu.Unlock()
+	u.discardTail()
+	infof("Completed upload %s of %s (%d bytes in %d parts)", u.id, u.key, size, len(parts))
+	fi, _ := fsCall(r.Context(), func() (fileInfo, error) { return uploadedFile(u.key, size), nil })
+	writeJSON(w, http.StatusOK, fi)
+}
+
+func handleAbortUpload(w http.ResponseWriter, r *http.Request) {
+	u, err := getUpload(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	uploads.mu.Lock()
+	delete(uploads.m, u.id)
+	uploads.mu.Unlock()
+	u.discardTail()
+	if store := bucketStore.Load(); store != nil {
+		abortUpload(store, u.key, u.s3ID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
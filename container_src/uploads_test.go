@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"server/container_src/internal/s3test"
+)
+
+func TestDirectUpload(t *testing.T) {
+	t.Cleanup(func() { bucketStore.Store(nil) })
+	store := s3test.NewServer(t).Client(t, "s3-test")
+	ctx := context.Background()
+	if err := store.CreateBucket(ctx); err != nil {
+		t.Fatal(err)
+	}
+	bucketStore.Store(store)
+	cfg := *currentConfig()
+	cfg.MultipartThreshold = 1 << 20
+	prev := activeConfig.Swap(&cfg)
+	defer activeConfig.Store(prev)
+	object := func(key string) []byte {
+		t.Helper()
+		body, err := store.GetObject(ctx, key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer body.Close()
+		data, _ := io.ReadAll(body)
+		return data
+	}
+	do := func(method, path string, body io.Reader) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, testURL+path, body)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Above the threshold, the server splits the body into parts itself.
+	big := bytes.Repeat([]byte("0123456789abcdef"), (multipartPartSize+1<<20)/16)
+	resp := do("PUT", "/v1/files/direct/big.bin", bytes.NewReader(big))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("direct upload: %s", resp.Status)
+	}
+	if data := object("direct/big.bin"); !bytes.Equal(data, big) {
+		t.Fatalf("bucket has %d bytes, want %d", len(data), len(big))
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "direct")); err == nil {
+		t.Fatal("direct upload went through the mount")
+	}
+
+	// A client sends the parts, in any order, and completes once it has
+	// them all.
+	resp = do("POST", "/v1/uploads", strings.NewReader(`{"path": "direct/parts.txt"}`))
+	var up uploadInfo
+	json.NewDecoder(resp.Body).Decode(&up)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || up.ID == "" || up.PartSize != multipartPartSize {
+		t.Fatalf("start upload: %s, %+v", resp.Status, up)
+	}
+	base := "/v1/uploads/" + up.ID
+	do("PUT", base+"/2", strings.NewReader("world\n")).Body.Close()
+	resp = do("POST", base+"/complete", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("complete without part 1: %s, want 400", resp.Status)
+	}
+	resp = do("GET", base, nil)
+	json.NewDecoder(resp.Body).Decode(&up)
+	resp.Body.Close()
+	if len(up.Parts) != 1 || up.Parts[0].Part != 2 || up.Parts[0].Size != 6 {
+		t.Fatalf("parts = %+v, want part 2", up.Parts)
+	}
+	do("PUT", base+"/1", strings.NewReader("hello ")).Body.Close()
+	resp = do("POST", base+"/complete", nil)
+	var fi fileInfo
+	json.NewDecoder(resp.Body).Decode(&fi)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || fi.Path != "direct/parts.txt" || fi.Size != 12 {
+		t.Fatalf("complete: %s, %+v", resp.Status, fi)
+	}
+	if data := object("direct/parts.txt"); string(data) != "hello world\n" {
+		t.Fatalf("bucket has %q", data)
+	}
+	if resp = do("GET", base, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("completed upload: %s, want 404", resp.Status)
+	}
+	resp.Body.Close()
+
+	// Or it PATCHes chunks in order, which the server cuts into parts.
+	resp = do("POST", "/v1/uploads", strings.NewReader(`{"path": "direct/chunks.bin"}`))
+	json.NewDecoder(resp.Body).Decode(&up)
+	resp.Body.Close()
+	base = "/v1/uploads/" + up.ID
+	patch := func(off int, chunk []byte) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("PATCH", testURL+base, bytes.NewReader(chunk))
+		req.Header.Set("Upload-Offset", strconv.Itoa(off))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	split := 10 << 20
+	if resp := patch(0, big[:split]); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != strconv.Itoa(split) {
+		t.Fatalf("first chunk: %s, offset %s", resp.Status, resp.Header.Get("Upload-Offset"))
+	}
+	// A chunk resent after losing its response is refused, saying where
+	// to carry on from.
+	if resp := patch(0, big[:split]); resp.StatusCode != http.StatusConflict || resp.Header.Get("Upload-Offset") != strconv.Itoa(split) {
+		t.Fatalf("chunk at a stale offset: %s, offset %s", resp.Status, resp.Header.Get("Upload-Offset"))
+	}
+	if resp := patch(split, big[split:]); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("second chunk: %s", resp.Status)
+	}
+	resp = do("HEAD", base, nil)
+	resp.Body.Close()
+	if off := resp.Header.Get("Upload-Offset"); off != strconv.Itoa(len(big)) {
+		t.Fatalf("HEAD offset %s, want %d", off, len(big))
+	}
+	if resp = do("PUT", base+"/3", strings.NewReader("x")); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("numbered part of a chunked upload: %s", resp.Status)
+	}
+	resp.Body.Close()
+	resp = do("POST", base+"/complete", nil)
+	json.NewDecoder(resp.Body).Decode(&fi)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || fi.Size != int64(len(big)) {
+		t.Fatalf("complete chunked upload: %s, %+v", resp.Status, fi)
+	}
+	if data := object("direct/chunks.bin"); !bytes.Equal(data, big) {
+		t.Fatalf("bucket has %d bytes of the chunked upload, want %d", len(data), len(big))
+	}
+
+	c := dialTest(t)
+	if _, err := c.UploadParts(ctx, "direct/client.txt", strings.NewReader("from the client\n"), 16); err != nil {
+		t.Fatal(err)
+	}
+	if data := object("direct/client.txt"); string(data) != "from the client\n" {
+		t.Fatalf("bucket has %q", data)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"server/container_src/internal/s3client"
+)
+
+const (
+	// upstreamInterval is how often the S3 endpoint is probed.
+	upstreamInterval = 30 * time.Second
+	upstreamTimeout  = 10 * time.Second
+)
+
+var (
+	upstreamUp = newGauge("dos3_upstream_up",
+		"Whether the last probe of the S3 endpoint, apart from the mount, succeeded (1) or not (0).")
+	upstreamLatency = newGauge("dos3_upstream_latency_seconds",
+		"How long the last probe of the S3 endpoint took to answer.")
+)
+
+// upstreamProbe is how the S3 endpoint answered a HEAD of the bucket, made
+// directly rather than through the mount, so that an endpoint that can't
+// be reached can be told apart from tigrisfs failing.
+type upstreamProbe struct {
+	Checked  time.Time `json:"checked"`
+	Endpoint string    `json:"endpoint"`
+	OK       bool      `json:"ok"`
+	// Status is the HTTP status answered, 0 if there was no answer.
+	Status    int     `json:"status,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// lastUpstream is the last probe, nil until there has been one.
+var lastUpstream atomic.Pointer[upstreamProbe]
+
+// probeUpstreamForever probes the bucket of opts every upstreamInterval,
+// whether or not it is mounted.
+func probeUpstreamForever(opts mountOptions) {
+	c, err := opts.s3Client()
+	if err != nil {
+		warnf("The S3 endpoint will not be probed: %v", err)
+		return
+	}
+	for {
+		p := probeUpstream(c)
+		if prev := lastUpstream.Swap(&p); prev == nil || prev.OK != p.OK {
+			if p.OK {
+				infof("S3 endpoint %s is answering (%.0fms)", p.Endpoint, p.LatencyMS)
+			} else {
+				warnf("S3 endpoint %s is failing: %s", p.Endpoint, p.Error)
+			}
+		}
+		time.Sleep(upstreamInterval)
+	}
+}
+
+// probeUpstream makes a HEAD request for c's bucket: cheap, signed, and
+// answered by the S3 endpoint itself.
+func probeUpstream(c *s3client.Client) upstreamProbe {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+	start := time.Now()
+	err := c.HeadBucket(ctx)
+	elapsed := time.Since(start)
+	p := upstreamProbe{
+		Checked:   start.UTC(),
+		Endpoint:  c.Endpoint.Redacted(),
+		OK:        err == nil,
+		LatencyMS: float64(elapsed.Microseconds()) / 1000,
+	}
+	var se *s3client.Error
+	switch {
+	case err == nil:
+		p.Status = http.StatusOK
+	case errors.As(err, &se):
+		p.Status = se.StatusCode
+		p.Error = err.Error()
+	default:
+		p.Error = err.Error()
+	}
+	up := 0.0
+	if p.OK {
+		up = 1
+	}
+	upstreamUp.set(up)
+	upstreamLatency.set(elapsed.Seconds())
+	return p
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"server/container_src/internal/s3client"
+	"server/container_src/internal/s3test"
+)
+
+func TestUpstreamProbe(t *testing.T) {
+	if p := probeUpstream(s3test.NewServer(t).Client(t, "s3-test")); !p.OK || p.Status != http.StatusOK || p.Error != "" || p.LatencyMS <= 0 {
+		t.Errorf("probe of a working endpoint: %+v", p)
+	}
+	denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer denied.Close()
+	store, err := s3client.New(denied.URL+"/", "s3-test", "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := probeUpstream(store); p.OK || p.Status != http.StatusForbidden || p.Error == "" {
+		t.Errorf("probe of a denying endpoint: %+v", p)
+	}
+	denied.Close()
+	p := probeUpstream(store)
+	if p.OK || p.Status != 0 || p.Error == "" {
+		t.Errorf("probe of an endpoint that is down: %+v", p)
+	}
+
+	prev := lastUpstream.Swap(&p)
+	defer lastUpstream.Store(prev)
+	resp, err := http.Get(testURL + "/v1/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var health healthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil || health.Upstream == nil || health.Upstream.Error != p.Error {
+		t.Errorf("health upstream = %+v (%v), want %+v", health.Upstream, err, p)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// userTokenHeader carries a user token; WebSocket clients, which can't
+	// set headers, pass it as ?user_token= instead.
+	userTokenHeader = "X-User-Token"
+	// usersDirName is the directory under /data holding each user's
+	// namespace.
+	usersDirName = "users"
+)
+
+var errUserScope = errors.New("not available to user-scoped requests")
+
+// validUser matches the user IDs a namespace can be named after.
+var validUser = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type userKey struct{}
+
+// identity is who a request is from, as its credentials say.
+type identity struct {
+	User string
+	// Paths limits the user to parts of /data in place of their namespace
+	// (see paths.go); nil if it doesn't.
+	Paths pathGrants
+}
+
+// withUser scopes requests from a user to that user's namespace,
+// /data/users/<user>. Which user a request is from is up to the provider
+// auth configures (see auth.go): by default an HS256 JWT signed with
+// USER_TOKEN_SECRET whose "user" claim names the user. Under user_token,
+// requests without credentials are not scoped at all, so whatever fronts
+// the server must keep them from reaching it on a user's behalf: the Worker
+// only forwards /v1 and /proxy with a user token it has verified or with
+// CONTROL_TOKEN, though /ws as it comes. Other providers refuse requests
+// without credentials unless auth allows anonymous requests (see
+// authConfig.authenticate). Credentials that don't verify are refused, as
+// are any while the provider lacks its secret.
+func withUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := currentConfig().Auth.authenticate(r)
+		switch {
+		case errors.Is(err, errAuthDisabled):
+			httpError(w, r, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			writeProblem(w, r, http.StatusUnauthorized, fmt.Errorf("invalid credentials: %w", err))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), id)))
+	})
+}
+
+// withIdentity returns ctx scoped to id's user, and limited to its paths.
+func withIdentity(ctx context.Context, id identity) context.Context {
+	if id.User == "" {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, userKey{}, id.User)
+	if id.Paths != nil {
+		ctx = context.WithValue(ctx, pathsKey{}, id.Paths)
+	}
+	return ctx
+}
+
+// verifyUserToken checks a user token's signature and expiry and returns
+// the user it names, with the paths it limits them to.
+func verifyUserToken(token string, secret []byte, now time.Time) (identity, error) {
+	var claims struct {
+		User  string   `json:"user"`
+		Paths []string `json:"paths"`
+	}
+	if err := verifyHS256(token, secret, now, &claims); err != nil {
+		return identity{}, err
+	}
+	if err := checkUser(claims.User); err != nil {
+		return identity{}, err
+	}
+	grants, err := parsePathGrants(claims.Paths)
+	if err != nil {
+		return identity{}, err
+	}
+	return identity{User: claims.User, Paths: grants}, nil
+}
+
+// checkUser checks user can name a namespace.
+func checkUser(user string) error {
+	if !validUser.MatchString(user) || user == "." || user == ".." {
+		return fmt.Errorf("user %q: want 1 to 64 letters, digits, '.', '_' or '-'", user)
+	}
+	return nil
+}
+
+// verifyHS256 checks an HS256 JWT's signature with secret and its expiry,
+// if it has one, and decodes its claims into claims.
+func verifyHS256(token string, secret []byte, now time.Time, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("not a JWT: has %d parts, want 3", len(parts))
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return fmt.Errorf("invalid JWT header: %w", err)
+	}
+	if header.Alg != "HS256" {
+		return fmt.Errorf("alg %q, want HS256", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid JWT signature: %w", err)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errors.New("bad signature")
+	}
+	var std struct {
+		Exp *float64 `json:"exp"`
+	}
+	if err := decodeJWTPart(parts[1], &std); err != nil {
+		return fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	if std.Exp != nil {
+		if exp := time.Unix(int64(*std.Exp), 0); now.After(exp) {
+			return fmt.Errorf("%w at %s", errAuthExpired, exp.UTC().Format(time.RFC3339))
+		}
+	}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	return nil
+}
+
+// userFromContext returns the user a request is scoped to, or "".
+func userFromContext(ctx context.Context) string {
+	u, _ := ctx.Value(userKey{}).(string)
+	return u
+}
+
+// userRoot is the directory a user's requests are scoped to.
+func userRoot(user string) string {
+	return filepath.Join(dataDir, usersDirName, user)
+}
+
+// unscopedOnly refuses requests scoped to a user, for endpoints that would
+// reach outside their namespace.
+func unscopedOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if userFromContext(r.Context()) != "" {
+			writeError(w, r, fmt.Errorf("%s %s: %w", r.Method, r.URL.Path, errUserScope))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// scopePath maps a file API path onto the namespace of the request's user,
+// if it has one. The namespace is the user's root: "/", "/data" and ".."
+// at the top all name it. A symlink leading out of it is refused.
+func scopePath(r *http.Request, p string) (string, error) {
+	return scopePathFor(r, p, isWrite(r))
+}
+
+// scopePathFor is scopePath for reading p, or writing it. Requests limited
+// to paths are held to them instead (see paths.go).
+func scopePathFor(r *http.Request, p string, write bool) (string, error) {
+	user := userFromContext(r.Context())
+	if user == "" {
+		return p, nil
+	}
+	if grants := pathGrantsFromContext(r.Context()); grants != nil {
+		return grants.scope(p, write)
+	}
+	if strings.ContainsRune(p, 0) {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	if rest, ok := strings.CutPrefix(p, dataDir); ok && (rest == "" || rest[0] == '/') {
+		p = rest
+	}
+	rel := path.Join(usersDirName, user, path.Clean("/"+p))
+	full, err := resolvePath(rel)
+	if err != nil {
+		return "", err
+	}
+	if err := confineUser(userRoot(user), full); err != nil {
+		return "", fmt.Errorf("%s: %w", p, err)
+	}
+	return rel, nil
+}
+
+// confineUser refuses full, a path under root, if following symlinks on
+// the way to it leads out of root. Shells share /data, so a user's
+// namespace may hold links anywhere.
+func confineUser(root, full string) error {
+	for _, dir := range []string{filepath.Dir(root), root} {
+		if fi, err := os.Lstat(dir); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s is a symlink", errOutsideData, relPath(dir))
+		}
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// The deepest part of full that exists decides where the rest goes.
+	for p := full; p != root; p = filepath.Dir(p) {
+		real, err := filepath.EvalSymlinks(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			// A dangling symlink would be followed by a write.
+			if fi, err := os.Lstat(p); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+				return fmt.Errorf("%w: %s is a dangling symlink", errOutsideData, relPath(p))
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if real != realRoot && !strings.HasPrefix(real, realRoot+string(filepath.Separator)) {
+			return fmt.Errorf("%w: %s leads outside the user's directory", errOutsideData, relPath(p))
+		}
+		return nil
+	}
+	return nil
+}
+
+// unscopePath maps a path relative to /data back to one relative to the
+// request user's root, the inverse of scopePath.
+func unscopePath(r *http.Request, p string) string {
+	user := userFromContext(r.Context())
+	if user == "" || pathGrantsFromContext(r.Context()) != nil {
+		return p
+	}
+	root := usersDirName + "/" + user
+	if p == root {
+		return ""
+	}
+	return strings.TrimPrefix(p, root+"/")
+}
+
+// isUserRoot reports whether the scoped path p is the request user's root,
+// or the directory of one of their path grants, which they can't delete or
+// replace.
+func isUserRoot(r *http.Request, p string) bool {
+	user := userFromContext(r.Context())
+	if grants := pathGrantsFromContext(r.Context()); user != "" && grants != nil {
+		return grants.isBase(p)
+	}
+	return user != "" && p == usersDirName+"/"+user
+}
+
+// ownsSession reports whether the request may use s: unscoped requests may
+// use any session, scoped ones only their user's.
+func ownsSession(r *http.Request, s *session) bool {
+	user := userFromContext(r.Context())
+	return user == "" || s.user == user
+}
+
+// scopeExec runs a user's command in their namespace, which is its HOME;
+// or, limited to paths, in a directory they may write to, by default their
+// home there (see pathGrants.home).
+func scopeExec(r *http.Request, user string, req *execRequest) error {
+	home := userRoot(user)
+	grants := pathGrantsFromContext(r.Context())
+	if grants != nil {
+		home = filepath.Join(dataDir, grants.home())
+		if req.Cwd == "" {
+			req.Cwd = grants.home()
+		}
+	}
+	cwd, err := scopePathFor(r, req.Cwd, true)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(home, 0755); err != nil {
+		return err
+	}
+	req.Cwd = cwd
+	if req.Env == nil {
+		req.Env = make(map[string]string)
+	}
+	req.Env["HOME"] = home
+	return nil
+}
+
+// scopeBatch maps a batch's paths onto the request user's namespace, whose
+// root no operation may apply to.
+func scopeBatch(r *http.Request, ops []batchOp) error {
+	if userFromContext(r.Context()) == "" {
+		return nil
+	}
+	for i := range ops {
+		for _, p := range []*string{&ops[i].From, &ops[i].To, &ops[i].Path} {
+			if *p == "" {
+				continue
+			}
+			// Copying only reads its source.
+			write := p != &ops[i].From || ops[i].Op != "copy"
+			scoped, err := scopePathFor(r, *p, write)
+			if err != nil {
+				return fmt.Errorf("operation %d: %w", i, err)
+			}
+			if isUserRoot(r, scoped) {
+				return fmt.Errorf("%w: operation %d: cannot %s the user's directory", errInvalidBatch, i, ops[i].Op)
+			}
+			*p = scoped
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUserNamespaces(t *testing.T) {
+	t.Setenv("USER_TOKEN_SECRET", "s3cret")
+	defer os.RemoveAll(filepath.Join(dataDir, usersDirName))
+	do := func(user, method, path, body string, v any) int {
+		t.Helper()
+		req, err := http.NewRequest(method, testURL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != "" {
+			req.Header.Set(userTokenHeader, userToken("s3cret", user))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil && resp.StatusCode < 300 {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var fi fileInfo
+	if code := do("alice", "PUT", "/v1/files/notes.txt", "alice's\n", &fi); code != http.StatusOK || fi.Path != "notes.txt" {
+		t.Fatalf("alice's PUT = %d, %+v", code, fi)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dataDir, "users", "alice", "notes.txt")); string(data) != "alice's\n" {
+		t.Fatalf("alice's file has %q", data)
+	}
+	var list fileList
+	if code := do("alice", "GET", "/v1/files/", "", &list); code != http.StatusOK || len(list.Entries) != 1 || list.Entries[0].Path != "notes.txt" {
+		t.Fatalf("alice's listing = %d, %+v", code, list)
+	}
+	if code := do("bob", "GET", "/v1/files/notes.txt", "", nil); code != http.StatusNotFound {
+		t.Fatalf("bob reading alice's file: %d", code)
+	}
+	// Climbing out of bob's root stays in it, and a symlink out is refused.
+	var batch batchResponse
+	ops := `{"operations":[{"op":"copy","from":"../alice/notes.txt","to":"stolen.txt"}]}`
+	if code := do("bob", "POST", "/v1/files:batch", ops, &batch); code != http.StatusOK || batch.OK {
+		t.Fatalf("bob copying alice's file = %d, %+v", code, batch)
+	}
+	if err := os.MkdirAll(userRoot("bob"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(userRoot("alice"), filepath.Join(userRoot("bob"), "link")); err != nil {
+		t.Fatal(err)
+	}
+	if code := do("bob", "GET", "/v1/files/link/notes.txt", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("bob reading through a symlink: %d", code)
+	}
+	if code := do("alice", "DELETE", "/v1/files/?recursive=1", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("alice deleting her root: %d", code)
+	}
+
+	// Endpoints that would reach outside the namespace refuse scoped
+	// requests, and tokens have to verify.
+	if code := do("alice", "GET", "/v1/trash", "", nil); code != http.StatusForbidden {
+		t.Fatalf("alice listing the trash: %d", code)
+	}
+	req, _ := http.NewRequest("GET", testURL+"/v1/health", nil)
+	req.Header.Set(userTokenHeader, userToken("wrong", "alice"))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("forged token: %v, %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	var res execResponse
+	if code := do("alice", "POST", "/v1/exec", `{"argv":["sh","-c","pwd; echo $HOME"],"cwd":"/"}`, &res); code != http.StatusOK {
+		t.Fatalf("alice's exec: %d", code)
+	}
+	if want := userRoot("alice") + "\n" + userRoot("alice") + "\n"; res.Stdout != want {
+		t.Fatalf("alice's exec printed %q, want %q", res.Stdout, want)
+	}
+
+	// Sessions belong to the user who started them.
+	var poll pollResponse
+	if code := do("alice", "POST", "/v1/poll", "", &poll); code != http.StatusCreated {
+		t.Fatalf("alice's poll session: %d", code)
+	}
+	defer do("alice", "DELETE", "/v1/poll/"+poll.ID, "", nil)
+	var info sessionInfo
+	if code := do("alice", "GET", "/v1/sessions/"+poll.ID, "", &info); code != http.StatusOK || info.User != "alice" {
+		t.Fatalf("alice's session = %d, %+v", code, info)
+	}
+	if code := do("bob", "GET", "/v1/sessions/"+poll.ID, "", nil); code != http.StatusNotFound {
+		t.Fatalf("bob describing alice's session: %d", code)
+	}
+	if code := do("bob", "DELETE", "/v1/poll/"+poll.ID, "", nil); code != http.StatusNotFound {
+		t.Fatalf("bob closing alice's session: %d", code)
+	}
+	var sl sessionList
+	if do("bob", "GET", "/v1/sessions", "", &sl); len(sl.Sessions) != 0 {
+		t.Fatalf("bob's sessions = %+v", sl.Sessions)
+	}
+}
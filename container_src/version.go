@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, set by the Dockerfile at link time:
+//
+//	go build -ldflags "-X main.gitCommit=... -X main.buildTime=... -X main.tigrisfsVersion=..."
+//
+// A plain go build inside the repository still reports the commit, from
+// the VCS stamp Go records in the binary.
+var (
+	gitCommit       string
+	buildTime       string
+	tigrisfsVersion string
+)
+
+type versionInfo struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+	// Tigrisfs is the tigrisfs release installed alongside the server.
+	Tigrisfs string `json:"tigrisfs_version"`
+	// Modified is set for builds from a tree with uncommitted changes, as
+	// far as the VCS stamp tells.
+	Modified bool `json:"modified,omitempty"`
+}
+
+var buildVersion = readVersion()
+
+func readVersion() versionInfo {
+	v := versionInfo{
+		Commit:    gitCommit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+		Tigrisfs:  tigrisfsVersion,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if v.Commit == "" {
+					v.Commit = s.Value
+				}
+			case "vcs.modified":
+				v.Modified = s.Value == "true"
+			}
+		}
+	}
+	for _, s := range []*string{&v.Commit, &v.BuildTime, &v.Tigrisfs} {
+		if *s == "" {
+			*s = "unknown"
+		}
+	}
+	return v
+}
+
+// handleVersion serves the build metadata: GET /version.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, buildVersion)
+}
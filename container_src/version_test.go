@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+
+	"server/container_src/client"
+)
+
+func TestVersion(t *testing.T) {
+	resp, err := http.Get(testURL + "/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var v client.Version
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.GoVersion != runtime.Version() || v.Commit == "" || v.TigrisfsVersion != "unknown" {
+		t.Errorf("/version = %+v", v)
+	}
+
+	h, err := dialTest(t).Health(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != v {
+		t.Errorf("health reports version %+v, want %+v", h.Version, v)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"time"
+
+	"server/container_src/internal/s3client"
+)
+
+var (
+	errNoBucket              = errors.New("no bucket mounted")
+	errVersioningUnsupported = errors.New("the bucket does not keep file versions")
+	errInvalidRestore        = errors.New("invalid restore")
+)
+
+// fileVersion is a version of a file kept by the bucket, or a delete marker
+// recording that the file was deleted.
+type fileVersion struct {
+	VersionID string    `json:"version_id"`
+	Latest    bool      `json:"latest"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	ETag      string    `json:"etag,omitempty"`
+}
+
+type fileVersionList struct {
+	Path string `json:"path"`
+	// Versions are newest first.
+	Versions []fileVersion `json:"versions"`
+}
+
+type restoreRequest struct {
+	Path      string `json:"path"`
+	VersionID string `json:"version_id"`
+}
+
+// bucketKey is the bucket key of the file at p: tigrisfs stores a file
+// under its path relative to the mount.
+func bucketKey(p string) (string, error) {
+	full, err := resolvePath(p)
+	if err != nil {
+		return "", err
+	}
+	if full == dataDir {
+		return "", fmt.Errorf("%w: %s", errIsDir, dataDir)
+	}
+	return relPath(full), nil
+}
+
+// listVersions returns the versions the bucket keeps of the file at p.
+func listVersions(ctx context.Context, p string) (fileVersionList, error) {
+	store := bucketStore.Load()
+	if store == nil {
+		return fileVersionList{}, errNoBucket
+	}
+	key, err := bucketKey(p)
+	if err != nil {
+		return fileVersionList{}, err
+	}
+	objs, err := store.ListObjectVersions(ctx, key)
+	if errors.Is(err, s3client.ErrVersioningUnsupported) {
+		return fileVersionList{}, errVersioningUnsupported
+	}
+	if err != nil {
+		return fileVersionList{}, err
+	}
+	list := fileVersionList{Path: key, Versions: []fileVersion{}}
+	for _, o := range objs {
+		// The listing is by prefix; "a.txt" also finds "a.txt.bak".
+		if o.Key != key {
+			continue
+		}
+		list.Versions = append(list.Versions, fileVersion{
+			VersionID: o.VersionID,
+			Latest:    o.IsLatest,
+			Deleted:   o.DeleteMarker,
+			Size:      o.Size,
+			ModTime:   o.LastModified,
+			ETag:      o.ETag,
+		})
+	}
+	if len(list.Versions) == 0 {
+		return fileVersionList{}, fmt.Errorf("%s: %w (no versions)", key, fs.ErrNotExist)
+	}
+	return list, nil
+}
+
+// restoreVersion writes a version's contents back to the file at p, through
+// the mount so that its caches and the write queue see it. The file keeps
+// its permissions; one restored after deletion gets the default. The
+// version restored over stays in the bucket's history.
+func restoreVersion(ctx context.Context, p, versionID string) (fileInfo, error) {
+	store := bucketStore.Load()
+	if store == nil {
+		return fileInfo{}, errNoBucket
+	}
+	key, err := bucketKey(p)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	if versionID == "" {
+		return fileInfo{}, fmt.Errorf("%w: version_id is required", errInvalidRestore)
+	}
+	body, err := store.GetObject(ctx, key, versionID)
+	var se *s3client.Error
+	switch {
+	case s3client.IsNotFound(err):
+		return fileInfo{}, fmt.Errorf("%s version %s: %w", key, versionID, fs.ErrNotExist)
+	case errors.As(err, &se) && se.StatusCode == http.StatusMethodNotAllowed:
+		// S3's answer for a delete marker.
+		return fileInfo{}, fmt.Errorf("%w: version %s of %s is a deletion", errInvalidRestore, versionID, key)
+	case err != nil:
+		return fileInfo{}, err
+	}
+	defer body.Close()
+	var mode fs.FileMode
+	if fi, err := statPath(p); err == nil {
+		if fi.IsDir {
+			return fileInfo{}, fmt.Errorf("%w: %s", errIsDir, key)
+		}
+		mode = os.FileMode(fi.Mode)
+	}
+	fi, err := writeFile(p, body, mode)
+	if err == nil {
+		infof("Restored %s to version %s", key, versionID)
+	}
+	return fi, err
+}
+
+// handleFileRestore restores a file to one of its versions:
+// POST /v1/files:restore {"path": "a.txt", "version_id": "..."}.
+func handleFileRestore(w http.ResponseWriter, r *http.Request) {
+	var req restoreRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInputBody)).Decode(&req); err != nil {
+		httpError(w, r, "invalid restore request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Copying the version may take as long as it takes, but give up when
+	// the client does.
+	fi, err := fsCall(r.Context(), func() (fileInfo, error) {
+		return restoreVersion(r.Context(), req.Path, req.VersionID)
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, fi)
+}
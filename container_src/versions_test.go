@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"server/container_src/internal/s3client"
+	"server/container_src/internal/s3test"
+)
+
+func TestFileVersions(t *testing.T) {
+	t.Cleanup(func() { bucketStore.Store(nil) })
+	problemType := func(resp *http.Response) string {
+		t.Helper()
+		defer resp.Body.Close()
+		var p problem
+		json.NewDecoder(resp.Body).Decode(&p)
+		return p.Type
+	}
+
+	// The embedded fake S3, like the S3 Durable Object, keeps no versions.
+	bucketStore.Store(s3test.NewServer(t).Client(t, "s3-test"))
+	resp, err := http.Get(testURL + "/v1/files/v.txt?versions=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotImplemented || problemType(resp) != "urn:do-s3:problem:versioning-unsupported" {
+		t.Fatalf("versions without versioning: %s", resp.Status)
+	}
+
+	versioned := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Query().Has("versions"):
+			io.WriteString(w, `<ListVersionsResult>
+				<Version><Key>v.txt</Key><VersionId>v2</VersionId><IsLatest>true</IsLatest><Size>4</Size><LastModified>2026-01-02T00:00:00Z</LastModified></Version>
+				<Version><Key>v.txt</Key><VersionId>v1</VersionId><Size>4</Size><LastModified>2026-01-01T00:00:00Z</LastModified></Version>
+				<Version><Key>v.txt.bak</Key><VersionId>b1</VersionId><Size>4</Size><LastModified>2026-01-01T00:00:00Z</LastModified></Version>
+			</ListVersionsResult>`)
+		case r.URL.Path == "/s3-test/v.txt" && r.URL.Query().Get("versionId") == "v1":
+			io.WriteString(w, "old\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer versioned.Close()
+	c, _ := s3client.New(versioned.URL+"/", "s3-test", "test", "test")
+	bucketStore.Store(c)
+	if err := os.WriteFile(filepath.Join(dataDir, "v.txt"), []byte("new\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := dialTest(t).Versions(context.Background(), "v.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].VersionID != "v2" || !versions[0].Latest || versions[1].VersionID != "v1" {
+		t.Fatalf("versions = %+v, want v2 then v1", versions)
+	}
+
+	resp, err = http.Post(testURL+"/v1/files:restore", "application/json", strings.NewReader(`{"path": "v.txt", "version_id": "v1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("restore: %s", resp.Status)
+	}
+	fi, err := os.Stat(filepath.Join(dataDir, "v.txt"))
+	if data, _ := os.ReadFile(filepath.Join(dataDir, "v.txt")); string(data) != "old\n" || err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("restored file has %q, mode %v", data, fi.Mode())
+	}
+
+	resp, err = http.Post(testURL+"/v1/files:restore", "application/json", strings.NewReader(`{"path": "v.txt", "version_id": "v9"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotFound || problemType(resp) != "urn:do-s3:problem:not-found" {
+		t.Errorf("restoring a missing version: %s", resp.Status)
+	}
+}
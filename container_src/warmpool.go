@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// warmSessionsEnv is set by the Durable Object to the number of shells to
+// start once the mount is ready, so that the first clients to connect get
+// a prompt at once instead of waiting for a shell to start.
+const warmSessionsEnv = "WARM_SESSIONS"
+
+// Warm sessions start at the size mux sessions default to; the client's
+// size replaces it when one is handed out.
+const warmCols, warmRows = 80, 24
+
+var (
+	warmHandouts = newCounter("dos3_warm_sessions_used_total",
+		"Sessions started by handing out a warm one rather than starting a shell.")
+	_ = newGaugeFunc("dos3_warm_sessions", "Warm sessions waiting to be handed out.", func() float64 {
+		return float64(sessions.warmCount())
+	})
+)
+
+// warmPoolSize reads WARM_SESSIONS, 0 if it isn't set.
+func warmPoolSize() (int, error) {
+	v := os.Getenv(warmSessionsEnv)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("want a number of sessions, not %q", v)
+	}
+	return n, nil
+}
+
+// warm keeps n warm sessions waiting from now on, starting them now.
+func (m *sessionManager) warm(n int) {
+	if n <= 0 {
+		return
+	}
+	m.mu.Lock()
+	m.warmTarget = n
+	m.mu.Unlock()
+	start := time.Now()
+	m.fillWarm()
+	infof("Warmed %d sessions in %s", m.warmCount(), time.Since(start).Round(time.Millisecond))
+}
+
+// warmCount is how many warm sessions are waiting.
+func (m *sessionManager) warmCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.countLocked(true)
+}
+
+// fillWarm starts warm sessions until the pool is full, max_sessions is
+// reached, or one fails to start. Only one fill runs at a time.
+func (m *sessionManager) fillWarm() {
+	m.mu.Lock()
+	if m.warming {
+		m.mu.Unlock()
+		return
+	}
+	m.warming = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.warming = false
+		m.mu.Unlock()
+	}()
+	for {
+		m.mu.Lock()
+		short := m.countLocked(true) < m.warmTarget
+		m.mu.Unlock()
+		if !short || handingOver.Load() {
+			return
+		}
+		if _, err := m.spawn(warmCols, warmRows, sessionMeta{}, "", spawnOptions{warm: true}); err != nil {
+			if !errors.Is(err, errTooManySessions) {
+				warnf("Starting a warm session: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// takeWarm hands out the oldest warm session whose shell is still running,
+// at the client's size and with its metadata, and starts another in its
+// place. It returns nil if none is waiting.
+func (m *sessionManager) takeWarm(cols, rows int, meta sessionMeta) *session {
+	for {
+		m.mu.Lock()
+		var s *session
+		for _, c := range m.sessions {
+			if c.warm.Load() && !c.exited.Load() && (s == nil || c.created.Before(s.created)) {
+				s = c
+			}
+		}
+		if s == nil {
+			m.mu.Unlock()
+			return nil
+		}
+		// Listed from now on, as started now.
+		s.created = time.Now()
+		s.warm.Store(false)
+		m.mu.Unlock()
+
+		s.mu.Lock()
+		s.meta = meta
+		s.mu.Unlock()
+		if err := s.resize(cols, rows); err != nil {
+			debugf("Warm session %s unusable: %v", s.id, err)
+			s.close()
+			continue
+		}
+		warmHandouts.add(1)
+		events.publish(event{Kind: eventSessionStarted, Session: s})
+		go m.fillWarm()
+		infof("Session %s started from the warm pool (%dx%d)", s.id, cols, rows)
+		return s
+	}
+}
+
+// evictWarmLocked closes a warm session to make room under max_sessions for
+// one that isn't warm, if there is one to close.
+func (m *sessionManager) evictWarmLocked() {
+	for id, s := range m.sessions {
+		if s.warm.Load() {
+			delete(m.sessions, id)
+			go s.close()
+			return
+		}
+	}
+}
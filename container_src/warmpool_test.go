@@ -0,0 +1,77 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWarmPool(t *testing.T) {
+	t.Setenv(warmSessionsEnv, "two")
+	if _, err := warmPoolSize(); err == nil {
+		t.Error("WARM_SESSIONS=two accepted")
+	}
+	sessions.warm(2)
+	defer func() {
+		sessions.mu.Lock()
+		sessions.warmTarget = 0
+		for _, s := range sessions.sessions {
+			if s.warm.Load() {
+				s.close()
+			}
+		}
+		sessions.mu.Unlock()
+	}()
+	if n := sessions.warmCount(); n != 2 {
+		t.Fatalf("%d warm sessions, want 2", n)
+	}
+	listed := len(sessions.list())
+	sessions.mu.Lock()
+	var warm []string
+	for id, s := range sessions.sessions {
+		if s.warm.Load() {
+			warm = append(warm, id)
+		}
+	}
+	sessions.mu.Unlock()
+	if sessions.get(warm[0]) != nil {
+		t.Error("warm session can be looked up")
+	}
+
+	// The next session is a warm one, at the client's size, and another is
+	// started in its place.
+	sess, err := sessions.start(100, 30, sessionMeta{Name: "warmed"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	if !slices.Contains(warm, sess.id) {
+		t.Errorf("session %s wasn't taken from the pool %v", sess.id, warm)
+	}
+	if cols, rows := sess.size(); cols != 100 || rows != 30 || sess.metadata().Name != "warmed" {
+		t.Errorf("warm session handed out at %dx%d as %+v", cols, rows, sess.metadata())
+	}
+	if len(sessions.list()) != listed+1 || sessions.get(sess.id) != sess {
+		t.Error("handed-out session isn't listed")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for sessions.warmCount() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := sessions.warmCount(); n != 2 {
+		t.Errorf("pool refilled to %d, want 2", n)
+	}
+	// The shell was running before it was handed out: its prompt is
+	// already there to replay.
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		data, _, _ := sess.output.read(0, 1<<20)
+		if len(data) > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if data, _, _ := sess.output.read(0, 1<<20); len(data) == 0 {
+		t.Error("no output from the warm shell")
+	}
+}
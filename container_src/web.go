@@ -0,0 +1,28 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// termPage is a standalone terminal client for /ws, so the container can be
+// used for debugging without the Worker's frontend.
+//
+//go:embed web/term.html
+var termPage []byte
+
+// termScript is the page's terminal emulator. It is served from the binary
+// with the page, so the page works offline and behind egress filtering.
+//
+//go:embed web/term.js
+var termScript []byte
+
+func handleTermPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(termPage)
+}
+
+func handleTermScript(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Write(termScript)
+}
@@ -0,0 +1,548 @@
+// term.js is the /term page's terminal: a small VT100/xterm emulator that
+// renders into the page, enough for shells and full-screen programs. It is
+// served from the binary with the page, so the page needs nothing from the
+// network but the server.
+"use strict";
+
+// The 16 ANSI colors, then the 6x6x6 cube and the grayscale ramp of the
+// 256-color palette.
+const palette = [
+  "#000000", "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#bc3fbc", "#11a8cd", "#e5e5e5",
+  "#666666", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#d670d6", "#29b8db", "#ffffff",
+];
+for (let i = 0; i < 216; i++) {
+  const level = (v) => (v ? 55 + v * 40 : 0);
+  palette.push(`rgb(${level(Math.floor(i / 36))},${level(Math.floor(i / 6) % 6)},${level(i % 6)})`);
+}
+for (let i = 0; i < 24; i++) palette.push(`rgb(${8 + i * 10},${8 + i * 10},${8 + i * 10})`);
+
+const defaultPen = Object.freeze({ fg: null, bg: null, bold: false, italic: false, underline: false, inverse: false });
+
+// keys maps keys to what they send; arrows, Home and End send SS3 forms in
+// application cursor mode.
+const keys = {
+  Enter: "\r", Backspace: "\x7f", Tab: "\t", Escape: "\x1b",
+  Insert: "\x1b[2~", Delete: "\x1b[3~", PageUp: "\x1b[5~", PageDown: "\x1b[6~",
+  F1: "\x1bOP", F2: "\x1bOQ", F3: "\x1bOR", F4: "\x1bOS", F5: "\x1b[15~", F6: "\x1b[17~",
+  F7: "\x1b[18~", F8: "\x1b[19~", F9: "\x1b[20~", F10: "\x1b[21~", F11: "\x1b[23~", F12: "\x1b[24~",
+};
+const cursorKeys = { ArrowUp: "A", ArrowDown: "B", ArrowRight: "C", ArrowLeft: "D", Home: "H", End: "F" };
+
+// maxScrollback caps the lines kept above the screen.
+const maxScrollback = 5000;
+
+const escapeHTML = (s) => s.replace(/[&<>]/g, (c) => ({ "&": "&amp;", "<": "&lt;", ">": "&gt;" })[c]);
+
+class Terminal {
+  constructor(el) {
+    this.el = el;
+    el.tabIndex = 0;
+    el.classList.add("term");
+    this.history = el.appendChild(document.createElement("pre"));
+    this.screen = el.appendChild(document.createElement("pre"));
+    this.decoder = new TextDecoder();
+    this.dataHandlers = [];
+    this.resizeHandlers = [];
+    this.cols = 80;
+    this.rows = 24;
+    this.reset();
+    el.addEventListener("keydown", (e) => this.keydown(e));
+    el.addEventListener("paste", (e) => {
+      e.preventDefault();
+      this.paste(e.clipboardData.getData("text/plain"));
+    });
+    // Focus on click, unless the click selected text to copy.
+    el.addEventListener("mouseup", () => String(window.getSelection()) || el.focus());
+  }
+
+  reset() {
+    this.lines = this.blankLines(this.rows);
+    this.saved = null;
+    this.alt = null;
+    this.x = this.y = 0;
+    this.wrapPending = false;
+    this.pen = defaultPen;
+    this.top = 0;
+    this.bottom = this.rows - 1;
+    this.modes = { autowrap: true, cursor: true, appCursor: false, bracketedPaste: false };
+    this.state = "ground";
+    this.params = "";
+    this.osc = "";
+    this.redraw();
+  }
+
+  onData(fn) {
+    this.dataHandlers.push(fn);
+  }
+
+  onResize(fn) {
+    this.resizeHandlers.push(fn);
+  }
+
+  focus() {
+    this.el.focus();
+  }
+
+  send(data) {
+    for (const fn of this.dataHandlers) fn(data);
+  }
+
+  // fit sizes the terminal to its element.
+  fit() {
+    const probe = this.screen.appendChild(document.createElement("span"));
+    probe.textContent = "W".repeat(10);
+    const { width, height } = probe.getBoundingClientRect();
+    probe.remove();
+    if (!width || !height) return;
+    const cols = Math.max(2, Math.floor(this.el.clientWidth / (width / 10)));
+    const rows = Math.max(1, Math.floor(this.el.clientHeight / height));
+    this.resize(cols, rows);
+  }
+
+  resize(cols, rows) {
+    if (cols === this.cols && rows === this.rows) return;
+    const fix = (lines) => {
+      for (const line of lines) {
+        line.length = Math.min(line.length, cols);
+        while (line.length < cols) line.push(this.blankCell(defaultPen));
+      }
+    };
+    fix(this.lines);
+    // Shrinking keeps the lines around the cursor, moving those above it
+    // into the scrollback.
+    while (this.lines.length > rows) {
+      if (this.y > 0) {
+        const line = this.lines.shift();
+        if (!this.alt) this.scrolledOff(line);
+        this.y--;
+      } else {
+        this.lines.pop();
+      }
+    }
+    this.cols = cols;
+    while (this.lines.length < rows) this.lines.push(this.blankLine(defaultPen));
+    if (this.alt) {
+      fix(this.alt.lines);
+      this.alt.lines.length = Math.min(this.alt.lines.length, rows);
+      while (this.alt.lines.length < rows) this.alt.lines.push(this.blankLine(defaultPen));
+    }
+    this.rows = rows;
+    this.x = Math.min(this.x, cols - 1);
+    this.y = Math.min(this.y, rows - 1);
+    this.top = 0;
+    this.bottom = rows - 1;
+    this.wrapPending = false;
+    this.redraw();
+    for (const fn of this.resizeHandlers) fn({ cols, rows });
+  }
+
+  // write feeds the terminal output from the PTY.
+  write(bytes) {
+    for (const c of this.decoder.decode(bytes, { stream: true })) this.feed(c);
+    this.redraw();
+  }
+
+  feed(c) {
+    const code = c.codePointAt(0);
+    switch (this.state) {
+      case "ground":
+        if (code === 0x1b) this.state = "esc";
+        else if (code < 0x20) this.control(c);
+        else if (code !== 0x7f) this.print(c);
+        return;
+      case "esc":
+        this.state = "ground";
+        return this.escape(c);
+      case "charset":
+        this.state = "ground";
+        return;
+      case "csi":
+        if (code >= 0x40 && code <= 0x7e) {
+          this.state = "ground";
+          this.csi(c, this.params);
+        } else if (code >= 0x30 && code <= 0x3f) {
+          this.params += c;
+        } else if (code < 0x20 || code > 0x7e) {
+          // Controls take effect even in the middle of a sequence.
+          if (code === 0x1b) this.state = "esc";
+          else if (code < 0x20) this.control(c);
+        }
+        return;
+      case "osc":
+        if (code === 0x07) this.endOSC();
+        else if (code === 0x1b) this.state = "oscEsc";
+        else this.osc += c;
+        return;
+      case "oscEsc":
+        this.endOSC();
+        if (c !== "\\") this.feed(c);
+        return;
+    }
+  }
+
+  control(c) {
+    switch (c) {
+      case "\r":
+        this.x = 0;
+        this.wrapPending = false;
+        break;
+      case "\n":
+      case "\v":
+      case "\f":
+        this.lineFeed();
+        break;
+      case "\b":
+        if (this.x > 0) this.x--;
+        this.wrapPending = false;
+        break;
+      case "\t":
+        this.x = Math.min(this.cols - 1, (Math.floor(this.x / 8) + 1) * 8);
+        break;
+    }
+  }
+
+  escape(c) {
+    switch (c) {
+      case "[":
+        this.state = "csi";
+        this.params = "";
+        break;
+      case "]":
+        this.state = "osc";
+        this.osc = "";
+        break;
+      case "(":
+      case ")":
+      case "*":
+      case "+":
+        this.state = "charset";
+        break;
+      case "7":
+        this.saveCursor();
+        break;
+      case "8":
+        this.restoreCursor();
+        break;
+      case "D":
+        this.lineFeed();
+        break;
+      case "E":
+        this.x = 0;
+        this.lineFeed();
+        break;
+      case "M":
+        if (this.y === this.top) this.scrollDown(1);
+        else if (this.y > 0) this.y--;
+        break;
+      case "c":
+        this.reset();
+        break;
+    }
+  }
+
+  // endOSC takes a window title from OSC 0 or 2 and ignores the rest.
+  endOSC() {
+    this.state = "ground";
+    const [cmd, ...rest] = this.osc.split(";");
+    if (cmd === "0" || cmd === "2") document.title = rest.join(";");
+  }
+
+  csi(final, raw) {
+    const priv = raw[0] === "?" || raw[0] === ">" ? raw[0] : "";
+    const args = raw.slice(priv.length).split(";").map((p) => parseInt(p, 10));
+    // n is the first argument, or 1 where a count or position is missing.
+    const n = args[0] > 0 ? args[0] : 1;
+    switch (final) {
+      case "A": this.moveTo(this.x, this.y - n); break;
+      case "B": this.moveTo(this.x, this.y + n); break;
+      case "C": this.moveTo(this.x + n, this.y); break;
+      case "D": this.moveTo(this.x - n, this.y); break;
+      case "E": this.moveTo(0, this.y + n); break;
+      case "F": this.moveTo(0, this.y - n); break;
+      case "G": this.moveTo(n - 1, this.y); break;
+      case "d": this.moveTo(this.x, n - 1); break;
+      case "H":
+      case "f": this.moveTo((args[1] > 0 ? args[1] : 1) - 1, n - 1); break;
+      case "J": this.eraseDisplay(args[0] || 0); break;
+      case "K": this.eraseLine(args[0] || 0); break;
+      case "L": if (this.inRegion()) this.scrollDown(n, this.y); break;
+      case "M": if (this.inRegion()) this.scrollUp(n, this.y, false); break;
+      case "@": this.insertChars(n); break;
+      case "P": this.deleteChars(n); break;
+      case "X": this.fill(this.y, this.x, Math.min(this.cols, this.x + n)); break;
+      case "S": this.scrollUp(n); break;
+      case "T": this.scrollDown(n); break;
+      case "m": this.sgr(raw === "" ? [0] : args); break;
+      case "r":
+        this.top = (args[0] > 0 ? args[0] : 1) - 1;
+        this.bottom = Math.min(this.rows, args[1] > 0 ? args[1] : this.rows) - 1;
+        if (this.top >= this.bottom) {
+          this.top = 0;
+          this.bottom = this.rows - 1;
+        }
+        this.moveTo(0, 0);
+        break;
+      case "s": this.saveCursor(); break;
+      case "u": this.restoreCursor(); break;
+      case "h":
+      case "l": if (priv === "?") this.setModes(args, final === "h"); break;
+      case "n":
+        if (args[0] === 5) this.send("\x1b[0n");
+        if (args[0] === 6) this.send(`\x1b[${this.y + 1};${this.x + 1}R`);
+        break;
+      case "c":
+        if (priv === ">") this.send("\x1b[>0;0;0c");
+        else if (!(args[0] > 0)) this.send("\x1b[?1;2c");
+        break;
+    }
+  }
+
+  setModes(modes, on) {
+    for (const mode of modes) {
+      switch (mode) {
+        case 1: this.modes.appCursor = on; break;
+        case 7: this.modes.autowrap = on; break;
+        case 25: this.modes.cursor = on; break;
+        case 2004: this.modes.bracketedPaste = on; break;
+        case 47:
+        case 1047:
+        case 1049: this.altScreen(on, mode === 1049); break;
+      }
+    }
+  }
+
+  // altScreen switches to the alternate screen full-screen programs draw
+  // on, and back to the normal one, which kept its contents.
+  altScreen(on, saveCursor) {
+    if (on === !!this.alt) return;
+    if (on) {
+      if (saveCursor) this.saveCursor();
+      this.alt = { lines: this.lines };
+      this.lines = this.blankLines(this.rows);
+    } else {
+      this.lines = this.alt.lines;
+      this.alt = null;
+      if (saveCursor) this.restoreCursor();
+    }
+  }
+
+  sgr(args) {
+    const pen = { ...this.pen };
+    for (let i = 0; i < args.length; i++) {
+      const a = args[i] || 0;
+      if (a === 0) Object.assign(pen, defaultPen);
+      else if (a === 1) pen.bold = true;
+      else if (a === 3) pen.italic = true;
+      else if (a === 4) pen.underline = true;
+      else if (a === 7) pen.inverse = true;
+      else if (a === 22) pen.bold = false;
+      else if (a === 23) pen.italic = false;
+      else if (a === 24) pen.underline = false;
+      else if (a === 27) pen.inverse = false;
+      else if (a >= 30 && a <= 37) pen.fg = palette[a - 30];
+      else if (a >= 40 && a <= 47) pen.bg = palette[a - 40];
+      else if (a >= 90 && a <= 97) pen.fg = palette[a - 82];
+      else if (a >= 100 && a <= 107) pen.bg = palette[a - 92];
+      else if (a === 39) pen.fg = null;
+      else if (a === 49) pen.bg = null;
+      else if (a === 38 || a === 48) {
+        let color = null;
+        if (args[i + 1] === 5) {
+          color = palette[args[i + 2]] || null;
+          i += 2;
+        } else if (args[i + 1] === 2) {
+          color = `rgb(${args[i + 2] || 0},${args[i + 3] || 0},${args[i + 4] || 0})`;
+          i += 4;
+        }
+        pen[a === 38 ? "fg" : "bg"] = color;
+      }
+    }
+    this.pen = Object.freeze(pen);
+  }
+
+  print(c) {
+    if (this.wrapPending) {
+      this.x = 0;
+      this.lineFeed();
+    }
+    this.lines[this.y][this.x] = { ch: c, pen: this.pen };
+    if (this.x < this.cols - 1) this.x++;
+    else this.wrapPending = this.modes.autowrap;
+  }
+
+  lineFeed() {
+    this.wrapPending = false;
+    if (this.y === this.bottom) this.scrollUp(1);
+    else if (this.y < this.rows - 1) this.y++;
+  }
+
+  moveTo(x, y) {
+    this.x = Math.max(0, Math.min(this.cols - 1, x));
+    this.y = Math.max(0, Math.min(this.rows - 1, y));
+    this.wrapPending = false;
+  }
+
+  inRegion() {
+    return this.y >= this.top && this.y <= this.bottom;
+  }
+
+  // scrollUp moves the lines from top to the bottom of the scroll region
+  // up n. Those scrolled off the top of the normal screen go into the
+  // scrollback, unless they were deleted.
+  scrollUp(n, top = this.top, keep = true) {
+    for (let i = 0; i < n; i++) {
+      const [line] = this.lines.splice(top, 1);
+      if (keep && top === 0 && !this.alt) this.scrolledOff(line);
+      this.lines.splice(this.bottom, 0, this.blankLine(this.erasePen()));
+    }
+  }
+
+  scrollDown(n, top = this.top) {
+    for (let i = 0; i < n; i++) {
+      this.lines.splice(this.bottom, 1);
+      this.lines.splice(top, 0, this.blankLine(this.erasePen()));
+    }
+  }
+
+  eraseDisplay(mode) {
+    if (mode === 0) {
+      this.eraseLine(0);
+      for (let y = this.y + 1; y < this.rows; y++) this.fill(y, 0, this.cols);
+    } else if (mode === 1) {
+      this.eraseLine(1);
+      for (let y = 0; y < this.y; y++) this.fill(y, 0, this.cols);
+    } else if (mode === 2) {
+      for (let y = 0; y < this.rows; y++) this.fill(y, 0, this.cols);
+    } else if (mode === 3) {
+      this.history.textContent = "";
+    }
+  }
+
+  eraseLine(mode) {
+    if (mode === 0) this.fill(this.y, this.x, this.cols);
+    else if (mode === 1) this.fill(this.y, 0, this.x + 1);
+    else this.fill(this.y, 0, this.cols);
+  }
+
+  insertChars(n) {
+    const line = this.lines[this.y];
+    line.splice(this.x, 0, ...Array.from({ length: n }, () => this.blankCell(this.erasePen())));
+    line.length = this.cols;
+  }
+
+  deleteChars(n) {
+    const line = this.lines[this.y];
+    line.splice(this.x, n);
+    while (line.length < this.cols) line.push(this.blankCell(this.erasePen()));
+  }
+
+  fill(y, from, to) {
+    const pen = this.erasePen();
+    for (let x = from; x < to; x++) this.lines[y][x] = this.blankCell(pen);
+  }
+
+  // erasePen is what erased cells are drawn with: the current background.
+  erasePen() {
+    return this.pen.bg ? Object.freeze({ ...defaultPen, bg: this.pen.bg }) : defaultPen;
+  }
+
+  blankCell(pen) {
+    return { ch: " ", pen };
+  }
+
+  blankLine(pen) {
+    return Array.from({ length: this.cols }, () => this.blankCell(pen));
+  }
+
+  blankLines(n) {
+    return Array.from({ length: n }, () => this.blankLine(defaultPen));
+  }
+
+  saveCursor() {
+    this.saved = { x: this.x, y: this.y, pen: this.pen };
+  }
+
+  restoreCursor() {
+    if (!this.saved) return;
+    this.moveTo(this.saved.x, this.saved.y);
+    this.pen = this.saved.pen;
+  }
+
+  scrolledOff(line) {
+    const div = this.history.appendChild(document.createElement("div"));
+    div.innerHTML = this.lineHTML(line, -1) || " ";
+    if (this.history.childElementCount > maxScrollback) this.history.firstChild.remove();
+  }
+
+  // redraw renders the screen on the next frame, keeping the view at the
+  // bottom unless the user scrolled up.
+  redraw() {
+    if (this.frame) return;
+    this.frame = requestAnimationFrame(() => {
+      this.frame = 0;
+      const el = this.el;
+      const atBottom = el.scrollTop + el.clientHeight >= el.scrollHeight - 4;
+      const cursor = this.modes.cursor ? this.x : -1;
+      this.screen.innerHTML = this.lines.map((line, y) => this.lineHTML(line, y === this.y ? cursor : -1)).join("\n");
+      if (atBottom) el.scrollTop = el.scrollHeight;
+    });
+  }
+
+  // lineHTML renders a line as runs of spans, with the cursor at column
+  // cursor if it is on the line.
+  lineHTML(line, cursor) {
+    let html = "";
+    for (let x = 0; x < line.length; ) {
+      const pen = line[x].pen;
+      let text = "";
+      let end = x;
+      while (end < line.length && line[end].pen === pen && end !== cursor) text += line[end++].ch;
+      if (end === x) text = line[end++].ch;
+      html += `<span${this.style(pen, x === cursor)}>${escapeHTML(text)}</span>`;
+      x = end;
+    }
+    return html;
+  }
+
+  style(pen, cursor) {
+    let fg = pen.fg;
+    let bg = pen.bg;
+    if (pen.inverse !== cursor) [fg, bg] = [bg || "var(--bg)", fg || "var(--fg)"];
+    const css = [];
+    if (fg) css.push(`color:${fg}`);
+    if (bg) css.push(`background:${bg}`);
+    if (pen.bold) css.push("font-weight:bold");
+    if (pen.italic) css.push("font-style:italic");
+    if (pen.underline) css.push("text-decoration:underline");
+    const cls = cursor ? ' class="cursor"' : "";
+    return css.length ? `${cls} style="${css.join(";")}"` : cls;
+  }
+
+  keydown(e) {
+    if (e.isComposing || e.metaKey) return;
+    let data;
+    if (cursorKeys[e.key]) {
+      data = (this.modes.appCursor ? "\x1bO" : "\x1b[") + cursorKeys[e.key];
+    } else if (keys[e.key]) {
+      data = e.shiftKey && e.key === "Tab" ? "\x1b[Z" : keys[e.key];
+    } else if (e.ctrlKey && !e.altKey && e.key.length === 1) {
+      // Leave Ctrl-C to copy a selection, and Ctrl-Shift combinations to
+      // the browser.
+      if (e.shiftKey || (e.key === "c" && String(window.getSelection()))) return;
+      const code = e.key.toUpperCase().charCodeAt(0);
+      if (code >= 0x40 && code <= 0x5f) data = String.fromCharCode(code & 0x1f);
+      else if (e.key === " ") data = "\x00";
+    } else if (e.key.length === 1 || [...e.key].length === 1) {
+      data = (e.altKey ? "\x1b" : "") + e.key;
+    }
+    if (data === undefined) return;
+    e.preventDefault();
+    this.el.scrollTop = this.el.scrollHeight;
+    this.send(data);
+  }
+
+  paste(text) {
+    text = text.replace(/\r?\n/g, "\r");
+    this.send(this.modes.bracketedPaste ? `\x1b[200~${text}\x1b[201~` : text);
+  }
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTermPage(t *testing.T) {
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get(testURL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+	_, page := get("/term")
+	if !strings.Contains(page, `<script src="/term/term.js">`) {
+		t.Error("the page doesn't load its terminal from the binary")
+	}
+	if strings.Contains(page, "https://") {
+		t.Error("the page loads something from elsewhere")
+	}
+	resp, script := get("/term/term.js")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "javascript") ||
+		!strings.Contains(script, "class Terminal") {
+		t.Errorf("GET /term/term.js: %d %q, %d bytes", resp.StatusCode, resp.Header.Get("Content-Type"), len(script))
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The workspace file, /data/.do-s3/workspace.json, declares what a
+// workspace needs running around it: variables for its shells and services,
+// services to supervise, the ports its servers listen on, and further
+// buckets to mount. It travels with the bucket, so a workspace restored
+// anywhere comes up the same. It is read at boot, once the bucket is
+// mounted after a degraded start, and on SIGHUP or POST
+// /v1/workspace/reload. It is JSON, like the config: the server reads
+// everything with the standard library, which has no YAML parser.
+
+const (
+	// workspaceFilePath is where the workspace file is, relative to dataDir.
+	workspaceFilePath = ".do-s3/workspace.json"
+	// maxWorkspaceFile bounds its size.
+	maxWorkspaceFile = 1 << 20
+)
+
+// extraMountRoot is where the workspace file's mounts go, each in a
+// directory of its name.
+var extraMountRoot = "/mnt"
+
+var errInvalidWorkspaceFile = errors.New("invalid workspace file")
+
+// validWorkspaceName is the form of the names of the workspace file's
+// services, ports and mounts.
+var validWorkspaceName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]{0,62}$`)
+
+// workspaceSpec is the workspace file.
+type workspaceSpec struct {
+	// Env is set for every session and for the file's services.
+	Env map[string]string `json:"env,omitempty"`
+	// EnvProfiles are further sets of variables, by name, that services
+	// opt into with env_profile.
+	EnvProfiles map[string]map[string]string `json:"env_profiles,omitempty"`
+	// Services are supervised as those of the services config are. One
+	// the config also names is left to the config.
+	Services map[string]workspaceService `json:"services,omitempty"`
+	// Ports name the ports the workspace's servers listen on, which
+	// /proxy/{name}/ then reaches.
+	Ports map[string]int `json:"ports,omitempty"`
+	// Mounts are parts of the workspace's bucket mounted at /mnt/{name}
+	// with its S3 endpoint and credentials.
+	Mounts map[string]workspaceMount `json:"mounts,omitempty"`
+}
+
+type workspaceService struct {
+	serviceSpec
+	// EnvProfile adds a profile's variables to the service's, which win.
+	EnvProfile string `json:"env_profile,omitempty"`
+}
+
+type workspaceMount struct {
+	// Bucket can only name the workspace's own, the default: the file
+	// can't reach other buckets with the workspace's credentials. Prefix is
+	// within the part of it the workspace is scoped to.
+	Bucket string `json:"bucket,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// workspaceStatus is the body of GET /v1/workspace.
+type workspaceStatus struct {
+	Path string `json:"path"`
+	// Found is whether the workspace has a workspace file; Loaded when it
+	// was last read, and Error why it couldn't be, in which case the spec
+	// read before that stays in effect.
+	Found  bool            `json:"found"`
+	Loaded time.Time       `json:"loaded,omitzero"`
+	Error  string          `json:"error,omitempty"`
+	Spec   *workspaceSpec  `json:"spec,omitempty"`
+	Ports  []workspacePort `json:"ports"`
+	Mounts []extraMount    `json:"mounts"`
+}
+
+type workspacePort struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+	// URL is the path the port is proxied at.
+	URL string `json:"url"`
+}
+
+// extraMount is one of the workspace file's mounts.
+type extraMount struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Source  string `json:"source"`
+	Mounted bool   `json:"mounted"`
+	PID     int    `json:"pid,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// workspaceState is the workspace file in effect.
+type workspaceState struct {
+	spec atomic.Pointer[workspaceSpec]
+
+	mu     sync.Mutex
+	opts   *mountOptions // the workspace's bucket, nil without one
+	found  bool
+	loaded time.Time
+	err    error
+	mounts map[string]*extraMount
+}
+
+var workspace = &workspaceState{mounts: make(map[string]*extraMount)}
+
+// current is the workspace file in effect, empty if there is none.
+func (w *workspaceState) current() *workspaceSpec {
+	if s := w.spec.Load(); s != nil {
+		return s
+	}
+	return &workspaceSpec{}
+}
+
+// loadWorkspace reads the workspace file at boot, or once the bucket opts
+// is mounted after a degraded start, and mounts what it asks for. The
+// services it declares start with the next services.sync.
+func loadWorkspace(opts *mountOptions) {
+	workspace.mu.Lock()
+	workspace.opts = opts
+	workspace.mu.Unlock()
+	if err := workspace.reload(); err != nil {
+		warnf("Ignoring the workspace file: %v", err)
+	}
+}
+
+// reload reads the workspace file again. A file that can't be read or
+// isn't valid is reported and leaves the one in effect alone; a file that
+// was removed clears it. Mounts the file no longer lists stay mounted.
+func (w *workspaceState) reload() error {
+	var bucket string
+	w.mu.Lock()
+	if w.opts != nil {
+		bucket = w.opts.bucket
+	}
+	w.mu.Unlock()
+	spec, found, err := readWorkspaceFile(filepath.Join(dataDir, workspaceFilePath), bucket)
+	w.mu.Lock()
+	w.loaded, w.err = time.Now().UTC(), err
+	if err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	w.found = found
+	w.spec.Store(spec)
+	var added []*extraMount
+	for _, name := range slices.Sorted(maps.Keys(spec.Mounts)) {
+		if _, ok := w.mounts[name]; !ok {
+			em := &extraMount{Name: name, Path: filepath.Join(extraMountRoot, name)}
+			w.mounts[name] = em
+			added = append(added, em)
+		}
+	}
+	opts := w.opts
+	w.mu.Unlock()
+	if found {
+		infof("Workspace file loaded: %d services, %d ports, %d mounts", len(spec.Services), len(spec.Ports), len(spec.Mounts))
+	}
+	for _, em := range added {
+		w.mount(opts, em, spec.Mounts[em.Name])
+	}
+	return nil
+}
+
+// readWorkspaceFile reads and validates the workspace file at p, for a
+// workspace in bucket. A missing file is an empty spec, unless a YAML one
+// was written in its place, which is refused rather than quietly ignored.
+func readWorkspaceFile(p, bucket string) (*workspaceSpec, bool, error) {
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		for _, ext := range []string{".yaml", ".yml"} {
+			yml := strings.TrimSuffix(p, ".json") + ext
+			if _, err := os.Stat(yml); err == nil {
+				return nil, true, fmt.Errorf("%w: %s is not read: the workspace file is JSON, in %s", errInvalidWorkspaceFile, filepath.Base(yml), workspaceFilePath)
+			}
+		}
+		return &workspaceSpec{}, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	var spec workspaceSpec
+	dec := json.NewDecoder(io.LimitReader(f, maxWorkspaceFile))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		return nil, true, fmt.Errorf("%w: %s: %v", errInvalidWorkspaceFile, workspaceFilePath, err)
+	}
+	if err := spec.validate(bucket); err != nil {
+		return nil, true, fmt.Errorf("%w: %s: %v", errInvalidWorkspaceFile, workspaceFilePath, err)
+	}
+	return &spec, true, nil
+}
+
+func (s *workspaceSpec) validate(bucket string) error {
+	var errs []error
+	checkEnv := func(where string, env map[string]string) {
+		for k, v := range env {
+			if err := checkEnvVar(k, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", where, err))
+			}
+		}
+	}
+	checkEnv("env", s.Env)
+	for name, env := range s.EnvProfiles {
+		checkEnv("env_profiles: "+name, env)
+	}
+	for name, svc := range s.Services {
+		switch {
+		case !validWorkspaceName.MatchString(name):
+			errs = append(errs, fmt.Errorf("services: %q is not a valid name", name))
+		case len(svc.Argv) == 0:
+			errs = append(errs, fmt.Errorf("services: %q has no argv", name))
+		case svc.TTY && svc.Stdin:
+			errs = append(errs, fmt.Errorf("services: %q: stdin only applies without tty", name))
+		}
+		if _, err := resolvePath(svc.Cwd); err != nil {
+			errs = append(errs, fmt.Errorf("services: %q: %v", name, err))
+		}
+		if _, ok := s.EnvProfiles[svc.EnvProfile]; svc.EnvProfile != "" && !ok {
+			errs = append(errs, fmt.Errorf("services: %q: no env profile %q", name, svc.EnvProfile))
+		}
+	}
+	for name, port := range s.Ports {
+		if !validWorkspaceName.MatchString(name) {
+			errs = append(errs, fmt.Errorf("ports: %q is not a valid name", name))
+		}
+		if port <= 0 || port > 65535 {
+			errs = append(errs, fmt.Errorf("ports: %q: %d is not a port", name, port))
+		}
+	}
+	for name, m := range s.Mounts {
+		if !validWorkspaceName.MatchString(name) {
+			errs = append(errs, fmt.Errorf("mounts: %q is not a valid name", name))
+		}
+		if p := m.Prefix; p != "" && (p[0] == '/' || !strings.HasSuffix(p, "/") || path.Clean(p)+"/" != p || strings.HasPrefix(p, "../")) {
+			errs = append(errs, fmt.Errorf("mounts: %q: prefix %q must be a clean relative path within the workspace, ending in /", name, p))
+		}
+		if m.Bucket != "" && m.Bucket != bucket {
+			errs = append(errs, fmt.Errorf("mounts: %q: bucket %q is not the workspace's; only parts of its own can be mounted", name, m.Bucket))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// services returns the file's services as the service manager runs them,
+// with the workspace's variables and their profile's added.
+func (s *workspaceSpec) services() map[string]serviceSpec {
+	out := make(map[string]serviceSpec, len(s.Services))
+	for name, svc := range s.Services {
+		spec := svc.serviceSpec
+		spec.Env = make(map[string]string)
+		maps.Copy(spec.Env, s.Env)
+		maps.Copy(spec.Env, s.EnvProfiles[svc.EnvProfile])
+		maps.Copy(spec.Env, svc.Env)
+		out[name] = spec
+	}
+	return out
+}
+
+// env returns the variables the file sets for sessions, as NAME=value.
+func (s *workspaceSpec) env() []string {
+	var env []string
+	for _, k := range slices.Sorted(maps.Keys(s.Env)) {
+		env = append(env, k+"="+s.Env[k])
+	}
+	return env
+}
+
+// mount mounts m at em.Path, or takes over a tigrisfs already serving it
+// there, as reuseMount does for /data. It returns once the mount is up or
+// has failed; tigrisfs exiting later is recorded rather than fatal, as
+// /data doesn't depend on it.
+func (w *workspaceState) mount(opts *mountOptions, em *extraMount, m workspaceMount) {
+	if opts == nil || !mountReady.Load() {
+		w.mu.Lock()
+		em.Error = "no bucket is mounted"
+		w.mu.Unlock()
+		return
+	}
+	o := *opts
+	o.prefix += m.Prefix
+	var exited chan error
+	pid := o.findMountProcess("/proc", em.Path)
+	if pid != 0 && servesFUSE(pid) && isFUSEMount(em.Path, mountCheckTimeout) {
+		infof("Reusing the mount of %s at %s (tigrisfs pid %d)", o.source(), em.Path, pid)
+	} else {
+		pid, exited = 0, make(chan error, 1)
+	}
+	var err error
+	if exited != nil {
+		pid, err = startExtraMount(o, em.Path, exited)
+	}
+	w.mu.Lock()
+	em.Source, em.Mounted, em.PID = o.source(), err == nil, pid
+	if err != nil {
+		em.Error = err.Error()
+	}
+	w.mu.Unlock()
+	switch {
+	case err != nil:
+		warnf("Mounting %s at %s: %v", o.source(), em.Path, err)
+	case exited != nil:
+		go func() {
+			err := <-exited
+			warnf("tigrisfs for %s exited: %v", em.Path, err)
+			w.mu.Lock()
+			em.Mounted, em.PID, em.Error = false, 0, fmt.Sprintf("tigrisfs exited: %v", err)
+			w.mu.Unlock()
+		}()
+	}
+}
+
+// startExtraMount starts tigrisfs mounting o at dir and waits for the
+// mount. Once it is up, how tigrisfs exits is sent on exited.
+func startExtraMount(o mountOptions, dir string, exited chan<- error) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	cmd := o.command(dir)
+	cmd.Stdout = &mountLogWriter{w: os.Stdout, uncounted: true}
+	cmd.Stderr = &mountLogWriter{w: os.Stderr, uncounted: true}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("starting tigrisfs: %w", err)
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- cmd.Wait() }()
+	ready := make(chan error, 1)
+	go func() { ready <- waitForMount(dir, 10*time.Second) }()
+	select {
+	case err := <-waited:
+		return 0, fmt.Errorf("tigrisfs exited before mounting: %v", err)
+	case err := <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			<-waited
+			return 0, err
+		}
+	}
+	go func() { exited <- <-waited }()
+	return cmd.Process.Pid, nil
+}
+
+// portByName returns the port the workspace file names name, or 0.
+func (w *workspaceState) portByName(name string) int {
+	return w.current().Ports[name]
+}
+
+func (w *workspaceState) status() workspaceStatus {
+	spec := w.current()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := workspaceStatus{Path: filepath.Join(dataDir, workspaceFilePath), Found: w.found, Loaded: w.loaded,
+		Ports: []workspacePort{}, Mounts: []extraMount{}}
+	if w.found {
+		st.Spec = spec
+	}
+	if w.err != nil {
+		st.Error = w.err.Error()
+	}
+	for _, name := range slices.Sorted(maps.Keys(spec.Ports)) {
+		st.Ports = append(st.Ports, workspacePort{Name: name, Port: spec.Ports[name], URL: "/proxy/" + name + "/"})
+	}
+	for _, name := range slices.Sorted(maps.Keys(w.mounts)) {
+		st.Mounts = append(st.Mounts, *w.mounts[name])
+	}
+	return st
+}
+
+func handleGetWorkspace(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, workspace.status())
+}
+
+func handleReloadWorkspace(w http.ResponseWriter, r *http.Request) {
+	if err := workspace.reload(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	services.sync()
+	writeJSON(w, http.StatusOK, workspace.status())
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWorkspaceFile(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "app at %s", r.URL.Path)
+	}))
+	defer app.Close()
+	appURL, _ := url.Parse(app.URL)
+	file := filepath.Join(dataDir, workspaceFilePath)
+	os.MkdirAll(filepath.Dir(file), 0755)
+	t.Cleanup(func() {
+		os.RemoveAll(filepath.Dir(file))
+		workspace.reload()
+		services.sync()
+		workspace.mu.Lock()
+		delete(workspace.mounts, "shared")
+		workspace.mu.Unlock()
+	})
+	reload := func() *http.Response {
+		t.Helper()
+		resp, err := http.Post(testURL+"/v1/workspace/reload", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	os.WriteFile(file, []byte(`{
+		"env": {"WS_MODE": "dev"},
+		"env_profiles": {"test": {"WS_MODE": "test", "WS_PROFILE": "yes"}},
+		"services": {"ws-sleeper": {"argv": ["sleep", "30"], "env_profile": "test"}},
+		"ports": {"app": `+appURL.Port()+`},
+		"mounts": {"shared": {"prefix": "shared/"}}
+	}`), 0644)
+	resp := reload()
+	var st workspaceStatus
+	json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !st.Found || len(st.Ports) != 1 || st.Ports[0].URL != "/proxy/app/" {
+		t.Fatalf("reload: %d %+v", resp.StatusCode, st)
+	}
+	// Without a bucket there is nothing to mount from.
+	if len(st.Mounts) != 1 || st.Mounts[0].Mounted || st.Mounts[0].Error == "" {
+		t.Errorf("mounts %+v", st.Mounts)
+	}
+
+	svc := services.get("ws-sleeper")
+	if svc == nil {
+		t.Fatal("the workspace file's service isn't running")
+	}
+	if env := svc.spec.Env; env["WS_MODE"] != "test" || env["WS_PROFILE"] != "yes" {
+		t.Errorf("service environment %v", env)
+	}
+	sess, err := sessions.start(80, 24, sessionMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	environ, _ := os.ReadFile(fmt.Sprintf("/proc/%d/environ", sess.cmd.Process.Pid))
+	if !strings.Contains(string(environ), "\x00WS_MODE=dev\x00") || strings.Contains(string(environ), "WS_PROFILE") {
+		t.Errorf("session environment %q", environ)
+	}
+
+	resp, err = http.Get(testURL + "/proxy/app/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "app at /hello" {
+		t.Errorf("proxy by name: %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := http.Get(testURL + "/proxy/nope/"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("proxy to an unnamed port: %d", resp.StatusCode)
+	}
+
+	// An invalid file is refused, and the one in effect stays.
+	os.WriteFile(file, []byte(`{"services": {"bad": {"argv": [], "env_profile": "none"}}}`), 0644)
+	resp = reload()
+	var p problem
+	json.NewDecoder(resp.Body).Decode(&p)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || p.Type != "urn:do-s3:problem:invalid-workspace-file" {
+		t.Errorf("invalid file: %d %+v", resp.StatusCode, p)
+	}
+	if services.get("ws-sleeper") == nil || workspace.current().Ports["app"] == 0 {
+		t.Error("an invalid workspace file replaced the one in effect")
+	}
+
+	// A YAML file isn't read, and says so.
+	os.Remove(file)
+	yml := filepath.Join(filepath.Dir(file), "workspace.yaml")
+	os.WriteFile(yml, []byte("ports:\n  app: 3000\n"), 0644)
+	resp = reload()
+	p = problem{}
+	json.NewDecoder(resp.Body).Decode(&p)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(p.Detail, "workspace.yaml is not read") {
+		t.Errorf("YAML file: %d %+v", resp.StatusCode, p)
+	}
+
+	os.Remove(yml)
+	reload().Body.Close()
+	if services.get("ws-sleeper") != nil {
+		t.Error("the service outlived the workspace file")
+	}
+}
+
+// TestWorkspaceMountScope checks that the workspace file can only mount
+// parts of the workspace's own bucket.
+func TestWorkspaceMountScope(t *testing.T) {
+	for _, tt := range []struct {
+		mount workspaceMount
+		ok    bool
+	}{
+		{workspaceMount{Prefix: "datasets/"}, true},
+		{workspaceMount{Bucket: "ws-bucket", Prefix: "datasets/"}, true},
+		{workspaceMount{Bucket: "team-assets"}, false},
+		{workspaceMount{Bucket: "team-assets", Prefix: "datasets/"}, false},
+		{workspaceMount{Prefix: "../other/"}, false},
+	} {
+		spec := workspaceSpec{Mounts: map[string]workspaceMount{"m": tt.mount}}
+		if err := spec.validate("ws-bucket"); (err == nil) != tt.ok {
+			t.Errorf("%+v: %v, want ok %v", tt.mount, err, tt.ok)
+		}
+	}
+}
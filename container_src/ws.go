@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: checkOrigin,
+}
+
+// maxWSMessage caps a single inbound WebSocket message; input is typed or
+// pasted text and control messages are small JSON objects.
+const maxWSMessage = maxInputBody
+
+type resizeMessage struct {
+	Type string `json:"type"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+// sessionMessage tells a control client which session it is connected to,
+// for reclaiming it after an upgrade.
+type sessionMessage struct {
+	Type string `json:"type"` // "session"
+	ID   string `json:"id"`
+}
+
+// wsConn serializes writes from the output and ping goroutines.
+type wsConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *wsConn) write(msgType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.WriteMessage(msgType, data)
+}
+
+func (c *wsConn) control(msgType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.WriteControl(msgType, data, time.Now().Add(10*time.Second))
+}
+
+// protocolError closes ws after a message that violates the protocol.
+func (c *wsConn) protocolError(reason string) {
+	warnf("Closing WebSocket: %s", reason)
+	c.control(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, reason))
+}
+
+// clientMessage is a JSON control message from a /ws client: a resize, a
+// control key ({"type": "interrupt"}, "eof" or "suspend"), or a probe or
+// probe reply (see probeMessage).
+type clientMessage struct {
+	Type string `json:"type"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+	T    int64  `json:"t"`
+	// paste_confirm: the answer to the server's question with this ID.
+	ID     int  `json:"id"`
+	Accept bool `json:"accept"`
+	// input: sequenced input, applied unless it repeats input already
+	// applied from the same client (see inputDedup).
+	Client string `json:"client"`
+	Seq    int64  `json:"seq"`
+	Data   string `json:"data"`
+	// notify: passed back in the command_finished message.
+	Tag string `json:"tag"`
+	// approval: the approval request answered, with Accept (see
+	// approvalMessage).
+	Approval string `json:"approval"`
+	// input_control: what to do about control of the session's input,
+	// request, release, grant or revoke, and To whom it is granted.
+	Action string `json:"action"`
+	To     string `json:"to"`
+	// search: what to find in the session's transcript, answered by a
+	// search_results message with the same ID (see searchQuery).
+	Pattern    string `json:"pattern"`
+	Regex      bool   `json:"regex"`
+	IgnoreCase bool   `json:"ignore_case"`
+	Limit      int    `json:"limit"`
+}
+
+// inputAckMessage acknowledges sequenced input; Duplicate is set if it was
+// dropped as a retransmission.
+type inputAckMessage struct {
+	Type      string `json:"type"` // "input_ack"
+	Client    string `json:"client,omitempty"`
+	Seq       int64  `json:"seq"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// terminalTarget is what a /ws connection drives: the session it started,
+// or a service it attached to.
+type terminalTarget interface {
+	follow(ctx context.Context, off int64, send func(data []byte, next int64) error) error
+	write(p []byte) error
+	resize(cols, rows int) error
+	key(key string) error
+}
+
+// parseSize reads the cols/rows query params, defaulting to 80x24.
+func parseSize(r *http.Request) (cols, rows int, err error) {
+	cols = 80
+	rows = 24
+
+	if colsStr := r.URL.Query().Get("cols"); colsStr != "" {
+		if cols, err = strconv.Atoi(colsStr); err != nil {
+			return 0, 0, fmt.Errorf("%w: cols=%q", errInvalidSize, colsStr)
+		}
+	}
+	if rowsStr := r.URL.Query().Get("rows"); rowsStr != "" {
+		if rows, err = strconv.Atoi(rowsStr); err != nil {
+			return 0, 0, fmt.Errorf("%w: rows=%q", errInvalidSize, rowsStr)
+		}
+	}
+	return fitSize(cols, rows)
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Proxies that strip the Upgrade header leave EventSource clients here;
+	// serve them the SSE transport instead of failing the upgrade.
+	if !websocket.IsWebSocketUpgrade(r) && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		handleSSE(w, r)
+		return
+	}
+
+	cols, rows, err := parseSize(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// With ?control=1 output is sent as binary frames, which leaves text
+	// frames free for JSON control messages to the client. Without it,
+	// text frames are output, as older clients expect.
+	control := r.URL.Query().Get("control") == "1"
+	// ?confirm_paste=N holds input with N or more line breaks until the
+	// client confirms it, which needs control messages to ask.
+	var confirmLines int
+	if v := r.URL.Query().Get("confirm_paste"); v != "" {
+		if confirmLines, err = strconv.Atoi(v); err != nil || confirmLines < 1 {
+			httpError(w, r, fmt.Sprintf("invalid confirm_paste=%q: must be a positive number of lines", v), http.StatusBadRequest)
+			return
+		}
+		if !control {
+			httpError(w, r, "confirm_paste requires control=1", http.StatusBadRequest)
+			return
+		}
+	}
+	// ?service= attaches to a supervised service instead of starting a
+	// shell; the service keeps running after the connection closes.
+	var svc *service
+	if name := r.URL.Query().Get("service"); name != "" {
+		if userFromContext(r.Context()) != "" {
+			writeError(w, r, fmt.Errorf("service %s: %w", name, errUserScope))
+			return
+		}
+		if svc = services.get(name); svc == nil {
+			httpError(w, r, "service not found", http.StatusNotFound)
+			return
+		}
+	}
+	meta, err := sessionMetaFromQuery(r.URL.Query())
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// ?share= attaches to the session a share link is for, as its guest.
+	var guest *share
+	var shared *session
+	if token := r.URL.Query().Get("share"); token != "" && svc == nil {
+		var ok bool
+		if guest, shared, ok = shares.resolve(token); !ok {
+			httpError(w, r, "share link expired or revoked", http.StatusForbidden)
+			return
+		}
+	}
+
+	// ?resumable=1 keeps the session for the client to resume if the
+	// connection drops, and ?offset= resumes its output (see resume.go).
+	resumable := r.URL.Query().Get("resumable") == "1" && svc == nil && guest == nil
+	from, err := parseResumeOffset(r.URL.Query())
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// ?session= reclaims a session this connection's client started before
+	// a binary upgrade, or lost the connection to.
+	var reclaimed *session
+	if id := r.URL.Query().Get("session"); id != "" && svc == nil && guest == nil {
+		if reclaimed = sessions.reclaim(id, userFromContext(r.Context())); reclaimed == nil {
+			writeError(w, r, fmt.Errorf("no session to reclaim: %w", errSessionNotFound))
+			return
+		}
+	}
+
+	if svc == nil && reclaimed == nil && guest == nil && sessions.full() {
+		writeError(w, r, errTooManySessions)
+		return
+	}
+
+	// Upgrade to WebSocket
+	raw, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		warnf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	ws := &wsConn{Conn: raw}
+	defer ws.Close()
+	// Oversized messages fail the read and gorilla closes with 1009. The
+	// limit admits pasted files; text messages are held to maxWSMessage.
+	ws.SetReadLimit(maxPasteFile + maxWSMessage)
+
+	var sess *session
+	var target terminalTarget
+	if svc != nil {
+		// Like a reclaimed session, a service keeps its size unless the
+		// client reports one.
+		if q := r.URL.Query(); !q.Has("cols") && !q.Has("rows") {
+			cols, rows = 0, 0
+		}
+		if err := svc.restoreSize(cols, rows); err != nil {
+			warnf("Failed to resize service %s: %v", svc.name, err)
+		}
+		target = svc
+	} else if guest != nil {
+		// The session is its owner's: it outlives the guest leaving.
+		sess = shared
+		target = guestTarget{session: sess, observe: guest.info.Mode == shareObserve}
+		shareConnections.add(1, "mode", guest.info.Mode)
+		infof("Guest attached to session %s with share %s (%s)", sess.id, guest.info.ID, guest.info.Mode)
+	} else if reclaimed != nil {
+		sess = reclaimed
+		// Without a size from the client, the session keeps the one it had.
+		if q := r.URL.Query(); !q.Has("cols") && !q.Has("rows") {
+			cols, rows = 0, 0
+		}
+		if err := sess.restoreSize(cols, rows); err != nil {
+			warnf("Failed to resize session %s: %v", sess.id, err)
+		}
+		target = sess
+	} else {
+		sess, err = sessions.startFor(r.Context(), cols, rows, meta)
+		if err != nil {
+			warnf("Failed to start session: %v (request %s)", err, requestID(r))
+			code := websocket.CloseInternalServerErr
+			if c := errorCode(err).CloseCode(); c != 0 {
+				code = c
+			}
+			ws.control(websocket.CloseMessage, websocket.FormatCloseMessage(code, err.Error()))
+			return
+		}
+		target = sess
+	}
+	// The session's input policy decides whether this connection's input
+	// goes through (see floor.go).
+	var participant string
+	if sess != nil {
+		participant = randomID()[:8]
+		defer sess.floor.join(floorParticipant{ID: participant, Name: r.URL.Query().Get("display_name"),
+			Host: guest == nil, Observer: guest != nil && guest.info.Mode == shareObserve})()
+		target = floorTarget{terminalTarget: target, floor: &sess.floor, id: participant}
+	}
+	// clientClosed is set when the client ends the connection itself.
+	var clientClosed bool
+	if sess != nil && guest == nil {
+		// A WebSocket session lives exactly as long as its connection,
+		// unless it can be resumed.
+		if resumable {
+			rs := sess.attachStream(func() {
+				ws.control(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "resumed by another connection"))
+				ws.SetReadDeadline(time.Now())
+			})
+			defer func() { sess.detachStream(rs, clientClosed) }()
+		} else {
+			defer sess.close()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	link := &linkQuality{}
+	ctx = withLinkQuality(ctx, link)
+
+	outputType := websocket.TextMessage
+	if control {
+		outputType = websocket.BinaryMessage
+	}
+	// meter counts traffic on /ws, and against the session if it's one's.
+	meter := func(kind, dir string, n int) {
+		meterTraffic("/ws", kind, dir, n)
+		if sess != nil {
+			sess.meterTraffic(kind, dir, n)
+		}
+	}
+	sendControl := func(v any) {
+		if !control {
+			return
+		}
+		if data, err := json.Marshal(v); err == nil && ws.write(websocket.TextMessage, data) == nil {
+			meter(trafficControl, "out", len(data))
+		}
+	}
+
+	hello := newHello(r)
+	if sess != nil {
+		hello.Session, hello.Shell = sess.id, sess.cmd.Path
+		if guest != nil {
+			hello.Share = guest.info.Mode
+		}
+	} else {
+		hello.Service = svc.name
+	}
+	sendControl(hello)
+	if sess != nil {
+		sendControl(sessionMessage{Type: "session", ID: sess.id})
+	}
+	if sess != nil && guest == nil {
+		var gap bool
+		from, gap = sess.resumeAt(from)
+		sendControl(streamMessage{Type: "stream", Session: sess.id, Offset: from, Gap: gap,
+			InputSeq: sess.dedup.last(r.URL.Query().Get("client")), Resumable: resumable})
+	} else {
+		from = 0
+	}
+	go announceShutdown(ctx, ws, func(n shutdownNotice) { sendControl(n) })
+	if control {
+		go durability.follow(ctx, func(m durabilityMessage) error { sendControl(m); return nil })
+		if sess != nil {
+			go sess.followPrompt(ctx, func(m promptMessage) { sendControl(m) })
+			go sess.followFloor(ctx, participant, func(m inputControlMessage) { sendControl(m) })
+			if guest == nil {
+				go approvals.follow(ctx, sess.user, func(m approvalMessage) { sendControl(m) })
+			}
+			sess.followAlerts(ctx, func(m alertMessage) { sendControl(m) })
+		}
+	}
+
+	input := target.write
+	var dedup *inputDedup
+	if sess != nil {
+		dedup = &sess.dedup
+	} else {
+		dedup = &svc.dedup
+	}
+	// notifying is set while a notify request waits for its command.
+	var notifying atomic.Bool
+	var pastes *pasteGuard
+	if confirmLines > 0 {
+		pastes = newPasteGuard(confirmLines, target.write, func(q pasteConfirm) { sendControl(q) })
+		defer pastes.stop()
+		input = pastes.input
+	}
+
+	// Set up pong handler. Pongs echo the ping's timestamp, which gives the
+	// round-trip time, and the deadline adapts to the link and to config
+	// reloads.
+	ws.SetReadDeadline(link.deadline())
+	ws.SetPongHandler(func(payload string) error {
+		if report, ok := link.pong(payload); ok {
+			sendControl(report)
+		}
+		ws.SetReadDeadline(link.deadline())
+		return nil
+	})
+
+	// Ping to keep the connection alive. Probes, for clients that answer
+	// them, measure the round trip through the client application, not
+	// just its WebSocket stack, and far more often than pings.
+	go func() {
+		var probe func(probeMessage)
+		if control {
+			probe = func(m probeMessage) { sendControl(m) }
+		}
+		if err := keepalive(ctx, ws, link, probe); err != nil {
+			warnf("Ping error: %v", err)
+		}
+	}()
+
+	// A guest is let go when the link lapses or is revoked.
+	if guest != nil {
+		go func() {
+			if guest.wait(ctx) {
+				ws.control(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "share link expired or revoked"))
+				ws.SetReadDeadline(time.Now())
+			}
+		}()
+	}
+
+	// PTY -> WebSocket (read from PTY, send to browser). Observers are
+	// sent repaints of the screen instead, unless they ask with ?screen=0
+	// for every byte.
+	go func() {
+		send := func(data []byte) error {
+			if err := ws.write(outputType, data); err != nil {
+				return err
+			}
+			meter(trafficTerminal, "out", len(data))
+			return nil
+		}
+		var err error
+		if guest != nil && guest.info.Mode == shareObserve && r.URL.Query().Get("screen") != "0" {
+			err = followScreen(ctx, sess, send, func(cols, rows int) {
+				sendControl(screenSizeMessage{Type: "screen_size", Cols: cols, Rows: rows})
+			})
+		} else {
+			err = target.follow(ctx, from, func(data []byte, _ int64) error { return send(data) })
+		}
+		if err == nil {
+			// The shell exited (or the service was removed); tell the client
+			// rather than leaving it attached to a dead session.
+			reason := "session ended"
+			if svc != nil {
+				reason = "service removed"
+			}
+			ws.control(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		} else if ctx.Err() == nil {
+			warnf("WebSocket write error: %v", err)
+		}
+		cancel()
+	}()
+
+	// WebSocket -> PTY (read from browser, write to PTY)
+	for {
+		msgType, data, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure) {
+				warnf("WebSocket read error: %v", err)
+			}
+			clientClosed = websocket.IsCloseError(err, websocket.CloseNormalClosure)
+			break
+		}
+		// Anything from the client shows the link is alive.
+		ws.SetReadDeadline(link.deadline())
+
+		if msgType == websocket.BinaryMessage {
+			meter(trafficFile, "in", len(data))
+			h, body, err := parsePasteMessage(data)
+			if err != nil {
+				ws.protocolError(err.Error())
+				break
+			}
+			if len(body) > maxPasteFile {
+				ws.control(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "pasted file too large"))
+				break
+			}
+			if sess == nil {
+				warnf("Ignoring file pasted into service %s", svc.name)
+				continue
+			}
+			if !sess.floor.mayWrite(participant) {
+				continue
+			}
+			dir, err := pasteDir(r)
+			if err != nil {
+				warnf("Refusing file pasted into session %s: %v", sess.id, err)
+				continue
+			}
+			if _, err := sess.pasteFile(dir, h, body); err != nil {
+				warnf("Failed to save pasted file: %v", err)
+			}
+			continue
+		}
+		if len(data) > maxWSMessage {
+			ws.control(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseMessageTooBig, ""))
+			break
+		}
+
+		// Check if it's a control message. Probes are only recognised from
+		// clients that asked for control messages.
+		if len(data) > 0 && data[0] == '{' {
+			var msg clientMessage
+			if err := json.Unmarshal(data, &msg); err == nil {
+				switch {
+				case msg.Type == "resize":
+					meter(trafficControl, "in", len(data))
+					if _, _, err := fitSize(msg.Cols, msg.Rows); err != nil {
+						ws.protocolError(err.Error())
+						return
+					}
+					if err := target.resize(msg.Cols, msg.Rows); err != nil {
+						ptyWarnf(err, "Failed to resize PTY: %v", err)
+					}
+					continue
+				case msg.Type == keyInterrupt, msg.Type == keyEOF, msg.Type == keySuspend:
+					meter(trafficControl, "in", len(data))
+					if err := target.key(msg.Type); err != nil {
+						ptyWarnf(err, "Failed to send %s: %v", msg.Type, err)
+					}
+					continue
+				case msg.Type == "paste_confirm" && pastes != nil:
+					meter(trafficControl, "in", len(data))
+					if err := pastes.confirm(msg.ID, msg.Accept); err != nil {
+						ptyWarnf(err, "PTY write error: %v", err)
+						return
+					}
+					continue
+				case control && msg.Type == "input":
+					meter(trafficTerminal, "in", len(data))
+					if msg.Seq < 1 {
+						ws.protocolError("input seq must be positive")
+						return
+					}
+					fresh := dedup.fresh(msg.Client, msg.Seq)
+					if fresh {
+						if err := input([]byte(msg.Data)); err != nil {
+							ptyWarnf(err, "PTY write error: %v", err)
+							return
+						}
+					}
+					sendControl(inputAckMessage{Type: "input_ack", Client: msg.Client, Seq: msg.Seq, Duplicate: !fresh})
+					continue
+				case control && msg.Type == "notify":
+					meter(trafficControl, "in", len(data))
+					if sess != nil && !notifying.Swap(true) {
+						go func() {
+							defer notifying.Store(false)
+							sess.notifyWhenFinished(ctx, msg.Tag, func(m commandFinishedMessage) {
+								sendControl(m)
+								notificationsSent.add(1, "via", "websocket")
+							})
+						}()
+					}
+					continue
+				case control && msg.Type == "approval":
+					meter(trafficControl, "in", len(data))
+					if sess != nil && guest == nil {
+						approvals.answer(msg.Approval, sess, msg.Accept)
+					}
+					continue
+				case control && msg.Type == "input_control":
+					meter(trafficControl, "in", len(data))
+					if sess != nil {
+						sess.floor.act(participant, msg.Action, msg.To)
+					}
+					continue
+				case control && msg.Type == "search":
+					meter(trafficControl, "in", len(data))
+					res := searchResults{Matches: []searchMatch{}}
+					if sess == nil {
+						res.Error = "services have no transcript"
+					} else if found, err := sess.transcript.search(searchQuery{Pattern: msg.Pattern, Regex: msg.Regex, IgnoreCase: msg.IgnoreCase, Limit: msg.Limit}); err != nil {
+						res.Error = err.Error()
+					} else {
+						res = found
+						transcriptSearches.add(1, "via", "websocket")
+					}
+					res.Type, res.ID = "search_results", msg.ID
+					sendControl(res)
+					continue
+				case control && msg.Type == "probe":
+					meter(trafficControl, "in", len(data))
+					sendControl(probeMessage{Type: "probe_ack", T: msg.T})
+					continue
+				case control && msg.Type == "probe_ack":
+					meter(trafficControl, "in", len(data))
+					if report, ok := link.probeAcked(msg.T); ok {
+						sendControl(report)
+					}
+					continue
+				}
+			}
+		}
+
+		// Regular input - write to PTY
+		meter(trafficTerminal, "in", len(data))
+		if err := input(data); err != nil {
+			ptyWarnf(err, "PTY write error: %v", err)
+			break
+		}
+	}
+}
@@ -1,9 +1,18 @@
 import { createRequestHandler } from "react-router";
 import { Container } from "@cloudflare/containers";
 import { S3 } from "./s3";
-import { signToken } from "./lib/jwt";
+import { signToken, verifyUserToken } from "./lib/jwt";
 export { S3 };
 
+declare global {
+  interface Env {
+    // Secrets shared with the container: user tokens are signed with
+    // USER_TOKEN_SECRET, and CONTROL_TOKEN is the operator's bearer token.
+    USER_TOKEN_SECRET?: string;
+    CONTROL_TOKEN?: string;
+  }
+}
+
 declare module "react-router" {
   export interface AppLoadContext {
     cloudflare: {
@@ -53,6 +62,34 @@ function getContainerEnv(request: Request): Record<string, string> {
   }
 }
 
+const problemTitles: Record<401 | 403, [string, string]> = {
+  401: ["unauthorized", "Unauthorized"],
+  403: ["forbidden", "Forbidden"],
+};
+
+// problem answers with an RFC 9457 problem, as the container does.
+function problem(
+  status: 401 | 403,
+  detail: string,
+  headers: Record<string, string> = {}
+): Response {
+  const [type, title] = problemTitles[status];
+  return Response.json(
+    { type: `urn:do-s3:problem:${type}`, title, status, detail },
+    {
+      status,
+      headers: { ...headers, "Content-Type": "application/problem+json" },
+    }
+  );
+}
+
+function timingSafeEqual(a: string, b: string): boolean {
+  const encoder = new TextEncoder();
+  const x = encoder.encode(a);
+  const y = encoder.encode(b);
+  return x.byteLength === y.byteLength && crypto.subtle.timingSafeEqual(x, y);
+}
+
 export class Terminal extends Container<Env> {
   // Port the container listens on (default: 8283)
   defaultPort = 8283;
@@ -100,6 +137,14 @@ class Worker {
     if (url.pathname.startsWith("/ws")) {
       return this.handleWebSocketRequest(request);
     }
+    // /v1/* is the container's REST API, including the SSE and long-poll
+    // fallback transports; /proxy/* reaches servers inside the workspace
+    if (
+      url.pathname.startsWith("/v1/") ||
+      url.pathname.startsWith("/proxy/")
+    ) {
+      return this.handleApiRequest(request);
+    }
 
     // Fallback to React Router
     return this.handleReactRouterRequest(request);
@@ -138,13 +183,63 @@ class Worker {
     }
   }
 
+  // The container serves requests without a user token unscoped, with
+  // access to the whole workspace, so the API is only forwarded with
+  // credentials the Worker has checked: a user token, which the container
+  // then scopes to the user's namespace, or the operator's CONTROL_TOKEN.
+  private async handleApiRequest(request: Request): Promise<Response> {
+    const { USER_TOKEN_SECRET, CONTROL_TOKEN } = this.env;
+    if (!USER_TOKEN_SECRET && !CONTROL_TOKEN) {
+      return problem(
+        403,
+        "API disabled: neither USER_TOKEN_SECRET nor CONTROL_TOKEN is set"
+      );
+    }
+    const bearer = request.headers
+      .get("Authorization")
+      ?.match(/^Bearer (.+)$/);
+    if (CONTROL_TOKEN && bearer && timingSafeEqual(bearer[1], CONTROL_TOKEN)) {
+      return this.handleWebSocketRequest(request);
+    }
+    const url = new URL(request.url);
+    // Browsers can't set headers on WebSocket upgrades.
+    const token =
+      request.headers.get("X-User-Token") ||
+      (request.headers.get("Upgrade")?.toLowerCase() === "websocket"
+        ? url.searchParams.get("user_token")
+        : null);
+    if (!token) {
+      return problem(401, "missing credentials", {
+        "WWW-Authenticate": "Bearer",
+      });
+    }
+    if (!USER_TOKEN_SECRET) {
+      return problem(403, "user tokens disabled: USER_TOKEN_SECRET not set");
+    }
+    try {
+      await verifyUserToken(token, USER_TOKEN_SECRET);
+    } catch (error) {
+      const reason = error instanceof Error ? error.message : String(error);
+      return problem(401, `invalid credentials: ${reason}`);
+    }
+    return this.handleWebSocketRequest(request);
+  }
+
   private createContainerRequest(request: Request, token: string): Request {
     // For some reason, in dev, the url host doesn't contain the port.
     const hostHeader = request.headers.get("host") || "localhost";
-    return setContainerEnv(request, {
+    const envVars: Record<string, string> = {
       S3_AUTH_TOKEN: token,
       HOST: hostHeader,
-    });
+    };
+    // The container verifies user tokens and the operator's token itself.
+    if (this.env.USER_TOKEN_SECRET) {
+      envVars.USER_TOKEN_SECRET = this.env.USER_TOKEN_SECRET;
+    }
+    if (this.env.CONTROL_TOKEN) {
+      envVars.CONTROL_TOKEN = this.env.CONTROL_TOKEN;
+    }
+    return setContainerEnv(request, envVars);
   }
 
   private async handleS3LogsWebSocket(request: Request): Promise<Response> {
@@ -180,6 +275,9 @@ export default {
   fetch: async (req: Request, env: Env, ctx: ExecutionContext) => {
     const startTime = Date.now();
     const url = new URL(req.url);
+    // WebSocket clients pass their user token in the query; keep it out of
+    // the logs.
+    url.searchParams.delete("user_token");
     const resp = await new Worker(env, ctx).fetch(req);
     const duration = Date.now() - startTime;
     console.log(
@@ -57,3 +57,22 @@ export async function verifyToken(
 
   throw new Error("Invalid token");
 }
+
+// Users a namespace can be named after, as the container accepts them.
+const validUser = /^[A-Za-z0-9._-]{1,64}$/;
+
+// verifyUserToken checks a user token, an HS256 JWT whose "user" claim
+// names the user, and returns the user.
+export async function verifyUserToken(
+  token: string,
+  secret: string
+): Promise<string> {
+  const secretKey = new TextEncoder().encode(secret);
+  const { payload } = await jwtVerify(token, secretKey, {
+    algorithms: ["HS256"],
+  });
+  if (typeof payload.user !== "string" || !validUser.test(payload.user)) {
+    throw new Error("Invalid user claim");
+  }
+  return payload.user;
+}